@@ -8,9 +8,19 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"distore/audit"
+	"distore/auth"
+	"distore/cluster"
+	"distore/config"
+	"distore/encryption"
+	"distore/quota"
+	"distore/replication"
 	"distore/storage"
 	"distore/testutils"
+
+	"github.com/gorilla/mux"
 )
 
 func TestAdminNodesHandlers(t *testing.T) {
@@ -111,3 +121,549 @@ func TestBackupRestoreHandlers(t *testing.T) {
 		t.Fatalf("expected restored b=2, got %s", v)
 	}
 }
+
+func TestEncryptedBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.EncryptionConfig{KMS: "local", MasterKeyFile: filepath.Join(dir, "master.json")}
+	kms, err := encryption.NewKMS(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, _ := encryption.OpenKeyring("", kms)
+	store := encryption.NewStorage(storage.NewMemoryStorage(), keyring)
+	_ = store.Set("a", "secret")
+	h := NewHandlers(store, testutils.NewMockReplicator([]string{}, 0), nil)
+	h.Encryption = encryption.NewRotator(store, cfg)
+
+	do := func(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("POST", "/", bytes.NewBufferString(body)))
+		return rr
+	}
+	bpath := filepath.Join(dir, "backup.json")
+	if rr := do(h.BackupHandler, `{"path":"`+bpath+`"}`); rr.Code != http.StatusOK {
+		t.Fatalf("backup status %d %s", rr.Code, rr.Body.String())
+	}
+	if data, _ := os.ReadFile(bpath); bytes.Contains(data, []byte("secret")) {
+		t.Errorf("Expected an encrypted backup file, got %s", data)
+	}
+
+	_ = store.Delete("a")
+	if rr := do(h.RestoreHandler, `{"path":"`+bpath+`"}`); rr.Code != http.StatusOK {
+		t.Fatalf("restore status %d %s", rr.Code, rr.Body.String())
+	}
+	if v, _ := store.Get("a"); v != "secret" {
+		t.Errorf("Expected restored a=secret, got %q", v)
+	}
+
+	// Without encryption the backup cannot be read
+	h.Encryption = nil
+	if rr := do(h.RestoreHandler, `{"path":"`+bpath+`"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an encrypted backup without encryption, got %d", rr.Code)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	for _, key := range []string{"t1:a", "t1:secret", "t2:c", "unscoped"} {
+		_ = store.Set(key, "v")
+	}
+	authService := auth.NewSimpleAuthService(3600)
+	h := NewHandlers(store, testutils.NewMockReplicator([]string{}, 0), authService)
+	policy, err := auth.NewAccessPolicy(config.AccessPolicyConfig{Rules: []config.PolicyRuleConfig{
+		{Subjects: []string{"role:read"}, Keys: []string{"secret*"}, Access: "read", Effect: "deny"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := auth.NewGuard(policy, nil)
+
+	router := mux.NewRouter()
+	router.Use(auth.AuthMiddleware(authService), guard.Tenant, guard.KeyAccess)
+	router.HandleFunc("/keys", h.GetAllHandler).Methods("GET")
+	router.HandleFunc("/get/{key}", h.GetHandler).Methods("GET")
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(guard.AdminScope("/admin/backup"))
+	admin.HandleFunc("/backup", h.BackupHandler).Methods("POST")
+	admin.HandleFunc("/nodes", h.ListNodesHandler).Methods("GET")
+
+	do := func(method, path, body string, tenant string, roles ...string) *httptest.ResponseRecorder {
+		token, _ := authService.GenerateToken("user", tenant, roles)
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	keysOf := func(rr *httptest.ResponseRecorder) map[string]bool {
+		var resp struct{ Items []storage.KeyValue }
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		keys := make(map[string]bool)
+		for _, item := range resp.Items {
+			keys[item.Key] = true
+		}
+		return keys
+	}
+
+	// Readers see their own tenant's keys, minus what the policy denies
+	if keys := keysOf(do("GET", "/keys", "", "t1", "read")); len(keys) != 1 || !keys["a"] {
+		t.Errorf("Expected only key a for t1, got %v", keys)
+	}
+	if rr := do("GET", "/get/secret", "", "t1", "read"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected denied key to answer 403, got %d", rr.Code)
+	}
+	if rr := do("GET", "/keys", "", auth.AllTenants, "read"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected all-tenants marker to need admin, got %d", rr.Code)
+	}
+	if keys := keysOf(do("GET", "/keys", "", auth.AllTenants, "admin")); len(keys) != 4 {
+		t.Errorf("Expected cluster admin to see all keys, got %v", keys)
+	}
+
+	// Tenant admins back up their own keys and cannot run cluster operations
+	if keys := keysOf(do("POST", "/admin/backup", `{}`, "t1", "admin")); len(keys) != 2 || !keys["secret"] {
+		t.Errorf("Expected t1 backup of a and secret, got %v", keys)
+	}
+	if rr := do("POST", "/admin/backup", `{"path": "/tmp/x.json"}`, "t1", "admin"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected server path backup to need a cluster admin, got %d", rr.Code)
+	}
+	if rr := do("GET", "/admin/nodes", "", "t1", "admin"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected cluster operation to need a cluster admin, got %d", rr.Code)
+	}
+	if rr := do("GET", "/admin/nodes", "", auth.AllTenants, "admin"); rr.Code != http.StatusOK {
+		t.Errorf("Expected cluster admin to list nodes, got %d", rr.Code)
+	}
+}
+
+func TestReadOnlyModeHandlers(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	mock := testutils.NewMockReplicator([]string{"n1"}, 1)
+	h := NewHandlers(store, mock, nil)
+	h.ReadOnly = cluster.NewReadOnlyManager(0)
+
+	// Force read-only
+	body, _ := json.Marshal(map[string]string{"mode": "read_only", "reason": "maintenance"})
+	req := httptest.NewRequest("POST", "/admin/readonly", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	h.SetReadOnlyHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("set read-only status %d", rr.Code)
+	}
+
+	// Writes are rejected with 503 and Retry-After
+	body, _ = json.Marshal(storage.KeyValue{Key: "k", Value: "v"})
+	req = httptest.NewRequest("POST", "/set", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	h.SetHandler(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 in read-only mode, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+	if _, err := store.Get("k"); err != storage.ErrKeyNotFound {
+		t.Fatal("value must not be stored in read-only mode")
+	}
+
+	// Read-only batches still work
+	body, _ = json.Marshal(map[string]interface{}{"operations": []map[string]string{{"Type": "get", "Key": "k"}}})
+	req = httptest.NewRequest("POST", "/advanced/batch", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	NewHandlers(storage.NewBatchStorage(store), mock, nil).BatchHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected read batch to pass, got %d", rr.Code)
+	}
+
+	// Clear the override
+	body, _ = json.Marshal(map[string]string{"mode": "auto"})
+	req = httptest.NewRequest("POST", "/admin/readonly", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	h.SetReadOnlyHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("clear read-only status %d", rr.Code)
+	}
+
+	body, _ = json.Marshal(storage.KeyValue{Key: "k", Value: "v"})
+	req = httptest.NewRequest("POST", "/set", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	h.SetHandler(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 after clearing read-only, got %d", rr.Code)
+	}
+
+	// Invalid mode
+	body, _ = json.Marshal(map[string]string{"mode": "sometimes"})
+	req = httptest.NewRequest("POST", "/admin/readonly", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	h.SetReadOnlyHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid mode, got %d", rr.Code)
+	}
+}
+
+func TestLifecycleHandlers(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	mock := testutils.NewMockReplicator([]string{"self:8080"}, 1)
+	h := NewHandlers(store, mock, nil)
+	rebalancer := cluster.NewRebalancer(store, mock, "self:8080")
+	h.Lifecycle = cluster.NewNodeLifecycle("self:8080", store, mock, rebalancer)
+
+	// A single node has nobody to hand its data to
+	req := httptest.NewRequest("POST", "/admin/lifecycle/decommission", nil)
+	rr := httptest.NewRecorder()
+	h.DecommissionHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without peers, got %d", rr.Code)
+	}
+
+	// Peers announce a joining node
+	body, _ := json.Marshal(cluster.MembershipEvent{Node: "n2:8080", State: cluster.MemberJoining})
+	req = httptest.NewRequest("POST", "/internal/membership", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	h.InternalMembershipHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("membership status %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(mock.GetNodes()) != 2 {
+		t.Fatalf("expected joining node to be added, got %v", mock.GetNodes())
+	}
+
+	body, _ = json.Marshal(map[string]string{"node": "unknown:1"})
+	req = httptest.NewRequest("POST", "/admin/lifecycle/replace", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	h.ReplaceNodeHandler(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown node, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/admin/lifecycle", nil)
+	rr = httptest.NewRecorder()
+	h.LifecycleStatusHandler(rr, req)
+	var status map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if status["state"] != string(cluster.LocalNodeNormal) {
+		t.Fatalf("expected normal state, got %v", status["state"])
+	}
+}
+
+func TestKeyspaceHandlers(t *testing.T) {
+	ttlStore := storage.NewTTLStorage(storage.NewMemoryStorage(), time.Minute)
+	store := storage.NewCASStorage(ttlStore)
+	mock := testutils.NewMockReplicator([]string{"n1", "n2"}, 1)
+	h := NewHandlers(store, mock, nil)
+	h.Keyspaces = replication.NewKeyspaceRegistry(nil)
+
+	// Invalid keyspace
+	body, _ := json.Marshal(map[string]interface{}{"prefixes": []string{"s:"}, "replication_factor": 0})
+	req := mux.SetURLVars(httptest.NewRequest("PUT", "/admin/keyspaces/sessions", bytes.NewReader(body)), map[string]string{"name": "sessions"})
+	rr := httptest.NewRecorder()
+	h.PutKeyspaceHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid keyspace, got %d", rr.Code)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{"prefixes": []string{"s:"}, "replication_factor": 2, "default_ttl": 60})
+	req = mux.SetURLVars(httptest.NewRequest("PUT", "/admin/keyspaces/sessions", bytes.NewReader(body)), map[string]string{"name": "sessions"})
+	rr = httptest.NewRecorder()
+	h.PutKeyspaceHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("put keyspace status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/admin/keyspaces/resolve?key=s:1", nil)
+	rr = httptest.NewRecorder()
+	h.ResolveKeyspaceHandler(rr, req)
+	var resolved struct {
+		Keyspace string   `json:"keyspace"`
+		Replicas []string `json:"replicas"`
+	}
+	json.NewDecoder(rr.Body).Decode(&resolved)
+	if resolved.Keyspace != "sessions" || len(resolved.Replicas) != 2 {
+		t.Fatalf("unexpected resolution %+v", resolved)
+	}
+
+	// Plain writes pick up the keyspace TTL
+	body, _ = json.Marshal(map[string]string{"key": "s:1", "value": "v"})
+	req = httptest.NewRequest("POST", "/set", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	h.SetHandler(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("set status %d", rr.Code)
+	}
+	if ttl, err := ttlStore.GetTTL("s:1"); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("expected keyspace TTL on key, got %v (%v)", ttl, err)
+	}
+
+	// Keys moved in by rebalance and repair batches keep their remaining TTL
+	items := []storage.KeyValue{{Key: "s:2", Value: "v", TTLMillis: 5000}, {Key: "s:3", Value: "v"}}
+	body, _ = json.Marshal(map[string]interface{}{"items": items})
+	req = httptest.NewRequest("POST", "/internal/batch_set", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	h.InternalBatchSetHandler(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("batch set status %d", rr.Code)
+	}
+	if ttl, err := ttlStore.GetTTL("s:2"); err != nil || ttl <= 0 || ttl > 5*time.Second {
+		t.Fatalf("expected remaining TTL on batch-moved key, got %v (%v)", ttl, err)
+	}
+	if ttl, err := ttlStore.GetTTL("s:3"); err != storage.ErrKeyNotFound {
+		t.Fatalf("expected no TTL on a batch-moved key without one, got %v (%v)", ttl, err)
+	}
+
+	req = mux.SetURLVars(httptest.NewRequest("DELETE", "/admin/keyspaces/sessions", nil), map[string]string{"name": "sessions"})
+	rr = httptest.NewRecorder()
+	h.DeleteKeyspaceHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("delete keyspace status %d", rr.Code)
+	}
+	if len(h.Keyspaces.List()) != 0 {
+		t.Fatal("keyspace should be deleted")
+	}
+}
+
+func TestTokenIssuance(t *testing.T) {
+	identities := auth.NewIdentities()
+	if _, err := identities.Bootstrap(config.AuthBootstrapConfig{Password: "bootstrap-password"}); err != nil {
+		t.Fatal(err)
+	}
+	issuer := auth.NewIssuer(auth.NewSimpleAuthService(3600), identities, time.Hour)
+	h := NewHandlers(storage.NewMemoryStorage(), testutils.NewMockReplicator([]string{}, 0), issuer)
+	h.Issuer = issuer
+
+	router := mux.NewRouter()
+	router.HandleFunc("/auth/token", h.TokenHandler).Methods("POST")
+	router.Handle("/auth/logout", auth.AuthMiddleware(issuer)(http.HandlerFunc(h.LogoutHandler))).Methods("POST")
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(auth.AuthMiddleware(issuer), auth.RBACMiddleware(auth.RoleAdmin))
+	admin.HandleFunc("/identities/{id}", h.PutIdentityHandler).Methods("PUT")
+	admin.HandleFunc("/identities/{id}/api_keys", h.CreateAPIKeyHandler).Methods("POST")
+
+	do := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func(body map[string]string) (auth.TokenPair, int) {
+		rr := do("POST", "/auth/token", "", body)
+		var pair auth.TokenPair
+		json.Unmarshal(rr.Body.Bytes(), &pair)
+		return pair, rr.Code
+	}
+
+	// Callers can no longer pick their own roles
+	if _, code := login(map[string]string{"user_id": "mallory", "tenant_id": "*"}); code != http.StatusBadRequest {
+		t.Errorf("Expected a request without grant_type to fail with 400, got %d", code)
+	}
+	if _, code := login(map[string]string{"grant_type": "password", "user_id": "admin", "password": "guess"}); code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to fail with 401, got %d", code)
+	}
+
+	adminPair, code := login(map[string]string{"grant_type": "password", "user_id": "admin", "password": "bootstrap-password"})
+	if code != http.StatusOK || adminPair.RefreshToken == "" {
+		t.Fatalf("Admin login failed: %d", code)
+	}
+	rr := do("PUT", "/admin/identities/etl", adminPair.Token, map[string]interface{}{"kind": "service", "tenant_id": "t1", "roles": []string{"write"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Creating a service account failed: %d %s", rr.Code, rr.Body.String())
+	}
+	var created struct {
+		Identity     auth.Identity `json:"identity"`
+		ClientSecret string        `json:"client_secret"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if created.ClientSecret == "" || created.Identity.SecretHash != "" {
+		t.Fatalf("Expected the generated secret and no hash, got %s", rr.Body.String())
+	}
+
+	etlPair, code := login(map[string]string{"grant_type": "client_credentials", "client_id": "etl", "client_secret": created.ClientSecret})
+	if code != http.StatusOK {
+		t.Fatalf("Client credentials grant failed: %d", code)
+	}
+	claims, err := issuer.ValidateToken(etlPair.Token)
+	if err != nil || claims.TenantID != "t1" || len(claims.Roles) != 1 || claims.Roles[0] != "write" {
+		t.Errorf("Expected the stored tenant and roles, got %+v, %v", claims, err)
+	}
+	if rr := do("POST", "/admin/identities/etl/api_keys", etlPair.Token, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected a writer to be refused API keys, got %d", rr.Code)
+	}
+
+	rr = do("POST", "/admin/identities/etl/api_keys", adminPair.Token, map[string]string{"name": "nightly"})
+	var key struct {
+		APIKey string `json:"api_key"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &key)
+	if rr.Code != http.StatusCreated || key.APIKey == "" {
+		t.Fatalf("Creating an API key failed: %d %s", rr.Code, rr.Body.String())
+	}
+	if _, code := login(map[string]string{"grant_type": "api_key", "api_key": key.APIKey}); code != http.StatusOK {
+		t.Errorf("API key grant failed: %d", code)
+	}
+
+	// Logout revokes the token and its refresh token
+	if rr := do("POST", "/auth/logout", adminPair.Token, map[string]string{"refresh_token": adminPair.RefreshToken}); rr.Code != http.StatusOK {
+		t.Fatalf("Logout failed: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("PUT", "/admin/identities/etl", adminPair.Token, map[string]interface{}{"roles": []string{"admin"}}); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the logged out token to be rejected, got %d", rr.Code)
+	}
+	if _, code := login(map[string]string{"grant_type": "refresh_token", "refresh_token": adminPair.RefreshToken}); code != http.StatusUnauthorized {
+		t.Errorf("Expected the logged out refresh token to be rejected, got %d", code)
+	}
+}
+
+func TestQuotaHandlers(t *testing.T) {
+	quotas := quota.NewManager(config.QuotaConfig{Default: config.TenantQuotaConfig{MaxKeys: 1}})
+	authService := auth.NewSimpleAuthService(3600)
+	h := NewHandlers(quota.NewStorage(storage.NewMemoryStorage(), quotas), testutils.NewMockReplicator([]string{}, 0), authService)
+	h.Quotas = quotas
+
+	router := mux.NewRouter()
+	router.Use(auth.AuthMiddleware(authService))
+	router.HandleFunc("/set", h.SetHandler).Methods("POST")
+	router.HandleFunc("/admin/quotas", h.QuotasHandler).Methods("GET")
+	do := func(method, path, body, tenant string) *httptest.ResponseRecorder {
+		token, _ := authService.GenerateToken("user", tenant, []string{"admin"})
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do("POST", "/set", `{"key":"a","value":"1"}`, "t1"); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", rr.Code)
+	}
+	if rr := do("POST", "/set", `{"key":"b","value":"1"}`, "t1"); rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected 507 beyond max_keys, got %d", rr.Code)
+	}
+	do("POST", "/set", `{"key":"a","value":"1"}`, "t2")
+
+	usageOf := func(rr *httptest.ResponseRecorder) []quota.TenantUsage {
+		var resp struct{ Tenants []quota.TenantUsage }
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp.Tenants
+	}
+	if usage := usageOf(do("GET", "/admin/quotas", "", "t1")); len(usage) != 1 || usage[0].Keys != 1 || usage[0].Rejected["max_keys"] != 1 {
+		t.Errorf("Expected the usage of t1 only, got %+v", usage)
+	}
+	if usage := usageOf(do("GET", "/admin/quotas", "", auth.AllTenants)); len(usage) != 2 {
+		t.Errorf("Expected a cluster admin to see both tenants, got %+v", usage)
+	}
+}
+
+func TestAuditHandlers(t *testing.T) {
+	auditLog, err := audit.Open(t.TempDir(), "node1", config.AuditConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	store := storage.NewMemoryStorage()
+	authService := auth.NewSimpleAuthService(3600)
+	h := NewHandlers(store, testutils.NewMockReplicator([]string{}, 0), authService)
+	h.Audit = auditLog
+
+	router := mux.NewRouter()
+	router.Use(auth.AuthMiddleware(authService))
+	router.Use(auditLog.DataMiddleware(store))
+	router.HandleFunc("/set", h.SetHandler).Methods("POST")
+	router.HandleFunc("/admin/audit", h.AuditHandler).Methods("GET")
+	router.HandleFunc("/admin/audit/verify", h.AuditVerifyHandler).Methods("GET")
+	do := func(method, path, body, tenant string) *httptest.ResponseRecorder {
+		token, _ := authService.GenerateToken("user-"+tenant, tenant, []string{"admin"})
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	do("POST", "/set", `{"key":"a","value":"1"}`, "t1")
+	do("POST", "/set", `{"key":"a","value":"2"}`, "t1")
+	do("POST", "/set", `{"key":"a","value":"1"}`, "t2")
+
+	eventsOf := func(rr *httptest.ResponseRecorder) []audit.Event {
+		var resp struct{ Events []audit.Event }
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp.Events
+	}
+	// Tenant admins name keys without their prefix and only see their tenant
+	events := eventsOf(do("GET", "/admin/audit?key=a", "", "t1"))
+	if len(events) != 2 || events[1].Key != "t1:a" || events[1].Version != 2 || events[1].Principal != "user-t1" {
+		t.Errorf("Expected the 2 writes of t1:a, got %+v", events)
+	}
+	if events := eventsOf(do("GET", "/admin/audit?tenant=t2", "", "t1")); len(events) != 2 {
+		t.Errorf("Expected a tenant admin to be kept to its tenant, got %+v", events)
+	}
+	if events := eventsOf(do("GET", "/admin/audit?key=t2:a", "", auth.AllTenants)); len(events) != 1 {
+		t.Errorf("Expected a cluster admin to see t2:a, got %+v", events)
+	}
+	if rr := do("GET", "/admin/audit?since=yesterday", "", auth.AllTenants); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid time, got %d", rr.Code)
+	}
+
+	rr := do("GET", "/admin/audit/verify", "", auth.AllTenants)
+	var verify struct {
+		Valid  bool
+		Report audit.Report
+	}
+	json.Unmarshal(rr.Body.Bytes(), &verify)
+	if rr.Code != http.StatusOK || !verify.Valid || verify.Report.Events != 3 {
+		t.Errorf("Expected a valid chain of 3 events, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHintsAndRepairHandlers(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Set("a", "1")
+	h := NewHandlers(store, testutils.NewMockReplicator([]string{"self:8080"}, 1), nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/hints", h.HintsHandler).Methods("GET")
+	router.HandleFunc("/admin/hints/{node}", h.DropHintsHandler).Methods("DELETE")
+	router.HandleFunc("/admin/repair", h.StartRepairHandler).Methods("POST")
+	router.HandleFunc("/admin/repair/status", h.RepairStatusHandler).Methods("GET")
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+		return rr
+	}
+
+	if rr := do("GET", "/admin/hints"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without hinted handoff, got %d", rr.Code)
+	}
+	h.Hints = replication.NewHintedHandoff(t.TempDir())
+	h.Hints.StoreHint("a", "1", "down:8080")
+	var hints struct {
+		Total int
+		Nodes []replication.HintStats
+	}
+	json.Unmarshal(do("GET", "/admin/hints").Body.Bytes(), &hints)
+	if hints.Total != 1 || len(hints.Nodes) != 1 || hints.Nodes[0].Node != "down:8080" {
+		t.Errorf("Expected a hint for down:8080, got %+v", hints)
+	}
+	if rr := do("DELETE", "/admin/hints/down:8080"); rr.Code != http.StatusOK || !bytes.Contains(rr.Body.Bytes(), []byte(`"dropped":1`)) {
+		t.Errorf("Expected the hint dropped, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := do("POST", "/admin/repair"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a repairer, got %d", rr.Code)
+	}
+	h.Repairer = cluster.NewRepairer(store, "self:8080", func(key string) []string { return []string{"self:8080"} })
+	if rr := do("POST", "/admin/repair"); rr.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", rr.Code)
+	}
+	if progress := h.Repairer.Wait(); progress.State != cluster.RepairCompleted || progress.ScannedKeys != 1 {
+		t.Errorf("Expected a completed repair, got %+v", progress)
+	}
+	var progress cluster.RepairProgress
+	json.Unmarshal(do("GET", "/admin/repair/status").Body.Bytes(), &progress)
+	if progress.State != cluster.RepairCompleted {
+		t.Errorf("Expected the status of the last repair, got %+v", progress)
+	}
+}
@@ -1,8 +1,10 @@
 package api
 
 import (
+	"distore/quota"
 	"distore/storage"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -15,6 +17,10 @@ func (h *Handlers) TTLHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.rejectIfReadOnly(w) {
+		return
+	}
+
 	var req struct {
 		Key   string `json:"key"`
 		Value string `json:"value"`
@@ -35,9 +41,10 @@ func (h *Handlers) TTLHandler(w http.ResponseWriter, r *http.Request) {
 	tenantKey := h.getTenantKey(r, req.Key)
 	err := ttlStorage.SetWithTTL(tenantKey, req.Value, time.Duration(req.TTL)*time.Second)
 	if err != nil {
-		http.Error(w, "Error setting key: "+err.Error(), http.StatusInternalServerError)
+		writeStorageError(w, err, "Error setting key: "+err.Error())
 		return
 	}
+	h.mirrorSet(tenantKey, req.Value)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -54,6 +61,10 @@ func (h *Handlers) IncrementHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.rejectIfReadOnly(w) {
+		return
+	}
+
 	var req struct {
 		Key   string `json:"key"`
 		Delta int64  `json:"delta"`
@@ -73,9 +84,10 @@ func (h *Handlers) IncrementHandler(w http.ResponseWriter, r *http.Request) {
 	tenantKey := h.getTenantKey(r, req.Key)
 	newValue, err := atomicStorage.Increment(tenantKey, req.Delta)
 	if err != nil {
-		http.Error(w, "Error incrementing key: "+err.Error(), http.StatusInternalServerError)
+		writeStorageError(w, err, "Error incrementing key: "+err.Error())
 		return
 	}
+	h.mirrorSet(tenantKey, strconv.FormatInt(newValue, 10))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -106,14 +118,40 @@ func (h *Handlers) BatchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Read-only batches are allowed while writes are rejected
+	for _, op := range req.Operations {
+		if op.Type != "get" {
+			if h.rejectIfReadOnly(w) {
+				return
+			}
+			break
+		}
+	}
+
 	// Apply tenant prefix to all keys
 	for i := range req.Operations {
 		req.Operations[i].Key = h.getTenantKey(r, req.Operations[i].Key)
 	}
 
 	results := batchStorage.ExecuteBatch(req.Operations)
+	status := http.StatusOK
+	for _, result := range results {
+		if errors.Is(result.Error, quota.ErrQuotaExceeded) {
+			status = http.StatusInsufficientStorage
+		}
+		if result.Error != nil {
+			continue
+		}
+		switch result.Operation.Type {
+		case "set":
+			h.mirrorSet(result.Operation.Key, result.Operation.Value)
+		case "delete":
+			h.mirrorDelete(result.Operation.Key)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"results": results,
 	})
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"distore/audit"
+	"distore/auth"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Admin: events of the audit log of this node, most recent last. Tenant
+// admins only see the events of their tenant, and name keys without the
+// tenant prefix.
+func (h *Handlers) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Audit == nil {
+		http.Error(w, "Audit log is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	q := r.URL.Query()
+	filter := audit.Filter{
+		Category:  q.Get("category"),
+		Principal: q.Get("principal"),
+		Tenant:    q.Get("tenant"),
+		Operation: q.Get("operation"),
+		Outcome:   q.Get("outcome"),
+	}
+	if key := q.Get("key"); key != "" {
+		filter.Key = h.getTenantKey(r, key)
+	}
+	if !h.isClusterAdmin(r) {
+		filter.Tenant = auth.TenantOf(auth.ClaimsFrom(r.Context()))
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := q.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+	if value := q.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	events, err := h.Audit.Query(filter)
+	if err != nil {
+		http.Error(w, "Error reading the audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []audit.Event{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"events": events})
+}
+
+// Admin: check the hash chain of the audit log of this node. The head it
+// reports can be kept elsewhere to detect a truncated log later.
+func (h *Handlers) AuditVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Audit == nil {
+		http.Error(w, "Audit log is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	report, err := audit.Verify(h.Audit.Dir())
+	var chainErr *audit.ChainError
+	if err != nil && !errors.As(err, &chainErr) {
+		http.Error(w, "Error reading the audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"valid": err == nil, "report": report}
+	status := http.StatusOK
+	if chainErr != nil {
+		response["error"] = chainErr.Error()
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// auditToken records a token request. principal is the identity the client
+// named, replaced by the one of the token when it was issued.
+func (h *Handlers) auditToken(r *http.Request, grantType, principal string, pair *auth.TokenPair, err error) {
+	if h.Audit == nil {
+		return
+	}
+	e := audit.Event{Category: audit.CategoryAuth, Operation: "token " + grantType, Principal: principal, Outcome: audit.OutcomeSuccess}
+	if errors.Is(err, auth.ErrInvalidCredentials) || (err != nil && grantType == "refresh_token") {
+		e.Outcome, e.Reason = audit.OutcomeDenied, err.Error()
+	} else if err != nil {
+		e.Outcome, e.Reason = audit.OutcomeFailed, err.Error()
+	} else if claims, verr := h.Issuer.ValidateToken(pair.Token); verr == nil {
+		e.Principal, e.Tenant, e.Roles = claims.UserID, auth.TenantOf(claims), claims.Roles
+	}
+	h.Audit.RecordRequest(r, e)
+}
+
+func (h *Handlers) auditLogout(r *http.Request, all bool, err error) {
+	if h.Audit == nil {
+		return
+	}
+	e := audit.Event{Category: audit.CategoryAuth, Operation: "logout", Outcome: audit.OutcomeSuccess}
+	if all {
+		e.Operation = "logout all"
+	}
+	if err != nil {
+		e.Outcome, e.Reason = audit.OutcomeFailed, err.Error()
+	}
+	h.Audit.RecordRequest(r, e)
+}
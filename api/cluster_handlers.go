@@ -0,0 +1,36 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Nodes of the cluster, for clients to discover them without being admins
+func (h *Handlers) ClusterNodesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"nodes":         h.replicator.GetNodes(),
+		"replica_count": h.replicator.GetReplicaCount(),
+	})
+}
+
+// Nodes holding the keys named by the key query parameters, owner first,
+// for clients to send each key to its owner
+func (h *Handlers) PlacementHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Placement == nil {
+		http.Error(w, "Placement is not available", http.StatusServiceUnavailable)
+		return
+	}
+	keys := r.URL.Query()["key"]
+	if len(keys) == 0 {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+
+	placement := make(map[string][]string, len(keys))
+	for _, key := range keys {
+		placement[key] = h.Placement(h.getTenantKey(r, key))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"placement": placement})
+}
@@ -1,14 +1,25 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
+	"distore/audit"
 	"distore/auth"
 	"distore/cluster"
+	"distore/config"
+	"distore/encryption"
+	"distore/k8s"
+	"distore/quota"
 	"distore/replication"
 	"distore/storage"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +31,47 @@ type Handlers struct {
 	replicator  replication.ReplicatorInterface
 	authService auth.AuthServiceInterface
 	Rebalancer  *cluster.Rebalancer
+	Failover    *cluster.FailoverManager
+	ReadOnly    *cluster.ReadOnlyManager
+	Lifecycle   *cluster.NodeLifecycle
+	Keyspaces   *replication.KeyspaceRegistry
+	CrossDC     *cluster.CrossDCReplicator
+	Latency     *cluster.LatencyProber
+	ReadRouter  *cluster.ReadRouter
+	Repairer    *cluster.Repairer
+
+	// Hints kept for unreachable nodes, nil for single-node setups
+	Hints *replication.HintedHandoff
+
+	// Edge caches: core nodes publish invalidations, edge nodes serve from the cache
+	Invalidations *cluster.InvalidationLog
+	EdgeCache     *cluster.EdgeCache
+	Edges         *k8s.EdgeNodeManager
+
+	// Applies config file changes without a restart
+	ConfigReloader *config.Reloader
+
+	// Replicated membership and keyspace settings, nil keeps them local to this node
+	Metadata *cluster.MetadataStore
+
+	// Issues tokens to stored identities, nil when auth is disabled
+	Issuer *auth.Issuer
+
+	// Signs the tokens of this node, its public keys are served as JWKS
+	Signer *auth.AuthService
+
+	// Per-tenant rate limits and storage quotas, nil when disabled
+	Quotas *quota.Manager
+
+	// Audit log, nil when disabled
+	Audit *audit.Log
+
+	// Encryption at rest: data key rotation and re-encryption, nil when
+	// disabled
+	Encryption *encryption.Rotator
+
+	// Placement returns the nodes holding a key, owner first
+	Placement func(key string) []string
 }
 
 func NewHandlers(storage storage.Storage, replicator replication.ReplicatorInterface, authService auth.AuthServiceInterface) *Handlers {
@@ -37,6 +89,10 @@ func (h *Handlers) SetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.rejectIfReadOnly(w) {
+		return
+	}
+
 	var kv storage.KeyValue
 	if err := json.NewDecoder(r.Body).Decode(&kv); err != nil {
 		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
@@ -53,9 +109,11 @@ func (h *Handlers) SetHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err := h.storage.Set(tenantKey, kv.Value); err != nil {
 		log.Printf("Error setting key %s: %v", tenantKey, err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeStorageError(w, err, "Internal server error")
 		return
 	}
+	h.applyKeyspaceTTL(tenantKey)
+	h.mirrorSet(tenantKey, kv.Value)
 
 	// Asynchronous replication
 	go func() {
@@ -88,13 +146,28 @@ func (h *Handlers) GetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	key := pathParts[2]
 
+	if h.rejectIfNotServing(w) {
+		return
+	}
+
 	// Add tenant prefix if necessary
 	tenantKey := h.getTenantKey(r, key)
 
-	value, err := h.storage.Get(tenantKey)
+	var value string
+	var err error
+	if h.ReadRouter != nil {
+		value, err = h.routedGet(w, r, tenantKey)
+	} else {
+		value, err = h.storage.Get(tenantKey)
+	}
 	if err != nil {
 		if err == storage.ErrKeyNotFound {
 			http.Error(w, "Key not found", http.StatusNotFound)
+		} else if errors.Is(err, cluster.ErrInvalidReadPolicy) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, cluster.ErrNoReadReplica) {
+			log.Printf("Error getting key %s: %v", tenantKey, err)
+			http.Error(w, "No replica available", http.StatusServiceUnavailable)
 		} else {
 			log.Printf("Error getting key %s: %v", tenantKey, err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -109,6 +182,28 @@ func (h *Handlers) GetHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// routedGet reads through the locality-aware router. The policy can be chosen
+// per request with the read_policy query parameter or X-Read-Policy header.
+func (h *Handlers) routedGet(w http.ResponseWriter, r *http.Request, key string) (string, error) {
+	name := r.URL.Query().Get("read_policy")
+	if name == "" {
+		name = r.Header.Get("X-Read-Policy")
+	}
+	policy, err := cluster.ParseReadPolicy(name)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := h.ReadRouter.Read(key, policy)
+	if result.Node != "" {
+		w.Header().Set("X-Served-By", result.Node)
+	}
+	if err == nil || err == storage.ErrKeyNotFound {
+		return result.Value, err
+	}
+	return "", fmt.Errorf("%s read failed after %d attempts: %w", result.Policy, result.Attempts, err)
+}
+
 // Handler for deleting a value
 func (h *Handlers) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
@@ -116,6 +211,10 @@ func (h *Handlers) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.rejectIfReadOnly(w) {
+		return
+	}
+
 	pathParts := strings.Split(r.URL.Path, "/")
 	if len(pathParts) < 3 {
 		http.Error(w, "Key is required", http.StatusBadRequest)
@@ -135,6 +234,7 @@ func (h *Handlers) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	h.mirrorDelete(tenantKey)
 
 	// Asynchronous replication without waiting
 	go func() {
@@ -151,20 +251,98 @@ func (h *Handlers) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// rejectIfReadOnly answers 503 with Retry-After when the cluster does not
+// accept writes. It returns true if the request was rejected.
+func (h *Handlers) rejectIfReadOnly(w http.ResponseWriter) bool {
+	if h.Lifecycle != nil && !h.Lifecycle.AcceptingWrites() {
+		http.Error(w, "Node is decommissioned", http.StatusServiceUnavailable)
+		return true
+	}
+	if h.ReadOnly == nil || h.ReadOnly.CanWrite() {
+		return false
+	}
+
+	retryAfter := int(h.ReadOnly.RetryAfter().Seconds())
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Cluster is in read-only mode: "+h.ReadOnly.Reason(), http.StatusServiceUnavailable)
+	return true
+}
+
+// writeStorageError answers a failed write: 507 when it would take the
+// tenant beyond a storage quota, 500 with message otherwise
+func writeStorageError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, quota.ErrQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	http.Error(w, message, http.StatusInternalServerError)
+}
+
+// rejectIfNotServing answers 503 while this node is still pulling its data
+// (bootstrap or replace) or has left the cluster
+func (h *Handlers) rejectIfNotServing(w http.ResponseWriter) bool {
+	if h.Lifecycle == nil || h.Lifecycle.AcceptingReads() {
+		return false
+	}
+
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "Node is not serving reads: "+string(h.Lifecycle.State()), http.StatusServiceUnavailable)
+	return true
+}
+
+// mirrorSet double-writes to the new owner while the key's range is being rebalanced
+func (h *Handlers) mirrorSet(key, value string) {
+	if h.Rebalancer != nil {
+		h.Rebalancer.MirrorSet(key, value)
+	}
+}
+
+// mirrorDelete double-deletes on the new owner while the key's range is being rebalanced
+func (h *Handlers) mirrorDelete(key string) {
+	if h.Rebalancer != nil {
+		h.Rebalancer.MirrorDelete(key)
+	}
+}
+
 // Helper function for getting a key given a tenant
 func (h *Handlers) getTenantKey(r *http.Request, key string) string {
 	if h.authService == nil {
 		return key
 	}
+	return auth.TenantKey(auth.ClaimsFrom(r.Context()), key)
+}
 
-	claims, ok := r.Context().Value("claims").(*auth.Claims)
-	if ok && claims != nil && claims.TenantID != "" {
-		return claims.TenantID + ":" + key
+// tenantItems keeps the items of the caller's tenant that it may perform
+// action on, named without the tenant prefix
+func (h *Handlers) tenantItems(r *http.Request, items []storage.KeyValue, action auth.Action) []storage.KeyValue {
+	if h.authService == nil {
+		return items
 	}
-	return key
+	prefix := auth.TenantPrefix(auth.ClaimsFrom(r.Context()))
+
+	scoped := make([]storage.KeyValue, 0, len(items))
+	for _, item := range items {
+		if !strings.HasPrefix(item.Key, prefix) {
+			continue
+		}
+		item.Key = strings.TrimPrefix(item.Key, prefix)
+		if auth.Allowed(r, item.Key, action) {
+			scoped = append(scoped, item)
+		}
+	}
+	return scoped
+}
+
+// isClusterAdmin tells whether the caller may act on the whole cluster
+func (h *Handlers) isClusterAdmin(r *http.Request) bool {
+	return h.authService == nil || auth.IsClusterAdmin(auth.ClaimsFrom(r.Context()))
 }
 
-// Handler for receiving a token
+// Handler for receiving a token. Tokens are only issued to stored
+// identities, which hold the roles and tenant that go into them.
 func (h *Handlers) TokenHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -172,15 +350,19 @@ func (h *Handlers) TokenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// If authentication is disabled
-	if h.authService == nil {
+	if h.Issuer == nil {
 		http.Error(w, "Authentication is disabled", http.StatusServiceUnavailable)
 		return
 	}
 
 	var req struct {
-		UserID   string   `json:"user_id"`
-		TenantID string   `json:"tenant_id"`
-		Roles    []string `json:"roles"`
+		GrantType    string `json:"grant_type"`
+		UserID       string `json:"user_id"`
+		Password     string `json:"password"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		APIKey       string `json:"api_key"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -188,30 +370,36 @@ func (h *Handlers) TokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check required fields
-	if req.UserID == "" {
-		http.Error(w, "user_id is required", http.StatusBadRequest)
+	var pair *auth.TokenPair
+	var err error
+	switch req.GrantType {
+	case "password":
+		pair, err = h.Issuer.Password(req.UserID, req.Password)
+	case "client_credentials":
+		pair, err = h.Issuer.ClientCredentials(req.ClientID, req.ClientSecret)
+	case "api_key":
+		pair, err = h.Issuer.APIKey(req.APIKey)
+	case "refresh_token":
+		pair, err = h.Issuer.Refresh(req.RefreshToken)
+	default:
+		http.Error(w, "grant_type must be password, client_credentials, api_key or refresh_token", http.StatusBadRequest)
 		return
 	}
-	if req.TenantID == "" {
-		req.TenantID = "default"
-	}
-	if len(req.Roles) == 0 {
-		req.Roles = []string{"read", "write"}
-	}
-
-	token, err := h.authService.GenerateToken(req.UserID, req.TenantID, req.Roles)
-	if err != nil {
+	h.auditToken(r, req.GrantType, req.UserID+req.ClientID, pair, err)
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	} else if err != nil && req.GrantType == "refresh_token" {
+		http.Error(w, "Invalid refresh token: "+err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
 		http.Error(w, "Error generating token: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"token":      token,
-		"token_type": "Bearer",
-		"expires_in": "3600",
-	})
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(pair)
 }
 
 // Internal handler for replication set
@@ -229,13 +417,305 @@ func (h *Handlers) InternalSetHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err := h.storage.Set(kv.Key, kv.Value); err != nil {
 		log.Printf("Internal error setting key %s: %v", kv.Key, err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeStorageError(w, err, "Internal server error")
 		return
 	}
+	h.applyKeyspaceTTL(kv.Key)
+	h.mirrorSet(kv.Key, kv.Value)
 
 	w.WriteHeader(http.StatusCreated)
 }
 
+// Internal handler for streamed batches (used by rebalance)
+func (h *Handlers) InternalBatchSetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Items []storage.KeyValue `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Items keep the TTL they had on the sending node rather than a fresh
+	// keyspace TTL
+	ttlStorage := storage.FindTTLStorage(h.storage)
+	for _, kv := range req.Items {
+		if err := h.storage.Set(kv.Key, kv.Value); err != nil {
+			log.Printf("Internal error setting key %s: %v", kv.Key, err)
+			writeStorageError(w, err, "Internal server error")
+			return
+		}
+		if kv.TTLMillis > 0 && ttlStorage != nil {
+			if err := ttlStorage.Expire(kv.Key, time.Duration(kv.TTLMillis)*time.Millisecond); err != nil {
+				log.Printf("Error applying TTL to %s: %v", kv.Key, err)
+			}
+		}
+		h.mirrorSet(kv.Key, kv.Value)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"count": len(req.Items)})
+}
+
+// Internal handler returning a checksum over the given keys (used to verify rebalance transfers)
+func (h *Handlers) InternalChecksumHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := make([]storage.KeyValue, 0, len(req.Keys))
+	for _, key := range req.Keys {
+		value, err := h.storage.Get(key)
+		if err == storage.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		items = append(items, storage.KeyValue{Key: key, Value: value})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"checksum": cluster.ChecksumKeyValues(items),
+		"count":    len(items),
+	})
+}
+
+// Internal handler applying a (gzip-compressed) batch shipped by another data center
+func (h *Handlers) InternalDCBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.CrossDC == nil {
+		http.Error(w, "cross-DC replication not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	var batch cluster.CrossDCBatch
+	if err := json.NewDecoder(body).Decode(&batch); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.CrossDC.ApplyBatch(h.storage, batch); err != nil {
+		log.Printf("Cross-DC batch from %s failed: %v", batch.SourceDC, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"applied": len(batch.Entries)})
+}
+
+// Internal handler long-polling the key invalidations edge caches subscribe to
+func (h *Handlers) InternalInvalidationsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Invalidations == nil {
+		http.Error(w, "invalidation log not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	epoch := query.Get("epoch")
+	since, _ := strconv.ParseUint(query.Get("since"), 10, 64)
+	waitMs, _ := strconv.Atoi(query.Get("wait_ms"))
+	if waitMs > 30000 {
+		waitMs = 30000
+	}
+
+	if epoch == h.Invalidations.Epoch() && waitMs > 0 {
+		h.Invalidations.Wait(since, time.Duration(waitMs)*time.Millisecond)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Invalidations.Since(epoch, since, 0))
+}
+
+// Admin: edge cache statistics and invalidation sync state
+func (h *Handlers) EdgeCacheStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if h.EdgeCache == nil {
+		http.Error(w, "node is not an edge cache", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.EdgeCache.Stats())
+}
+
+// Admin: probed health of the edge nodes
+func (h *Handlers) EdgeHealthHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Edges == nil {
+		http.Error(w, "edge nodes not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	if id := mux.Vars(r)["id"]; id != "" {
+		health := h.Edges.GetEdgeNodeHealth(id)
+		if health == nil {
+			http.Error(w, "Edge node not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(health)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"edges": h.Edges.GetAllEdgeNodeHealth(),
+	})
+}
+
+// Internal handler returning a page of the items in a token range (used by bootstrap and replace)
+func (h *Handlers) InternalRangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Start uint32 `json:"start"`
+		End   uint32 `json:"end"`
+		After string `json:"after"`
+		Limit int    `json:"limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items, err := h.storage.GetAll()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	page, next := cluster.ItemsInRange(items, cluster.TokenRange{Start: req.Start, End: req.End}, req.After, req.Limit)
+	if page == nil {
+		page = []storage.KeyValue{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"items": page,
+		"next":  next,
+	})
+}
+
+// Internal handler applying a lifecycle event announced by a peer
+func (h *Handlers) InternalMembershipHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Lifecycle == nil {
+		http.Error(w, "lifecycle not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var ev cluster.MembershipEvent
+	if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.Lifecycle.ApplyMembership(ev); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": h.replicator.GetNodes()})
+}
+
+// Internal handler exchanging cluster metadata: a POSTed copy is adopted if
+// newer, and the answer is this node's copy. GET answers without credential
+// hashes, as it only serves to inspect a node.
+func (h *Handlers) InternalMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Metadata == nil {
+		http.Error(w, "cluster metadata not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var remote cluster.ClusterMetadata
+		if err := json.NewDecoder(r.Body).Decode(&remote); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := h.Metadata.Merge(remote); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	meta := h.Metadata.Shared()
+	if r.Method == http.MethodGet {
+		meta.Auth = meta.Auth.Redacted()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+// Admin: show the cluster metadata, without credential hashes
+func (h *Handlers) MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Metadata == nil {
+		http.Error(w, "cluster metadata not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	meta := h.Metadata.Get()
+	meta.Auth = meta.Auth.Redacted()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+// setMembers changes the node list and replica count. With cluster metadata
+// the change is recorded there and reaches every node.
+func (h *Handlers) setMembers(nodes []string, replicaCount *int) error {
+	if h.Metadata == nil {
+		if nodes != nil {
+			h.replicator.UpdateNodes(nodes)
+		}
+		if replicaCount != nil {
+			h.replicator.SetReplicaCount(*replicaCount)
+		}
+		return nil
+	}
+
+	_, err := h.Metadata.Update(func(meta *cluster.ClusterMetadata) error {
+		if nodes != nil {
+			meta.Members = nodes
+		}
+		if replicaCount != nil {
+			meta.ReplicaCount = *replicaCount
+		}
+		return nil
+	})
+	return err
+}
+
 // Internal handler to read value (used for quorum/repair/rebalance)
 func (h *Handlers) InternalGetHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -250,6 +730,10 @@ func (h *Handlers) InternalGetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	key := pathParts[3]
 
+	if h.rejectIfNotServing(w) {
+		return
+	}
+
 	value, err := h.storage.Get(key)
 	if err != nil {
 		if err == storage.ErrKeyNotFound {
@@ -284,6 +768,7 @@ func (h *Handlers) InternalDeleteHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	h.mirrorDelete(key)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -337,7 +822,10 @@ func (h *Handlers) AddNodeHandler(w http.ResponseWriter, r *http.Request) {
 	if !found {
 		nodes = append(nodes, req.Node)
 	}
-	h.replicator.UpdateNodes(nodes)
+	if err := h.setMembers(nodes, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": nodes})
@@ -352,6 +840,12 @@ func (h *Handlers) RemoveNodeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Removing this node hands its data over instead of dropping it
+	if h.Lifecycle != nil && node == h.Lifecycle.Self() {
+		h.DecommissionHandler(w, r)
+		return
+	}
+
 	nodes := h.replicator.GetNodes()
 	filtered := make([]string, 0, len(nodes))
 	for _, n := range nodes {
@@ -359,34 +853,305 @@ func (h *Handlers) RemoveNodeHandler(w http.ResponseWriter, r *http.Request) {
 			filtered = append(filtered, n)
 		}
 	}
-	h.replicator.UpdateNodes(filtered)
+	if err := h.setMembers(filtered, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": filtered})
 }
 
-// Admin: trigger rebalance
+// Admin: failure detector status of all nodes
+func (h *Handlers) NodeStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Failover == nil {
+		http.Error(w, "failure detection not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	type nodeStatusResponse struct {
+		Node      string    `json:"node"`
+		State     string    `json:"state"`
+		Online    bool      `json:"online"`
+		Phi       float64   `json:"phi"`
+		LatencyMs int64     `json:"latency_ms"`
+		LastSeen  time.Time `json:"last_seen"`
+	}
+
+	statuses := h.Failover.GetNodeStatus()
+	result := make([]nodeStatusResponse, 0, len(statuses))
+	for _, node := range h.Failover.GetNodes() {
+		status, ok := statuses[node]
+		if !ok {
+			continue
+		}
+		result = append(result, nodeStatusResponse{
+			Node:      status.URL,
+			State:     string(status.State),
+			Online:    status.Online,
+			Phi:       status.Phi,
+			LatencyMs: status.Latency.Milliseconds(),
+			LastSeen:  status.LastSeen,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": result})
+}
+
+// Admin: mark node as leaving (or clear the flag with ?clear=true)
+func (h *Handlers) NodeLeavingHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Failover == nil {
+		http.Error(w, "failure detection not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	node := mux.Vars(r)["node"]
+	if node == "" {
+		http.Error(w, "node is required", http.StatusBadRequest)
+		return
+	}
+
+	var ok bool
+	if r.URL.Query().Get("clear") == "true" {
+		ok = h.Failover.ClearLeaving(node)
+	} else {
+		ok = h.Failover.MarkLeaving(node)
+	}
+	if !ok {
+		http.Error(w, "node not found", http.StatusNotFound)
+		return
+	}
+
+	state := string(cluster.NodeStateLeaving)
+	if status, exists := h.Failover.GetNodeStatus()[node]; exists {
+		state = string(status.State)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"node": node, "state": state})
+}
+
+// Admin: lifecycle state of this node and its workflows
+func (h *Handlers) LifecycleStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Lifecycle == nil {
+		http.Error(w, "lifecycle not configured", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Lifecycle.GetStatus())
+}
+
+// Admin: stream this node's data to the remaining nodes and leave the cluster
+func (h *Handlers) DecommissionHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Lifecycle == nil {
+		http.Error(w, "lifecycle not configured", http.StatusServiceUnavailable)
+		return
+	}
+	h.writeLifecycleStart(w, h.Lifecycle.Decommission())
+}
+
+// Admin: pull this node's ranges from the cluster before serving reads
+func (h *Handlers) BootstrapHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Lifecycle == nil {
+		http.Error(w, "lifecycle not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req struct {
+		Seeds []string `json:"seeds"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	h.writeLifecycleStart(w, h.Lifecycle.Bootstrap(req.Seeds))
+}
+
+// Admin: take over the token ranges of a dead node
+func (h *Handlers) ReplaceNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Lifecycle == nil {
+		http.Error(w, "lifecycle not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req struct {
+		Node  string `json:"node"`
+		Force bool   `json:"force"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Node == "" {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	h.writeLifecycleStart(w, h.Lifecycle.Replace(req.Node, req.Force))
+}
+
+func (h *Handlers) writeLifecycleStart(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+	case cluster.ErrUnknownNode:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case cluster.ErrNoPeers:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	job, _ := h.Lifecycle.Job()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// Admin: outbound cross-DC queues and replication lag
+func (h *Handlers) CrossDCStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if h.CrossDC == nil {
+		http.Error(w, "cross-DC replication not configured", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"local_data_center": h.CrossDC.LocalDataCenter(),
+		"data_centers":      h.CrossDC.Status(),
+	})
+}
+
+// Admin: measured latencies of data center and edge nodes
+func (h *Handlers) LatencyStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Latency == nil {
+		http.Error(w, "latency prober not configured", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"nodes": h.Latency.Stats(),
+	})
+}
+
+// Admin: read-only mode status
+func (h *Handlers) ReadOnlyStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if h.ReadOnly == nil {
+		http.Error(w, "read-only manager not configured", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.ReadOnly.GetStatus())
+}
+
+// Admin: force or clear read-only mode
+func (h *Handlers) SetReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.ReadOnly == nil {
+		http.Error(w, "read-only manager not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req struct {
+		Mode   string `json:"mode"` // "read_only", "writable" or "auto"
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	mode := cluster.ReadOnlyMode(req.Mode)
+	switch mode {
+	case cluster.ReadOnlyModeAuto, cluster.ReadOnlyModeForced, cluster.ReadOnlyModeWritable:
+	default:
+		http.Error(w, "mode must be one of: auto, read_only, writable", http.StatusBadRequest)
+		return
+	}
+
+	h.ReadOnly.SetMode(mode, req.Reason)
+	log.Printf("Read-only mode set to %s by admin (reason: %q)", mode, req.Reason)
+	h.ReadOnlyStatusHandler(w, r)
+}
+
+// Admin: start a background rebalance job
 func (h *Handlers) TriggerRebalanceHandler(w http.ResponseWriter, r *http.Request) {
 	if h.Rebalancer == nil {
 		http.Error(w, "rebalancer not configured", http.StatusServiceUnavailable)
 		return
 	}
-	moved, err := h.Rebalancer.TriggerRebalance()
+
+	var req struct {
+		Full bool `json:"full"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.Rebalancer.Start(req.Full); err != nil {
+		if err == cluster.ErrRebalanceInProgress {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(h.Rebalancer.Progress())
+}
+
+// Admin: rebalance progress
+func (h *Handlers) RebalanceStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Rebalancer == nil {
+		http.Error(w, "rebalancer not configured", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Rebalancer.Progress())
+}
+
+// Admin: pause, resume or cancel the running rebalance job
+func (h *Handlers) RebalanceControlHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Rebalancer == nil {
+		http.Error(w, "rebalancer not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var err error
+	switch action := mux.Vars(r)["action"]; action {
+	case "pause":
+		err = h.Rebalancer.Pause()
+	case "resume":
+		err = h.Rebalancer.Resume()
+	case "cancel":
+		err = h.Rebalancer.Cancel()
+	default:
+		http.Error(w, "unknown action: "+action, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"moved": moved})
+	json.NewEncoder(w).Encode(h.Rebalancer.Progress())
 }
 
 // Admin: config get
 func (h *Handlers) GetConfigHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	resp := map[string]interface{}{
 		"nodes":         h.replicator.GetNodes(),
 		"replica_count": h.replicator.GetReplicaCount(),
-	})
+	}
+	if h.ConfigReloader != nil {
+		resp["pending_restart"] = h.ConfigReloader.PendingRestart()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 // Admin: config update
@@ -399,36 +1164,81 @@ func (h *Handlers) UpdateConfigHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	var nodes []string
 	if len(req.Nodes) > 0 {
-		h.replicator.UpdateNodes(req.Nodes)
+		nodes = req.Nodes
 	}
-	if req.ReplicaCount != nil {
-		h.replicator.SetReplicaCount(*req.ReplicaCount)
+	if err := h.setMembers(nodes, req.ReplicaCount); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	h.GetConfigHandler(w, r)
 }
 
-// Admin: backup current data to a JSON file path provided
+// Admin: re-read the config file and apply what can change without a restart
+func (h *Handlers) ReloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if h.ConfigReloader == nil {
+		http.Error(w, "Config reload not available", http.StatusServiceUnavailable)
+		return
+	}
+	result, err := h.ConfigReloader.Reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Config reload (admin API): %s", result)
+
+	status := http.StatusOK
+	if len(result.Failed) > 0 {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// Admin: backup current data to a JSON file path provided, or into the
+// response. Tenant admins get the keys of their tenant in the response.
 func (h *Handlers) BackupHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Path string `json:"path"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	if req.Path != "" && !h.isClusterAdmin(r) {
+		http.Error(w, "Backing up to a server path requires a cluster admin", http.StatusForbidden)
+		return
+	}
 	items, err := h.storage.GetAll()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	items = h.tenantItems(r, items, auth.ActionAdmin)
+
+	// Without a path the backup is the response
+	if req.Path == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": len(items), "items": items})
+		return
+	}
+	// Files are encrypted at rest like the data, with a key of their own
+	var content interface{} = items
+	if h.Encryption != nil {
+		if content, err = encryption.SealBackup(h.Encryption.Keyring().KMS(), items); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	f, err := os.Create(req.Path)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer f.Close()
-	if err := json.NewEncoder(f).Encode(items); err != nil {
+	if err := json.NewEncoder(f).Encode(content); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -436,33 +1246,72 @@ func (h *Handlers) BackupHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "count": len(items)})
 }
 
-// Admin: restore from a JSON file
+// Admin: restore from a JSON file. Tenant admins send the items inline
+// and restore into their tenant only.
 func (h *Handlers) RestoreHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Path string `json:"path"`
+		Path  string             `json:"path"`
+		Items []storage.KeyValue `json:"items"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Path == "" && req.Items == nil) {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-	f, err := os.Open(req.Path)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer f.Close()
-	var items []storage.KeyValue
-	if err := json.NewDecoder(f).Decode(&items); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	items := req.Items
+	if req.Path != "" {
+		if !h.isClusterAdmin(r) {
+			http.Error(w, "Restoring from a server path requires a cluster admin", http.StatusForbidden)
+			return
+		}
+		f, err := os.Open(req.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		if items, err = h.readBackup(f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 	for _, it := range items {
-		_ = h.storage.Set(it.Key, it.Value)
+		if !auth.Allowed(r, it.Key, auth.ActionAdmin) {
+			http.Error(w, fmt.Sprintf("Access denied: admin on key %q", it.Key), http.StatusForbidden)
+			return
+		}
+	}
+	for i, it := range items {
+		if err := h.storage.Set(h.getTenantKey(r, it.Key), it.Value); errors.Is(err, quota.ErrQuotaExceeded) {
+			http.Error(w, fmt.Sprintf("Restored %d of %d items: %v", i, len(items), err), http.StatusInsufficientStorage)
+			return
+		}
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "count": len(items)})
 }
 
+// readBackup reads a backup file: a list of items, or an encrypted backup
+func (h *Handlers) readBackup(r io.Reader) ([]storage.KeyValue, error) {
+	var content json.RawMessage
+	if err := json.NewDecoder(r).Decode(&content); err != nil {
+		return nil, err
+	}
+	var items []storage.KeyValue
+	if !bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		err := json.Unmarshal(content, &items)
+		return items, err
+	}
+
+	if h.Encryption == nil {
+		return nil, errors.New("the backup is encrypted, restoring it requires encryption to be enabled")
+	}
+	var backup encryption.Backup
+	if err := json.Unmarshal(content, &backup); err != nil {
+		return nil, err
+	}
+	return encryption.OpenBackup(h.Encryption.Keyring().KMS(), &backup)
+}
+
 // New handler for getting all keys
 func (h *Handlers) GetAllHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -470,12 +1319,17 @@ func (h *Handlers) GetAllHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.rejectIfNotServing(w) {
+		return
+	}
+
 	items, err := h.storage.GetAll()
 	if err != nil {
 		log.Printf("Error getting all items: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	items = h.tenantItems(r, items, auth.ActionRead)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -491,6 +1345,10 @@ func (h *Handlers) CASHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.rejectIfReadOnly(w) {
+		return
+	}
+
 	var req struct {
 		Key             string `json:"key"`
 		ExpectedValue   string `json:"expected_value"`
@@ -512,9 +1370,12 @@ func (h *Handlers) CASHandler(w http.ResponseWriter, r *http.Request) {
 	tenantKey := h.getTenantKey(r, req.Key)
 	result, err := casStorage.CompareAndSet(tenantKey, req.ExpectedValue, req.NewValue, req.ExpectedVersion)
 	if err != nil {
-		http.Error(w, "Error in CAS operation: "+err.Error(), http.StatusInternalServerError)
+		writeStorageError(w, err, "Error in CAS operation: "+err.Error())
 		return
 	}
+	if result.Success {
+		h.mirrorSet(tenantKey, req.NewValue)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -531,6 +1392,10 @@ func (h *Handlers) AcquireLockHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.rejectIfReadOnly(w) {
+		return
+	}
+
 	// Extract the key from the path
 	vars := mux.Vars(r)
 	key := vars["key"]
@@ -579,6 +1444,10 @@ func (h *Handlers) ReleaseLockHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.rejectIfReadOnly(w) {
+		return
+	}
+
 	// Extract the key from the path using
 	vars := mux.Vars(r)
 	key := vars["key"]
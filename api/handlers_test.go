@@ -3,15 +3,18 @@ package api
 import (
 	"bytes"
 	"distore/auth"
+	"distore/cluster"
 	"distore/config"
 	"distore/replication"
 	"distore/storage"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 // MockReplicator implements replication.ReplicatorInterface
@@ -557,3 +560,208 @@ func TestReplicationErrors(t *testing.T) {
 		}
 	})
 }
+
+func TestRoutedGetHandler(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Set("k", "local")
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"value": "remote"})
+	}))
+	defer remote.Close()
+
+	cdc := cluster.NewCrossDCReplicator(config.MultiCloudConfig{
+		DataCenters: []config.DataCenterConfig{
+			{ID: "eu", Nodes: []string{"self:8080"}},
+			{ID: "us", Nodes: []string{remote.URL[7:]}},
+		},
+	})
+	handlers := NewHandlers(store, NewMockReplicator(), nil)
+	handlers.ReadRouter = cluster.NewReadRouter("self:8080", store, cdc, func(key string) []string {
+		return []string{remote.URL[7:], "self:8080"}
+	})
+
+	get := func(target string, header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if header != "" {
+			req.Header.Set("X-Read-Policy", header)
+		}
+		rr := httptest.NewRecorder()
+		handlers.GetHandler(rr, req)
+		return rr
+	}
+
+	rr := get("/get/k", "")
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Served-By") != "self:8080" {
+		t.Fatalf("expected local read, got %d from %q", rr.Code, rr.Header().Get("X-Served-By"))
+	}
+
+	rr = get("/get/k?read_policy=primary_only", "")
+	var body map[string]string
+	json.NewDecoder(rr.Body).Decode(&body)
+	if rr.Code != http.StatusOK || body["value"] != "remote" || rr.Header().Get("X-Served-By") != remote.URL[7:] {
+		t.Fatalf("expected primary read, got %d %v", rr.Code, body)
+	}
+
+	if rr = get("/get/k", "fastest"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown policy, got %d", rr.Code)
+	}
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handlers := NewHandlers(storage.NewAtomicStorage(store), NewMockReplicator(), nil)
+	cache := NewIdempotencyCache(time.Minute, 2)
+	increment := cache.Middleware(http.HandlerFunc(handlers.IncrementHandler))
+
+	do := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/advanced/increment", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(IdempotencyHeader, key)
+		}
+		rr := httptest.NewRecorder()
+		increment.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := do("k1", `{"key":"c","delta":1}`)
+	retry := do("k1", `{"key":"c","delta":1}`)
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the first response replayed, got %d %q", retry.Code, retry.Body.String())
+	}
+	if value, _ := store.Get("c"); value != "1" {
+		t.Errorf("Expected a retry not to be applied, got %s", value)
+	}
+	if rr := do("k1", `{"key":"c","delta":5}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a key reused for another request, got %d", rr.Code)
+	}
+
+	do("", `{"key":"c","delta":1}`)
+	do("", `{"key":"c","delta":1}`)
+	if value, _ := store.Get("c"); value != "3" {
+		t.Errorf("Expected requests without a key to be applied, got %s", value)
+	}
+
+	// Beyond max entries, the oldest keys are forgotten
+	do("k2", `{"key":"c","delta":1}`)
+	do("k3", `{"key":"c","delta":1}`)
+	if rr := do("k1", `{"key":"c","delta":1}`); rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("Expected the oldest key to be evicted")
+	}
+}
+
+func TestIdempotencyMiddleware_Failures(t *testing.T) {
+	write := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch string(body) {
+		case "panic":
+			panic("handler failed")
+		case "fail":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+			w.Write(body)
+		}
+	})
+	handler := NewIdempotencyCache(time.Minute, 3).Middleware(write)
+	do := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/set", strings.NewReader(body))
+		req.Header.Set(IdempotencyHeader, key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A panic leaves no entry behind that retries would wait on
+	func() {
+		defer func() { recover() }()
+		do("p", "panic")
+	}()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- do("p", "ok") }()
+	select {
+	case rr := <-done:
+		if rr.Code != http.StatusOK || rr.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("Expected the retry to be applied, got %d", rr.Code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Retry after a panic blocked")
+	}
+
+	// A failed write is forgotten, also from the eviction order: the key
+	// stored again is evicted by its own age
+	cache := NewIdempotencyCache(time.Minute, 3)
+	handler = cache.Middleware(write)
+	do("k0", "0")
+	do("k1", "fail")
+	do("k2", "2")
+	do("k1", "1")
+	do("k3", "3")
+	do("k4", "4")
+	if _, ok := cache.entries["k1"]; !ok {
+		t.Error("Expected k1, stored after k2, to outlive it")
+	}
+	if _, ok := cache.entries["k2"]; ok {
+		t.Error("Expected k2, the oldest, to be evicted")
+	}
+	if len(cache.order) != len(cache.entries) {
+		t.Errorf("Expected one key in the eviction order per entry, got %v", cache.order)
+	}
+
+	big := strings.Repeat("x", maxIdempotentBody+1)
+	if rr := do("big", big); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a body over the limit, got %d", rr.Code)
+	}
+
+	// Responses over the limit are sent but not kept
+	large := strings.Repeat("x", maxIdempotentResponse+1)
+	if rr := do("large", large); rr.Code != http.StatusOK || rr.Body.Len() != len(large) {
+		t.Errorf("Expected the large response to be sent, got %d with %d bytes", rr.Code, rr.Body.Len())
+	}
+	if _, ok := cache.entries["large"]; ok {
+		t.Error("Expected a response over the limit not to be kept")
+	}
+	if rr := do("large", large); rr.Header().Get("Idempotent-Replayed") != "" || rr.Body.Len() != len(large) {
+		t.Error("Expected the retry of a large response to be applied")
+	}
+}
+
+func TestClusterHandlers(t *testing.T) {
+	replicator := NewMockReplicator()
+	replicator.nodes = []string{"node1:8080", "node2:8080"}
+	replicator.replicaCount = 2
+	handlers := NewHandlers(storage.NewMemoryStorage(), replicator, nil)
+
+	rr := httptest.NewRecorder()
+	handlers.ClusterNodesHandler(rr, httptest.NewRequest("GET", "/cluster/nodes", nil))
+	var nodes struct {
+		Nodes        []string
+		ReplicaCount int `json:"replica_count"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &nodes)
+	if len(nodes.Nodes) != 2 || nodes.ReplicaCount != 2 {
+		t.Errorf("Expected 2 nodes, got %s", rr.Body.String())
+	}
+
+	placement := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handlers.PlacementHandler(rr, httptest.NewRequest("GET", target, nil))
+		return rr
+	}
+	if rr := placement("/cluster/placement?key=a"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without placement, got %d", rr.Code)
+	}
+	handlers.Placement = func(key string) []string {
+		if key == "a" {
+			return []string{"node2:8080", "node1:8080"}
+		}
+		return []string{"node1:8080", "node2:8080"}
+	}
+	if rr := placement("/cluster/placement"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a key, got %d", rr.Code)
+	}
+	var resp struct{ Placement map[string][]string }
+	json.Unmarshal(placement("/cluster/placement?key=a&key=b").Body.Bytes(), &resp)
+	if resp.Placement["a"][0] != "node2:8080" || resp.Placement["b"][0] != "node1:8080" {
+		t.Errorf("Expected the owner of each key first, got %+v", resp.Placement)
+	}
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"distore/auth"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyHeader names the header a client sets to make a write safe to
+// retry: a retried request with the same value gets the first response
+// back instead of being applied again
+const IdempotencyHeader = "Idempotency-Key"
+
+// maxIdempotentBody bounds the request bodies read for their fingerprint, as
+// the guard does when it reads the keys of a request
+const maxIdempotentBody = 32 << 20
+
+// maxIdempotentResponse bounds the response bodies kept for replay. Larger
+// responses, such as backups, are not kept and their retries are applied again.
+const maxIdempotentResponse = 1 << 20
+
+// IdempotencyCache remembers the responses of the writes sent with an
+// idempotency key, per caller, for a while. It is kept by each node, so a
+// retry must go to the node of the first attempt.
+type IdempotencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]*idempotentResponse
+	order   []string // oldest first
+}
+
+type idempotentResponse struct {
+	fingerprint [32]byte      // of the request, a key is only replayed for the same request
+	done        chan struct{} // closed once the response is recorded
+	expires     time.Time
+	status      int
+	header      http.Header
+	body        []byte
+	unrecorded  bool // the response was too large to keep
+}
+
+func NewIdempotencyCache(ttl time.Duration, max int) *IdempotencyCache {
+	return &IdempotencyCache{ttl: ttl, max: max, entries: make(map[string]*idempotentResponse)}
+}
+
+// Middleware replays the response of a write retried with the same
+// idempotency key. It must run after authentication, so that callers do
+// not share keys.
+func (c *IdempotencyCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyHeader)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, "Error reading the request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if claims := auth.ClaimsFrom(r.Context()); claims != nil {
+			key = claims.UserID + "\x00" + claims.TenantID + "\x00" + key
+		}
+		fingerprint := sha256.Sum256(append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), body...))
+
+		entry, first := c.claim(key, fingerprint)
+		if !first {
+			<-entry.done
+			if entry.status == 0 {
+				// The first attempt panicked and was forgotten
+				http.Error(w, "The request with this idempotency key failed, retry it", http.StatusServiceUnavailable)
+				return
+			}
+			if entry.fingerprint != fingerprint {
+				http.Error(w, "Idempotency key reused for another request", http.StatusUnprocessableEntity)
+				return
+			}
+			if entry.unrecorded {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		defer func() {
+			// Failed writes may be retried for real, as may writes whose
+			// handler panicked and recorded nothing or whose response was
+			// too large to keep
+			if entry.status == 0 || entry.status >= 500 || entry.unrecorded {
+				c.forget(key, entry)
+			}
+			close(entry.done)
+		}()
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK, limit: maxIdempotentResponse}
+		next.ServeHTTP(rec, r)
+		entry.status, entry.header, entry.body, entry.unrecorded = rec.status, w.Header().Clone(), rec.body.Bytes(), rec.overflow
+	})
+}
+
+// forget drops entry, the entry of key, so that a retry is applied
+func (c *IdempotencyCache) forget(key string, entry *idempotentResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[key] != entry {
+		return
+	}
+	delete(c.entries, key)
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// claim returns the entry of key, creating it when there is none and
+// telling whether the caller has to fill it
+func (c *IdempotencyCache) claim(key string, fingerprint [32]byte) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for len(c.order) > 0 {
+		oldest, ok := c.entries[c.order[0]]
+		if ok && len(c.entries) < c.max && now.Before(oldest.expires) {
+			break
+		}
+		if ok {
+			delete(c.entries, c.order[0])
+		}
+		c.order = c.order[1:]
+	}
+
+	if entry, ok := c.entries[key]; ok {
+		return entry, false
+	}
+	entry := &idempotentResponse{fingerprint: fingerprint, done: make(chan struct{}), expires: now.Add(c.ttl)}
+	c.entries[key] = entry
+	c.order = append(c.order, key)
+	return entry, true
+}
+
+// recordingWriter copies the response it writes, up to limit bytes
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	limit    int
+	overflow bool // the body went over limit and was dropped
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.body.Len()+len(b) > w.limit {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
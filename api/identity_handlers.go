@@ -0,0 +1,224 @@
+package api
+
+import (
+	"distore/auth"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Revoke the caller's token, and optionally a refresh token or every token
+// of the caller
+func (h *Handlers) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Issuer == nil {
+		http.Error(w, "Authentication is disabled", http.StatusServiceUnavailable)
+		return
+	}
+	claims := auth.ClaimsFrom(r.Context())
+	if claims == nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+		All          bool   `json:"all"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := h.Issuer.Logout(claims, req.RefreshToken, req.All)
+	h.auditLogout(r, req.All, err)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			http.Error(w, "Invalid refresh token", http.StatusBadRequest)
+		} else if errors.Is(err, auth.ErrExternalToken) {
+			http.Error(w, "Tokens of external issuers are revoked by their issuer", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "logged out"})
+}
+
+// Public keys tokens of the cluster are signed with, for clients verifying
+// them on their own
+func (h *Handlers) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Signer == nil {
+		http.Error(w, "Authentication is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	json.NewEncoder(w).Encode(h.Signer.JWKS())
+}
+
+// Admin: list identities
+func (h *Handlers) ListIdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Issuer == nil {
+		http.Error(w, "Authentication is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"identities": h.Issuer.Identities().List(),
+	})
+}
+
+// Admin: get one identity
+func (h *Handlers) GetIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Issuer == nil {
+		http.Error(w, "Authentication is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	for _, ident := range h.Issuer.Identities().List() {
+		if ident.ID == mux.Vars(r)["id"] {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ident)
+			return
+		}
+	}
+	http.Error(w, auth.ErrIdentityNotFound.Error(), http.StatusNotFound)
+}
+
+// Admin: create or update a user or service account
+func (h *Handlers) PutIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Issuer == nil {
+		http.Error(w, "Authentication is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var spec auth.IdentitySpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	ident, secret, err := h.Issuer.Identities().Put(id, spec)
+	if err != nil {
+		writeIdentityError(w, err)
+		return
+	}
+	log.Printf("Identity %s updated by admin", id)
+
+	resp := map[string]interface{}{"identity": ident}
+	if secret != "" {
+		resp["client_secret"] = secret // only shown now
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Admin: delete an identity, its tokens stop working
+func (h *Handlers) DeleteIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Issuer == nil {
+		http.Error(w, "Authentication is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if err := h.Issuer.Identities().Delete(id); err != nil {
+		writeIdentityError(w, err)
+		return
+	}
+	log.Printf("Identity %s deleted by admin", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted", "id": id})
+}
+
+// Admin: create an API key for an identity
+func (h *Handlers) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Issuer == nil {
+		http.Error(w, "Authentication is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	id := mux.Vars(r)["id"]
+	key, apiKey, err := h.Issuer.Identities().AddAPIKey(id, req.Name)
+	if err != nil {
+		writeIdentityError(w, err)
+		return
+	}
+	log.Printf("API key %s created for identity %s", apiKey.ID, id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"api_key": key, // only shown now
+		"key":     apiKey,
+	})
+}
+
+// Admin: delete an API key
+func (h *Handlers) DeleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Issuer == nil {
+		http.Error(w, "Authentication is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	if err := h.Issuer.Identities().DeleteAPIKey(vars["id"], vars["key_id"]); err != nil {
+		writeIdentityError(w, err)
+		return
+	}
+	log.Printf("API key %s of identity %s deleted by admin", vars["key_id"], vars["id"])
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted", "key_id": vars["key_id"]})
+}
+
+// Admin: revoke every token issued to an identity so far
+func (h *Handlers) RevokeIdentityTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Issuer == nil {
+		http.Error(w, "Authentication is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if err := h.Issuer.Identities().RevokeTokens(id); err != nil {
+		writeIdentityError(w, err)
+		return
+	}
+	log.Printf("Tokens of identity %s revoked by admin", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked", "id": id})
+}
+
+func writeIdentityError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrIdentityNotFound), errors.Is(err, auth.ErrAPIKeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, auth.ErrInvalidIdentity):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
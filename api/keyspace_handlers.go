@@ -0,0 +1,169 @@
+package api
+
+import (
+	"distore/cluster"
+	"distore/replication"
+	"distore/storage"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// applyKeyspaceTTL sets the default TTL of the key's keyspace after a plain set
+func (h *Handlers) applyKeyspaceTTL(key string) {
+	if h.Keyspaces == nil {
+		return
+	}
+	ks, ok := h.Keyspaces.Resolve(key)
+	if !ok || ks.DefaultTTL <= 0 {
+		return
+	}
+
+	ttlStorage := storage.FindTTLStorage(h.storage)
+	if ttlStorage == nil {
+		return
+	}
+	if err := ttlStorage.Expire(key, ks.TTL()); err != nil {
+		log.Printf("Error applying keyspace %s TTL to %s: %v", ks.Name, key, err)
+	}
+}
+
+// Admin: list keyspaces
+func (h *Handlers) ListKeyspacesHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Keyspaces == nil {
+		http.Error(w, "keyspaces not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keyspaces": h.Keyspaces.List(),
+		"default": map[string]interface{}{
+			"name":               replication.DefaultKeyspace,
+			"replication_factor": h.replicator.GetReplicaCount(),
+		},
+	})
+}
+
+// Admin: get one keyspace
+func (h *Handlers) GetKeyspaceHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Keyspaces == nil {
+		http.Error(w, "keyspaces not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	ks, ok := h.Keyspaces.Get(mux.Vars(r)["name"])
+	if !ok {
+		http.Error(w, replication.ErrKeyspaceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ks)
+}
+
+// Admin: create or replace a keyspace
+func (h *Handlers) PutKeyspaceHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Keyspaces == nil {
+		http.Error(w, "keyspaces not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var ks replication.Keyspace
+	if err := json.NewDecoder(r.Body).Decode(&ks); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if name := mux.Vars(r)["name"]; name != "" {
+		ks.Name = name
+	}
+
+	if err := h.Keyspaces.Put(ks); err != nil {
+		if errors.Is(err, replication.ErrInvalidKeyspace) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := h.recordKeyspaces(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Keyspace %s updated by admin", ks.Name)
+
+	stored, _ := h.Keyspaces.Get(ks.Name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stored)
+}
+
+// Admin: delete a keyspace (its keys fall back to the default replication)
+func (h *Handlers) DeleteKeyspaceHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Keyspaces == nil {
+		http.Error(w, "keyspaces not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if !h.Keyspaces.Delete(name) {
+		http.Error(w, replication.ErrKeyspaceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err := h.recordKeyspaces(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Keyspace %s deleted by admin", name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted", "name": name})
+}
+
+// Admin: show which keyspace and replicas a key maps to
+func (h *Handlers) ResolveKeyspaceHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Keyspaces == nil {
+		http.Error(w, "keyspaces not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+
+	nodes := h.replicator.GetNodes()
+	result := map[string]interface{}{"key": key}
+	if ks, ok := h.Keyspaces.Resolve(key); ok {
+		result["keyspace"] = ks.Name
+		result["replicas"] = h.Keyspaces.Replicas(ks, key, nodes)
+		result["write_consistency"] = ks.WriteConsistency
+		result["read_consistency"] = ks.ReadConsistency
+		result["default_ttl"] = ks.DefaultTTL
+	} else {
+		count := h.replicator.GetReplicaCount()
+		if count > len(nodes) {
+			count = len(nodes)
+		}
+		result["keyspace"] = replication.DefaultKeyspace
+		result["replicas"] = nodes[:count]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// recordKeyspaces stores the keyspaces in the cluster metadata so that every
+// node applies them
+func (h *Handlers) recordKeyspaces() error {
+	if h.Metadata == nil {
+		return nil
+	}
+	_, err := h.Metadata.Update(func(meta *cluster.ClusterMetadata) error {
+		meta.Keyspaces = h.Keyspaces.Configs()
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,27 @@
+package api
+
+import (
+	"distore/auth"
+	"distore/quota"
+	"encoding/json"
+	"net/http"
+)
+
+// Admin: usage and limits of the tenants on this node. Tenant admins only
+// see their own tenant.
+func (h *Handlers) QuotasHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Quotas == nil {
+		http.Error(w, "Quotas are disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var usage []quota.TenantUsage
+	if h.isClusterAdmin(r) {
+		usage = h.Quotas.Usage()
+	} else {
+		usage = []quota.TenantUsage{h.Quotas.UsageOf(auth.TenantOf(auth.ClaimsFrom(r.Context())))}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tenants": usage})
+}
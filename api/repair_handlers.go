@@ -0,0 +1,107 @@
+package api
+
+import (
+	"distore/cluster"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Admin: hints kept by this node for unreachable nodes
+func (h *Handlers) HintsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Hints == nil {
+		http.Error(w, "hinted handoff is not enabled on a single node", http.StatusServiceUnavailable)
+		return
+	}
+	stats := h.Hints.Stats()
+	total := 0
+	for _, s := range stats {
+		total += s.Hints
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": stats, "total": total})
+}
+
+// Admin: deliver the hints now instead of at the next retry
+func (h *Handlers) DeliverHintsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Hints == nil {
+		http.Error(w, "hinted handoff is not enabled on a single node", http.StatusServiceUnavailable)
+		return
+	}
+	delivered, remaining := h.Hints.Deliver()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"delivered": delivered, "remaining": remaining})
+}
+
+// Admin: discard the hints of a node, e.g. one removed for good
+func (h *Handlers) DropHintsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Hints == nil {
+		http.Error(w, "hinted handoff is not enabled on a single node", http.StatusServiceUnavailable)
+		return
+	}
+	node := mux.Vars(r)["node"]
+	dropped, err := h.Hints.Drop(node)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"node": node, "dropped": dropped})
+}
+
+// Admin: start a repair of the replicas of this node's keys, optionally
+// of one node only
+func (h *Handlers) StartRepairHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Repairer == nil {
+		http.Error(w, "repair not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req struct {
+		Node string `json:"node"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.Repairer.Start(req.Node); err != nil {
+		if err == cluster.ErrRepairInProgress {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(h.Repairer.Progress())
+}
+
+// Admin: repair progress
+func (h *Handlers) RepairStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Repairer == nil {
+		http.Error(w, "repair not configured", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Repairer.Progress())
+}
+
+// Admin: cancel the running repair
+func (h *Handlers) CancelRepairHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Repairer == nil {
+		http.Error(w, "repair not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if err := h.Repairer.Cancel(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Repairer.Progress())
+}
@@ -0,0 +1,261 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"distore/auth"
+	"distore/config"
+	"distore/storage"
+
+	"github.com/gorilla/mux"
+)
+
+func openTestLog(t *testing.T, dir string, cfg config.AuditConfig) *Log {
+	t.Helper()
+	l, err := Open(dir, "node1", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestLog_ChainSurvivesRestarts(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, dir, config.AuditConfig{SegmentBytes: 600})
+	for i := 0; i < 5; i++ {
+		l.Record(Event{Category: CategoryData, Operation: "set", Key: "acme:a", Outcome: OutcomeSuccess})
+	}
+	l.Close()
+
+	l = openTestLog(t, dir, config.AuditConfig{SegmentBytes: 600})
+	e, err := l.Append(Event{Category: CategoryData, Operation: "delete", Key: "acme:a", Outcome: OutcomeSuccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Seq != 6 || e.Version != 6 || e.Node != "node1" {
+		t.Errorf("Expected event 6 of version 6 after a restart, got %+v", e)
+	}
+
+	report, err := Verify(dir)
+	if err != nil {
+		t.Fatalf("Valid log rejected: %v", err)
+	}
+	if report.Events != 6 || report.Segments < 2 || report.Anchor != "" || report.Head != e.Hash {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if seq, head := l.Head(); seq != 6 || head != e.Hash {
+		t.Errorf("Unexpected head %d %s", seq, head)
+	}
+}
+
+func TestVerify_DetectsTampering(t *testing.T) {
+	write := func() string {
+		dir := t.TempDir()
+		l := openTestLog(t, dir, config.AuditConfig{})
+		for _, principal := range []string{"alice", "bob", "carol"} {
+			l.Record(Event{Category: CategoryData, Principal: principal, Operation: "set", Key: "k", Outcome: OutcomeSuccess})
+		}
+		l.Close()
+		return dir
+	}
+	segment := func(dir string) string { return filepath.Join(dir, segmentName(1)) }
+
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+		seq    uint64
+	}{
+		{"changed", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"bob"`, `"mallory"`, 1)
+			return lines
+		}, 2},
+		{"removed", func(lines []string) []string { return append(lines[:1], lines[2:]...) }, 3},
+		{"reordered", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := write()
+			data, _ := os.ReadFile(segment(dir))
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			os.WriteFile(segment(dir), []byte(strings.Join(tt.tamper(lines), "\n")+"\n"), 0600)
+
+			_, err := Verify(dir)
+			var chainErr *ChainError
+			if !errors.As(err, &chainErr) || chainErr.Seq != tt.seq {
+				t.Errorf("Expected the chain to break at event %d, got %v", tt.seq, err)
+			}
+		})
+	}
+}
+
+func TestLog_RetentionKeepsAnchor(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, dir, config.AuditConfig{SegmentBytes: 300, RetentionDays: 1})
+	clock := time.Now()
+	l.now = func() time.Time { return clock }
+
+	var last Event
+	for i := 0; i < 4; i++ {
+		last, _ = l.Append(Event{Category: CategoryAuth, Operation: "token password", Outcome: OutcomeSuccess})
+	}
+	segments, _ := segmentsIn(dir)
+	if len(segments) < 3 {
+		t.Fatalf("Expected several segments, got %v", segments)
+	}
+
+	// A new segment prunes the full ones older than the retention
+	clock = clock.Add(49 * time.Hour)
+	l.Append(Event{Category: CategoryAuth, Operation: "logout", Outcome: OutcomeSuccess})
+	if remaining, _ := segmentsIn(dir); len(remaining) != 1 {
+		t.Fatalf("Expected only the current segment to be kept, got %v", remaining)
+	}
+
+	report, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FirstSeq != 5 || report.Anchor != last.Hash {
+		t.Errorf("Expected the chain to start at event 5 anchored to %s, got %+v", last.Hash, report)
+	}
+}
+
+func TestLog_Query(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), config.AuditConfig{})
+	l.Record(Event{Category: CategoryData, Tenant: "acme", Principal: "alice", Operation: "set", Key: "acme:a", Outcome: OutcomeSuccess})
+	l.Record(Event{Category: CategoryData, Tenant: "other", Principal: "bob", Operation: "set", Key: "other:a", Outcome: OutcomeSuccess})
+	l.Record(Event{Category: CategoryData, Tenant: "acme", Principal: "bob", Operation: "delete", Key: "acme:a", Outcome: OutcomeSuccess})
+	l.Record(Event{Category: CategoryAdmin, Tenant: "acme", Principal: "alice", Operation: "POST /admin/restore", Outcome: OutcomeFailed})
+
+	events, err := l.Query(Filter{Key: "acme:a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Operation != "set" || events[1].Version != 2 {
+		t.Errorf("Expected both writes of acme:a in order, got %+v", events)
+	}
+	if events, _ := l.Query(Filter{Tenant: "acme", Limit: 2}); len(events) != 2 || events[1].Category != CategoryAdmin {
+		t.Errorf("Expected the 2 most recent events of acme, got %+v", events)
+	}
+	if events, _ := l.Query(Filter{Since: time.Now().Add(time.Hour)}); len(events) != 0 {
+		t.Errorf("Expected no future events, got %+v", events)
+	}
+}
+
+func TestDataMiddleware(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Set("acme:a", "old")
+	l := openTestLog(t, t.TempDir(), config.AuditConfig{Values: "full"})
+
+	router := mux.NewRouter()
+	router.Use(l.DataMiddleware(store))
+	router.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+		var kv storage.KeyValue
+		json.NewDecoder(r.Body).Decode(&kv)
+		if kv.Value == "" {
+			http.Error(w, "Value is required", http.StatusBadRequest)
+			return
+		}
+		store.Set("acme:"+kv.Key, kv.Value)
+		w.WriteHeader(http.StatusCreated)
+	}).Methods("POST")
+	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+
+	do := func(method, path, body string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		claims := &auth.Claims{UserID: "alice", TenantID: "acme", Roles: []string{"write"}}
+		req = req.WithContext(context.WithValue(req.Context(), "claims", claims))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	do("POST", "/set", `{"key":"a","value":"new"}`)
+	do("POST", "/set", `{"key":"a"}`)
+	do("GET", "/get/a", "")
+
+	events, _ := l.Query(Filter{})
+	if len(events) != 2 {
+		t.Fatalf("Expected the 2 writes only, got %+v", events)
+	}
+	set := events[0]
+	if set.Principal != "alice" || set.Tenant != "acme" || set.Key != "acme:a" || set.Version != 1 ||
+		*set.Before != "old" || *set.After != "new" || set.Outcome != OutcomeSuccess || set.Status != http.StatusCreated {
+		t.Errorf("Unexpected event %+v", set)
+	}
+	if failed := events[1]; failed.Outcome != OutcomeFailed || failed.After != nil || failed.Version != 0 {
+		t.Errorf("Expected a failed write without a version, got %+v", failed)
+	}
+
+	// Hashed values do not reveal the value
+	l.SetConfig(config.AuditConfig{Values: "hash"})
+	do("POST", "/set", `{"key":"a","value":"secret"}`)
+	events, _ = l.Query(Filter{Limit: 1})
+	after := *events[0].After
+	if !strings.HasPrefix(after, "hmac-sha256:") || strings.Contains(after, "secret") {
+		t.Errorf("Expected a hashed value, got %s", after)
+	}
+	// The hash is keyed, so it cannot be recomputed from a guessed value
+	sum := sha256.Sum256([]byte("secret"))
+	if strings.HasSuffix(after, hex.EncodeToString(sum[:])) {
+		t.Error("Expected values to be hashed with the key of the log")
+	}
+	// The key outlives the node, keeping hashes of the same value comparable
+	reopened := openTestLog(t, l.Dir(), config.AuditConfig{})
+	if !bytes.Equal(reopened.valueKey, l.valueKey) {
+		t.Error("Expected the value key to be kept in the log directory")
+	}
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), config.AuditConfig{})
+	router := mux.NewRouter()
+	router.Use(l.AdminMiddleware)
+	var body []byte
+	handler := func(w http.ResponseWriter, r *http.Request) { body, _ = io.ReadAll(r.Body) }
+	router.HandleFunc("/admin/identities/{id}", handler).Methods("GET", "PUT")
+
+	put := `{"tenant_id":"acme","roles":["admin"],"secret":"hunter22"}`
+	for _, method := range []string{"GET", "PUT"} {
+		req := httptest.NewRequest(method, "/admin/identities/alice", bytes.NewBufferString(put))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if string(body) != put {
+		t.Errorf("Handler got %q", body)
+	}
+
+	events, _ := l.Query(Filter{})
+	if len(events) != 1 {
+		t.Fatalf("Expected the PUT only, got %+v", events)
+	}
+	e := events[0]
+	if e.Operation != "PUT /admin/identities/{id}" || e.Target["id"] != "alice" || e.Target["roles"] != `["admin"]` || e.Target["tenant_id"] != "acme" {
+		t.Errorf("Unexpected event %+v", e)
+	}
+	if _, ok := e.Target["secret"]; ok {
+		t.Error("Secret kept in the audit log")
+	}
+}
+
+func TestAuditor_RecordsDenials(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), config.AuditConfig{})
+	l.Auditor().Record(auth.AuditEvent{UserID: "bob", TenantID: "acme", Method: "POST", Path: "/set", Key: "a", Action: "write", Reason: "denied by access policy"})
+
+	events, _ := l.Query(Filter{Outcome: OutcomeDenied})
+	if len(events) != 1 || events[0].Key != "acme:a" || events[0].Category != CategoryAuth || events[0].Target["action"] != "write" {
+		t.Errorf("Unexpected events %+v", events)
+	}
+}
@@ -0,0 +1,427 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"distore/config"
+)
+
+// Event categories
+const (
+	CategoryData  = "data"
+	CategoryAdmin = "admin"
+	CategoryAuth  = "auth"
+)
+
+// Outcomes
+const (
+	OutcomeSuccess  = "success"
+	OutcomeDenied   = "denied"   // authentication or authorization failed
+	OutcomeRejected = "rejected" // over a quota or rate limit, or the node is read-only
+	OutcomeFailed   = "failed"
+)
+
+const defaultSegmentBytes = 64 << 20
+
+// valueKeyFile holds the key that values are hashed with in "hash" mode, so
+// that the events alone do not allow guessing low-entropy values
+const valueKeyFile = "value.key"
+
+// Event is an entry of the audit log. Hash covers every other field and the
+// hash of the previous event, so that changing, inserting or removing an
+// event breaks the chain from there on.
+type Event struct {
+	Seq       uint64            `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Node      string            `json:"node,omitempty"`
+	Category  string            `json:"category"`
+	Principal string            `json:"principal,omitempty"` // user or client of the token
+	Tenant    string            `json:"tenant,omitempty"`
+	Roles     []string          `json:"roles,omitempty"`
+	Operation string            `json:"operation"`
+	Key       string            `json:"key,omitempty"`     // stored key, tenant prefix included
+	Version   uint64            `json:"version,omitempty"` // writes of the key logged so far, this one included
+	Before    *string           `json:"before,omitempty"`  // value before the write, absent for a new key
+	After     *string           `json:"after,omitempty"`   // value after the write, absent once deleted
+	Target    map[string]string `json:"target,omitempty"`  // what an admin action applies to
+	Outcome   string            `json:"outcome"`
+	Status    int               `json:"status,omitempty"`
+	Reason    string            `json:"reason,omitempty"`
+	ClientIP  string            `json:"client_ip,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash"`
+}
+
+// hash computes the hash of e chained to its PrevHash
+func (e Event) hash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(e.PrevHash), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log is an append-only, hash-chained audit log. It is written to segment
+// files named after the sequence number of their first event; full
+// segments are deleted once older than the retention.
+type Log struct {
+	mu       sync.Mutex
+	dir      string
+	node     string
+	cfg      config.AuditConfig
+	file     *os.File
+	size     int64
+	seq      uint64            // of the last event
+	head     string            // hash of the last event
+	versions map[string]uint64 // by key, see Event.Version
+	valueKey []byte            // HMAC key of hashed values
+	now      func() time.Time
+}
+
+// Open opens the log in dir, continuing the chain of the events already
+// there. node names this node in the events.
+func Open(dir, node string, cfg config.AuditConfig) (*Log, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, node: node, cfg: cfg, versions: make(map[string]uint64), now: time.Now}
+	var err error
+	if l.valueKey, err = loadValueKey(filepath.Join(dir, valueKeyFile)); err != nil {
+		return nil, fmt.Errorf("value key: %w", err)
+	}
+
+	segments, err := segmentsIn(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range segments {
+		last := i == len(segments)-1
+		if last {
+			if err := repairTail(filepath.Join(dir, name)); err != nil {
+				return nil, err
+			}
+		}
+		err := scanSegment(filepath.Join(dir, name), func(e Event) bool {
+			l.seq, l.head = e.Seq, e.Hash
+			if e.Version > l.versions[e.Key] {
+				l.versions[e.Key] = e.Version
+			}
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+	}
+
+	if len(segments) > 0 {
+		path := filepath.Join(dir, segments[len(segments)-1])
+		if l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return nil, err
+		}
+		info, err := l.file.Stat()
+		if err != nil {
+			l.file.Close()
+			return nil, err
+		}
+		l.size = info.Size()
+	}
+	l.prune()
+	return l, nil
+}
+
+// SetConfig changes how values are kept, the segment size and the
+// retention of a running log
+func (l *Log) SetConfig(cfg config.AuditConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+}
+
+// Dir returns the directory of the log
+func (l *Log) Dir() string {
+	return l.dir
+}
+
+// Head returns the sequence number and hash of the last event. Keeping it
+// outside of the node lets a verification detect a truncated log.
+func (l *Log) Head() (uint64, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq, l.head
+}
+
+// Append chains e to the log and writes it. Seq, Time, Node, the version
+// of a key and the hashes are filled in.
+func (l *Log) Append(e Event) (Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	e.Time = l.now().UTC()
+	if e.Node == "" {
+		e.Node = l.node
+	}
+	if e.Key != "" && e.Category == CategoryData && e.Outcome == OutcomeSuccess {
+		e.Version = l.versions[e.Key] + 1
+	}
+	e.PrevHash = l.head
+	hash, err := e.hash()
+	if err != nil {
+		return e, err
+	}
+	e.Hash = hash
+	line, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+	line = append(line, '\n')
+
+	if l.file == nil || l.size+int64(len(line)) > l.segmentBytes() && l.size > 0 {
+		if err := l.rotate(e.Seq); err != nil {
+			return e, err
+		}
+	}
+	if _, err := l.file.Write(line); err != nil {
+		return e, err
+	}
+	if l.cfg.Sync {
+		if err := l.file.Sync(); err != nil {
+			return e, err
+		}
+	}
+	l.size += int64(len(line))
+	l.seq, l.head = e.Seq, e.Hash
+	if e.Version > 0 {
+		l.versions[e.Key] = e.Version
+	}
+	return e, nil
+}
+
+func (l *Log) segmentBytes() int64 {
+	if l.cfg.SegmentBytes > 0 {
+		return l.cfg.SegmentBytes
+	}
+	return defaultSegmentBytes
+}
+
+// rotate starts a new segment with the event seq. Called with the lock held.
+func (l *Log) rotate(seq uint64) error {
+	if l.file != nil {
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+		l.file.Close()
+		l.file = nil
+	}
+	file, err := os.OpenFile(filepath.Join(l.dir, segmentName(seq)), os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	l.file, l.size = file, 0
+	l.prune()
+	return nil
+}
+
+// prune deletes the segments before the current one that were last
+// written before the retention. Called with the lock held or before the log
+// is shared.
+func (l *Log) prune() {
+	if l.cfg.RetentionDays <= 0 {
+		return
+	}
+	segments, err := segmentsIn(l.dir)
+	if err != nil {
+		log.Printf("Audit log retention: %v", err)
+		return
+	}
+	cutoff := l.now().Add(-time.Duration(l.cfg.RetentionDays) * 24 * time.Hour)
+	for _, name := range segments[:max(len(segments)-1, 0)] {
+		path := filepath.Join(l.dir, name)
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().After(cutoff) {
+			break
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Audit log retention: %v", err)
+			return
+		}
+		log.Printf("Audit log segment %s deleted after %d days", name, l.cfg.RetentionDays)
+	}
+}
+
+// Close flushes and closes the current segment
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Sync()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file = nil
+	return err
+}
+
+// Filter selects events of the log, empty fields matching anything
+type Filter struct {
+	Category  string
+	Principal string
+	Tenant    string
+	Operation string
+	Key       string
+	Outcome   string
+	Since     time.Time
+	Until     time.Time
+	Limit     int // most recent events returned, default 100
+}
+
+func (f Filter) matches(e Event) bool {
+	return (f.Category == "" || e.Category == f.Category) &&
+		(f.Principal == "" || e.Principal == f.Principal) &&
+		(f.Tenant == "" || e.Tenant == f.Tenant) &&
+		(f.Operation == "" || e.Operation == f.Operation) &&
+		(f.Key == "" || e.Key == f.Key) &&
+		(f.Outcome == "" || e.Outcome == f.Outcome) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Query returns the most recent events matching f, oldest first
+func (l *Log) Query(f Filter) ([]Event, error) {
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+	// Hold the lock so that no event is half written while reading
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	segments, err := segmentsIn(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	for _, name := range segments {
+		err := scanSegment(filepath.Join(l.dir, name), func(e Event) bool {
+			if f.matches(e) {
+				events = append(events, e)
+				if len(events) > f.Limit {
+					events = events[1:]
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+	}
+	return events, nil
+}
+
+func segmentName(firstSeq uint64) string {
+	return fmt.Sprintf("audit-%020d.log", firstSeq)
+}
+
+// segmentsIn lists the segment files of dir, oldest first
+func segmentsIn(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasPrefix(name, "audit-") && strings.HasSuffix(name, ".log") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// loadValueKey reads the HMAC key of the log at path, creating it on first use
+func loadValueKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) < 32 {
+			return nil, fmt.Errorf("%s is shorter than 32 bytes", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(key); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return key, nil
+}
+
+// scanSegment calls fn with each event of a segment until it returns false
+func scanSegment(path string, fn func(Event) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		var e Event
+		if err := json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+}
+
+// repairTail cuts a last line left incomplete by a crash while it was
+// written. Complete lines are never changed.
+func repairTail(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) == 0 || data[len(data)-1] == '\n' {
+		return err
+	}
+	keep := bytes.LastIndexByte(data, '\n') + 1
+	log.Printf("Audit log %s: dropping %d bytes of an incomplete event", filepath.Base(path), len(data)-keep)
+	return os.Truncate(path, int64(keep))
+}
@@ -0,0 +1,254 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"distore/auth"
+	"distore/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// maxInspectedBody bounds how much of an admin request body is read for
+// its target
+const maxInspectedBody = 1 << 20
+
+// dataOperations names the routes whose writes are audited
+var dataOperations = map[string]string{
+	"POST /set":                "set",
+	"DELETE /delete/{key}":     "delete",
+	"POST /advanced/ttl":       "set_ttl",
+	"POST /advanced/increment": "increment",
+	"POST /advanced/batch":     "batch",
+	"POST /advanced/cas":       "cas",
+}
+
+// targetFields are the fields of admin request bodies kept in the target
+// of their events. Secrets and bulk data are left out.
+var targetFields = []string{"node", "nodes", "seeds", "replica_count", "force", "mode", "reason", "path", "full", "kind", "tenant_id", "roles", "disabled", "name"}
+
+// Record appends e, logging a failure: requests are not refused because
+// their audit event could not be written
+func (l *Log) Record(e Event) {
+	if _, err := l.Append(e); err != nil {
+		log.Printf("Error writing audit event %s %s: %v", e.Category, e.Operation, err)
+	}
+}
+
+// RecordRequest records e for r, taking the principal, tenant and roles
+// from the claims of r unless set
+func (l *Log) RecordRequest(r *http.Request, e Event) {
+	if claims := auth.ClaimsFrom(r.Context()); claims != nil && e.Principal == "" {
+		e.Principal, e.Tenant, e.Roles = claims.UserID, auth.TenantOf(claims), claims.Roles
+	}
+	if e.ClientIP == "" {
+		e.ClientIP = r.RemoteAddr
+	}
+	l.Record(e)
+}
+
+// Auditor returns the log as an auth.Auditor, so that the requests the
+// guard denies are chained with the rest
+func (l *Log) Auditor() auth.Auditor {
+	return auditor{l}
+}
+
+type auditor struct{ log *Log }
+
+func (a auditor) Record(d auth.AuditEvent) {
+	e := Event{
+		Category:  CategoryAuth,
+		Principal: d.UserID,
+		Tenant:    d.TenantID,
+		Roles:     d.Roles,
+		Operation: "authorize",
+		Target:    map[string]string{"method": d.Method, "path": d.Path},
+		Outcome:   OutcomeDenied,
+		Status:    http.StatusForbidden,
+		Reason:    d.Reason,
+		ClientIP:  d.ClientIP,
+	}
+	if d.Key != "" {
+		e.Key = auth.TenantKey(&auth.Claims{TenantID: d.TenantID, Roles: d.Roles}, d.Key)
+		e.Target["action"] = d.Action
+	}
+	a.log.Record(e)
+}
+
+// DataMiddleware records the writes of the data routes, with the value of
+// each written key in store before and after the request
+func (l *Log) DataMiddleware(store storage.Storage) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			operation, ok := dataOperations[r.Method+" "+routeOf(r)]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			keys, err := auth.WrittenKeys(r)
+			if err != nil || len(keys) == 0 {
+				next.ServeHTTP(w, r) // the handler rejects the request
+				return
+			}
+
+			claims := auth.ClaimsFrom(r.Context())
+			before := make([]*string, len(keys))
+			for i, key := range keys {
+				keys[i] = auth.TenantKey(claims, key)
+				before[i] = l.valueOf(store, keys[i])
+			}
+
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+
+			outcome := outcomeOf(sw.status)
+			for i, key := range keys {
+				e := Event{Category: CategoryData, Operation: operation, Key: key, Before: before[i], Outcome: outcome, Status: sw.status}
+				if outcome == OutcomeSuccess {
+					e.After = l.valueOf(store, key)
+				}
+				l.RecordRequest(r, e)
+			}
+		})
+	}
+}
+
+// AdminMiddleware records the admin requests that change something, with
+// the route variables and the fields of the body that name what changed
+func (l *Log) AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		target := make(map[string]string)
+		for name, value := range mux.Vars(r) {
+			target[name] = value
+		}
+		if err := bodyTarget(r, target); err != nil {
+			log.Printf("Audit: reading %s %s: %v", r.Method, r.URL.Path, err)
+		}
+		if len(target) == 0 {
+			target = nil
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		l.RecordRequest(r, Event{
+			Category:  CategoryAdmin,
+			Operation: r.Method + " " + routeOf(r),
+			Target:    target,
+			Outcome:   outcomeOf(sw.status),
+			Status:    sw.status,
+		})
+	})
+}
+
+// bodyTarget adds the target fields of a JSON body to target, leaving the
+// body for the handler
+func bodyTarget(r *http.Request, target map[string]string) error {
+	if r.Body == nil || r.ContentLength == 0 {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxInspectedBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+	if err != nil || len(data) > maxInspectedBody {
+		return err // too large to inspect, as restores are
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return nil // the handler reports invalid JSON
+	}
+	for _, name := range targetFields {
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			target[name] = s
+			continue
+		}
+		var compact bytes.Buffer
+		if json.Compact(&compact, raw) == nil {
+			target[name] = compact.String()
+		}
+	}
+	return nil
+}
+
+// valueOf returns the value of key in store as the log keeps it, nil if
+// the key does not exist
+func (l *Log) valueOf(store storage.Storage, key string) *string {
+	value, err := store.Get(key)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		return nil
+	} else if err != nil {
+		log.Printf("Audit: reading %s: %v", key, err)
+		return nil
+	}
+
+	l.mu.Lock()
+	mode := l.cfg.Values
+	l.mu.Unlock()
+	switch mode {
+	case "none":
+		return nil
+	case "full":
+		return &value
+	default:
+		mac := hmac.New(sha256.New, l.valueKey)
+		mac.Write([]byte(value))
+		hashed := "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+		return &hashed
+	}
+}
+
+// outcomeOf classifies a request by its response status
+func outcomeOf(status int) string {
+	switch {
+	case status < 400:
+		return OutcomeSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return OutcomeDenied
+	case status == http.StatusTooManyRequests || status == http.StatusInsufficientStorage || status == http.StatusServiceUnavailable:
+		return OutcomeRejected
+	default:
+		return OutcomeFailed
+	}
+}
+
+// routeOf returns the route template of r, its path outside of a router
+func routeOf(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// statusWriter keeps the status of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
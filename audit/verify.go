@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Report sums up a verified log
+type Report struct {
+	Segments int    `json:"segments"`
+	Events   uint64 `json:"events"`
+	FirstSeq uint64 `json:"first_seq,omitempty"`
+	LastSeq  uint64 `json:"last_seq,omitempty"`
+	Anchor   string `json:"anchor"` // prev_hash of the first event kept, empty if none was deleted
+	Head     string `json:"head"`   // hash of the last event
+}
+
+// ChainError tells where the chain of a log breaks
+type ChainError struct {
+	Segment string
+	Seq     uint64
+	Reason  string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("%s: event %d: %s", e.Segment, e.Seq, e.Reason)
+}
+
+// Verify checks the hash chain of the log in dir: every event must hash to
+// its hash, link to the hash of the event before it and follow it in
+// sequence. Events deleted by the retention are only detected by comparing
+// the anchor, and a truncated end by comparing the head, with values kept
+// elsewhere.
+func Verify(dir string) (*Report, error) {
+	segments, err := segmentsIn(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{Segments: len(segments)}
+	for _, name := range segments {
+		var chainErr *ChainError
+		err := scanSegment(filepath.Join(dir, name), func(e Event) bool {
+			fail := func(format string, args ...interface{}) bool {
+				chainErr = &ChainError{Segment: name, Seq: e.Seq, Reason: fmt.Sprintf(format, args...)}
+				return false
+			}
+			if report.Events == 0 {
+				if e.Seq == 1 && e.PrevHash != "" {
+					return fail("the first event links to a previous one")
+				}
+				if name != segmentName(e.Seq) {
+					return fail("segment does not start with event %d", e.Seq)
+				}
+				report.FirstSeq, report.Anchor = e.Seq, e.PrevHash
+			} else {
+				if e.Seq != report.LastSeq+1 {
+					return fail("follows event %d", report.LastSeq)
+				}
+				if e.PrevHash != report.Head {
+					return fail("prev_hash does not match the hash of event %d", report.LastSeq)
+				}
+			}
+			hash, err := e.hash()
+			if err != nil {
+				return fail("%v", err)
+			}
+			if hash != e.Hash {
+				return fail("content does not match its hash")
+			}
+			report.Events++
+			report.LastSeq, report.Head = e.Seq, e.Hash
+			return true
+		})
+		if chainErr != nil {
+			return report, chainErr
+		}
+		if err != nil {
+			return report, &ChainError{Segment: name, Seq: report.LastSeq + 1, Reason: err.Error()}
+		}
+	}
+	return report, nil
+}
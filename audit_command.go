@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"distore/audit"
+	"distore/config"
+)
+
+// auditDir is where the audit log of cfg is kept
+func auditDir(cfg *config.Config) string {
+	if cfg.Audit.Dir != "" {
+		return cfg.Audit.Dir
+	}
+	return filepath.Join(cfg.DataDir, "audit")
+}
+
+// runAuditCommand implements "distore audit verify", returning the exit code
+func runAuditCommand(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: distore audit verify [-config file | -dir dir] [-head hash] [-json]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	configFile := fs.String("config", "config.json", "Path to a JSON or YAML config file, for the location of the log")
+	dir := fs.String("dir", "", "Directory of the audit log (overrides -config)")
+	head := fs.String("head", "", "Hash the last event must have, as recorded by an earlier verification")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if *dir == "" {
+		cfg, err := newConfigLoader(nil).Load(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *configFile, err)
+			return 1
+		}
+		*dir = auditDir(cfg)
+	}
+
+	report, err := audit.Verify(*dir)
+	var chainErr *audit.ChainError
+	if err != nil && !errors.As(err, &chainErr) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *dir, err)
+		return 1
+	}
+	if err == nil && *head != "" && report.Head != *head {
+		err = fmt.Errorf("the last event has hash %s, expected %s: events were removed from the end", report.Head, *head)
+	}
+
+	if *asJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		fmt.Printf("%s: %d events in %d segments", *dir, report.Events, report.Segments)
+		if report.Events > 0 {
+			fmt.Printf(", seq %d to %d, head %s", report.FirstSeq, report.LastSeq, report.Head)
+		}
+		fmt.Println()
+		if report.Anchor != "" {
+			fmt.Printf("Earlier events were deleted by the retention, the chain starts at %s\n", report.Anchor)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "INVALID: %v\n", err)
+		return 1
+	}
+	if !*asJSON {
+		fmt.Println("OK")
+	}
+	return 0
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// AllTenants as the tenant of an admin token makes a cluster admin, who
+	// sees every tenant's keys and runs cluster-wide operations
+	AllTenants = "*"
+	// DefaultTenant holds the keys of tokens issued without a tenant
+	DefaultTenant = "default"
+)
+
+// maxInspectedBody bounds how much of a request body is read for its keys
+const maxInspectedBody = 32 << 20
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// TenantOf returns the tenant of claims
+func TenantOf(claims *Claims) string {
+	if claims.TenantID == "" {
+		return DefaultTenant
+	}
+	return claims.TenantID
+}
+
+// IsClusterAdmin tells whether claims belong to an admin of all tenants
+func IsClusterAdmin(claims *Claims) bool {
+	return claims != nil && claims.TenantID == AllTenants && hasRole(claims, RoleAdmin)
+}
+
+// TenantPrefix is prepended to the keys of claims' tenant, "" when claims
+// see the whole key space (no auth, cluster admin)
+func TenantPrefix(claims *Claims) string {
+	if claims == nil || IsClusterAdmin(claims) {
+		return ""
+	}
+	return TenantOf(claims) + ":"
+}
+
+// TenantKey returns the stored key for key as named by claims
+func TenantKey(claims *Claims, key string) string {
+	return TenantPrefix(claims) + key
+}
+
+// ClaimsFrom returns the claims AuthMiddleware stored in ctx, or nil
+func ClaimsFrom(ctx context.Context) *Claims {
+	claims, _ := ctx.Value("claims").(*Claims)
+	return claims
+}
+
+// Guard enforces tenant isolation and the access policy, and audits the
+// requests it denies
+type Guard struct {
+	mu      sync.RWMutex
+	policy  *AccessPolicy
+	auditor Auditor
+}
+
+func NewGuard(policy *AccessPolicy, auditor Auditor) *Guard {
+	return &Guard{policy: policy, auditor: auditor}
+}
+
+// SetPolicy replaces the access policy of a running guard
+func (g *Guard) SetPolicy(policy *AccessPolicy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.policy = policy
+}
+
+func (g *Guard) currentPolicy() *AccessPolicy {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.policy
+}
+
+func (g *Guard) deny(w http.ResponseWriter, status int, event AuditEvent, message string) {
+	if g.auditor != nil {
+		g.auditor.Record(event)
+	}
+	http.Error(w, message, status)
+}
+
+// impliedRoles lists the roles that include another: admin can do anything,
+// writers can read
+var impliedRoles = map[Role][]Role{
+	RoleRead:  {RoleWrite, RoleAdmin},
+	RoleWrite: {RoleAdmin},
+}
+
+func grantsRole(claims *Claims, required Role) bool {
+	if hasRole(claims, required) || hasRole(claims, RoleAdmin) {
+		return true
+	}
+	for _, role := range impliedRoles[required] {
+		if hasRole(claims, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// RBAC requires requiredRole or a role including it
+func (g *Guard) RBAC(requiredRole Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := ClaimsFrom(r.Context())
+			if claims == nil {
+				http.Error(w, "Authentication required", http.StatusUnauthorized)
+				return
+			}
+
+			if !grantsRole(claims, requiredRole) {
+				g.deny(w, http.StatusForbidden,
+					newAuditEvent(r, claims, "missing role "+string(requiredRole)), "Insufficient permissions")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Tenant rejects tokens whose tenant could reach into another tenant's keys.
+// Only admins may hold the all-tenants marker.
+func (g *Guard) Tenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := ClaimsFrom(r.Context())
+		if claims == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tenant := TenantOf(claims)
+		if strings.Contains(tenant, ":") || (tenant == AllTenants && !hasRole(claims, RoleAdmin)) {
+			g.deny(w, http.StatusForbidden,
+				newAuditEvent(r, claims, "invalid tenant "+tenant), "Invalid tenant")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminScope lets tenant admins use only the admin routes under
+// tenantPaths, which scope themselves to the tenant; the others change the
+// whole cluster and need a cluster admin
+func (g *Guard) AdminScope(tenantPaths ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := ClaimsFrom(r.Context())
+			if claims == nil || IsClusterAdmin(claims) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for _, path := range tenantPaths {
+				if r.URL.Path == path {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			g.deny(w, http.StatusForbidden,
+				newAuditEvent(r, claims, "cluster admin required"), "Cluster admin required")
+		})
+	}
+}
+
+type accessContextKey struct{}
+
+// KeyAccess checks the keys a request names against the access policy, and
+// leaves the policy in the context for handlers that select keys themselves
+// (see Allowed)
+func (g *Guard) KeyAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := ClaimsFrom(r.Context())
+		if claims == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		policy := g.currentPolicy()
+		keys, err := requestKeys(r)
+		if errors.Is(err, errBodyTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, k := range keys {
+			if !policy.Allowed(claims, k.key, k.action) {
+				event := newAuditEvent(r, claims, "denied by access policy")
+				event.Key, event.Action = k.key, k.action.String()
+				g.deny(w, http.StatusForbidden, event,
+					fmt.Sprintf("Access denied: %s on key %q", k.action, k.key))
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), accessContextKey{}, policy)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Allowed tells whether the caller of r may perform action on key, for
+// handlers that pick keys from a scan. Without auth everything is allowed.
+func Allowed(r *http.Request, key string, action Action) bool {
+	policy, _ := r.Context().Value(accessContextKey{}).(*AccessPolicy)
+	return policy.Allowed(ClaimsFrom(r.Context()), key, action)
+}
+
+// WrittenKeys lists the keys a request writes, as named by the client
+func WrittenKeys(r *http.Request) ([]string, error) {
+	keys, err := requestKeys(r)
+	if err != nil {
+		return nil, err
+	}
+	var written []string
+	for _, k := range keys {
+		if k.action == ActionWrite && k.key != "" {
+			written = append(written, k.key)
+		}
+	}
+	return written, nil
+}
+
+type keyAccess struct {
+	key    string
+	action Action
+}
+
+// requestKeys finds the keys a request names: the {key} route variable and
+// the key, keys and operations[].key fields of a JSON body. GET requests,
+// get operations and key lists (cache preloads) read; the rest writes.
+func requestKeys(r *http.Request) ([]keyAccess, error) {
+	var keys []keyAccess
+	action := ActionWrite
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		action = ActionRead
+	}
+	if key, ok := mux.Vars(r)["key"]; ok {
+		keys = append(keys, keyAccess{key, action})
+	}
+
+	if r.Body == nil || r.ContentLength == 0 || action == ActionRead {
+		return keys, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxInspectedBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading request: %w", err)
+	}
+	if len(data) > maxInspectedBody {
+		return nil, errBodyTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+
+	var body struct {
+		Key        string   `json:"key"`
+		Keys       []string `json:"keys"`
+		Operations []struct {
+			Type string `json:"type"`
+			Key  string `json:"key"`
+		} `json:"operations"`
+	}
+	if json.Unmarshal(data, &body) != nil {
+		return keys, nil // the handler reports invalid JSON
+	}
+	if body.Key != "" {
+		keys = append(keys, keyAccess{body.Key, action})
+	}
+	for _, key := range body.Keys {
+		keys = append(keys, keyAccess{key, ActionRead})
+	}
+	for _, op := range body.Operations {
+		opAction := ActionWrite
+		if op.Type == "get" {
+			opAction = ActionRead
+		}
+		keys = append(keys, keyAccess{op.Key, opAction})
+	}
+	return keys, nil
+}
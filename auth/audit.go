@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AuditEvent describes a request that was denied
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	UserID   string    `json:"user_id,omitempty"`
+	TenantID string    `json:"tenant_id,omitempty"`
+	Roles    []string  `json:"roles,omitempty"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Key      string    `json:"key,omitempty"`
+	Action   string    `json:"action,omitempty"`
+	Reason   string    `json:"reason"`
+	ClientIP string    `json:"client_ip"`
+}
+
+// Auditor records denied requests
+type Auditor interface {
+	Record(event AuditEvent)
+}
+
+// Auditors records events with each of its auditors
+type Auditors []Auditor
+
+func (a Auditors) Record(e AuditEvent) {
+	for _, auditor := range a {
+		auditor.Record(e)
+	}
+}
+
+// LogAuditor writes audit events to the structured log
+type LogAuditor struct{}
+
+func (LogAuditor) Record(e AuditEvent) {
+	logrus.WithFields(logrus.Fields{
+		"audit":     true,
+		"user_id":   e.UserID,
+		"tenant_id": e.TenantID,
+		"roles":     e.Roles,
+		"method":    e.Method,
+		"path":      e.Path,
+		"key":       e.Key,
+		"action":    e.Action,
+		"reason":    e.Reason,
+		"client_ip": e.ClientIP,
+	}).Warn("Access denied")
+}
+
+func newAuditEvent(r *http.Request, claims *Claims, reason string) AuditEvent {
+	e := AuditEvent{
+		Time:     time.Now().UTC(),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Reason:   reason,
+		ClientIP: r.RemoteAddr,
+	}
+	if claims != nil {
+		e.UserID = claims.UserID
+		e.TenantID = claims.TenantID
+		e.Roles = claims.Roles
+	}
+	return e
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -10,20 +11,26 @@ import (
 	"distore/config"
 )
 
-func generateTestKeys() (string, string) {
-	privateKey, _ := rsa.GenerateKey(nil, 2048)
+func generateTestKeys(t *testing.T) (string, string) {
+	t.Helper()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Private key
-	privateKeyBytes := x509.MarshalPKCS1PrivateKey(privateKey)
 	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
 		Type:  "RSA PRIVATE KEY",
-		Bytes: privateKeyBytes,
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
 	})
 
 	// Public key
-	publicKeyBytes, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
 	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
+		Type:  "PUBLIC KEY",
 		Bytes: publicKeyBytes,
 	})
 
@@ -31,7 +38,7 @@ func generateTestKeys() (string, string) {
 }
 
 func TestAuthService_GenerateAndValidateToken(t *testing.T) {
-	privateKey, publicKey := generateTestKeys()
+	privateKey, publicKey := generateTestKeys(t)
 
 	cfg := &config.AuthConfig{
 		Enabled:       true,
@@ -68,7 +75,7 @@ func TestAuthService_GenerateAndValidateToken(t *testing.T) {
 }
 
 func TestAuthService_InvalidToken(t *testing.T) {
-	privateKey, publicKey := generateTestKeys()
+	privateKey, publicKey := generateTestKeys(t)
 
 	cfg := &config.AuthConfig{
 		Enabled:       true,
@@ -90,7 +97,7 @@ func TestAuthService_InvalidToken(t *testing.T) {
 }
 
 func TestAuthService_ExpiredToken(t *testing.T) {
-	privateKey, publicKey := generateTestKeys()
+	privateKey, publicKey := generateTestKeys(t)
 
 	cfg := &config.AuthConfig{
 		Enabled:       true,
@@ -117,3 +124,37 @@ func TestAuthService_ExpiredToken(t *testing.T) {
 		t.Error("Expected error for expired token, got nil")
 	}
 }
+
+func TestAuthService_UpdateKeys(t *testing.T) {
+	oldPrivate, oldPublic := generateTestKeys(t)
+	service, err := NewAuthService(&config.AuthConfig{Enabled: true, PrivateKey: oldPrivate, PublicKey: oldPublic, TokenDuration: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtService, ok := service.(*AuthService)
+	if !ok {
+		t.Fatalf("Expected a JWT auth service, got %T", service)
+	}
+	oldToken, _ := jwtService.GenerateToken("user1", "tenant1", []string{"read"})
+
+	newPrivate, newPublic := generateTestKeys(t)
+	if err := jwtService.UpdateKeys(&config.AuthConfig{PrivateKey: "garbage", PublicKey: newPublic}); err == nil {
+		t.Fatal("Expected invalid key to be rejected")
+	}
+	if err := jwtService.UpdateKeys(&config.AuthConfig{PrivateKey: newPrivate, PublicKey: newPublic, TokenDuration: 60}); err != nil {
+		t.Fatalf("UpdateKeys: %v", err)
+	}
+
+	newToken, _ := jwtService.GenerateToken("user1", "tenant1", []string{"read"})
+	claims, err := jwtService.ValidateToken(newToken)
+	if err != nil {
+		t.Fatalf("New token rejected: %v", err)
+	}
+	if ttl := time.Until(claims.ExpiresAt.Time); ttl > time.Minute {
+		t.Errorf("Expected the new token duration, got %v", ttl)
+	}
+	// Tokens issued before the rotation stay valid until they expire
+	if _, err := jwtService.ValidateToken(oldToken); err != nil {
+		t.Errorf("Token signed with the previous key rejected: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// passwordIterations is the PBKDF2-SHA256 work factor of new hashes; stored
+// hashes carry their own
+var passwordIterations = 600000
+
+var errMalformedHash = errors.New("malformed password hash")
+
+// HashPassword returns a salted PBKDF2-SHA256 hash of password, encoded as
+// pbkdf2-sha256$<iterations>$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword tells whether password matches a hash from HashPassword
+func CheckPassword(hash, password string) bool {
+	ok, err := checkPassword(hash, password)
+	return err == nil && ok
+}
+
+func checkPassword(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false, errMalformedHash
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false, errMalformedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, errMalformedHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, errMalformedHash
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1, nil
+}
+
+// dummyHash is checked against when an identity does not exist, so that
+// unknown and known names take as long to reject
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("distore-dummy-password")
+	return hash
+})
+
+// newSecret returns a random secret for client credentials and API keys
+func newSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// API keys read dsk_<key id>_<secret>. Only a SHA-256 of the secret is
+// stored: the secret is random, so a slow hash adds nothing.
+const apiKeyPrefix = "dsk_"
+
+func newAPIKey() (id, key, hash string) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id = hex.EncodeToString(b)
+	secret := newSecret()
+	return id, apiKeyPrefix + id + "_" + secret, hashAPISecret(secret)
+}
+
+func parseAPIKey(key string) (id, secret string, ok bool) {
+	rest, found := strings.CutPrefix(key, apiKeyPrefix)
+	if !found {
+		return "", "", false
+	}
+	return strings.Cut(rest, "_")
+}
+
+func hashAPISecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
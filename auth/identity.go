@@ -0,0 +1,426 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"distore/config"
+)
+
+// Kinds of identity
+const (
+	KindUser    = "user"
+	KindService = "service"
+)
+
+var (
+	ErrIdentityNotFound = errors.New("identity not found")
+	ErrInvalidIdentity  = errors.New("invalid identity")
+	ErrAPIKeyNotFound   = errors.New("api key not found")
+)
+
+// Identity is a user or service account that tokens are issued to. Tokens
+// carry its tenant and roles; callers cannot pick their own.
+type Identity struct {
+	ID       string   `json:"id"`
+	Kind     string   `json:"kind"`
+	TenantID string   `json:"tenant_id"`
+	Roles    []string `json:"roles"`
+	// SecretHash is the password of a user, the client secret of a service
+	// account (see HashPassword)
+	SecretHash string   `json:"secret_hash,omitempty"`
+	APIKeys    []APIKey `json:"api_keys,omitempty"`
+	Disabled   bool     `json:"disabled,omitempty"`
+	// Generation goes into every token issued to the identity; bumping it
+	// revokes them all (logout from all sessions, secret changes)
+	Generation int       `json:"generation,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RevokedToken keeps a token ID rejected until the token expires
+type RevokedToken struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IdentityState is the identity document every node shares: identities
+// with their hashed credentials, and revoked tokens
+type IdentityState struct {
+	Identities []Identity     `json:"identities,omitempty"`
+	Revoked    []RevokedToken `json:"revoked,omitempty"`
+}
+
+// Clone deep-copies s, storing empty lists as nil so that copies compare equal
+func (s IdentityState) Clone() IdentityState {
+	var c IdentityState
+	for _, id := range s.Identities {
+		c.Identities = append(c.Identities, id.clone())
+	}
+	c.Revoked = append([]RevokedToken(nil), s.Revoked...)
+	return c
+}
+
+// Redacted returns a copy of s without credential hashes
+func (s IdentityState) Redacted() IdentityState {
+	c := s.Clone()
+	for i := range c.Identities {
+		c.Identities[i] = c.Identities[i].redacted()
+	}
+	return c
+}
+
+func (id Identity) clone() Identity {
+	id.Roles = append([]string(nil), id.Roles...)
+	id.APIKeys = append([]APIKey(nil), id.APIKeys...)
+	return id
+}
+
+func (id Identity) redacted() Identity {
+	id.SecretHash = ""
+	keys := make([]APIKey, len(id.APIKeys))
+	for i, key := range id.APIKeys {
+		key.Hash = ""
+		keys[i] = key
+	}
+	id.APIKeys = keys
+	return id
+}
+
+// IdentitySpec creates or updates an identity
+type IdentitySpec struct {
+	Kind     string   `json:"kind"` // "user" (default) or "service"
+	TenantID string   `json:"tenant_id"`
+	Roles    []string `json:"roles"`
+	// Secret is the password of a user, the client secret of a service
+	// account. Service accounts created without one get a generated secret.
+	// Changing it ends the sessions of the identity.
+	Secret   string `json:"secret,omitempty"`
+	Disabled bool   `json:"disabled"`
+}
+
+// Identities holds the identity document of this node. Changes go through
+// the commit function, which with cluster metadata replicates them to every
+// node; Replace installs each document a commit or a peer produces.
+type Identities struct {
+	mu      sync.RWMutex
+	state   IdentityState
+	byID    map[string]int
+	revoked map[string]bool
+	commit  func(change func(*IdentityState) error) error
+}
+
+func NewIdentities() *Identities {
+	s := &Identities{}
+	s.commit = s.applyLocal
+	s.install(IdentityState{})
+	return s
+}
+
+// SetCommit routes changes through commit, which must end up calling Replace
+func (s *Identities) SetCommit(commit func(change func(*IdentityState) error) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commit = commit
+}
+
+func (s *Identities) applyLocal(change func(*IdentityState) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.state.Clone()
+	if err := change(&next); err != nil {
+		return err
+	}
+	s.install(next)
+	return nil
+}
+
+func (s *Identities) update(change func(*IdentityState) error) error {
+	s.mu.RLock()
+	commit := s.commit
+	s.mu.RUnlock()
+	return commit(change)
+}
+
+// Replace installs a new identity document
+func (s *Identities) Replace(state IdentityState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.install(state.Clone())
+}
+
+func (s *Identities) install(state IdentityState) {
+	s.state = state
+	s.byID = make(map[string]int, len(state.Identities))
+	for i, id := range state.Identities {
+		s.byID[id.ID] = i
+	}
+	s.revoked = make(map[string]bool, len(state.Revoked))
+	for _, token := range state.Revoked {
+		s.revoked[token.ID] = true
+	}
+}
+
+// State returns a copy of the identity document
+func (s *Identities) State() IdentityState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state.Clone()
+}
+
+func (s *Identities) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.state.Identities)
+}
+
+// Get returns the identity with its credential hashes
+func (s *Identities) Get(id string) (Identity, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.byID[id]
+	if !ok {
+		return Identity{}, false
+	}
+	return s.state.Identities[i].clone(), true
+}
+
+// List returns the identities sorted by ID, without credential hashes
+func (s *Identities) List() []Identity {
+	list := s.State().Redacted().Identities
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// IsRevoked tells whether the token with ID jti was revoked
+func (s *Identities) IsRevoked(jti string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.revoked[jti]
+}
+
+// findAPIKey returns the identity holding the API key keyID
+func (s *Identities) findAPIKey(keyID string) (Identity, APIKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, id := range s.state.Identities {
+		for _, key := range id.APIKeys {
+			if key.ID == keyID {
+				return id, key, true
+			}
+		}
+	}
+	return Identity{}, APIKey{}, false
+}
+
+// Put creates or updates the identity id. It returns the generated client
+// secret of a new service account, shown only once.
+func (s *Identities) Put(id string, spec IdentitySpec) (Identity, string, error) {
+	if spec.Kind == "" {
+		spec.Kind = KindUser
+	}
+	if err := validateIdentity(id, spec); err != nil {
+		return Identity{}, "", err
+	}
+
+	_, exists := s.Get(id)
+	generated := ""
+	if spec.Secret == "" && !exists {
+		if spec.Kind == KindUser {
+			return Identity{}, "", fmt.Errorf("%w: a password is required", ErrInvalidIdentity)
+		}
+		generated = newSecret()
+		spec.Secret = generated
+	}
+	secretHash := ""
+	if spec.Secret != "" {
+		hash, err := HashPassword(spec.Secret)
+		if err != nil {
+			return Identity{}, "", err
+		}
+		secretHash = hash
+	}
+
+	var stored Identity
+	err := s.update(func(state *IdentityState) error {
+		now := time.Now().UTC()
+		i := indexOf(state, id)
+		if i < 0 {
+			state.Identities = append(state.Identities, Identity{ID: id, CreatedAt: now})
+			i = len(state.Identities) - 1
+		}
+		ident := &state.Identities[i]
+		if ident.Kind != "" && ident.Kind != spec.Kind {
+			return fmt.Errorf("%w: %s is a %s", ErrInvalidIdentity, id, ident.Kind)
+		}
+		ident.Kind = spec.Kind
+		ident.TenantID = spec.TenantID
+		ident.Roles = spec.Roles
+		ident.Disabled = spec.Disabled
+		if secretHash != "" {
+			if ident.SecretHash != "" {
+				ident.Generation++
+			}
+			ident.SecretHash = secretHash
+		}
+		stored = *ident
+		return nil
+	})
+	if err != nil {
+		return Identity{}, "", err
+	}
+	return stored.redacted(), generated, nil
+}
+
+// Bootstrap creates the configured admin of all tenants while no identity
+// exists, reporting whether it did
+func (s *Identities) Bootstrap(cfg config.AuthBootstrapConfig) (bool, error) {
+	if cfg.Password == "" || s.Len() > 0 {
+		return false, nil
+	}
+	user := cfg.User
+	if user == "" {
+		user = "admin"
+	}
+	_, _, err := s.Put(user, IdentitySpec{
+		Kind:     KindUser,
+		TenantID: AllTenants,
+		Roles:    []string{string(RoleAdmin)},
+		Secret:   cfg.Password,
+	})
+	return err == nil, err
+}
+
+// Delete removes an identity; its tokens stop working
+func (s *Identities) Delete(id string) error {
+	return s.update(func(state *IdentityState) error {
+		i := indexOf(state, id)
+		if i < 0 {
+			return ErrIdentityNotFound
+		}
+		state.Identities = append(state.Identities[:i], state.Identities[i+1:]...)
+		return nil
+	})
+}
+
+// AddAPIKey creates an API key for id. The key is returned only once.
+func (s *Identities) AddAPIKey(id, name string) (string, APIKey, error) {
+	keyID, key, hash := newAPIKey()
+	apiKey := APIKey{ID: keyID, Name: name, Hash: hash, CreatedAt: time.Now().UTC()}
+	err := s.update(func(state *IdentityState) error {
+		i := indexOf(state, id)
+		if i < 0 {
+			return ErrIdentityNotFound
+		}
+		state.Identities[i].APIKeys = append(state.Identities[i].APIKeys, apiKey)
+		return nil
+	})
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	apiKey.Hash = ""
+	return key, apiKey, nil
+}
+
+// DeleteAPIKey revokes an API key of id. Tokens already issued for it stay
+// valid until they expire.
+func (s *Identities) DeleteAPIKey(id, keyID string) error {
+	return s.update(func(state *IdentityState) error {
+		i := indexOf(state, id)
+		if i < 0 {
+			return ErrIdentityNotFound
+		}
+		keys := state.Identities[i].APIKeys
+		for k := range keys {
+			if keys[k].ID == keyID {
+				state.Identities[i].APIKeys = append(keys[:k], keys[k+1:]...)
+				return nil
+			}
+		}
+		return ErrAPIKeyNotFound
+	})
+}
+
+// RevokeTokens rejects every token issued to id so far
+func (s *Identities) RevokeTokens(id string) error {
+	return s.update(func(state *IdentityState) error {
+		i := indexOf(state, id)
+		if i < 0 {
+			return ErrIdentityNotFound
+		}
+		state.Identities[i].Generation++
+		return nil
+	})
+}
+
+// RevokeToken rejects the token with ID jti until it expires. Revoking a
+// token twice fails with ErrTokenRevoked, which makes refresh token
+// rotation single use.
+func (s *Identities) RevokeToken(jti string, expiresAt time.Time) error {
+	return s.update(func(state *IdentityState) error {
+		now := time.Now()
+		kept := state.Revoked[:0]
+		for _, token := range state.Revoked {
+			if token.ID == jti {
+				return ErrTokenRevoked
+			}
+			if token.ExpiresAt.After(now) {
+				kept = append(kept, token)
+			}
+		}
+		state.Revoked = append(kept, RevokedToken{ID: jti, ExpiresAt: expiresAt.UTC()})
+		return nil
+	})
+}
+
+func indexOf(state *IdentityState, id string) int {
+	for i := range state.Identities {
+		if state.Identities[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func validateIdentity(id string, spec IdentitySpec) error {
+	if id == "" || strings.ContainsAny(id, ": /") {
+		return fmt.Errorf("%w: id must be non-empty without ':', '/' or spaces", ErrInvalidIdentity)
+	}
+	if spec.Kind != KindUser && spec.Kind != KindService {
+		return fmt.Errorf("%w: kind must be user or service", ErrInvalidIdentity)
+	}
+	if strings.Contains(spec.TenantID, ":") {
+		return fmt.Errorf("%w: tenant_id must not contain ':'", ErrInvalidIdentity)
+	}
+	if spec.Secret != "" && len(spec.Secret) < 8 {
+		return fmt.Errorf("%w: secret must be at least 8 characters", ErrInvalidIdentity)
+	}
+	if len(spec.Roles) == 0 {
+		return fmt.Errorf("%w: at least one role is required", ErrInvalidIdentity)
+	}
+	admin := false
+	for _, role := range spec.Roles {
+		switch Role(role) {
+		case RoleRead, RoleWrite:
+		case RoleAdmin:
+			admin = true
+		default:
+			// replicator tokens are for nodes only
+			return fmt.Errorf("%w: unknown role %q", ErrInvalidIdentity, role)
+		}
+	}
+	if spec.TenantID == AllTenants && !admin {
+		return fmt.Errorf("%w: only admins may have tenant %q", ErrInvalidIdentity, AllTenants)
+	}
+	return nil
+}
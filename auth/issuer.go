@@ -0,0 +1,260 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrTokenRevoked       = errors.New("token revoked")
+)
+
+// TokenPair is what /auth/token answers
+type TokenPair struct {
+	Token        string `json:"token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // seconds
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// Issuer issues tokens to the stored identities and checks every token it
+// validates against revocations and the current state of its identity. It
+// signs with the wrapped service.
+type Issuer struct {
+	tokens     AuthServiceInterface
+	identities *Identities
+
+	mu              sync.RWMutex
+	refreshDuration time.Duration
+	external        map[string]*OIDCVerifier // by issuer
+}
+
+// NewIssuer issues tokens signed by tokens. A refreshDuration of 0 issues
+// no refresh tokens.
+func NewIssuer(tokens AuthServiceInterface, identities *Identities, refreshDuration time.Duration) *Issuer {
+	return &Issuer{tokens: tokens, identities: identities, refreshDuration: refreshDuration}
+}
+
+func (i *Issuer) SetRefreshDuration(d time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.refreshDuration = d
+}
+
+// SetExternalIssuers replaces the external issuers whose tokens are
+// accepted besides our own
+func (i *Issuer) SetExternalIssuers(verifiers []*OIDCVerifier) {
+	external := make(map[string]*OIDCVerifier, len(verifiers))
+	for _, v := range verifiers {
+		external[v.Issuer()] = v
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.external = external
+}
+
+func (i *Issuer) Identities() *Identities {
+	return i.identities
+}
+
+// Password authenticates a user, returning an access and a refresh token
+func (i *Issuer) Password(userID, password string) (*TokenPair, error) {
+	ident, err := i.checkSecret(userID, password, KindUser)
+	if err != nil {
+		return nil, err
+	}
+	return i.issue(ident, true)
+}
+
+// ClientCredentials authenticates a service account. Service accounts can
+// always authenticate again, so they get no refresh token.
+func (i *Issuer) ClientCredentials(clientID, secret string) (*TokenPair, error) {
+	ident, err := i.checkSecret(clientID, secret, KindService)
+	if err != nil {
+		return nil, err
+	}
+	return i.issue(ident, false)
+}
+
+// APIKey exchanges an API key for an access token
+func (i *Issuer) APIKey(key string) (*TokenPair, error) {
+	keyID, secret, ok := parseAPIKey(key)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	ident, apiKey, found := i.identities.findAPIKey(keyID)
+	if !found {
+		return nil, ErrInvalidCredentials
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPISecret(secret)), []byte(apiKey.Hash)) != 1 || ident.Disabled {
+		return nil, ErrInvalidCredentials
+	}
+	return i.issue(ident, false)
+}
+
+// Refresh exchanges a refresh token for new tokens. Each refresh token works
+// once: presenting a used or logged out one again means it leaked, and ends
+// every session of its identity.
+func (i *Issuer) Refresh(refreshToken string) (*TokenPair, error) {
+	claims, err := i.tokens.ValidateToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenUse != TokenUseRefresh {
+		return nil, ErrInvalidToken
+	}
+	if i.identities.IsRevoked(claims.ID) {
+		i.identities.RevokeTokens(claims.UserID)
+		return nil, ErrTokenRevoked
+	}
+	ident, err := i.checkIdentity(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := i.identities.RevokeToken(claims.ID, expiry(claims)); err != nil {
+		if errors.Is(err, ErrTokenRevoked) {
+			i.identities.RevokeTokens(ident.ID)
+		}
+		return nil, err
+	}
+	return i.issue(ident, true)
+}
+
+// Logout revokes the access token of claims and, when given, a refresh
+// token of the same identity. With all, every token of the identity is
+// revoked.
+func (i *Issuer) Logout(claims *Claims, refreshToken string, all bool) error {
+	if claims.Issuer != localIssuer {
+		return ErrExternalToken
+	}
+	if all {
+		return i.identities.RevokeTokens(claims.UserID)
+	}
+	if err := i.identities.RevokeToken(claims.ID, expiry(claims)); err != nil && !errors.Is(err, ErrTokenRevoked) {
+		return err
+	}
+	if refreshToken == "" {
+		return nil
+	}
+
+	refresh, err := i.tokens.ValidateToken(refreshToken)
+	if err != nil || refresh.TokenUse != TokenUseRefresh || refresh.UserID != claims.UserID {
+		return ErrInvalidToken
+	}
+	if err := i.identities.RevokeToken(refresh.ID, expiry(refresh)); err != nil && !errors.Is(err, ErrTokenRevoked) {
+		return err
+	}
+	return nil
+}
+
+func (i *Issuer) GenerateToken(userID, tenantID string, roles []string) (string, error) {
+	return i.tokens.GenerateToken(userID, tenantID, roles)
+}
+
+func (i *Issuer) IssueToken(claims *Claims, duration time.Duration) (string, error) {
+	return i.tokens.IssueToken(claims, duration)
+}
+
+// ValidateToken accepts access tokens of identities that still exist and
+// are enabled, unless the token was revoked, and the tokens of external
+// issuers
+func (i *Issuer) ValidateToken(tokenString string) (*Claims, error) {
+	if verifier := i.externalIssuerOf(tokenString); verifier != nil {
+		return verifier.ValidateToken(tokenString)
+	}
+	claims, err := i.tokens.ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenUse == TokenUseRefresh {
+		return nil, ErrInvalidToken
+	}
+	if _, err := i.checkIdentity(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// externalIssuerOf returns the verifier for the issuer a token claims to be
+// from. The claim is checked again once the signature is.
+func (i *Issuer) externalIssuerOf(tokenString string) *OIDCVerifier {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if len(i.external) == 0 {
+		return nil
+	}
+	var unverified jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, &unverified); err != nil {
+		return nil
+	}
+	return i.external[unverified.Issuer]
+}
+
+func (i *Issuer) checkSecret(id, secret, kind string) (Identity, error) {
+	ident, ok := i.identities.Get(id)
+	if !ok || ident.Kind != kind || ident.SecretHash == "" {
+		CheckPassword(dummyHash(), secret)
+		return Identity{}, ErrInvalidCredentials
+	}
+	if !CheckPassword(ident.SecretHash, secret) || ident.Disabled {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return ident, nil
+}
+
+// checkIdentity returns the identity of claims if the token is still good
+func (i *Issuer) checkIdentity(claims *Claims) (Identity, error) {
+	if claims.ID != "" && i.identities.IsRevoked(claims.ID) {
+		return Identity{}, ErrTokenRevoked
+	}
+	ident, ok := i.identities.Get(claims.UserID)
+	if !ok || ident.Disabled {
+		return Identity{}, ErrTokenRevoked
+	}
+	if claims.Generation != ident.Generation {
+		return Identity{}, ErrTokenRevoked
+	}
+	return ident, nil
+}
+
+func (i *Issuer) issue(ident Identity, withRefresh bool) (*TokenPair, error) {
+	access := &Claims{UserID: ident.ID, TenantID: ident.TenantID, Roles: ident.Roles, Generation: ident.Generation}
+	token, err := i.tokens.IssueToken(access, 0)
+	if err != nil {
+		return nil, err
+	}
+	pair := &TokenPair{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresIn: int(access.ExpiresAt.Sub(access.IssuedAt.Time).Seconds()),
+	}
+
+	i.mu.RLock()
+	refreshDuration := i.refreshDuration
+	i.mu.RUnlock()
+	if withRefresh && refreshDuration > 0 {
+		// Refresh tokens hold no roles: they are good for nothing but
+		// /auth/token, where the roles are read from the identity again
+		refresh := &Claims{UserID: ident.ID, TokenUse: TokenUseRefresh, Generation: ident.Generation}
+		if pair.RefreshToken, err = i.tokens.IssueToken(refresh, refreshDuration); err != nil {
+			return nil, err
+		}
+	}
+	return pair, nil
+}
+
+// expiry is how long a revocation of claims must be kept
+func expiry(claims *Claims) time.Time {
+	if claims.ExpiresAt == nil {
+		return time.Now().Add(24 * time.Hour)
+	}
+	return claims.ExpiresAt.Time
+}
+
+var _ AuthServiceInterface = (*Issuer)(nil)
@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"distore/config"
+)
+
+// fastHashes keeps password hashing cheap for the duration of a test
+func fastHashes(t *testing.T) {
+	old := passwordIterations
+	passwordIterations = 1000
+	t.Cleanup(func() { passwordIterations = old })
+}
+
+func newTestIssuer(t *testing.T) *Issuer {
+	fastHashes(t)
+	identities := NewIdentities()
+	if _, _, err := identities.Put("alice", IdentitySpec{TenantID: "acme", Roles: []string{"read", "write"}, Secret: "alice-password"}); err != nil {
+		t.Fatal(err)
+	}
+	return NewIssuer(NewSimpleAuthService(3600), identities, time.Hour)
+}
+
+func TestPasswordHash(t *testing.T) {
+	fastHashes(t)
+	hash, err := HashPassword("s3cret-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "pbkdf2-sha256$1000$") {
+		t.Errorf("Unexpected hash format %q", hash)
+	}
+	if !CheckPassword(hash, "s3cret-password") {
+		t.Error("Correct password rejected")
+	}
+	if CheckPassword(hash, "s3cret-passwore") {
+		t.Error("Wrong password accepted")
+	}
+	if CheckPassword("plain-text", "plain-text") {
+		t.Error("Malformed hash accepted")
+	}
+	if other, _ := HashPassword("s3cret-password"); other == hash {
+		t.Error("Expected a new salt per hash")
+	}
+}
+
+func TestSimpleAuthService_RejectsForgedTokens(t *testing.T) {
+	service := NewSimpleAuthService(3600)
+	token, _ := service.GenerateToken("bob", "acme", []string{"read"})
+	if _, err := service.ValidateToken(token); err != nil {
+		t.Fatalf("Own token rejected: %v", err)
+	}
+
+	encoded, signature, _ := strings.Cut(strings.TrimPrefix(token, "simple-token-"), ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(encoded)
+	forged := strings.Replace(string(payload), `"read"`, `"admin"`, 1)
+	forgedToken := "simple-token-" + base64.RawURLEncoding.EncodeToString([]byte(forged)) + "." + signature
+	if _, err := service.ValidateToken(forgedToken); err == nil {
+		t.Error("Token with edited roles accepted")
+	}
+	if _, err := NewSimpleAuthService(3600).ValidateToken(token); err == nil {
+		t.Error("Token of another service accepted")
+	}
+}
+
+func TestIssuer_Grants(t *testing.T) {
+	issuer := newTestIssuer(t)
+	identities := issuer.Identities()
+
+	pair, err := issuer.Password("alice", "alice-password")
+	if err != nil {
+		t.Fatalf("Password grant: %v", err)
+	}
+	claims, err := issuer.ValidateToken(pair.Token)
+	if err != nil {
+		t.Fatalf("Issued token rejected: %v", err)
+	}
+	if claims.TenantID != "acme" || len(claims.Roles) != 2 || claims.ID == "" {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+	if pair.RefreshToken == "" || pair.ExpiresIn != 3600 {
+		t.Errorf("Unexpected token pair %+v", pair)
+	}
+
+	for name, grant := range map[string]func() (*TokenPair, error){
+		"wrong password": func() (*TokenPair, error) { return issuer.Password("alice", "alice-passwore") },
+		"unknown user":   func() (*TokenPair, error) { return issuer.Password("mallory", "alice-password") },
+		"user as client": func() (*TokenPair, error) { return issuer.ClientCredentials("alice", "alice-password") },
+		"bad api key":    func() (*TokenPair, error) { return issuer.APIKey("dsk_0000_secret") },
+	} {
+		if _, err := grant(); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: expected ErrInvalidCredentials, got %v", name, err)
+		}
+	}
+
+	// Service accounts get a generated secret and no refresh token
+	_, secret, err := identities.Put("etl", IdentitySpec{Kind: KindService, TenantID: "acme", Roles: []string{"write"}})
+	if err != nil || secret == "" {
+		t.Fatalf("Creating service account: %q, %v", secret, err)
+	}
+	pair, err = issuer.ClientCredentials("etl", secret)
+	if err != nil {
+		t.Fatalf("Client credentials grant: %v", err)
+	}
+	if pair.RefreshToken != "" {
+		t.Error("Expected no refresh token for client credentials")
+	}
+
+	key, _, err := identities.AddAPIKey("etl", "nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err = issuer.APIKey(key)
+	if err != nil {
+		t.Fatalf("API key grant: %v", err)
+	}
+	if claims, _ := issuer.ValidateToken(pair.Token); claims == nil || claims.UserID != "etl" {
+		t.Errorf("Expected a token for etl, got %+v", claims)
+	}
+	if _, err := issuer.APIKey(key[:len(key)-1] + "x"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected a wrong API key secret to fail, got %v", err)
+	}
+
+	// Disabling an identity ends its sessions and logins
+	if _, _, err := identities.Put("etl", IdentitySpec{Kind: KindService, TenantID: "acme", Roles: []string{"write"}, Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuer.ValidateToken(pair.Token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Expected the token of a disabled identity to be rejected, got %v", err)
+	}
+	if _, err := issuer.APIKey(key); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected a disabled identity to be refused, got %v", err)
+	}
+}
+
+func TestIssuer_RefreshRotation(t *testing.T) {
+	issuer := newTestIssuer(t)
+	first, _ := issuer.Password("alice", "alice-password")
+
+	if _, err := issuer.ValidateToken(first.RefreshToken); err == nil {
+		t.Error("Refresh token accepted as access token")
+	}
+	if _, err := issuer.Refresh(first.Token); err == nil {
+		t.Error("Access token accepted as refresh token")
+	}
+
+	second, err := issuer.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if _, err := issuer.ValidateToken(second.Token); err != nil {
+		t.Fatalf("Refreshed token rejected: %v", err)
+	}
+
+	// Reusing a refresh token revokes every session of the identity
+	if _, err := issuer.Refresh(first.RefreshToken); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("Expected reuse to fail with ErrTokenRevoked, got %v", err)
+	}
+	if _, err := issuer.ValidateToken(second.Token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Expected sessions to end after refresh token reuse, got %v", err)
+	}
+	if _, err := issuer.Refresh(second.RefreshToken); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Expected the rotated refresh token to be revoked too, got %v", err)
+	}
+}
+
+func TestIssuer_Logout(t *testing.T) {
+	issuer := newTestIssuer(t)
+	session, _ := issuer.Password("alice", "alice-password")
+	other, _ := issuer.Password("alice", "alice-password")
+
+	claims, err := issuer.ValidateToken(session.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.Logout(claims, session.RefreshToken, false); err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	if _, err := issuer.ValidateToken(session.Token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Expected the logged out token to be revoked, got %v", err)
+	}
+	if _, err := issuer.ValidateToken(other.Token); err != nil {
+		t.Errorf("Other session ended by logout: %v", err)
+	}
+	if _, err := issuer.Refresh(session.RefreshToken); err == nil {
+		t.Error("Expected the logged out refresh token to be revoked")
+	}
+
+	third, _ := issuer.Password("alice", "alice-password")
+	thirdClaims, _ := issuer.ValidateToken(third.Token)
+	if err := issuer.Logout(thirdClaims, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuer.ValidateToken(third.Token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Expected logout from all sessions to revoke every token, got %v", err)
+	}
+}
+
+func TestIdentities_Validation(t *testing.T) {
+	fastHashes(t)
+	identities := NewIdentities()
+	for name, spec := range map[string]IdentitySpec{
+		"no password":       {Roles: []string{"read"}},
+		"short password":    {Roles: []string{"read"}, Secret: "short"},
+		"no roles":          {Secret: "password1"},
+		"replicator":        {Roles: []string{"replicator"}, Secret: "password1"},
+		"all tenants":       {TenantID: AllTenants, Roles: []string{"write"}, Secret: "password1"},
+		"tenant with colon": {TenantID: "a:b", Roles: []string{"read"}, Secret: "password1"},
+		"unknown kind":      {Kind: "robot", Roles: []string{"read"}, Secret: "password1"},
+	} {
+		if _, _, err := identities.Put("bob", spec); !errors.Is(err, ErrInvalidIdentity) {
+			t.Errorf("%s: expected ErrInvalidIdentity, got %v", name, err)
+		}
+	}
+
+	if created, err := identities.Bootstrap(config.AuthBootstrapConfig{User: "root", Password: "root-password-1"}); !created || err != nil {
+		t.Fatalf("Bootstrap: %v, %v", created, err)
+	}
+	root, _ := identities.Get("root")
+	if root.TenantID != AllTenants || !hasRole(&Claims{Roles: root.Roles}, RoleAdmin) {
+		t.Errorf("Expected a cluster admin, got %+v", root)
+	}
+	if created, _ := identities.Bootstrap(config.AuthBootstrapConfig{User: "other", Password: "other-password-1"}); created {
+		t.Error("Bootstrap ran with identities present")
+	}
+	for _, ident := range identities.List() {
+		if ident.SecretHash != "" {
+			t.Errorf("List exposes the secret hash of %s", ident.ID)
+		}
+	}
+}
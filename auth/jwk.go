@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing algorithms
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// JWK is a public key as published at /.well-known/jwks.json (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// SigningKey is a key tokens are signed or verified with. Keys of other
+// nodes and issuers have no private part.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	Public    crypto.PublicKey
+}
+
+// GenerateSigningKey creates a key for alg
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newSigningKey(private, private.Public())
+}
+
+// ParseSigningKey reads a PEM private key (PKCS#1, PKCS#8 or SEC 1) and the
+// matching public key
+func ParseSigningKey(privatePEM, publicPEM []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(privatePEM)
+	if block == nil {
+		return nil, errors.New("private key: no PEM data found")
+	}
+	var private interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("private key: %w", err)
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key: unsupported key type")
+	}
+
+	public, err := ParsePublicKey(publicPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !publicKeysEqual(signer.Public(), public) {
+		return nil, errors.New("public key does not match the private key")
+	}
+	return newSigningKey(signer, public)
+}
+
+// ParsePublicKey reads a PEM public key (PKIX or PKCS#1)
+func ParsePublicKey(publicPEM []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(publicPEM)
+	if block == nil {
+		return nil, errors.New("public key: no PEM data found")
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		if rsaKey, rsaErr := x509.ParsePKCS1PublicKey(block.Bytes); rsaErr == nil {
+			return rsaKey, nil
+		}
+		return nil, fmt.Errorf("public key: %w", err)
+	}
+	return public, nil
+}
+
+func newSigningKey(private crypto.Signer, public crypto.PublicKey) (*SigningKey, error) {
+	alg, err := algorithmOf(public)
+	if err != nil {
+		return nil, err
+	}
+	jwk, err := publicJWK(public, alg)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: jwk.Kid, Algorithm: alg, Private: private, Public: public}, nil
+}
+
+// JWK returns the public part of k
+func (k *SigningKey) JWK() JWK {
+	jwk, _ := publicJWK(k.Public, k.Algorithm)
+	return jwk
+}
+
+func (k *SigningKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+func algorithmOf(public crypto.PublicKey) (string, error) {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return AlgRS256, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return "", errors.New("only P-256 EC keys are supported")
+		}
+		return AlgES256, nil
+	case ed25519.PublicKey:
+		return AlgEdDSA, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", public)
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	eq, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && eq.Equal(b)
+}
+
+var b64 = base64.RawURLEncoding
+
+// publicJWK encodes public with its RFC 7638 thumbprint as key ID
+func publicJWK(public crypto.PublicKey, alg string) (JWK, error) {
+	jwk := JWK{Alg: alg, Use: "sig"}
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64.EncodeToString(key.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return JWK{}, errors.New("only P-256 EC keys are supported")
+		}
+		jwk.Kty, jwk.Crv = "EC", "P-256"
+		jwk.X = b64.EncodeToString(key.X.FillBytes(make([]byte, 32)))
+		jwk.Y = b64.EncodeToString(key.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		jwk.Kty, jwk.Crv = "OKP", "Ed25519"
+		jwk.X = b64.EncodeToString(key)
+	default:
+		return JWK{}, fmt.Errorf("unsupported key type %T", public)
+	}
+	jwk.Kid = jwk.thumbprint()
+	return jwk, nil
+}
+
+// thumbprint hashes the required members in lexical order (RFC 7638)
+func (j JWK) thumbprint() string {
+	var members interface{}
+	switch j.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{j.E, j.Kty, j.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{j.Crv, j.Kty, j.X, j.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{j.Crv, j.Kty, j.X}
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return b64.EncodeToString(sum[:])
+}
+
+// PublicKey decodes j
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %s: %w", j.Kid, err)
+		}
+		e, err := b64.DecodeString(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %s: %w", j.Kid, err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, fmt.Errorf("jwk %s: unsupported curve %q", j.Kid, j.Crv)
+		}
+		x, errX := b64.DecodeString(j.X)
+		y, errY := b64.DecodeString(j.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("jwk %s: invalid coordinates", j.Kid)
+		}
+		uncompressed := append(append([]byte{4}, x...), y...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), uncompressed)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %s: %w", j.Kid, err)
+		}
+		return key, nil
+	case "OKP":
+		x, err := b64.DecodeString(j.X)
+		if err != nil || j.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("jwk %s: invalid Ed25519 key", j.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("jwk %s: unsupported key type %q", j.Kid, j.Kty)
+}
+
+// verifyingKey decodes j for tokens signed with alg, which must be the
+// algorithm of the key
+func (j JWK) verifyingKey(alg string) (crypto.PublicKey, error) {
+	public, err := j.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	keyAlg, err := algorithmOf(public)
+	if err != nil {
+		return nil, err
+	}
+	if keyAlg != alg || (j.Alg != "" && j.Alg != alg) {
+		return nil, fmt.Errorf("key %s is not an %s key", j.Kid, alg)
+	}
+	return public, nil
+}
@@ -1,12 +1,19 @@
 package auth
 
 import (
-	"crypto/rsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"distore/config"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -20,71 +27,349 @@ var (
 // AuthServiceInterface defines the interface for the authentication service
 type AuthServiceInterface interface {
 	GenerateToken(userID, tenantID string, roles []string) (string, error)
+	// IssueToken signs claims valid for duration, the token duration of the
+	// service when 0. It fills in the registered claims, including a new ID.
+	IssueToken(claims *Claims, duration time.Duration) (string, error)
 	ValidateToken(tokenString string) (*Claims, error)
 }
 
+// TokenUseRefresh marks refresh tokens, which can only be exchanged for new
+// tokens at /auth/token
+const TokenUseRefresh = "refresh"
+
 type Claims struct {
 	jwt.RegisteredClaims
 	UserID   string   `json:"user_id"`
 	Roles    []string `json:"roles"`
 	TenantID string   `json:"tenant_id"`
+	TokenUse string   `json:"token_use,omitempty"`
+	// Generation of the identity the token was issued to, see Identity
+	Generation int `json:"gen,omitempty"`
+}
+
+// fill sets the registered claims of a token issued now
+func (c *Claims) fill(duration time.Duration) {
+	now := time.Now()
+	c.ExpiresAt = jwt.NewNumericDate(now.Add(duration))
+	c.IssuedAt = jwt.NewNumericDate(now)
+	c.Issuer = localIssuer
+	c.ID = newTokenID()
+}
+
+func newTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
+// AuthService signs tokens with its current key and verifies them with any
+// key it signed with recently, or that a peer published. Tokens carry the
+// ID of their key in the kid header.
 type AuthService struct {
-	privateKey    *rsa.PrivateKey
-	publicKey     *rsa.PublicKey
+	mu            sync.RWMutex
+	current       *SigningKey
+	clusterKey    *SigningKey          // configured key all nodes share, nil when generated
+	keys          map[string]*localKey // current and retired keys of this node
+	peerKeys      map[string]JWK       // keys other nodes sign with
 	tokenDuration time.Duration
+	retention     time.Duration // longest lifetime of a token signed so far
+	listeners     []func()
+}
+
+type localKey struct {
+	*SigningKey
+	retiredAt time.Time // zero for the current key
 }
 
-// NewAuthService creates auth service based on config
+// NewAuthService creates auth service based on config. Without configured
+// keys, a key is generated for auth.key_rotation.algorithm.
 func NewAuthService(cfg *config.AuthConfig) (AuthServiceInterface, error) {
 	if !cfg.Enabled {
 		return nil, nil
 	}
 
-	// Try to create a JWT auth service
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(cfg.PrivateKey))
+	key, err := configuredKey(cfg)
 	if err != nil {
-		// If PEM parsing fails, use a simple implementation
-		return NewSimpleAuthService(cfg.TokenDuration), nil
+		return nil, err
 	}
 
-	publicKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(cfg.PublicKey))
+	tokenDuration := time.Duration(cfg.TokenDuration) * time.Second
+	service := &AuthService{
+		current:       key,
+		keys:          map[string]*localKey{key.ID: {SigningKey: key}},
+		peerKeys:      make(map[string]JWK),
+		tokenDuration: tokenDuration,
+		retention:     tokenDuration,
+	}
+	if hasConfiguredKeys(cfg) {
+		service.clusterKey = key
+	}
+	return service, nil
+}
+
+func configuredKey(cfg *config.AuthConfig) (*SigningKey, error) {
+	if !hasConfiguredKeys(cfg) && cfg.KeyRotation.Interval > 0 {
+		return GenerateSigningKey(rotationAlgorithm(cfg.KeyRotation))
+	}
+	return readSigningKey(cfg)
+}
+
+func hasConfiguredKeys(cfg *config.AuthConfig) bool {
+	return cfg.PrivateKey != "" || cfg.PublicKey != "" || cfg.PrivateKeyFile != "" || cfg.PublicKeyFile != ""
+}
+
+// readSigningKey parses the configured keys, read from their files when
+// private_key_file and public_key_file are set
+func readSigningKey(cfg *config.AuthConfig) (*SigningKey, error) {
+	privatePEM, err := keyPEM(cfg.PrivateKey, cfg.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("private key: %w", err)
+	}
+	publicPEM, err := keyPEM(cfg.PublicKey, cfg.PublicKeyFile)
 	if err != nil {
-		return NewSimpleAuthService(cfg.TokenDuration), nil
+		return nil, fmt.Errorf("public key: %w", err)
 	}
+	return ParseSigningKey(privatePEM, publicPEM)
+}
 
-	return &AuthService{
-		privateKey:    privateKey,
-		publicKey:     publicKey,
-		tokenDuration: time.Duration(cfg.TokenDuration) * time.Second,
-	}, nil
+func keyPEM(inline, filename string) ([]byte, error) {
+	if filename == "" {
+		return []byte(inline), nil
+	}
+	return os.ReadFile(filename)
 }
 
-func (a *AuthService) GenerateToken(userID, tenantID string, roles []string) (string, error) {
-	claims := &Claims{
-		UserID:   userID,
-		Roles:    roles,
-		TenantID: tenantID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(a.tokenDuration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    "distore",
-		},
+func rotationAlgorithm(cfg config.KeyRotationConfig) string {
+	if cfg.Algorithm == "" {
+		return AlgES256
+	}
+	return cfg.Algorithm
+}
+
+// UpdateKeys switches to the configured keys and token duration of a
+// running service. The keys in use are kept when the new ones do not parse,
+// and tokens signed with them stay valid until they expire.
+func (a *AuthService) UpdateKeys(cfg *config.AuthConfig) error {
+	var key *SigningKey
+	if hasConfiguredKeys(cfg) || cfg.KeyRotation.Interval == 0 {
+		var err error
+		if key, err = readSigningKey(cfg); err != nil {
+			return err
+		}
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	return token.SignedString(a.privateKey)
+	a.mu.Lock()
+	a.tokenDuration = time.Duration(cfg.TokenDuration) * time.Second
+	changed := key != nil && key.ID != a.current.ID
+	if changed {
+		a.use(key)
+	}
+	if key != nil {
+		// A replaced cluster key ages out like any retired key
+		if a.clusterKey != nil && a.clusterKey.ID != key.ID {
+			if previous, ok := a.keys[a.clusterKey.ID]; ok && previous.ID != a.current.ID {
+				previous.retiredAt = time.Now()
+			}
+		}
+		a.clusterKey = key
+	}
+	a.mu.Unlock()
+
+	if changed {
+		a.keysChanged()
+	}
+	return nil
 }
 
-func (a *AuthService) ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// Rotate starts signing with a new key for alg
+func (a *AuthService) Rotate(alg string) (*SigningKey, error) {
+	key, err := GenerateSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	a.use(key)
+	a.mu.Unlock()
+
+	a.keysChanged()
+	return key, nil
+}
+
+// use makes key the current key, retiring the previous one. Called with the
+// lock held.
+func (a *AuthService) use(key *SigningKey) {
+	now := time.Now()
+	a.prune(now)
+	if previous, ok := a.keys[a.current.ID]; ok {
+		previous.retiredAt = now
+	}
+	a.keys[key.ID] = &localKey{SigningKey: key}
+	a.current = key
+}
+
+// prune forgets retired keys no token signed with them can outlive. Called
+// with the lock held.
+func (a *AuthService) prune(now time.Time) {
+	for id, key := range a.keys {
+		if a.clusterKey != nil && id == a.clusterKey.ID {
+			continue // service tokens of the peers are signed with it
+		}
+		if !key.retiredAt.IsZero() && now.Sub(key.retiredAt) > a.retention {
+			delete(a.keys, id)
+		}
+	}
+}
+
+// RetainKeys keeps verifying tokens signed with keys this node published
+// before a restart, as if they had been retired now
+func (a *AuthService) RetainKeys(keys []JWK) {
+	now := time.Now()
+	a.mu.Lock()
+	added := 0
+	for _, jwk := range keys {
+		if _, ok := a.keys[jwk.Kid]; ok {
+			continue
+		}
+		public, err := jwk.verifyingKey(jwk.Alg)
+		if err != nil || jwk.Kid != jwk.thumbprint() {
+			continue
+		}
+		a.keys[jwk.Kid] = &localKey{
+			SigningKey: &SigningKey{ID: jwk.Kid, Algorithm: jwk.Alg, Public: public},
+			retiredAt:  now,
+		}
+		added++
+	}
+	a.mu.Unlock()
+
+	if added > 0 {
+		a.keysChanged()
+	}
+}
+
+// SetPeerKeys replaces the keys other nodes sign with
+func (a *AuthService) SetPeerKeys(keys []JWK) {
+	peerKeys := make(map[string]JWK, len(keys))
+	for _, jwk := range keys {
+		// A key ID that is not the thumbprint of the key could shadow
+		// another key
+		if jwk.Kid == jwk.thumbprint() {
+			peerKeys[jwk.Kid] = jwk
+		}
+	}
+	a.mu.Lock()
+	a.peerKeys = peerKeys
+	a.mu.Unlock()
+}
+
+// PublicKeys returns the keys tokens of this node can be verified with, the
+// current key first
+func (a *AuthService) PublicKeys() []JWK {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prune(time.Now())
+
+	keys := []JWK{a.current.JWK()}
+	for id, key := range a.keys {
+		if id != a.current.ID {
+			keys = append(keys, key.JWK())
 		}
-		return a.publicKey, nil
-	})
+	}
+	sort.Slice(keys[1:], func(i, j int) bool { return keys[i+1].Kid < keys[j+1].Kid })
+	return keys
+}
 
+// JWKS returns every key tokens of the cluster are signed with
+func (a *AuthService) JWKS() JWKSet {
+	keys := a.PublicKeys()
+	seen := make(map[string]bool, len(keys))
+	for _, jwk := range keys {
+		seen[jwk.Kid] = true
+	}
+
+	a.mu.RLock()
+	peers := make([]JWK, 0, len(a.peerKeys))
+	for kid, jwk := range a.peerKeys {
+		if !seen[kid] {
+			peers = append(peers, jwk)
+		}
+	}
+	a.mu.RUnlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Kid < peers[j].Kid })
+
+	return JWKSet{Keys: append(keys, peers...)}
+}
+
+// OnKeysChange registers fn to run after the keys of this node changed
+func (a *AuthService) OnKeysChange(fn func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.listeners = append(a.listeners, fn)
+}
+
+func (a *AuthService) keysChanged() {
+	a.mu.RLock()
+	listeners := append([]func(){}, a.listeners...)
+	a.mu.RUnlock()
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
+func (a *AuthService) GenerateToken(userID, tenantID string, roles []string) (string, error) {
+	return a.IssueToken(&Claims{UserID: userID, TenantID: tenantID, Roles: roles}, 0)
+}
+
+func (a *AuthService) IssueToken(claims *Claims, duration time.Duration) (string, error) {
+	return a.issue(claims, duration, false)
+}
+
+// ClusterSigner returns a view of a that signs with the configured keys,
+// which every node has from the start, rather than with a rotated key that
+// peers only learn from the cluster metadata. Service tokens are signed
+// with it, as the metadata itself is only accepted with a valid one.
+// Without configured keys, it signs with the current key.
+func (a *AuthService) ClusterSigner() AuthServiceInterface {
+	return clusterSigner{a}
+}
+
+type clusterSigner struct{ *AuthService }
+
+func (s clusterSigner) GenerateToken(userID, tenantID string, roles []string) (string, error) {
+	return s.IssueToken(&Claims{UserID: userID, TenantID: tenantID, Roles: roles}, 0)
+}
+
+func (s clusterSigner) IssueToken(claims *Claims, duration time.Duration) (string, error) {
+	return s.issue(claims, duration, true)
+}
+
+func (a *AuthService) issue(claims *Claims, duration time.Duration, cluster bool) (string, error) {
+	a.mu.Lock()
+	key := a.current
+	if cluster && a.clusterKey != nil {
+		key = a.clusterKey
+	}
+	if duration == 0 {
+		duration = a.tokenDuration
+	}
+	if duration > a.retention {
+		a.retention = duration
+	}
+	a.mu.Unlock()
+
+	claims.fill(duration)
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// validMethods are the algorithms tokens may be signed with, so that no
+// token can pick "none" or use a public key as an HMAC secret
+var validMethods = []string{AlgRS256, AlgES256, AlgEdDSA}
+
+func (a *AuthService) ValidateToken(tokenString string) (*Claims, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods(validMethods))
+	token, err := parser.ParseWithClaims(tokenString, &Claims{}, a.verifyingKey)
 	if err != nil {
 		return nil, err
 	}
@@ -96,22 +381,73 @@ func (a *AuthService) ValidateToken(tokenString string) (*Claims, error) {
 	return nil, ErrInvalidToken
 }
 
-// SimpleAuthService - simple implementation for testing
+// verifyingKey finds the key named by the kid header of token
+func (a *AuthService) verifyingKey(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	kid, _ := token.Header["kid"].(string)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if kid == "" {
+		// Tokens signed before key IDs were introduced
+		var set jwt.VerificationKeySet
+		for _, key := range a.keys {
+			if key.Algorithm == alg {
+				set.Keys = append(set.Keys, key.Public)
+			}
+		}
+		return set, nil
+	}
+	if key, ok := a.keys[kid]; ok {
+		if key.Algorithm != alg {
+			return nil, fmt.Errorf("key %s is not an %s key", kid, alg)
+		}
+		return key.Public, nil
+	}
+	if jwk, ok := a.peerKeys[kid]; ok {
+		return jwk.verifyingKey(alg)
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// SimpleAuthService - simple implementation for testing. Tokens are signed
+// with a random key of the instance, so only it accepts them.
 type SimpleAuthService struct {
 	tokenDuration time.Duration
+	secret        []byte
 }
 
 func NewSimpleAuthService(tokenDuration int) *SimpleAuthService {
+	secret := make([]byte, 32)
+	rand.Read(secret)
 	return &SimpleAuthService{
 		tokenDuration: time.Duration(tokenDuration) * time.Second,
+		secret:        secret,
 	}
 }
 
 func (s *SimpleAuthService) GenerateToken(userID, tenantID string, roles []string) (string, error) {
-	// Use base64 to avoid problems with special characters
-	tokenData := fmt.Sprintf("%s:%s:%s", userID, tenantID, strings.Join(roles, ","))
-	encoded := base64.StdEncoding.EncodeToString([]byte(tokenData))
-	return "simple-token-" + encoded, nil
+	return s.IssueToken(&Claims{UserID: userID, TenantID: tenantID, Roles: roles}, 0)
+}
+
+func (s *SimpleAuthService) IssueToken(claims *Claims, duration time.Duration) (string, error) {
+	if duration == 0 {
+		duration = s.tokenDuration
+	}
+	claims.fill(duration)
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return "simple-token-" + encoded + "." + s.sign(encoded), nil
+}
+
+func (s *SimpleAuthService) sign(encoded string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 }
 
 func (s *SimpleAuthService) ValidateToken(tokenString string) (*Claims, error) {
@@ -119,27 +455,23 @@ func (s *SimpleAuthService) ValidateToken(tokenString string) (*Claims, error) {
 		return nil, ErrInvalidToken
 	}
 
-	// Extract the base64 part
-	encoded := strings.TrimPrefix(tokenString, "simple-token-")
-	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	encoded, signature, ok := strings.Cut(strings.TrimPrefix(tokenString, "simple-token-"), ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(encoded))) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
 	if err != nil {
 		return nil, ErrInvalidToken
 	}
 
-	parts := strings.Split(string(decoded), ":")
-	if len(parts) < 3 {
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
 		return nil, ErrInvalidToken
 	}
-
-	userID := parts[0]
-	tenantID := parts[1]
-	roles := strings.Split(parts[2], ",")
-
-	return &Claims{
-		UserID:   userID,
-		TenantID: tenantID,
-		Roles:    roles,
-	}, nil
+	if claims.ExpiresAt != nil && time.Now().After(claims.ExpiresAt.Time) {
+		return nil, ErrTokenExpired
+	}
+	return &claims, nil
 }
 
 // Ensure AuthService implements AuthServiceInterface
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"distore/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newRotatingService signs with a generated key, as with key rotation on
+func newRotatingService(t *testing.T, alg string) *AuthService {
+	service, err := NewAuthService(&config.AuthConfig{
+		Enabled:       true,
+		TokenDuration: 3600,
+		KeyRotation:   config.KeyRotationConfig{Interval: 3600, Algorithm: alg},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service.(*AuthService)
+}
+
+func TestAuthService_Algorithms(t *testing.T) {
+	for _, alg := range []string{AlgRS256, AlgES256, AlgEdDSA} {
+		service := newRotatingService(t, alg)
+		token, err := service.GenerateToken("user1", "tenant1", []string{"read"})
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		parsed, _, _ := jwt.NewParser().ParseUnverified(token, &Claims{})
+		if parsed.Method.Alg() != alg || parsed.Header["kid"] != service.PublicKeys()[0].Kid {
+			t.Errorf("%s: unexpected header %v", alg, parsed.Header)
+		}
+		if _, err := service.ValidateToken(token); err != nil {
+			t.Errorf("%s: own token rejected: %v", alg, err)
+		}
+	}
+
+	// PEM keys of any supported type can be configured
+	key, _ := GenerateSigningKey(AlgES256)
+	private, _ := x509.MarshalPKCS8PrivateKey(key.Private)
+	public, _ := x509.MarshalPKIXPublicKey(key.Public)
+	service, err := NewAuthService(&config.AuthConfig{
+		Enabled:    true,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private})),
+		PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})),
+	})
+	if err != nil {
+		t.Fatalf("ES256 PEM keys: %v", err)
+	}
+	if kid := service.(*AuthService).PublicKeys()[0].Kid; kid != key.ID {
+		t.Errorf("Expected key ID %s, got %s", key.ID, kid)
+	}
+
+	other, _ := GenerateSigningKey(AlgES256)
+	otherPublic, _ := x509.MarshalPKIXPublicKey(other.Public)
+	if _, err := NewAuthService(&config.AuthConfig{
+		Enabled:    true,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private})),
+		PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: otherPublic})),
+	}); err == nil {
+		t.Error("Expected a mismatched key pair to be rejected")
+	}
+}
+
+func TestAuthService_Rotate(t *testing.T) {
+	service := newRotatingService(t, AlgES256)
+	changes := 0
+	service.OnKeysChange(func() { changes++ })
+
+	oldToken, _ := service.GenerateToken("user1", "tenant1", []string{"read"})
+	oldKid := service.PublicKeys()[0].Kid
+	key, err := service.Rotate(AlgEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes != 1 {
+		t.Errorf("Expected one key change, got %d", changes)
+	}
+
+	keys := service.PublicKeys()
+	if len(keys) != 2 || keys[0].Kid != key.ID || keys[1].Kid != oldKid {
+		t.Fatalf("Expected the new and the retired key, got %+v", keys)
+	}
+	if _, err := service.ValidateToken(oldToken); err != nil {
+		t.Errorf("Token signed before the rotation rejected: %v", err)
+	}
+	newToken, _ := service.GenerateToken("user1", "tenant1", []string{"read"})
+	if _, err := service.ValidateToken(newToken); err != nil {
+		t.Errorf("Token signed after the rotation rejected: %v", err)
+	}
+
+	// Retired keys are dropped once every token they signed has expired
+	service.mu.Lock()
+	service.keys[oldKid].retiredAt = time.Now().Add(-2 * time.Hour)
+	service.mu.Unlock()
+	if keys := service.PublicKeys(); len(keys) != 1 {
+		t.Errorf("Expected the expired key to be dropped, got %+v", keys)
+	}
+	if _, err := service.ValidateToken(oldToken); err == nil {
+		t.Error("Token of a dropped key accepted")
+	}
+}
+
+func TestAuthService_ClusterSignerWithRotation(t *testing.T) {
+	// Nodes share the configured keys and rotate to keys of their own
+	shared, _ := GenerateSigningKey(AlgES256)
+	private, _ := x509.MarshalPKCS8PrivateKey(shared.Private)
+	public, _ := x509.MarshalPKIXPublicKey(shared.Public)
+	cfg := &config.AuthConfig{
+		Enabled:       true,
+		PrivateKey:    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private})),
+		PublicKey:     string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})),
+		TokenDuration: 3600,
+		KeyRotation:   config.KeyRotationConfig{Interval: 3600},
+	}
+	nodes := make([]*AuthService, 3)
+	for i := range nodes {
+		service, err := NewAuthService(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = service.(*AuthService)
+		if _, err := nodes[i].Rotate(AlgEdDSA); err != nil {
+			t.Fatal(err)
+		}
+		// Long after the rotation, the shared key is still kept
+		nodes[i].mu.Lock()
+		nodes[i].keys[shared.ID].retiredAt = time.Now().Add(-2 * time.Hour)
+		nodes[i].mu.Unlock()
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for i, from := range nodes {
+		// Before any signing key is exchanged through the metadata
+		userToken, _ := from.GenerateToken("user1", "tenant1", []string{"read"})
+		serviceToken, err := NewServiceTokens(from.ClusterSigner(), fmt.Sprintf("node%d", i)).Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, to := range nodes {
+			if i == j {
+				continue
+			}
+			req := httptest.NewRequest("POST", "/internal/metadata", nil)
+			req.Header.Set("Authorization", "Bearer "+serviceToken)
+			rr := httptest.NewRecorder()
+			InternodeMiddleware(false, to)(ok).ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("Node %d rejected the service token of node %d: %d", j, i, rr.Code)
+			}
+			if _, err := to.ValidateToken(userToken); err == nil {
+				t.Errorf("Node %d accepted a token of an unpublished key of node %d", j, i)
+			}
+		}
+	}
+}
+
+func TestAuthService_PeerKeys(t *testing.T) {
+	node1 := newRotatingService(t, AlgES256)
+	node2 := newRotatingService(t, AlgRS256)
+	token, _ := node1.GenerateToken("user1", "tenant1", []string{"read"})
+
+	if _, err := node2.ValidateToken(token); err == nil {
+		t.Fatal("Token of an unknown node accepted")
+	}
+	node2.SetPeerKeys(node1.PublicKeys())
+	if _, err := node2.ValidateToken(token); err != nil {
+		t.Errorf("Token of a peer rejected: %v", err)
+	}
+	if set := node2.JWKS(); len(set.Keys) != 2 {
+		t.Errorf("Expected own and peer keys in the JWKS, got %+v", set.Keys)
+	}
+
+	// A key published under the ID of another key is ignored
+	forged := node2.PublicKeys()[0]
+	forged.Kid = node1.PublicKeys()[0].Kid
+	node2.SetPeerKeys([]JWK{forged})
+	if _, err := node2.ValidateToken(token); err == nil {
+		t.Error("Token accepted with a key published under a foreign key ID")
+	}
+
+	// Keys published before a restart keep their tokens valid
+	restarted := newRotatingService(t, AlgES256)
+	restarted.RetainKeys(node1.PublicKeys())
+	if _, err := restarted.ValidateToken(token); err != nil {
+		t.Errorf("Token signed before a restart rejected: %v", err)
+	}
+}
+
+func TestAuthService_RejectsUnexpectedAlgorithms(t *testing.T) {
+	service := newRotatingService(t, AlgRS256)
+	jwk := service.PublicKeys()[0]
+
+	// A token signed with the public key as HMAC secret
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UserID: "mallory", Roles: []string{"admin"}})
+	token.Header["kid"] = jwk.Kid
+	forged, _ := token.SignedString([]byte(jwk.N))
+	if _, err := service.ValidateToken(forged); err == nil {
+		t.Error("HS256 token accepted")
+	}
+
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, &Claims{UserID: "mallory"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if _, err := service.ValidateToken(unsigned); err == nil {
+		t.Error("Unsigned token accepted")
+	}
+}
+
+func TestJWK_RoundTrip(t *testing.T) {
+	for _, alg := range []string{AlgRS256, AlgES256, AlgEdDSA} {
+		key, err := GenerateSigningKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwk := key.JWK()
+		public, err := jwk.PublicKey()
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if !publicKeysEqual(key.Public, public) {
+			t.Errorf("%s: decoded key differs", alg)
+		}
+		if jwk.Kid != jwk.thumbprint() || jwk.Kid != key.ID {
+			t.Errorf("%s: key ID %s is not the thumbprint", alg, jwk.Kid)
+		}
+		if _, err := jwk.verifyingKey(AlgRS256); alg != AlgRS256 && err == nil {
+			t.Errorf("%s: key accepted for RS256", alg)
+		}
+	}
+}
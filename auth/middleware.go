@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -25,21 +26,8 @@ func AuthMiddleware(authService AuthServiceInterface) func(http.Handler) http.Ha
 				return
 			}
 
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				http.Error(w, "Authorization header required", http.StatusUnauthorized)
-				return
-			}
-
-			parts := strings.Split(authHeader, " ")
-			if len(parts) != 2 || parts[0] != "Bearer" {
-				http.Error(w, "Invalid authorization format", http.StatusUnauthorized)
-				return
-			}
-
-			claims, err := authService.ValidateToken(parts[1])
-			if err != nil {
-				http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+			claims, ok := bearerClaims(w, r, authService)
+			if !ok {
 				return
 			}
 
@@ -50,73 +38,124 @@ func AuthMiddleware(authService AuthServiceInterface) func(http.Handler) http.Ha
 	}
 }
 
-// RBACMiddleware for gorilla/mux
-func RBACMiddleware(requiredRole Role) func(http.Handler) http.Handler {
+// bearerClaims validates the bearer token of r, answering 401 when it is
+// missing or invalid
+func bearerClaims(w http.ResponseWriter, r *http.Request, authService AuthServiceInterface) (*Claims, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		http.Error(w, "Authorization header required", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		http.Error(w, "Invalid authorization format", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	claims, err := authService.ValidateToken(parts[1])
+	if err != nil {
+		http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	return claims, true
+}
+
+// InternodeMiddleware admits only other nodes to the internal routes: with
+// requireCert the client must present a certificate signed by the cluster CA,
+// and with a tokenService a token holding the replicator role
+func InternodeMiddleware(requireCert bool, tokenService AuthServiceInterface) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			claims, ok := r.Context().Value("claims").(*Claims)
-			if !ok {
-				http.Error(w, "Authentication required", http.StatusUnauthorized)
+			if requireCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+				http.Error(w, "Node certificate required", http.StatusUnauthorized)
 				return
 			}
 
-			hasRole := false
-			for _, role := range claims.Roles {
-				if Role(role) == requiredRole || Role(role) == RoleAdmin {
-					hasRole = true
-					break
+			if tokenService != nil {
+				claims, ok := bearerClaims(w, r, tokenService)
+				if !ok {
+					return
+				}
+				if !hasRole(claims, RoleReplicator) {
+					http.Error(w, "Insufficient permissions", http.StatusForbidden)
+					return
 				}
+				r = r.WithContext(context.WithValue(r.Context(), "claims", claims))
 			}
 
-			if !hasRole {
-				http.Error(w, "Insufficient permissions", http.StatusForbidden)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// MemberOriginMiddleware admits only requests sent from an address one of
+// the members resolves to. It guards the internal routes that change the
+// whole cluster when nodes do not authenticate each other.
+func MemberOriginMiddleware(members func() []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !fromMember(r.RemoteAddr, members()) {
+				http.Error(w, "Only cluster members may call this route", http.StatusForbidden)
 				return
 			}
-
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-// TenantMiddleware for gorilla/mux
-func TenantMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		claims, ok := r.Context().Value("claims").(*Claims)
-		if !ok {
-			next.ServeHTTP(w, r)
-			return
+func fromMember(remoteAddr string, members []string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	origin := net.ParseIP(host)
+	if origin == nil {
+		return false
+	}
+	for _, member := range members {
+		memberHost, _, err := net.SplitHostPort(member)
+		if err != nil {
+			memberHost = member
 		}
-
-		// Skip tenant verification for administrators
-		for _, role := range claims.Roles {
-			if Role(role) == RoleAdmin {
-				next.ServeHTTP(w, r)
-				return
+		addrs, err := net.LookupHost(memberHost)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil && ip.Equal(origin) {
+				return true
 			}
 		}
+	}
+	return false
+}
 
-		// TODO: Additional tenant checking logic can be added here.
-		// For example, checking that the tenantID in the path matches the tenantID in the token
+func hasRole(claims *Claims, role Role) bool {
+	for _, r := range claims.Roles {
+		if Role(r) == role {
+			return true
+		}
+	}
+	return false
+}
 
-		next.ServeHTTP(w, r)
-	})
+// RBACMiddleware for gorilla/mux
+func RBACMiddleware(requiredRole Role) func(http.Handler) http.Handler {
+	return defaultGuard.RBAC(requiredRole)
 }
 
-// KeyAccessMiddleware for gorilla/mux
-func KeyAccessMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// claims, ok := r.Context().Value("claims").(*Claims)
-		_, ok := r.Context().Value("claims").(*Claims)
-		if !ok {
-			next.ServeHTTP(w, r)
-			return
-		}
+// defaultGuard enforces tenants without an access policy, logging denials
+var defaultGuard = NewGuard(nil, LogAuditor{})
 
-		// TODO: Here you can add logic for checking access to keys
-		// For example, prefix check: user_* is only accessible to the owner
+// TenantMiddleware for gorilla/mux, see Guard.Tenant
+func TenantMiddleware(next http.Handler) http.Handler {
+	return defaultGuard.Tenant(next)
+}
 
-		next.ServeHTTP(w, r)
-	})
+// KeyAccessMiddleware for gorilla/mux, see Guard.KeyAccess
+func KeyAccessMiddleware(next http.Handler) http.Handler {
+	return defaultGuard.KeyAccess(next)
 }
 
 // PublicMiddleware allows access without authentication
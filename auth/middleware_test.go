@@ -5,11 +5,12 @@ import (
 	"distore/config"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
 func TestAuthMiddleware(t *testing.T) {
-	privateKey, publicKey := generateTestKeys()
+	privateKey, publicKey := generateTestKeys(t)
 
 	cfg := &config.AuthConfig{
 		Enabled:       true,
@@ -145,3 +146,125 @@ func TestRBACMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestInternodeMiddleware(t *testing.T) {
+	tokens := NewSimpleAuthService(3600)
+	replicatorToken, _ := NewServiceTokens(tokens, "node1").Token()
+	readToken, _ := tokens.GenerateToken("user", "tenant", []string{"read"})
+
+	handler := InternodeMiddleware(false, tokens)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name           string
+		authHeader     string
+		expectedStatus int
+	}{
+		{"Replicator token", "Bearer " + replicatorToken, http.StatusOK},
+		{"User token", "Bearer " + readToken, http.StatusForbidden},
+		{"No token", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/internal/set", nil)
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+		})
+	}
+
+	// Without a verified client certificate, mTLS rejects even a valid token
+	req := httptest.NewRequest("POST", "/internal/set", nil)
+	req.Header.Set("Authorization", "Bearer "+replicatorToken)
+	rr := httptest.NewRecorder()
+	InternodeMiddleware(true, tokens)(handler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without a node certificate, got %d", rr.Code)
+	}
+}
+
+func TestMemberOriginMiddleware(t *testing.T) {
+	handler := MemberOriginMiddleware(func() []string { return []string{"localhost:8081", "10.0.0.2:8080"} })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{"Member by name", "127.0.0.1:50000", http.StatusOK},
+		{"Member by address", "10.0.0.2:50000", http.StatusOK},
+		{"Other host", "10.0.0.9:50000", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/internal/metadata", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+type recordingAuditor struct{ events []AuditEvent }
+
+func (a *recordingAuditor) Record(e AuditEvent) { a.events = append(a.events, e) }
+
+func TestGuard(t *testing.T) {
+	policy, err := NewAccessPolicy(config.AccessPolicyConfig{Rules: []config.PolicyRuleConfig{
+		{Subjects: []string{"*"}, Keys: []string{"locked:*"}, Access: "write", Effect: "deny"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor := &recordingAuditor{}
+	guard := NewGuard(policy, auditor)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	serve := func(handler http.Handler, claims *Claims, method, body string) int {
+		req := httptest.NewRequest(method, "/advanced/batch", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), "claims", claims))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	user := &Claims{UserID: "u", TenantID: "t1", Roles: []string{"write"}}
+
+	// Keys are found in JSON bodies, batch operations included
+	if code := serve(guard.KeyAccess(ok), user, "POST", `{"operations": [{"type": "get", "key": "locked:a"}, {"type": "set", "key": "b"}]}`); code != http.StatusOK {
+		t.Errorf("Expected reads of locked keys to pass, got %d", code)
+	}
+	if code := serve(guard.KeyAccess(ok), user, "POST", `{"operations": [{"type": "set", "key": "locked:a"}]}`); code != http.StatusForbidden {
+		t.Errorf("Expected write of a locked key to be denied, got %d", code)
+	}
+	if code := serve(guard.KeyAccess(ok), user, "POST", `{"key": "locked:b", "value": "v"}`); code != http.StatusForbidden {
+		t.Errorf("Expected set of a locked key to be denied, got %d", code)
+	}
+
+	// Tenants cannot reach into each other's key space
+	if code := serve(guard.Tenant(ok), &Claims{TenantID: "t1:t2", Roles: []string{"read"}}, "GET", ""); code != http.StatusForbidden {
+		t.Errorf("Expected tenant with a separator to be rejected, got %d", code)
+	}
+	if code := serve(guard.Tenant(ok), &Claims{TenantID: AllTenants, Roles: []string{"read"}}, "GET", ""); code != http.StatusForbidden {
+		t.Errorf("Expected all-tenants marker without admin to be rejected, got %d", code)
+	}
+
+	if len(auditor.events) != 4 {
+		t.Fatalf("Expected 4 audited denials, got %d", len(auditor.events))
+	}
+	if e := auditor.events[0]; e.Key != "locked:a" || e.Action != "write" || e.UserID != "u" {
+		t.Errorf("Unexpected audit event %+v", e)
+	}
+}
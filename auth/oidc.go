@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"distore/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrExternalToken is returned for operations only tokens of this cluster
+// support, such as logout
+var ErrExternalToken = errors.New("token of an external issuer")
+
+// localIssuer is the iss claim of the tokens this cluster issues
+const localIssuer = "distore"
+
+// jwksRefreshInterval limits how often unknown key IDs make a verifier
+// fetch the keys of its issuer again
+const jwksRefreshInterval = 30 * time.Second
+
+// OIDCVerifier accepts the tokens of an external OpenID Connect issuer and
+// maps their claims to roles and a tenant
+type OIDCVerifier struct {
+	cfg    config.OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	jwksURL   string
+	keys      map[string]JWK
+	fetchedAt time.Time
+}
+
+// NewOIDCVerifier creates a verifier for cfg. The keys of the issuer are
+// fetched on first use.
+func NewOIDCVerifier(cfg config.OIDCConfig, client *http.Client) *OIDCVerifier {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = "sub"
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+	if cfg.TenantClaim == "" {
+		cfg.TenantClaim = "tenant_id"
+	}
+	return &OIDCVerifier{cfg: cfg, client: client, jwksURL: cfg.JWKSURL}
+}
+
+// NewOIDCVerifiers creates a verifier for each configured issuer
+func NewOIDCVerifiers(cfgs []config.OIDCConfig) []*OIDCVerifier {
+	verifiers := make([]*OIDCVerifier, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		verifiers = append(verifiers, NewOIDCVerifier(cfg, nil))
+	}
+	return verifiers
+}
+
+func (v *OIDCVerifier) Issuer() string {
+	return v.cfg.Issuer
+}
+
+func (v *OIDCVerifier) ValidateToken(tokenString string) (*Claims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(validMethods),
+		jwt.WithIssuer(v.cfg.Issuer),
+		jwt.WithAudience(v.cfg.Audience),
+		jwt.WithExpirationRequired(),
+	)
+	external := jwt.MapClaims{}
+	token, err := parser.ParseWithClaims(tokenString, external, v.verifyingKey)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	return v.mapClaims(external)
+}
+
+// mapClaims turns the claims of an external token into ours
+func (v *OIDCVerifier) mapClaims(external jwt.MapClaims) (*Claims, error) {
+	userID, _ := claimAt(external, v.cfg.UserClaim).(string)
+	if userID == "" {
+		return nil, fmt.Errorf("%w: no %s claim", ErrInvalidToken, v.cfg.UserClaim)
+	}
+
+	var roles []string
+	for _, role := range stringsOf(claimAt(external, v.cfg.RolesClaim)) {
+		mapped := []string{role}
+		if v.cfg.RoleMap != nil {
+			mapped = v.cfg.RoleMap[role]
+		}
+		for _, r := range mapped {
+			switch Role(r) {
+			case RoleRead, RoleWrite, RoleAdmin:
+			default:
+				continue
+			}
+			if !contains(roles, r) {
+				roles = append(roles, r)
+			}
+		}
+	}
+
+	tenantID, _ := claimAt(external, v.cfg.TenantClaim).(string)
+	if tenantID == "" {
+		tenantID = v.cfg.DefaultTenant
+	}
+	if tenantID == "" {
+		return nil, fmt.Errorf("%w: no %s claim", ErrInvalidToken, v.cfg.TenantClaim)
+	}
+	if tenantID == AllTenants && !contains(roles, string(RoleAdmin)) {
+		return nil, fmt.Errorf("%w: only admins may act on all tenants", ErrInvalidToken)
+	}
+
+	claims := &Claims{UserID: userID, TenantID: tenantID, Roles: roles}
+	claims.Issuer = v.cfg.Issuer
+	claims.Subject, _ = external["sub"].(string)
+	claims.ID, _ = external["jti"].(string)
+	if exp, err := external.GetExpirationTime(); err == nil {
+		claims.ExpiresAt = exp
+	}
+	if iat, err := external.GetIssuedAt(); err == nil {
+		claims.IssuedAt = iat
+	}
+	return claims, nil
+}
+
+// claimAt looks up a claim, dots in path descending into objects
+func claimAt(claims jwt.MapClaims, path string) interface{} {
+	var value interface{} = map[string]interface{}(claims)
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// stringsOf reads a list claim, or a space separated one like scope
+func stringsOf(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyingKey finds the key named by the kid header of token, fetching the
+// keys of the issuer again when it is unknown, as after a key rotation
+func (v *OIDCVerifier) verifyingKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("token has no key ID")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	jwk, ok := v.keys[kid]
+	if !ok && time.Since(v.fetchedAt) >= jwksRefreshInterval {
+		if err := v.fetchKeys(); err != nil {
+			return nil, fmt.Errorf("fetching keys of %s: %w", v.cfg.Issuer, err)
+		}
+		jwk, ok = v.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return jwk.verifyingKey(token.Method.Alg())
+}
+
+// fetchKeys loads the JWKS of the issuer, discovering its URL first if it
+// is not configured. Called with the lock held.
+func (v *OIDCVerifier) fetchKeys() error {
+	v.fetchedAt = time.Now()
+	if v.jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		url := strings.TrimSuffix(v.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+		if err := v.getJSON(url, &discovery); err != nil {
+			return err
+		}
+		if discovery.Issuer != v.cfg.Issuer {
+			return fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return errors.New("discovery document has no jwks_uri")
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+
+	var set JWKSet
+	if err := v.getJSON(v.jwksURL, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]JWK, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use == "" || jwk.Use == "sig" {
+			keys[jwk.Kid] = jwk
+		}
+	}
+	v.keys = keys
+	return nil
+}
+
+func (v *OIDCVerifier) getJSON(url string, out interface{}) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
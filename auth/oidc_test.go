@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"distore/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testIssuer is a local stand-in for an OpenID Connect provider
+type testIssuer struct {
+	*httptest.Server
+	mu  sync.Mutex
+	key *SigningKey
+}
+
+func newTestOIDCIssuer(t *testing.T) *testIssuer {
+	issuer := &testIssuer{}
+	issuer.rotate(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.URL, "jwks_uri": issuer.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{issuer.key.JWK()}})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (i *testIssuer) rotate(t *testing.T) {
+	key, err := GenerateSigningKey(AlgES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.mu.Lock()
+	i.key = key
+	i.mu.Unlock()
+}
+
+func (i *testIssuer) token(claims jwt.MapClaims) string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	base := jwt.MapClaims{"iss": i.URL, "aud": "distore", "sub": "carol", "exp": time.Now().Add(time.Hour).Unix()}
+	for name, value := range claims {
+		if value == nil {
+			delete(base, name)
+		} else {
+			base[name] = value
+		}
+	}
+	token := jwt.NewWithClaims(i.key.method(), base)
+	token.Header["kid"] = i.key.ID
+	signed, _ := token.SignedString(i.key.Private)
+	return signed
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	provider := newTestOIDCIssuer(t)
+	verifier := NewOIDCVerifier(config.OIDCConfig{
+		Issuer:     provider.URL,
+		Audience:   "distore",
+		RolesClaim: "realm_access.roles",
+		RoleMap:    map[string][]string{"editor": {"read", "write"}, "root": {"superuser"}},
+	}, provider.Client())
+
+	claims, err := verifier.ValidateToken(provider.token(jwt.MapClaims{
+		"realm_access": map[string]interface{}{"roles": []string{"editor", "root", "viewer"}},
+		"tenant_id":    "acme",
+	}))
+	if err != nil {
+		t.Fatalf("Valid token rejected: %v", err)
+	}
+	if claims.UserID != "carol" || claims.TenantID != "acme" || len(claims.Roles) != 2 || claims.Roles[1] != "write" {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+
+	for name, token := range map[string]string{
+		"wrong audience":  provider.token(jwt.MapClaims{"aud": "other", "tenant_id": "acme"}),
+		"wrong issuer":    provider.token(jwt.MapClaims{"iss": "https://evil.example", "tenant_id": "acme"}),
+		"expired":         provider.token(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix(), "tenant_id": "acme"}),
+		"no expiry":       provider.token(jwt.MapClaims{"exp": nil, "tenant_id": "acme"}),
+		"no tenant":       provider.token(jwt.MapClaims{}),
+		"all tenants":     provider.token(jwt.MapClaims{"tenant_id": AllTenants}),
+		"foreign key":     newTestOIDCIssuer(t).token(jwt.MapClaims{"iss": provider.URL, "tenant_id": "acme"}),
+		"not a signature": provider.token(jwt.MapClaims{"tenant_id": "acme"}) + "x",
+	} {
+		if _, err := verifier.ValidateToken(token); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	// After a key rotation at the issuer its keys are fetched again
+	provider.rotate(t)
+	verifier.mu.Lock()
+	verifier.fetchedAt = time.Time{}
+	verifier.mu.Unlock()
+	if _, err := verifier.ValidateToken(provider.token(jwt.MapClaims{"tenant_id": "acme"})); err != nil {
+		t.Errorf("Token signed with the new key of the issuer rejected: %v", err)
+	}
+}
+
+func TestIssuer_ExternalTokens(t *testing.T) {
+	provider := newTestOIDCIssuer(t)
+	issuer := newTestIssuer(t)
+	verifier := NewOIDCVerifier(config.OIDCConfig{Issuer: provider.URL, Audience: "distore", DefaultTenant: "acme"}, provider.Client())
+	issuer.SetExternalIssuers([]*OIDCVerifier{verifier})
+
+	claims, err := issuer.ValidateToken(provider.token(jwt.MapClaims{"roles": "read write"}))
+	if err != nil {
+		t.Fatalf("External token rejected: %v", err)
+	}
+	if claims.TenantID != "acme" || len(claims.Roles) != 2 {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+	if err := issuer.Logout(claims, "", true); !errors.Is(err, ErrExternalToken) {
+		t.Errorf("Expected logout of an external token to fail, got %v", err)
+	}
+
+	// Own tokens are still accepted
+	pair, _ := issuer.Password("alice", "alice-password")
+	if _, err := issuer.ValidateToken(pair.Token); err != nil {
+		t.Errorf("Own token rejected: %v", err)
+	}
+
+	issuer.SetExternalIssuers(nil)
+	if _, err := issuer.ValidateToken(provider.token(jwt.MapClaims{"roles": "read"})); err == nil {
+		t.Error("Token of a removed issuer accepted")
+	}
+}
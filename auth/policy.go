@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"distore/config"
+)
+
+// Action is the kind of access a request needs to a key. Each action
+// includes the ones before it.
+type Action int
+
+const (
+	ActionRead Action = iota
+	ActionWrite
+	ActionAdmin
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionRead:
+		return "read"
+	case ActionWrite:
+		return "write"
+	case ActionAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("action(%d)", int(a))
+}
+
+func ParseAction(s string) (Action, error) {
+	switch s {
+	case "read":
+		return ActionRead, nil
+	case "write":
+		return ActionWrite, nil
+	case "admin":
+		return ActionAdmin, nil
+	}
+	return 0, fmt.Errorf("unknown access %q", s)
+}
+
+type policyRule struct {
+	subjects []string
+	keys     []string
+	access   Action
+	deny     bool
+}
+
+// AccessPolicy maps key patterns to the access roles, users or tenants
+// have. A matching deny rule wins over allow rules; without a matching rule
+// the default applies. Cluster admins are not subject to it.
+type AccessPolicy struct {
+	rules       []policyRule
+	defaultDeny bool
+}
+
+func NewAccessPolicy(cfg config.AccessPolicyConfig) (*AccessPolicy, error) {
+	p := &AccessPolicy{defaultDeny: cfg.Default == "deny"}
+	for i, rc := range cfg.Rules {
+		access, err := ParseAction(rc.Access)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		p.rules = append(p.rules, policyRule{
+			subjects: rc.Subjects,
+			keys:     rc.Keys,
+			access:   access,
+			deny:     rc.Effect == "deny",
+		})
+	}
+	return p, nil
+}
+
+// Allowed tells whether claims may perform action on key, the key as the
+// client names it (without the tenant prefix)
+func (p *AccessPolicy) Allowed(claims *Claims, key string, action Action) bool {
+	if p == nil || claims == nil || IsClusterAdmin(claims) {
+		return true
+	}
+
+	allowed := false
+	for _, rule := range p.rules {
+		if !rule.appliesTo(claims) || !rule.matchesKey(key) {
+			continue
+		}
+		if rule.deny {
+			// deny write still lets read through
+			if action >= rule.access {
+				return false
+			}
+		} else if action <= rule.access {
+			allowed = true
+		}
+	}
+	return allowed || !p.defaultDeny
+}
+
+func (r policyRule) appliesTo(claims *Claims) bool {
+	for _, subject := range r.subjects {
+		kind, name, _ := strings.Cut(subject, ":")
+		switch {
+		case subject == "*":
+			return true
+		case kind == "user" && name == claims.UserID:
+			return true
+		case kind == "tenant" && name == TenantOf(claims):
+			return true
+		case kind == "role" && hasRole(claims, Role(name)):
+			return true
+		}
+	}
+	return false
+}
+
+func (r policyRule) matchesKey(key string) bool {
+	for _, pattern := range r.keys {
+		if matchGlob(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches * against any run of characters and ? against one
+func matchGlob(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star >= 0:
+			// let the last * swallow one more character
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"testing"
+
+	"distore/config"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:42", true},
+		{"user:*", "users:42", false},
+		{"*:profile", "user:42:profile", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"key?", "key1", true},
+		{"key?", "key12", false},
+		{"exact", "exact", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestAccessPolicy(t *testing.T) {
+	policy, err := NewAccessPolicy(config.AccessPolicyConfig{
+		Default: "deny",
+		Rules: []config.PolicyRuleConfig{
+			{Subjects: []string{"role:read"}, Keys: []string{"*"}, Access: "read"},
+			{Subjects: []string{"role:write"}, Keys: []string{"orders:*"}, Access: "write"},
+			{Subjects: []string{"user:bob"}, Keys: []string{"orders:archive:*"}, Access: "write", Effect: "deny"},
+			{Subjects: []string{"tenant:acme"}, Keys: []string{"config:*"}, Access: "admin"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &Claims{UserID: "alice", TenantID: "t1", Roles: []string{"read", "write"}}
+	bob := &Claims{UserID: "bob", TenantID: "t1", Roles: []string{"read", "write"}}
+	acme := &Claims{UserID: "carol", TenantID: "acme"}
+	admin := &Claims{UserID: "root", TenantID: AllTenants, Roles: []string{"admin"}}
+
+	tests := []struct {
+		name   string
+		claims *Claims
+		key    string
+		action Action
+		want   bool
+	}{
+		{"read anywhere", alice, "users:1", ActionRead, true},
+		{"write outside grant", alice, "users:1", ActionWrite, false},
+		{"write inside grant", alice, "orders:1", ActionWrite, true},
+		{"write does not include admin", alice, "orders:1", ActionAdmin, false},
+		{"deny wins over allow", bob, "orders:archive:1", ActionWrite, false},
+		{"deny write keeps read", bob, "orders:archive:1", ActionRead, true},
+		{"tenant subject", acme, "config:x", ActionAdmin, true},
+		{"default deny", acme, "users:1", ActionRead, false},
+		{"cluster admin bypasses", admin, "users:1", ActionAdmin, true},
+		{"no auth", nil, "users:1", ActionAdmin, true},
+	}
+	for _, tt := range tests {
+		if got := policy.Allowed(tt.claims, tt.key, tt.action); got != tt.want {
+			t.Errorf("%s: Allowed(%s on %q) = %v, want %v", tt.name, tt.action, tt.key, got, tt.want)
+		}
+	}
+
+	var none *AccessPolicy
+	if !none.Allowed(alice, "anything", ActionAdmin) {
+		t.Error("Expected no policy to allow everything")
+	}
+	if _, err := NewAccessPolicy(config.AccessPolicyConfig{Rules: []config.PolicyRuleConfig{{Access: "own"}}}); err == nil {
+		t.Error("Expected unknown access to be rejected")
+	}
+}
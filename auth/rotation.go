@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"distore/config"
+)
+
+// KeyRotator makes an AuthService sign with a new key on a schedule
+type KeyRotator struct {
+	service *AuthService
+
+	mu    sync.Mutex
+	cfg   config.KeyRotationConfig
+	reset chan struct{}
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func NewKeyRotator(service *AuthService, cfg config.KeyRotationConfig) *KeyRotator {
+	return &KeyRotator{service: service, cfg: cfg, reset: make(chan struct{}, 1)}
+}
+
+// Update changes the rotation schedule of a running rotator. An interval of
+// 0 pauses rotation.
+func (r *KeyRotator) Update(cfg config.KeyRotationConfig) {
+	r.mu.Lock()
+	r.cfg = cfg
+	r.mu.Unlock()
+
+	select {
+	case r.reset <- struct{}{}:
+	default:
+	}
+}
+
+// Start rotates keys in the background until Stop is called
+func (r *KeyRotator) Start() {
+	r.mu.Lock()
+	if r.stop != nil {
+		r.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	r.stop = stop
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			r.mu.Lock()
+			cfg := r.cfg
+			r.mu.Unlock()
+
+			var tick <-chan time.Time
+			var timer *time.Timer
+			if cfg.Interval > 0 {
+				timer = time.NewTimer(time.Duration(cfg.Interval) * time.Second)
+				tick = timer.C
+			}
+			select {
+			case <-tick:
+				if key, err := r.service.Rotate(rotationAlgorithm(cfg)); err != nil {
+					log.Printf("Key rotation failed: %v", err)
+				} else {
+					log.Printf("Rotated signing key, now signing with %s key %s", key.Algorithm, key.ID)
+				}
+			case <-r.reset:
+			case <-stop:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}()
+}
+
+// Stop halts the rotation
+func (r *KeyRotator) Stop() {
+	r.mu.Lock()
+	if r.stop == nil {
+		r.mu.Unlock()
+		return
+	}
+	close(r.stop)
+	r.stop = nil
+	r.mu.Unlock()
+	r.wg.Wait()
+}
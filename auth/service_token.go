@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// ServiceTokens mints the replicator tokens a node sends with internal
+// requests, reusing each one until most of its lifetime has passed
+type ServiceTokens struct {
+	mu      sync.Mutex
+	service AuthServiceInterface
+	node    string
+	token   string
+	renewAt time.Time
+}
+
+func NewServiceTokens(service AuthServiceInterface, node string) *ServiceTokens {
+	return &ServiceTokens{service: service, node: node}
+}
+
+// Token returns a valid token for this node
+func (s *ServiceTokens) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.token != "" && now.Before(s.renewAt) {
+		return s.token, nil
+	}
+
+	token, err := s.service.GenerateToken(s.node, "", []string{string(RoleReplicator)})
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	s.renewAt = now
+	if claims, err := s.service.ValidateToken(token); err == nil && claims.ExpiresAt != nil {
+		s.renewAt = now.Add(claims.ExpiresAt.Sub(now) * 4 / 5)
+	}
+	return token, nil
+}
@@ -0,0 +1,231 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// Status is an admin answer the client does not model, decoded from JSON
+type Status map[string]interface{}
+
+// Admin sends a request to an admin route, e.g. Admin(ctx, "GET",
+// "/admin/lifecycle", nil), for the routes without a method of their own
+func (c *Client) Admin(ctx context.Context, method, path string, body interface{}) (Status, error) {
+	var resp Status
+	req := request{method: method, path: path, body: body, idempotent: method == "GET"}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Nodes lists the members of the cluster
+func (c *Client) Nodes(ctx context.Context) ([]string, error) {
+	return c.nodesRequest(ctx, request{method: "GET", path: "/admin/nodes", idempotent: true})
+}
+
+// AddNode adds a member and returns the new member list
+func (c *Client) AddNode(ctx context.Context, node string) ([]string, error) {
+	return c.nodesRequest(ctx, request{method: "POST", path: "/admin/nodes", body: map[string]string{"node": node}, idempotent: true})
+}
+
+// RemoveNode removes a member and returns the new member list
+func (c *Client) RemoveNode(ctx context.Context, node string) ([]string, error) {
+	return c.nodesRequest(ctx, request{method: "DELETE", path: "/admin/nodes/" + escape(node), idempotent: true})
+}
+
+func (c *Client) nodesRequest(ctx context.Context, req request) ([]string, error) {
+	var resp struct {
+		Nodes []string `json:"nodes"`
+	}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Nodes, nil
+}
+
+// NodeStatus is the failure detector's view of a node
+type NodeStatus struct {
+	Node      string    `json:"node"`
+	State     string    `json:"state"`
+	Online    bool      `json:"online"`
+	Phi       float64   `json:"phi"`
+	LatencyMs int64     `json:"latency_ms"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// NodeStatus returns the health of the members, as seen by one node
+func (c *Client) NodeStatus(ctx context.Context) ([]NodeStatus, error) {
+	var resp struct {
+		Nodes []NodeStatus `json:"nodes"`
+	}
+	if err := c.do(ctx, request{method: "GET", path: "/admin/nodes/status", idempotent: true}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Nodes, nil
+}
+
+// Rebalance starts moving data to the nodes that own it. full moves every
+// key instead of the keys whose owners changed.
+func (c *Client) Rebalance(ctx context.Context, full bool) (Status, error) {
+	return c.Admin(ctx, "POST", "/admin/rebalance", map[string]bool{"full": full})
+}
+
+// RebalanceStatus returns the progress of the rebalance of a node
+func (c *Client) RebalanceStatus(ctx context.Context) (Status, error) {
+	return c.Admin(ctx, "GET", "/admin/rebalance/status", nil)
+}
+
+// ControlRebalance pauses, resumes or cancels the running rebalance:
+// action is "pause", "resume" or "cancel"
+func (c *Client) ControlRebalance(ctx context.Context, action string) (Status, error) {
+	return c.Admin(ctx, "POST", "/admin/rebalance/"+escape(action), nil)
+}
+
+// Repair starts copying a node's values to the other replicas of its keys
+// where they differ, to every replica or to node only
+func (c *Client) Repair(ctx context.Context, node string) (Status, error) {
+	return c.Admin(ctx, "POST", "/admin/repair", map[string]string{"node": node})
+}
+
+// RepairStatus returns the progress of the repair of a node
+func (c *Client) RepairStatus(ctx context.Context) (Status, error) {
+	return c.Admin(ctx, "GET", "/admin/repair/status", nil)
+}
+
+// CancelRepair stops the running repair of a node
+func (c *Client) CancelRepair(ctx context.Context) (Status, error) {
+	return c.Admin(ctx, "POST", "/admin/repair/cancel", nil)
+}
+
+// HintStats describes the hints a node keeps for an unreachable node
+type HintStats struct {
+	Node     string    `json:"node"`
+	Hints    int       `json:"hints"`
+	Oldest   time.Time `json:"oldest"`
+	Attempts int       `json:"attempts"`
+}
+
+// Hints lists the hints kept by a node, by target node
+func (c *Client) Hints(ctx context.Context) ([]HintStats, error) {
+	var resp struct {
+		Nodes []HintStats `json:"nodes"`
+	}
+	if err := c.do(ctx, request{method: "GET", path: "/admin/hints", idempotent: true}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Nodes, nil
+}
+
+// DeliverHints makes a node deliver its hints now, and returns the number
+// delivered and the number left
+func (c *Client) DeliverHints(ctx context.Context) (delivered, remaining int, err error) {
+	var resp struct {
+		Delivered int `json:"delivered"`
+		Remaining int `json:"remaining"`
+	}
+	if err := c.do(ctx, request{method: "POST", path: "/admin/hints/deliver", idempotent: true}, &resp); err != nil {
+		return 0, 0, err
+	}
+	return resp.Delivered, resp.Remaining, nil
+}
+
+// DropHints discards the hints a node keeps for target, and returns their
+// number
+func (c *Client) DropHints(ctx context.Context, target string) (int, error) {
+	var resp struct {
+		Dropped int `json:"dropped"`
+	}
+	if err := c.do(ctx, request{method: "DELETE", path: "/admin/hints/" + escape(target), idempotent: true}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Dropped, nil
+}
+
+// ReadOnly returns the read-only state of a node
+func (c *Client) ReadOnly(ctx context.Context) (Status, error) {
+	return c.Admin(ctx, "GET", "/admin/readonly", nil)
+}
+
+// SetReadOnly sets the read-only mode of a node: "read_only", "writable"
+// or "auto"
+func (c *Client) SetReadOnly(ctx context.Context, mode, reason string) (Status, error) {
+	return c.Admin(ctx, "POST", "/admin/readonly", map[string]string{"mode": mode, "reason": reason})
+}
+
+// Config returns the members, the replica count and the settings waiting
+// for a restart
+func (c *Client) Config(ctx context.Context) (Status, error) {
+	return c.Admin(ctx, "GET", "/admin/config", nil)
+}
+
+// UpdateConfig changes the members, unless nodes is empty, and the replica
+// count, unless replicaCount is nil
+func (c *Client) UpdateConfig(ctx context.Context, nodes []string, replicaCount *int) (Status, error) {
+	body := map[string]interface{}{}
+	if len(nodes) > 0 {
+		body["nodes"] = nodes
+	}
+	if replicaCount != nil {
+		body["replica_count"] = *replicaCount
+	}
+	return c.Admin(ctx, "PATCH", "/admin/config", body)
+}
+
+// ReloadConfig makes a node re-read its config file
+func (c *Client) ReloadConfig(ctx context.Context) (Status, error) {
+	return c.Admin(ctx, "POST", "/admin/config/reload", nil)
+}
+
+// Metadata returns the cluster metadata of a node
+func (c *Client) Metadata(ctx context.Context) (Status, error) {
+	return c.Admin(ctx, "GET", "/admin/metadata", nil)
+}
+
+// Backup writes the data of a node to a file on that node, and returns the
+// number of keys written
+func (c *Client) Backup(ctx context.Context, path string) (int, error) {
+	var resp struct {
+		Count int `json:"count"`
+	}
+	if err := c.do(ctx, request{method: "POST", path: "/admin/backup", body: map[string]string{"path": path}}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// BackupItems returns the keys of the caller's tenant with their values,
+// as stored: values encrypted by the client stay encrypted
+func (c *Client) BackupItems(ctx context.Context) ([]KeyValue, error) {
+	var resp struct {
+		Items []KeyValue `json:"items"`
+	}
+	if err := c.do(ctx, request{method: "POST", path: "/admin/backup", body: map[string]string{}}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Items, nil
+}
+
+// Restore loads a backup file on the node into the cluster, and returns
+// the number of keys restored
+func (c *Client) Restore(ctx context.Context, path string) (int, error) {
+	return c.restore(ctx, map[string]interface{}{"path": path})
+}
+
+// RestoreItems writes items as they are, e.g. from BackupItems
+func (c *Client) RestoreItems(ctx context.Context, items []KeyValue) (int, error) {
+	if items == nil {
+		items = []KeyValue{}
+	}
+	return c.restore(ctx, map[string]interface{}{"items": items})
+}
+
+func (c *Client) restore(ctx context.Context, body map[string]interface{}) (int, error) {
+	var resp struct {
+		Count int `json:"count"`
+	}
+	if err := c.do(ctx, request{method: "POST", path: "/admin/restore", body: body, idempotent: true}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Credentials get the client its tokens from /auth/token. Set the fields of
+// one grant: a user and password, a client ID and secret, an API key, or a
+// refresh token kept from an earlier login.
+type Credentials struct {
+	UserID       string
+	Password     string
+	ClientID     string
+	ClientSecret string
+	APIKey       string
+	RefreshToken string
+}
+
+func (cr Credentials) grant() map[string]string {
+	switch {
+	case cr.UserID != "":
+		return map[string]string{"grant_type": "password", "user_id": cr.UserID, "password": cr.Password}
+	case cr.ClientID != "":
+		return map[string]string{"grant_type": "client_credentials", "client_id": cr.ClientID, "client_secret": cr.ClientSecret}
+	case cr.APIKey != "":
+		return map[string]string{"grant_type": "api_key", "api_key": cr.APIKey}
+	default:
+		return map[string]string{"grant_type": "refresh_token", "refresh_token": cr.RefreshToken}
+	}
+}
+
+// TokenPair is a token issued by /auth/token
+type TokenPair struct {
+	Token        string `json:"token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // seconds
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// authError is a failure to get a token, which retrying does not fix
+type authError struct {
+	err error
+}
+
+func (e *authError) Error() string { return "distore: login failed: " + e.err.Error() }
+func (e *authError) Unwrap() error { return e.err }
+
+// tokenSource holds the current token of a client with credentials
+type tokenSource struct {
+	mu      sync.Mutex
+	creds   Credentials
+	pair    *TokenPair
+	expires time.Time
+}
+
+// refreshBefore is how long before its expiry a token is replaced
+const refreshBefore = 30 * time.Second
+
+// reset drops the current token, keeping the refresh token
+func (ts *tokenSource) reset() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.expires = time.Time{}
+}
+
+// token returns the bearer token of a request
+func (c *Client) token(ctx context.Context) (string, error) {
+	if c.auth == nil {
+		return c.cfg.Token, nil
+	}
+	c.auth.mu.Lock()
+	defer c.auth.mu.Unlock()
+	if c.auth.pair != nil && time.Until(c.auth.expires) > refreshBefore {
+		return c.auth.pair.Token, nil
+	}
+	if err := c.loginLocked(ctx); err != nil {
+		return "", &authError{err}
+	}
+	return c.auth.pair.Token, nil
+}
+
+// loginLocked refreshes the token, or requests one with the credentials
+// when there is no refresh token or it was refused
+func (c *Client) loginLocked(ctx context.Context) error {
+	ts := c.auth
+	if ts.pair != nil && ts.pair.RefreshToken != "" {
+		refresh := Credentials{RefreshToken: ts.pair.RefreshToken}
+		if err := c.requestToken(ctx, refresh.grant()); err == nil {
+			return nil
+		}
+	}
+	if ts.creds == (Credentials{}) {
+		return errors.New("no credentials")
+	}
+	return c.requestToken(ctx, ts.creds.grant())
+}
+
+func (c *Client) requestToken(ctx context.Context, grant map[string]string) error {
+	var pair TokenPair
+	if err := c.do(ctx, request{method: "POST", path: "/auth/token", body: grant, idempotent: true, anonymous: true, direct: true}, &pair); err != nil {
+		return err
+	}
+	c.auth.pair = &pair
+	c.auth.expires = time.Now().Add(time.Duration(pair.ExpiresIn) * time.Second)
+	if c.cfg.OnToken != nil {
+		c.cfg.OnToken(pair)
+	}
+	return nil
+}
+
+// Login requests a token with the credentials now, instead of on the first
+// request. The pair returned can be kept to log in with its refresh token
+// later.
+func (c *Client) Login(ctx context.Context) (*TokenPair, error) {
+	if c.auth == nil {
+		return nil, errors.New("distore: the client has no credentials")
+	}
+	c.auth.mu.Lock()
+	defer c.auth.mu.Unlock()
+	c.auth.expires = time.Time{}
+	if err := c.requestToken(ctx, c.auth.creds.grant()); err != nil {
+		return nil, err
+	}
+	pair := *c.auth.pair
+	return &pair, nil
+}
+
+// Logout revokes the token and the refresh token of the client
+func (c *Client) Logout(ctx context.Context) error {
+	if c.auth == nil {
+		return nil
+	}
+	c.auth.mu.Lock()
+	pair := c.auth.pair
+	c.auth.mu.Unlock()
+	if pair == nil {
+		return nil
+	}
+	body := map[string]string{"refresh_token": pair.RefreshToken}
+	if err := c.do(ctx, request{method: "POST", path: "/auth/logout", body: body, idempotent: true, direct: true}, nil); err != nil {
+		return err
+	}
+	c.auth.mu.Lock()
+	defer c.auth.mu.Unlock()
+	c.auth.pair, c.auth.expires = nil, time.Time{}
+	return nil
+}
@@ -0,0 +1,390 @@
+// Package client is a Go client of distore's HTTP API. It discovers the
+// nodes of the cluster from seed endpoints, fails over between them,
+// retries with backoff and can send each key to the node that owns it.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for keys that do not exist
+var ErrNotFound = errors.New("key not found")
+
+// ErrNoNodes is returned when no endpoint is configured
+var ErrNoNodes = errors.New("no node to send the request to")
+
+// Error is an error answered by the server
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("distore: %d %s", e.Status, e.Message)
+}
+
+// Config configures a client
+type Config struct {
+	// Endpoints are base URLs of seed nodes, e.g. http://localhost:8080.
+	// The other nodes of the cluster are discovered from them.
+	Endpoints []string
+
+	Token       string       // static bearer token, empty when auth is disabled
+	Credentials *Credentials // requests tokens and refreshes them, instead of Token
+	HTTPClient  *http.Client // default: pooled connections and a 10 second timeout
+
+	// OnToken is called with each token pair got with Credentials.
+	// Refresh tokens are used once, so a program keeping one across runs
+	// saves the latest.
+	OnToken func(TokenPair)
+
+	MaxRetries   int           // retries of a failed request, default 3, negative disables
+	RetryBackoff time.Duration // delay before the first retry, doubled on each, default 100ms
+	MaxBackoff   time.Duration // longest delay between retries, default 2s
+
+	DisableDiscovery  bool          // only talk to Endpoints
+	DiscoveryInterval time.Duration // how often the node list is refreshed, default 30s
+
+	// KeyRouting sends the requests on a key to the node that owns it. The
+	// owners of a key are looked up on its first request.
+	KeyRouting bool
+
+	// Encryption encrypts values before they leave the client, nil sends
+	// them as they are
+	Encryption *FieldEncryption
+}
+
+const (
+	defaultMaxRetries        = 3
+	defaultRetryBackoff      = 100 * time.Millisecond
+	defaultMaxBackoff        = 2 * time.Second
+	defaultDiscoveryInterval = 30 * time.Second
+
+	// downFor is how long a node that refused a connection is tried last
+	downFor = 5 * time.Second
+	// maxPlacements bounds the owners remembered, the cache is cleared
+	// when it is full
+	maxPlacements = 10000
+)
+
+// Client calls the API of the nodes of a cluster. It is safe for
+// concurrent use.
+type Client struct {
+	cfg    Config
+	http   *http.Client
+	scheme string // of the seed endpoints, used for discovered nodes
+	auth   *tokenSource
+
+	mu          sync.Mutex
+	nodes       []*node // discovered nodes, then the seeds not among them
+	next        int     // spreads requests over the nodes
+	discovered  time.Time
+	discovering bool
+	placement   map[string][]string
+}
+
+type node struct {
+	url       string
+	downUntil time.Time
+}
+
+func New(cfg Config) *Client {
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = defaultRetryBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if cfg.DiscoveryInterval <= 0 {
+		cfg.DiscoveryInterval = defaultDiscoveryInterval
+	}
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 32,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+
+	c := &Client{cfg: cfg, http: httpClient, scheme: "http", placement: make(map[string][]string)}
+	for _, endpoint := range cfg.Endpoints {
+		endpoint = strings.TrimRight(endpoint, "/")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		c.nodes = append(c.nodes, &node{url: endpoint})
+	}
+	if len(c.nodes) > 0 {
+		c.scheme, _, _ = strings.Cut(c.nodes[0].url, "://")
+	}
+	if cfg.Credentials != nil {
+		c.auth = &tokenSource{creds: *cfg.Credentials}
+	}
+	return c
+}
+
+// Node returns a client sending every request to one node, sharing the
+// connections and the tokens of c
+func (c *Client) Node(addr string) *Client {
+	cfg := c.cfg
+	cfg.Endpoints, cfg.DisableDiscovery, cfg.KeyRouting = []string{c.nodeURL(addr)}, true, false
+	n := New(cfg)
+	n.http, n.auth = c.http, c.auth
+	return n
+}
+
+// Close releases the idle connections
+func (c *Client) Close() {
+	c.http.CloseIdleConnections()
+}
+
+// nodeURL turns a node address as the cluster names it into a base URL
+func (c *Client) nodeURL(addr string) string {
+	if strings.Contains(addr, "://") {
+		return strings.TrimRight(addr, "/")
+	}
+	return c.scheme + "://" + addr
+}
+
+// request describes a call of the API
+type request struct {
+	method string
+	path   string
+	body   interface{}
+	key    string // sends the request to the owners of key first
+	// idempotent requests can be sent again to any node. The others carry
+	// an idempotency key and are only retried on the node that got them,
+	// unless it could not be reached.
+	idempotent bool
+	anonymous  bool // sent without a token
+	direct     bool // neither discovers nodes nor looks up owners
+}
+
+// do sends a request, retrying and failing over, and decodes the JSON
+// answer into out
+func (c *Client) do(ctx context.Context, req request, out interface{}) error {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return err
+		}
+	}
+	idempotencyKey := ""
+	if !req.idempotent && req.method != http.MethodGet {
+		idempotencyKey = newIdempotencyKey()
+	}
+
+	nodes := c.candidates(ctx, req)
+	if len(nodes) == 0 {
+		return ErrNoNodes
+	}
+	current, reauthenticated := 0, false
+	for attempt := 0; ; attempt++ {
+		n := nodes[current%len(nodes)]
+		status, header, data, err := c.send(ctx, n, req, body, idempotencyKey)
+		if err == nil && status == http.StatusUnauthorized && c.auth != nil && !req.anonymous && !reauthenticated {
+			// The token may have been revoked or signed with a retired key
+			reauthenticated = true
+			c.auth.reset()
+			attempt--
+			continue
+		}
+		if err == nil && status < 400 {
+			if out == nil || len(data) == 0 {
+				return nil
+			}
+			return json.Unmarshal(data, out)
+		}
+		if err == nil {
+			err = &Error{Status: status, Message: strings.TrimSpace(string(data))}
+		}
+
+		retry := retryable(ctx, status, err)
+		if !retry || attempt >= c.cfg.MaxRetries {
+			return err
+		}
+		if status == 0 {
+			c.markDown(n)
+		}
+		if req.idempotent || unreached(err) {
+			current++
+		}
+		if err := c.sleep(ctx, attempt, header); err != nil {
+			return err
+		}
+	}
+}
+
+// send makes one attempt. status is 0 when the node did not answer.
+func (c *Client) send(ctx context.Context, n *node, req request, body []byte, idempotencyKey string) (int, http.Header, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, n.url+req.path, reader)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		httpReq.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	if !req.anonymous {
+		token, err := c.token(ctx)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if token != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return resp.StatusCode, resp.Header, data, nil
+}
+
+// retryable tells whether a failed attempt is worth another one
+func retryable(ctx context.Context, status int, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		var authErr *authError
+		return !errors.As(err, &authErr) // the node did not answer
+	}
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// unreached tells whether a request failed before it reached the node, so
+// that sending it to another node cannot apply it twice
+func unreached(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// sleep waits before retry number attempt+1: the Retry-After of the answer,
+// or an exponential backoff with jitter
+func (c *Client) sleep(ctx context.Context, attempt int, header http.Header) error {
+	delay := c.cfg.RetryBackoff << uint(attempt)
+	if delay > c.cfg.MaxBackoff || delay <= 0 {
+		delay = c.cfg.MaxBackoff
+	}
+	delay = delay/2 + time.Duration(mathrand.Int63n(int64(delay/2)+1))
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil && seconds >= 0 {
+		delay = time.Duration(seconds) * time.Second
+		if delay > c.cfg.MaxBackoff {
+			delay = c.cfg.MaxBackoff
+		}
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// candidates lists the nodes to try in order: the owners of the key, then
+// the others in turn, the nodes recently unreachable last
+func (c *Client) candidates(ctx context.Context, req request) []*node {
+	if !req.direct {
+		c.maybeDiscover(ctx)
+	}
+	var owners []string
+	if c.cfg.KeyRouting && req.key != "" && !req.direct {
+		owners = c.owners(ctx, req.key)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ordered := make([]*node, 0, len(c.nodes))
+	seen := make(map[*node]bool, len(c.nodes))
+	for _, owner := range owners {
+		for _, n := range c.nodes {
+			if n.url == c.nodeURL(owner) && !seen[n] {
+				ordered = append(ordered, n)
+				seen[n] = true
+			}
+		}
+	}
+	if len(c.nodes) > 0 {
+		c.next = (c.next + 1) % len(c.nodes)
+	}
+	for i := range c.nodes {
+		if n := c.nodes[(c.next+i)%len(c.nodes)]; !seen[n] {
+			ordered = append(ordered, n)
+		}
+	}
+
+	now := time.Now()
+	up := make([]*node, 0, len(ordered))
+	var down []*node
+	for _, n := range ordered {
+		if now.Before(n.downUntil) {
+			down = append(down, n)
+		} else {
+			up = append(up, n)
+		}
+	}
+	return append(up, down...)
+}
+
+func (c *Client) markDown(n *node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n.downUntil = time.Now().Add(downFor)
+}
+
+// escape escapes a key for a path
+func escape(key string) string {
+	return url.PathEscape(key)
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// ClusterNodes lists the nodes of the cluster and its replica count
+func (c *Client) ClusterNodes(ctx context.Context) ([]string, int, error) {
+	var resp struct {
+		Nodes        []string `json:"nodes"`
+		ReplicaCount int      `json:"replica_count"`
+	}
+	if err := c.do(ctx, request{method: "GET", path: "/cluster/nodes", idempotent: true, direct: true}, &resp); err != nil {
+		return nil, 0, err
+	}
+	return resp.Nodes, resp.ReplicaCount, nil
+}
+
+// Health checks that a node answers, without a token
+func (c *Client) Health(ctx context.Context) error {
+	return c.do(ctx, request{method: "GET", path: "/health", idempotent: true, anonymous: true, direct: true}, nil)
+}
+
+// Placement returns the nodes holding each key, owner first
+func (c *Client) Placement(ctx context.Context, keys ...string) (map[string][]string, error) {
+	query := url.Values{"key": keys}
+	var resp struct {
+		Placement map[string][]string `json:"placement"`
+	}
+	if err := c.do(ctx, request{method: "GET", path: "/cluster/placement?" + query.Encode(), idempotent: true, direct: true}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Placement, nil
+}
+
+// Discover refreshes the node list from the cluster. The seed endpoints
+// stay in the list, after the discovered nodes.
+func (c *Client) Discover(ctx context.Context) error {
+	nodes, _, err := c.ClusterNodes(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.discovered = time.Now()
+	if err != nil || len(nodes) == 0 {
+		return err
+	}
+
+	known := make(map[string]*node, len(c.nodes))
+	for _, n := range c.nodes {
+		known[n.url] = n
+	}
+	updated := make([]*node, 0, len(nodes)+len(c.cfg.Endpoints))
+	changed := false
+	for _, addr := range nodes {
+		u := c.nodeURL(addr)
+		n, ok := known[u]
+		if !ok {
+			n, changed = &node{url: u}, true
+		}
+		delete(known, u)
+		updated = append(updated, n)
+	}
+	for _, n := range c.nodes {
+		if _, ok := known[n.url]; ok && c.isSeed(n.url) {
+			updated = append(updated, n)
+			delete(known, n.url)
+		}
+	}
+	if changed || len(known) > 0 {
+		// Owners move when the members change
+		c.placement = make(map[string][]string)
+	}
+	c.nodes = updated
+	return nil
+}
+
+func (c *Client) isSeed(u string) bool {
+	for _, endpoint := range c.cfg.Endpoints {
+		if c.nodeURL(endpoint) == u {
+			return true
+		}
+	}
+	return false
+}
+
+// maybeDiscover refreshes the node list when it is due: before the first
+// request, then in the background
+func (c *Client) maybeDiscover(ctx context.Context) {
+	if c.cfg.DisableDiscovery {
+		return
+	}
+	c.mu.Lock()
+	first := c.discovered.IsZero()
+	start := !c.discovering && (first || time.Since(c.discovered) > c.cfg.DiscoveryInterval)
+	if start {
+		c.discovering = true
+	}
+	c.mu.Unlock()
+	if !start {
+		return
+	}
+
+	discover := func(ctx context.Context) {
+		c.Discover(ctx)
+		c.mu.Lock()
+		c.discovering = false
+		c.mu.Unlock()
+	}
+	if first {
+		discover(ctx)
+	} else {
+		go discover(context.Background())
+	}
+}
+
+// owners returns the nodes holding key, looked up on its first request
+func (c *Client) owners(ctx context.Context, key string) []string {
+	c.mu.Lock()
+	owners, ok := c.placement[key]
+	c.mu.Unlock()
+	if ok {
+		return owners
+	}
+
+	placement, err := c.Placement(ctx, key)
+	if err != nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.placement) >= maxPlacements {
+		c.placement = make(map[string][]string)
+	}
+	c.placement[key] = placement[key]
+	return placement[key]
+}
@@ -0,0 +1,250 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// KeyValue is a key and its value
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Set writes the value of key
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	stored, err := c.encrypt(key, value)
+	if err != nil {
+		return err
+	}
+	body := KeyValue{Key: key, Value: stored}
+	return c.do(ctx, request{method: "POST", path: "/set", body: body, key: key, idempotent: true}, nil)
+}
+
+// Get reads the value of key
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var resp KeyValue
+	err := c.do(ctx, request{method: "GET", path: "/get/" + escape(key), key: key, idempotent: true}, &resp)
+	if err != nil {
+		return "", notFound(err)
+	}
+	return c.decrypt(key, resp.Value)
+}
+
+// Delete removes key
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return notFound(c.do(ctx, request{method: "DELETE", path: "/delete/" + escape(key), key: key}, nil))
+}
+
+// Keys reads every key of the caller's tenant with its value
+func (c *Client) Keys(ctx context.Context) ([]KeyValue, error) {
+	var resp struct {
+		Items []KeyValue `json:"items"`
+	}
+	if err := c.do(ctx, request{method: "GET", path: "/keys", idempotent: true}, &resp); err != nil {
+		return nil, err
+	}
+	for i, item := range resp.Items {
+		value, err := c.decrypt(item.Key, item.Value)
+		if err != nil {
+			return nil, err
+		}
+		resp.Items[i].Value = value
+	}
+	return resp.Items, nil
+}
+
+// SetWithTTL writes the value of key, which expires after ttl
+func (c *Client) SetWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	stored, err := c.encrypt(key, value)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{"key": key, "value": stored, "ttl": int64(ttl / time.Second)}
+	return c.do(ctx, request{method: "POST", path: "/advanced/ttl", body: body, key: key, idempotent: true}, nil)
+}
+
+// Increment adds delta to the integer value of key and returns the new
+// value. Counters are not encrypted, the server has to read them. With
+// client-side encryption, reading them with Get needs
+// FieldEncryption.AllowPlaintext.
+func (c *Client) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	var resp struct {
+		Value int64 `json:"value"`
+	}
+	body := map[string]interface{}{"key": key, "delta": delta}
+	if err := c.do(ctx, request{method: "POST", path: "/advanced/increment", body: body, key: key}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Value, nil
+}
+
+// CASResult is the outcome of a compare-and-set
+type CASResult struct {
+	Success      bool
+	Version      int64
+	CurrentValue string // when it failed
+}
+
+// CompareAndSet writes newValue if key holds expected, "" meaning that the
+// key does not exist, and if its version is expectedVersion unless 0.
+// With encryption, a value stored under a key since rotated is compared
+// under the key ID it names, so the provider must keep that key until the
+// value has been rewritten.
+func (c *Client) CompareAndSet(ctx context.Context, key, expected, newValue string, expectedVersion int64) (*CASResult, error) {
+	storedExpected, err := c.encryptExpected(key, expected)
+	if err != nil {
+		return nil, err
+	}
+	storedNew, err := c.encrypt(key, newValue)
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.cas(ctx, key, storedExpected, storedNew, expectedVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server compares ciphertexts. A value encrypted at random, or
+	// under a key since rotated, holds the expected plaintext under another
+	// ciphertext: decrypt it with the key ID it names and, when it matches,
+	// compare again with the stored ciphertext.
+	if c.cfg.Encryption != nil && !result.Success && expected != "" && result.CurrentValue != storedExpected {
+		if current, err := c.decrypt(key, result.CurrentValue); err == nil && current == expected {
+			if result, err = c.cas(ctx, key, result.CurrentValue, storedNew, expectedVersion); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if result.CurrentValue != "" {
+		if result.CurrentValue, err = c.decrypt(key, result.CurrentValue); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (c *Client) cas(ctx context.Context, key, expected, newValue string, expectedVersion int64) (*CASResult, error) {
+	var resp struct {
+		Success      bool   `json:"success"`
+		Version      int64  `json:"version"`
+		CurrentValue string `json:"current_value"`
+	}
+	body := map[string]interface{}{"key": key, "expected_value": expected, "new_value": newValue, "expected_version": expectedVersion}
+	if err := c.do(ctx, request{method: "POST", path: "/advanced/cas", body: body, key: key}, &resp); err != nil {
+		return nil, err
+	}
+	return &CASResult{Success: resp.Success, Version: resp.Version, CurrentValue: resp.CurrentValue}, nil
+}
+
+// BatchOp is an operation of a batch: "set", "get" or "delete"
+type BatchOp struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// BatchResult is the outcome of a batch operation
+type BatchResult struct {
+	Op    BatchOp
+	Value string // read by a get
+	Err   error
+}
+
+// Batch runs operations in one request. The results are in the order of
+// the operations.
+func (c *Client) Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	sent := make([]BatchOp, len(ops))
+	for i, op := range ops {
+		sent[i] = op
+		if op.Type == "set" {
+			stored, err := c.encrypt(op.Key, op.Value)
+			if err != nil {
+				return nil, err
+			}
+			sent[i].Value = stored
+		}
+	}
+
+	var resp struct {
+		Results []struct {
+			Error json.RawMessage
+			Value string
+		} `json:"results"`
+	}
+	err := c.do(ctx, request{method: "POST", path: "/advanced/batch", body: map[string]interface{}{"operations": sent}}, &resp)
+	var apiErr *Error
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.Status == http.StatusInsufficientStorage) {
+		return nil, err
+	}
+	if len(resp.Results) != len(ops) {
+		return nil, fmt.Errorf("distore: %d results for %d operations", len(resp.Results), len(ops))
+	}
+
+	results := make([]BatchResult, len(ops))
+	for i, r := range resp.Results {
+		results[i] = BatchResult{Op: ops[i]}
+		switch {
+		case len(r.Error) > 0 && string(r.Error) != "null":
+			results[i].Err = fmt.Errorf("distore: %s of %s failed", ops[i].Type, ops[i].Key)
+		case ops[i].Type == "get":
+			results[i].Value, results[i].Err = c.decrypt(ops[i].Key, r.Value)
+		}
+	}
+	return results, nil
+}
+
+// AcquireLock takes the lock named key for timeout, and tells whether it
+// got it
+func (c *Client) AcquireLock(ctx context.Context, key string, timeout time.Duration) (bool, error) {
+	var resp struct {
+		Acquired bool `json:"acquired"`
+	}
+	body := map[string]interface{}{"timeout": int64(timeout / time.Second)}
+	if err := c.do(ctx, request{method: "POST", path: "/advanced/lock/" + escape(key), body: body, key: key}, &resp); err != nil {
+		return false, err
+	}
+	return resp.Acquired, nil
+}
+
+// ReleaseLock releases the lock named key
+func (c *Client) ReleaseLock(ctx context.Context, key string) error {
+	return c.do(ctx, request{method: "DELETE", path: "/advanced/lock/" + escape(key), key: key, idempotent: true}, nil)
+}
+
+// notFound turns a 404 into ErrNotFound
+func notFound(err error) error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (c *Client) encrypt(key, value string) (string, error) {
+	if c.cfg.Encryption == nil {
+		return value, nil
+	}
+	return c.cfg.Encryption.Encrypt(key, value)
+}
+
+// encryptExpected encrypts the expected value of a compare-and-set. ""
+// stands for a missing key and is sent as it is.
+func (c *Client) encryptExpected(key, expected string) (string, error) {
+	if expected == "" {
+		return "", nil
+	}
+	return c.encrypt(key, expected)
+}
+
+func (c *Client) decrypt(key, value string) (string, error) {
+	if c.cfg.Encryption == nil {
+		return value, nil
+	}
+	return c.cfg.Encryption.Decrypt(key, value)
+}
@@ -0,0 +1,259 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"distore/encryption"
+)
+
+// valuePrefix starts every value encrypted by the client, followed by the
+// mode ("r" at random, "d" deterministic), the key ID and the sealed value
+// in base64: "\x00cse1:<mode>:<key id>:<base64>"
+const valuePrefix = "\x00cse1:"
+
+// ErrDecrypt is returned for values that cannot be decrypted: tampered
+// with, moved to another key or encrypted with a key the provider lacks
+var ErrDecrypt = errors.New("cannot decrypt value")
+
+// KeyProvider supplies the AES-256 keys the client encrypts values with.
+// The server never sees them.
+type KeyProvider interface {
+	// CurrentKeyID names the key new values are encrypted with
+	CurrentKeyID() string
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider holding keys in memory
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (s *StaticKeys) CurrentKeyID() string {
+	return s.Current
+}
+
+func (s *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := s.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+// FileKeys is a KeyProvider reading a key file in the format of the master
+// key files of the server, created with genkeys master
+type FileKeys struct {
+	path string
+	mu   sync.RWMutex
+	keys *encryption.MasterKeys
+}
+
+func NewFileKeys(path string) (*FileKeys, error) {
+	f := &FileKeys{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload re-reads the key file, after a key was added to it
+func (f *FileKeys) Reload() error {
+	keys, err := encryption.ReadMasterKeys(f.path)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys = keys
+	return nil
+}
+
+func (f *FileKeys) CurrentKeyID() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.keys.Current
+}
+
+func (f *FileKeys) Key(id string) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	key, ok := f.keys.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q in %s", id, f.path)
+	}
+	return key, nil
+}
+
+// FieldEncryption encrypts values on the client with AES-256-GCM, bound to
+// their key. Values are encrypted at random, so that equal values look
+// different, except for the keys matching a deterministic pattern: equal
+// values of such a key encrypt the same, which a compare-and-set needs to
+// succeed in one round trip.
+type FieldEncryption struct {
+	keys          KeyProvider
+	deterministic []string
+	plaintext     []string // patterns of the keys whose values may be unencrypted
+
+	mu     sync.Mutex
+	derive map[string]*derivedKeys
+}
+
+// derivedKeys are the keys derived from a provider's key
+type derivedKeys struct {
+	aead cipher.AEAD
+	siv  []byte // derives the nonces of deterministic values
+}
+
+// NewFieldEncryption encrypts with the keys of provider. Keys matching one
+// of the deterministic patterns (path.Match syntax) are encrypted
+// deterministically.
+func NewFieldEncryption(keys KeyProvider, deterministic ...string) (*FieldEncryption, error) {
+	if err := checkPatterns("deterministic", deterministic); err != nil {
+		return nil, err
+	}
+	return &FieldEncryption{keys: keys, deterministic: deterministic, derive: make(map[string]*derivedKeys)}, nil
+}
+
+// AllowPlaintext lets the values of the keys matching one of the patterns
+// be read back unencrypted: counters, or values written before client-side
+// encryption ("*" for every key). Other values that are not encrypted are
+// refused, as the server could otherwise answer with values of its choice.
+// It must be called before the client is used.
+func (e *FieldEncryption) AllowPlaintext(patterns ...string) error {
+	if err := checkPatterns("plaintext", patterns); err != nil {
+		return err
+	}
+	e.plaintext = append(e.plaintext, patterns...)
+	return nil
+}
+
+func checkPatterns(kind string, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s pattern %q: %w", kind, pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Deterministic tells whether the values of key are encrypted
+// deterministically
+func (e *FieldEncryption) Deterministic(key string) bool {
+	return matchAny(e.deterministic, key)
+}
+
+func (e *FieldEncryption) keysFor(id string) (*derivedKeys, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if d, ok := e.derive[id]; ok {
+		return d, nil
+	}
+	key, err := e.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key %q has %d bytes, AES-256 needs 32", id, len(key))
+	}
+	block, err := aes.NewCipher(subkey(key, "distore client encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	d := &derivedKeys{aead: aead, siv: subkey(key, "distore client nonces")}
+	e.derive[id] = d
+	return d, nil
+}
+
+func subkey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Encrypt encrypts the value of key with the current key of the provider
+func (e *FieldEncryption) Encrypt(key, value string) (string, error) {
+	id := e.keys.CurrentKeyID()
+	if strings.Contains(id, ":") {
+		return "", fmt.Errorf("key ID %q contains a colon", id)
+	}
+	d, err := e.keysFor(id)
+	if err != nil {
+		return "", err
+	}
+
+	mode := "r"
+	nonce := make([]byte, d.aead.NonceSize())
+	if e.Deterministic(key) {
+		// The nonce is a MAC of the key and the value: only equal values
+		// of the same key share it
+		mode = "d"
+		mac := hmac.New(sha256.New, d.siv)
+		binary.Write(mac, binary.BigEndian, uint32(len(key)))
+		mac.Write([]byte(key))
+		mac.Write([]byte(value))
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := d.aead.Seal(nonce, nonce, []byte(value), []byte(key))
+	return valuePrefix + mode + ":" + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value of key. Values that are not encrypted are
+// returned as they are for the keys of AllowPlaintext only.
+func (e *FieldEncryption) Decrypt(key, value string) (string, error) {
+	rest, found := strings.CutPrefix(value, valuePrefix)
+	if !found {
+		if matchAny(e.plaintext, key) {
+			return value, nil
+		}
+		return "", fmt.Errorf("%w of %s: not encrypted", ErrDecrypt, key)
+	}
+	parts := strings.SplitN(rest, ":", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%w of %s: malformed", ErrDecrypt, key)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w of %s: %v", ErrDecrypt, key, err)
+	}
+	d, err := e.keysFor(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("%w of %s: %v", ErrDecrypt, key, err)
+	}
+	if len(sealed) < d.aead.NonceSize() {
+		return "", fmt.Errorf("%w of %s: too short", ErrDecrypt, key)
+	}
+	nonce, ciphertext := sealed[:d.aead.NonceSize()], sealed[d.aead.NonceSize():]
+	plain, err := d.aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return "", fmt.Errorf("%w of %s: %v", ErrDecrypt, key, err)
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,204 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"distore/api"
+	"distore/encryption"
+	"distore/storage"
+	"distore/testutils"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestServer serves the key, CAS and batch routes over base
+func newTestServer(t *testing.T, base storage.Storage) string {
+	t.Helper()
+	replicator := testutils.NewMockReplicator([]string{}, 0)
+	h := api.NewHandlers(storage.NewCASStorage(base), replicator, nil)
+	batch := api.NewHandlers(storage.NewBatchStorage(base), replicator, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/set", h.SetHandler).Methods("POST")
+	router.HandleFunc("/get/{key}", h.GetHandler).Methods("GET")
+	router.HandleFunc("/advanced/cas", h.CASHandler).Methods("POST")
+	router.HandleFunc("/advanced/batch", batch.BatchHandler).Methods("POST")
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func newTestEncryption(t *testing.T, deterministic ...string) (*FieldEncryption, *StaticKeys) {
+	t.Helper()
+	keys := &StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": []byte(strings.Repeat("a", 32))}}
+	e, err := NewFieldEncryption(keys, deterministic...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, keys
+}
+
+func TestFieldEncryption_Modes(t *testing.T) {
+	e, _ := newTestEncryption(t, "account:*")
+
+	r1, _ := e.Encrypt("note", "hello")
+	r2, _ := e.Encrypt("note", "hello")
+	if r1 == r2 {
+		t.Error("Expected values encrypted at random to differ")
+	}
+	d1, _ := e.Encrypt("account:1", "hello")
+	d2, _ := e.Encrypt("account:1", "hello")
+	other, _ := e.Encrypt("account:2", "hello")
+	if d1 != d2 || d1 == other {
+		t.Errorf("Expected deterministic values equal for the same key only, got %q %q %q", d1, d2, other)
+	}
+
+	for key, value := range map[string]string{"note": r1, "account:1": d1} {
+		if plain, err := e.Decrypt(key, value); err != nil || plain != "hello" {
+			t.Errorf("Expected hello for %s, got %q %v", key, plain, err)
+		}
+	}
+	if _, err := e.Decrypt("account:2", d1); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Expected ErrDecrypt for a value moved to another key, got %v", err)
+	}
+	// A server cannot answer with a plaintext of its choice, unless the key
+	// was allowed to hold one
+	if _, err := e.Decrypt("note", "plain"); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Expected ErrDecrypt for a value that is not encrypted, got %v", err)
+	}
+	if err := e.AllowPlaintext("legacy:*"); err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := e.Decrypt("legacy:1", "plain"); err != nil || plain != "plain" {
+		t.Errorf("Expected a plaintext value back, got %q %v", plain, err)
+	}
+	if _, err := e.Decrypt("note", "plain"); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Expected plaintext to stay refused for other keys, got %v", err)
+	}
+	if _, err := NewFieldEncryption(&StaticKeys{}, "["); err == nil {
+		t.Error("Expected an invalid pattern to be rejected")
+	}
+	if err := e.AllowPlaintext("["); err == nil {
+		t.Error("Expected an invalid plaintext pattern to be rejected")
+	}
+}
+
+func TestClient_EncryptsValues(t *testing.T) {
+	base := storage.NewMemoryStorage()
+	e, keys := newTestEncryption(t, "counter:*")
+	c := New(Config{Endpoints: []string{newTestServer(t, base)}, DisableDiscovery: true, Encryption: e})
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "note", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := base.Get("note"); strings.Contains(stored, "secret") {
+		t.Errorf("Expected the server to hold ciphertext, got %q", stored)
+	}
+	if value, err := c.Get(ctx, "note"); err != nil || value != "secret" {
+		t.Errorf("Expected secret, got %q %v", value, err)
+	}
+	if _, err := c.Get(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Compare-and-set on deterministic values, on random ones, and after
+	// the key rotated
+	if r, err := c.CompareAndSet(ctx, "counter:a", "", "1", 0); err != nil || !r.Success {
+		t.Fatalf("Expected the key to be created, got %+v %v", r, err)
+	}
+	if r, err := c.CompareAndSet(ctx, "counter:a", "1", "2", 0); err != nil || !r.Success {
+		t.Errorf("Expected a deterministic CAS to succeed, got %+v %v", r, err)
+	}
+	if r, err := c.CompareAndSet(ctx, "counter:a", "1", "3", 0); err != nil || r.Success || r.CurrentValue != "2" {
+		t.Errorf("Expected a CAS on a stale value to fail with the current value, got %+v %v", r, err)
+	}
+	if r, err := c.CompareAndSet(ctx, "note", "secret", "changed", 0); err != nil || !r.Success {
+		t.Errorf("Expected a CAS on a random value to succeed, got %+v %v", r, err)
+	}
+	keys.Keys["k2"], keys.Current = []byte(strings.Repeat("b", 32)), "k2"
+	if r, err := c.CompareAndSet(ctx, "counter:a", "2", "3", 0); err != nil || !r.Success {
+		t.Errorf("Expected a CAS across a key rotation to succeed, got %+v %v", r, err)
+	}
+
+	results, err := c.Batch(ctx, []BatchOp{
+		{Type: "set", Key: "b1", Value: "v1"},
+		{Type: "get", Key: "b1"},
+		{Type: "get", Key: "counter:a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[1].Value != "v1" || results[2].Value != "3" || results[1].Err != nil {
+		t.Errorf("Expected decrypted batch reads, got %+v", results)
+	}
+	if stored, _ := base.Get("b1"); stored == "v1" {
+		t.Error("Expected the batch write to be encrypted")
+	}
+}
+
+func TestClient_CASAfterKeyRotation(t *testing.T) {
+	base := storage.NewMemoryStorage()
+	url := newTestServer(t, base)
+	e, keys := newTestEncryption(t, "counter:*")
+	c := New(Config{Endpoints: []string{url}, DisableDiscovery: true, Encryption: e})
+	ctx := context.Background()
+
+	if r, err := c.CompareAndSet(ctx, "counter:a", "", "1", 0); err != nil || !r.Success {
+		t.Fatalf("Expected the key to be created, got %+v %v", r, err)
+	}
+	keys.Keys["k2"], keys.Current = []byte(strings.Repeat("b", 32)), "k2"
+
+	// A stale value under the old key fails with the current value
+	if r, err := c.CompareAndSet(ctx, "counter:a", "0", "2", 0); err != nil || r.Success || r.CurrentValue != "1" {
+		t.Errorf("Expected a stale CAS to fail with the current value, got %+v %v", r, err)
+	}
+	if r, err := c.CompareAndSet(ctx, "counter:a", "1", "2", 0); err != nil || !r.Success {
+		t.Fatalf("Expected a CAS on a value under the old key to succeed, got %+v %v", r, err)
+	}
+	if stored, _ := base.Get("counter:a"); !strings.Contains(stored, ":k2:") {
+		t.Errorf("Expected the value to be rewritten under the new key, got %q", stored)
+	}
+
+	// Without the old key, a value under it cannot be compared
+	if r, err := c.CompareAndSet(ctx, "counter:b", "", "1", 0); err != nil || !r.Success {
+		t.Fatalf("Expected the key to be created, got %+v %v", r, err)
+	}
+	rotated := &StaticKeys{Current: "k3", Keys: map[string][]byte{"k3": []byte(strings.Repeat("c", 32))}}
+	e3, _ := NewFieldEncryption(rotated, "counter:*")
+	c3 := New(Config{Endpoints: []string{url}, DisableDiscovery: true, Encryption: e3})
+	if _, err := c3.CompareAndSet(ctx, "counter:b", "1", "2", 0); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Expected ErrDecrypt without the key of the stored value, got %v", err)
+	}
+}
+
+func TestFileKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys := &encryption.MasterKeys{}
+	first, _ := keys.Add()
+	keys.Write(path)
+
+	provider, err := NewFileKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := NewFieldEncryption(provider)
+	old, _ := e.Encrypt("a", "v")
+
+	second, _ := keys.Add()
+	keys.Write(path)
+	if err := provider.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if provider.CurrentKeyID() != second || second == first {
+		t.Errorf("Expected %s to be current, got %s", second, provider.CurrentKeyID())
+	}
+	if plain, err := e.Decrypt("a", old); err != nil || plain != "v" {
+		t.Errorf("Expected values of the first key to decrypt, got %q %v", plain, err)
+	}
+}
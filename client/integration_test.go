@@ -0,0 +1,420 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"distore/api"
+	"distore/auth"
+	"distore/config"
+	"distore/storage"
+	"distore/testutils"
+
+	"github.com/gorilla/mux"
+)
+
+// testNode is an in-process node of a test cluster. The nodes share their
+// storage, as if replication was instant.
+type testNode struct {
+	addr   string
+	server *httptest.Server
+
+	mu   sync.Mutex
+	hits map[string]int // requests by route
+	hook func(w http.ResponseWriter, r *http.Request, next http.Handler)
+}
+
+func (n *testNode) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		n.mu.Lock()
+		n.hits[r.Method+" "+route]++
+		hook := n.hook
+		n.mu.Unlock()
+		if hook != nil {
+			hook(w, r, next)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (n *testNode) setHook(hook func(w http.ResponseWriter, r *http.Request, next http.Handler)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.hook = hook
+}
+
+func (n *testNode) hitsOf(route string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.hits[route]
+}
+
+type testCluster struct {
+	nodes []*testNode
+	base  storage.Storage
+}
+
+// owners ranks the nodes of the test cluster for a key
+func (tc *testCluster) owners(key string) []string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	first := int(h.Sum32() % uint32(len(tc.nodes)))
+	owners := make([]string, 0, len(tc.nodes))
+	for i := range tc.nodes {
+		owners = append(owners, tc.nodes[(first+i)%len(tc.nodes)].addr)
+	}
+	return owners
+}
+
+func (tc *testCluster) node(addr string) *testNode {
+	for _, n := range tc.nodes {
+		if n.addr == addr {
+			return n
+		}
+	}
+	return nil
+}
+
+func (tc *testCluster) url(i int) string {
+	return "http://" + tc.nodes[i].addr
+}
+
+// newTestCluster starts size nodes. With an issuer, the data routes
+// require its tokens.
+func newTestCluster(t *testing.T, size int, issuer *auth.Issuer) *testCluster {
+	t.Helper()
+	tc := &testCluster{base: storage.NewMemoryStorage()}
+	var listeners []net.Listener
+	var addrs []string
+	for i := 0; i < size; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	var authService auth.AuthServiceInterface
+	if issuer != nil {
+		authService = issuer
+	}
+	replicator := testutils.NewMockReplicator(addrs, 2)
+	ttl := storage.NewTTLStorage(tc.base, time.Minute)
+	atomic := storage.NewAtomicStorage(tc.base)
+	batch := storage.NewBatchStorage(tc.base)
+	cas := storage.NewCASStorage(tc.base)
+	handlers := func(store storage.Storage) *api.Handlers {
+		h := api.NewHandlers(store, replicator, authService)
+		h.Issuer = issuer
+		h.Placement = tc.owners
+		return h
+	}
+	h, hTTL, hAtomic, hBatch, hCAS := handlers(tc.base), handlers(ttl), handlers(atomic), handlers(batch), handlers(cas)
+
+	for i, l := range listeners {
+		n := &testNode{addr: addrs[i], hits: make(map[string]int)}
+		router := mux.NewRouter()
+		router.Use(n.middleware)
+		if issuer != nil {
+			router.HandleFunc("/auth/token", h.TokenHandler).Methods("POST")
+			router.Handle("/auth/logout", auth.AuthMiddleware(issuer)(http.HandlerFunc(h.LogoutHandler))).Methods("POST")
+		}
+		routes := router.PathPrefix("").Subrouter()
+		if issuer != nil {
+			routes.Use(auth.AuthMiddleware(issuer))
+		}
+		routes.Use(api.NewIdempotencyCache(time.Minute, 1000).Middleware)
+		routes.HandleFunc("/set", h.SetHandler).Methods("POST")
+		routes.HandleFunc("/get/{key}", h.GetHandler).Methods("GET")
+		routes.HandleFunc("/delete/{key}", h.DeleteHandler).Methods("DELETE")
+		routes.HandleFunc("/keys", h.GetAllHandler).Methods("GET")
+		routes.HandleFunc("/cluster/nodes", h.ClusterNodesHandler).Methods("GET")
+		routes.HandleFunc("/cluster/placement", h.PlacementHandler).Methods("GET")
+		routes.HandleFunc("/advanced/ttl", hTTL.TTLHandler).Methods("POST")
+		routes.HandleFunc("/advanced/increment", hAtomic.IncrementHandler).Methods("POST")
+		routes.HandleFunc("/advanced/batch", hBatch.BatchHandler).Methods("POST")
+		routes.HandleFunc("/advanced/cas", hCAS.CASHandler).Methods("POST")
+		routes.HandleFunc("/advanced/lock/{key}", hCAS.AcquireLockHandler).Methods("POST")
+		routes.HandleFunc("/advanced/lock/{key}", hCAS.ReleaseLockHandler).Methods("DELETE")
+		routes.HandleFunc("/admin/nodes", h.ListNodesHandler).Methods("GET")
+		routes.HandleFunc("/admin/nodes", h.AddNodeHandler).Methods("POST")
+		routes.HandleFunc("/admin/nodes/{node}", h.RemoveNodeHandler).Methods("DELETE")
+		routes.HandleFunc("/admin/config", h.GetConfigHandler).Methods("GET")
+		routes.HandleFunc("/admin/config", h.UpdateConfigHandler).Methods("PATCH")
+		routes.HandleFunc("/admin/backup", h.BackupHandler).Methods("POST")
+		routes.HandleFunc("/admin/restore", h.RestoreHandler).Methods("POST")
+
+		n.server = &httptest.Server{Listener: l, Config: &http.Server{Handler: router}}
+		n.server.Start()
+		t.Cleanup(n.server.Close)
+		tc.nodes = append(tc.nodes, n)
+	}
+	return tc
+}
+
+func testConfig(tc *testCluster) Config {
+	return Config{Endpoints: []string{tc.url(0)}, RetryBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+}
+
+func TestIntegration_DataOperations(t *testing.T) {
+	tc := newTestCluster(t, 3, nil)
+	c := New(testConfig(tc))
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "a"); err != nil || value != "1" {
+		t.Errorf("Expected 1, got %q %v", value, err)
+	}
+	if err := c.SetWithTTL(ctx, "t", "temp", time.Minute); err != nil {
+		t.Errorf("SetWithTTL failed: %v", err)
+	}
+	if value, err := c.Increment(ctx, "counter", 5); err != nil || value != 5 {
+		t.Errorf("Expected 5, got %d %v", value, err)
+	}
+	if r, err := c.CompareAndSet(ctx, "a", "1", "2", 0); err != nil || !r.Success {
+		t.Errorf("Expected the CAS to succeed, got %+v %v", r, err)
+	}
+	results, err := c.Batch(ctx, []BatchOp{{Type: "set", Key: "b", Value: "x"}, {Type: "get", Key: "a"}})
+	if err != nil || results[1].Value != "2" {
+		t.Errorf("Expected the batch to read 2, got %+v %v", results, err)
+	}
+	if ok, err := c.AcquireLock(ctx, "job", time.Minute); err != nil || !ok {
+		t.Errorf("Expected the lock, got %v %v", ok, err)
+	}
+	if ok, _ := c.AcquireLock(ctx, "job", time.Minute); ok {
+		t.Error("Expected a held lock to be refused")
+	}
+	if err := c.ReleaseLock(ctx, "job"); err != nil {
+		t.Errorf("ReleaseLock failed: %v", err)
+	}
+	if items, err := c.Keys(ctx); err != nil || len(items) < 4 {
+		t.Errorf("Expected the keys, got %+v %v", items, err)
+	}
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "a"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := c.Delete(ctx, "a"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing key, got %v", err)
+	}
+}
+
+func TestIntegration_DiscoveryAndFailover(t *testing.T) {
+	tc := newTestCluster(t, 3, nil)
+	c := New(testConfig(tc))
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	known := len(c.nodes)
+	c.mu.Unlock()
+	if known != 3 {
+		t.Fatalf("Expected the 3 nodes to be discovered from one seed, got %d", known)
+	}
+
+	// The seed goes away, the other nodes keep serving
+	tc.nodes[0].server.Close()
+	for i := 0; i < 5; i++ {
+		if value, err := c.Get(ctx, "a"); err != nil || value != "1" {
+			t.Fatalf("Expected reads to fail over, got %q %v", value, err)
+		}
+		if err := c.Set(ctx, "a", "1"); err != nil {
+			t.Fatalf("Expected writes to fail over, got %v", err)
+		}
+	}
+}
+
+func TestIntegration_KeyRouting(t *testing.T) {
+	tc := newTestCluster(t, 3, nil)
+	cfg := testConfig(tc)
+	cfg.KeyRouting = true
+	c := New(cfg)
+	ctx := context.Background()
+
+	keys := []string{"k1", "k2", "k3", "k4", "k5", "k6"}
+	for _, key := range keys {
+		if err := c.Set(ctx, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sets := make(map[string]int)
+	for _, key := range keys {
+		sets[tc.owners(key)[0]]++
+	}
+	for _, n := range tc.nodes {
+		if got := n.hitsOf("POST /set"); got != sets[n.addr] {
+			t.Errorf("Expected %s to get the %d writes it owns, got %d", n.addr, sets[n.addr], got)
+		}
+	}
+
+	// Owners are looked up once per key
+	c.Get(ctx, "k1")
+	lookups := 0
+	for _, n := range tc.nodes {
+		lookups += n.hitsOf("GET /cluster/placement")
+	}
+	if lookups != len(keys) {
+		t.Errorf("Expected %d placement lookups, got %d", len(keys), lookups)
+	}
+}
+
+func TestIntegration_RetriesWithIdempotencyKeys(t *testing.T) {
+	tc := newTestCluster(t, 1, nil)
+	cfg := testConfig(tc)
+	cfg.DisableDiscovery = true
+	c := New(cfg)
+	ctx := context.Background()
+	n := tc.nodes[0]
+
+	// The first increment is applied but its answer is lost
+	var once sync.Once
+	n.setHook(func(w http.ResponseWriter, r *http.Request, next http.Handler) {
+		lost := false
+		once.Do(func() { lost = true })
+		if !lost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(httptest.NewRecorder(), r)
+		panic(http.ErrAbortHandler)
+	})
+	if value, err := c.Increment(ctx, "counter", 1); err != nil || value != 1 {
+		t.Fatalf("Expected the retry to get the first answer back, got %d %v", value, err)
+	}
+	if stored, _ := tc.base.Get("counter"); stored != "1" || n.hitsOf("POST /advanced/increment") != 2 {
+		t.Errorf("Expected 2 attempts applied once, got %q after %d", stored, n.hitsOf("POST /advanced/increment"))
+	}
+
+	// Unavailable nodes are retried, up to MaxRetries
+	failures := 2
+	n.setHook(func(w http.ResponseWriter, r *http.Request, next http.Handler) {
+		if failures > 0 {
+			failures--
+			http.Error(w, "read-only", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	if _, err := c.Get(ctx, "counter"); err != nil {
+		t.Errorf("Expected the read to succeed on the third attempt, got %v", err)
+	}
+	failures = 10
+	var apiErr *Error
+	if _, err := c.Get(ctx, "counter"); !errors.As(err, &apiErr) || apiErr.Status != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 after the retries, got %v", err)
+	}
+	n.setHook(nil)
+
+	// Client errors are not retried
+	before := n.hitsOf("POST /advanced/increment")
+	if _, err := c.Increment(ctx, "a-string", 1); err == nil {
+		c.Set(ctx, "a-string", "x")
+	}
+	c.Set(ctx, "word", "x")
+	if _, err := c.Increment(ctx, "word", 1); err == nil {
+		t.Error("Expected incrementing a word to fail")
+	}
+	if got := n.hitsOf("POST /advanced/increment") - before; got != 2 {
+		t.Errorf("Expected no retry of a failed increment, got %d attempts", got)
+	}
+}
+
+func TestIntegration_Tokens(t *testing.T) {
+	identities := auth.NewIdentities()
+	if _, err := identities.Bootstrap(config.AuthBootstrapConfig{Password: "bootstrap-password"}); err != nil {
+		t.Fatal(err)
+	}
+	// Tokens expire at once, so every request refreshes its token
+	issuer := auth.NewIssuer(auth.NewSimpleAuthService(1), identities, time.Hour)
+	tc := newTestCluster(t, 2, issuer)
+	ctx := context.Background()
+
+	if err := New(testConfig(tc)).Set(ctx, "a", "1"); err == nil {
+		t.Fatal("Expected a request without a token to be refused")
+	}
+
+	cfg := testConfig(tc)
+	cfg.Credentials = &Credentials{UserID: "admin", Password: "bootstrap-password"}
+	c := New(cfg)
+	pair, err := c.Login(ctx)
+	if err != nil || pair.RefreshToken == "" {
+		t.Fatalf("Expected a token pair, got %+v %v", pair, err)
+	}
+	if err := c.Set(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "a"); err != nil || value != "1" {
+		t.Errorf("Expected 1, got %q %v", value, err)
+	}
+
+	// A refresh token kept from a login is enough. Refresh tokens rotate,
+	// so it comes from a login of its own.
+	kept, err := New(cfg).Login(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Credentials = &Credentials{RefreshToken: kept.RefreshToken}
+	if value, err := New(cfg).Get(ctx, "a"); err != nil || value != "1" {
+		t.Errorf("Expected a refresh token to log in, got %q %v", value, err)
+	}
+
+	if err := c.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Credentials = &Credentials{UserID: "admin", Password: "wrong"}
+	var authErr *authError
+	if _, err := New(cfg).Get(ctx, "a"); !errors.As(err, &authErr) {
+		t.Errorf("Expected a login error for wrong credentials, got %v", err)
+	}
+}
+
+func TestIntegration_Admin(t *testing.T) {
+	tc := newTestCluster(t, 2, nil)
+	c := New(testConfig(tc))
+	ctx := context.Background()
+
+	nodes, err := c.AddNode(ctx, "node3:8080")
+	if err != nil || len(nodes) != 3 {
+		t.Fatalf("Expected 3 nodes, got %v %v", nodes, err)
+	}
+	if nodes, err := c.RemoveNode(ctx, "node3:8080"); err != nil || len(nodes) != 2 {
+		t.Errorf("Expected 2 nodes, got %v %v", nodes, err)
+	}
+	if nodes, err := c.Nodes(ctx); err != nil || len(nodes) != 2 {
+		t.Errorf("Expected 2 nodes, got %v %v", nodes, err)
+	}
+	replicas := 1
+	if status, err := c.UpdateConfig(ctx, nil, &replicas); err != nil || status["replica_count"] != float64(1) {
+		t.Errorf("Expected a replica count of 1, got %v %v", status, err)
+	}
+
+	c.Set(ctx, "a", "1")
+	items, err := c.BackupItems(ctx)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("Expected 1 item, got %+v %v", items, err)
+	}
+	c.Delete(ctx, "a")
+	if count, err := c.RestoreItems(ctx, items); err != nil || count != 1 {
+		t.Errorf("Expected 1 item restored, got %d %v", count, err)
+	}
+	if value, _ := c.Node(tc.nodes[1].addr).Get(ctx, "a"); value != "1" {
+		t.Errorf("Expected the restored value on node 2, got %q", value)
+	}
+}
@@ -1,7 +1,9 @@
 package cluster
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
@@ -9,6 +11,7 @@ import (
 	"time"
 
 	"distore/config"
+	"distore/internode"
 )
 
 type CrossDCReplicator struct {
@@ -18,6 +21,14 @@ type CrossDCReplicator struct {
 	latencyConfig config.LatencyConfig
 	httpClient    *http.Client
 	nodeLatencies map[string]time.Duration
+	flaggedNodes  map[string]bool // beyond their latency threshold or unreachable
+
+	// Asynchronous pipeline, set up by Start
+	opts    CrossDCOptions
+	localDC string
+	queues  map[string]*dcQueue // remote data center id -> outbound queue
+	stop    chan struct{}
+	wg      sync.WaitGroup
 }
 
 type ReplicationTarget struct {
@@ -26,6 +37,7 @@ type ReplicationTarget struct {
 	Priority int
 	Latency  time.Duration
 	IsEdge   bool
+	Flagged  bool
 }
 
 func NewCrossDCReplicator(multiCloudConfig config.MultiCloudConfig) *CrossDCReplicator {
@@ -35,9 +47,10 @@ func NewCrossDCReplicator(multiCloudConfig config.MultiCloudConfig) *CrossDCRepl
 		latencyConfig: multiCloudConfig.LatencyThresholds,
 		httpClient: &http.Client{
 			Timeout:   5 * time.Second,
-			Transport: &http.Transport{MaxIdleConnsPerHost: 10},
+			Transport: internode.Wrap(&http.Transport{MaxIdleConnsPerHost: 10}),
 		},
 		nodeLatencies: make(map[string]time.Duration),
+		flaggedNodes:  make(map[string]bool),
 	}
 }
 
@@ -62,6 +75,7 @@ func (cdc *CrossDCReplicator) SelectOptimalTargets(key string, replicaCount int)
 				Priority: dc.Priority,
 				Latency:  latency,
 				IsEdge:   false,
+				Flagged:  cdc.flaggedNodes[node],
 			})
 		}
 	}
@@ -79,14 +93,18 @@ func (cdc *CrossDCReplicator) SelectOptimalTargets(key string, replicaCount int)
 			Priority: 1, // Edge nodes have highest priority
 			Latency:  latency,
 			IsEdge:   true,
+			Flagged:  cdc.flaggedNodes[edge.Node],
 		})
 	}
 
-	// Sort by priority (ascending) and then by latency (ascending)
+	// Sort by priority (ascending), flagged nodes last, then by latency (ascending)
 	sort.Slice(targets, func(i, j int) bool {
 		if targets[i].Priority != targets[j].Priority {
 			return targets[i].Priority < targets[j].Priority
 		}
+		if targets[i].Flagged != targets[j].Flagged {
+			return !targets[i].Flagged
+		}
 		return targets[i].Latency < targets[j].Latency
 	})
 
@@ -147,23 +165,23 @@ func (cdc *CrossDCReplicator) calculateTimeout(latency time.Duration) time.Durat
 }
 
 func (cdc *CrossDCReplicator) replicateToNode(key, value, nodeURL string, timeout time.Duration) error {
-	_ = key   // TODO: implement request body with key/value
-	_ = value // TODO: implement request body with key/value
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	url := fmt.Sprintf("http://%s/internal/set", nodeURL)
-	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	body, err := json.Marshal(map[string]string{"key": key, "value": value})
 	if err != nil {
 		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	url := internode.URL(nodeURL, "/internal/set")
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
 
-	// TODO: add request body with key/value
+	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: timeout}
-	resp, err := client.Do(req)
+	resp, err := cdc.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -183,6 +201,24 @@ func (cdc *CrossDCReplicator) UpdateLatencyMetrics(node string, latency time.Dur
 	cdc.nodeLatencies[node] = latency
 }
 
+// SetNodeFlagged marks a node as too slow or unreachable, so it is selected last
+func (cdc *CrossDCReplicator) SetNodeFlagged(node string, flagged bool) {
+	cdc.mu.Lock()
+	defer cdc.mu.Unlock()
+	if flagged {
+		cdc.flaggedNodes[node] = true
+	} else {
+		delete(cdc.flaggedNodes, node)
+	}
+}
+
+// IsNodeFlagged reports whether a node is beyond its latency threshold
+func (cdc *CrossDCReplicator) IsNodeFlagged(node string) bool {
+	cdc.mu.RLock()
+	defer cdc.mu.RUnlock()
+	return cdc.flaggedNodes[node]
+}
+
 // GetLatencyMetrics returns current latency measurements
 func (cdc *CrossDCReplicator) GetLatencyMetrics() map[string]time.Duration {
 	cdc.mu.RLock()
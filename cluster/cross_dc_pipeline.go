@@ -0,0 +1,456 @@
+package cluster
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"distore/internode"
+	"distore/storage"
+)
+
+// CrossDCOptions configure the cross-DC replication pipeline
+type CrossDCOptions struct {
+	Self          string        // address of this node
+	LocalDC       string        // data center of this node, derived from Self when empty
+	QueueDir      string        // directory of the durable queues, empty keeps them in memory
+	Async         bool          // acknowledge writes after the local quorum only
+	BatchSize     int           // entries per shipped batch
+	FlushInterval time.Duration // how often queues are drained without new writes
+	AckTimeout    time.Duration // how long a synchronous write waits for remote DCs
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+}
+
+// DefaultCrossDCOptions returns the default pipeline settings
+func DefaultCrossDCOptions() CrossDCOptions {
+	return CrossDCOptions{
+		Async:         true,
+		BatchSize:     100,
+		FlushInterval: time.Second,
+		AckTimeout:    5 * time.Second,
+		MinBackoff:    100 * time.Millisecond,
+		MaxBackoff:    30 * time.Second,
+	}
+}
+
+// CrossDCBatch is the payload shipped to a remote data center
+type CrossDCBatch struct {
+	SourceDC string         `json:"source_dc"`
+	Entries  []CrossDCEntry `json:"entries"`
+}
+
+// DCReplicationStatus is the outbound replication state of one remote data center
+type DCReplicationStatus struct {
+	DataCenter string    `json:"data_center"`
+	Pending    int       `json:"pending"`
+	LagSeconds float64   `json:"lag_seconds"`
+	AckedSeq   uint64    `json:"acked_seq"`
+	Sent       uint64    `json:"sent"`
+	Failures   uint64    `json:"failures"`
+	LastAck    time.Time `json:"last_ack,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+var ErrLocalQuorum = errors.New("local data center quorum not reached")
+
+// Start sets up one durable outbound queue per remote data center and starts
+// shipping them in the background
+func (cdc *CrossDCReplicator) Start(opts CrossDCOptions) error {
+	defaults := DefaultCrossDCOptions()
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaults.BatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaults.FlushInterval
+	}
+	if opts.AckTimeout <= 0 {
+		opts.AckTimeout = defaults.AckTimeout
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaults.MinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = defaults.MaxBackoff
+	}
+
+	localDC := opts.LocalDC
+	if localDC == "" {
+		if dc := cdc.GetDataCenterForNode(opts.Self); dc != nil {
+			localDC = dc.ID
+		}
+	}
+	if localDC == "" {
+		return fmt.Errorf("cannot determine the data center of %s", opts.Self)
+	}
+
+	cdc.mu.Lock()
+	defer cdc.mu.Unlock()
+
+	if cdc.queues != nil {
+		return errors.New("cross-DC pipeline already started")
+	}
+
+	queues := make(map[string]*dcQueue)
+	found := false
+	for _, dc := range cdc.dataCenters {
+		if dc.ID == localDC {
+			found = true
+			continue
+		}
+		q, err := openDCQueue(opts.QueueDir, dc.ID)
+		if err != nil {
+			for _, opened := range queues {
+				opened.close()
+			}
+			return fmt.Errorf("opening queue for %s: %w", dc.ID, err)
+		}
+		queues[dc.ID] = q
+	}
+	if !found {
+		return fmt.Errorf("unknown local data center %s", localDC)
+	}
+
+	cdc.opts = opts
+	cdc.localDC = localDC
+	cdc.queues = queues
+	cdc.stop = make(chan struct{})
+	for _, q := range queues {
+		cdc.wg.Add(1)
+		go cdc.runSender(q, opts, cdc.stop)
+	}
+
+	log.Printf("Cross-DC replication started in %s (%d remote data centers, async=%v)", localDC, len(queues), opts.Async)
+	return nil
+}
+
+// Stop halts the senders. Pending entries stay in the durable queues.
+func (cdc *CrossDCReplicator) Stop() {
+	cdc.mu.Lock()
+	if cdc.stop == nil {
+		cdc.mu.Unlock()
+		return
+	}
+	close(cdc.stop)
+	cdc.stop = nil
+	queues := cdc.queues
+	cdc.queues = nil
+	cdc.mu.Unlock()
+
+	cdc.wg.Wait()
+	for _, q := range queues {
+		q.close()
+	}
+}
+
+// LocalDataCenter returns the data center of this node once started
+func (cdc *CrossDCReplicator) LocalDataCenter() string {
+	cdc.mu.RLock()
+	defer cdc.mu.RUnlock()
+	return cdc.localDC
+}
+
+// Replicate writes to a quorum of the local data center and queues the write
+// for every remote data center. In synchronous mode it also waits until each
+// remote data center acknowledged the write.
+func (cdc *CrossDCReplicator) Replicate(key, value string) error {
+	return cdc.replicate("set", key, value)
+}
+
+// ReplicateDelete is Replicate for deletes
+func (cdc *CrossDCReplicator) ReplicateDelete(key string) error {
+	return cdc.replicate("delete", key, "")
+}
+
+func (cdc *CrossDCReplicator) replicate(op, key, value string) error {
+	cdc.mu.RLock()
+	queues := cdc.queues
+	opts := cdc.opts
+	cdc.mu.RUnlock()
+	if queues == nil {
+		return errors.New("cross-DC pipeline not started")
+	}
+
+	localErr := cdc.replicateLocal(op, key, value)
+
+	// Remote data centers are queued even if the local quorum failed: the
+	// write is already applied on this node and must not diverge across DCs
+	seqs := make(map[string]uint64, len(queues))
+	for dc, q := range queues {
+		seq, err := q.push(op, key, value)
+		if err != nil {
+			return fmt.Errorf("queueing for %s: %w", dc, err)
+		}
+		seqs[dc] = seq
+	}
+	if localErr != nil {
+		return localErr
+	}
+
+	if opts.Async {
+		return nil
+	}
+	for dc, seq := range seqs {
+		if !queues[dc].waitAck(seq, opts.AckTimeout) {
+			return fmt.Errorf("data center %s did not acknowledge within %v", dc, opts.AckTimeout)
+		}
+	}
+	return nil
+}
+
+// replicateLocal sends a mutation to the other nodes of the local data center
+// and waits for a quorum, counting this node's own write
+func (cdc *CrossDCReplicator) replicateLocal(op, key, value string) error {
+	peers := cdc.localPeers()
+	// quorum of the DC is (n/2)+1 with n = peers+1; this node's write counts as one
+	required := (len(peers) + 1) / 2
+	if required == 0 {
+		return nil
+	}
+
+	results := make(chan error, len(peers))
+	for _, node := range peers {
+		go func(nodeURL string) {
+			if op == "delete" {
+				results <- cdc.deleteOnNode(key, nodeURL, cdc.calculateTimeout(cdc.latencyOf(nodeURL)))
+			} else {
+				results <- cdc.replicateToNode(key, value, nodeURL, cdc.calculateTimeout(cdc.latencyOf(nodeURL)))
+			}
+		}(node)
+	}
+
+	successful := 0
+	for i := 0; i < len(peers); i++ {
+		if err := <-results; err == nil {
+			successful++
+			if successful >= required {
+				return nil
+			}
+		} else {
+			log.Printf("Cross-DC: local replication of %s failed: %v", key, err)
+		}
+	}
+	return fmt.Errorf("%w: %d/%d", ErrLocalQuorum, successful, required)
+}
+
+func (cdc *CrossDCReplicator) localPeers() []string {
+	cdc.mu.RLock()
+	defer cdc.mu.RUnlock()
+
+	var peers []string
+	for _, dc := range cdc.dataCenters {
+		if dc.ID != cdc.localDC {
+			continue
+		}
+		for _, node := range dc.Nodes {
+			if node != cdc.opts.Self {
+				peers = append(peers, node)
+			}
+		}
+	}
+	return peers
+}
+
+func (cdc *CrossDCReplicator) latencyOf(node string) time.Duration {
+	cdc.mu.RLock()
+	defer cdc.mu.RUnlock()
+	return cdc.nodeLatencies[node]
+}
+
+func (cdc *CrossDCReplicator) deleteOnNode(key, nodeURL string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	url := internode.URL(nodeURL, "/internal/delete/"+key)
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cdc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("delete on %s failed: %s", nodeURL, resp.Status)
+	}
+	return nil
+}
+
+// ApplyBatch applies a batch received from another data center in order and
+// forwards it to the rest of the local data center. It does not queue the
+// entries again, so batches never bounce between data centers.
+func (cdc *CrossDCReplicator) ApplyBatch(store storage.Storage, batch CrossDCBatch) error {
+	for _, entry := range batch.Entries {
+		var err error
+		switch entry.Op {
+		case "set":
+			err = store.Set(entry.Key, entry.Value)
+		case "delete":
+			err = store.Delete(entry.Key)
+			if err == storage.ErrKeyNotFound {
+				err = nil
+			}
+		default:
+			err = fmt.Errorf("unknown operation %q", entry.Op)
+		}
+		if err != nil {
+			return fmt.Errorf("applying seq %d from %s: %w", entry.Seq, batch.SourceDC, err)
+		}
+
+		if err := cdc.replicateLocal(entry.Op, entry.Key, entry.Value); err != nil {
+			log.Printf("Cross-DC: forwarding %s from %s in local DC: %v", entry.Key, batch.SourceDC, err)
+		}
+	}
+	return nil
+}
+
+// Status returns the outbound replication state per remote data center
+func (cdc *CrossDCReplicator) Status() []DCReplicationStatus {
+	cdc.mu.RLock()
+	queues := cdc.queues
+	cdc.mu.RUnlock()
+
+	statuses := make([]DCReplicationStatus, 0, len(queues))
+	for _, q := range queues {
+		statuses = append(statuses, q.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].DataCenter < statuses[j].DataCenter })
+	return statuses
+}
+
+// runSender ships the queue of one data center batch by batch. A batch is
+// only removed after the remote side applied it, and the next batch is sent
+// only then, so writes to a key arrive in order.
+func (cdc *CrossDCReplicator) runSender(q *dcQueue, opts CrossDCOptions, stop <-chan struct{}) {
+	defer cdc.wg.Done()
+
+	ticker := time.NewTicker(opts.FlushInterval)
+	defer ticker.Stop()
+
+	backoff := opts.MinBackoff
+	for {
+		select {
+		case <-stop:
+			return
+		case <-q.notify:
+		case <-ticker.C:
+		}
+
+		for {
+			batch := q.peek(opts.BatchSize)
+			if len(batch) == 0 {
+				break
+			}
+
+			if err := cdc.sendBatch(q.dc, batch); err != nil {
+				q.recordFailure(err)
+				log.Printf("Cross-DC: shipping %d entries to %s failed, retrying in %v: %v", len(batch), q.dc, backoff, err)
+
+				// full jitter keeps senders of several nodes from retrying in lockstep
+				wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+				select {
+				case <-stop:
+					return
+				case <-time.After(wait):
+				}
+				backoff *= 2
+				if backoff > opts.MaxBackoff {
+					backoff = opts.MaxBackoff
+				}
+				continue
+			}
+
+			backoff = opts.MinBackoff
+			if err := q.ack(batch[len(batch)-1].Seq, len(batch)); err != nil {
+				log.Printf("Cross-DC: persisting acknowledgement for %s: %v", q.dc, err)
+			}
+		}
+	}
+}
+
+// sendBatch ships a gzip-compressed batch to the first reachable node of the
+// data center, trying nodes in order of measured latency
+func (cdc *CrossDCReplicator) sendBatch(dcID string, entries []CrossDCEntry) error {
+	payload, err := json.Marshal(CrossDCBatch{SourceDC: cdc.LocalDataCenter(), Entries: entries})
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(payload); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	nodes := cdc.dataCenterNodes(dcID)
+	if len(nodes) == 0 {
+		return fmt.Errorf("data center %s has no nodes", dcID)
+	}
+
+	var lastErr error
+	for _, node := range nodes {
+		timeout := cdc.calculateTimeout(cdc.latencyOf(node))
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		url := internode.URL(node, "/internal/dc_batch")
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			cancel()
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+
+		resp, err := cdc.httpClient.Do(req)
+		if err != nil {
+			cancel()
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		cancel()
+		if resp.StatusCode >= 300 {
+			lastErr = fmt.Errorf("%s rejected batch: %s", node, resp.Status)
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// dataCenterNodes returns the nodes of a data center, fastest first and
+// flagged nodes last
+func (cdc *CrossDCReplicator) dataCenterNodes(dcID string) []string {
+	cdc.mu.RLock()
+	defer cdc.mu.RUnlock()
+
+	var nodes []string
+	for _, dc := range cdc.dataCenters {
+		if dc.ID == dcID {
+			nodes = append(nodes, dc.Nodes...)
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if fi, fj := cdc.flaggedNodes[nodes[i]], cdc.flaggedNodes[nodes[j]]; fi != fj {
+			return !fi
+		}
+		li, lj := cdc.nodeLatencies[nodes[i]], cdc.nodeLatencies[nodes[j]]
+		// unmeasured nodes keep their configured order after measured ones
+		if li == 0 || lj == 0 {
+			return li != 0 && lj == 0
+		}
+		return li < lj
+	})
+	return nodes
+}
@@ -0,0 +1,259 @@
+package cluster
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"distore/config"
+	"distore/storage"
+)
+
+// remoteDC records the batches shipped to it
+type remoteDC struct {
+	mu      sync.Mutex
+	entries []CrossDCEntry
+	failN   int32 // number of requests to reject before accepting
+	server  *httptest.Server
+}
+
+func newRemoteDC(t *testing.T, failN int32) *remoteDC {
+	rdc := &remoteDC{failN: failN}
+	rdc.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/internal/dc_batch" || r.Header.Get("Content-Encoding") != "gzip" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if atomic.AddInt32(&rdc.failN, -1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var batch CrossDCBatch
+		if err := json.NewDecoder(zr).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rdc.mu.Lock()
+		rdc.entries = append(rdc.entries, batch.Entries...)
+		rdc.mu.Unlock()
+	}))
+	t.Cleanup(rdc.server.Close)
+	return rdc
+}
+
+func (rdc *remoteDC) received() []CrossDCEntry {
+	rdc.mu.Lock()
+	defer rdc.mu.Unlock()
+	return append([]CrossDCEntry(nil), rdc.entries...)
+}
+
+func (rdc *remoteDC) addr() string {
+	return rdc.server.URL[7:]
+}
+
+func crossDCTestConfig(localPeer, remote string) config.MultiCloudConfig {
+	return config.MultiCloudConfig{
+		Enabled: true,
+		DataCenters: []config.DataCenterConfig{
+			{ID: "eu", Nodes: []string{"self:8080", localPeer}},
+			{ID: "us", Nodes: []string{remote}},
+		},
+	}
+}
+
+func fastCrossDCOptions() CrossDCOptions {
+	opts := DefaultCrossDCOptions()
+	opts.Self = "self:8080"
+	opts.BatchSize = 4
+	opts.FlushInterval = 10 * time.Millisecond
+	opts.MinBackoff = 5 * time.Millisecond
+	opts.MaxBackoff = 20 * time.Millisecond
+	return opts
+}
+
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
+
+func TestCrossDCReplicator_ReplicateToNodeSendsBody(t *testing.T) {
+	var got map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cdc := NewCrossDCReplicator(config.MultiCloudConfig{})
+	if err := cdc.replicateToNode("k", "v", server.URL[7:], time.Second); err != nil {
+		t.Fatalf("replicate error: %v", err)
+	}
+	if got["key"] != "k" || got["value"] != "v" {
+		t.Fatalf("expected key and value in body, got %v", got)
+	}
+}
+
+func TestCrossDCPipeline_AsyncOrderedWithRetry(t *testing.T) {
+	var localWrites int32
+	localPeer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&localWrites, 1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer localPeer.Close()
+	remote := newRemoteDC(t, 3)
+
+	cdc := NewCrossDCReplicator(crossDCTestConfig(localPeer.URL[7:], remote.addr()))
+	if err := cdc.Start(fastCrossDCOptions()); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	defer cdc.Stop()
+
+	if cdc.LocalDataCenter() != "eu" {
+		t.Fatalf("expected local DC eu, got %s", cdc.LocalDataCenter())
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := cdc.Replicate("counter", fmt.Sprintf("%d", i)); err != nil {
+			t.Fatalf("replicate error: %v", err)
+		}
+	}
+	if err := cdc.ReplicateDelete("counter"); err != nil {
+		t.Fatalf("delete error: %v", err)
+	}
+	if atomic.LoadInt32(&localWrites) != 11 {
+		t.Errorf("expected local DC quorum writes, got %d", localWrites)
+	}
+
+	waitFor(t, 5*time.Second, func() bool { return len(remote.received()) == 11 })
+
+	entries := remote.received()
+	for i := 0; i < 10; i++ {
+		if entries[i].Op != "set" || entries[i].Value != fmt.Sprintf("%d", i) {
+			t.Fatalf("entry %d out of order: %+v", i, entries[i])
+		}
+	}
+	if entries[10].Op != "delete" {
+		t.Fatalf("expected trailing delete, got %+v", entries[10])
+	}
+
+	// The ack of the last batch is recorded after the remote has stored it
+	waitFor(t, 5*time.Second, func() bool {
+		status := cdc.Status()
+		return len(status) == 1 && status[0].Pending == 0
+	})
+	status := cdc.Status()
+	if len(status) != 1 || status[0].DataCenter != "us" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if status[0].Pending != 0 || status[0].LagSeconds != 0 || status[0].Failures == 0 {
+		t.Errorf("expected drained queue with recorded failures, got %+v", status[0])
+	}
+}
+
+func TestCrossDCPipeline_SyncWaitsForRemoteAck(t *testing.T) {
+	remote := newRemoteDC(t, 1<<30) // never accepts
+	cfg := config.MultiCloudConfig{
+		DataCenters: []config.DataCenterConfig{
+			{ID: "eu", Nodes: []string{"self:8080"}},
+			{ID: "us", Nodes: []string{remote.addr()}},
+		},
+	}
+
+	cdc := NewCrossDCReplicator(cfg)
+	opts := fastCrossDCOptions()
+	opts.Async = false
+	opts.AckTimeout = 100 * time.Millisecond
+	if err := cdc.Start(opts); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	defer cdc.Stop()
+
+	if err := cdc.Replicate("k", "v"); err == nil {
+		t.Fatal("synchronous write should fail while the remote DC is down")
+	}
+	if status := cdc.Status(); status[0].Pending != 1 || status[0].LagSeconds <= 0 {
+		t.Errorf("expected queued entry with lag, got %+v", status[0])
+	}
+}
+
+func TestCrossDCPipeline_DurableQueue(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.MultiCloudConfig{
+		DataCenters: []config.DataCenterConfig{
+			{ID: "eu", Nodes: []string{"self:8080"}},
+			{ID: "us", Nodes: []string{"127.0.0.1:1"}},
+		},
+	}
+
+	cdc := NewCrossDCReplicator(cfg)
+	opts := fastCrossDCOptions()
+	opts.QueueDir = dir
+	if err := cdc.Start(opts); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		cdc.Replicate(fmt.Sprintf("k%d", i), "v")
+	}
+	cdc.Stop()
+
+	// The restarted node ships what was queued before
+	remote := newRemoteDC(t, 0)
+	cfg.DataCenters[1].Nodes = []string{remote.addr()}
+	restarted := NewCrossDCReplicator(cfg)
+	if err := restarted.Start(opts); err != nil {
+		t.Fatalf("restart error: %v", err)
+	}
+	defer restarted.Stop()
+
+	waitFor(t, 5*time.Second, func() bool { return len(remote.received()) == 3 })
+
+	// Acknowledged entries are not shipped again after another restart
+	restarted.Stop()
+	q, err := openDCQueue(dir, "us")
+	if err != nil {
+		t.Fatalf("reopen error: %v", err)
+	}
+	defer q.close()
+	if len(q.entries) != 0 || q.nextSeq != 4 {
+		t.Fatalf("expected empty queue continuing at seq 4, got %d entries, next %d", len(q.entries), q.nextSeq)
+	}
+}
+
+func TestCrossDCPipeline_ApplyBatch(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Set("gone", "x")
+
+	cdc := NewCrossDCReplicator(config.MultiCloudConfig{})
+	err := cdc.ApplyBatch(store, CrossDCBatch{SourceDC: "us", Entries: []CrossDCEntry{
+		{Seq: 1, Op: "set", Key: "a", Value: "1"},
+		{Seq: 2, Op: "set", Key: "a", Value: "2"},
+		{Seq: 3, Op: "delete", Key: "gone"},
+		{Seq: 4, Op: "delete", Key: "missing"},
+	}})
+	if err != nil {
+		t.Fatalf("apply error: %v", err)
+	}
+	if v, _ := store.Get("a"); v != "2" {
+		t.Errorf("expected last write to win in order, got %s", v)
+	}
+	if _, err := store.Get("gone"); err != storage.ErrKeyNotFound {
+		t.Error("expected deleted key")
+	}
+}
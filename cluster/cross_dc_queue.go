@@ -0,0 +1,275 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// compactAfter is the number of acknowledged entries after which the queue
+// file is rewritten with the pending entries only
+const compactAfter = 10000
+
+// CrossDCEntry is a mutation queued for a remote data center
+type CrossDCEntry struct {
+	Seq       uint64    `json:"seq"`
+	Op        string    `json:"op"` // "set" or "delete"
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	Timestamp time.Time `json:"ts"`
+}
+
+// dcQueue is the outbound queue of one remote data center. Entries are
+// appended to a log file and the acknowledged sequence number is kept next to
+// it, so pending entries survive a restart. Without a directory the queue is
+// kept in memory only.
+type dcQueue struct {
+	mu       sync.Mutex
+	dc       string
+	logPath  string
+	ackPath  string
+	file     *os.File
+	entries  []CrossDCEntry // pending, in sequence order
+	nextSeq  uint64
+	ackedSeq uint64
+	dead     int           // acknowledged entries still in the log file
+	notify   chan struct{} // signals the sender that entries were added
+	acked    chan struct{} // closed and replaced on every acknowledgement
+
+	// statistics
+	sent      uint64
+	failures  uint64
+	lastAck   time.Time
+	lastError string
+}
+
+func openDCQueue(dir, dc string) (*dcQueue, error) {
+	q := &dcQueue{
+		dc:      dc,
+		nextSeq: 1,
+		notify:  make(chan struct{}, 1),
+		acked:   make(chan struct{}),
+	}
+	if dir == "" {
+		return q, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q.logPath = filepath.Join(dir, dc+".queue")
+	q.ackPath = filepath.Join(dir, dc+".ack")
+
+	if data, err := os.ReadFile(q.ackPath); err == nil {
+		q.ackedSeq, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+	q.nextSeq = q.ackedSeq + 1
+
+	if f, err := os.Open(q.logPath); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			var entry CrossDCEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue // torn write at the end of the log
+			}
+			if entry.Seq > q.ackedSeq {
+				q.entries = append(q.entries, entry)
+			}
+			if entry.Seq >= q.nextSeq {
+				q.nextSeq = entry.Seq + 1
+			}
+		}
+		f.Close()
+	}
+
+	// start from a compacted log
+	if err := q.rewriteLocked(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// push appends a mutation and returns its sequence number
+func (q *dcQueue) push(op, key, value string) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry := CrossDCEntry{
+		Seq:       q.nextSeq,
+		Op:        op,
+		Key:       key,
+		Value:     value,
+		Timestamp: time.Now(),
+	}
+
+	if q.file != nil {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := q.file.Write(append(line, '\n')); err != nil {
+			return 0, err
+		}
+		if err := q.file.Sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	q.nextSeq++
+	q.entries = append(q.entries, entry)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return entry.Seq, nil
+}
+
+// peek returns up to n pending entries without removing them
+func (q *dcQueue) peek(n int) []CrossDCEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if n > len(q.entries) {
+		n = len(q.entries)
+	}
+	return append([]CrossDCEntry(nil), q.entries[:n]...)
+}
+
+// ack removes all entries up to seq once the remote data center applied them
+func (q *dcQueue) ack(seq uint64, sent int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed := 0
+	for removed < len(q.entries) && q.entries[removed].Seq <= seq {
+		removed++
+	}
+	q.entries = q.entries[removed:]
+	q.dead += removed
+	if seq > q.ackedSeq {
+		q.ackedSeq = seq
+	}
+	q.sent += uint64(sent)
+	q.lastAck = time.Now()
+	q.lastError = ""
+
+	close(q.acked)
+	q.acked = make(chan struct{})
+
+	if q.file == nil {
+		return nil
+	}
+	if err := os.WriteFile(q.ackPath, []byte(strconv.FormatUint(q.ackedSeq, 10)), 0644); err != nil {
+		return err
+	}
+	if len(q.entries) == 0 || q.dead >= compactAfter {
+		return q.rewriteLocked()
+	}
+	return nil
+}
+
+// rewriteLocked replaces the log file with the pending entries
+func (q *dcQueue) rewriteLocked() error {
+	if q.logPath == "" {
+		return nil
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+
+	tmp := q.logPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, entry := range q.entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, q.logPath); err != nil {
+		return err
+	}
+
+	q.file, err = os.OpenFile(q.logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	q.dead = 0
+	return err
+}
+
+// waitAck blocks until seq is acknowledged or the timeout expires
+func (q *dcQueue) waitAck(seq uint64, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		q.mu.Lock()
+		if q.ackedSeq >= seq {
+			q.mu.Unlock()
+			return true
+		}
+		acked := q.acked
+		q.mu.Unlock()
+
+		select {
+		case <-acked:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+func (q *dcQueue) recordFailure(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.failures++
+	q.lastError = err.Error()
+}
+
+// status returns the queue depth and replication lag of the data center
+func (q *dcQueue) status() DCReplicationStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status := DCReplicationStatus{
+		DataCenter: q.dc,
+		Pending:    len(q.entries),
+		AckedSeq:   q.ackedSeq,
+		Sent:       q.sent,
+		Failures:   q.failures,
+		LastAck:    q.lastAck,
+		LastError:  q.lastError,
+	}
+	if len(q.entries) > 0 {
+		status.LagSeconds = time.Since(q.entries[0].Timestamp).Seconds()
+	}
+	return status
+}
+
+func (q *dcQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file != nil {
+		q.file.Close()
+		q.file = nil
+	}
+}
@@ -0,0 +1,549 @@
+package cluster
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"distore/internode"
+	"distore/storage"
+)
+
+var ErrCacheOnly = errors.New("edge node is cache-only, writes go to the core cluster")
+
+// EdgeCacheOptions configure a cache-only edge node
+type EdgeCacheOptions struct {
+	Self         string
+	MaxEntries   int           // max cached keys
+	MaxBytes     int64         // max size of cached keys and values, 0 means unlimited
+	MaxStaleness time.Duration // a value is not served longer than this without an invalidation sync
+	PollTimeout  time.Duration // how long a core node holds an invalidation poll open
+	RetryDelay   time.Duration // pause after a failed poll
+}
+
+// DefaultEdgeCacheOptions returns the default edge cache settings
+func DefaultEdgeCacheOptions() EdgeCacheOptions {
+	return EdgeCacheOptions{
+		MaxEntries:   10000,
+		MaxStaleness: 5 * time.Second,
+		PollTimeout:  2 * time.Second,
+		RetryDelay:   500 * time.Millisecond,
+	}
+}
+
+// EdgeCacheStats are the counters of an edge cache
+type EdgeCacheStats struct {
+	Entries       int            `json:"entries"`
+	Bytes         int64          `json:"bytes"`
+	Hits          uint64         `json:"hits"`
+	Misses        uint64         `json:"misses"`
+	Stale         uint64         `json:"stale"` // cached values refetched because the staleness bound passed
+	Evictions     uint64         `json:"evictions"`
+	Invalidations uint64         `json:"invalidations"`
+	Resets        uint64         `json:"resets"`
+	FetchErrors   uint64         `json:"fetch_errors"`
+	Forwarded     uint64         `json:"forwarded"`
+	Sources       []EdgeSyncInfo `json:"sources"`
+}
+
+// EdgeSyncInfo is the invalidation stream state of one core node
+type EdgeSyncInfo struct {
+	Node     string    `json:"node"`
+	Epoch    string    `json:"epoch"`
+	Seq      uint64    `json:"seq"`
+	LastSync time.Time `json:"last_sync"`
+}
+
+type edgeEntry struct {
+	key     string
+	value   string
+	fetched time.Time
+}
+
+// EdgeCache serves reads of an edge node from a bounded LRU cache. Misses are
+// fetched from the nearest data center, and entries are dropped when a core
+// node publishes an invalidation. A value is served only while it was fetched,
+// or the invalidation streams were synced, within MaxStaleness.
+type EdgeCache struct {
+	mu      sync.Mutex
+	opts    EdgeCacheOptions
+	crossDC *CrossDCReplicator
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int64
+	stats   EdgeCacheStats
+
+	// Invalidation bookkeeping, see store
+	gen         uint64
+	floor       uint64            // fetches started before this generation are not cached
+	invalidated map[string]uint64 // key -> generation of its last invalidation
+
+	sources       map[string]*EdgeSyncInfo // core node -> invalidation cursor
+	httpClient    *http.Client             // internal routes of the core nodes
+	forwardClient *http.Client             // client requests, with their own credentials
+	stop          chan struct{}
+	wg            sync.WaitGroup
+}
+
+func NewEdgeCache(crossDC *CrossDCReplicator, opts EdgeCacheOptions) *EdgeCache {
+	defaults := DefaultEdgeCacheOptions()
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaults.MaxEntries
+	}
+	if opts.MaxStaleness <= 0 {
+		opts.MaxStaleness = defaults.MaxStaleness
+	}
+	if opts.PollTimeout <= 0 {
+		opts.PollTimeout = defaults.PollTimeout
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = defaults.RetryDelay
+	}
+	// A poll must come back in time to keep entries fresh
+	if opts.PollTimeout > opts.MaxStaleness/2 {
+		opts.PollTimeout = opts.MaxStaleness / 2
+	}
+
+	return &EdgeCache{
+		opts:        opts,
+		crossDC:     crossDC,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		invalidated: make(map[string]uint64),
+		sources:     make(map[string]*EdgeSyncInfo),
+		httpClient: &http.Client{
+			Timeout:   opts.PollTimeout + 2*time.Second,
+			Transport: internode.Wrap(&http.Transport{MaxIdleConnsPerHost: 10}),
+		},
+		forwardClient: &http.Client{
+			Timeout:   opts.PollTimeout + 2*time.Second,
+			Transport: internode.Relay(&http.Transport{MaxIdleConnsPerHost: 10}),
+		},
+	}
+}
+
+// Start subscribes to the invalidations of every node of the nearest data center
+func (ec *EdgeCache) Start() error {
+	nodes := ec.subscriptionNodes()
+	if len(nodes) == 0 {
+		return errors.New("no core nodes to subscribe to")
+	}
+
+	ec.mu.Lock()
+	if ec.stop != nil {
+		ec.mu.Unlock()
+		return errors.New("edge cache already started")
+	}
+	ec.stop = make(chan struct{})
+	for _, node := range nodes {
+		ec.sources[node] = &EdgeSyncInfo{Node: node}
+	}
+	stop := ec.stop
+	ec.mu.Unlock()
+
+	for _, node := range nodes {
+		ec.wg.Add(1)
+		go ec.subscribe(node, stop)
+	}
+	log.Printf("Edge cache subscribed to invalidations of %v", nodes)
+	return nil
+}
+
+// Stop ends the invalidation subscriptions
+func (ec *EdgeCache) Stop() {
+	ec.mu.Lock()
+	if ec.stop == nil {
+		ec.mu.Unlock()
+		return
+	}
+	close(ec.stop)
+	ec.stop = nil
+	ec.mu.Unlock()
+	ec.wg.Wait()
+}
+
+// Get serves a key from the cache or the nearest data center
+func (ec *EdgeCache) Get(key string) (string, error) {
+	ec.mu.Lock()
+	if elem, ok := ec.entries[key]; ok {
+		entry := elem.Value.(*edgeEntry)
+		if ec.freshLocked(entry) {
+			ec.lru.MoveToFront(elem)
+			ec.stats.Hits++
+			ec.mu.Unlock()
+			return entry.value, nil
+		}
+		ec.stats.Stale++
+		ec.removeLocked(elem)
+	}
+	ec.stats.Misses++
+	gen := ec.gen
+	ec.mu.Unlock()
+
+	fetched := time.Now()
+	value, err := ec.fetch(key)
+	if err != nil {
+		return "", err
+	}
+	ec.store(key, value, fetched, gen)
+	return value, nil
+}
+
+// Set is rejected, writes are forwarded to the core cluster with Forward
+func (ec *EdgeCache) Set(key, value string) error {
+	return ErrCacheOnly
+}
+
+// Delete is rejected, writes are forwarded to the core cluster with Forward
+func (ec *EdgeCache) Delete(key string) error {
+	return ErrCacheOnly
+}
+
+// GetAll returns the fresh cached entries
+func (ec *EdgeCache) GetAll() ([]storage.KeyValue, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	items := make([]storage.KeyValue, 0, len(ec.entries))
+	for key, elem := range ec.entries {
+		if entry := elem.Value.(*edgeEntry); ec.freshLocked(entry) {
+			items = append(items, storage.KeyValue{Key: key, Value: entry.value})
+		}
+	}
+	return items, nil
+}
+
+func (ec *EdgeCache) Close() error {
+	ec.Stop()
+	return nil
+}
+
+// Invalidate drops a key from the cache
+func (ec *EdgeCache) Invalidate(key string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.invalidateLocked(key)
+}
+
+// Flush drops the whole cache
+func (ec *EdgeCache) Flush() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.flushLocked()
+}
+
+// Stats returns the cache counters and the state of the invalidation streams
+func (ec *EdgeCache) Stats() EdgeCacheStats {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	stats := ec.stats
+	stats.Entries = len(ec.entries)
+	stats.Bytes = ec.bytes
+	stats.Sources = make([]EdgeSyncInfo, 0, len(ec.sources))
+	for _, src := range ec.sources {
+		stats.Sources = append(stats.Sources, *src)
+	}
+	sort.Slice(stats.Sources, func(i, j int) bool { return stats.Sources[i].Node < stats.Sources[j].Node })
+	return stats
+}
+
+// freshLocked reports whether an entry may still be served. Either the value
+// itself is recent, or every invalidation stream confirmed it is unchanged.
+func (ec *EdgeCache) freshLocked(entry *edgeEntry) bool {
+	validSince := entry.fetched
+	if synced := ec.syncedLocked(); synced.After(validSince) {
+		validSince = synced
+	}
+	return time.Since(validSince) <= ec.opts.MaxStaleness
+}
+
+// syncedLocked returns the time up to which all invalidations are applied
+func (ec *EdgeCache) syncedLocked() time.Time {
+	var oldest time.Time
+	first := true
+	for _, src := range ec.sources {
+		if first || src.LastSync.Before(oldest) {
+			oldest = src.LastSync
+			first = false
+		}
+	}
+	return oldest
+}
+
+// store caches a fetched value unless the key was invalidated while the
+// fetch was in flight
+func (ec *EdgeCache) store(key, value string, fetched time.Time, gen uint64) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if gen < ec.floor || ec.invalidated[key] > gen {
+		return
+	}
+	if elem, ok := ec.entries[key]; ok {
+		ec.removeLocked(elem)
+	}
+
+	entry := &edgeEntry{key: key, value: value, fetched: fetched}
+	size := int64(len(key) + len(value))
+	if ec.opts.MaxBytes > 0 && size > ec.opts.MaxBytes {
+		return
+	}
+	ec.entries[key] = ec.lru.PushFront(entry)
+	ec.bytes += size
+
+	for len(ec.entries) > ec.opts.MaxEntries || (ec.opts.MaxBytes > 0 && ec.bytes > ec.opts.MaxBytes) {
+		ec.removeLocked(ec.lru.Back())
+		ec.stats.Evictions++
+	}
+}
+
+func (ec *EdgeCache) removeLocked(elem *list.Element) {
+	entry := elem.Value.(*edgeEntry)
+	ec.lru.Remove(elem)
+	delete(ec.entries, entry.key)
+	ec.bytes -= int64(len(entry.key) + len(entry.value))
+}
+
+func (ec *EdgeCache) invalidateLocked(key string) {
+	ec.gen++
+	ec.invalidated[key] = ec.gen
+	if elem, ok := ec.entries[key]; ok {
+		ec.removeLocked(elem)
+	}
+	ec.stats.Invalidations++
+
+	// Forget old invalidations, fetches older than them are not cached
+	if len(ec.invalidated) > ec.opts.MaxEntries {
+		ec.invalidated = make(map[string]uint64)
+		ec.floor = ec.gen
+	}
+}
+
+func (ec *EdgeCache) flushLocked() {
+	ec.gen++
+	ec.floor = ec.gen
+	ec.invalidated = make(map[string]uint64)
+	ec.entries = make(map[string]*list.Element)
+	ec.lru.Init()
+	ec.bytes = 0
+	ec.stats.Resets++
+}
+
+// coreNodes returns all data center nodes, nearest data center first
+func (ec *EdgeCache) coreNodes() []string {
+	ec.crossDC.mu.RLock()
+	type dcNodes struct {
+		latency time.Duration
+		nodes   []string
+	}
+	var dcs []dcNodes
+	for _, dc := range ec.crossDC.dataCenters {
+		d := dcNodes{latency: time.Duration(dc.LatencyMs) * time.Millisecond}
+		for _, node := range dc.Nodes {
+			if node == ec.opts.Self {
+				continue
+			}
+			d.nodes = append(d.nodes, node)
+			if measured, ok := ec.crossDC.nodeLatencies[node]; ok && (len(d.nodes) == 1 || measured < d.latency) {
+				d.latency = measured
+			}
+		}
+		if len(d.nodes) > 0 {
+			dcs = append(dcs, d)
+		}
+	}
+	ec.crossDC.mu.RUnlock()
+
+	sort.SliceStable(dcs, func(i, j int) bool { return dcs[i].latency < dcs[j].latency })
+	var nodes []string
+	for _, d := range dcs {
+		nodes = append(nodes, d.nodes...)
+	}
+	return nodes
+}
+
+// subscriptionNodes returns the nodes of the nearest data center
+func (ec *EdgeCache) subscriptionNodes() []string {
+	nodes := ec.coreNodes()
+	if len(nodes) == 0 {
+		return nil
+	}
+	if dc := ec.crossDC.GetDataCenterForNode(nodes[0]); dc != nil {
+		var same []string
+		for _, node := range nodes {
+			if contains(dc.Nodes, node) {
+				same = append(same, node)
+			}
+		}
+		return same
+	}
+	return nodes[:1]
+}
+
+// fetch reads a key from the core nodes, nearest first
+func (ec *EdgeCache) fetch(key string) (string, error) {
+	var lastErr error = ErrNoReadReplica
+	for _, node := range ec.coreNodes() {
+		value, err := ec.fetchFromNode(key, node)
+		if err == nil || err == storage.ErrKeyNotFound {
+			return value, err
+		}
+		lastErr = err
+	}
+
+	ec.mu.Lock()
+	ec.stats.FetchErrors++
+	ec.mu.Unlock()
+	return "", fmt.Errorf("edge fetch of %s failed: %w", key, lastErr)
+}
+
+func (ec *EdgeCache) fetchFromNode(key, node string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", internode.URL(node, "/internal/get/"+key), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := ec.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", storage.ErrKeyNotFound
+	}
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("read from %s failed: %s", node, resp.Status)
+	}
+
+	var response struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	}
+	return response.Value, nil
+}
+
+// subscribe long-polls the invalidations of a core node until stopped
+func (ec *EdgeCache) subscribe(node string, stop <-chan struct{}) {
+	defer ec.wg.Done()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if err := ec.poll(node); err != nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(ec.opts.RetryDelay):
+			}
+		}
+	}
+}
+
+// poll fetches and applies one batch of invalidations from a core node
+func (ec *EdgeCache) poll(node string) error {
+	ec.mu.Lock()
+	src := ec.sources[node]
+	epoch, seq := src.Epoch, src.Seq
+	ec.mu.Unlock()
+
+	// Every change recorded before the request started is in the answer
+	started := time.Now()
+	query := url.Values{}
+	query.Set("epoch", epoch)
+	query.Set("since", fmt.Sprintf("%d", seq))
+	query.Set("wait_ms", fmt.Sprintf("%d", ec.opts.PollTimeout.Milliseconds()))
+
+	resp, err := ec.httpClient.Get(internode.URL(node, "/internal/invalidations?"+query.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalidations from %s: %s", node, resp.Status)
+	}
+
+	var batch InvalidationBatch
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return err
+	}
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if batch.Reset {
+		log.Printf("Edge cache: invalidation history of %s lost, dropping cache", node)
+		ec.flushLocked()
+	}
+	for _, event := range batch.Events {
+		ec.invalidateLocked(event.Key)
+	}
+	src.Epoch = batch.Epoch
+	src.Seq = batch.Seq
+	src.LastSync = started
+	return nil
+}
+
+// Forward sends a client request to the core cluster and relays the answer.
+// Nodes are tried nearest first; a node that answered is not retried.
+func (ec *EdgeCache) Forward(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var lastErr error = ErrNoReadReplica
+	for _, node := range ec.coreNodes() {
+		target := internode.URL(node, r.URL.RequestURI())
+		req, err := http.NewRequestWithContext(r.Context(), r.Method, target, bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		req.Header = r.Header.Clone()
+
+		resp, err := ec.forwardClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		ec.mu.Lock()
+		ec.stats.Forwarded++
+		ec.mu.Unlock()
+
+		for name, values := range resp.Header {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+		}
+		w.Header().Set("X-Forwarded-To", node)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+		return
+	}
+
+	log.Printf("Edge cache: forwarding %s %s failed: %v", r.Method, r.URL.Path, lastErr)
+	http.Error(w, "Core cluster unavailable", http.StatusBadGateway)
+}
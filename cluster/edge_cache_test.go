@@ -0,0 +1,276 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"distore/auth"
+	"distore/config"
+	"distore/internode"
+	"distore/storage"
+)
+
+// coreNode is a fake core node publishing the invalidations of its store
+type coreNode struct {
+	store         storage.Storage
+	log           *InvalidationLog
+	server        *httptest.Server
+	fetches       int32
+	failPolls     int32 // 1 makes invalidation polls fail
+	forwardedBody string
+}
+
+func newCoreNode(t *testing.T) *coreNode {
+	core := &coreNode{log: NewInvalidationLog(100)}
+	core.store = storage.NewObservedStorage(storage.NewMemoryStorage(), core.log.Record)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/internal/get/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&core.fetches, 1)
+		value, err := core.store.Get(strings.TrimPrefix(r.URL.Path, "/internal/get/"))
+		if err != nil {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"value": value})
+	})
+	mux.HandleFunc("/internal/invalidations", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&core.failPolls) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		q := r.URL.Query()
+		since, _ := strconv.ParseUint(q.Get("since"), 10, 64)
+		waitMs, _ := strconv.Atoi(q.Get("wait_ms"))
+		if q.Get("epoch") == core.log.Epoch() {
+			core.log.Wait(since, time.Duration(waitMs)*time.Millisecond)
+		}
+		json.NewEncoder(w).Encode(core.log.Since(q.Get("epoch"), since, 0))
+	})
+	mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		core.forwardedBody = string(body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("stored"))
+	})
+	core.server = httptest.NewServer(mux)
+	t.Cleanup(core.server.Close)
+	return core
+}
+
+func (core *coreNode) addr() string {
+	return core.server.URL[7:]
+}
+
+func newTestEdgeCache(core *coreNode, opts EdgeCacheOptions) *EdgeCache {
+	cdc := NewCrossDCReplicator(config.MultiCloudConfig{
+		DataCenters: []config.DataCenterConfig{{ID: "eu", Nodes: []string{core.addr()}}},
+	})
+	return NewEdgeCache(cdc, opts)
+}
+
+func TestInvalidationLog(t *testing.T) {
+	l := NewInvalidationLog(3)
+
+	first := l.Since("", 0, 0)
+	if first.Reset || first.Seq != 0 || first.Epoch != l.Epoch() {
+		t.Fatalf("unexpected first contact %+v", first)
+	}
+
+	l.Record("a")
+	l.Record("b")
+	batch := l.Since(l.Epoch(), 0, 0)
+	if len(batch.Events) != 2 || batch.Events[1].Key != "b" || batch.Seq != 2 {
+		t.Fatalf("unexpected batch %+v", batch)
+	}
+	if batch = l.Since(l.Epoch(), 1, 0); len(batch.Events) != 1 || batch.Events[0].Key != "b" {
+		t.Fatalf("expected events after seq 1, got %+v", batch)
+	}
+
+	if !l.Since("other", 0, 0).Reset {
+		t.Error("expected reset for another epoch")
+	}
+
+	// Overflow the ring: a cursor at 0 lost events
+	l.Record("c")
+	l.Record("d")
+	if !l.Since(l.Epoch(), 0, 0).Reset {
+		t.Error("expected reset after history was dropped")
+	}
+	if batch = l.Since(l.Epoch(), 1, 0); batch.Reset || len(batch.Events) != 3 {
+		t.Errorf("cursor at the oldest retained event should not reset, got %+v", batch)
+	}
+
+	start := time.Now()
+	l.Wait(4, 20*time.Millisecond)
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("expected wait to time out without events")
+	}
+}
+
+func TestEdgeCache_ServesAndInvalidates(t *testing.T) {
+	core := newCoreNode(t)
+	core.store.Set("k", "v1")
+
+	ec := newTestEdgeCache(core, EdgeCacheOptions{MaxStaleness: 2 * time.Second, PollTimeout: 50 * time.Millisecond})
+	if err := ec.Start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	defer ec.Stop()
+
+	for i := 0; i < 3; i++ {
+		if v, err := ec.Get("k"); err != nil || v != "v1" {
+			t.Fatalf("get %d: %s, %v", i, v, err)
+		}
+	}
+	if fetches := atomic.LoadInt32(&core.fetches); fetches != 1 {
+		t.Fatalf("expected one fetch from the core, got %d", fetches)
+	}
+
+	if _, err := ec.Get("missing"); err != storage.ErrKeyNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err := ec.Set("k", "x"); err != ErrCacheOnly {
+		t.Fatalf("expected local writes to be rejected, got %v", err)
+	}
+
+	// A write on the core invalidates the cached value
+	core.store.Set("k", "v2")
+	waitFor(t, 2*time.Second, func() bool {
+		v, _ := ec.Get("k")
+		return v == "v2"
+	})
+
+	stats := ec.Stats()
+	if stats.Invalidations == 0 || len(stats.Sources) != 1 || stats.Sources[0].Seq != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestEdgeCache_StalenessBound(t *testing.T) {
+	core := newCoreNode(t)
+	core.store.Set("k", "v1")
+	atomic.StoreInt32(&core.failPolls, 1)
+
+	ec := newTestEdgeCache(core, EdgeCacheOptions{MaxStaleness: 100 * time.Millisecond, RetryDelay: 10 * time.Millisecond})
+	if err := ec.Start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	defer ec.Stop()
+
+	ec.Get("k")
+	ec.Get("k")
+	if stats := ec.Stats(); stats.Hits != 1 {
+		t.Fatalf("expected a hit within the bound, got %+v", stats)
+	}
+
+	// Without invalidation syncs the value is refetched once it is too old
+	core.store.Set("k", "v2")
+	time.Sleep(150 * time.Millisecond)
+	if v, _ := ec.Get("k"); v != "v2" {
+		t.Fatalf("expected a refetch after the staleness bound, got %s", v)
+	}
+	if stats := ec.Stats(); stats.Stale != 1 {
+		t.Errorf("expected one stale entry, got %+v", stats)
+	}
+}
+
+func TestEdgeCache_Bounded(t *testing.T) {
+	core := newCoreNode(t)
+	for _, k := range []string{"a", "b", "c"} {
+		core.store.Set(k, "value")
+	}
+
+	ec := newTestEdgeCache(core, EdgeCacheOptions{MaxEntries: 2})
+	ec.Get("a")
+	ec.Get("b")
+	ec.Get("a") // a is now the most recently used
+	ec.Get("c")
+
+	stats := ec.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	items, _ := ec.GetAll()
+	for _, item := range items {
+		if item.Key == "b" {
+			t.Fatal("expected the least recently used key to be evicted")
+		}
+	}
+
+	// Invalidated while in flight: the fetched value is not cached
+	gen := ec.gen
+	ec.Invalidate("d")
+	ec.store("d", "old", time.Now(), gen)
+	if _, cached := ec.entries["d"]; cached {
+		t.Error("value fetched before an invalidation should not be cached")
+	}
+}
+
+type serviceToken string
+
+func (s serviceToken) Token() (string, error) { return string(s), nil }
+
+func TestEdgeCache_ForwardsClientCredentials(t *testing.T) {
+	tokens := auth.NewSimpleAuthService(3600)
+	service, _ := tokens.GenerateToken("replicator", "", []string{"admin"})
+	if err := internode.Configure(config.InternodeConfig{ServiceToken: true}, serviceToken(service)); err != nil {
+		t.Fatal(err)
+	}
+	defer internode.Reset()
+
+	// The core authenticates client routes like a real node
+	core := httptest.NewServer(auth.AuthMiddleware(tokens)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})))
+	defer core.Close()
+	cdc := NewCrossDCReplicator(config.MultiCloudConfig{
+		DataCenters: []config.DataCenterConfig{{ID: "eu", Nodes: []string{core.URL[7:]}}},
+	})
+	ec := NewEdgeCache(cdc, EdgeCacheOptions{})
+
+	rr := httptest.NewRecorder()
+	ec.Forward(rr, httptest.NewRequest("POST", "/set", strings.NewReader("{}")))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a forwarded request without a token to be rejected, got %d", rr.Code)
+	}
+
+	user, _ := tokens.GenerateToken("u", "t1", []string{"write"})
+	req := httptest.NewRequest("POST", "/set", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer "+user)
+	rr = httptest.NewRecorder()
+	ec.Forward(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Expected a forwarded request with a token to pass, got %d", rr.Code)
+	}
+}
+
+func TestEdgeCache_ForwardsWrites(t *testing.T) {
+	core := newCoreNode(t)
+	ec := newTestEdgeCache(core, EdgeCacheOptions{})
+
+	req := httptest.NewRequest("POST", "/set", strings.NewReader(`{"key":"k","value":"v"}`))
+	rr := httptest.NewRecorder()
+	ec.Forward(rr, req)
+
+	if rr.Code != http.StatusCreated || rr.Body.String() != "stored" || rr.Header().Get("X-Forwarded-To") != core.addr() {
+		t.Fatalf("unexpected forwarded response %d %q", rr.Code, rr.Body.String())
+	}
+	if core.forwardedBody != `{"key":"k","value":"v"}` {
+		t.Errorf("body not forwarded: %q", core.forwardedBody)
+	}
+
+	core.server.Close()
+	rr = httptest.NewRecorder()
+	ec.Forward(rr, httptest.NewRequest("POST", "/set", strings.NewReader("{}")))
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 without core nodes, got %d", rr.Code)
+	}
+}
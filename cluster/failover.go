@@ -2,10 +2,21 @@ package cluster
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"sync"
 	"time"
+
+	"distore/internode"
+)
+
+// NodeState is the failure detector's view of a node
+type NodeState string
+
+const (
+	NodeStateUp      NodeState = "up"
+	NodeStateSuspect NodeState = "suspect"
+	NodeStateDown    NodeState = "down"
+	NodeStateLeaving NodeState = "leaving"
 )
 
 type NodeStatus struct {
@@ -13,14 +24,24 @@ type NodeStatus struct {
 	LastSeen time.Time
 	Online   bool
 	Latency  time.Duration
+	State    NodeState
+	Phi      float64
+
+	detector             *PhiAccrualDetector
+	consecutiveSuccesses int
 }
 
+// StatusListener is notified when a node changes state
+type StatusListener func(node string, from, to NodeState)
+
 type FailoverManager struct {
 	mu            sync.RWMutex
 	nodes         []string
 	nodeStatus    map[string]*NodeStatus
 	checkInterval time.Duration
 	timeout       time.Duration
+	detectorCfg   FailureDetectorConfig
+	listeners     []StatusListener
 }
 
 func NewFailoverManager(nodes []string, checkInterval, timeout time.Duration) *FailoverManager {
@@ -29,19 +50,38 @@ func NewFailoverManager(nodes []string, checkInterval, timeout time.Duration) *F
 		nodeStatus:    make(map[string]*NodeStatus),
 		checkInterval: checkInterval,
 		timeout:       timeout,
+		detectorCfg:   DefaultFailureDetectorConfig(checkInterval),
 	}
 
 	for _, node := range nodes {
-		fm.nodeStatus[node] = &NodeStatus{
-			URL:    node,
-			Online: true,
-		}
+		fm.nodeStatus[node] = fm.newNodeStatus(node)
 	}
 
 	go fm.startHealthChecks()
 	return fm
 }
 
+func (fm *FailoverManager) newNodeStatus(node string) *NodeStatus {
+	return &NodeStatus{
+		URL:      node,
+		Online:   true,
+		State:    NodeStateUp,
+		detector: NewPhiAccrualDetector(fm.detectorCfg, fm.checkInterval),
+	}
+}
+
+// SetDetectorConfig replaces the failure detector settings.
+// Heartbeat history is reset for all nodes.
+func (fm *FailoverManager) SetDetectorConfig(cfg FailureDetectorConfig) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	fm.detectorCfg = cfg
+	for _, status := range fm.nodeStatus {
+		status.detector = NewPhiAccrualDetector(cfg, fm.checkInterval)
+	}
+}
+
 func (fm *FailoverManager) startHealthChecks() {
 	ticker := time.NewTicker(fm.checkInterval)
 	defer ticker.Stop()
@@ -76,15 +116,18 @@ func (fm *FailoverManager) checkNode(nodeURL string) {
 	ctx, cancel := context.WithTimeout(context.Background(), fm.timeout)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/health", nodeURL), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", internode.URL(nodeURL, "/health"), nil)
 	if err != nil {
 		fm.updateNodeStatus(nodeURL, false, 0)
 		return
 	}
 
-	client := &http.Client{Timeout: fm.timeout}
+	client := internode.NewClient(fm.timeout)
 	resp, err := client.Do(req)
 	latency := time.Since(start)
+	if resp != nil {
+		resp.Body.Close()
+	}
 
 	if err != nil || resp.StatusCode != 200 {
 		fm.updateNodeStatus(nodeURL, false, latency)
@@ -94,14 +137,97 @@ func (fm *FailoverManager) checkNode(nodeURL string) {
 	fm.updateNodeStatus(nodeURL, true, latency)
 }
 
-func (fm *FailoverManager) updateNodeStatus(nodeURL string, online bool, latency time.Duration) {
+// OnStatusChange registers a listener for node state transitions.
+// Listeners are called outside of the manager's lock.
+func (fm *FailoverManager) OnStatusChange(listener StatusListener) {
 	fm.mu.Lock()
 	defer fm.mu.Unlock()
+	fm.listeners = append(fm.listeners, listener)
+}
+
+func (fm *FailoverManager) notify(node string, from, to NodeState) {
+	fm.mu.RLock()
+	listeners := make([]StatusListener, len(fm.listeners))
+	copy(listeners, fm.listeners)
+	fm.mu.RUnlock()
+
+	for _, listener := range listeners {
+		listener(node, from, to)
+	}
+}
+
+func (fm *FailoverManager) updateNodeStatus(nodeURL string, online bool, latency time.Duration) {
+	fm.recordProbe(nodeURL, online, latency, time.Now())
+}
+
+// recordProbe applies the result of a probe made at now and notifies the
+// listeners when the node changes state
+func (fm *FailoverManager) recordProbe(nodeURL string, online bool, latency time.Duration, now time.Time) {
+	fm.mu.Lock()
+	status, exists := fm.nodeStatus[nodeURL]
+	if !exists {
+		fm.mu.Unlock()
+		return // node was removed while the probe was in flight
+	}
+	previous := status.State
+	fm.applyProbe(status, online, latency, now)
+	current := status.State
+	fm.mu.Unlock()
 
-	status := fm.nodeStatus[nodeURL]
-	status.Online = online
-	status.LastSeen = time.Now()
+	if previous != current {
+		fm.notify(nodeURL, previous, current)
+	}
+}
+
+func (fm *FailoverManager) applyProbe(status *NodeStatus, online bool, latency time.Duration, now time.Time) {
 	status.Latency = latency
+
+	if online {
+		status.detector.Heartbeat(now)
+		status.LastSeen = now
+		status.consecutiveSuccesses++
+	} else {
+		status.consecutiveSuccesses = 0
+	}
+	status.Phi = status.detector.Phi(now)
+
+	status.State = fm.nextState(status, online)
+	if status.State == NodeStateLeaving {
+		status.Online = online
+	} else {
+		status.Online = status.State != NodeStateDown
+	}
+}
+
+// nextState evaluates the state transition after a probe
+func (fm *FailoverManager) nextState(status *NodeStatus, probeOK bool) NodeState {
+	if status.State == NodeStateLeaving {
+		return NodeStateLeaving
+	}
+
+	if probeOK {
+		if status.State == NodeStateDown && status.consecutiveSuccesses < fm.detectorCfg.RecoveryProbes {
+			return NodeStateDown
+		}
+		return NodeStateUp
+	}
+
+	// A node that never answered has no history to accrue suspicion from
+	if !status.detector.HasHistory() {
+		return NodeStateDown
+	}
+
+	switch {
+	case status.Phi >= fm.detectorCfg.PhiThreshold:
+		return NodeStateDown
+	case status.Phi >= fm.detectorCfg.SuspectThreshold:
+		if status.State == NodeStateDown {
+			return NodeStateDown
+		}
+		return NodeStateSuspect
+	default:
+		return status.State
+	}
 }
 
 func (fm *FailoverManager) GetActiveNodes() []string {
@@ -128,6 +254,8 @@ func (fm *FailoverManager) GetNodeStatus() map[string]*NodeStatus {
 			LastSeen: v.LastSeen,
 			Online:   v.Online,
 			Latency:  v.Latency,
+			State:    v.State,
+			Phi:      v.Phi,
 		}
 	}
 	return statusCopy
@@ -147,7 +275,7 @@ func (fm *FailoverManager) SetNodes(nodes []string) {
 		if s, ok := fm.nodeStatus[n]; ok {
 			newStatus[n] = s
 		} else {
-			newStatus[n] = &NodeStatus{URL: n, Online: true}
+			newStatus[n] = fm.newNodeStatus(n)
 		}
 	}
 	fm.nodeStatus = newStatus
@@ -165,7 +293,7 @@ func (fm *FailoverManager) AddNode(node string) {
 	}
 	fm.nodes = append(fm.nodes, node)
 	if _, exists := fm.nodeStatus[node]; !exists {
-		fm.nodeStatus[node] = &NodeStatus{URL: node, Online: true}
+		fm.nodeStatus[node] = fm.newNodeStatus(node)
 	}
 }
 
@@ -192,3 +320,56 @@ func (fm *FailoverManager) GetNodes() []string {
 	copy(nodes, fm.nodes)
 	return nodes
 }
+
+// MarkLeaving flags a node as leaving the cluster. The detector keeps
+// probing it but no longer changes its state.
+func (fm *FailoverManager) MarkLeaving(node string) bool {
+	fm.mu.Lock()
+	status, exists := fm.nodeStatus[node]
+	if !exists {
+		fm.mu.Unlock()
+		return false
+	}
+	previous := status.State
+	status.State = NodeStateLeaving
+	fm.mu.Unlock()
+
+	if previous != NodeStateLeaving {
+		fm.notify(node, previous, NodeStateLeaving)
+	}
+	return true
+}
+
+// ClearLeaving returns a leaving node to normal failure detection
+func (fm *FailoverManager) ClearLeaving(node string) bool {
+	fm.mu.Lock()
+	status, exists := fm.nodeStatus[node]
+	if !exists || status.State != NodeStateLeaving {
+		fm.mu.Unlock()
+		return false
+	}
+	if status.Online {
+		status.State = NodeStateUp
+	} else {
+		status.State = NodeStateDown
+	}
+	current := status.State
+	fm.mu.Unlock()
+
+	fm.notify(node, NodeStateLeaving, current)
+	return true
+}
+
+// GetNodesByState returns nodes currently in the given state
+func (fm *FailoverManager) GetNodesByState(state NodeState) []string {
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+
+	nodes := make([]string, 0)
+	for _, status := range fm.nodeStatus {
+		if status.State == state {
+			nodes = append(nodes, status.URL)
+		}
+	}
+	return nodes
+}
@@ -3,6 +3,7 @@ package cluster
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -100,3 +101,94 @@ func TestFailoverManager_DynamicMembership(t *testing.T) {
 		t.Fatalf("expected 1 active node after set")
 	}
 }
+
+func TestFailoverManager_ProbeHistories(t *testing.T) {
+	type step struct {
+		at     time.Duration // since the first probe
+		action string        // "ok", "fail", "leave" or "clear"
+		want   NodeState
+	}
+
+	// Probes every hour with the default detector: phi stays below the
+	// suspect threshold one hour after a heartbeat, passes it after two and
+	// passes the down threshold after two and a half
+	tests := []struct {
+		name        string
+		steps       []step
+		transitions []string
+	}{
+		{
+			name: "up, suspect, down and back up",
+			steps: []step{
+				{0, "ok", NodeStateUp},
+				{time.Hour, "ok", NodeStateUp},
+				{2 * time.Hour, "ok", NodeStateUp},
+				{3 * time.Hour, "fail", NodeStateUp},
+				{4 * time.Hour, "fail", NodeStateSuspect},
+				{4*time.Hour + 30*time.Minute, "fail", NodeStateDown},
+				{5 * time.Hour, "ok", NodeStateDown},
+				{6 * time.Hour, "ok", NodeStateUp},
+			},
+			transitions: []string{"up>suspect", "suspect>down", "down>up"},
+		},
+		{
+			name: "suspect node answering again",
+			steps: []step{
+				{0, "ok", NodeStateUp},
+				{time.Hour, "ok", NodeStateUp},
+				{3 * time.Hour, "fail", NodeStateSuspect},
+				{3*time.Hour + time.Minute, "ok", NodeStateUp},
+			},
+			transitions: []string{"up>suspect", "suspect>up"},
+		},
+		{
+			name: "node that never answered",
+			steps: []step{
+				{0, "fail", NodeStateDown},
+				{time.Hour, "ok", NodeStateDown},
+				{2 * time.Hour, "ok", NodeStateUp},
+			},
+			transitions: []string{"up>down", "down>up"},
+		},
+		{
+			name: "leaving node",
+			steps: []step{
+				{0, "ok", NodeStateUp},
+				{0, "leave", NodeStateLeaving},
+				{time.Hour, "ok", NodeStateLeaving},
+				{10 * time.Hour, "fail", NodeStateLeaving},
+				{10 * time.Hour, "clear", NodeStateDown},
+			},
+			transitions: []string{"up>leaving", "leaving>down"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Long check interval: probes are only fed by the test
+			fm := NewFailoverManager([]string{"node:1"}, time.Hour, time.Second)
+			var transitions []string
+			fm.OnStatusChange(func(node string, from, to NodeState) {
+				transitions = append(transitions, string(from)+">"+string(to))
+			})
+
+			start := time.Now()
+			for i, s := range tt.steps {
+				switch s.action {
+				case "ok", "fail":
+					fm.recordProbe("node:1", s.action == "ok", time.Millisecond, start.Add(s.at))
+				case "leave":
+					fm.MarkLeaving("node:1")
+				case "clear":
+					fm.ClearLeaving("node:1")
+				}
+				if state := fm.GetNodeStatus()["node:1"].State; state != s.want {
+					t.Fatalf("Step %d (%s at %v): expected %s, got %s", i, s.action, s.at, s.want, state)
+				}
+			}
+			if strings.Join(transitions, " ") != strings.Join(tt.transitions, " ") {
+				t.Errorf("Expected transitions %v, got %v", tt.transitions, transitions)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package cluster
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// InvalidationEvent tells edge caches that a key changed on the core cluster
+type InvalidationEvent struct {
+	Seq  uint64    `json:"seq"`
+	Key  string    `json:"key"`
+	Time time.Time `json:"ts"`
+}
+
+// InvalidationBatch is the answer to an edge polling for invalidations.
+// Reset asks the edge to drop its whole cache because events were missed.
+type InvalidationBatch struct {
+	Epoch  string              `json:"epoch"`
+	Seq    uint64              `json:"seq"`
+	Events []InvalidationEvent `json:"events"`
+	Reset  bool                `json:"reset"`
+}
+
+// InvalidationLog keeps the most recent key changes of a core node in a ring
+// buffer. The epoch changes on every restart, so edges notice lost history.
+type InvalidationLog struct {
+	mu      sync.Mutex
+	epoch   string
+	buf     []InvalidationEvent
+	start   int // index of the oldest event in buf
+	count   int
+	seq     uint64
+	changed chan struct{} // closed and replaced on every event
+}
+
+func NewInvalidationLog(capacity int) *InvalidationLog {
+	if capacity <= 0 {
+		capacity = 10000
+	}
+	return &InvalidationLog{
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		buf:     make([]InvalidationEvent, capacity),
+		changed: make(chan struct{}),
+	}
+}
+
+// Epoch identifies this incarnation of the log
+func (l *InvalidationLog) Epoch() string {
+	return l.epoch
+}
+
+// Record appends an invalidation for key
+func (l *InvalidationLog) Record(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	event := InvalidationEvent{Seq: l.seq, Key: key, Time: time.Now()}
+	if l.count < len(l.buf) {
+		l.buf[(l.start+l.count)%len(l.buf)] = event
+		l.count++
+	} else {
+		l.buf[l.start] = event
+		l.start = (l.start + 1) % len(l.buf)
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Since returns up to max events after seq. A caller from another epoch, or
+// one that fell behind the retained history, gets a reset.
+func (l *InvalidationLog) Since(epoch string, seq uint64, max int) InvalidationBatch {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	batch := InvalidationBatch{Epoch: l.epoch, Seq: l.seq}
+	if epoch == "" {
+		// First contact: nothing cached from this node yet
+		return batch
+	}
+	oldest := l.seq - uint64(l.count) + 1
+	if epoch != l.epoch || seq > l.seq || seq+1 < oldest {
+		batch.Reset = true
+		return batch
+	}
+
+	for i := 0; i < l.count && (max <= 0 || len(batch.Events) < max); i++ {
+		event := l.buf[(l.start+i)%len(l.buf)]
+		if event.Seq > seq {
+			batch.Events = append(batch.Events, event)
+		}
+	}
+	if len(batch.Events) > 0 {
+		batch.Seq = batch.Events[len(batch.Events)-1].Seq
+	}
+	return batch
+}
+
+// Wait blocks until an event after seq is recorded or the timeout expires
+func (l *InvalidationLog) Wait(seq uint64, timeout time.Duration) {
+	l.mu.Lock()
+	if l.seq > seq {
+		l.mu.Unlock()
+		return
+	}
+	changed := l.changed
+	l.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,370 @@
+package cluster
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"distore/config"
+	"distore/internode"
+)
+
+// Node kinds used to pick the latency threshold
+const (
+	LatencyKindLocal   = "local"
+	LatencyKindCrossDC = "cross_dc"
+	LatencyKindEdge    = "edge"
+)
+
+// LatencyProberConfig configures the active latency prober
+type LatencyProberConfig struct {
+	Self       string               // address of this node, never probed
+	LocalDC    string               // data center of this node, derived from Self when empty
+	Interval   time.Duration        // time between probe rounds
+	Timeout    time.Duration        // timeout of a single probe
+	Alpha      float64              // EWMA smoothing factor, weight of the newest sample
+	WindowSize int                  // number of samples kept for percentiles
+	Thresholds config.LatencyConfig // defaults to the thresholds of the replicator
+}
+
+// DefaultLatencyProberConfig returns the default prober settings
+func DefaultLatencyProberConfig() LatencyProberConfig {
+	return LatencyProberConfig{
+		Interval:   5 * time.Second,
+		Timeout:    2 * time.Second,
+		Alpha:      0.3,
+		WindowSize: 100,
+	}
+}
+
+// LatencyProberConfigFromConfig builds prober settings from the multi-cloud
+// section of the config, falling back to defaults for unset values
+func LatencyProberConfigFromConfig(self string, cfg config.MultiCloudConfig) LatencyProberConfig {
+	lpc := DefaultLatencyProberConfig()
+	lpc.Self = self
+	lpc.LocalDC = cfg.LocalDataCenter
+	lpc.Thresholds = cfg.LatencyThresholds
+	if cfg.LatencyThresholds.ProbeIntervalMs > 0 {
+		lpc.Interval = time.Duration(cfg.LatencyThresholds.ProbeIntervalMs) * time.Millisecond
+	}
+	if cfg.LatencyThresholds.ProbeTimeoutMs > 0 {
+		lpc.Timeout = time.Duration(cfg.LatencyThresholds.ProbeTimeoutMs) * time.Millisecond
+	}
+	if cfg.LatencyThresholds.Smoothing > 0 && cfg.LatencyThresholds.Smoothing <= 1 {
+		lpc.Alpha = cfg.LatencyThresholds.Smoothing
+	}
+	if cfg.LatencyThresholds.WindowSize > 0 {
+		lpc.WindowSize = cfg.LatencyThresholds.WindowSize
+	}
+	return lpc
+}
+
+// LatencyStats are the measurements of one probed node
+type LatencyStats struct {
+	Node       string        `json:"node"`
+	DataCenter string        `json:"data_center,omitempty"`
+	Kind       string        `json:"kind"`
+	EWMA       time.Duration `json:"ewma"`
+	Last       time.Duration `json:"last"`
+	P50        time.Duration `json:"p50"`
+	P95        time.Duration `json:"p95"`
+	P99        time.Duration `json:"p99"`
+	Samples    uint64        `json:"samples"`
+	Failures   uint64        `json:"failures"`
+	Reachable  bool          `json:"reachable"`
+	Threshold  time.Duration `json:"threshold"`
+	Exceeded   bool          `json:"exceeded"` // EWMA above the threshold or unreachable
+	LastProbe  time.Time     `json:"last_probe"`
+}
+
+type latencyTarget struct {
+	dc   string
+	kind string
+
+	ewma      float64   // milliseconds
+	window    []float64 // milliseconds, ring buffer
+	next      int
+	last      time.Duration
+	samples   uint64
+	failures  uint64
+	reachable bool
+	lastProbe time.Time
+}
+
+// LatencyProber measures the round trip time to every data center and edge
+// node and feeds the smoothed estimates into the cross-DC replicator
+type LatencyProber struct {
+	mu         sync.RWMutex
+	cfg        LatencyProberConfig
+	replicator *CrossDCReplicator
+	targets    map[string]*latencyTarget
+	httpClient *http.Client
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+func NewLatencyProber(replicator *CrossDCReplicator, cfg LatencyProberConfig) *LatencyProber {
+	defaults := DefaultLatencyProberConfig()
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaults.Interval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaults.Timeout
+	}
+	if cfg.Alpha <= 0 || cfg.Alpha > 1 {
+		cfg.Alpha = defaults.Alpha
+	}
+	if cfg.WindowSize <= 0 {
+		cfg.WindowSize = defaults.WindowSize
+	}
+
+	lp := &LatencyProber{
+		cfg:        cfg,
+		replicator: replicator,
+		targets:    make(map[string]*latencyTarget),
+		httpClient: internode.NewClient(cfg.Timeout),
+	}
+
+	replicator.mu.RLock()
+	if lp.cfg.Thresholds == (config.LatencyConfig{}) {
+		lp.cfg.Thresholds = replicator.latencyConfig
+	}
+	localDC := cfg.LocalDC
+	if localDC == "" {
+		localDC = replicator.localDC
+	}
+	if localDC == "" {
+		for _, dc := range replicator.dataCenters {
+			if contains(dc.Nodes, cfg.Self) {
+				localDC = dc.ID
+			}
+		}
+	}
+	for _, dc := range replicator.dataCenters {
+		kind := LatencyKindCrossDC
+		if dc.ID == localDC {
+			kind = LatencyKindLocal
+		}
+		for _, node := range dc.Nodes {
+			if node != cfg.Self {
+				lp.targets[node] = &latencyTarget{dc: dc.ID, kind: kind}
+			}
+		}
+	}
+	for _, edge := range replicator.edgeNodes {
+		if edge.Node != cfg.Self {
+			lp.targets[edge.Node] = &latencyTarget{kind: LatencyKindEdge}
+		}
+	}
+	replicator.mu.RUnlock()
+
+	return lp
+}
+
+// Start probes all nodes periodically until Stop is called
+func (lp *LatencyProber) Start() {
+	lp.mu.Lock()
+	if lp.stop != nil {
+		lp.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	lp.stop = stop
+	lp.mu.Unlock()
+
+	lp.wg.Add(1)
+	go func() {
+		defer lp.wg.Done()
+		ticker := time.NewTicker(lp.cfg.Interval)
+		defer ticker.Stop()
+
+		lp.ProbeOnce()
+		for {
+			select {
+			case <-ticker.C:
+				lp.ProbeOnce()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	log.Printf("Latency prober started for %d nodes (interval %v)", len(lp.targets), lp.cfg.Interval)
+}
+
+// Stop halts the background probing
+func (lp *LatencyProber) Stop() {
+	lp.mu.Lock()
+	if lp.stop == nil {
+		lp.mu.Unlock()
+		return
+	}
+	close(lp.stop)
+	lp.stop = nil
+	lp.mu.Unlock()
+	lp.wg.Wait()
+}
+
+// ProbeOnce measures every node concurrently and updates the replicator
+func (lp *LatencyProber) ProbeOnce() {
+	lp.mu.RLock()
+	nodes := make([]string, 0, len(lp.targets))
+	for node := range lp.targets {
+		nodes = append(nodes, node)
+	}
+	lp.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			rtt, err := lp.probe(node)
+			lp.record(node, rtt, err == nil)
+		}(node)
+	}
+	wg.Wait()
+}
+
+func (lp *LatencyProber) probe(node string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lp.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", internode.URL(node, "/health"), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	resp, err := lp.httpClient.Do(req)
+	rtt := time.Since(start)
+	if err != nil {
+		return rtt, err
+	}
+	resp.Body.Close()
+
+	// Any answer measures the round trip, even an unhealthy one
+	return rtt, nil
+}
+
+// record adds a probe result and pushes the new estimate to the replicator
+func (lp *LatencyProber) record(node string, rtt time.Duration, ok bool) {
+	lp.mu.Lock()
+	t, exists := lp.targets[node]
+	if !exists {
+		lp.mu.Unlock()
+		return
+	}
+
+	t.lastProbe = time.Now()
+	t.reachable = ok
+	if ok {
+		ms := float64(rtt) / float64(time.Millisecond)
+		if t.samples == 0 {
+			t.ewma = ms
+		} else {
+			t.ewma = lp.cfg.Alpha*ms + (1-lp.cfg.Alpha)*t.ewma
+		}
+		if len(t.window) < lp.cfg.WindowSize {
+			t.window = append(t.window, ms)
+		} else {
+			t.window[t.next] = ms
+		}
+		t.next = (t.next + 1) % lp.cfg.WindowSize
+		t.last = rtt
+		t.samples++
+	} else {
+		t.failures++
+	}
+
+	stats := lp.statsLocked(node, t)
+	lp.mu.Unlock()
+
+	if stats.Samples > 0 {
+		lp.replicator.UpdateLatencyMetrics(node, stats.EWMA)
+	}
+	lp.replicator.SetNodeFlagged(node, stats.Exceeded)
+}
+
+// threshold returns the configured latency limit of a node kind, 0 means none
+func (lp *LatencyProber) threshold(kind string) time.Duration {
+	var ms int
+	switch kind {
+	case LatencyKindLocal:
+		ms = lp.cfg.Thresholds.LocalThresholdMs
+	case LatencyKindCrossDC:
+		ms = lp.cfg.Thresholds.CrossDCThresholdMs
+	case LatencyKindEdge:
+		ms = lp.cfg.Thresholds.EdgeThresholdMs
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (lp *LatencyProber) statsLocked(node string, t *latencyTarget) LatencyStats {
+	stats := LatencyStats{
+		Node:       node,
+		DataCenter: t.dc,
+		Kind:       t.kind,
+		EWMA:       msToDuration(t.ewma),
+		Last:       t.last,
+		Samples:    t.samples,
+		Failures:   t.failures,
+		Reachable:  t.reachable,
+		Threshold:  lp.threshold(t.kind),
+		LastProbe:  t.lastProbe,
+	}
+	if len(t.window) > 0 {
+		sorted := append([]float64(nil), t.window...)
+		sort.Float64s(sorted)
+		stats.P50 = msToDuration(percentile(sorted, 0.50))
+		stats.P95 = msToDuration(percentile(sorted, 0.95))
+		stats.P99 = msToDuration(percentile(sorted, 0.99))
+	}
+	if !t.lastProbe.IsZero() && !t.reachable {
+		stats.Exceeded = true
+	} else if stats.Threshold > 0 && t.samples > 0 && stats.EWMA > stats.Threshold {
+		stats.Exceeded = true
+	}
+	return stats
+}
+
+// Stats returns the measurements of all probed nodes ordered by node
+func (lp *LatencyProber) Stats() []LatencyStats {
+	lp.mu.RLock()
+	defer lp.mu.RUnlock()
+
+	list := make([]LatencyStats, 0, len(lp.targets))
+	for node, t := range lp.targets {
+		list = append(list, lp.statsLocked(node, t))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Node < list[j].Node })
+	return list
+}
+
+// NodeStats returns the measurements of one node
+func (lp *LatencyProber) NodeStats(node string) (LatencyStats, bool) {
+	lp.mu.RLock()
+	defer lp.mu.RUnlock()
+
+	t, ok := lp.targets[node]
+	if !ok {
+		return LatencyStats{}, false
+	}
+	return lp.statsLocked(node, t), true
+}
+
+// percentile returns the nearest-rank percentile of sorted samples
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func msToDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
@@ -0,0 +1,123 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"distore/config"
+)
+
+func delayedNode(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestLatencyProber_FeedsReplicator(t *testing.T) {
+	fast := delayedNode(0)
+	defer fast.Close()
+	slow := delayedNode(30 * time.Millisecond)
+	defer slow.Close()
+
+	cfg := config.MultiCloudConfig{
+		DataCenters: []config.DataCenterConfig{
+			{ID: "eu", Nodes: []string{"self:8080", fast.URL[7:]}, Priority: 1},
+			{ID: "us", Nodes: []string{slow.URL[7:], "127.0.0.1:1"}, Priority: 1, LatencyMs: 1},
+		},
+		LatencyThresholds: config.LatencyConfig{LocalThresholdMs: 20, CrossDCThresholdMs: 10},
+	}
+	cdc := NewCrossDCReplicator(cfg)
+	lp := NewLatencyProber(cdc, LatencyProberConfig{Self: "self:8080", Timeout: 500 * time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		lp.ProbeOnce()
+	}
+
+	stats := lp.Stats()
+	if len(stats) != 3 {
+		t.Fatalf("expected 3 probed nodes, self excluded, got %d", len(stats))
+	}
+
+	fastStats, _ := lp.NodeStats(fast.URL[7:])
+	if fastStats.Kind != LatencyKindLocal || fastStats.Samples != 3 || fastStats.Exceeded {
+		t.Errorf("unexpected local node stats %+v", fastStats)
+	}
+
+	slowStats, _ := lp.NodeStats(slow.URL[7:])
+	if slowStats.Kind != LatencyKindCrossDC || slowStats.EWMA < 30*time.Millisecond || !slowStats.Exceeded {
+		t.Errorf("expected slow cross-DC node beyond threshold, got %+v", slowStats)
+	}
+	if slowStats.P50 < 30*time.Millisecond || slowStats.P99 < slowStats.P50 {
+		t.Errorf("unexpected percentiles %+v", slowStats)
+	}
+
+	downStats, _ := lp.NodeStats("127.0.0.1:1")
+	if downStats.Reachable || downStats.Failures != 3 || !downStats.Exceeded {
+		t.Errorf("expected unreachable node to be flagged, got %+v", downStats)
+	}
+
+	if got := cdc.GetLatencyMetrics()[slow.URL[7:]]; got != slowStats.EWMA {
+		t.Errorf("replicator latency %v, want %v", got, slowStats.EWMA)
+	}
+	if _, measured := cdc.GetLatencyMetrics()["127.0.0.1:1"]; measured {
+		t.Error("unreachable node should keep its configured latency")
+	}
+
+	// Flagged nodes are selected after healthy ones of the same priority
+	targets, _ := cdc.SelectOptimalTargets("k", 4)
+	if targets[0].Node != "self:8080" && targets[0].Node != fast.URL[7:] {
+		t.Errorf("expected an unflagged node first, got %+v", targets[0])
+	}
+	if !targets[2].Flagged || !targets[3].Flagged {
+		t.Errorf("expected flagged nodes last, got %+v", targets)
+	}
+}
+
+func TestLatencyProber_EWMAAndRecovery(t *testing.T) {
+	cdc := NewCrossDCReplicator(config.MultiCloudConfig{
+		EdgeNodes:         []config.EdgeNodeConfig{{ID: "edge-1", Node: "edge:8080"}},
+		LatencyThresholds: config.LatencyConfig{EdgeThresholdMs: 50},
+	})
+	lp := NewLatencyProber(cdc, LatencyProberConfig{Alpha: 0.5, WindowSize: 4})
+
+	lp.record("edge:8080", 100*time.Millisecond, true)
+	lp.record("edge:8080", 20*time.Millisecond, true)
+	stats, _ := lp.NodeStats("edge:8080")
+	if stats.Kind != LatencyKindEdge || stats.EWMA != 60*time.Millisecond || !stats.Exceeded {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if !cdc.IsNodeFlagged("edge:8080") {
+		t.Fatal("expected edge node to be flagged")
+	}
+
+	for i := 0; i < 4; i++ {
+		lp.record("edge:8080", 10*time.Millisecond, true)
+	}
+	stats, _ = lp.NodeStats("edge:8080")
+	if stats.Exceeded || cdc.IsNodeFlagged("edge:8080") {
+		t.Fatalf("expected recovery below threshold, got %+v", stats)
+	}
+	if stats.P99 != 10*time.Millisecond {
+		t.Errorf("expected the window to drop old samples, got p99 %v", stats.P99)
+	}
+}
+
+func TestLatencyProber_StartStop(t *testing.T) {
+	node := delayedNode(0)
+	defer node.Close()
+
+	cdc := NewCrossDCReplicator(config.MultiCloudConfig{
+		DataCenters: []config.DataCenterConfig{{ID: "eu", Nodes: []string{node.URL[7:]}}},
+	})
+	lp := NewLatencyProber(cdc, LatencyProberConfig{Interval: 10 * time.Millisecond})
+	lp.Start()
+	waitFor(t, 2*time.Second, func() bool {
+		stats, _ := lp.NodeStats(node.URL[7:])
+		return stats.Samples >= 2
+	})
+	lp.Stop()
+	lp.Stop()
+}
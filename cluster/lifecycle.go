@@ -0,0 +1,651 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"distore/internode"
+	"distore/storage"
+)
+
+// LifecycleOperation is a node lifecycle workflow
+type LifecycleOperation string
+
+const (
+	OpDecommission LifecycleOperation = "decommission" // stream all owned ranges away, then leave
+	OpBootstrap    LifecycleOperation = "bootstrap"    // pull this node's ranges, then take traffic
+	OpReplace      LifecycleOperation = "replace"      // take over the ranges of a dead node
+)
+
+// LocalNodeState is the lifecycle state of this node
+type LocalNodeState string
+
+const (
+	LocalNodeNormal         LocalNodeState = "normal"
+	LocalNodeJoining        LocalNodeState = "joining"
+	LocalNodeReplacing      LocalNodeState = "replacing"
+	LocalNodeLeaving        LocalNodeState = "leaving"
+	LocalNodeDecommissioned LocalNodeState = "decommissioned"
+)
+
+// LifecycleJobState is the state of a lifecycle workflow
+type LifecycleJobState string
+
+const (
+	LifecycleRunning   LifecycleJobState = "running"
+	LifecycleCompleted LifecycleJobState = "completed"
+	LifecycleFailed    LifecycleJobState = "failed"
+)
+
+// Membership event states announced to peers
+const (
+	MemberJoining  = "joining"
+	MemberJoined   = "joined"
+	MemberLeaving  = "leaving"
+	MemberLeft     = "left"
+	MemberReplaced = "replaced"
+)
+
+const maxLifecycleHistory = 20
+
+var (
+	ErrLifecycleInProgress = errors.New("a lifecycle operation is already running")
+	ErrNoPeers             = errors.New("no other cluster members")
+	ErrNodeAlive           = errors.New("node is not down, use force to replace it anyway")
+	ErrUnknownNode         = errors.New("node is not a cluster member")
+	ErrInvalidNodeState    = errors.New("operation not allowed in the current node state")
+)
+
+// LifecycleJob tracks a decommission, bootstrap or replace workflow
+type LifecycleJob struct {
+	Operation       LifecycleOperation `json:"operation"`
+	Node            string             `json:"node"`
+	Replaces        string             `json:"replaces,omitempty"`
+	State           LifecycleJobState  `json:"state"`
+	Phase           string             `json:"phase"`
+	StartedAt       time.Time          `json:"started_at"`
+	FinishedAt      time.Time          `json:"finished_at,omitempty"`
+	TotalRanges     int                `json:"total_ranges"`
+	CompletedRanges int                `json:"completed_ranges"`
+	Keys            int                `json:"keys"`
+	Error           string             `json:"error,omitempty"`
+}
+
+// MembershipEvent is announced to peers as a node moves through its lifecycle
+type MembershipEvent struct {
+	Node     string `json:"node"`
+	State    string `json:"state"`
+	Replaces string `json:"replaces,omitempty"`
+}
+
+// MembershipManager is the node list the lifecycle workflows update
+type MembershipManager interface {
+	GetNodes() []string
+	UpdateNodes(nodes []string)
+}
+
+// NodeLifecycle runs the decommission, bootstrap and replace workflows of
+// this node and applies the membership events announced by peers
+type NodeLifecycle struct {
+	mu         sync.RWMutex
+	self       string
+	store      storage.Storage
+	members    MembershipManager
+	rebalancer *Rebalancer
+	failover   *FailoverManager
+	httpClient *http.Client
+
+	state   LocalNodeState
+	job     *LifecycleJob
+	history []LifecycleJob
+	done    chan struct{}
+}
+
+func NewNodeLifecycle(self string, store storage.Storage, members MembershipManager, rebalancer *Rebalancer) *NodeLifecycle {
+	return &NodeLifecycle{
+		self:       self,
+		store:      store,
+		members:    members,
+		rebalancer: rebalancer,
+		httpClient: internode.NewClient(10 * time.Second),
+		state:      LocalNodeNormal,
+	}
+}
+
+// SetFailoverManager enables liveness checks for replace and leaving marks
+// for announced departures
+func (nl *NodeLifecycle) SetFailoverManager(fm *FailoverManager) {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	nl.failover = fm
+}
+
+// Self returns the address of this node
+func (nl *NodeLifecycle) Self() string {
+	return nl.self
+}
+
+// State returns the lifecycle state of this node
+func (nl *NodeLifecycle) State() LocalNodeState {
+	nl.mu.RLock()
+	defer nl.mu.RUnlock()
+	return nl.state
+}
+
+// AcceptingReads reports whether this node holds its data and may serve reads
+func (nl *NodeLifecycle) AcceptingReads() bool {
+	state := nl.State()
+	return state == LocalNodeNormal || state == LocalNodeLeaving
+}
+
+// AcceptingWrites reports whether this node is still a cluster member.
+// Joining and replacing nodes accept writes so they do not miss updates
+// racing with the transfer.
+func (nl *NodeLifecycle) AcceptingWrites() bool {
+	return nl.State() != LocalNodeDecommissioned
+}
+
+// Job returns the current or last lifecycle job
+func (nl *NodeLifecycle) Job() (LifecycleJob, bool) {
+	nl.mu.RLock()
+	defer nl.mu.RUnlock()
+
+	if nl.job == nil {
+		return LifecycleJob{}, false
+	}
+	return *nl.job, true
+}
+
+// Wait blocks until the running job finishes and returns it
+func (nl *NodeLifecycle) Wait() LifecycleJob {
+	nl.mu.RLock()
+	done := nl.done
+	nl.mu.RUnlock()
+
+	if done != nil {
+		<-done
+	}
+	job, _ := nl.Job()
+	return job
+}
+
+// GetStatus returns the node state, the current job and recent history
+func (nl *NodeLifecycle) GetStatus() map[string]interface{} {
+	nl.mu.RLock()
+	defer nl.mu.RUnlock()
+
+	status := map[string]interface{}{
+		"node":    nl.self,
+		"state":   nl.state,
+		"history": append([]LifecycleJob(nil), nl.history...),
+	}
+	if nl.job != nil {
+		status["job"] = *nl.job
+	}
+	return status
+}
+
+// Decommission streams every local key to its owner in the cluster without
+// this node, then announces the departure and leaves the ring
+func (nl *NodeLifecycle) Decommission() error {
+	remaining := without(nl.members.GetNodes(), nl.self)
+	if len(remaining) == 0 {
+		return ErrNoPeers
+	}
+
+	job, err := nl.begin(OpDecommission, "", LocalNodeLeaving, LocalNodeNormal)
+	if err != nil {
+		return err
+	}
+
+	go nl.finish(job, LocalNodeDecommissioned, LocalNodeNormal, func() error {
+		nl.announce(MembershipEvent{Node: nl.self, State: MemberLeaving}, remaining)
+
+		nl.setPhase("streaming")
+		if err := nl.rebalancer.StartWithNodes(remaining, true); err != nil {
+			nl.announce(MembershipEvent{Node: nl.self, State: MemberJoined}, remaining)
+			return err
+		}
+		progress := nl.rebalancer.Wait()
+
+		nl.mu.Lock()
+		nl.job.TotalRanges = progress.TotalRanges
+		nl.job.CompletedRanges = progress.CompletedRanges
+		nl.job.Keys = progress.MovedKeys
+		nl.mu.Unlock()
+
+		if progress.State != RebalanceCompleted {
+			// abort: keep serving, peers clear the leaving mark
+			nl.announce(MembershipEvent{Node: nl.self, State: MemberJoined}, remaining)
+			if progress.Error != "" {
+				return errors.New(progress.Error)
+			}
+			return fmt.Errorf("streaming %s", progress.State)
+		}
+
+		nl.setPhase("leaving")
+		nl.announce(MembershipEvent{Node: nl.self, State: MemberLeft}, remaining)
+		nl.members.UpdateNodes(remaining)
+		return nil
+	})
+	return nil
+}
+
+// Bootstrap joins the cluster formed by the current members and seeds. The
+// ranges this node will own are pulled from their current owners (falling back
+// to other replicas) before the node serves reads.
+func (nl *NodeLifecycle) Bootstrap(seeds []string) error {
+	members := without(union(nl.members.GetNodes(), seeds), nl.self)
+	if len(members) == 0 {
+		return ErrNoPeers
+	}
+
+	job, err := nl.begin(OpBootstrap, "", LocalNodeJoining, LocalNodeNormal, LocalNodeJoining)
+	if err != nil {
+		return err
+	}
+
+	go nl.finish(job, LocalNodeNormal, LocalNodeJoining, func() error {
+		newNodes := union(members, []string{nl.self})
+		oldRing := nl.rebalancer.BuildRing(members)
+		newRing := nl.rebalancer.BuildRing(newNodes)
+
+		// peers start replicating writes to us before the transfer
+		nl.announce(MembershipEvent{Node: nl.self, State: MemberJoining}, members)
+
+		nl.setPhase("streaming")
+		var movements []RangeMovement
+		for _, m := range ComputeRangeMovements(oldRing, newRing) {
+			if m.To == nl.self {
+				movements = append(movements, m)
+			}
+		}
+		if err := nl.pullRanges(movements, func(m RangeMovement) []string {
+			return append([]string{m.From}, without(members, m.From)...)
+		}, false); err != nil {
+			return err
+		}
+
+		nl.setPhase("joining")
+		nl.members.UpdateNodes(newNodes)
+		nl.rebalancer.ResetRing(newNodes)
+		nl.announce(MembershipEvent{Node: nl.self, State: MemberJoined}, members)
+		return nil
+	})
+	return nil
+}
+
+// Replace takes over the token ranges of a dead node and pulls their data
+// from the surviving replicas
+func (nl *NodeLifecycle) Replace(dead string, force bool) error {
+	members := nl.members.GetNodes()
+	if !contains(members, dead) {
+		return ErrUnknownNode
+	}
+	if dead == nl.self {
+		return ErrInvalidNodeState
+	}
+
+	nl.mu.RLock()
+	fm := nl.failover
+	nl.mu.RUnlock()
+	if fm != nil && !force {
+		if status, ok := fm.GetNodeStatus()[dead]; ok && status.State != NodeStateDown {
+			return ErrNodeAlive
+		}
+	}
+
+	survivors := without(without(members, dead), nl.self)
+	if len(survivors) == 0 {
+		return ErrNoPeers
+	}
+
+	job, err := nl.begin(OpReplace, dead, LocalNodeReplacing, LocalNodeNormal, LocalNodeJoining, LocalNodeReplacing)
+	if err != nil {
+		return err
+	}
+
+	go nl.finish(job, LocalNodeNormal, LocalNodeReplacing, func() error {
+		oldRing := nl.rebalancer.BuildRing(members)
+		identity := dead
+		if id, ok := nl.rebalancer.TokenIdentities()[dead]; ok {
+			identity = id
+		}
+		nl.rebalancer.SetTokenIdentity(nl.self, identity)
+		newNodes := union(without(members, dead), []string{nl.self})
+		newRing := nl.rebalancer.BuildRing(newNodes)
+
+		nl.announce(MembershipEvent{Node: nl.self, State: MemberJoining, Replaces: dead}, survivors)
+
+		nl.setPhase("streaming")
+		var movements []RangeMovement
+		for _, m := range ComputeRangeMovements(oldRing, newRing) {
+			if m.To == nl.self {
+				movements = append(movements, m)
+			}
+		}
+		// the dead node's data only survives as replicas, so merge all of them
+		if err := nl.pullRanges(movements, func(m RangeMovement) []string {
+			return survivors
+		}, true); err != nil {
+			return err
+		}
+
+		nl.setPhase("joining")
+		nl.members.UpdateNodes(newNodes)
+		nl.rebalancer.ResetRing(newNodes)
+		nl.announce(MembershipEvent{Node: nl.self, State: MemberReplaced, Replaces: dead}, survivors)
+		return nil
+	})
+	return nil
+}
+
+// ApplyMembership applies a lifecycle event announced by a peer
+func (nl *NodeLifecycle) ApplyMembership(ev MembershipEvent) error {
+	if ev.Node == "" {
+		return errors.New("node is required")
+	}
+	if ev.Node == nl.self {
+		return nil
+	}
+
+	nl.mu.RLock()
+	fm := nl.failover
+	nl.mu.RUnlock()
+
+	nodes := nl.members.GetNodes()
+	switch ev.State {
+	case MemberJoining:
+		nl.members.UpdateNodes(union(nodes, []string{ev.Node}))
+	case MemberJoined:
+		nl.members.UpdateNodes(union(nodes, []string{ev.Node}))
+		if fm != nil {
+			fm.ClearLeaving(ev.Node)
+		}
+	case MemberLeaving:
+		if fm != nil {
+			fm.MarkLeaving(ev.Node)
+		}
+	case MemberLeft:
+		nl.members.UpdateNodes(without(nodes, ev.Node))
+	case MemberReplaced:
+		if ev.Replaces == "" {
+			return errors.New("replaces is required")
+		}
+		identity := ev.Replaces
+		if id, ok := nl.rebalancer.TokenIdentities()[ev.Replaces]; ok {
+			identity = id
+		}
+		nl.rebalancer.SetTokenIdentity(ev.Node, identity)
+		nl.rebalancer.SetTokenIdentity(ev.Replaces, "")
+		nl.members.UpdateNodes(union(without(nodes, ev.Replaces), []string{ev.Node}))
+	default:
+		return fmt.Errorf("unknown membership state: %s", ev.State)
+	}
+
+	log.Printf("Membership: %s is %s", ev.Node, ev.State)
+	return nil
+}
+
+// begin registers a new job if no other job runs and the node is in one of
+// the allowed states
+func (nl *NodeLifecycle) begin(op LifecycleOperation, replaces string, state LocalNodeState, allowed ...LocalNodeState) (*LifecycleJob, error) {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+
+	if nl.job != nil && nl.job.State == LifecycleRunning {
+		return nil, ErrLifecycleInProgress
+	}
+	if !containsState(allowed, nl.state) {
+		return nil, ErrInvalidNodeState
+	}
+
+	nl.state = state
+	nl.job = &LifecycleJob{
+		Operation: op,
+		Node:      nl.self,
+		Replaces:  replaces,
+		State:     LifecycleRunning,
+		Phase:     "announcing",
+		StartedAt: time.Now(),
+	}
+	nl.done = make(chan struct{})
+	log.Printf("Lifecycle: %s of %s started", op, nl.self)
+	return nl.job, nil
+}
+
+// finish runs the workflow and records its outcome
+func (nl *NodeLifecycle) finish(job *LifecycleJob, successState, failureState LocalNodeState, workflow func() error) {
+	err := workflow()
+
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+
+	job.FinishedAt = time.Now()
+	if err != nil {
+		job.State = LifecycleFailed
+		job.Error = err.Error()
+		nl.state = failureState
+	} else {
+		job.State = LifecycleCompleted
+		job.Phase = "done"
+		nl.state = successState
+	}
+
+	nl.history = append(nl.history, *job)
+	if len(nl.history) > maxLifecycleHistory {
+		nl.history = nl.history[len(nl.history)-maxLifecycleHistory:]
+	}
+	close(nl.done)
+	log.Printf("Lifecycle: %s of %s %s (%d keys)", job.Operation, job.Node, job.State, job.Keys)
+}
+
+func (nl *NodeLifecycle) setPhase(phase string) {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	nl.job.Phase = phase
+}
+
+// pullRanges copies the given ranges to the local store. With merge set every
+// source is read, otherwise the first source that succeeds is used.
+func (nl *NodeLifecycle) pullRanges(movements []RangeMovement, sourcesFor func(RangeMovement) []string, merge bool) error {
+	nl.mu.Lock()
+	nl.job.TotalRanges = len(movements)
+	nl.mu.Unlock()
+
+	for _, m := range movements {
+		pulled := false
+		var lastErr error
+		for _, source := range sourcesFor(m) {
+			if err := nl.pullRange(m.Range, source); err != nil {
+				log.Printf("Lifecycle: pulling %s from %s failed: %v", m.Range, source, err)
+				lastErr = err
+				continue
+			}
+			pulled = true
+			if !merge {
+				break
+			}
+		}
+		if !pulled {
+			return fmt.Errorf("range %s: no source available: %v", m.Range, lastErr)
+		}
+
+		nl.mu.Lock()
+		nl.job.CompletedRanges++
+		nl.mu.Unlock()
+	}
+	return nil
+}
+
+// pullRange copies a range from one source page by page. Every page is
+// verified against the source's checksum and re-fetched on mismatch.
+func (nl *NodeLifecycle) pullRange(tr TokenRange, source string) error {
+	opts := nl.rebalancer.options()
+	ctx := context.Background()
+
+	after := ""
+	for {
+		var (
+			items []storage.KeyValue
+			next  string
+			err   error
+		)
+		verified := false
+		for attempt := 0; attempt <= opts.VerifyRetries; attempt++ {
+			items, next, err = nl.fetchRange(ctx, source, tr, after, opts.BatchSize)
+			if err != nil {
+				return err
+			}
+			for _, kv := range items {
+				if err := nl.store.Set(kv.Key, kv.Value); err != nil {
+					return err
+				}
+			}
+
+			keys := batchKeys(items)
+			remote, err := nl.rebalancer.remoteChecksum(ctx, source, keys)
+			if err != nil {
+				return err
+			}
+			if remote == ChecksumKeyValues(nl.rebalancer.readBatch(keys)) {
+				verified = true
+				break
+			}
+		}
+		if !verified {
+			return fmt.Errorf("checksum mismatch after %d attempts", opts.VerifyRetries+1)
+		}
+
+		nl.mu.Lock()
+		nl.job.Keys += len(items)
+		nl.mu.Unlock()
+
+		if next == "" {
+			return nil
+		}
+		after = next
+	}
+}
+
+func (nl *NodeLifecycle) fetchRange(ctx context.Context, source string, tr TokenRange, after string, limit int) ([]storage.KeyValue, string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"start": tr.Start,
+		"end":   tr.End,
+		"after": after,
+		"limit": limit,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	url := internode.URL(source, "/internal/range")
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := nl.httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("range request failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Items []storage.KeyValue `json:"items"`
+		Next  string             `json:"next"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+	return result.Items, result.Next, nil
+}
+
+// announce sends a membership event to the given peers. Unreachable peers are
+// logged and skipped; they pick up the change from the node list later.
+func (nl *NodeLifecycle) announce(ev MembershipEvent, peers []string) {
+	body, _ := json.Marshal(ev)
+	for _, peer := range peers {
+		url := internode.URL(peer, "/internal/membership")
+		resp, err := nl.httpClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Lifecycle: announcing %s to %s failed: %v", ev.State, peer, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Lifecycle: %s rejected %s announcement: %s", peer, ev.State, resp.Status)
+		}
+	}
+}
+
+// ItemsInRange returns up to limit items whose token falls into the range,
+// ordered by key and starting after the given key. The second result is the
+// key to continue from, empty when the range is exhausted.
+func ItemsInRange(items []storage.KeyValue, tr TokenRange, after string, limit int) ([]storage.KeyValue, string) {
+	var matched []storage.KeyValue
+	for _, kv := range items {
+		if kv.Key > after && tr.Contains(KeyToken(kv.Key)) {
+			matched = append(matched, kv)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Key < matched[j].Key })
+
+	if limit <= 0 || len(matched) <= limit {
+		return matched, ""
+	}
+	return matched[:limit], matched[limit-1].Key
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func containsState(states []LocalNodeState, state LocalNodeState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns nodes minus node, preserving order
+func without(nodes []string, node string) []string {
+	result := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		if n != node {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// union returns the nodes of a followed by the nodes of b not in a
+func union(a, b []string) []string {
+	result := append([]string{}, a...)
+	for _, n := range b {
+		if n != "" && !contains(result, n) {
+			result = append(result, n)
+		}
+	}
+	return result
+}
@@ -0,0 +1,300 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"distore/storage"
+)
+
+type testMembers struct {
+	mu    sync.Mutex
+	nodes []string
+}
+
+func (m *testMembers) GetNodes() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.nodes...)
+}
+
+func (m *testMembers) UpdateNodes(nodes []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodes = append([]string{}, nodes...)
+}
+
+type lifecycleTestNode struct {
+	addr      string
+	store     storage.Storage
+	members   *testMembers
+	lifecycle *NodeLifecycle
+	server    *httptest.Server
+}
+
+// newLifecycleTestNode starts a node serving the internal endpoints used by
+// the lifecycle workflows
+func newLifecycleTestNode(t *testing.T) *lifecycleTestNode {
+	node := &lifecycleTestNode{store: storage.NewMemoryStorage(), members: &testMembers{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/internal/batch_set", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Items []storage.KeyValue `json:"items"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		for _, kv := range req.Items {
+			_ = node.store.Set(kv.Key, kv.Value)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/internal/checksum", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Keys []string `json:"keys"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var items []storage.KeyValue
+		for _, key := range req.Keys {
+			if v, err := node.store.Get(key); err == nil {
+				items = append(items, storage.KeyValue{Key: key, Value: v})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]string{"checksum": ChecksumKeyValues(items)})
+	})
+	mux.HandleFunc("/internal/range", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Start uint32 `json:"start"`
+			End   uint32 `json:"end"`
+			After string `json:"after"`
+			Limit int    `json:"limit"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		items, _ := node.store.GetAll()
+		page, next := ItemsInRange(items, TokenRange{Start: req.Start, End: req.End}, req.After, req.Limit)
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": page, "next": next})
+	})
+	mux.HandleFunc("/internal/membership", func(w http.ResponseWriter, r *http.Request) {
+		var ev MembershipEvent
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		if err := node.lifecycle.ApplyMembership(ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	})
+
+	node.server = httptest.NewServer(mux)
+	t.Cleanup(node.server.Close)
+	node.addr = strings.TrimPrefix(node.server.URL, "http://")
+
+	rebalancer := NewRebalancer(node.store, node.members, node.addr)
+	opts := DefaultRebalanceOptions()
+	opts.BatchSize = 7
+	rebalancer.SetOptions(opts)
+	node.lifecycle = NewNodeLifecycle(node.addr, node.store, node.members, rebalancer)
+	return node
+}
+
+func setMembers(nodes ...*lifecycleTestNode) {
+	var addrs []string
+	for _, n := range nodes {
+		addrs = append(addrs, n.addr)
+	}
+	for _, n := range nodes {
+		n.members.UpdateNodes(addrs)
+		n.lifecycle.rebalancer.ResetRing(addrs)
+	}
+}
+
+func TestNodeLifecycle_Decommission(t *testing.T) {
+	a, b, c := newLifecycleTestNode(t), newLifecycleTestNode(t), newLifecycleTestNode(t)
+	setMembers(a, b, c)
+
+	for i := 0; i < 100; i++ {
+		_ = a.store.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+
+	if err := a.lifecycle.Decommission(); err != nil {
+		t.Fatalf("decommission error: %v", err)
+	}
+	if a.lifecycle.State() != LocalNodeLeaving {
+		t.Errorf("expected leaving state while streaming, got %s", a.lifecycle.State())
+	}
+	job := a.lifecycle.Wait()
+	if job.State != LifecycleCompleted {
+		t.Fatalf("expected completed job, got %s (%s)", job.State, job.Error)
+	}
+	if job.Keys != 100 {
+		t.Errorf("expected 100 streamed keys, got %d", job.Keys)
+	}
+
+	ring := NewRing([]string{b.addr, c.addr}, DefaultVirtualNodes)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := b
+		if ring.Owner(key) == c.addr {
+			owner = c
+		}
+		if v, err := owner.store.Get(key); err != nil || v != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("key %s missing on its new owner", key)
+		}
+	}
+	if items, _ := a.store.GetAll(); len(items) != 0 {
+		t.Errorf("decommissioned node still holds %d keys", len(items))
+	}
+
+	if a.lifecycle.State() != LocalNodeDecommissioned || a.lifecycle.AcceptingWrites() {
+		t.Error("node should be decommissioned and reject writes")
+	}
+	for _, peer := range []*lifecycleTestNode{b, c} {
+		if contains(peer.members.GetNodes(), a.addr) {
+			t.Errorf("peer %s still lists the decommissioned node", peer.addr)
+		}
+	}
+
+	if err := a.lifecycle.Decommission(); err == nil {
+		t.Error("decommissioning twice should fail")
+	}
+}
+
+func TestNodeLifecycle_Bootstrap(t *testing.T) {
+	b, c := newLifecycleTestNode(t), newLifecycleTestNode(t)
+	setMembers(b, c)
+
+	// every key is replicated on both existing nodes
+	for i := 0; i < 100; i++ {
+		key, value := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		_ = b.store.Set(key, value)
+		_ = c.store.Set(key, value)
+	}
+
+	d := newLifecycleTestNode(t)
+	if err := d.lifecycle.Bootstrap([]string{b.addr, c.addr}); err != nil {
+		t.Fatalf("bootstrap error: %v", err)
+	}
+	if d.lifecycle.AcceptingReads() {
+		t.Error("joining node must not serve reads before its data is pulled")
+	}
+	job := d.lifecycle.Wait()
+	if job.State != LifecycleCompleted {
+		t.Fatalf("expected completed job, got %s (%s)", job.State, job.Error)
+	}
+
+	ring := NewRing([]string{b.addr, c.addr, d.addr}, DefaultVirtualNodes)
+	expected := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, err := d.store.Get(key)
+		if ring.Owner(key) == d.addr {
+			expected++
+			if err != nil {
+				t.Fatalf("owned key %s was not pulled", key)
+			}
+		} else if err == nil {
+			t.Fatalf("key %s not owned by the new node was pulled", key)
+		}
+	}
+	if job.Keys != expected {
+		t.Errorf("expected %d pulled keys, got %d", expected, job.Keys)
+	}
+
+	if !d.lifecycle.AcceptingReads() {
+		t.Error("bootstrapped node should serve reads")
+	}
+	for _, n := range []*lifecycleTestNode{b, c, d} {
+		if !contains(n.members.GetNodes(), d.addr) {
+			t.Errorf("%s does not list the new node", n.addr)
+		}
+	}
+}
+
+func TestNodeLifecycle_Replace(t *testing.T) {
+	b, c, dead := newLifecycleTestNode(t), newLifecycleTestNode(t), newLifecycleTestNode(t)
+	setMembers(b, c, dead)
+	deadRing := NewRing([]string{b.addr, c.addr, dead.addr}, DefaultVirtualNodes)
+	dead.server.Close()
+
+	for i := 0; i < 100; i++ {
+		key, value := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		// replicas of the dead node's keys are spread over the survivors
+		if i%2 == 0 {
+			_ = b.store.Set(key, value)
+		} else {
+			_ = c.store.Set(key, value)
+		}
+	}
+
+	d := newLifecycleTestNode(t)
+	d.members.UpdateNodes(b.members.GetNodes())
+
+	if err := d.lifecycle.Replace("unknown:1", true); err != ErrUnknownNode {
+		t.Errorf("expected ErrUnknownNode, got %v", err)
+	}
+	if err := d.lifecycle.Replace(dead.addr, true); err != nil {
+		t.Fatalf("replace error: %v", err)
+	}
+	job := d.lifecycle.Wait()
+	if job.State != LifecycleCompleted {
+		t.Fatalf("expected completed job, got %s (%s)", job.State, job.Error)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, err := d.store.Get(key)
+		if deadRing.Owner(key) == dead.addr && err != nil {
+			t.Fatalf("key %s of the dead node was not recovered", key)
+		}
+		if deadRing.Owner(key) != dead.addr && err == nil {
+			t.Fatalf("key %s not owned by the dead node was pulled", key)
+		}
+	}
+
+	// the replacement owns exactly the dead node's ranges on every node
+	for _, n := range []*lifecycleTestNode{b, d} {
+		nodes := n.members.GetNodes()
+		if contains(nodes, dead.addr) || !contains(nodes, d.addr) {
+			t.Fatalf("%s has unexpected members %v", n.addr, nodes)
+		}
+		ring := n.lifecycle.rebalancer.BuildRing(nodes)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			want := deadRing.Owner(key)
+			if want == dead.addr {
+				want = d.addr
+			}
+			if got := ring.Owner(key); got != want {
+				t.Fatalf("%s: key %s owned by %s, want %s", n.addr, key, got, want)
+			}
+		}
+	}
+}
+
+func TestItemsInRange(t *testing.T) {
+	var items []storage.KeyValue
+	for i := 0; i < 50; i++ {
+		items = append(items, storage.KeyValue{Key: fmt.Sprintf("k%02d", i), Value: "v"})
+	}
+	whole := TokenRange{Start: 0, End: 0}
+
+	var all []storage.KeyValue
+	after := ""
+	for {
+		page, next := ItemsInRange(items, whole, after, 20)
+		all = append(all, page...)
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	if len(all) != 50 {
+		t.Fatalf("expected 50 items over all pages, got %d", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1].Key >= all[i].Key {
+			t.Fatal("pages should be ordered by key without duplicates")
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"distore/auth"
+	"distore/config"
+	"distore/internode"
+)
+
+// MetadataFormat is the version of the ClusterMetadata document layout
+const MetadataFormat = 1
+
+// ClusterMetadata is the topology and settings every node must agree on.
+// Each change bumps Version; between two documents the higher version wins,
+// ties going to the higher UpdatedBy so that all nodes pick the same one.
+type ClusterMetadata struct {
+	Format        int                     `json:"format"`
+	Version       uint64                  `json:"version"`
+	SchemaVersion uint64                  `json:"schema_version"` // bumped when keyspaces change
+	Members       []string                `json:"members"`
+	ReplicaCount  int                     `json:"replica_count"`
+	TokenIDs      map[string]string       `json:"token_ids,omitempty"` // node -> identity its ring tokens derive from
+	Keyspaces     []config.KeyspaceConfig `json:"keyspaces,omitempty"`
+	Auth          auth.IdentityState      `json:"auth"`                   // identities and revoked tokens
+	SigningKeys   map[string][]auth.JWK   `json:"signing_keys,omitempty"` // node -> public keys its tokens verify with
+	UpdatedBy     string                  `json:"updated_by,omitempty"`
+	UpdatedAt     time.Time               `json:"updated_at"`
+}
+
+// newerThan tells whether m should replace other
+func (m ClusterMetadata) newerThan(other ClusterMetadata) bool {
+	if m.Version != other.Version {
+		return m.Version > other.Version
+	}
+	return m.UpdatedBy > other.UpdatedBy
+}
+
+// clone deep-copies m, storing empty lists as nil so that copies compare equal
+func (m ClusterMetadata) clone() ClusterMetadata {
+	c := m
+	c.Members = append([]string(nil), m.Members...)
+	c.TokenIDs = nil
+	if len(m.TokenIDs) > 0 {
+		c.TokenIDs = make(map[string]string, len(m.TokenIDs))
+		for node, id := range m.TokenIDs {
+			c.TokenIDs[node] = id
+		}
+	}
+	c.Keyspaces = append([]config.KeyspaceConfig(nil), m.Keyspaces...)
+	c.Auth = m.Auth.Clone()
+	c.SigningKeys = nil
+	if len(m.SigningKeys) > 0 {
+		c.SigningKeys = make(map[string][]auth.JWK, len(m.SigningKeys))
+		for node, keys := range m.SigningKeys {
+			c.SigningKeys[node] = append([]auth.JWK(nil), keys...)
+		}
+	}
+	return c
+}
+
+// MetadataOptions tune persistence and propagation
+type MetadataOptions struct {
+	Path         string        // file the metadata is persisted to, empty keeps it in memory
+	SyncInterval time.Duration // anti-entropy exchange with a random peer
+	Timeout      time.Duration // per request to a peer
+	// TrustPeers is set when nodes authenticate each other with internode
+	// mTLS or service tokens. Only then are signing keys taken from peers,
+	// as anyone could otherwise forge tokens.
+	TrustPeers bool
+	// ShareIdentities is set with internode TLS. Identities carry credential
+	// hashes, so they are only exchanged with authenticated peers over
+	// encrypted connections.
+	ShareIdentities bool
+}
+
+func DefaultMetadataOptions() MetadataOptions {
+	return MetadataOptions{
+		SyncInterval: 10 * time.Second,
+		Timeout:      2 * time.Second,
+	}
+}
+
+// MetadataStore holds the cluster metadata of this node. Local changes are
+// persisted and pushed to all members; a periodic push-pull with a random
+// peer repairs nodes that missed an update.
+type MetadataStore struct {
+	mu         sync.RWMutex
+	self       string
+	opts       MetadataOptions
+	meta       ClusterMetadata
+	listeners  []func(ClusterMetadata)
+	notifyMu   sync.Mutex // keeps listeners from seeing versions out of order
+	httpClient *http.Client
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewMetadataStore loads the persisted metadata. Without a persisted copy the
+// store starts at version 0 from seed, so that any copy held by a peer wins.
+func NewMetadataStore(self string, seed ClusterMetadata, opts MetadataOptions) (*MetadataStore, error) {
+	defaults := DefaultMetadataOptions()
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaults.SyncInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaults.Timeout
+	}
+
+	s := &MetadataStore{
+		self:       self,
+		opts:       opts,
+		httpClient: internode.NewClient(opts.Timeout),
+	}
+
+	seed = seed.clone()
+	seed.Format = MetadataFormat
+	seed.Version = 0
+	s.meta = seed
+
+	if opts.Path != "" {
+		data, err := os.ReadFile(opts.Path)
+		switch {
+		case err == nil:
+			var stored ClusterMetadata
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return nil, fmt.Errorf("reading cluster metadata %s: %w", opts.Path, err)
+			}
+			if stored.Format > MetadataFormat {
+				return nil, fmt.Errorf("cluster metadata %s has format %d, this node reads up to %d", opts.Path, stored.Format, MetadataFormat)
+			}
+			s.meta = stored.clone()
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Get returns a copy of the current metadata
+func (s *MetadataStore) Get() ClusterMetadata {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.meta.clone()
+}
+
+// OnChange registers fn to run after every change, local or received. It is
+// called once right away with the current metadata.
+func (s *MetadataStore) OnChange(fn func(ClusterMetadata)) {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+
+	s.mu.Lock()
+	s.listeners = append(s.listeners, fn)
+	meta := s.meta.clone()
+	s.mu.Unlock()
+	fn(meta)
+}
+
+// Update applies change to a copy of the metadata, then persists and
+// propagates the result under a new version
+func (s *MetadataStore) Update(change func(*ClusterMetadata) error) (ClusterMetadata, error) {
+	s.mu.Lock()
+	next := s.meta.clone()
+	if err := change(&next); err != nil {
+		s.mu.Unlock()
+		return ClusterMetadata{}, err
+	}
+	next = next.clone()
+	if reflect.DeepEqual(next, s.meta) {
+		s.mu.Unlock()
+		return next, nil
+	}
+
+	if !reflect.DeepEqual(next.Keyspaces, s.meta.Keyspaces) {
+		next.SchemaVersion++
+	}
+	next.Format = MetadataFormat
+	next.Version = s.meta.Version + 1
+	next.UpdatedBy = s.self
+	next.UpdatedAt = time.Now().UTC()
+	peers := union(s.peersLocked(), next.Members) // removed members learn about it too
+	if err := s.setLocked(next); err != nil {
+		s.mu.Unlock()
+		return ClusterMetadata{}, err
+	}
+	s.mu.Unlock()
+
+	s.notify()
+	go s.broadcast(next, without(peers, s.self))
+	return next.clone(), nil
+}
+
+// Merge adopts remote if it is newer than the local copy, reporting whether
+// it did
+func (s *MetadataStore) Merge(remote ClusterMetadata) (bool, error) {
+	if remote.Format < 1 || remote.Format > MetadataFormat {
+		return false, fmt.Errorf("metadata format %d is not supported", remote.Format)
+	}
+	// The schema version is only bumped along with the version
+	if remote.SchemaVersion > remote.Version {
+		return false, fmt.Errorf("metadata schema version %d is ahead of version %d", remote.SchemaVersion, remote.Version)
+	}
+
+	s.mu.Lock()
+	if !remote.newerThan(s.meta) {
+		s.mu.Unlock()
+		return false, nil
+	}
+	if !s.opts.TrustPeers {
+		remote.SigningKeys = s.meta.SigningKeys
+	}
+	if !s.opts.TrustPeers || !s.opts.ShareIdentities {
+		remote.Auth = s.meta.Auth
+	}
+	remote = remote.clone()
+	if err := s.setLocked(remote); err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	s.mu.Unlock()
+
+	log.Printf("Cluster metadata: adopted version %d from %s", remote.Version, remote.UpdatedBy)
+	s.notify()
+	return true, nil
+}
+
+// Shared returns the metadata as sent to peers
+func (s *MetadataStore) Shared() ClusterMetadata {
+	return s.shared(s.Get())
+}
+
+// shared strips from meta what peers must not see unless identities are
+// shared: credential hashes and revoked tokens
+func (s *MetadataStore) shared(meta ClusterMetadata) ClusterMetadata {
+	if !s.opts.TrustPeers || !s.opts.ShareIdentities {
+		meta.Auth = auth.IdentityState{}
+	}
+	return meta
+}
+
+// setLocked persists and installs meta
+func (s *MetadataStore) setLocked(meta ClusterMetadata) error {
+	if s.opts.Path != "" {
+		if err := writeFileAtomic(s.opts.Path, meta); err != nil {
+			return fmt.Errorf("persisting cluster metadata: %w", err)
+		}
+	}
+	s.meta = meta
+	return nil
+}
+
+// notify hands the latest metadata to the listeners
+func (s *MetadataStore) notify() {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+
+	s.mu.RLock()
+	meta := s.meta.clone()
+	listeners := append([]func(ClusterMetadata){}, s.listeners...)
+	s.mu.RUnlock()
+	for _, fn := range listeners {
+		fn(meta.clone())
+	}
+}
+
+func (s *MetadataStore) peersLocked() []string {
+	return without(s.meta.Members, s.self)
+}
+
+// broadcast pushes meta to peers. Unreachable peers catch up through the
+// periodic sync.
+func (s *MetadataStore) broadcast(meta ClusterMetadata, peers []string) {
+	for _, peer := range peers {
+		if _, err := s.exchange(peer, meta); err != nil {
+			log.Printf("Cluster metadata: pushing version %d to %s failed: %v", meta.Version, peer, err)
+		}
+	}
+}
+
+// exchange sends meta to peer and returns the peer's copy after merging
+func (s *MetadataStore) exchange(peer string, meta ClusterMetadata) (ClusterMetadata, error) {
+	body, err := json.Marshal(s.shared(meta))
+	if err != nil {
+		return ClusterMetadata{}, err
+	}
+	resp, err := s.httpClient.Post(internode.URL(peer, "/internal/metadata"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return ClusterMetadata{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return ClusterMetadata{}, fmt.Errorf("peer returned %s", resp.Status)
+	}
+
+	var theirs ClusterMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&theirs); err != nil {
+		return ClusterMetadata{}, err
+	}
+	return theirs, nil
+}
+
+// SyncWith does one push-pull exchange with peer
+func (s *MetadataStore) SyncWith(peer string) error {
+	theirs, err := s.exchange(peer, s.Get())
+	if err != nil {
+		return err
+	}
+	_, err = s.Merge(theirs)
+	return err
+}
+
+// Start runs the periodic anti-entropy sync
+func (s *MetadataStore) Start() {
+	s.mu.Lock()
+	if s.stopCh != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.stopCh = make(chan struct{})
+	stopCh := s.stopCh
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.opts.SyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				s.mu.RLock()
+				peers := s.peersLocked()
+				s.mu.RUnlock()
+				if len(peers) == 0 {
+					continue
+				}
+				peer := peers[rand.Intn(len(peers))]
+				if err := s.SyncWith(peer); err != nil {
+					log.Printf("Cluster metadata: sync with %s failed: %v", peer, err)
+				}
+			}
+		}
+	}()
+}
+
+func (s *MetadataStore) Stop() {
+	s.mu.Lock()
+	stopCh := s.stopCh
+	s.stopCh = nil
+	s.mu.Unlock()
+	if stopCh != nil {
+		close(stopCh)
+		s.wg.Wait()
+	}
+}
+
+// Membership returns a node list backed by the metadata, for the lifecycle
+// workflows: node list changes are recorded together with the token
+// identities of rebalancer
+func (s *MetadataStore) Membership(rebalancer *Rebalancer) MembershipManager {
+	return &metadataMembership{store: s, rebalancer: rebalancer}
+}
+
+type metadataMembership struct {
+	store      *MetadataStore
+	rebalancer *Rebalancer
+}
+
+func (m *metadataMembership) GetNodes() []string {
+	return m.store.Get().Members
+}
+
+func (m *metadataMembership) UpdateNodes(nodes []string) {
+	_, err := m.store.Update(func(meta *ClusterMetadata) error {
+		meta.Members = append([]string(nil), nodes...)
+		if m.rebalancer != nil {
+			meta.TokenIDs = m.rebalancer.TokenIdentities()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Cluster metadata: recording members failed: %v", err)
+	}
+}
+
+func writeFileAtomic(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,213 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"distore/auth"
+	"distore/config"
+	"distore/storage"
+)
+
+// metadataNode serves /internal/metadata for its store like the API does
+func metadataNode(t *testing.T, seed ClusterMetadata, path string) (*MetadataStore, string) {
+	t.Helper()
+	var store *MetadataStore
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var remote ClusterMetadata
+		if err := json.NewDecoder(r.Body).Decode(&remote); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := store.Merge(remote); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(store.Get())
+	}))
+	t.Cleanup(server.Close)
+
+	addr := strings.TrimPrefix(server.URL, "http://")
+	var err error
+	store, err = NewMetadataStore(addr, seed, MetadataOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, addr
+}
+
+func TestMetadataStore_PersistsVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cluster_metadata.json")
+	seed := ClusterMetadata{Members: []string{"a:1"}, ReplicaCount: 1}
+	store, err := NewMetadataStore("a:1", seed, MetadataOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := store.Update(func(m *ClusterMetadata) error {
+		m.Members = append(m.Members, "b:1")
+		m.Keyspaces = []config.KeyspaceConfig{{Name: "users", Prefixes: []string{"user:"}}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Version != 1 || meta.SchemaVersion != 1 || meta.UpdatedBy != "a:1" {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+
+	// Unchanged content keeps the version
+	if meta, _ := store.Update(func(m *ClusterMetadata) error { return nil }); meta.Version != 1 {
+		t.Errorf("Expected version 1 after a no-op update, got %d", meta.Version)
+	}
+	// Membership changes leave the schema version alone
+	meta, _ = store.Update(func(m *ClusterMetadata) error {
+		m.ReplicaCount = 2
+		return nil
+	})
+	if meta.Version != 2 || meta.SchemaVersion != 1 {
+		t.Errorf("Expected version 2, schema 1, got %d, %d", meta.Version, meta.SchemaVersion)
+	}
+
+	// A restart reads the persisted copy, not the seed
+	reopened, err := NewMetadataStore("a:1", seed, MetadataOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Get(); !reflect.DeepEqual(got, store.Get()) {
+		t.Errorf("Expected %+v after restart, got %+v", store.Get(), got)
+	}
+}
+
+func TestMetadataStore_Merge(t *testing.T) {
+	store, err := NewMetadataStore("b:1", ClusterMetadata{Members: []string{"b:1"}}, MetadataOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []uint64
+	store.OnChange(func(m ClusterMetadata) { seen = append(seen, m.Version) })
+
+	remote := ClusterMetadata{Format: MetadataFormat, Version: 3, Members: []string{"a:1", "b:1"}, UpdatedBy: "a:1"}
+	if adopted, err := store.Merge(remote); err != nil || !adopted {
+		t.Fatalf("Expected newer version to be adopted, got %v, %v", adopted, err)
+	}
+	if adopted, _ := store.Merge(ClusterMetadata{Format: MetadataFormat, Version: 2, UpdatedBy: "z:1"}); adopted {
+		t.Error("Older version must not be adopted")
+	}
+
+	// Same version: the higher updater wins on every node
+	tie := remote
+	tie.Members = []string{"c:1"}
+	tie.UpdatedBy = "c:1"
+	if adopted, _ := store.Merge(tie); !adopted || store.Get().Members[0] != "c:1" {
+		t.Error("Expected tie to go to the higher updater")
+	}
+	tie.UpdatedBy = "a:0"
+	if adopted, _ := store.Merge(tie); adopted {
+		t.Error("Expected tie from a lower updater to be ignored")
+	}
+
+	if _, err := store.Merge(ClusterMetadata{Format: MetadataFormat + 1, Version: 9}); err == nil {
+		t.Error("Expected unknown format to be rejected")
+	}
+	if _, err := store.Merge(ClusterMetadata{Version: 9, UpdatedBy: "z:1"}); err == nil {
+		t.Error("Expected a document without format to be rejected")
+	}
+	if _, err := store.Merge(ClusterMetadata{Format: MetadataFormat, Version: 9, SchemaVersion: 10}); err == nil {
+		t.Error("Expected a schema version ahead of the version to be rejected")
+	}
+	if !reflect.DeepEqual(seen, []uint64{0, 3, 3}) {
+		t.Errorf("Expected listeners to see versions 0, 3, 3, got %v", seen)
+	}
+}
+
+func TestMetadataStore_CredentialsNeedTrustedPeers(t *testing.T) {
+	local := auth.IdentityState{Identities: []auth.Identity{{ID: "app", Kind: "user", SecretHash: "hash"}}}
+	remote := ClusterMetadata{
+		Format: MetadataFormat, Version: 5, UpdatedBy: "a:1", Members: []string{"a:1", "b:1"},
+		Auth:        auth.IdentityState{Identities: []auth.Identity{{ID: "intruder", Kind: "user", TenantID: "*", Roles: []string{"admin"}}}},
+		SigningKeys: map[string][]auth.JWK{"a:1": {{Kid: "forged", Kty: "OKP"}}},
+	}
+
+	// Signing keys need authenticated peers, identities need TLS as well
+	for _, opts := range []MetadataOptions{{}, {TrustPeers: true}, {TrustPeers: true, ShareIdentities: true}} {
+		trusted, shared := opts.TrustPeers, opts.ShareIdentities
+		store, err := NewMetadataStore("b:1", ClusterMetadata{Members: []string{"b:1"}}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Update(func(m *ClusterMetadata) error {
+			m.Auth = local
+			return nil
+		})
+		if got := store.Shared().Auth; shared != (len(got.Identities) == 1) {
+			t.Errorf("%+v: unexpected identities shared with peers %+v", opts, got)
+		}
+
+		if adopted, err := store.Merge(remote); err != nil || !adopted {
+			t.Fatalf("%+v: expected the members to be adopted, got %v %v", opts, adopted, err)
+		}
+		meta := store.Get()
+		if len(meta.Members) != 2 {
+			t.Errorf("%+v: expected the remote members, got %v", opts, meta.Members)
+		}
+		if got := meta.Auth.Identities[0].ID; shared != (got == "intruder") {
+			t.Errorf("%+v: unexpected identity %s after the merge", opts, got)
+		}
+		if trusted != (len(meta.SigningKeys["a:1"]) == 1) {
+			t.Errorf("%+v: unexpected signing keys %v after the merge", opts, meta.SigningKeys)
+		}
+	}
+}
+
+func TestMetadataStore_Propagates(t *testing.T) {
+	storeA, addrA := metadataNode(t, ClusterMetadata{}, "")
+	storeB, addrB := metadataNode(t, ClusterMetadata{}, "")
+
+	// Updates are pushed to the members
+	if _, err := storeA.Update(func(m *ClusterMetadata) error {
+		m.Members = []string{addrA, addrB}
+		m.ReplicaCount = 2
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, func() bool { return storeB.Get().Version == 1 })
+	if got := storeB.Get(); got.ReplicaCount != 2 || len(got.Members) != 2 {
+		t.Errorf("Unexpected metadata on peer %+v", got)
+	}
+
+	// A node that missed updates catches up through a sync
+	storeC, _ := metadataNode(t, ClusterMetadata{}, "")
+	if err := storeC.SyncWith(addrA); err != nil {
+		t.Fatal(err)
+	}
+	if storeC.Get().Version != 1 {
+		t.Errorf("Expected version 1 after sync, got %d", storeC.Get().Version)
+	}
+}
+
+func TestMetadataStore_Membership(t *testing.T) {
+	store, err := NewMetadataStore("a:1", ClusterMetadata{Members: []string{"a:1"}}, MetadataOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebalancer := NewRebalancer(storage.NewMemoryStorage(), mockNodeLister{nodes: []string{"a:1"}}, "a:1")
+	rebalancer.SetTokenIdentity("c:1", "b:1")
+
+	members := store.Membership(rebalancer)
+	members.UpdateNodes([]string{"a:1", "c:1"})
+
+	if got := members.GetNodes(); !reflect.DeepEqual(got, []string{"a:1", "c:1"}) {
+		t.Errorf("Unexpected members %v", got)
+	}
+	if ids := store.Get().TokenIDs; ids["c:1"] != "b:1" {
+		t.Errorf("Expected token identity of c:1 to be recorded, got %v", ids)
+	}
+}
@@ -0,0 +1,182 @@
+package cluster
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"distore/config"
+)
+
+// FailureDetectorConfig configures the phi accrual failure detector
+type FailureDetectorConfig struct {
+	PhiThreshold             float64       // phi at which a node is considered down
+	SuspectThreshold         float64       // phi at which a node is considered suspect
+	MaxSampleSize            int           // number of heartbeat intervals kept in history
+	MinStdDeviation          time.Duration // lower bound for the interval standard deviation
+	AcceptableHeartbeatPause time.Duration // extra pause tolerated before phi starts growing
+	RecoveryProbes           int           // consecutive successful probes required to leave down state
+}
+
+// DefaultFailureDetectorConfig returns detector settings suitable for the given probe interval
+func DefaultFailureDetectorConfig(checkInterval time.Duration) FailureDetectorConfig {
+	return FailureDetectorConfig{
+		PhiThreshold:             8.0,
+		SuspectThreshold:         3.0,
+		MaxSampleSize:            200,
+		MinStdDeviation:          checkInterval / 4,
+		AcceptableHeartbeatPause: 0,
+		RecoveryProbes:           2,
+	}
+}
+
+// FailureDetectorConfigFromConfig builds detector settings from the failover
+// section of the config, falling back to defaults for unset values
+func FailureDetectorConfigFromConfig(cfg config.FailoverConfig, checkInterval time.Duration) FailureDetectorConfig {
+	fdc := DefaultFailureDetectorConfig(checkInterval)
+	if cfg.PhiThreshold > 0 {
+		fdc.PhiThreshold = cfg.PhiThreshold
+	}
+	if cfg.SuspectPhiThreshold > 0 {
+		fdc.SuspectThreshold = cfg.SuspectPhiThreshold
+	}
+	if cfg.MaxSampleSize > 0 {
+		fdc.MaxSampleSize = cfg.MaxSampleSize
+	}
+	if cfg.MinStdDeviationMs > 0 {
+		fdc.MinStdDeviation = time.Duration(cfg.MinStdDeviationMs) * time.Millisecond
+	}
+	if cfg.AcceptableHeartbeatPauseMs > 0 {
+		fdc.AcceptableHeartbeatPause = time.Duration(cfg.AcceptableHeartbeatPauseMs) * time.Millisecond
+	}
+	if cfg.RecoveryProbes > 0 {
+		fdc.RecoveryProbes = cfg.RecoveryProbes
+	}
+	return fdc
+}
+
+// PhiAccrualDetector implements the phi accrual failure detector
+// (Hayashibara et al.) over the history of heartbeat inter-arrival times
+type PhiAccrualDetector struct {
+	mu            sync.Mutex
+	cfg           FailureDetectorConfig
+	firstInterval time.Duration
+	intervals     []float64 // in milliseconds, ring buffer
+	next          int
+	lastHeartbeat time.Time
+}
+
+// NewPhiAccrualDetector creates a detector. firstInterval seeds the history
+// so that a node with a single heartbeat already has an estimate.
+func NewPhiAccrualDetector(cfg FailureDetectorConfig, firstInterval time.Duration) *PhiAccrualDetector {
+	if cfg.MaxSampleSize <= 0 {
+		cfg.MaxSampleSize = 200
+	}
+	return &PhiAccrualDetector{
+		cfg:           cfg,
+		firstInterval: firstInterval,
+		intervals:     make([]float64, 0, cfg.MaxSampleSize),
+	}
+}
+
+// Heartbeat records a heartbeat arrival
+func (d *PhiAccrualDetector) Heartbeat(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.lastHeartbeat.IsZero() {
+		// Seed the history with the expected interval (mean +/- stddev)
+		mean := float64(d.firstInterval.Milliseconds())
+		stdDev := mean / 4
+		d.addInterval(mean - stdDev)
+		d.addInterval(mean + stdDev)
+	} else {
+		d.addInterval(float64(now.Sub(d.lastHeartbeat).Milliseconds()))
+	}
+	d.lastHeartbeat = now
+}
+
+func (d *PhiAccrualDetector) addInterval(interval float64) {
+	if len(d.intervals) < d.cfg.MaxSampleSize {
+		d.intervals = append(d.intervals, interval)
+		return
+	}
+	d.intervals[d.next] = interval
+	d.next = (d.next + 1) % d.cfg.MaxSampleSize
+}
+
+// HasHistory reports whether at least one heartbeat has been recorded
+func (d *PhiAccrualDetector) HasHistory() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.lastHeartbeat.IsZero()
+}
+
+// LastHeartbeat returns the time of the last recorded heartbeat
+func (d *PhiAccrualDetector) LastHeartbeat() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastHeartbeat
+}
+
+// Phi returns the suspicion level at the given time. Zero means no history.
+func (d *PhiAccrualDetector) Phi(now time.Time) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.lastHeartbeat.IsZero() || len(d.intervals) == 0 {
+		return 0
+	}
+
+	mean, stdDev := d.stats()
+	mean += float64(d.cfg.AcceptableHeartbeatPause.Milliseconds())
+	elapsed := float64(now.Sub(d.lastHeartbeat).Milliseconds())
+
+	return phi(elapsed, mean, stdDev)
+}
+
+func (d *PhiAccrualDetector) stats() (mean, stdDev float64) {
+	for _, v := range d.intervals {
+		mean += v
+	}
+	mean /= float64(len(d.intervals))
+
+	variance := 0.0
+	for _, v := range d.intervals {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(len(d.intervals))
+	stdDev = math.Sqrt(variance)
+
+	minStdDev := float64(d.cfg.MinStdDeviation.Milliseconds())
+	if stdDev < minStdDev {
+		stdDev = minStdDev
+	}
+	if stdDev <= 0 {
+		stdDev = 1
+	}
+	return mean, stdDev
+}
+
+// maxPhi caps the suspicion level so it stays finite (and JSON-encodable)
+const maxPhi = 1000.0
+
+// phi uses the logistic approximation of the normal CDF
+func phi(elapsed, mean, stdDev float64) float64 {
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+
+	var p float64
+	if elapsed > mean {
+		p = -math.Log10(e / (1.0 + e))
+	} else {
+		p = -math.Log10(1.0 - 1.0/(1.0+e))
+	}
+	if math.IsInf(p, 1) || math.IsNaN(p) || p > maxPhi {
+		return maxPhi
+	}
+	if p < 0 {
+		return 0
+	}
+	return p
+}
@@ -0,0 +1,122 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPhiAccrualDetector(t *testing.T) {
+	cfg := DefaultFailureDetectorConfig(100 * time.Millisecond)
+
+	t.Run("NoHistory", func(t *testing.T) {
+		d := NewPhiAccrualDetector(cfg, 100*time.Millisecond)
+		if d.HasHistory() {
+			t.Error("New detector should have no history")
+		}
+		if phi := d.Phi(time.Now()); phi != 0 {
+			t.Errorf("Expected phi 0 without history, got %f", phi)
+		}
+	})
+
+	t.Run("PhiGrowsWithSilence", func(t *testing.T) {
+		d := NewPhiAccrualDetector(cfg, 100*time.Millisecond)
+		start := time.Now()
+		for i := 0; i < 10; i++ {
+			d.Heartbeat(start.Add(time.Duration(i) * 100 * time.Millisecond))
+		}
+		last := start.Add(900 * time.Millisecond)
+
+		onTime := d.Phi(last.Add(100 * time.Millisecond))
+		late := d.Phi(last.Add(300 * time.Millisecond))
+		veryLate := d.Phi(last.Add(2 * time.Second))
+
+		if onTime >= cfg.SuspectThreshold {
+			t.Errorf("On-time heartbeat should not be suspect, phi=%f", onTime)
+		}
+		if late <= onTime {
+			t.Errorf("Phi should grow with silence: %f <= %f", late, onTime)
+		}
+		if veryLate < cfg.PhiThreshold {
+			t.Errorf("Long silence should exceed threshold, phi=%f", veryLate)
+		}
+	})
+
+	t.Run("AcceptablePauseDelaysSuspicion", func(t *testing.T) {
+		paused := cfg
+		paused.AcceptableHeartbeatPause = time.Second
+
+		d1 := NewPhiAccrualDetector(cfg, 100*time.Millisecond)
+		d2 := NewPhiAccrualDetector(paused, 100*time.Millisecond)
+		now := time.Now()
+		d1.Heartbeat(now)
+		d2.Heartbeat(now)
+
+		at := now.Add(500 * time.Millisecond)
+		if d2.Phi(at) >= d1.Phi(at) {
+			t.Error("Acceptable pause should lower phi")
+		}
+	})
+}
+
+func TestFailoverManager_StateTransitions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	node := server.URL[7:]
+
+	// Long check interval: transitions are driven manually
+	fm := NewFailoverManager([]string{node}, time.Hour, time.Second)
+
+	fm.updateNodeStatus(node, true, time.Millisecond)
+	if state := fm.GetNodeStatus()[node].State; state != NodeStateUp {
+		t.Fatalf("Expected up after successful probe, got %s", state)
+	}
+
+	// A single failed probe right after a heartbeat must not take the node down
+	fm.updateNodeStatus(node, false, 0)
+	status := fm.GetNodeStatus()[node]
+	if status.State == NodeStateDown || !status.Online {
+		t.Fatalf("Single failed probe should not mark node down, got %s", status.State)
+	}
+
+	// Simulate a long silence by moving the last heartbeat back in time
+	fm.mu.Lock()
+	fm.nodeStatus[node].detector.lastHeartbeat = time.Now().Add(-10 * time.Hour)
+	fm.mu.Unlock()
+
+	fm.updateNodeStatus(node, false, 0)
+	if state := fm.GetNodeStatus()[node].State; state != NodeStateDown {
+		t.Fatalf("Expected down after long silence, got %s", state)
+	}
+	if len(fm.GetActiveNodes()) != 0 {
+		t.Error("Down node should not be active")
+	}
+
+	// Recovery requires several consecutive successes
+	fm.updateNodeStatus(node, true, time.Millisecond)
+	if state := fm.GetNodeStatus()[node].State; state != NodeStateDown {
+		t.Fatalf("Expected node to stay down after one success, got %s", state)
+	}
+	fm.updateNodeStatus(node, true, time.Millisecond)
+	if state := fm.GetNodeStatus()[node].State; state != NodeStateUp {
+		t.Fatalf("Expected up after recovery probes, got %s", state)
+	}
+
+	// Leaving is sticky until cleared
+	if !fm.MarkLeaving(node) {
+		t.Fatal("MarkLeaving should succeed for known node")
+	}
+	fm.updateNodeStatus(node, true, time.Millisecond)
+	if got := fm.GetNodesByState(NodeStateLeaving); len(got) != 1 {
+		t.Fatalf("Expected 1 leaving node, got %d", len(got))
+	}
+	if !fm.ClearLeaving(node) {
+		t.Fatal("ClearLeaving should succeed for leaving node")
+	}
+	if state := fm.GetNodeStatus()[node].State; state != NodeStateUp {
+		t.Errorf("Expected up after clearing leaving, got %s", state)
+	}
+}
@@ -0,0 +1,316 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"distore/internode"
+	"distore/storage"
+)
+
+// ReadPolicy decides which replica serves a read
+type ReadPolicy string
+
+const (
+	ReadPolicyLocalDCFirst ReadPolicy = "local_dc_first" // replicas of the local DC, then other DCs by priority
+	ReadPolicyNearest      ReadPolicy = "nearest"        // the replica with the lowest measured latency
+	ReadPolicyEdgeFirst    ReadPolicy = "edge_first"     // edge caches, then the nearest replica
+	ReadPolicyPrimaryOnly  ReadPolicy = "primary_only"   // the primary replica only, no fallback
+)
+
+var (
+	ErrInvalidReadPolicy = errors.New("invalid read policy")
+	ErrNoReadReplica     = errors.New("no replica could serve the read")
+)
+
+// ParseReadPolicy validates a policy name, the empty name is allowed
+func ParseReadPolicy(name string) (ReadPolicy, error) {
+	switch policy := ReadPolicy(name); policy {
+	case "", ReadPolicyLocalDCFirst, ReadPolicyNearest, ReadPolicyEdgeFirst, ReadPolicyPrimaryOnly:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidReadPolicy, name)
+	}
+}
+
+// ReplicaResolver returns the nodes holding a key, primary first
+type ReplicaResolver func(key string) []string
+
+// ReadCandidate is a node a read may be sent to
+type ReadCandidate struct {
+	Node       string        `json:"node"`
+	DataCenter string        `json:"data_center,omitempty"`
+	Latency    time.Duration `json:"latency"`
+	IsEdge     bool          `json:"is_edge"`
+	Available  bool          `json:"available"`
+}
+
+// ReadResult describes where a read was served from
+type ReadResult struct {
+	Value    string     `json:"value"`
+	Node     string     `json:"node"`
+	Policy   ReadPolicy `json:"policy"`
+	Attempts int        `json:"attempts"`
+}
+
+// ReadRouter orders the replicas of a key by locality and reads from the
+// first one that answers, falling back across data centers
+type ReadRouter struct {
+	mu            sync.RWMutex
+	self          string
+	local         storage.Storage
+	crossDC       *CrossDCReplicator
+	failover      *FailoverManager
+	resolve       ReplicaResolver
+	defaultPolicy ReadPolicy
+	httpClient    *http.Client
+}
+
+func NewReadRouter(self string, local storage.Storage, crossDC *CrossDCReplicator, resolve ReplicaResolver) *ReadRouter {
+	return &ReadRouter{
+		self:          self,
+		local:         local,
+		crossDC:       crossDC,
+		resolve:       resolve,
+		defaultPolicy: ReadPolicyLocalDCFirst,
+		httpClient: &http.Client{
+			Timeout:   2 * time.Second,
+			Transport: internode.Wrap(&http.Transport{MaxIdleConnsPerHost: 10}),
+		},
+	}
+}
+
+// SetFailoverManager lets the router skip nodes the failure detector reports down
+func (rr *ReadRouter) SetFailoverManager(fm *FailoverManager) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.failover = fm
+}
+
+// SetDefaultPolicy sets the policy of reads that do not request one
+func (rr *ReadRouter) SetDefaultPolicy(policy ReadPolicy) error {
+	policy, err := ParseReadPolicy(string(policy))
+	if err != nil {
+		return err
+	}
+	if policy == "" {
+		policy = ReadPolicyLocalDCFirst
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.defaultPolicy = policy
+	return nil
+}
+
+// DefaultPolicy returns the policy of reads that do not request one
+func (rr *ReadRouter) DefaultPolicy() ReadPolicy {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	return rr.defaultPolicy
+}
+
+// Candidates returns the nodes a read of key is tried on, in order
+func (rr *ReadRouter) Candidates(key string, policy ReadPolicy) []ReadCandidate {
+	if policy == "" {
+		policy = rr.DefaultPolicy()
+	}
+
+	replicas := rr.resolve(key)
+	if len(replicas) == 0 {
+		return nil
+	}
+	if policy == ReadPolicyPrimaryOnly {
+		return []ReadCandidate{rr.candidate(replicas[0], false)}
+	}
+
+	candidates := make([]ReadCandidate, 0, len(replicas))
+	for _, node := range replicas {
+		candidates = append(candidates, rr.candidate(node, false))
+	}
+
+	localDC := rr.localDataCenter()
+	priorities := rr.dataCenterPriorities()
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		if ci.Available != cj.Available {
+			return ci.Available
+		}
+		if policy == ReadPolicyLocalDCFirst {
+			li, lj := ci.DataCenter == localDC, cj.DataCenter == localDC
+			if li != lj {
+				return li
+			}
+			if pi, pj := priorities[ci.DataCenter], priorities[cj.DataCenter]; pi != pj {
+				return pi < pj
+			}
+		}
+		return ci.Latency < cj.Latency
+	})
+
+	if policy == ReadPolicyEdgeFirst {
+		var edges []ReadCandidate
+		for _, node := range rr.edgeNodes() {
+			edges = append(edges, rr.candidate(node, true))
+		}
+		sort.SliceStable(edges, func(i, j int) bool {
+			if edges[i].Available != edges[j].Available {
+				return edges[i].Available
+			}
+			return edges[i].Latency < edges[j].Latency
+		})
+		candidates = append(edges, candidates...)
+	}
+
+	return candidates
+}
+
+// Read serves a key from the first candidate that has it. Edge caches that
+// miss and unreachable replicas fall through to the next candidate.
+func (rr *ReadRouter) Read(key string, policy ReadPolicy) (ReadResult, error) {
+	if policy == "" {
+		policy = rr.DefaultPolicy()
+	}
+	result := ReadResult{Policy: policy}
+
+	var lastErr error
+	for _, candidate := range rr.Candidates(key, policy) {
+		result.Attempts++
+
+		var value string
+		var err error
+		if candidate.Node == rr.self {
+			value, err = rr.local.Get(key)
+		} else {
+			value, err = rr.readFromNode(key, candidate.Node)
+		}
+
+		if err == nil {
+			result.Value = value
+			result.Node = candidate.Node
+			return result, nil
+		}
+		if err == storage.ErrKeyNotFound && !candidate.IsEdge {
+			// A replica that answers is authoritative
+			result.Node = candidate.Node
+			return result, err
+		}
+		lastErr = err
+	}
+	if lastErr != nil {
+		return result, fmt.Errorf("%w: %v", ErrNoReadReplica, lastErr)
+	}
+	return result, ErrNoReadReplica
+}
+
+func (rr *ReadRouter) readFromNode(key, nodeURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rr.httpClient.Timeout)
+	defer cancel()
+
+	url := internode.URL(nodeURL, "/internal/get/"+key)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := rr.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", storage.ErrKeyNotFound
+	}
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("read from %s failed: %s", nodeURL, resp.Status)
+	}
+
+	var response struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	}
+	return response.Value, nil
+}
+
+// candidate looks up the locality, latency and health of a node
+func (rr *ReadRouter) candidate(node string, isEdge bool) ReadCandidate {
+	c := ReadCandidate{Node: node, IsEdge: isEdge, Available: true}
+
+	rr.crossDC.mu.RLock()
+	for _, dc := range rr.crossDC.dataCenters {
+		if contains(dc.Nodes, node) {
+			c.DataCenter = dc.ID
+			c.Latency = time.Duration(dc.LatencyMs) * time.Millisecond
+		}
+	}
+	for _, edge := range rr.crossDC.edgeNodes {
+		if edge.Node == node {
+			c.Latency = time.Duration(edge.LatencyMs) * time.Millisecond
+		}
+	}
+	if measured, ok := rr.crossDC.nodeLatencies[node]; ok {
+		c.Latency = measured
+	}
+	if rr.crossDC.flaggedNodes[node] {
+		c.Available = false
+	}
+	rr.crossDC.mu.RUnlock()
+
+	if node == rr.self {
+		c.Latency = 0
+		c.Available = true
+		return c
+	}
+
+	rr.mu.RLock()
+	fm := rr.failover
+	rr.mu.RUnlock()
+	if fm != nil {
+		if status, ok := fm.GetNodeStatus()[node]; ok && !status.Online {
+			c.Available = false
+		}
+	}
+	return c
+}
+
+func (rr *ReadRouter) edgeNodes() []string {
+	rr.crossDC.mu.RLock()
+	defer rr.crossDC.mu.RUnlock()
+
+	var nodes []string
+	for _, edge := range rr.crossDC.edgeNodes {
+		if edge.Node != rr.self {
+			nodes = append(nodes, edge.Node)
+		}
+	}
+	return nodes
+}
+
+func (rr *ReadRouter) localDataCenter() string {
+	if dc := rr.crossDC.LocalDataCenter(); dc != "" {
+		return dc
+	}
+	if dc := rr.crossDC.GetDataCenterForNode(rr.self); dc != nil {
+		return dc.ID
+	}
+	return ""
+}
+
+func (rr *ReadRouter) dataCenterPriorities() map[string]int {
+	rr.crossDC.mu.RLock()
+	defer rr.crossDC.mu.RUnlock()
+
+	priorities := make(map[string]int, len(rr.crossDC.dataCenters))
+	for _, dc := range rr.crossDC.dataCenters {
+		priorities[dc.ID] = dc.Priority
+	}
+	return priorities
+}
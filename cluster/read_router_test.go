@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"distore/config"
+	"distore/storage"
+)
+
+// replicaNode serves /internal/get from its own store
+func replicaNode(t *testing.T, store storage.Storage) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/internal/get/")
+		value, err := store.Get(key)
+		if err != nil {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"value": value})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func routerFixture(t *testing.T) (rr *ReadRouter, cdc *CrossDCReplicator, remote, edge, local string) {
+	remoteStore := storage.NewMemoryStorage()
+	remoteStore.Set("k", "remote")
+	edgeStore := storage.NewMemoryStorage()
+	edgeStore.Set("cached", "edge")
+
+	remote = replicaNode(t, remoteStore).URL[7:]
+	edge = replicaNode(t, edgeStore).URL[7:]
+	local = "self:8080"
+
+	cdc = NewCrossDCReplicator(config.MultiCloudConfig{
+		DataCenters: []config.DataCenterConfig{
+			{ID: "eu", Nodes: []string{local}, Priority: 1, LatencyMs: 5},
+			{ID: "us", Nodes: []string{remote}, Priority: 2, LatencyMs: 80},
+		},
+		EdgeNodes: []config.EdgeNodeConfig{{ID: "edge-1", Node: edge, LatencyMs: 1}},
+	})
+
+	localStore := storage.NewMemoryStorage()
+	localStore.Set("k", "local")
+	rr = NewReadRouter(local, localStore, cdc, func(key string) []string {
+		return []string{remote, local}
+	})
+	return rr, cdc, remote, edge, local
+}
+
+func TestReadRouter_Policies(t *testing.T) {
+	rr, cdc, remote, edge, local := routerFixture(t)
+
+	result, err := rr.Read("k", "")
+	if err != nil || result.Node != local || result.Value != "local" || result.Policy != ReadPolicyLocalDCFirst {
+		t.Fatalf("default policy should read locally, got %+v, %v", result, err)
+	}
+
+	result, err = rr.Read("k", ReadPolicyPrimaryOnly)
+	if err != nil || result.Node != remote || result.Value != "remote" {
+		t.Fatalf("primary_only should read from the first replica, got %+v, %v", result, err)
+	}
+
+	// A measured latency below the local node's still loses to self
+	cdc.UpdateLatencyMetrics(remote, time.Millisecond)
+	if c := rr.Candidates("k", ReadPolicyNearest); c[0].Node != local || c[1].Node != remote {
+		t.Fatalf("unexpected nearest order %+v", c)
+	}
+
+	// Edge cache first, a miss falls through to the replicas
+	c := rr.Candidates("cached", ReadPolicyEdgeFirst)
+	if !c[0].IsEdge || c[0].Node != edge || len(c) != 3 {
+		t.Fatalf("unexpected edge_first order %+v", c)
+	}
+	result, err = rr.Read("cached", ReadPolicyEdgeFirst)
+	if err != nil || result.Node != edge || result.Value != "edge" {
+		t.Fatalf("expected edge hit, got %+v, %v", result, err)
+	}
+	result, err = rr.Read("k", ReadPolicyEdgeFirst)
+	if err != nil || result.Node != local || result.Attempts != 2 {
+		t.Fatalf("expected edge miss to fall back, got %+v, %v", result, err)
+	}
+
+	if _, err := ParseReadPolicy("fastest"); !errors.Is(err, ErrInvalidReadPolicy) {
+		t.Errorf("expected invalid policy error, got %v", err)
+	}
+}
+
+func TestReadRouter_FallsBackAcrossDataCenters(t *testing.T) {
+	remoteStore := storage.NewMemoryStorage()
+	remoteStore.Set("k", "remote")
+	remote := replicaNode(t, remoteStore).URL[7:]
+	down := "127.0.0.1:1"
+
+	cdc := NewCrossDCReplicator(config.MultiCloudConfig{
+		DataCenters: []config.DataCenterConfig{
+			{ID: "eu", Nodes: []string{"self:8080", down}, Priority: 1},
+			{ID: "us", Nodes: []string{remote}, Priority: 2},
+		},
+	})
+	rr := NewReadRouter("self:8080", storage.NewMemoryStorage(), cdc, func(key string) []string {
+		return []string{down, remote}
+	})
+
+	// The unreachable local replica is tried first, then the remote DC
+	result, err := rr.Read("k", ReadPolicyLocalDCFirst)
+	if err != nil || result.Node != remote || result.Attempts != 2 {
+		t.Fatalf("expected cross-DC fallback, got %+v, %v", result, err)
+	}
+
+	// Once flagged, the local replica is skipped to the end
+	cdc.SetNodeFlagged(down, true)
+	c := rr.Candidates("k", ReadPolicyLocalDCFirst)
+	if c[0].Node != remote || c[1].Available {
+		t.Fatalf("expected flagged node last, got %+v", c)
+	}
+
+	// primary_only does not fall back
+	if _, err := rr.Read("k", ReadPolicyPrimaryOnly); !errors.Is(err, ErrNoReadReplica) {
+		t.Fatalf("expected primary_only to fail, got %v", err)
+	}
+}
@@ -5,42 +5,192 @@ import (
 	"time"
 )
 
+// ReadOnlyMode is an operator override of the automatic read-only detection
+type ReadOnlyMode string
+
+const (
+	ReadOnlyModeAuto     ReadOnlyMode = "auto"      // follow node health
+	ReadOnlyModeForced   ReadOnlyMode = "read_only" // reject writes regardless of health
+	ReadOnlyModeWritable ReadOnlyMode = "writable"  // accept writes regardless of health
+)
+
 type ReadOnlyManager struct {
 	mu          sync.RWMutex
 	isReadOnly  bool
 	quorumSize  int
 	activeNodes int
 	lastCheck   time.Time
+
+	// Hysteresis: quorum must be lost (or regained) for this long before
+	// the automatic state flips
+	enterAfter   time.Duration
+	exitAfter    time.Duration
+	pendingSince time.Time // when the observed quorum state started disagreeing with isReadOnly
+
+	mode       ReadOnlyMode
+	reason     string
+	changedAt  time.Time
+	retryAfter time.Duration
 }
 
 func NewReadOnlyManager(quorumSize int) *ReadOnlyManager {
 	return &ReadOnlyManager{
 		quorumSize: quorumSize,
 		isReadOnly: false,
+		mode:       ReadOnlyModeAuto,
+		retryAfter: 30 * time.Second,
 	}
 }
 
+// SetHysteresis configures how long quorum must stay lost before entering
+// read-only mode and how long it must stay regained before leaving it
+func (rom *ReadOnlyManager) SetHysteresis(enterAfter, exitAfter time.Duration) {
+	rom.mu.Lock()
+	defer rom.mu.Unlock()
+	rom.enterAfter = enterAfter
+	rom.exitAfter = exitAfter
+}
+
+// SetQuorumSize updates the number of nodes required for writes
+func (rom *ReadOnlyManager) SetQuorumSize(quorumSize int) {
+	rom.mu.Lock()
+	defer rom.mu.Unlock()
+	rom.quorumSize = quorumSize
+}
+
+// SetRetryAfter sets the delay suggested to clients while writes are rejected
+func (rom *ReadOnlyManager) SetRetryAfter(d time.Duration) {
+	rom.mu.Lock()
+	defer rom.mu.Unlock()
+	rom.retryAfter = d
+}
+
 func (rom *ReadOnlyManager) UpdateNodeCount(activeNodes int) {
 	rom.mu.Lock()
 	defer rom.mu.Unlock()
 
+	now := time.Now()
 	rom.activeNodes = activeNodes
-	rom.lastCheck = time.Now()
+	rom.lastCheck = now
 
 	// Включаем read-only mode если нет кворума
-	rom.isReadOnly = activeNodes < rom.quorumSize
+	wantReadOnly := activeNodes < rom.quorumSize
+	if wantReadOnly == rom.isReadOnly {
+		rom.pendingSince = time.Time{}
+		return
+	}
+
+	delay := rom.exitAfter
+	if wantReadOnly {
+		delay = rom.enterAfter
+	}
+
+	if rom.pendingSince.IsZero() {
+		rom.pendingSince = now
+	}
+	if now.Sub(rom.pendingSince) >= delay {
+		rom.isReadOnly = wantReadOnly
+		rom.pendingSince = time.Time{}
+		if rom.mode == ReadOnlyModeAuto {
+			rom.changedAt = now
+		}
+	}
+}
+
+// WatchFailover keeps the read-only state in sync with node health reported
+// by the failover manager. State changes are applied immediately; the periodic
+// re-evaluation lets pending hysteresis transitions complete. The returned
+// function stops watching.
+func (rom *ReadOnlyManager) WatchFailover(fm *FailoverManager) (stop func()) {
+	done := make(chan struct{})
+	fm.OnStatusChange(func(node string, from, to NodeState) {
+		select {
+		case <-done:
+		default:
+			rom.UpdateNodeCount(len(fm.GetActiveNodes()))
+		}
+	})
+
+	go func() {
+		ticker := time.NewTicker(fm.checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				rom.UpdateNodeCount(len(fm.GetActiveNodes()))
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// SetMode overrides automatic detection. ReadOnlyModeAuto clears the override.
+func (rom *ReadOnlyManager) SetMode(mode ReadOnlyMode, reason string) {
+	rom.mu.Lock()
+	defer rom.mu.Unlock()
+
+	rom.mode = mode
+	rom.reason = reason
+	rom.changedAt = time.Now()
+}
+
+// Mode returns the current override mode
+func (rom *ReadOnlyManager) Mode() ReadOnlyMode {
+	rom.mu.RLock()
+	defer rom.mu.RUnlock()
+	return rom.mode
 }
 
 func (rom *ReadOnlyManager) IsReadOnly() bool {
 	rom.mu.RLock()
 	defer rom.mu.RUnlock()
-	return rom.isReadOnly
+	return rom.readOnlyLocked()
+}
+
+func (rom *ReadOnlyManager) readOnlyLocked() bool {
+	switch rom.mode {
+	case ReadOnlyModeForced:
+		return true
+	case ReadOnlyModeWritable:
+		return false
+	default:
+		return rom.isReadOnly
+	}
 }
 
 func (rom *ReadOnlyManager) CanWrite() bool {
 	rom.mu.RLock()
 	defer rom.mu.RUnlock()
-	return !rom.isReadOnly
+	return !rom.readOnlyLocked()
+}
+
+// RetryAfter returns the delay suggested to clients whose writes were rejected
+func (rom *ReadOnlyManager) RetryAfter() time.Duration {
+	rom.mu.RLock()
+	defer rom.mu.RUnlock()
+	return rom.retryAfter
+}
+
+// Reason explains why writes are currently rejected
+func (rom *ReadOnlyManager) Reason() string {
+	rom.mu.RLock()
+	defer rom.mu.RUnlock()
+
+	if rom.mode == ReadOnlyModeForced {
+		if rom.reason != "" {
+			return rom.reason
+		}
+		return "read-only mode forced by operator"
+	}
+	if rom.isReadOnly {
+		return "write quorum lost"
+	}
+	return ""
 }
 
 func (rom *ReadOnlyManager) GetStatus() map[string]interface{} {
@@ -48,9 +198,13 @@ func (rom *ReadOnlyManager) GetStatus() map[string]interface{} {
 	defer rom.mu.RUnlock()
 
 	return map[string]interface{}{
-		"read_only":    rom.isReadOnly,
+		"read_only":    rom.readOnlyLocked(),
 		"active_nodes": rom.activeNodes,
 		"quorum_size":  rom.quorumSize,
 		"last_check":   rom.lastCheck,
+		"mode":         rom.mode,
+		"reason":       rom.reason,
+		"changed_at":   rom.changedAt,
+		"quorum_lost":  rom.isReadOnly,
 	}
 }
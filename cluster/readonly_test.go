@@ -2,6 +2,7 @@ package cluster
 
 import (
 	"testing"
+	"time"
 )
 
 func TestReadOnlyManager(t *testing.T) {
@@ -46,3 +47,89 @@ func TestReadOnlyManager(t *testing.T) {
 		}
 	})
 }
+
+func TestReadOnlyManager_Hysteresis(t *testing.T) {
+	rom := NewReadOnlyManager(2)
+	rom.SetHysteresis(50*time.Millisecond, 50*time.Millisecond)
+
+	rom.UpdateNodeCount(1)
+	if rom.IsReadOnly() {
+		t.Fatal("Should not enter read-only before the enter delay")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	rom.UpdateNodeCount(1)
+	if !rom.IsReadOnly() {
+		t.Fatal("Should enter read-only after quorum stays lost")
+	}
+
+	// A brief recovery does not immediately re-enable writes
+	rom.UpdateNodeCount(2)
+	if rom.CanWrite() {
+		t.Fatal("Should stay read-only before the exit delay")
+	}
+
+	// Flapping back resets the pending transition
+	rom.UpdateNodeCount(1)
+	time.Sleep(60 * time.Millisecond)
+	rom.UpdateNodeCount(2)
+	if rom.CanWrite() {
+		t.Fatal("Pending exit should restart after flapping")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	rom.UpdateNodeCount(2)
+	if !rom.CanWrite() {
+		t.Fatal("Should leave read-only after quorum stays regained")
+	}
+}
+
+func TestReadOnlyManager_Override(t *testing.T) {
+	rom := NewReadOnlyManager(2)
+	rom.UpdateNodeCount(3)
+
+	rom.SetMode(ReadOnlyModeForced, "maintenance")
+	if rom.CanWrite() {
+		t.Error("Forced mode should reject writes")
+	}
+	if rom.Reason() != "maintenance" {
+		t.Errorf("Expected operator reason, got %q", rom.Reason())
+	}
+
+	rom.SetMode(ReadOnlyModeAuto, "")
+	rom.UpdateNodeCount(1)
+	if rom.CanWrite() {
+		t.Error("Auto mode should follow quorum")
+	}
+
+	rom.SetMode(ReadOnlyModeWritable, "")
+	if !rom.CanWrite() {
+		t.Error("Writable mode should accept writes without quorum")
+	}
+}
+
+func TestReadOnlyManager_WatchFailover(t *testing.T) {
+	fm := NewFailoverManager([]string{"a:1", "b:1", "c:1"}, time.Hour, time.Second)
+	rom := NewReadOnlyManager(2)
+	stop := rom.WatchFailover(fm)
+	defer stop()
+
+	// Nodes that never answered go down on their first failed probe
+	fm.updateNodeStatus("a:1", false, 0)
+	if rom.IsReadOnly() {
+		t.Fatal("Two of three nodes are still active")
+	}
+
+	fm.updateNodeStatus("b:1", false, 0)
+	if !rom.IsReadOnly() {
+		t.Fatal("Losing quorum should switch to read-only")
+	}
+
+	// A stopped watch no longer follows node health
+	stop()
+	fm.updateNodeStatus("a:1", true, 0)
+	fm.updateNodeStatus("b:1", true, 0)
+	if !rom.IsReadOnly() {
+		t.Fatal("Expected a stopped watch to ignore status changes")
+	}
+}
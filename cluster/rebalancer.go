@@ -2,91 +2,678 @@ package cluster
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"hash/fnv"
+	"log"
 	"net/http"
+	"net/url"
 	"sort"
 	"sync"
 	"time"
 
+	"distore/internode"
 	"distore/storage"
 )
 
-// Rebalancer provides basic consistent-hashing based key movement when topology changes
 // NodeLister is a minimal interface for listing cluster nodes
 type NodeLister interface {
 	GetNodes() []string
 }
 
+// RebalanceState is the lifecycle state of a rebalance job
+type RebalanceState string
+
+const (
+	RebalanceIdle      RebalanceState = "idle"
+	RebalanceRunning   RebalanceState = "running"
+	RebalancePaused    RebalanceState = "paused"
+	RebalanceCompleted RebalanceState = "completed"
+	RebalanceFailed    RebalanceState = "failed"
+	RebalanceCancelled RebalanceState = "cancelled"
+)
+
+var (
+	ErrRebalanceInProgress = errors.New("rebalance already in progress")
+	ErrNoRebalanceJob      = errors.New("no rebalance job is running")
+)
+
+// RebalanceProgress is a snapshot of the current (or last) rebalance job
+type RebalanceProgress struct {
+	State           RebalanceState  `json:"state"`
+	StartedAt       time.Time       `json:"started_at,omitempty"`
+	FinishedAt      time.Time       `json:"finished_at,omitempty"`
+	Full            bool            `json:"full"`
+	TotalRanges     int             `json:"total_ranges"`
+	CompletedRanges int             `json:"completed_ranges"`
+	TotalKeys       int             `json:"total_keys"`
+	MovedKeys       int             `json:"moved_keys"`
+	BytesSent       int64           `json:"bytes_sent"`
+	VerifyFailures  int             `json:"verify_failures"`
+	CurrentRange    string          `json:"current_range,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	Movements       []RangeMovement `json:"movements,omitempty"`
+}
+
+// RebalanceOptions tune how ranges are streamed
+type RebalanceOptions struct {
+	BatchSize      int   // keys per streamed batch
+	BandwidthLimit int64 // bytes per second, 0 means unlimited
+	VirtualNodes   int   // tokens per node on the ring
+	VerifyRetries  int   // re-sends of a batch whose checksum does not match
+}
+
+// DefaultRebalanceOptions returns the default streaming settings
+func DefaultRebalanceOptions() RebalanceOptions {
+	return RebalanceOptions{
+		BatchSize:      100,
+		BandwidthLimit: 0,
+		VirtualNodes:   DefaultVirtualNodes,
+		VerifyRetries:  3,
+	}
+}
+
+// Rebalancer streams token ranges to their new owners when topology changes
 type Rebalancer struct {
-	mu    sync.RWMutex
-	store storage.Storage
-	nodes NodeLister
-	self  string // this node address, e.g., host:port
+	mu         sync.RWMutex
+	store      storage.Storage
+	nodes      NodeLister
+	self       string // this node address, e.g., host:port
+	opts       RebalanceOptions
+	httpClient *http.Client
+
+	ring     *Ring             // ring the local data was last balanced against
+	tokenIDs map[string]string // node -> identity its tokens are derived from (set by replace)
+	progress RebalanceProgress
+	moving   []RangeMovement // ranges being moved by the running job (double-write targets)
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	pauseMu sync.Mutex
+	paused  bool
+	resume  *sync.Cond
 }
 
 func NewRebalancer(store storage.Storage, nodes NodeLister, self string) *Rebalancer {
-	return &Rebalancer{store: store, nodes: nodes, self: self}
+	r := &Rebalancer{
+		store:      store,
+		nodes:      nodes,
+		self:       self,
+		opts:       DefaultRebalanceOptions(),
+		httpClient: internode.NewClient(10 * time.Second),
+		progress:   RebalanceProgress{State: RebalanceIdle},
+		tokenIDs:   make(map[string]string),
+	}
+	r.resume = sync.NewCond(&r.pauseMu)
+	r.ring = NewRing(nodes.GetNodes(), r.opts.VirtualNodes)
+	return r
 }
 
-// TriggerRebalance moves keys that no longer belong to this node to their new owners
-// It uses a simple consistent hash over node list
-func (r *Rebalancer) TriggerRebalance() (moved int, err error) {
+// SetOptions replaces the streaming options. Changing the number of virtual
+// nodes resets the reference ring.
+func (r *Rebalancer) SetOptions(opts RebalanceOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.VirtualNodes <= 0 {
+		opts.VirtualNodes = DefaultVirtualNodes
+	}
+	if opts.VerifyRetries < 0 {
+		opts.VerifyRetries = 0
+	}
+	if opts.VirtualNodes != r.opts.VirtualNodes {
+		r.ring = NewRingWithTokens(r.ring.Nodes(), opts.VirtualNodes, r.tokenIDs)
+	}
+	r.opts = opts
+}
+
+// SetTokenIdentity makes node own the tokens of identity, so a replacement
+// node takes over exactly the ranges of the node it replaces
+func (r *Rebalancer) SetTokenIdentity(node, identity string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if identity == "" || identity == node {
+		delete(r.tokenIDs, node)
+	} else {
+		r.tokenIDs[node] = identity
+	}
+}
+
+// SetTokenIdentities replaces all token identity overrides, e.g. with the
+// ones recorded in the cluster metadata
+func (r *Rebalancer) SetTokenIdentities(ids map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tokenIDs = make(map[string]string, len(ids))
+	for node, id := range ids {
+		if id != "" && id != node {
+			r.tokenIDs[node] = id
+		}
+	}
+}
+
+// TokenIdentities returns the token identity overrides
+func (r *Rebalancer) TokenIdentities() map[string]string {
 	r.mu.RLock()
-	nodes := r.nodes.GetNodes()
-	self := r.self
-	r.mu.RUnlock()
+	defer r.mu.RUnlock()
 
-	if len(nodes) == 0 {
-		return 0, nil
+	ids := make(map[string]string, len(r.tokenIDs))
+	for node, id := range r.tokenIDs {
+		ids[node] = id
 	}
+	return ids
+}
 
-	// Build hash ring order (stable sort)
-	sort.Strings(nodes)
+// BuildRing returns the ring for the given members using the current options
+// and token identities
+func (r *Rebalancer) BuildRing(nodes []string) *Ring {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return NewRingWithTokens(nodes, r.opts.VirtualNodes, r.tokenIDs)
+}
 
-	items, err := r.store.GetAll()
-	if err != nil {
+// ResetRing records that the local data is balanced against the given members,
+// e.g. after a bootstrap pulled this node's ranges
+func (r *Rebalancer) ResetRing(nodes []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ring = NewRingWithTokens(nodes, r.opts.VirtualNodes, r.tokenIDs)
+}
+
+func (r *Rebalancer) options() RebalanceOptions {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.opts
+}
+
+// Ring returns the ring the local data was last balanced against
+func (r *Rebalancer) Ring() *Ring {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ring
+}
+
+// TriggerRebalance moves keys that no longer belong to this node to their new
+// owners and waits for completion. It returns the number of moved keys.
+func (r *Rebalancer) TriggerRebalance() (moved int, err error) {
+	if err := r.Start(false); err != nil {
 		return 0, err
 	}
+	progress := r.Wait()
+	if progress.State == RebalanceFailed {
+		return progress.MovedKeys, errors.New(progress.Error)
+	}
+	return progress.MovedKeys, nil
+}
 
-	client := &http.Client{Timeout: 3 * time.Second}
-	movedCount := 0
+// Start launches a background rebalance job. With full set, every local key
+// not owned by this node is moved, otherwise only ranges that changed owner
+// since the last rebalance.
+func (r *Rebalancer) Start(full bool) error {
+	return r.StartWithNodes(r.nodes.GetNodes(), full)
+}
 
+// StartWithNodes is like Start but balances against the given members instead
+// of the current node list, e.g. the cluster without this node when decommissioning
+func (r *Rebalancer) StartWithNodes(nodes []string, full bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.progress.State == RebalanceRunning || r.progress.State == RebalancePaused {
+		return ErrRebalanceInProgress
+	}
+
+	newRing := NewRingWithTokens(nodes, r.opts.VirtualNodes, r.tokenIDs)
+	oldRing := r.ring
+	movements := r.planMovements(oldRing, newRing, full)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.moving = movements
+	r.progress = RebalanceProgress{
+		State:       RebalanceRunning,
+		StartedAt:   time.Now(),
+		Full:        full,
+		TotalRanges: len(movements),
+		Movements:   movements,
+	}
+
+	r.pauseMu.Lock()
+	r.paused = false
+	r.pauseMu.Unlock()
+
+	go r.run(ctx, newRing, movements, r.done)
+	return nil
+}
+
+// planMovements selects the ranges this node has to stream away
+func (r *Rebalancer) planMovements(oldRing, newRing *Ring, full bool) []RangeMovement {
+	// Without a usable reference ring every range owned by someone else is a candidate
+	if full || oldRing == nil || !oldRing.HasNode(r.self) {
+		var movements []RangeMovement
+		for _, or := range newRing.Ranges() {
+			if or.Node != r.self {
+				movements = append(movements, RangeMovement{Range: or.Range, From: r.self, To: or.Node})
+			}
+		}
+		return movements
+	}
+
+	var movements []RangeMovement
+	for _, m := range ComputeRangeMovements(oldRing, newRing) {
+		if m.From == r.self {
+			movements = append(movements, m)
+		}
+	}
+	return movements
+}
+
+func (r *Rebalancer) run(ctx context.Context, newRing *Ring, movements []RangeMovement, done chan struct{}) {
+	defer close(done)
+
+	err := r.stream(ctx, movements)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.moving = nil
+	r.progress.FinishedAt = time.Now()
+	r.progress.CurrentRange = ""
+	switch {
+	case errors.Is(err, context.Canceled):
+		r.progress.State = RebalanceCancelled
+	case err != nil:
+		r.progress.State = RebalanceFailed
+		r.progress.Error = err.Error()
+	default:
+		r.progress.State = RebalanceCompleted
+		r.ring = newRing
+	}
+	log.Printf("Rebalance %s: %d keys moved, %d bytes sent", r.progress.State, r.progress.MovedKeys, r.progress.BytesSent)
+}
+
+func (r *Rebalancer) stream(ctx context.Context, movements []RangeMovement) error {
+	if len(movements) == 0 {
+		return nil
+	}
+
+	items, err := r.store.GetAll()
+	if err != nil {
+		return err
+	}
+
+	// Bucket local keys by movement
+	buckets := make([][]string, len(movements))
+	total := 0
 	for _, item := range items {
-		owner := chooseOwner(item.Key, nodes)
-		if owner == self {
-			continue
+		token := KeyToken(item.Key)
+		for i, m := range movements {
+			if m.Range.Contains(token) {
+				buckets[i] = append(buckets[i], item.Key)
+				total++
+				break
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.progress.TotalKeys = total
+	opts := r.opts
+	r.mu.Unlock()
+
+	throttle := newThrottle(opts.BandwidthLimit)
+
+	for i, m := range movements {
+		r.mu.Lock()
+		r.progress.CurrentRange = m.Range.String()
+		r.mu.Unlock()
+
+		keys := buckets[i]
+		sort.Strings(keys)
+		for start := 0; start < len(keys); start += opts.BatchSize {
+			if err := r.waitIfPaused(ctx); err != nil {
+				return err
+			}
+
+			end := start + opts.BatchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			if err := r.moveBatch(ctx, m.To, keys[start:end], opts, throttle); err != nil {
+				return fmt.Errorf("range %s to %s: %w", m.Range, m.To, err)
+			}
+		}
+
+		r.mu.Lock()
+		r.progress.CompletedRanges++
+		r.mu.Unlock()
+	}
+
+	return nil
+}
+
+// moveBatch streams a batch, verifies the target's copy and only then deletes
+// the local copy
+func (r *Rebalancer) moveBatch(ctx context.Context, target string, keys []string, opts RebalanceOptions, throttle *throttle) error {
+	for attempt := 0; attempt <= opts.VerifyRetries; attempt++ {
+		batch := r.readBatch(keys)
+		if len(batch) == 0 {
+			return nil // keys were deleted concurrently
+		}
+
+		sent, err := r.sendBatch(ctx, target, batch)
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.progress.BytesSent += int64(sent)
+		r.mu.Unlock()
+		if err := throttle.wait(ctx, sent); err != nil {
+			return err
 		}
 
-		// send to owner via internal set
-		reqBody, _ := json.Marshal(map[string]string{"key": item.Key, "value": item.Value})
-		url := fmt.Sprintf("http://%s/internal/set", owner)
-		req, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
+		// Re-read so that writes which landed during the transfer are covered
+		batch = r.readBatch(keys)
+		remote, err := r.remoteChecksum(ctx, target, batchKeys(batch))
 		if err != nil {
+			return err
+		}
+		if remote != ChecksumKeyValues(batch) {
+			r.mu.Lock()
+			r.progress.VerifyFailures++
+			r.mu.Unlock()
 			continue
 		}
-		req.Header.Set("Content-Type", "application/json")
-		resp, err := client.Do(req)
-		if err == nil && resp.StatusCode < 300 {
-			// delete local copy
-			_ = r.store.Delete(item.Key)
-			movedCount++
+
+		for _, kv := range batch {
+			if err := r.store.Delete(kv.Key); err != nil && err != storage.ErrKeyNotFound {
+				log.Printf("Rebalance: failed to delete moved key %s: %v", kv.Key, err)
+			}
 		}
-		if resp != nil {
-			resp.Body.Close()
+		r.mu.Lock()
+		r.progress.MovedKeys += len(batch)
+		r.mu.Unlock()
+		return nil
+	}
+
+	return fmt.Errorf("checksum mismatch after %d attempts", opts.VerifyRetries+1)
+}
+
+func (r *Rebalancer) readBatch(keys []string) []storage.KeyValue {
+	batch := make([]storage.KeyValue, 0, len(keys))
+	for _, key := range keys {
+		value, err := r.store.Get(key)
+		if err != nil {
+			continue
+		}
+		batch = append(batch, storage.KeyValue{Key: key, Value: value, TTLMillis: storage.RemainingTTLMillis(r.store, key)})
+	}
+	return batch
+}
+
+func batchKeys(batch []storage.KeyValue) []string {
+	keys := make([]string, len(batch))
+	for i, kv := range batch {
+		keys[i] = kv.Key
+	}
+	return keys
+}
+
+func (r *Rebalancer) sendBatch(ctx context.Context, target string, batch []storage.KeyValue) (int, error) {
+	return sendBatch(ctx, r.httpClient, target, batch)
+}
+
+// sendBatch writes a batch to the storage of target, returning the bytes sent.
+// Entries carry their remaining TTL, so moved keys expire when they would have.
+func sendBatch(ctx context.Context, client *http.Client, target string, batch []storage.KeyValue) (int, error) {
+	body, err := json.Marshal(map[string]interface{}{"items": batch})
+	if err != nil {
+		return 0, err
+	}
+
+	url := internode.URL(target, "/internal/batch_set")
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("batch transfer failed: %s", resp.Status)
+	}
+	return len(body), nil
+}
+
+func (r *Rebalancer) remoteChecksum(ctx context.Context, target string, keys []string) (string, error) {
+	return remoteChecksum(ctx, r.httpClient, target, keys)
+}
+
+// remoteChecksum returns the checksum of the values target has for keys
+func remoteChecksum(ctx context.Context, client *http.Client, target string, keys []string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		return "", err
+	}
+
+	url := internode.URL(target, "/internal/checksum")
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("checksum request failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Checksum string `json:"checksum"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Checksum, nil
+}
+
+// ChecksumKeyValues returns an order-independent checksum over key/value pairs
+func ChecksumKeyValues(items []storage.KeyValue) string {
+	sorted := make([]storage.KeyValue, len(items))
+	copy(sorted, items)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	h := sha256.New()
+	for _, kv := range sorted {
+		h.Write([]byte(kv.Key))
+		h.Write([]byte{0})
+		h.Write([]byte(kv.Value))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// MirrorSet forwards a local write to the new owner while its range is being
+// moved, so the target does not miss writes that race with streaming. The
+// write is mirrored before it is acknowledged, so successive writes to a key
+// reach the target in the order they were made.
+func (r *Rebalancer) MirrorSet(key, value string) {
+	target := r.moveTarget(key)
+	if target == "" {
+		return
+	}
+
+	batch := []storage.KeyValue{{Key: key, Value: value, TTLMillis: storage.RemainingTTLMillis(r.store, key)}}
+	if _, err := r.sendBatch(context.Background(), target, batch); err != nil {
+		log.Printf("Rebalance: double-write of %s to %s failed: %v", key, target, err)
+	}
+}
+
+// MirrorDelete forwards a local delete to the new owner while its range is
+// being moved, in order with the mirrored writes
+func (r *Rebalancer) MirrorDelete(key string) {
+	target := r.moveTarget(key)
+	if target == "" {
+		return
+	}
+
+	endpoint := internode.URL(target, "/internal/delete/"+url.PathEscape(key))
+	req, err := http.NewRequest("DELETE", endpoint, nil)
+	if err != nil {
+		return
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		log.Printf("Rebalance: double-delete of %s on %s failed: %v", key, target, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (r *Rebalancer) moveTarget(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.moving) == 0 {
+		return ""
+	}
+	token := KeyToken(key)
+	for _, m := range r.moving {
+		if m.Range.Contains(token) {
+			return m.To
 		}
 	}
+	return ""
+}
+
+// Pause suspends the running job after the current batch
+func (r *Rebalancer) Pause() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.progress.State != RebalanceRunning {
+		return ErrNoRebalanceJob
+	}
+	r.pauseMu.Lock()
+	r.paused = true
+	r.pauseMu.Unlock()
+	r.progress.State = RebalancePaused
+	return nil
+}
 
-	return movedCount, nil
+// Resume continues a paused job
+func (r *Rebalancer) Resume() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.progress.State != RebalancePaused {
+		return ErrNoRebalanceJob
+	}
+	r.pauseMu.Lock()
+	r.paused = false
+	r.resume.Broadcast()
+	r.pauseMu.Unlock()
+	r.progress.State = RebalanceRunning
+	return nil
 }
 
-func chooseOwner(key string, nodes []string) string {
-	h := fnv.New32a()
-	_, _ = h.Write([]byte(key))
-	idx := int(h.Sum32()) % len(nodes)
-	if idx < 0 {
-		idx = -idx
+// Cancel stops the running job. Batches already verified stay moved.
+func (r *Rebalancer) Cancel() error {
+	r.mu.Lock()
+	if r.progress.State != RebalanceRunning && r.progress.State != RebalancePaused {
+		r.mu.Unlock()
+		return ErrNoRebalanceJob
+	}
+	r.cancel()
+	r.mu.Unlock()
+
+	// wake up a paused job so it can observe the cancellation
+	r.pauseMu.Lock()
+	r.paused = false
+	r.resume.Broadcast()
+	r.pauseMu.Unlock()
+	return nil
+}
+
+// Wait blocks until the current job finishes and returns its final progress
+func (r *Rebalancer) Wait() RebalanceProgress {
+	r.mu.RLock()
+	done := r.done
+	r.mu.RUnlock()
+
+	if done != nil {
+		<-done
+	}
+	return r.Progress()
+}
+
+// Progress returns a snapshot of the current or last job
+func (r *Rebalancer) Progress() RebalanceProgress {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	progress := r.progress
+	progress.Movements = append([]RangeMovement(nil), r.progress.Movements...)
+	return progress
+}
+
+func (r *Rebalancer) waitIfPaused(ctx context.Context) error {
+	r.pauseMu.Lock()
+	for r.paused && ctx.Err() == nil {
+		r.resume.Wait()
+	}
+	r.pauseMu.Unlock()
+	return ctx.Err()
+}
+
+// throttle limits the average transfer rate
+type throttle struct {
+	bytesPerSec int64
+	start       time.Time
+	sent        int64
+}
+
+func newThrottle(bytesPerSec int64) *throttle {
+	return &throttle{bytesPerSec: bytesPerSec, start: time.Now()}
+}
+
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t.bytesPerSec <= 0 {
+		return nil
+	}
+	t.sent += int64(n)
+
+	expected := time.Duration(float64(t.sent) / float64(t.bytesPerSec) * float64(time.Second))
+	delay := expected - time.Since(t.start)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return nodes[idx]
 }
@@ -2,10 +2,12 @@ package cluster
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"distore/storage"
 )
@@ -54,3 +56,244 @@ func TestRebalancerMovesKeys(t *testing.T) {
 		t.Fatalf("unexpected moved count %d", moved)
 	}
 }
+
+// newStreamingTarget serves the batch and checksum endpoints on top of a storage
+func newStreamingTarget(store storage.Storage, corrupt bool) *httptest.Server {
+	handler := http.NewServeMux()
+	handler.HandleFunc("/internal/batch_set", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Items []storage.KeyValue `json:"items"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		for _, kv := range req.Items {
+			if corrupt {
+				kv.Value += "-corrupted"
+			}
+			_ = store.Set(kv.Key, kv.Value)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	handler.HandleFunc("/internal/checksum", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Keys []string `json:"keys"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var items []storage.KeyValue
+		for _, key := range req.Keys {
+			if v, err := store.Get(key); err == nil {
+				items = append(items, storage.KeyValue{Key: key, Value: v})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]string{"checksum": ChecksumKeyValues(items)})
+	})
+	return httptest.NewServer(handler)
+}
+
+func TestRebalancerStreamsAndVerifies(t *testing.T) {
+	source := storage.NewMemoryStorage()
+	target := storage.NewMemoryStorage()
+	srv := newStreamingTarget(target, false)
+	defer srv.Close()
+	targetAddr := strings.TrimPrefix(srv.URL, "http://")
+
+	for i := 0; i < 200; i++ {
+		_ = source.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+
+	// Start with a single-node ring, then add the target
+	lister := &mutableNodeLister{nodes: []string{"self:1234"}}
+	r := NewRebalancer(source, lister, "self:1234")
+	opts := DefaultRebalanceOptions()
+	opts.BatchSize = 10
+	r.SetOptions(opts)
+
+	lister.nodes = []string{"self:1234", targetAddr}
+	moved, err := r.TriggerRebalance()
+	if err != nil {
+		t.Fatalf("rebalance error: %v", err)
+	}
+
+	ring := NewRing(lister.nodes, opts.VirtualNodes)
+	expected := 0
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if ring.Owner(key) == targetAddr {
+			expected++
+			if v, err := target.Get(key); err != nil || v != fmt.Sprintf("value-%d", i) {
+				t.Fatalf("key %s missing on target", key)
+			}
+			if _, err := source.Get(key); err != storage.ErrKeyNotFound {
+				t.Fatalf("key %s should be removed from source", key)
+			}
+		} else if _, err := source.Get(key); err != nil {
+			t.Fatalf("key %s owned by self should stay local", key)
+		}
+	}
+	if moved != expected {
+		t.Fatalf("expected %d moved keys, got %d", expected, moved)
+	}
+
+	progress := r.Progress()
+	if progress.State != RebalanceCompleted || progress.CompletedRanges != progress.TotalRanges {
+		t.Fatalf("unexpected progress %+v", progress)
+	}
+
+	// A second run against the same topology has nothing to move
+	moved, err = r.TriggerRebalance()
+	if err != nil || moved != 0 {
+		t.Fatalf("expected no-op rebalance, got moved=%d err=%v", moved, err)
+	}
+}
+
+func TestRebalancerKeepsDataOnChecksumMismatch(t *testing.T) {
+	source := storage.NewMemoryStorage()
+	srv := newStreamingTarget(storage.NewMemoryStorage(), true)
+	defer srv.Close()
+	targetAddr := strings.TrimPrefix(srv.URL, "http://")
+
+	for i := 0; i < 50; i++ {
+		_ = source.Set(fmt.Sprintf("key-%d", i), "v")
+	}
+
+	lister := &mutableNodeLister{nodes: []string{"self:1234", targetAddr}}
+	r := NewRebalancer(source, lister, "self:1234")
+	opts := DefaultRebalanceOptions()
+	opts.VerifyRetries = 1
+	r.SetOptions(opts)
+
+	if err := r.Start(true); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	progress := r.Wait()
+	if progress.State != RebalanceFailed {
+		t.Fatalf("expected failed job, got %s", progress.State)
+	}
+	if progress.VerifyFailures == 0 {
+		t.Fatal("expected verify failures to be recorded")
+	}
+	items, _ := source.GetAll()
+	if len(items) != 50 {
+		t.Fatalf("source must keep unverified data, has %d keys", len(items))
+	}
+}
+
+func TestRebalancerPauseResume(t *testing.T) {
+	source := storage.NewMemoryStorage()
+	target := storage.NewMemoryStorage()
+	srv := newStreamingTarget(target, false)
+	defer srv.Close()
+	targetAddr := strings.TrimPrefix(srv.URL, "http://")
+
+	for i := 0; i < 100; i++ {
+		_ = source.Set(fmt.Sprintf("key-%d", i), "v")
+	}
+
+	lister := &mutableNodeLister{nodes: []string{targetAddr}}
+	r := NewRebalancer(source, lister, "self:1234")
+	opts := DefaultRebalanceOptions()
+	opts.BatchSize = 5
+	opts.BandwidthLimit = 20000 // keep the job running long enough to pause it
+	r.SetOptions(opts)
+
+	if err := r.Start(false); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	if err := r.Pause(); err != nil {
+		t.Fatalf("pause error: %v", err)
+	}
+	if r.Progress().State != RebalancePaused {
+		t.Fatal("expected paused state")
+	}
+	if err := r.Start(false); err != ErrRebalanceInProgress {
+		t.Fatalf("expected in-progress error, got %v", err)
+	}
+
+	// Writes to moving ranges are mirrored to the target
+	r.MirrorSet("mirrored", "value")
+	if v, err := target.Get("mirrored"); err != nil || v != "value" {
+		t.Fatal("expected double-write to reach the target")
+	}
+
+	if err := r.Resume(); err != nil {
+		t.Fatalf("resume error: %v", err)
+	}
+	progress := r.Wait()
+	if progress.State != RebalanceCompleted {
+		t.Fatalf("expected completed job, got %s (%s)", progress.State, progress.Error)
+	}
+	if progress.MovedKeys != 100 {
+		t.Fatalf("expected 100 moved keys, got %d", progress.MovedKeys)
+	}
+}
+
+type mutableNodeLister struct{ nodes []string }
+
+func (m *mutableNodeLister) GetNodes() []string { return append([]string{}, m.nodes...) }
+
+func TestRebalancerMirrorKeepsWriteOrder(t *testing.T) {
+	target := storage.NewMemoryStorage()
+	handler := http.NewServeMux()
+	handler.HandleFunc("/internal/batch_set", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Items []storage.KeyValue `json:"items"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		for _, kv := range req.Items {
+			// The first write is slower to arrive than the second one
+			if kv.Value == "v1" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			_ = target.Set(kv.Key, kv.Value)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	r := NewRebalancer(storage.NewMemoryStorage(), mockNodeLister{}, "self:1234")
+	r.moving = []RangeMovement{{Range: TokenRange{}, From: "self:1234", To: strings.TrimPrefix(srv.URL, "http://")}}
+
+	r.MirrorSet("k", "v1")
+	r.MirrorSet("k", "v2")
+	time.Sleep(100 * time.Millisecond)
+	if v, err := target.Get("k"); err != nil || v != "v2" {
+		t.Fatalf("Expected the target to end with the last write, got %q (%v)", v, err)
+	}
+}
+
+func TestRebalancerKeepsRemainingTTL(t *testing.T) {
+	ttls := make(map[string]int64)
+	handler := http.NewServeMux()
+	handler.HandleFunc("/internal/batch_set", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Items []storage.KeyValue `json:"items"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		for _, kv := range req.Items {
+			ttls[kv.Key] = kv.TTLMillis
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	source := storage.NewTTLStorage(storage.NewMemoryStorage(), time.Minute)
+	_ = source.SetWithTTL("expiring", "v", 30*time.Second)
+	_ = source.Set("kept", "v")
+
+	r := NewRebalancer(source, mockNodeLister{}, "self:1234")
+	r.moving = []RangeMovement{{Range: TokenRange{}, From: "self:1234", To: strings.TrimPrefix(srv.URL, "http://")}}
+	r.MirrorSet("expiring", "v")
+	r.MirrorSet("kept", "v")
+
+	if ttl := ttls["expiring"]; ttl <= 0 || ttl > 30000 {
+		t.Fatalf("Expected the remaining TTL to be sent, got %dms", ttl)
+	}
+	if ttl := ttls["kept"]; ttl != 0 {
+		t.Fatalf("Expected no TTL for a key that does not expire, got %dms", ttl)
+	}
+	batch := r.readBatch([]string{"expiring"})
+	if len(batch) != 1 || batch[0].TTLMillis <= 0 {
+		t.Fatalf("Expected streamed batches to carry the remaining TTL, got %+v", batch)
+	}
+}
@@ -0,0 +1,232 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"distore/internode"
+	"distore/storage"
+)
+
+// RepairState is the lifecycle state of a repair
+type RepairState string
+
+const (
+	RepairIdle      RepairState = "idle"
+	RepairRunning   RepairState = "running"
+	RepairCompleted RepairState = "completed"
+	RepairFailed    RepairState = "failed"
+	RepairCancelled RepairState = "cancelled"
+)
+
+var (
+	ErrRepairInProgress = errors.New("repair already in progress")
+	ErrNoRepair         = errors.New("no repair is running")
+)
+
+// RepairProgress is a snapshot of the current (or last) repair
+type RepairProgress struct {
+	State        RepairState       `json:"state"`
+	StartedAt    time.Time         `json:"started_at,omitempty"`
+	FinishedAt   time.Time         `json:"finished_at,omitempty"`
+	Node         string            `json:"node,omitempty"` // the only replica repaired, all when empty
+	ScannedKeys  int               `json:"scanned_keys"`
+	Batches      int               `json:"batches"`
+	Mismatched   int               `json:"mismatched_batches"`
+	RepairedKeys int               `json:"repaired_keys"`
+	Errors       map[string]string `json:"errors,omitempty"` // by replica that could not be repaired
+	Error        string            `json:"error,omitempty"`
+}
+
+// Repairer makes the other replicas of the keys of this node hold the
+// values this node holds. Keys are compared in batches by checksum, and
+// the batches that differ are sent again. This node's values win, and keys
+// it does not have are left alone on the replicas.
+type Repairer struct {
+	mu         sync.Mutex
+	store      storage.Storage
+	self       string
+	replicas   func(key string) []string
+	batchSize  int
+	httpClient *http.Client
+	progress   RepairProgress
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// NewRepairer repairs the replicas of store, replicas returning the nodes
+// holding a key
+func NewRepairer(store storage.Storage, self string, replicas func(key string) []string) *Repairer {
+	return &Repairer{
+		store:      store,
+		self:       self,
+		replicas:   replicas,
+		batchSize:  100,
+		httpClient: internode.NewClient(10 * time.Second),
+		progress:   RepairProgress{State: RepairIdle},
+	}
+}
+
+// Start launches a repair in the background. With node set, only that
+// replica is repaired, e.g. a node back from an outage longer than its
+// hints were kept.
+func (r *Repairer) Start(node string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.progress.State == RepairRunning {
+		return ErrRepairInProgress
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.progress = RepairProgress{State: RepairRunning, StartedAt: time.Now(), Node: node}
+	go r.run(ctx, node, r.done)
+	return nil
+}
+
+// Cancel stops the running repair after the current batch
+func (r *Repairer) Cancel() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.progress.State != RepairRunning {
+		return ErrNoRepair
+	}
+	r.cancel()
+	return nil
+}
+
+// Progress returns a snapshot of the current or last repair
+func (r *Repairer) Progress() RepairProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	progress := r.progress
+	if r.progress.Errors != nil {
+		progress.Errors = make(map[string]string, len(r.progress.Errors))
+		for node, err := range r.progress.Errors {
+			progress.Errors[node] = err
+		}
+	}
+	return progress
+}
+
+// Wait blocks until the running repair, if any, is done
+func (r *Repairer) Wait() RepairProgress {
+	r.mu.Lock()
+	done := r.done
+	r.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	return r.Progress()
+}
+
+func (r *Repairer) run(ctx context.Context, node string, done chan struct{}) {
+	defer close(done)
+
+	err := r.repair(ctx, node)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress.FinishedAt = time.Now()
+	switch {
+	case errors.Is(err, context.Canceled):
+		r.progress.State = RepairCancelled
+	case err != nil:
+		r.progress.State = RepairFailed
+		r.progress.Error = err.Error()
+	default:
+		r.progress.State = RepairCompleted
+	}
+	log.Printf("Repair %s: %d keys repaired in %d of %d batches", r.progress.State, r.progress.RepairedKeys, r.progress.Mismatched, r.progress.Batches)
+}
+
+func (r *Repairer) repair(ctx context.Context, only string) error {
+	items, err := r.store.GetAll()
+	if err != nil {
+		return err
+	}
+
+	// Keys by the other replicas holding them
+	byNode := make(map[string][]string)
+	for _, item := range items {
+		for _, node := range r.replicas(item.Key) {
+			if node != r.self && (only == "" || node == only) {
+				byNode[node] = append(byNode[node], item.Key)
+			}
+		}
+	}
+	r.mu.Lock()
+	r.progress.ScannedKeys = len(items)
+	r.mu.Unlock()
+
+	nodes := make([]string, 0, len(byNode))
+	for node := range byNode {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		err := r.repairNode(ctx, node, byNode[node])
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+		if err != nil {
+			// An unreachable replica does not stop the others' repair
+			log.Printf("Repair of %s: %v", node, err)
+			r.mu.Lock()
+			if r.progress.Errors == nil {
+				r.progress.Errors = make(map[string]string)
+			}
+			r.progress.Errors[node] = err.Error()
+			r.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+func (r *Repairer) repairNode(ctx context.Context, node string, keys []string) error {
+	sort.Strings(keys)
+	for start := 0; start < len(keys); start += r.batchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := start + r.batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch := make([]storage.KeyValue, 0, end-start)
+		for _, key := range keys[start:end] {
+			if value, err := r.store.Get(key); err == nil {
+				batch = append(batch, storage.KeyValue{Key: key, Value: value, TTLMillis: storage.RemainingTTLMillis(r.store, key)})
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		remote, err := remoteChecksum(ctx, r.httpClient, node, batchKeys(batch))
+		if err != nil {
+			return err
+		}
+		mismatched := remote != ChecksumKeyValues(batch)
+		if mismatched {
+			if _, err := sendBatch(ctx, r.httpClient, node, batch); err != nil {
+				return err
+			}
+		}
+
+		r.mu.Lock()
+		r.progress.Batches++
+		if mismatched {
+			r.progress.Mismatched++
+			r.progress.RepairedKeys += len(batch)
+		}
+		r.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"distore/storage"
+)
+
+func TestRepairerSendsMismatchedBatches(t *testing.T) {
+	local := storage.NewMemoryStorage()
+	healthy, stale := storage.NewMemoryStorage(), storage.NewMemoryStorage()
+	healthySrv, staleSrv := newStreamingTarget(healthy, false), newStreamingTarget(stale, false)
+	defer healthySrv.Close()
+	defer staleSrv.Close()
+	healthyAddr := strings.TrimPrefix(healthySrv.URL, "http://")
+	staleAddr := strings.TrimPrefix(staleSrv.URL, "http://")
+
+	for i := 0; i < 250; i++ {
+		key, value := fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)
+		local.Set(key, value)
+		healthy.Set(key, value)
+		if i < 100 {
+			stale.Set(key, value) // the first batch is in sync
+		}
+	}
+	stale.Set("key-150", "old")
+	stale.Set("only-remote", "kept")
+
+	r := NewRepairer(local, "self:8080", func(key string) []string {
+		return []string{"self:8080", healthyAddr, staleAddr}
+	})
+	if err := r.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	progress := r.Wait()
+	if progress.State != RepairCompleted || progress.ScannedKeys != 250 || progress.Batches != 6 {
+		t.Fatalf("Expected 6 batches of 250 keys, got %+v", progress)
+	}
+	if progress.Mismatched != 2 || progress.RepairedKeys != 150 {
+		t.Errorf("Expected the 2 batches out of sync to be sent, got %+v", progress)
+	}
+	if value, _ := stale.Get("key-150"); value != "value-150" {
+		t.Errorf("Expected the stale value to be repaired, got %q", value)
+	}
+	if items, _ := stale.GetAll(); len(items) != 251 {
+		t.Errorf("Expected the replica's own keys to be kept, got %d keys", len(items))
+	}
+
+	// An unreachable replica is reported, the others are repaired
+	staleSrv.Close()
+	stale.Delete("key-000")
+	healthy.Delete("key-000")
+	r.Start("")
+	progress = r.Wait()
+	if progress.State != RepairCompleted || progress.Errors[staleAddr] == "" || progress.RepairedKeys != 100 {
+		t.Errorf("Expected an error for the stopped replica only, got %+v", progress)
+	}
+	if _, err := healthy.Get("key-000"); err != nil {
+		t.Errorf("Expected the healthy replica to be repaired, got %v", err)
+	}
+
+	// A repair can be restricted to one replica
+	healthy.Delete("key-001")
+	r.Start(healthyAddr)
+	if progress = r.Wait(); progress.Node != healthyAddr || progress.Errors != nil || progress.RepairedKeys != 100 {
+		t.Errorf("Expected only %s to be repaired, got %+v", healthyAddr, progress)
+	}
+}
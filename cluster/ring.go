@@ -0,0 +1,212 @@
+package cluster
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// DefaultVirtualNodes is the number of tokens each node owns on the ring
+const DefaultVirtualNodes = 64
+
+// TokenRange is the half-open interval (Start, End] on the token ring.
+// A range with Start >= End wraps around zero.
+type TokenRange struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+// Contains reports whether the token falls into the range
+func (tr TokenRange) Contains(token uint32) bool {
+	if tr.Start < tr.End {
+		return token > tr.Start && token <= tr.End
+	}
+	// wrapping range (or the whole ring when Start == End)
+	return token > tr.Start || token <= tr.End
+}
+
+func (tr TokenRange) String() string {
+	return fmt.Sprintf("(%d,%d]", tr.Start, tr.End)
+}
+
+// OwnedRange is a token range together with the node owning it
+type OwnedRange struct {
+	Range TokenRange `json:"range"`
+	Node  string     `json:"node"`
+}
+
+// RangeMovement describes a range that changes owner between two rings
+type RangeMovement struct {
+	Range TokenRange `json:"range"`
+	From  string     `json:"from"`
+	To    string     `json:"to"`
+}
+
+// Ring is a consistent hash ring with virtual nodes
+type Ring struct {
+	tokens []uint32
+	owners map[uint32]string
+	nodes  []string
+}
+
+// KeyToken returns the ring position of a key
+func KeyToken(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// NewRing builds a ring where every node owns vnodes tokens
+func NewRing(nodes []string, vnodes int) *Ring {
+	return NewRingWithTokens(nodes, vnodes, nil)
+}
+
+// NewRingWithTokens is like NewRing but derives the tokens of a node from
+// tokenIDs[node] when set. A replacement node uses the identity of the node it
+// replaced and therefore owns the same ranges.
+func NewRingWithTokens(nodes []string, vnodes int, tokenIDs map[string]string) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	r := &Ring{
+		owners: make(map[uint32]string),
+		nodes:  make([]string, len(nodes)),
+	}
+	copy(r.nodes, nodes)
+	sort.Strings(r.nodes)
+
+	for _, node := range r.nodes {
+		identity := node
+		if id, ok := tokenIDs[node]; ok && id != "" {
+			identity = id
+		}
+		for i := 0; i < vnodes; i++ {
+			token := KeyToken(fmt.Sprintf("%s#%d", identity, i))
+			if _, taken := r.owners[token]; taken {
+				continue // extremely rare collision, first node keeps the token
+			}
+			r.owners[token] = node
+			r.tokens = append(r.tokens, token)
+		}
+	}
+	sort.Slice(r.tokens, func(i, j int) bool { return r.tokens[i] < r.tokens[j] })
+
+	return r
+}
+
+// Nodes returns the ring members
+func (r *Ring) Nodes() []string {
+	nodes := make([]string, len(r.nodes))
+	copy(nodes, r.nodes)
+	return nodes
+}
+
+// HasNode reports whether the node is a ring member
+func (r *Ring) HasNode(node string) bool {
+	for _, n := range r.nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEmpty reports whether the ring has no tokens
+func (r *Ring) IsEmpty() bool {
+	return len(r.tokens) == 0
+}
+
+// Owner returns the node owning the key
+func (r *Ring) Owner(key string) string {
+	return r.ownerOfToken(KeyToken(key))
+}
+
+func (r *Ring) ownerOfToken(token uint32) string {
+	if len(r.tokens) == 0 {
+		return ""
+	}
+	idx := sort.Search(len(r.tokens), func(i int) bool { return r.tokens[i] >= token })
+	if idx == len(r.tokens) {
+		idx = 0
+	}
+	return r.owners[r.tokens[idx]]
+}
+
+// Ranges returns all token ranges with their owners, in token order
+func (r *Ring) Ranges() []OwnedRange {
+	ranges := make([]OwnedRange, 0, len(r.tokens))
+	for i, token := range r.tokens {
+		prev := r.tokens[len(r.tokens)-1]
+		if i > 0 {
+			prev = r.tokens[i-1]
+		}
+		ranges = append(ranges, OwnedRange{
+			Range: TokenRange{Start: prev, End: token},
+			Node:  r.owners[token],
+		})
+	}
+	return ranges
+}
+
+// RangesFor returns the ranges owned by the given node
+func (r *Ring) RangesFor(node string) []TokenRange {
+	var ranges []TokenRange
+	for _, or := range r.Ranges() {
+		if or.Node == node {
+			ranges = append(ranges, or.Range)
+		}
+	}
+	return ranges
+}
+
+// ComputeRangeMovements returns the ranges whose owner differs between the
+// old and the new ring. Adjacent movements between the same nodes are merged.
+func ComputeRangeMovements(oldRing, newRing *Ring) []RangeMovement {
+	if oldRing == nil || newRing == nil || oldRing.IsEmpty() || newRing.IsEmpty() {
+		return nil
+	}
+
+	boundarySet := make(map[uint32]struct{}, len(oldRing.tokens)+len(newRing.tokens))
+	for _, t := range oldRing.tokens {
+		boundarySet[t] = struct{}{}
+	}
+	for _, t := range newRing.tokens {
+		boundarySet[t] = struct{}{}
+	}
+	boundaries := make([]uint32, 0, len(boundarySet))
+	for t := range boundarySet {
+		boundaries = append(boundaries, t)
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+
+	var movements []RangeMovement
+	for i, end := range boundaries {
+		start := boundaries[len(boundaries)-1]
+		if i > 0 {
+			start = boundaries[i-1]
+		}
+
+		// No boundary lies inside (start, end], so the owners of end own the whole range
+		from := oldRing.ownerOfToken(end)
+		to := newRing.ownerOfToken(end)
+		if from == to {
+			continue
+		}
+
+		if n := len(movements); n > 0 {
+			last := &movements[n-1]
+			if last.From == from && last.To == to && last.Range.End == start {
+				last.Range.End = end
+				continue
+			}
+		}
+		movements = append(movements, RangeMovement{
+			Range: TokenRange{Start: start, End: end},
+			From:  from,
+			To:    to,
+		})
+	}
+
+	return movements
+}
@@ -0,0 +1,80 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingOwnership(t *testing.T) {
+	ring := NewRing([]string{"n1:8080", "n2:8080", "n3:8080"}, 32)
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		owner := ring.Owner(fmt.Sprintf("key-%d", i))
+		if owner == "" {
+			t.Fatal("Every key should have an owner")
+		}
+		counts[owner]++
+	}
+	if len(counts) != 3 {
+		t.Fatalf("Expected keys on 3 nodes, got %d", len(counts))
+	}
+
+	// Every token falls into exactly one owned range
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("probe-%d", i)
+		token := KeyToken(key)
+		matches := 0
+		for _, or := range ring.Ranges() {
+			if or.Range.Contains(token) {
+				matches++
+				if or.Node != ring.Owner(key) {
+					t.Fatalf("Range owner %s differs from key owner %s", or.Node, ring.Owner(key))
+				}
+			}
+		}
+		if matches != 1 {
+			t.Fatalf("Token %d matched %d ranges", token, matches)
+		}
+	}
+}
+
+func TestComputeRangeMovements(t *testing.T) {
+	oldRing := NewRing([]string{"n1", "n2"}, 16)
+	newRing := NewRing([]string{"n1", "n2", "n3"}, 16)
+
+	movements := ComputeRangeMovements(oldRing, newRing)
+	if len(movements) == 0 {
+		t.Fatal("Adding a node should move some ranges")
+	}
+	for _, m := range movements {
+		if m.To != "n3" {
+			t.Errorf("Only ranges moving to the new node expected, got %s -> %s", m.From, m.To)
+		}
+	}
+
+	// Keys whose owner changed are covered by exactly the movement to the new owner
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		from, to := oldRing.Owner(key), newRing.Owner(key)
+		token := KeyToken(key)
+
+		var covered *RangeMovement
+		for j := range movements {
+			if movements[j].Range.Contains(token) {
+				covered = &movements[j]
+				break
+			}
+		}
+		if from == to && covered != nil {
+			t.Fatalf("Key %s did not change owner but is in movement %v", key, *covered)
+		}
+		if from != to && (covered == nil || covered.From != from || covered.To != to) {
+			t.Fatalf("Key %s moved %s -> %s but movement is %v", key, from, to, covered)
+		}
+	}
+
+	if got := ComputeRangeMovements(oldRing, oldRing); len(got) != 0 {
+		t.Errorf("Identical rings should have no movements, got %d", len(got))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"reflect"
+
+	"distore/auth"
+	"distore/cluster"
+	"distore/config"
+	"distore/replication"
+)
+
+// newMetadataStore opens the cluster metadata of this node. The config only
+// seeds it: once a version has been persisted or received from a peer, the
+// metadata is authoritative for members, replica count and keyspaces.
+func newMetadataStore(cfg *config.Config, selfAddr string) (*cluster.MetadataStore, error) {
+	opts := cluster.DefaultMetadataOptions()
+	if cfg.DataDir != "" {
+		opts.Path = filepath.Join(cfg.DataDir, "cluster_metadata.json")
+	}
+	opts.TrustPeers = cfg.Internode.TLS || cfg.Internode.ServiceToken
+	opts.ShareIdentities = cfg.Internode.TLS
+	seed := cluster.ClusterMetadata{
+		Members:      cfg.Nodes,
+		ReplicaCount: cfg.ReplicaCount,
+		Keyspaces:    cfg.Keyspaces,
+	}
+	return cluster.NewMetadataStore(selfAddr, seed, opts)
+}
+
+// followMetadata applies every metadata version, local or received, to the
+// running components
+func followMetadata(metadata *cluster.MetadataStore, replicator *replication.Replicator, rebalancer *cluster.Rebalancer, keyspaces *replication.KeyspaceRegistry) {
+	metadata.OnChange(func(meta cluster.ClusterMetadata) {
+		if len(meta.Members) > 0 && !reflect.DeepEqual(meta.Members, replicator.GetNodes()) {
+			replicator.UpdateNodes(meta.Members)
+		}
+		if meta.ReplicaCount > 0 {
+			replicator.SetReplicaCount(meta.ReplicaCount)
+		}
+		rebalancer.SetTokenIdentities(meta.TokenIDs)
+		if !reflect.DeepEqual(meta.Keyspaces, keyspaces.Configs()) {
+			if err := keyspaces.Replace(meta.Keyspaces); err != nil {
+				log.Printf("Cluster metadata version %d: keeping current keyspaces: %v", meta.Version, err)
+			}
+		}
+	})
+}
+
+// shareIdentities keeps identities and revoked tokens in the cluster
+// metadata, so that a logout or a new API key is seen by every node. They
+// are only exchanged with internode TLS (see
+// cluster.MetadataOptions.ShareIdentities); without it, each node keeps its
+// own.
+func shareIdentities(metadata *cluster.MetadataStore, identities *auth.Identities) {
+	identities.SetCommit(func(change func(*auth.IdentityState) error) error {
+		_, err := metadata.Update(func(meta *cluster.ClusterMetadata) error {
+			return change(&meta.Auth)
+		})
+		return err
+	})
+	metadata.OnChange(func(meta cluster.ClusterMetadata) {
+		identities.Replace(meta.Auth)
+	})
+}
+
+// shareSigningKeys publishes the public keys of this node in the cluster
+// metadata and verifies tokens with the keys every other node published.
+// The metadata only takes keys from authenticated nodes (see
+// cluster.MetadataOptions.TrustPeers).
+// Keys this node published before a restart stay valid until the tokens
+// signed with them expire.
+func shareSigningKeys(metadata *cluster.MetadataStore, signer *auth.AuthService, self string) {
+	signer.RetainKeys(metadata.Get().SigningKeys[self])
+
+	followPeers := func(meta cluster.ClusterMetadata) {
+		var peerKeys []auth.JWK
+		for node, keys := range meta.SigningKeys {
+			if node != self {
+				peerKeys = append(peerKeys, keys...)
+			}
+		}
+		signer.SetPeerKeys(peerKeys)
+	}
+	followPeers(metadata.Get())
+	metadata.OnChange(followPeers)
+
+	publish := func() {
+		keys := signer.PublicKeys()
+		_, err := metadata.Update(func(meta *cluster.ClusterMetadata) error {
+			if meta.SigningKeys == nil {
+				meta.SigningKeys = make(map[string][]auth.JWK)
+			}
+			meta.SigningKeys[self] = keys
+			// Nodes that left the cluster sign no more tokens
+			if len(meta.Members) > 0 {
+				members := make(map[string]bool, len(meta.Members))
+				for _, node := range meta.Members {
+					members[node] = true
+				}
+				for node := range meta.SigningKeys {
+					if node != self && !members[node] {
+						delete(meta.SigningKeys, node)
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Publishing signing keys: %v", err)
+		}
+	}
+	signer.OnKeysChange(publish)
+	publish()
+}
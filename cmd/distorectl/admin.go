@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"distore/client"
+)
+
+// nodeResult is the answer of one node to a node-local command
+type nodeResult struct {
+	Node   string      `json:"node"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// onNodes runs fn on the node of -node, or on every member in parallel
+func (c *cli) onNodes(ctx context.Context, fn func(ctx context.Context, node *client.Client) (interface{}, error)) ([]nodeResult, error) {
+	cl := c.connect()
+	nodes := []string{c.node}
+	if c.node == "" {
+		members, _, err := cl.ClusterNodes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		nodes = members
+	}
+
+	results := make([]nodeResult, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			result, err := fn(ctx, cl.Node(node))
+			results[i] = nodeResult{Node: node, Result: result}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, node)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// printNodes prints the results of a node-local command, rows giving the
+// cells after the node of each row of a result. It fails when a node did.
+func (c *cli) printNodes(results []nodeResult, header []string, rows func(result interface{}) [][]interface{}) error {
+	err := c.print(results, func(t *table) {
+		t.header(append([]string{"NODE"}, header...)...)
+		for _, r := range results {
+			if r.Error != "" {
+				t.row(r.Node, "ERROR: "+r.Error)
+				continue
+			}
+			for _, cells := range rows(r.Result) {
+				t.row(append([]interface{}{r.Node}, cells...)...)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			return &exitError{1}
+		}
+	}
+	return nil
+}
+
+// nodeClient returns the client of a command that any node can serve, or
+// the node of -node
+func (c *cli) nodeClient() *client.Client {
+	if c.node != "" {
+		return c.connect().Node(c.node)
+	}
+	return c.connect()
+}
+
+func runNodes(c *cli, args []string) error {
+	usage := commands["nodes"].usage
+	if len(args) == 0 {
+		return &usageError{usage}
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	cl := c.nodeClient()
+
+	var nodes []string
+	var err error
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		nodes, err = cl.Nodes(ctx)
+	case args[0] == "add" && len(args) == 2:
+		nodes, err = cl.AddNode(ctx, args[1])
+	case args[0] == "remove" && len(args) == 2:
+		nodes, err = cl.RemoveNode(ctx, args[1])
+	case args[0] == "status" && len(args) == 1:
+		statuses, err := cl.NodeStatus(ctx)
+		if err != nil {
+			return err
+		}
+		return c.print(statuses, func(t *table) {
+			t.header("NODE", "STATE", "ONLINE", "PHI", "LATENCY", "LAST SEEN")
+			for _, s := range statuses {
+				t.row(s.Node, s.State, s.Online, fmt.Sprintf("%.2f", s.Phi), fmt.Sprintf("%dms", s.LatencyMs), s.LastSeen)
+			}
+		})
+	default:
+		return &usageError{usage}
+	}
+	if err != nil {
+		return err
+	}
+	return c.print(map[string][]string{"nodes": nodes}, func(t *table) {
+		t.header("NODE")
+		for _, node := range nodes {
+			t.row(node)
+		}
+	})
+}
+
+// nodeStatus is what cluster status shows of a node
+type nodeStatus struct {
+	Health    string        `json:"health"`
+	Latency   time.Duration `json:"latency_ns"`
+	ReadOnly  client.Status `json:"read_only,omitempty"`
+	Rebalance client.Status `json:"rebalance,omitempty"`
+	Repair    client.Status `json:"repair,omitempty"`
+	Hints     *int          `json:"hints,omitempty"` // nil on single nodes
+}
+
+func runCluster(c *cli, args []string) error {
+	if len(args) != 1 || args[0] != "status" {
+		return &usageError{commands["cluster"].usage}
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+
+	_, replicas, err := c.connect().ClusterNodes(ctx)
+	if err != nil {
+		return err
+	}
+	results, err := c.onNodes(ctx, func(ctx context.Context, node *client.Client) (interface{}, error) {
+		s := &nodeStatus{Health: "ok"}
+		start := time.Now()
+		if err := node.Health(ctx); err != nil {
+			s.Health = "down"
+			return s, nil
+		}
+		s.Latency = time.Since(start)
+		// The routes of features a node does not run answer with errors
+		s.ReadOnly, _ = node.ReadOnly(ctx)
+		s.Rebalance, _ = node.RebalanceStatus(ctx)
+		s.Repair, _ = node.RepairStatus(ctx)
+		if hints, err := node.Hints(ctx); err == nil {
+			total := 0
+			for _, h := range hints {
+				total += h.Hints
+			}
+			s.Hints = &total
+		}
+		return s, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	down := 0
+	for _, r := range results {
+		if r.Error != "" || r.Result.(*nodeStatus).Health != "ok" {
+			down++
+		}
+	}
+	if c.output == "json" {
+		if err := c.print(map[string]interface{}{"replica_count": replicas, "nodes": results}, nil); err != nil {
+			return err
+		}
+	} else {
+		err = c.printNodes(results, []string{"HEALTH", "LATENCY", "READ-ONLY", "REBALANCE", "REPAIR", "HINTS"}, func(result interface{}) [][]interface{} {
+			s := result.(*nodeStatus)
+			if s.Health != "ok" {
+				return [][]interface{}{{s.Health}}
+			}
+			readOnly := status(s.ReadOnly, "read_only")
+			if reason := status(s.ReadOnly, "reason"); readOnly == "true" && reason != "-" {
+				readOnly += " (" + reason + ")"
+			}
+			hints := "-"
+			if s.Hints != nil {
+				hints = strconv.Itoa(*s.Hints)
+			}
+			return [][]interface{}{{s.Health, s.Latency.Round(100 * time.Microsecond).String(), readOnly, status(s.Rebalance, "state"), status(s.Repair, "state"), hints}}
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "\n%d nodes, %d down, replica count %d\n", len(results), down, replicas)
+	}
+	if down > 0 {
+		return &exitError{1}
+	}
+	return nil
+}
+
+func runRebalance(c *cli, args []string) error {
+	usage := commands["rebalance"].usage
+	if len(args) == 0 {
+		return &usageError{usage}
+	}
+	var fn func(ctx context.Context, node *client.Client) (interface{}, error)
+	switch args[0] {
+	case "status":
+		fn = func(ctx context.Context, node *client.Client) (interface{}, error) { return node.RebalanceStatus(ctx) }
+	case "start":
+		fs := flag.NewFlagSet("rebalance start", flag.ContinueOnError)
+		full := fs.Bool("full", false, "Move every key not owned by the node, not only the ranges that changed owner")
+		if err := parse(fs, args[1:], usage, 0, 0); err != nil {
+			return err
+		}
+		fn = func(ctx context.Context, node *client.Client) (interface{}, error) { return node.Rebalance(ctx, *full) }
+	case "pause", "resume", "cancel":
+		action := args[0]
+		fn = func(ctx context.Context, node *client.Client) (interface{}, error) {
+			return node.ControlRebalance(ctx, action)
+		}
+	default:
+		return &usageError{usage}
+	}
+	if args[0] != "start" && len(args) != 1 {
+		return &usageError{usage}
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	results, err := c.onNodes(ctx, fn)
+	if err != nil {
+		return err
+	}
+	return c.printNodes(results, []string{"STATE", "FULL", "RANGES", "KEYS MOVED", "STARTED", "ERROR"}, func(result interface{}) [][]interface{} {
+		s := result.(client.Status)
+		return [][]interface{}{{
+			status(s, "state"), status(s, "full"),
+			status(s, "completed_ranges") + "/" + status(s, "total_ranges"),
+			status(s, "moved_keys") + "/" + status(s, "total_keys"),
+			status(s, "started_at"), status(s, "error"),
+		}}
+	})
+}
+
+func runRepair(c *cli, args []string) error {
+	usage := commands["repair"].usage
+	if len(args) == 0 {
+		return &usageError{usage}
+	}
+	var fn func(ctx context.Context, node *client.Client) (interface{}, error)
+	switch args[0] {
+	case "status":
+		fn = func(ctx context.Context, node *client.Client) (interface{}, error) { return node.RepairStatus(ctx) }
+	case "start":
+		fs := flag.NewFlagSet("repair start", flag.ContinueOnError)
+		target := fs.String("target", "", "Only repair the copies on this node")
+		if err := parse(fs, args[1:], usage, 0, 0); err != nil {
+			return err
+		}
+		fn = func(ctx context.Context, node *client.Client) (interface{}, error) { return node.Repair(ctx, *target) }
+	case "cancel":
+		fn = func(ctx context.Context, node *client.Client) (interface{}, error) { return node.CancelRepair(ctx) }
+	default:
+		return &usageError{usage}
+	}
+	if args[0] != "start" && len(args) != 1 {
+		return &usageError{usage}
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	results, err := c.onNodes(ctx, fn)
+	if err != nil {
+		return err
+	}
+	return c.printNodes(results, []string{"STATE", "TARGET", "KEYS", "BATCHES", "MISMATCHED", "REPAIRED", "ERRORS"}, func(result interface{}) [][]interface{} {
+		s := result.(client.Status)
+		target := status(s, "node")
+		if target == "-" {
+			target = "all"
+		}
+		return [][]interface{}{{
+			status(s, "state"), target, status(s, "scanned_keys"), status(s, "batches"),
+			status(s, "mismatched_batches"), status(s, "repaired_keys"), status(s, "errors"),
+		}}
+	})
+}
+
+func runHints(c *cli, args []string) error {
+	usage := commands["hints"].usage
+	if len(args) == 0 {
+		return &usageError{usage}
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		results, err := c.onNodes(ctx, func(ctx context.Context, node *client.Client) (interface{}, error) { return node.Hints(ctx) })
+		if err != nil {
+			return err
+		}
+		return c.printNodes(results, []string{"TARGET", "HINTS", "OLDEST", "ATTEMPTS"}, func(result interface{}) [][]interface{} {
+			var rows [][]interface{}
+			for _, h := range result.([]client.HintStats) {
+				rows = append(rows, []interface{}{h.Node, h.Hints, h.Oldest, h.Attempts})
+			}
+			return rows
+		})
+
+	case args[0] == "deliver" && len(args) == 1:
+		results, err := c.onNodes(ctx, func(ctx context.Context, node *client.Client) (interface{}, error) {
+			delivered, remaining, err := node.DeliverHints(ctx)
+			return map[string]int{"delivered": delivered, "remaining": remaining}, err
+		})
+		if err != nil {
+			return err
+		}
+		return c.printNodes(results, []string{"DELIVERED", "REMAINING"}, func(result interface{}) [][]interface{} {
+			r := result.(map[string]int)
+			return [][]interface{}{{r["delivered"], r["remaining"]}}
+		})
+
+	case args[0] == "drop" && len(args) == 2:
+		target := args[1]
+		results, err := c.onNodes(ctx, func(ctx context.Context, node *client.Client) (interface{}, error) {
+			dropped, err := node.DropHints(ctx, target)
+			return map[string]int{"dropped": dropped}, err
+		})
+		if err != nil {
+			return err
+		}
+		return c.printNodes(results, []string{"DROPPED"}, func(result interface{}) [][]interface{} {
+			return [][]interface{}{{result.(map[string]int)["dropped"]}}
+		})
+
+	default:
+		return &usageError{usage}
+	}
+}
+
+func runBackup(c *cli, args []string) error {
+	usage := commands["backup"].usage
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	remote := fs.String("remote", "", "Path of the backup file on the node, encrypted with encryption at rest")
+	if err := parse(fs, args, usage, 0, 1); err != nil {
+		return err
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+
+	if *remote != "" {
+		if fs.NArg() != 0 {
+			return &usageError{usage}
+		}
+		results, err := c.onNodes(ctx, func(ctx context.Context, node *client.Client) (interface{}, error) {
+			count, err := node.Backup(ctx, *remote)
+			return map[string]interface{}{"path": *remote, "count": count}, err
+		})
+		if err != nil {
+			return err
+		}
+		return c.printNodes(results, []string{"PATH", "KEYS"}, func(result interface{}) [][]interface{} {
+			r := result.(map[string]interface{})
+			return [][]interface{}{{r["path"], r["count"]}}
+		})
+	}
+
+	if fs.NArg() != 1 {
+		return &usageError{usage}
+	}
+	items, err := c.nodeClient().BackupItems(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := fs.Arg(0)
+	if file == "-" {
+		_, err := fmt.Fprintln(c.stdout, string(data))
+		return err
+	}
+	if err := os.WriteFile(file, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return c.print(map[string]interface{}{"file": file, "count": len(items)}, func(t *table) {
+		t.line("Saved %d keys to %s", len(items), file)
+	})
+}
+
+func runRestore(c *cli, args []string) error {
+	usage := commands["restore"].usage
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	remote := fs.String("remote", "", "Path of a backup file on the node")
+	if err := parse(fs, args, usage, 0, 1); err != nil {
+		return err
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+
+	var count int
+	var source string
+	switch {
+	case *remote != "" && fs.NArg() == 0:
+		var err error
+		if count, err = c.nodeClient().Restore(ctx, *remote); err != nil {
+			return err
+		}
+		source = *remote
+	case *remote == "" && fs.NArg() == 1:
+		source = fs.Arg(0)
+		var data []byte
+		var err error
+		if source == "-" {
+			data, err = io.ReadAll(c.stdin)
+		} else {
+			data, err = os.ReadFile(source)
+		}
+		if err != nil {
+			return err
+		}
+		var items []client.KeyValue
+		if err := json.Unmarshal(data, &items); err != nil {
+			return fmt.Errorf("%s: not a backup written by distorectl backup: %w", source, err)
+		}
+		if count, err = c.nodeClient().RestoreItems(ctx, items); err != nil {
+			return err
+		}
+	default:
+		return &usageError{usage}
+	}
+	return c.print(map[string]interface{}{"source": source, "count": count}, func(t *table) {
+		t.line("Restored %d keys from %s", count, source)
+	})
+}
+
+func runConfig(c *cli, args []string) error {
+	usage := commands["config"].usage
+	if len(args) == 0 {
+		return &usageError{usage}
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+
+	var s client.Status
+	var err error
+	switch args[0] {
+	case "get":
+		if len(args) != 1 {
+			return &usageError{usage}
+		}
+		s, err = c.nodeClient().Config(ctx)
+	case "set":
+		if len(args) < 2 {
+			return &usageError{usage}
+		}
+		var nodes []string
+		var replicas *int
+		for _, arg := range args[1:] {
+			name, value, ok := strings.Cut(arg, "=")
+			switch {
+			case ok && name == "nodes":
+				nodes = strings.Split(value, ",")
+			case ok && name == "replica_count":
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return fmt.Errorf("invalid replica_count %q", value)
+				}
+				replicas = &n
+			default:
+				return fmt.Errorf("cannot set %q: the settings are nodes=a,b and replica_count=N, the others are changed in the config file with config reload", arg)
+			}
+		}
+		s, err = c.nodeClient().UpdateConfig(ctx, nodes, replicas)
+	case "reload":
+		if len(args) != 1 {
+			return &usageError{usage}
+		}
+		results, err := c.onNodes(ctx, func(ctx context.Context, node *client.Client) (interface{}, error) { return node.ReloadConfig(ctx) })
+		if err != nil {
+			return err
+		}
+		return c.printNodes(results, []string{"RESULT"}, func(result interface{}) [][]interface{} {
+			return [][]interface{}{{result}}
+		})
+	default:
+		return &usageError{usage}
+	}
+	if err != nil {
+		return err
+	}
+	return c.print(s, func(t *table) { t.fields(s) })
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"distore/client"
+)
+
+func runGet(c *cli, args []string) error {
+	if len(args) != 1 {
+		return &usageError{commands["get"].usage}
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	value, err := c.connect().Get(ctx, args[0])
+	if errors.Is(err, client.ErrNotFound) {
+		return fmt.Errorf("%s: key not found", args[0])
+	} else if err != nil {
+		return err
+	}
+	return c.print(client.KeyValue{Key: args[0], Value: value}, func(t *table) {
+		t.line("%s", value)
+	})
+}
+
+// valueArg returns a value argument, "-" reading it from stdin
+func (c *cli) valueArg(arg string) (string, error) {
+	if arg != "-" {
+		return arg, nil
+	}
+	data, err := io.ReadAll(c.stdin)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+func runSet(c *cli, args []string) error {
+	usage := commands["set"].usage
+	fs := flag.NewFlagSet("set", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "Expire the key after this long")
+	if err := parse(fs, args, usage, 2, 2); err != nil {
+		return err
+	}
+	return c.set(fs.Arg(0), fs.Arg(1), *ttl)
+}
+
+func runTTL(c *cli, args []string) error {
+	if len(args) != 3 {
+		return &usageError{commands["ttl"].usage}
+	}
+	ttl, err := time.ParseDuration(args[2])
+	if err != nil || ttl <= 0 {
+		return fmt.Errorf("invalid duration %q, e.g. 90s or 1h", args[2])
+	}
+	return c.set(args[0], args[1], ttl)
+}
+
+func (c *cli) set(key, arg string, ttl time.Duration) error {
+	value, err := c.valueArg(arg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	if ttl > 0 {
+		if ttl < time.Second {
+			return errors.New("the ttl is counted in seconds")
+		}
+		err = c.connect().SetWithTTL(ctx, key, value, ttl)
+	} else {
+		err = c.connect().Set(ctx, key, value)
+	}
+	if err != nil {
+		return err
+	}
+	result := map[string]interface{}{"key": key, "status": "created"}
+	if ttl > 0 {
+		result["ttl"] = int64(ttl / time.Second)
+	}
+	return c.print(result, func(t *table) { t.line("OK") })
+}
+
+func runDel(c *cli, args []string) error {
+	if len(args) != 1 {
+		return &usageError{commands["del"].usage}
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	err := c.connect().Delete(ctx, args[0])
+	if errors.Is(err, client.ErrNotFound) {
+		return fmt.Errorf("%s: key not found", args[0])
+	} else if err != nil {
+		return err
+	}
+	return c.print(map[string]string{"key": args[0], "status": "deleted"}, func(t *table) { t.line("OK") })
+}
+
+func runScan(c *cli, args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "Only the keys starting with this")
+	limit := fs.Int("limit", 0, "Most keys listed, 0 for all")
+	keysOnly := fs.Bool("keys", false, "List the keys without their values")
+	if err := parse(fs, args, commands["scan"].usage, 0, 0); err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	all, err := c.connect().Keys(ctx)
+	if err != nil {
+		return err
+	}
+	items := make([]client.KeyValue, 0, len(all))
+	for _, item := range all {
+		if strings.HasPrefix(item.Key, *prefix) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	if *limit > 0 && len(items) > *limit {
+		items = items[:*limit]
+	}
+
+	if *keysOnly {
+		keys := make([]string, len(items))
+		for i, item := range items {
+			keys[i] = item.Key
+		}
+		return c.print(keys, func(t *table) {
+			for _, key := range keys {
+				t.line("%s", key)
+			}
+		})
+	}
+	return c.print(items, func(t *table) {
+		t.header("KEY", "VALUE")
+		for _, item := range items {
+			t.row(item.Key, item.Value)
+		}
+	})
+}
+
+func runIncr(c *cli, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return &usageError{commands["incr"].usage}
+	}
+	delta := int64(1)
+	if len(args) == 2 {
+		var err error
+		if delta, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return fmt.Errorf("invalid delta %q", args[1])
+		}
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	value, err := c.connect().Increment(ctx, args[0], delta)
+	if err != nil {
+		return err
+	}
+	return c.print(map[string]interface{}{"key": args[0], "value": value}, func(t *table) {
+		t.line("%d", value)
+	})
+}
+
+func runCAS(c *cli, args []string) error {
+	fs := flag.NewFlagSet("cas", flag.ContinueOnError)
+	version := fs.Int64("version", 0, "Also require this version, 0 for any")
+	if err := parse(fs, args, commands["cas"].usage, 3, 3); err != nil {
+		return err
+	}
+	key, expected := fs.Arg(0), fs.Arg(1)
+	newValue, err := c.valueArg(fs.Arg(2))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	result, err := c.connect().CompareAndSet(ctx, key, expected, newValue, *version)
+	if err != nil {
+		return err
+	}
+	out := map[string]interface{}{"key": key, "success": result.Success, "version": result.Version}
+	if !result.Success {
+		out["current_value"] = result.CurrentValue
+	}
+	if err := c.print(out, func(t *table) {
+		if result.Success {
+			t.line("OK, version %d", result.Version)
+		} else {
+			t.line("FAILED, current value %q at version %d", result.CurrentValue, result.Version)
+		}
+	}); err != nil {
+		return err
+	}
+	if !result.Success {
+		return &exitError{1}
+	}
+	return nil
+}
+
+func runLock(c *cli, args []string) error {
+	usage := commands["lock"].usage
+	if len(args) == 0 {
+		return &usageError{usage}
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+
+	switch args[0] {
+	case "acquire":
+		fs := flag.NewFlagSet("lock acquire", flag.ContinueOnError)
+		ttl := fs.Duration("ttl", 30*time.Second, "Release the lock after this long")
+		if err := parse(fs, args[1:], usage, 1, 1); err != nil {
+			return err
+		}
+		key := fs.Arg(0)
+		acquired, err := c.connect().AcquireLock(ctx, key, *ttl)
+		if err != nil {
+			return err
+		}
+		if err := c.print(map[string]interface{}{"key": key, "acquired": acquired}, func(t *table) {
+			if acquired {
+				t.line("Acquired %s for %s", key, *ttl)
+			} else {
+				t.line("%s is held", key)
+			}
+		}); err != nil {
+			return err
+		}
+		if !acquired {
+			return &exitError{1}
+		}
+		return nil
+
+	case "release":
+		if len(args) != 2 {
+			return &usageError{usage}
+		}
+		if err := c.connect().ReleaseLock(ctx, args[1]); err != nil {
+			return err
+		}
+		return c.print(map[string]interface{}{"key": args[1], "released": true}, func(t *table) {
+			t.line("Released %s", args[1])
+		})
+
+	default:
+		return &usageError{usage}
+	}
+}
@@ -0,0 +1,186 @@
+// Command distorectl is the command line client of distore: data
+// operations, cluster administration, and profiles for several clusters.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"distore/client"
+)
+
+// command is a subcommand of distorectl
+type command struct {
+	usage string
+	help  string
+	run   func(c *cli, args []string) error
+}
+
+// commands is filled in init as the commands read their own usage
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"get":     {"get KEY", "Read a key", runGet},
+		"set":     {"set [-ttl DURATION] KEY VALUE", "Write a key, VALUE - reads it from stdin", runSet},
+		"del":     {"del KEY", "Delete a key", runDel},
+		"scan":    {"scan [-prefix PREFIX] [-limit N] [-keys]", "List keys with their values", runScan},
+		"ttl":     {"ttl KEY VALUE DURATION", "Write a key that expires after DURATION", runTTL},
+		"incr":    {"incr KEY [DELTA]", "Add DELTA (default 1) to a counter", runIncr},
+		"cas":     {"cas [-version N] KEY EXPECTED NEW", "Write NEW if KEY holds EXPECTED, \"\" for a missing key", runCAS},
+		"lock":    {"lock acquire [-ttl DURATION] KEY | release KEY", "Take or release a lock", runLock},
+		"nodes":   {"nodes list | status | add NODE | remove NODE", "List and change the members", runNodes},
+		"cluster": {"cluster status", "Health, read-only mode, rebalance, repair and hints of each node", runCluster},
+		"rebalance": {"rebalance status | start [-full] | pause | resume | cancel",
+			"Move data to the nodes that own it", runRebalance},
+		"repair": {"repair status | start [-target NODE] | cancel",
+			"Copy each node's values to the replicas that differ", runRepair},
+		"hints":   {"hints list | deliver | drop NODE", "Writes kept for unreachable nodes", runHints},
+		"backup":  {"backup FILE | backup -remote PATH", "Save the data of a node to a local file, or to a file on the node", runBackup},
+		"restore": {"restore FILE | restore -remote PATH", "Load a backup into the cluster", runRestore},
+		"config":  {"config get | set KEY=VALUE... | reload", "Members and replica count, nodes=a,b replica_count=N", runConfig},
+		"login":   {"login [-user ID | -client ID | -api-key] [-password-stdin]", "Get a token and keep it in the profile", runLogin},
+		"logout":  {"logout", "Revoke the token of the profile", runLogout},
+		"profile": {"profile list | show | use NAME | set NAME [flags] | delete NAME", "Manage the profiles of clusters", runProfile},
+	}
+}
+
+// usageError is a command used wrongly, exiting with 2
+type usageError struct{ usage string }
+
+func (e *usageError) Error() string { return "usage: distorectl " + e.usage }
+
+// exitError exits with code after its output was printed
+type exitError struct{ code int }
+
+func (e *exitError) Error() string { return fmt.Sprintf("exit status %d", e.code) }
+
+// cli is the state of a run
+type cli struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	output         string // "table" or "json"
+	timeout        time.Duration
+
+	profiles    *profileFile
+	profileName string
+	endpoints   []string // from -endpoint, override the profile's
+	token       string   // from -token or DISTORE_TOKEN
+	node        string   // from -node, pins the node-local commands
+
+	client *client.Client
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("distorectl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { printUsage(stderr, fs) }
+	profilesPath := fs.String("config", os.Getenv("DISTORECTL_CONFIG"), "Profiles file (default <user config dir>/distore/profiles.json)")
+	profile := fs.String("profile", os.Getenv("DISTORECTL_PROFILE"), "Profile to use (default the current one)")
+	endpoint := fs.String("endpoint", "", "Comma-separated node URLs, instead of the profile's")
+	token := fs.String("token", os.Getenv("DISTORE_TOKEN"), "Bearer token, instead of the profile's")
+	node := fs.String("node", "", "Node of the node-local commands, all nodes when empty")
+	output := fs.String("o", "table", "Output format: table or json")
+	timeout := fs.Duration("timeout", 30*time.Second, "Timeout of the command")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		printUsage(stderr, fs)
+		return 2
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(stderr, "distorectl: unknown output format %q\n", *output)
+		return 2
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "distorectl: unknown command %q\n", fs.Arg(0))
+		printUsage(stderr, fs)
+		return 2
+	}
+
+	profiles, err := loadProfiles(*profilesPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "distorectl: %v\n", err)
+		return 1
+	}
+	c := &cli{
+		stdin:       stdin,
+		stdout:      stdout,
+		stderr:      stderr,
+		output:      *output,
+		timeout:     *timeout,
+		profiles:    profiles,
+		profileName: profiles.name(*profile),
+		token:       *token,
+		node:        *node,
+	}
+	if *endpoint != "" {
+		c.endpoints = strings.Split(*endpoint, ",")
+	}
+
+	err = cmd.run(c, fs.Args()[1:])
+	if c.client != nil {
+		c.client.Close()
+	}
+	if saveErr := c.profiles.saveIfChanged(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+
+	var usage *usageError
+	var exit *exitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &usage):
+		fmt.Fprintln(stderr, usage.Error())
+		return 2
+	case errors.As(err, &exit):
+		return exit.code
+	default:
+		fmt.Fprintf(stderr, "distorectl: %v\n", err)
+		return 1
+	}
+}
+
+func printUsage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintln(w, "usage: distorectl [flags] COMMAND [args]")
+	fmt.Fprintln(w, "\nCommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-60s %s\n", commands[name].usage, commands[name].help)
+	}
+	fmt.Fprintln(w, "\nFlags:")
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// context returns the context of the command, bounded by -timeout
+func (c *cli) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+// parse parses the flags of a subcommand, which come before its arguments
+func parse(fs *flag.FlagSet, args []string, usage string, min, max int) error {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil || fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		return &usageError{usage}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"distore/api"
+	"distore/storage"
+	"distore/testutils"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestNode starts a single node serving the routes distorectl uses
+func newTestNode(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	base := storage.NewMemoryStorage()
+	replicator := testutils.NewMockReplicator([]string{addr}, 1)
+	h := api.NewHandlers(base, replicator, nil)
+	hTTL := api.NewHandlers(storage.NewTTLStorage(base, time.Minute), replicator, nil)
+	hAtomic := api.NewHandlers(storage.NewAtomicStorage(base), replicator, nil)
+	hCAS := api.NewHandlers(storage.NewCASStorage(base), replicator, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/health", h.HealthHandler).Methods("GET")
+	router.HandleFunc("/set", h.SetHandler).Methods("POST")
+	router.HandleFunc("/get/{key}", h.GetHandler).Methods("GET")
+	router.HandleFunc("/delete/{key}", h.DeleteHandler).Methods("DELETE")
+	router.HandleFunc("/keys", h.GetAllHandler).Methods("GET")
+	router.HandleFunc("/cluster/nodes", h.ClusterNodesHandler).Methods("GET")
+	router.HandleFunc("/advanced/ttl", hTTL.TTLHandler).Methods("POST")
+	router.HandleFunc("/advanced/increment", hAtomic.IncrementHandler).Methods("POST")
+	router.HandleFunc("/advanced/cas", hCAS.CASHandler).Methods("POST")
+	router.HandleFunc("/admin/nodes", h.ListNodesHandler).Methods("GET")
+	router.HandleFunc("/admin/config", h.GetConfigHandler).Methods("GET")
+	router.HandleFunc("/admin/backup", h.BackupHandler).Methods("POST")
+	router.HandleFunc("/admin/restore", h.RestoreHandler).Methods("POST")
+
+	server := &httptest.Server{Listener: l, Config: &http.Server{Handler: router}}
+	server.Start()
+	t.Cleanup(server.Close)
+	return addr
+}
+
+// distorectl runs the command with a profiles file of its own
+func distorectl(t *testing.T, config, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"-config", config, "-timeout", "5s"}, args...), strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestDataCommands(t *testing.T) {
+	addr := newTestNode(t)
+	config := filepath.Join(t.TempDir(), "profiles.json")
+	ep := "-endpoint=" + addr
+
+	if code, out, errOut := distorectl(t, config, "", ep, "set", "greeting", "hello"); code != 0 || out != "OK\n" {
+		t.Fatalf("set: expected OK, got %d %q %q", code, out, errOut)
+	}
+	if code, out, _ := distorectl(t, config, "", ep, "get", "greeting"); code != 0 || out != "hello\n" {
+		t.Errorf("get: expected hello, got %d %q", code, out)
+	}
+	if code, _, _ := distorectl(t, config, "from stdin\n", ep, "set", "piped", "-"); code != 0 {
+		t.Errorf("set from stdin failed with %d", code)
+	}
+
+	code, out, _ := distorectl(t, config, "", ep, "-o", "json", "get", "piped")
+	var kv map[string]string
+	if err := json.Unmarshal([]byte(out), &kv); code != 0 || err != nil || kv["value"] != "from stdin" {
+		t.Errorf("get -o json: expected the value read from stdin, got %d %q", code, out)
+	}
+
+	code, out, _ = distorectl(t, config, "", ep, "-o", "json", "scan", "-keys", "-prefix", "gr")
+	var keys []string
+	if err := json.Unmarshal([]byte(out), &keys); code != 0 || err != nil || len(keys) != 1 || keys[0] != "greeting" {
+		t.Errorf("scan: expected [greeting], got %d %q", code, out)
+	}
+
+	if code, out, _ := distorectl(t, config, "", ep, "incr", "hits", "3"); code != 0 || out != "3\n" {
+		t.Errorf("incr: expected 3, got %d %q", code, out)
+	}
+	if code, _, _ := distorectl(t, config, "", ep, "cas", "greeting", "hello", "bye"); code != 0 {
+		t.Errorf("cas: expected success, got %d", code)
+	}
+	if code, out, _ := distorectl(t, config, "", ep, "cas", "greeting", "hello", "again"); code != 1 || !strings.Contains(out, "FAILED") {
+		t.Errorf("cas: expected a failed swap to exit with 1, got %d %q", code, out)
+	}
+
+	if code, _, _ := distorectl(t, config, "", ep, "del", "greeting"); code != 0 {
+		t.Errorf("del failed with %d", code)
+	}
+	if code, _, errOut := distorectl(t, config, "", ep, "get", "greeting"); code != 1 || !strings.Contains(errOut, "key not found") {
+		t.Errorf("get: expected a missing key to exit with 1, got %d %q", code, errOut)
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	addr := newTestNode(t)
+	dir := t.TempDir()
+	config := filepath.Join(dir, "profiles.json")
+	ep := "-endpoint=" + addr
+
+	distorectl(t, config, "", ep, "set", "a", "1")
+	code, out, errOut := distorectl(t, config, "", ep, "cluster", "status")
+	if code != 0 || !strings.Contains(out, addr) || !strings.Contains(out, "1 nodes, 0 down") {
+		t.Errorf("cluster status: expected the node up, got %d %q %q", code, out, errOut)
+	}
+	if code, out, _ := distorectl(t, config, "", ep, "nodes", "list"); code != 0 || !strings.Contains(out, addr) {
+		t.Errorf("nodes list: expected %s, got %d %q", addr, code, out)
+	}
+
+	backup := filepath.Join(dir, "backup.json")
+	if code, _, errOut := distorectl(t, config, "", ep, "backup", backup); code != 0 {
+		t.Fatalf("backup failed with %d %q", code, errOut)
+	}
+	distorectl(t, config, "", ep, "del", "a")
+	if code, out, _ := distorectl(t, config, "", ep, "restore", backup); code != 0 || !strings.Contains(out, "Restored 1 keys") {
+		t.Errorf("restore: expected 1 key, got %d %q", code, out)
+	}
+	if code, out, _ := distorectl(t, config, "", ep, "get", "a"); code != 0 || out != "1\n" {
+		t.Errorf("Expected the restored value, got %d %q", code, out)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	addr := newTestNode(t)
+	config := filepath.Join(t.TempDir(), "profiles.json")
+
+	if code, _, errOut := distorectl(t, config, "", "profile", "set", "-endpoint", addr, "local"); code != 0 {
+		t.Fatalf("profile set failed with %d %q", code, errOut)
+	}
+	distorectl(t, config, "", "profile", "set", "-endpoint", "127.0.0.1:1", "other")
+
+	// The first profile saved is the current one
+	if code, out, _ := distorectl(t, config, "", "set", "k", "v"); code != 0 || out != "OK\n" {
+		t.Errorf("Expected the current profile to reach the node, got %d %q", code, out)
+	}
+	if code, _, _ := distorectl(t, config, "", "-timeout", "200ms", "-profile", "other", "get", "k"); code != 1 {
+		t.Errorf("Expected -profile other to fail, got %d", code)
+	}
+
+	distorectl(t, config, "", "profile", "use", "other")
+	code, out, _ := distorectl(t, config, "", "-o", "json", "profile", "list")
+	var entries []struct {
+		Name    string `json:"name"`
+		Current bool   `json:"current"`
+	}
+	if err := json.Unmarshal([]byte(out), &entries); code != 0 || err != nil || len(entries) != 2 || !entries[1].Current {
+		t.Errorf("Expected other to be current, got %d %q", code, out)
+	}
+
+	// Tokens are kept in the file, which only its owner reads
+	distorectl(t, config, "secret\n", "profile", "set", "-token", "-", "local")
+	info, err := os.Stat(config)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the profiles file to be private, got %v %v", info.Mode(), err)
+	}
+	data, _ := os.ReadFile(config)
+	if !strings.Contains(string(data), `"token": "secret"`) {
+		t.Errorf("Expected the token to be saved, got %s", data)
+	}
+
+	// Runs that change no profile leave the file alone
+	distorectl(t, config, "", "profile", "show")
+	distorectl(t, config, "", "profile", "set", "local")
+	distorectl(t, config, "", "-profile", "local", "get", "k")
+	if after, err := os.Stat(config); err != nil || !os.SameFile(info, after) {
+		t.Errorf("Expected read-only runs not to rewrite the profiles file, got %v", err)
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "profiles.json")
+	for _, args := range [][]string{
+		{},
+		{"unknown"},
+		{"get"},
+		{"set", "-ttl", "soon", "k", "v"},
+		{"-o", "yaml", "get", "k"},
+		{"rebalance", "status", "extra"},
+	} {
+		if code, _, _ := distorectl(t, config, "", args...); code != 2 {
+			t.Errorf("%v: expected exit status 2, got %d", args, code)
+		}
+	}
+	if _, err := os.Stat(config); !os.IsNotExist(err) {
+		t.Error("Expected usage errors not to write the profiles file")
+	}
+}
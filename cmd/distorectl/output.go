@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// table is the output of a command in table format: aligned rows and free
+// lines, in order
+type table struct {
+	lines []string
+}
+
+func (t *table) header(columns ...string) {
+	t.lines = append(t.lines, strings.Join(columns, "\t"))
+}
+
+func (t *table) row(cells ...interface{}) {
+	formatted := make([]string, len(cells))
+	for i, cell := range cells {
+		formatted[i] = formatCell(cell)
+	}
+	t.lines = append(t.lines, strings.Join(formatted, "\t"))
+}
+
+func (t *table) line(format string, args ...interface{}) {
+	t.lines = append(t.lines, fmt.Sprintf(format, args...))
+}
+
+// fields prints an object as FIELD VALUE rows, nested objects with dotted
+// names
+func (t *table) fields(object map[string]interface{}) {
+	flat := make(map[string]interface{})
+	flatten("", object, flat)
+	names := make([]string, 0, len(flat))
+	for name := range flat {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t.row(name, flat[name])
+	}
+}
+
+func flatten(prefix string, object map[string]interface{}, flat map[string]interface{}) {
+	for name, value := range object {
+		if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+			flatten(prefix+name+".", nested, flat)
+			continue
+		}
+		flat[prefix+name] = value
+	}
+}
+
+func formatCell(cell interface{}) string {
+	switch v := cell.(type) {
+	case nil:
+		return "-"
+	case string:
+		if v == "" || strings.HasPrefix(v, "0001-01-01T") { // zero times of the API
+			return "-"
+		}
+		return v
+	case time.Time:
+		if v.IsZero() {
+			return "-"
+		}
+		return v.Local().Format(time.RFC3339)
+	case []string:
+		if len(v) == 0 {
+			return "-"
+		}
+		return strings.Join(v, ",")
+	case float64:
+		return fmt.Sprintf("%g", v)
+	case bool, int, int64:
+		return fmt.Sprint(v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	}
+}
+
+// print writes value as JSON with -o json, or the table fill builds
+func (c *cli) print(value interface{}, fill func(t *table)) error {
+	if c.output == "json" {
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stdout, string(data))
+		return nil
+	}
+	t := &table{}
+	fill(t)
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	for _, line := range t.lines {
+		fmt.Fprintln(w, line)
+	}
+	return w.Flush()
+}
+
+// status reads a field of an admin answer as a cell
+func status(s map[string]interface{}, field string) string {
+	return formatCell(s[field])
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"distore/client"
+
+	"golang.org/x/term"
+)
+
+const defaultEndpoint = "http://localhost:8080"
+
+// Profile is how distorectl reaches a cluster
+type Profile struct {
+	Endpoints []string `json:"endpoints"`
+	Token     string   `json:"token,omitempty"` // static token, e.g. of a service
+
+	// Kept by login. Refresh tokens are used once, each run saves the
+	// latest.
+	User         string    `json:"user,omitempty"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	Expires      time.Time `json:"expires,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+}
+
+func (p *Profile) setTokens(pair client.TokenPair) {
+	p.AccessToken, p.RefreshToken = pair.Token, pair.RefreshToken
+	p.Expires = time.Now().Add(time.Duration(pair.ExpiresIn) * time.Second).UTC().Truncate(time.Second)
+}
+
+// profileFile is the file holding the profiles, readable by the owner only
+// as it holds tokens
+type profileFile struct {
+	Current  string              `json:"current"`
+	Profiles map[string]*Profile `json:"profiles"`
+
+	path    string
+	changed bool
+}
+
+func loadProfiles(path string) (*profileFile, error) {
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "distore", "profiles.json")
+	}
+	f := &profileFile{path: path, Profiles: make(map[string]*Profile)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if f.Profiles == nil {
+		f.Profiles = make(map[string]*Profile)
+	}
+	return f, nil
+}
+
+// name returns the profile to use: flag, then the current one, then
+// "default"
+func (f *profileFile) name(flag string) string {
+	switch {
+	case flag != "":
+		return flag
+	case f.Current != "":
+		return f.Current
+	default:
+		return "default"
+	}
+}
+
+// profile returns the profile called name, creating it. Callers changing
+// the profile mark the file changed themselves.
+func (f *profileFile) profile(name string) *Profile {
+	p, ok := f.Profiles[name]
+	if !ok {
+		p = &Profile{}
+		f.Profiles[name] = p
+		if f.Current == "" {
+			f.Current = name
+		}
+		f.changed = true
+	}
+	return p
+}
+
+func (f *profileFile) saveIfChanged() error {
+	if !f.changed {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	f.changed = false
+	return os.Rename(tmp, f.path)
+}
+
+// endpointURLs adds the scheme to endpoints given as host:port
+func endpointURLs(endpoints []string) []string {
+	urls := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		if !strings.Contains(e, "://") {
+			e = "http://" + e
+		}
+		urls = append(urls, strings.TrimSuffix(e, "/"))
+	}
+	return urls
+}
+
+// endpointsOf returns the endpoints of a run: -endpoint, then the
+// profile's, then DISTORE_ENDPOINT, then localhost
+func (c *cli) endpointsOf(p *Profile) []string {
+	switch {
+	case len(c.endpoints) > 0:
+		return endpointURLs(c.endpoints)
+	case p != nil && len(p.Endpoints) > 0:
+		return endpointURLs(p.Endpoints)
+	case os.Getenv("DISTORE_ENDPOINT") != "":
+		return endpointURLs(strings.Split(os.Getenv("DISTORE_ENDPOINT"), ","))
+	default:
+		return []string{defaultEndpoint}
+	}
+}
+
+// connect returns the client of the run, authenticated with -token, the
+// static token of the profile, or the tokens kept by login
+func (c *cli) connect() *client.Client {
+	if c.client != nil {
+		return c.client
+	}
+	p := c.profiles.Profiles[c.profileName]
+	cfg := client.Config{Endpoints: c.endpointsOf(p)}
+	switch {
+	case c.token != "":
+		cfg.Token = c.token
+	case p == nil:
+	case p.Token != "":
+		cfg.Token = p.Token
+	case p.AccessToken != "" && time.Until(p.Expires) > time.Minute:
+		cfg.Token = p.AccessToken
+	case p.RefreshToken != "":
+		cfg.Credentials = &client.Credentials{RefreshToken: p.RefreshToken}
+		cfg.OnToken = func(pair client.TokenPair) {
+			p.setTokens(pair)
+			c.profiles.changed = true
+		}
+	}
+	c.client = client.New(cfg)
+	return c.client
+}
+
+// readSecret reads a password or key: the first line of stdin, or a
+// prompt without echo on a terminal
+func (c *cli) readSecret(prompt string, fromStdin bool) (string, error) {
+	if f, ok := c.stdin.(*os.File); ok && !fromStdin && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(c.stderr, prompt)
+		secret, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(c.stderr)
+		return string(secret), err
+	}
+	line, err := bufio.NewReader(c.stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading the secret from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func runLogin(c *cli, args []string) error {
+	usage := commands["login"].usage
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	user := fs.String("user", "", "User ID, logging in with its password")
+	clientID := fs.String("client", "", "Client ID, logging in with its secret")
+	apiKey := fs.Bool("api-key", false, "Log in with an API key")
+	fromStdin := fs.Bool("password-stdin", false, "Read the password, secret or key from stdin")
+	if err := parse(fs, args, usage, 0, 0); err != nil {
+		return err
+	}
+
+	var creds client.Credentials
+	var who string
+	switch {
+	case *user != "":
+		password, err := c.readSecret("Password: ", *fromStdin)
+		if err != nil {
+			return err
+		}
+		creds, who = client.Credentials{UserID: *user, Password: password}, *user
+	case *clientID != "":
+		secret, err := c.readSecret("Client secret: ", *fromStdin)
+		if err != nil {
+			return err
+		}
+		creds, who = client.Credentials{ClientID: *clientID, ClientSecret: secret}, *clientID
+	case *apiKey:
+		key, err := c.readSecret("API key: ", *fromStdin)
+		if err != nil {
+			return err
+		}
+		creds, who = client.Credentials{APIKey: key}, "api key"
+	default:
+		return &usageError{usage}
+	}
+
+	p := c.profiles.profile(c.profileName)
+	if len(c.endpoints) > 0 {
+		p.Endpoints, c.profiles.changed = c.endpoints, true
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	cl := client.New(client.Config{Endpoints: c.endpointsOf(p), Credentials: &creds, DisableDiscovery: true})
+	defer cl.Close()
+	pair, err := cl.Login(ctx)
+	if err != nil {
+		return err
+	}
+	p.Token, p.User = "", who
+	p.setTokens(*pair)
+	c.profiles.changed = true
+
+	return c.print(map[string]interface{}{"profile": c.profileName, "user": who, "expires": p.Expires}, func(t *table) {
+		t.line("Logged in to %s as %s, token valid until %s", c.profileName, who, p.Expires.Local().Format(time.RFC3339))
+	})
+}
+
+func runLogout(c *cli, args []string) error {
+	if len(args) > 0 {
+		return &usageError{commands["logout"].usage}
+	}
+	p, ok := c.profiles.Profiles[c.profileName]
+	if !ok || p.RefreshToken == "" {
+		return fmt.Errorf("profile %s is not logged in", c.profileName)
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	cl := client.New(client.Config{
+		Endpoints:        c.endpointsOf(p),
+		Credentials:      &client.Credentials{RefreshToken: p.RefreshToken},
+		DisableDiscovery: true,
+	})
+	defer cl.Close()
+	_, err := cl.Login(ctx)
+	if err == nil {
+		err = cl.Logout(ctx)
+	}
+	// The tokens are forgotten even when the server already refused them
+	p.User, p.AccessToken, p.RefreshToken, p.Expires = "", "", "", time.Time{}
+	c.profiles.changed = true
+	if err != nil {
+		return fmt.Errorf("logged out locally, revoking the token failed: %w", err)
+	}
+	return c.print(map[string]string{"profile": c.profileName}, func(t *table) {
+		t.line("Logged out of %s", c.profileName)
+	})
+}
+
+func runProfile(c *cli, args []string) error {
+	usage := commands["profile"].usage
+	if len(args) == 0 {
+		return &usageError{usage}
+	}
+	f := c.profiles
+	switch args[0] {
+	case "list":
+		names := make([]string, 0, len(f.Profiles))
+		for name := range f.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		type entry struct {
+			Name      string   `json:"name"`
+			Current   bool     `json:"current"`
+			Endpoints []string `json:"endpoints"`
+			User      string   `json:"user,omitempty"`
+		}
+		entries := make([]entry, 0, len(names))
+		for _, name := range names {
+			p := f.Profiles[name]
+			entries = append(entries, entry{Name: name, Current: name == f.Current, Endpoints: p.Endpoints, User: p.User})
+		}
+		return c.print(entries, func(t *table) {
+			t.header("CURRENT", "NAME", "ENDPOINTS", "USER")
+			for _, e := range entries {
+				current := ""
+				if e.Current {
+					current = "*"
+				}
+				t.row(current, e.Name, strings.Join(e.Endpoints, ","), e.User)
+			}
+		})
+
+	case "show":
+		p, ok := f.Profiles[c.profileName]
+		if !ok {
+			return fmt.Errorf("no profile %s", c.profileName)
+		}
+		shown := map[string]interface{}{"name": c.profileName, "endpoints": p.Endpoints, "user": p.User}
+		switch {
+		case p.Token != "":
+			shown["auth"] = "static token"
+		case p.RefreshToken != "":
+			shown["auth"] = "login"
+			shown["expires"] = p.Expires
+		default:
+			shown["auth"] = "none"
+		}
+		return c.print(shown, func(t *table) { t.fields(shown) })
+
+	case "use":
+		if len(args) != 2 {
+			return &usageError{usage}
+		}
+		if _, ok := f.Profiles[args[1]]; !ok {
+			return fmt.Errorf("no profile %s", args[1])
+		}
+		f.Current, f.changed = args[1], true
+		return c.print(map[string]string{"current": args[1]}, func(t *table) {
+			t.line("Using profile %s", args[1])
+		})
+
+	case "set":
+		fs := flag.NewFlagSet("profile set", flag.ContinueOnError)
+		endpoints := fs.String("endpoint", "", "Comma-separated node URLs")
+		token := fs.String("token", "", "Static bearer token, \"-\" reads it from stdin")
+		if err := parse(fs, args[1:], "profile set [-endpoint URLS] [-token TOKEN] NAME", 1, 1); err != nil {
+			return err
+		}
+		p := f.profile(fs.Arg(0))
+		if *endpoints != "" {
+			p.Endpoints, f.changed = strings.Split(*endpoints, ","), true
+		}
+		if *token == "-" {
+			secret, err := c.readSecret("Token: ", true)
+			if err != nil {
+				return err
+			}
+			*token = secret
+		}
+		if *token != "" {
+			p.Token, p.User, p.AccessToken, p.RefreshToken, p.Expires = *token, "", "", "", time.Time{}
+			f.changed = true
+		}
+		return c.print(map[string]interface{}{"name": fs.Arg(0), "endpoints": p.Endpoints}, func(t *table) {
+			t.line("Saved profile %s", fs.Arg(0))
+		})
+
+	case "delete":
+		if len(args) != 2 {
+			return &usageError{usage}
+		}
+		if _, ok := f.Profiles[args[1]]; !ok {
+			return fmt.Errorf("no profile %s", args[1])
+		}
+		delete(f.Profiles, args[1])
+		if f.Current == args[1] {
+			f.Current = ""
+		}
+		f.changed = true
+		return c.print(map[string]string{"deleted": args[1]}, func(t *table) {
+			t.line("Deleted profile %s", args[1])
+		})
+
+	default:
+		return &usageError{usage}
+	}
+}
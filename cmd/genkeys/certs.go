@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"distore/internode"
+)
+
+const day = 24 * time.Hour
+
+// generateCA writes the cluster CA: genkeys ca [-dir certs] [-days 3650]
+func generateCA(args []string) int {
+	fs := flag.NewFlagSet("ca", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "Directory to write ca.pem and ca-key.pem to")
+	name := fs.String("name", "distore cluster CA", "Common name of the CA")
+	days := fs.Int("days", 3650, "Validity in days")
+	fs.Parse(args)
+
+	certFile, keyFile := filepath.Join(*dir, "ca.pem"), filepath.Join(*dir, "ca-key.pem")
+	if _, err := os.Stat(keyFile); err == nil {
+		fmt.Printf("Error: %s already exists, remove it to create a new CA\n", keyFile)
+		return 1
+	}
+
+	_, certPEM, keyPEM, err := internode.NewCA(*name, time.Duration(*days)*day)
+	if err != nil {
+		fmt.Printf("Error generating CA: %v\n", err)
+		return 1
+	}
+	if err := writePEM(*dir, certFile, certPEM, keyFile, keyPEM); err != nil {
+		fmt.Printf("Error writing CA: %v\n", err)
+		return 1
+	}
+
+	fmt.Println("✅ Cluster CA generated successfully:")
+	fmt.Printf("   Certificate: %s\n", certFile)
+	fmt.Printf("   Key:         %s (keep it off the nodes)\n", keyFile)
+	return 0
+}
+
+// generateNodeCert writes a node certificate signed by the cluster CA:
+// genkeys node -name node1 -hosts node1.example.com,10.0.0.1 [-dir certs] [-days 365]
+func generateNodeCert(args []string) int {
+	fs := flag.NewFlagSet("node", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "Directory holding the CA, the certificate is written there too")
+	name := fs.String("name", "", "Node name, used for the file names")
+	hosts := fs.String("hosts", "", "Comma-separated DNS names and IPs peers reach the node at (default: name)")
+	days := fs.Int("days", 365, "Validity in days")
+	fs.Parse(args)
+
+	if *name == "" {
+		fmt.Println("Error: -name is required")
+		return 2
+	}
+	hostList := []string{*name}
+	if *hosts != "" {
+		hostList = nil
+		for _, host := range strings.Split(*hosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hostList = append(hostList, host)
+			}
+		}
+	}
+
+	caCert, err := os.ReadFile(filepath.Join(*dir, "ca.pem"))
+	if err != nil {
+		fmt.Printf("Error reading CA (run 'genkeys ca' first): %v\n", err)
+		return 1
+	}
+	caKey, err := os.ReadFile(filepath.Join(*dir, "ca-key.pem"))
+	if err != nil {
+		fmt.Printf("Error reading CA key: %v\n", err)
+		return 1
+	}
+	ca, err := internode.LoadCA(caCert, caKey)
+	if err != nil {
+		fmt.Printf("Error loading CA: %v\n", err)
+		return 1
+	}
+
+	certPEM, keyPEM, err := ca.IssueNodeCert(*name, hostList, time.Duration(*days)*day)
+	if err != nil {
+		fmt.Printf("Error generating node certificate: %v\n", err)
+		return 1
+	}
+	certFile, keyFile := filepath.Join(*dir, *name+".pem"), filepath.Join(*dir, *name+"-key.pem")
+	if err := writePEM(*dir, certFile, certPEM, keyFile, keyPEM); err != nil {
+		fmt.Printf("Error writing node certificate: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("✅ Certificate for %s generated successfully (hosts: %s):\n", *name, strings.Join(hostList, ", "))
+	fmt.Printf("   Certificate: %s\n", certFile)
+	fmt.Printf("   Key:         %s\n", keyFile)
+	fmt.Println("")
+	fmt.Println("📋 Add them to the node's config.json:")
+	fmt.Println("")
+	fmt.Printf(`{
+  "internode": {
+    "tls": true,
+    "ca_file": "%s",
+    "cert_file": "%s",
+    "key_file": "%s"
+  }
+}
+`, filepath.Join(*dir, "ca.pem"), certFile, keyFile)
+	return 0
+}
+
+func writePEM(dir, certFile string, certPEM []byte, keyFile string, keyPEM []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, keyPEM, 0600)
+}
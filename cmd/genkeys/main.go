@@ -10,6 +10,18 @@ import (
 )
 
 func main() {
+	// Node certificates for internode mTLS
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ca":
+			os.Exit(generateCA(os.Args[2:]))
+		case "node":
+			os.Exit(generateNodeCert(os.Args[2:]))
+		case "master":
+			os.Exit(generateMasterKey(os.Args[2:]))
+		}
+	}
+
 	// Generate private key
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"distore/k8s"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func main() {
+	kubeconfig := flag.String("kubeconfig", "", "Path to a kubeconfig, in-cluster config when empty")
+	namespace := flag.String("namespace", os.Getenv("WATCH_NAMESPACE"), "Namespace to watch, all namespaces when empty")
+	resync := flag.Duration("resync", 5*time.Minute, "Interval of full reconciles")
+	requeue := flag.Duration("requeue", 10*time.Second, "Recheck delay of clusters that are scaling or upgrading")
+	adminToken := flag.String("admin_token", os.Getenv("DISTORE_ADMIN_TOKEN"), "Bearer token for the node admin API")
+	adminScheme := flag.String("admin_scheme", "http", "Scheme of the node admin API (http or https)")
+	flag.Parse()
+
+	restConfig, err := loadRestConfig(*kubeconfig)
+	if err != nil {
+		log.Fatalf("Error loading Kubernetes config: %v", err)
+	}
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		log.Fatalf("Error creating Kubernetes client: %v", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		log.Fatalf("Error creating dynamic client: %v", err)
+	}
+
+	admin := k8s.NewHTTPNodeAdmin(*adminToken)
+	admin.Scheme = *adminScheme
+
+	operator := k8s.NewOperator(kubeClient, dynamicClient, admin, k8s.OperatorOptions{
+		Namespace:      *namespace,
+		ResyncInterval: *resync,
+		RequeueDelay:   *requeue,
+	})
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	log.Printf("Distore operator started (namespace %q)", *namespace)
+	if err := operator.Run(ctx); err != nil {
+		log.Fatalf("Operator failed: %v", err)
+	}
+	log.Println("Distore operator stopped")
+}
+
+func loadRestConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return rest.InClusterConfig()
+}
@@ -1,16 +1,57 @@
 package config
 
-import (
-	"encoding/json"
-	"os"
-)
-
 type AuthConfig struct {
-	Enabled       bool     `json:"enabled"`
-	PrivateKey    string   `json:"private_key"`
-	PublicKey     string   `json:"public_key"`
-	TokenDuration int      `json:"token_duration"` // in seconds
-	DefaultRoles  []string `json:"default_roles"`
+	Enabled              bool                `json:"enabled"`
+	PrivateKey           string              `json:"private_key"`
+	PublicKey            string              `json:"public_key"`
+	PrivateKeyFile       string              `json:"private_key_file"`       // PEM file read instead of private_key
+	PublicKeyFile        string              `json:"public_key_file"`        // PEM file read instead of public_key
+	TokenDuration        int                 `json:"token_duration"`         // in seconds
+	RefreshTokenDuration int                 `json:"refresh_token_duration"` // in seconds, 0 issues no refresh tokens
+	DefaultRoles         []string            `json:"default_roles"`
+	Policy               AccessPolicyConfig  `json:"policy"`
+	Bootstrap            AuthBootstrapConfig `json:"bootstrap"`
+	KeyRotation          KeyRotationConfig   `json:"key_rotation"`
+	OIDC                 []OIDCConfig        `json:"oidc"` // external issuers whose tokens are accepted
+}
+
+// KeyRotationConfig has each node sign with keys it generates and replaces
+// on a schedule. Peers learn the public keys from the cluster metadata.
+type KeyRotationConfig struct {
+	Interval  int    `json:"interval"`  // seconds between rotations, 0 disables
+	Algorithm string `json:"algorithm"` // "ES256" (default), "RS256" or "EdDSA"
+}
+
+// OIDCConfig trusts the tokens of an external OpenID Connect issuer
+type OIDCConfig struct {
+	Issuer        string              `json:"issuer"`         // must equal the iss claim
+	Audience      string              `json:"audience"`       // must be in the aud claim
+	JWKSURL       string              `json:"jwks_url"`       // default: jwks_uri from the issuer's discovery document
+	UserClaim     string              `json:"user_claim"`     // default "sub"
+	RolesClaim    string              `json:"roles_claim"`    // default "roles", dots descend into objects
+	TenantClaim   string              `json:"tenant_claim"`   // default "tenant_id"
+	DefaultTenant string              `json:"default_tenant"` // for tokens without the tenant claim
+	RoleMap       map[string][]string `json:"role_map"`       // issuer role -> roles; when set, unmapped roles are dropped
+}
+
+// AuthBootstrapConfig creates the first cluster admin while no identity
+// exists, so that tokens can be requested at all
+type AuthBootstrapConfig struct {
+	User     string `json:"user"` // defaults to "admin"
+	Password string `json:"password"`
+}
+
+// AccessPolicyConfig grants or denies access to keys on top of the roles
+type AccessPolicyConfig struct {
+	Default string             `json:"default"` // "allow" (default) or "deny" when no rule matches
+	Rules   []PolicyRuleConfig `json:"rules"`
+}
+
+type PolicyRuleConfig struct {
+	Subjects []string `json:"subjects"` // "role:<name>", "user:<id>", "tenant:<id>" or "*"
+	Keys     []string `json:"keys"`     // glob patterns relative to the tenant, * matches any run of characters
+	Access   string   `json:"access"`   // "read", "write" or "admin", each including the previous
+	Effect   string   `json:"effect"`   // "allow" (default) or "deny"
 }
 
 type TLSConfig struct {
@@ -19,6 +60,62 @@ type TLSConfig struct {
 	KeyFile  string `json:"key_file"`
 }
 
+// InternodeConfig secures the /internal routes and the requests nodes send
+// each other
+type InternodeConfig struct {
+	TLS          bool   `json:"tls"`       // mutual TLS with certificates signed by the cluster CA
+	CAFile       string `json:"ca_file"`   // cluster CA certificate
+	CertFile     string `json:"cert_file"` // this node's certificate, used as server and client
+	KeyFile      string `json:"key_file"`
+	ServiceToken bool   `json:"service_token"` // replicator tokens signed with the auth keys
+}
+
+// QuotaConfig limits the request rate and the storage of each tenant, so
+// that one tenant cannot saturate a node
+type QuotaConfig struct {
+	Enabled bool                         `json:"enabled"`
+	Default TenantQuotaConfig            `json:"default"` // tenants without an entry in tenants
+	Tenants map[string]TenantQuotaConfig `json:"tenants"` // replaces default for a tenant
+	Routes  map[string]RateLimitConfig   `json:"routes"`  // per tenant and route, e.g. "POST /advanced/batch"
+}
+
+// TenantQuotaConfig holds the limits of a tenant, 0 meaning no limit
+type TenantQuotaConfig struct {
+	RequestRate  RateLimitConfig `json:"request_rate"` // all requests of the tenant
+	UserRate     RateLimitConfig `json:"user_rate"`    // requests of each user of the tenant
+	MaxKeys      int64           `json:"max_keys"`
+	MaxBytes     int64           `json:"max_bytes"`      // keys and values stored on a node
+	MaxValueSize int64           `json:"max_value_size"` // bytes stored, after compression
+}
+
+// RateLimitConfig is a token bucket
+type RateLimitConfig struct {
+	Rate  float64 `json:"rate"`  // requests per second, 0 for no limit
+	Burst int     `json:"burst"` // default: the rate rounded up
+}
+
+// AuditConfig sets up the hash-chained log of data writes, admin actions
+// and auth events
+type AuditConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Dir           string `json:"dir"`            // default: the audit directory of data_dir
+	Values        string `json:"values"`         // how before and after values are kept: "hash", "full" or "none"
+	Sync          bool   `json:"sync"`           // fsync every event
+	SegmentBytes  int64  `json:"segment_bytes"`  // size at which a new log file is started, default 64 MiB
+	RetentionDays int    `json:"retention_days"` // age at which full log files are deleted, 0 keeps them
+}
+
+// EncryptionConfig sets up the encryption of values at rest, with data keys
+// per tenant wrapped by a master key
+type EncryptionConfig struct {
+	Enabled          bool   `json:"enabled"`
+	KMS              string `json:"kms"`               // "file" (default) or "local", a stand-in for an external KMS
+	MasterKeyFile    string `json:"master_key_file"`   // master keys, created by the local KMS
+	KeyringFile      string `json:"keyring_file"`      // wrapped data keys, default: keyring.json in data_dir
+	RotationInterval int    `json:"rotation_interval"` // seconds between data key rotations, 0 disables
+	ReencryptRate    int    `json:"reencrypt_rate"`    // values re-encrypted per second in the background, default 100
+}
+
 type ReplicationConfig struct {
 	WriteQuorum          int    `json:"write_quorum"`
 	ReadQuorum           int    `json:"read_quorum"`
@@ -27,17 +124,46 @@ type ReplicationConfig struct {
 	CrossDCEnabled       bool   `json:"cross_dc_enabled"`
 	MaxLatencyMs         int    `json:"max_latency_ms"`
 	AsyncReplication     bool   `json:"async_replication"`
+	CrossDCBatchSize     int    `json:"cross_dc_batch_size"`        // entries per shipped batch
+	CrossDCFlushInterval int    `json:"cross_dc_flush_interval_ms"` // queue drain interval without new writes
 }
 
 type FailoverConfig struct {
-	CheckInterval int `json:"check_interval_seconds"`
-	Timeout       int `json:"timeout_seconds"`
+	CheckInterval              int     `json:"check_interval_seconds"`
+	Timeout                    int     `json:"timeout_seconds"`
+	PhiThreshold               float64 `json:"phi_threshold"`         // node is marked down above this value
+	SuspectPhiThreshold        float64 `json:"suspect_phi_threshold"` // node is marked suspect above this value
+	MaxSampleSize              int     `json:"max_sample_size"`       // heartbeat intervals kept per node
+	MinStdDeviationMs          int     `json:"min_std_deviation_ms"`
+	AcceptableHeartbeatPauseMs int     `json:"acceptable_heartbeat_pause_ms"`
+	RecoveryProbes             int     `json:"recovery_probes"`               // successful probes needed to leave down state
+	ReadOnlyEnterDelay         int     `json:"read_only_enter_delay_seconds"` // quorum must be lost this long before writes stop
+	ReadOnlyExitDelay          int     `json:"read_only_exit_delay_seconds"`  // quorum must be back this long before writes resume
 }
 
 type RepairConfig struct {
 	SyncInterval int `json:"sync_interval_seconds"`
 }
 
+type RebalanceConfig struct {
+	BatchSize            int      `json:"batch_size"`              // keys per streamed batch
+	BandwidthBytesPerSec int64    `json:"bandwidth_bytes_per_sec"` // 0 means unlimited
+	VirtualNodes         int      `json:"virtual_nodes"`           // ring tokens per node
+	VerifyRetries        int      `json:"verify_retries"`
+	JoinSeeds            []string `json:"join_seeds"` // bootstrap from these nodes on startup
+}
+
+// KeyspaceConfig groups keys by prefix with their own replication settings
+type KeyspaceConfig struct {
+	Name              string         `json:"name"`
+	Prefixes          []string       `json:"prefixes"`
+	ReplicationFactor int            `json:"replication_factor"`
+	WriteConsistency  string         `json:"write_consistency"` // "one", "quorum" or "all"
+	ReadConsistency   string         `json:"read_consistency"`
+	Placement         map[string]int `json:"placement"`   // data center id -> copies
+	DefaultTTL        int            `json:"default_ttl"` // in seconds, 0 means no expiry
+}
+
 type AdvancedConfig struct {
 	TTLEnabled      bool `json:"ttl_enabled"`
 	AtomicEnabled   bool `json:"atomic_enabled"`
@@ -59,6 +185,15 @@ type PerformanceConfig struct {
 	WALEnabled           bool `json:"wal_enabled"`
 }
 
+// EdgeConfig runs the node as a cache in front of the core data centers
+type EdgeConfig struct {
+	CacheOnly           bool  `json:"cache_only"`
+	CacheEntries        int   `json:"cache_entries"`         // max cached keys
+	CacheBytes          int64 `json:"cache_bytes"`           // max size of cached keys and values, 0 means unlimited
+	MaxStalenessMs      int   `json:"max_staleness_ms"`      // cached values are never served older than this without an invalidation sync
+	InvalidationLogSize int   `json:"invalidation_log_size"` // invalidation events kept by core nodes for edges
+}
+
 type Config struct {
 	HTTPPort       int               `json:"http_port"`
 	Nodes          []string          `json:"nodes"`
@@ -66,17 +201,26 @@ type Config struct {
 	DataDir        string            `json:"data_dir"`
 	Auth           AuthConfig        `json:"auth"`
 	TLS            TLSConfig         `json:"tls"`
+	Internode      InternodeConfig   `json:"internode"`
+	Quota          QuotaConfig       `json:"quota"`
+	Audit          AuditConfig       `json:"audit"`
+	Encryption     EncryptionConfig  `json:"encryption"`
 	PrometheusPort int               `json:"prometheus_port"`
 	Replication    ReplicationConfig `json:"replication"`
 	Failover       FailoverConfig    `json:"failover"`
 	Repair         RepairConfig      `json:"repair"`
+	Rebalance      RebalanceConfig   `json:"rebalance"`
+	Keyspaces      []KeyspaceConfig  `json:"keyspaces"`
 	Advanced       AdvancedConfig    `json:"advanced"`
 	Performance    PerformanceConfig `json:"performance"`
 	MultiCloud     MultiCloudConfig  `json:"multi_cloud"`
+	Edge           EdgeConfig        `json:"edge"`
 }
 
 type MultiCloudConfig struct {
 	Enabled           bool               `json:"enabled"`
+	LocalDataCenter   string             `json:"local_data_center"` // derived from the node address when empty
+	ReadPolicy        string             `json:"read_policy"`       // default read routing: local_dc_first, nearest, edge_first or primary_only
 	DataCenters       []DataCenterConfig `json:"data_centers"`
 	EdgeNodes         []EdgeNodeConfig   `json:"edge_nodes"`
 	LatencyThresholds LatencyConfig      `json:"latency_thresholds"`
@@ -104,6 +248,12 @@ type LatencyConfig struct {
 	LocalThresholdMs   int `json:"local_threshold_ms"`
 	CrossDCThresholdMs int `json:"cross_dc_threshold_ms"`
 	EdgeThresholdMs    int `json:"edge_threshold_ms"`
+
+	// Active probing
+	ProbeIntervalMs int     `json:"probe_interval_ms"`
+	ProbeTimeoutMs  int     `json:"probe_timeout_ms"`
+	Smoothing       float64 `json:"smoothing"`   // EWMA weight of the newest sample
+	WindowSize      int     `json:"window_size"` // samples kept for percentiles
 }
 
 type CloudProvider struct {
@@ -113,17 +263,8 @@ type CloudProvider struct {
 	Config map[string]interface{} `json:"config"`
 }
 
+// LoadConfig reads a JSON or YAML config file over the defaults, applies the
+// DISTORE_* environment overrides and validates the result
 func LoadConfig(filename string) (*Config, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
-
-	var config Config
-	err = json.Unmarshal(data, &config)
-	if err != nil {
-		return nil, err
-	}
-
-	return &config, nil
+	return NewLoader().Load(filename)
 }
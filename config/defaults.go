@@ -0,0 +1,37 @@
+package config
+
+// Default returns the settings used for everything a config file leaves out.
+// Zero values elsewhere mean "disabled" or "use the built-in default" of the
+// component reading them.
+func Default() *Config {
+	return &Config{
+		HTTPPort:       8080,
+		PrometheusPort: 9090,
+		ReplicaCount:   1,
+		Replication: ReplicationConfig{
+			ConflictResolution: "lww",
+		},
+		Auth: AuthConfig{
+			TokenDuration:        3600,
+			RefreshTokenDuration: 7 * 24 * 3600,
+		},
+		Audit: AuditConfig{
+			Values: "hash",
+		},
+		Failover: FailoverConfig{
+			CheckInterval: 30,
+			Timeout:       5,
+		},
+		Repair: RepairConfig{
+			SyncInterval: 60,
+		},
+		Advanced: AdvancedConfig{
+			CleanupInterval: 60,
+		},
+		Performance: PerformanceConfig{
+			CacheTTL:             300,
+			CompressionThreshold: 1024,
+			ExpectedElements:     10000,
+		},
+	}
+}
@@ -0,0 +1,240 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the names of the environment variables read by LoadConfig
+const EnvPrefix = "DISTORE"
+
+// Loader builds a config from, in increasing precedence: the defaults, a JSON
+// or YAML file, environment variables and command line overrides. The result
+// is validated as a whole before it is returned.
+type Loader struct {
+	// EnvPrefix names the environment overrides: the setting
+	// replication.write_quorum is read from <EnvPrefix>_REPLICATION_WRITE_QUORUM.
+	// Environment variables are ignored when empty.
+	EnvPrefix string
+	Environ   []string // defaults to os.Environ()
+
+	// Overrides are "path=value" pairs such as "replication.write_quorum=2"
+	Overrides []string
+
+	// Validators run after the built-in checks, for rules that live in other packages
+	Validators []func(*Config) error
+}
+
+func NewLoader() *Loader {
+	return &Loader{EnvPrefix: EnvPrefix}
+}
+
+// Load reads filename, which may be empty to configure the node from the
+// environment and overrides only
+func (l *Loader) Load(filename string) (*Config, error) {
+	cfg := Default()
+
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := Decode(data, formatOf(filename), cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+
+	verr := &ValidationError{}
+	if l.EnvPrefix != "" {
+		environ := l.Environ
+		if environ == nil {
+			environ = os.Environ()
+		}
+		for _, err := range applyEnv(cfg, l.EnvPrefix, environ) {
+			verr.add(err)
+		}
+	}
+	for _, override := range l.Overrides {
+		path, value, ok := strings.Cut(override, "=")
+		if !ok {
+			verr.add(fmt.Errorf("override %q: expected path=value", override))
+			continue
+		}
+		if err := Set(cfg, strings.TrimSpace(path), value); err != nil {
+			verr.add(err)
+		}
+	}
+	// Values that did not parse would only produce confusing follow-up errors
+	if len(verr.Problems) > 0 {
+		return nil, verr
+	}
+
+	verr.merge(cfg.Validate())
+	for _, validate := range l.Validators {
+		verr.merge(validate(cfg))
+	}
+	if len(verr.Problems) > 0 {
+		return nil, verr
+	}
+	return cfg, nil
+}
+
+// Decode reads a "json" or "yaml" document over cfg. Both formats use the
+// json names of the settings, and unknown settings are rejected.
+func Decode(data []byte, format string, cfg *Config) error {
+	if format == "yaml" {
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		if doc == nil {
+			return nil
+		}
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return err
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(cfg)
+}
+
+func formatOf(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	default:
+		return "json"
+	}
+}
+
+// Set assigns a scalar or string list setting by its dotted path, such as
+// "http_port" or "replication.write_quorum". Lists are comma separated.
+func Set(cfg *Config, path, value string) error {
+	for _, f := range settings(cfg) {
+		if f.path == path {
+			if err := setValue(f.value, value); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: unknown setting", path)
+}
+
+// EnvName is the environment variable overriding the setting at path
+func EnvName(prefix, path string) string {
+	return prefix + "_" + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+func applyEnv(cfg *Config, prefix string, environ []string) []error {
+	env := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+
+	var errs []error
+	for _, f := range settings(cfg) {
+		name := EnvName(prefix, f.path)
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+		if err := setValue(f.value, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s (from %s): %w", f.path, name, err))
+		}
+	}
+	return errs
+}
+
+// setting is an overridable field of the config
+type setting struct {
+	path  string
+	value reflect.Value
+}
+
+// settings lists the fields that can be set from a string. Lists of sections
+// (data centers, keyspaces...) can only come from the config file.
+func settings(cfg *Config) []setting {
+	return collectSettings(reflect.ValueOf(cfg).Elem(), "", nil)
+}
+
+func collectSettings(v reflect.Value, prefix string, out []setting) []setting {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			out = collectSettings(field, name, out)
+		case isScalar(field.Kind()),
+			field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			out = append(out, setting{path: name, value: field})
+		}
+	}
+	return out
+}
+
+func isScalar(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func setValue(v reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("cannot be set from a string")
+	}
+	return nil
+}
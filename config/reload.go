@@ -0,0 +1,285 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Diff lists the paths of the settings that differ between two configs.
+// Lists of sections, such as keyspaces, are compared as a whole.
+func Diff(old, new *Config) []string {
+	var changed []string
+	newFields := fieldsOf(new)
+	for path, value := range fieldsOf(old) {
+		if !reflect.DeepEqual(value.Interface(), newFields[path].Interface()) {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// fieldsOf maps the path of every leaf setting to its value
+func fieldsOf(cfg *Config) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			if v.Field(i).Kind() == reflect.Struct {
+				walk(v.Field(i), name)
+				continue
+			}
+			fields[name] = v.Field(i)
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+	return fields
+}
+
+// ReloadFunc applies new values of some settings to the running node
+type ReloadFunc func(old, new *Config) error
+
+type reloadHandler struct {
+	paths []string
+	apply ReloadFunc
+}
+
+// ReloadResult tells what a reload did with each changed setting
+type ReloadResult struct {
+	Applied         []string          `json:"applied"`
+	RestartRequired []string          `json:"restart_required"`
+	Failed          map[string]string `json:"failed,omitempty"` // path -> error
+}
+
+// Reloader re-reads the config file and applies the changed settings that
+// have a registered handler. Other changes are reported as needing a
+// restart and keep their running values.
+type Reloader struct {
+	mu       sync.Mutex
+	filename string
+	loader   *Loader
+	running  *Config // settings in effect
+	handlers []reloadHandler
+	pending  []string // changed settings that need a restart
+	onReload func(trigger string, result *ReloadResult, err error)
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewReloader tracks running, the config the node booted with
+func NewReloader(filename string, loader *Loader, running *Config) *Reloader {
+	return &Reloader{
+		filename: filename,
+		loader:   loader,
+		running:  running,
+	}
+}
+
+// Handle registers apply for the settings at paths. It is called once per
+// reload when any of them changed.
+func (r *Reloader) Handle(apply ReloadFunc, paths ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers = append(r.handlers, reloadHandler{paths: paths, apply: apply})
+}
+
+// OnReload registers fn to be told the outcome of the reloads of
+// ReloadAndLog
+func (r *Reloader) OnReload(fn func(trigger string, result *ReloadResult, err error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onReload = fn
+}
+
+// Running returns the settings in effect
+func (r *Reloader) Running() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.running
+}
+
+// PendingRestart lists the settings changed by the last reload that only
+// take effect after a restart
+func (r *Reloader) PendingRestart() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.pending...)
+}
+
+// Reload loads and validates the config file again, then applies it. An
+// invalid file leaves the node untouched.
+func (r *Reloader) Reload() (*ReloadResult, error) {
+	cfg, err := r.loader.Load(r.filename)
+	if err != nil {
+		return nil, err
+	}
+	return r.Apply(cfg), nil
+}
+
+// Apply switches the node to cfg as far as it can without a restart
+func (r *Reloader) Apply(cfg *Config) *ReloadResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := &ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	changed := Diff(r.running, cfg)
+	if len(changed) == 0 {
+		r.pending = nil
+		return result
+	}
+
+	next := *r.running
+	nextFields, newFields := fieldsOf(&next), fieldsOf(cfg)
+	handled := make(map[string]bool)
+	for _, h := range r.handlers {
+		paths := intersect(h.paths, changed)
+		if len(paths) == 0 {
+			continue
+		}
+		for _, path := range paths {
+			handled[path] = true
+		}
+		if err := h.apply(r.running, cfg); err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]string)
+			}
+			for _, path := range paths {
+				result.Failed[path] = err.Error()
+			}
+			continue
+		}
+		for _, path := range paths {
+			nextFields[path].Set(newFields[path])
+		}
+		result.Applied = append(result.Applied, paths...)
+	}
+	for _, path := range changed {
+		if !handled[path] {
+			result.RestartRequired = append(result.RestartRequired, path)
+		}
+	}
+	sort.Strings(result.Applied)
+
+	r.running = &next
+	r.pending = result.RestartRequired
+	return result
+}
+
+func intersect(paths, changed []string) []string {
+	var out []string
+	for _, path := range paths {
+		for _, c := range changed {
+			if c == path {
+				out = append(out, path)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Watch reloads the config file whenever its modification time changes,
+// checking every interval
+func (r *Reloader) Watch(interval time.Duration) {
+	r.mu.Lock()
+	if r.stopCh != nil || r.filename == "" {
+		r.mu.Unlock()
+		return
+	}
+	r.stopCh = make(chan struct{})
+	stopCh := r.stopCh
+	r.mu.Unlock()
+
+	lastMod := modTime(r.filename)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				mod := modTime(r.filename)
+				if mod.IsZero() || mod.Equal(lastMod) {
+					continue
+				}
+				lastMod = mod
+				r.ReloadAndLog("file change")
+			}
+		}
+	}()
+}
+
+// Stop ends the file watch
+func (r *Reloader) Stop() {
+	r.mu.Lock()
+	stopCh := r.stopCh
+	r.stopCh = nil
+	r.mu.Unlock()
+	if stopCh != nil {
+		close(stopCh)
+		r.wg.Wait()
+	}
+}
+
+// ReloadAndLog reloads and logs the outcome, for triggers without a caller
+// to report to
+func (r *Reloader) ReloadAndLog(trigger string) {
+	result, err := r.Reload()
+	r.mu.Lock()
+	onReload := r.onReload
+	r.mu.Unlock()
+	if onReload != nil {
+		onReload(trigger, result, err)
+	}
+	if err != nil {
+		log.Printf("Config reload (%s) rejected, keeping running config: %v", trigger, err)
+		return
+	}
+	log.Printf("Config reload (%s): %s", trigger, result)
+}
+
+func (res *ReloadResult) String() string {
+	if len(res.Applied) == 0 && len(res.RestartRequired) == 0 && len(res.Failed) == 0 {
+		return "no changes"
+	}
+	var parts []string
+	if len(res.Applied) > 0 {
+		parts = append(parts, "applied "+strings.Join(res.Applied, ", "))
+	}
+	if len(res.RestartRequired) > 0 {
+		parts = append(parts, "restart required for "+strings.Join(res.RestartRequired, ", "))
+	}
+	failed := make([]string, 0, len(res.Failed))
+	for path, err := range res.Failed {
+		failed = append(failed, fmt.Sprintf("%s failed: %s", path, err))
+	}
+	sort.Strings(failed)
+	parts = append(parts, failed...)
+	return strings.Join(parts, "; ")
+}
+
+func modTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
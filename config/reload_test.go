@@ -0,0 +1,126 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	old := Default()
+	new := Default()
+	new.Performance.CacheSize = 500
+	new.Auth.PublicKey = "key"
+	new.Keyspaces = []KeyspaceConfig{{Name: "users"}}
+
+	want := []string{"auth.public_key", "keyspaces", "performance.cache_size"}
+	if got := Diff(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if got := Diff(old, Default()); len(got) != 0 {
+		t.Errorf("Expected no changes, got %v", got)
+	}
+}
+
+func TestReloader_Apply(t *testing.T) {
+	running := Default()
+	running.Performance.CacheSize = 100
+	reloader := NewReloader("", &Loader{}, running)
+
+	var cacheSize int
+	reloader.Handle(func(old, new *Config) error {
+		cacheSize = new.Performance.CacheSize
+		return nil
+	}, "performance.cache_size", "performance.cache_ttl")
+	reloader.Handle(func(old, new *Config) error {
+		return errors.New("bad key")
+	}, "auth.private_key")
+
+	cfg := Default()
+	cfg.Performance.CacheSize = 200
+	cfg.DataDir = "/other"
+	cfg.Auth.PrivateKey = "new"
+	result := reloader.Apply(cfg)
+
+	if !reflect.DeepEqual(result.Applied, []string{"performance.cache_size"}) || cacheSize != 200 {
+		t.Errorf("Expected cache size applied, got %+v (size %d)", result, cacheSize)
+	}
+	if !reflect.DeepEqual(result.RestartRequired, []string{"data_dir"}) {
+		t.Errorf("Expected data_dir to need a restart, got %v", result.RestartRequired)
+	}
+	if result.Failed["auth.private_key"] != "bad key" {
+		t.Errorf("Expected failed auth key, got %v", result.Failed)
+	}
+
+	// Only applied settings become the running config
+	now := reloader.Running()
+	if now.Performance.CacheSize != 200 || now.DataDir != "" || now.Auth.PrivateKey != "" {
+		t.Errorf("Unexpected running config %+v", now)
+	}
+	if !reflect.DeepEqual(reloader.PendingRestart(), []string{"data_dir"}) {
+		t.Errorf("Expected pending restart for data_dir, got %v", reloader.PendingRestart())
+	}
+
+	// Reverting the restart-only change clears it
+	cfg.DataDir = ""
+	cfg.Auth.PrivateKey = ""
+	if result := reloader.Apply(cfg); len(result.Applied) != 0 || len(result.RestartRequired) != 0 {
+		t.Errorf("Expected no changes, got %+v", result)
+	}
+	if len(reloader.PendingRestart()) != 0 {
+		t.Errorf("Expected no pending restart, got %v", reloader.PendingRestart())
+	}
+}
+
+func TestReloader_RejectsInvalidFile(t *testing.T) {
+	file := writeConfig(t, "config.json", `{"http_port": 8080}`)
+	reloader := NewReloader(file, &Loader{}, Default())
+	applied := false
+	reloader.Handle(func(old, new *Config) error {
+		applied = true
+		return nil
+	}, "replication.write_quorum")
+
+	if err := os.WriteFile(file, []byte(`{"http_port": 8080, "replication": {"write_quorum": -1}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloader.Reload(); err == nil {
+		t.Fatal("Expected invalid config to be rejected")
+	}
+	if applied || reloader.Running().Replication.WriteQuorum != 0 {
+		t.Error("Invalid config must not be applied")
+	}
+}
+
+func TestReloader_Watch(t *testing.T) {
+	file := writeConfig(t, "config.yaml", "http_port: 8080\n")
+	reloader := NewReloader(file, &Loader{}, Default())
+	quorum := make(chan int, 1)
+	reloader.Handle(func(old, new *Config) error {
+		quorum <- new.Replication.WriteQuorum
+		return nil
+	}, "replication.write_quorum")
+
+	reloader.Watch(10 * time.Millisecond)
+	defer reloader.Stop()
+
+	// Make sure the modification time moves on coarse filesystems
+	later := time.Now().Add(time.Second)
+	if err := os.WriteFile(file, []byte("http_port: 8080\nreplication:\n  write_quorum: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case q := <-quorum:
+		if q != 1 {
+			t.Errorf("Expected write quorum 1, got %d", q)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Config change was not picked up")
+	}
+}
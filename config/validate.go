@@ -0,0 +1,494 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ValidationError lists every problem found in a config, so that all of them
+// can be fixed in one go
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid config: " + e.Problems[0]
+	}
+	return fmt.Sprintf("invalid config (%d problems):\n  %s", len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+func (e *ValidationError) add(err error) {
+	e.Problems = append(e.Problems, err.Error())
+}
+
+func (e *ValidationError) addf(path, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// merge appends the problems of err, which may itself be a ValidationError
+func (e *ValidationError) merge(err error) {
+	if err == nil {
+		return
+	}
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		e.Problems = append(e.Problems, verr.Problems...)
+		return
+	}
+	e.add(err)
+}
+
+func (e *ValidationError) orNil() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Validate checks every section and returns a *ValidationError listing all
+// invalid settings, or nil
+func (c *Config) Validate() error {
+	v := &ValidationError{}
+
+	checkPort(v, "http_port", c.HTTPPort, false)
+	checkPort(v, "prometheus_port", c.PrometheusPort, true)
+	if c.PrometheusPort != 0 && c.PrometheusPort == c.HTTPPort {
+		v.addf("prometheus_port", "must differ from http_port")
+	}
+	checkAddresses(v, "nodes", c.Nodes)
+	if c.ReplicaCount < 1 {
+		v.addf("replica_count", "must be at least 1, got %d", c.ReplicaCount)
+	} else if len(c.Nodes) > 0 && c.ReplicaCount > len(c.Nodes) {
+		v.addf("replica_count", "%d exceeds the %d configured nodes", c.ReplicaCount, len(c.Nodes))
+	}
+
+	c.validateAuth(v)
+	c.validateTLS(v)
+	c.validateInternode(v)
+	c.validateQuota(v)
+	c.validateAudit(v)
+	c.validateEncryption(v)
+	c.validateReplication(v)
+	c.validateFailover(v)
+	c.validateRebalance(v)
+	c.validateKeyspaces(v)
+	c.validateStorage(v)
+	c.validateMultiCloud(v)
+	c.validateEdge(v)
+
+	return v.orNil()
+}
+
+func (c *Config) validateAuth(v *ValidationError) {
+	if !c.Auth.Enabled {
+		return
+	}
+	rotation := c.Auth.KeyRotation
+	if rotation.Interval < 0 {
+		v.addf("auth.key_rotation.interval", "must not be negative")
+	}
+	switch rotation.Algorithm {
+	case "", "ES256", "RS256", "EdDSA":
+	default:
+		v.addf("auth.key_rotation.algorithm", "must be ES256, RS256 or EdDSA, got %q", rotation.Algorithm)
+	}
+	if c.Auth.PrivateKey != "" && c.Auth.PrivateKeyFile != "" {
+		v.addf("auth.private_key_file", "cannot be set together with private_key")
+	}
+	if c.Auth.PublicKey != "" && c.Auth.PublicKeyFile != "" {
+		v.addf("auth.public_key_file", "cannot be set together with public_key")
+	}
+	hasPrivate := c.Auth.PrivateKey != "" || c.Auth.PrivateKeyFile != ""
+	hasPublic := c.Auth.PublicKey != "" || c.Auth.PublicKeyFile != ""
+	if rotation.Interval == 0 {
+		if !hasPrivate {
+			v.addf("auth.private_key", "required when auth is enabled without key rotation")
+		}
+		if !hasPublic {
+			v.addf("auth.public_key", "required when auth is enabled without key rotation")
+		}
+	} else if hasPrivate != hasPublic {
+		v.addf("auth.public_key", "private_key and public_key go together")
+	}
+	for i, oidc := range c.Auth.OIDC {
+		path := fmt.Sprintf("auth.oidc[%d]", i)
+		if u, err := url.Parse(oidc.Issuer); oidc.Issuer == "" || err != nil || u.Host == "" {
+			v.addf(path+".issuer", "must be a URL, got %q", oidc.Issuer)
+		}
+		if oidc.Audience == "" {
+			v.addf(path+".audience", "required")
+		}
+		for from, roles := range oidc.RoleMap {
+			for _, role := range roles {
+				switch role {
+				case "read", "write", "admin":
+				default:
+					v.addf(path+".role_map", "%s maps to unknown role %q", from, role)
+				}
+			}
+		}
+	}
+	if c.Auth.TokenDuration < 0 {
+		v.addf("auth.token_duration", "must not be negative")
+	}
+	if c.Auth.RefreshTokenDuration < 0 {
+		v.addf("auth.refresh_token_duration", "must not be negative")
+	}
+	if p := c.Auth.Bootstrap.Password; p != "" && len(p) < 12 {
+		v.addf("auth.bootstrap.password", "must be at least 12 characters")
+	}
+
+	p := c.Auth.Policy
+	switch p.Default {
+	case "", "allow", "deny":
+	default:
+		v.addf("auth.policy.default", "must be allow or deny, got %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		path := fmt.Sprintf("auth.policy.rules[%d]", i)
+		if len(rule.Subjects) == 0 {
+			v.addf(path+".subjects", "required")
+		}
+		for _, subject := range rule.Subjects {
+			kind, name, _ := strings.Cut(subject, ":")
+			switch {
+			case subject == "*":
+			case (kind == "role" || kind == "user" || kind == "tenant") && name != "":
+			default:
+				v.addf(path+".subjects", "invalid subject %q, expected role:, user:, tenant: or *", subject)
+			}
+		}
+		if len(rule.Keys) == 0 {
+			v.addf(path+".keys", "required")
+		}
+		switch rule.Access {
+		case "read", "write", "admin":
+		default:
+			v.addf(path+".access", "must be read, write or admin, got %q", rule.Access)
+		}
+		switch rule.Effect {
+		case "", "allow", "deny":
+		default:
+			v.addf(path+".effect", "must be allow or deny, got %q", rule.Effect)
+		}
+	}
+}
+
+func (c *Config) validateTLS(v *ValidationError) {
+	if !c.TLS.Enabled {
+		return
+	}
+	if c.TLS.CertFile == "" {
+		v.addf("tls.cert_file", "required when TLS is enabled")
+	}
+	if c.TLS.KeyFile == "" {
+		v.addf("tls.key_file", "required when TLS is enabled")
+	}
+}
+
+func (c *Config) validateInternode(v *ValidationError) {
+	n := c.Internode
+	if n.TLS {
+		if n.CAFile == "" {
+			v.addf("internode.ca_file", "required when internode TLS is enabled")
+		}
+		if n.CertFile == "" {
+			v.addf("internode.cert_file", "required when internode TLS is enabled")
+		}
+		if n.KeyFile == "" {
+			v.addf("internode.key_file", "required when internode TLS is enabled")
+		}
+	}
+	// Identities and signing keys are replicated in the cluster metadata,
+	// which must not be taken from nodes that are not authenticated
+	if c.Auth.Enabled && !n.TLS && !n.ServiceToken {
+		v.addf("internode", "tls or service_token is required with auth.enabled")
+	}
+	if n.ServiceToken {
+		hasKeys := c.Auth.PrivateKey != "" || c.Auth.PrivateKeyFile != ""
+		switch {
+		case !c.Auth.Enabled:
+			v.addf("internode.service_token", "requires auth.enabled")
+		case c.Auth.TokenDuration <= 0:
+			v.addf("internode.service_token", "requires a positive auth.token_duration")
+		case !n.TLS && !hasKeys:
+			// Keys generated by each node are shared through the cluster
+			// metadata, which peers only accept with a token they can verify
+			v.addf("internode.service_token", "requires auth keys shared by all nodes, or internode.tls, with key rotation")
+		}
+	}
+}
+
+func (c *Config) validateQuota(v *ValidationError) {
+	q := c.Quota
+	checkTenant := func(path string, t TenantQuotaConfig) {
+		checkRateLimit(v, path+".request_rate", t.RequestRate)
+		checkRateLimit(v, path+".user_rate", t.UserRate)
+		if t.MaxKeys < 0 {
+			v.addf(path+".max_keys", "must not be negative, got %d", t.MaxKeys)
+		}
+		if t.MaxBytes < 0 {
+			v.addf(path+".max_bytes", "must not be negative, got %d", t.MaxBytes)
+		}
+		if t.MaxValueSize < 0 {
+			v.addf(path+".max_value_size", "must not be negative, got %d", t.MaxValueSize)
+		}
+	}
+	checkTenant("quota.default", q.Default)
+	for tenant, t := range q.Tenants {
+		checkTenant("quota.tenants."+tenant, t)
+	}
+	for route, limit := range q.Routes {
+		method, path, ok := strings.Cut(route, " ")
+		if !ok || method == "" || method != strings.ToUpper(method) || !strings.HasPrefix(path, "/") {
+			v.addf("quota.routes", "%q must be a method and a route, like \"POST /set\"", route)
+		}
+		checkRateLimit(v, "quota.routes."+route, limit)
+	}
+}
+
+func checkRateLimit(v *ValidationError, path string, limit RateLimitConfig) {
+	if limit.Rate < 0 {
+		v.addf(path+".rate", "must not be negative, got %g", limit.Rate)
+	}
+	if limit.Burst < 0 {
+		v.addf(path+".burst", "must not be negative, got %d", limit.Burst)
+	}
+}
+
+func (c *Config) validateAudit(v *ValidationError) {
+	a := c.Audit
+	if a.Enabled && a.Dir == "" && c.DataDir == "" {
+		v.addf("audit.dir", "required when audit is enabled without data_dir")
+	}
+	switch a.Values {
+	case "", "hash", "full", "none":
+	default:
+		v.addf("audit.values", "must be hash, full or none, got %q", a.Values)
+	}
+	if a.SegmentBytes < 0 {
+		v.addf("audit.segment_bytes", "must not be negative, got %d", a.SegmentBytes)
+	}
+	if a.RetentionDays < 0 {
+		v.addf("audit.retention_days", "must not be negative, got %d", a.RetentionDays)
+	}
+}
+
+func (c *Config) validateEncryption(v *ValidationError) {
+	e := c.Encryption
+	if !e.Enabled {
+		return
+	}
+	switch e.KMS {
+	case "", "file", "local":
+	default:
+		v.addf("encryption.kms", "must be file or local, got %q", e.KMS)
+	}
+	if e.MasterKeyFile == "" {
+		v.addf("encryption.master_key_file", "required when encryption is enabled")
+	}
+	if e.KeyringFile == "" && c.DataDir == "" {
+		v.addf("encryption.keyring_file", "required when encryption is enabled without data_dir")
+	}
+	if e.RotationInterval < 0 {
+		v.addf("encryption.rotation_interval", "must not be negative, got %d", e.RotationInterval)
+	}
+	if e.ReencryptRate < 0 {
+		v.addf("encryption.reencrypt_rate", "must not be negative, got %d", e.ReencryptRate)
+	}
+	// The audit log is not encrypted, full values would leak in plaintext
+	if c.Audit.Enabled && c.Audit.Values == "full" {
+		v.addf("audit.values", "must be hash or none when encryption is enabled")
+	}
+}
+
+func (c *Config) validateReplication(v *ValidationError) {
+	r := c.Replication
+	// 0 means a majority of the nodes
+	checkQuorum := func(path string, quorum int) {
+		if quorum < 0 {
+			v.addf(path, "must not be negative, got %d", quorum)
+		} else if len(c.Nodes) > 0 && quorum > len(c.Nodes) {
+			v.addf(path, "%d exceeds the %d configured nodes", quorum, len(c.Nodes))
+		}
+	}
+	checkQuorum("replication.write_quorum", r.WriteQuorum)
+	checkQuorum("replication.read_quorum", r.ReadQuorum)
+
+	switch r.ConflictResolution {
+	case "", "lww", "vector":
+	default:
+		v.addf("replication.conflict_resolution", "must be lww or vector, got %q", r.ConflictResolution)
+	}
+	checkNonNegative(v, "replication.max_latency_ms", r.MaxLatencyMs)
+	checkNonNegative(v, "replication.cross_dc_batch_size", r.CrossDCBatchSize)
+	checkNonNegative(v, "replication.cross_dc_flush_interval_ms", r.CrossDCFlushInterval)
+	if r.CrossDCEnabled && !c.MultiCloud.Enabled {
+		v.addf("replication.cross_dc_enabled", "requires multi_cloud.enabled")
+	}
+}
+
+func (c *Config) validateFailover(v *ValidationError) {
+	f := c.Failover
+	checkNonNegative(v, "failover.check_interval_seconds", f.CheckInterval)
+	checkNonNegative(v, "failover.timeout_seconds", f.Timeout)
+	checkNonNegative(v, "failover.max_sample_size", f.MaxSampleSize)
+	checkNonNegative(v, "failover.min_std_deviation_ms", f.MinStdDeviationMs)
+	checkNonNegative(v, "failover.acceptable_heartbeat_pause_ms", f.AcceptableHeartbeatPauseMs)
+	checkNonNegative(v, "failover.recovery_probes", f.RecoveryProbes)
+	checkNonNegative(v, "failover.read_only_enter_delay_seconds", f.ReadOnlyEnterDelay)
+	checkNonNegative(v, "failover.read_only_exit_delay_seconds", f.ReadOnlyExitDelay)
+	if f.PhiThreshold < 0 {
+		v.addf("failover.phi_threshold", "must not be negative")
+	}
+	if f.SuspectPhiThreshold < 0 {
+		v.addf("failover.suspect_phi_threshold", "must not be negative")
+	}
+	if f.PhiThreshold > 0 && f.SuspectPhiThreshold >= f.PhiThreshold {
+		v.addf("failover.suspect_phi_threshold", "must be below phi_threshold (%g)", f.PhiThreshold)
+	}
+	checkNonNegative(v, "repair.sync_interval_seconds", c.Repair.SyncInterval)
+}
+
+func (c *Config) validateRebalance(v *ValidationError) {
+	r := c.Rebalance
+	checkNonNegative(v, "rebalance.batch_size", r.BatchSize)
+	checkNonNegative(v, "rebalance.virtual_nodes", r.VirtualNodes)
+	checkNonNegative(v, "rebalance.verify_retries", r.VerifyRetries)
+	if r.BandwidthBytesPerSec < 0 {
+		v.addf("rebalance.bandwidth_bytes_per_sec", "must not be negative")
+	}
+	checkAddresses(v, "rebalance.join_seeds", r.JoinSeeds)
+}
+
+func (c *Config) validateKeyspaces(v *ValidationError) {
+	names := make(map[string]bool, len(c.Keyspaces))
+	for i, ks := range c.Keyspaces {
+		path := fmt.Sprintf("keyspaces[%d]", i)
+		if ks.Name == "" {
+			v.addf(path+".name", "required")
+		} else if names[ks.Name] {
+			v.addf(path+".name", "duplicate keyspace %q", ks.Name)
+		}
+		names[ks.Name] = true
+
+		checkNonNegative(v, path+".replication_factor", ks.ReplicationFactor)
+		checkNonNegative(v, path+".default_ttl", ks.DefaultTTL)
+		checkConsistency(v, path+".write_consistency", ks.WriteConsistency)
+		checkConsistency(v, path+".read_consistency", ks.ReadConsistency)
+	}
+}
+
+func (c *Config) validateStorage(v *ValidationError) {
+	checkNonNegative(v, "advanced.default_ttl", c.Advanced.DefaultTTL)
+	checkNonNegative(v, "advanced.cleanup_interval", c.Advanced.CleanupInterval)
+
+	p := c.Performance
+	checkNonNegative(v, "performance.cache_size", p.CacheSize)
+	checkNonNegative(v, "performance.cache_ttl", p.CacheTTL)
+	checkNonNegative(v, "performance.compression_threshold", p.CompressionThreshold)
+	checkNonNegative(v, "performance.expected_elements", p.ExpectedElements)
+	if p.Enabled && p.WALEnabled && c.DataDir == "" {
+		v.addf("performance.wal_enabled", "requires data_dir")
+	}
+}
+
+func (c *Config) validateMultiCloud(v *ValidationError) {
+	m := c.MultiCloud
+	ids := make(map[string]bool, len(m.DataCenters))
+	for i, dc := range m.DataCenters {
+		path := fmt.Sprintf("multi_cloud.data_centers[%d]", i)
+		if dc.ID == "" {
+			v.addf(path+".id", "required")
+		} else if ids[dc.ID] {
+			v.addf(path+".id", "duplicate data center %q", dc.ID)
+		}
+		ids[dc.ID] = true
+		checkAddresses(v, path+".nodes", dc.Nodes)
+		checkNonNegative(v, path+".priority", dc.Priority)
+		checkNonNegative(v, path+".replica_count", dc.ReplicaCount)
+		checkNonNegative(v, path+".latency_ms", dc.LatencyMs)
+	}
+	if m.LocalDataCenter != "" && len(m.DataCenters) > 0 && !ids[m.LocalDataCenter] {
+		v.addf("multi_cloud.local_data_center", "unknown data center %q", m.LocalDataCenter)
+	}
+
+	edges := make(map[string]bool, len(m.EdgeNodes))
+	for i, edge := range m.EdgeNodes {
+		path := fmt.Sprintf("multi_cloud.edge_nodes[%d]", i)
+		if edge.ID == "" {
+			v.addf(path+".id", "required")
+		} else if edges[edge.ID] {
+			v.addf(path+".id", "duplicate edge node %q", edge.ID)
+		}
+		edges[edge.ID] = true
+		checkAddresses(v, path+".node", []string{edge.Node})
+		checkNonNegative(v, path+".latency_ms", edge.LatencyMs)
+	}
+
+	l := m.LatencyThresholds
+	checkNonNegative(v, "multi_cloud.latency_thresholds.local_threshold_ms", l.LocalThresholdMs)
+	checkNonNegative(v, "multi_cloud.latency_thresholds.cross_dc_threshold_ms", l.CrossDCThresholdMs)
+	checkNonNegative(v, "multi_cloud.latency_thresholds.edge_threshold_ms", l.EdgeThresholdMs)
+	checkNonNegative(v, "multi_cloud.latency_thresholds.probe_interval_ms", l.ProbeIntervalMs)
+	checkNonNegative(v, "multi_cloud.latency_thresholds.probe_timeout_ms", l.ProbeTimeoutMs)
+	checkNonNegative(v, "multi_cloud.latency_thresholds.window_size", l.WindowSize)
+	if l.Smoothing < 0 || l.Smoothing > 1 {
+		v.addf("multi_cloud.latency_thresholds.smoothing", "must be between 0 and 1, got %g", l.Smoothing)
+	}
+}
+
+func (c *Config) validateEdge(v *ValidationError) {
+	e := c.Edge
+	checkNonNegative(v, "edge.cache_entries", e.CacheEntries)
+	checkNonNegative(v, "edge.max_staleness_ms", e.MaxStalenessMs)
+	checkNonNegative(v, "edge.invalidation_log_size", e.InvalidationLogSize)
+	if e.CacheBytes < 0 {
+		v.addf("edge.cache_bytes", "must not be negative")
+	}
+	if e.CacheOnly && len(c.MultiCloud.DataCenters) == 0 && len(c.Nodes) == 0 {
+		v.addf("edge.cache_only", "requires core nodes or multi_cloud.data_centers to forward to")
+	}
+}
+
+func checkPort(v *ValidationError, path string, port int, optional bool) {
+	if optional && port == 0 {
+		return
+	}
+	if port < 1 || port > 65535 {
+		v.addf(path, "must be between 1 and 65535, got %d", port)
+	}
+}
+
+func checkConsistency(v *ValidationError, path, level string) {
+	switch level {
+	case "", "one", "quorum", "all":
+	default:
+		v.addf(path, "must be one, quorum or all, got %q", level)
+	}
+}
+
+func checkNonNegative(v *ValidationError, path string, n int) {
+	if n < 0 {
+		v.addf(path, "must not be negative, got %d", n)
+	}
+}
+
+// checkAddresses requires host:port node addresses
+func checkAddresses(v *ValidationError, path string, addrs []string) {
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host == "" {
+			v.addf(path, "invalid address %q, expected host:port", addr)
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			v.addf(path, "invalid port in address %q", addr)
+		}
+	}
+}
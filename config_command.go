@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"distore/config"
+	"distore/k8s"
+	"distore/replication"
+)
+
+// stringList collects the values of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// newConfigLoader adds the checks owned by other packages to the config
+// validation, so that a node refuses to boot on any of them
+func newConfigLoader(overrides []string) *config.Loader {
+	loader := config.NewLoader()
+	loader.Overrides = overrides
+	loader.Validators = append(loader.Validators, validateMultiCloud, validateKeyspaces)
+	return loader
+}
+
+func validateMultiCloud(cfg *config.Config) error {
+	if !cfg.MultiCloud.Enabled {
+		return nil
+	}
+	if err := k8s.ValidateMultiCloudConfig(&cfg.MultiCloud); err != nil {
+		return fmt.Errorf("multi_cloud: %w", err)
+	}
+	return nil
+}
+
+func validateKeyspaces(cfg *config.Config) error {
+	if err := replication.NewKeyspaceRegistry(cfg.MultiCloud.DataCenters).Load(cfg.Keyspaces); err != nil {
+		return fmt.Errorf("keyspaces: %w", err)
+	}
+	return nil
+}
+
+// runConfigCommand implements "distore config validate", returning the exit code
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: distore config validate [-config file] [-set path=value]... [-print]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	configFile := fs.String("config", "config.json", "Path to a JSON or YAML config file")
+	printConfig := fs.Bool("print", false, "Print the effective config as JSON")
+	var overrides stringList
+	fs.Var(&overrides, "set", "Override a setting, e.g. -set replication.write_quorum=2 (repeatable)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg, err := newConfigLoader(overrides).Load(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configFile, err)
+		return 1
+	}
+
+	if *printConfig {
+		data, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(string(data))
+		return 0
+	}
+	fmt.Printf("%s: OK\n", *configFile)
+	return 0
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"distore/audit"
+	"distore/auth"
+	"distore/cluster"
+	"distore/config"
+	"distore/encryption"
+	"distore/internode"
+	"distore/quota"
+	"distore/replication"
+)
+
+// registerReloadHandlers declares the settings that can change on a running
+// node. A setting whose component is not running (a cache disabled at boot,
+// auth...) needs a restart to change.
+func registerReloadHandlers(reloader *config.Reloader, layers storageLayers, replicator *replication.Replicator, metadata *cluster.MetadataStore, jwtService *auth.AuthService, keyRotator *auth.KeyRotator, issuer *auth.Issuer, guard *auth.Guard, serviceTokens internode.TokenSource, quotas *quota.Manager, auditLog *audit.Log, dataKeys *encryption.Rotator) {
+	if cache := layers.cache; cache != nil {
+		reloader.Handle(func(old, new *config.Config) error {
+			if new.Performance.CacheSize <= 0 {
+				return errors.New("disabling the cache requires a restart")
+			}
+			cache.Resize(new.Performance.CacheSize, cacheEntryTTL(new))
+			return nil
+		}, "performance.cache_size", "performance.cache_ttl")
+	}
+
+	if compression := layers.compression; compression != nil {
+		reloader.Handle(func(old, new *config.Config) error {
+			compression.SetThreshold(compressionThreshold(new))
+			return nil
+		}, "performance.compression_threshold")
+	}
+
+	if ttl := layers.ttl; ttl != nil {
+		reloader.Handle(func(old, new *config.Config) error {
+			ttl.SetCleanupInterval(ttlCleanupInterval(new))
+			return nil
+		}, "advanced.cleanup_interval")
+	}
+
+	// Topology goes through the cluster metadata so that every node follows
+	reloader.Handle(func(old, new *config.Config) error {
+		_, err := metadata.Update(func(meta *cluster.ClusterMetadata) error {
+			meta.Members = new.Nodes
+			meta.ReplicaCount = new.ReplicaCount
+			return nil
+		})
+		return err
+	}, "nodes", "replica_count")
+
+	reloader.Handle(func(old, new *config.Config) error {
+		replicator.SetQuorum(new.Replication.WriteQuorum, new.Replication.ReadQuorum)
+		return nil
+	}, "replication.write_quorum", "replication.read_quorum")
+
+	if jwtService != nil {
+		reloader.Handle(func(old, new *config.Config) error {
+			return jwtService.UpdateKeys(&new.Auth)
+		}, "auth.private_key", "auth.public_key", "auth.private_key_file", "auth.public_key_file", "auth.token_duration")
+		reloader.Handle(func(old, new *config.Config) error {
+			issuer.SetRefreshDuration(time.Duration(new.Auth.RefreshTokenDuration) * time.Second)
+			return nil
+		}, "auth.refresh_token_duration")
+		reloader.Handle(func(old, new *config.Config) error {
+			keyRotator.Update(new.Auth.KeyRotation)
+			return nil
+		}, "auth.key_rotation.interval", "auth.key_rotation.algorithm")
+		reloader.Handle(func(old, new *config.Config) error {
+			issuer.SetExternalIssuers(auth.NewOIDCVerifiers(new.Auth.OIDC))
+			return nil
+		}, "auth.oidc")
+	}
+
+	reloader.Handle(func(old, new *config.Config) error {
+		policy, err := auth.NewAccessPolicy(new.Auth.Policy)
+		if err != nil {
+			return err
+		}
+		guard.SetPolicy(policy)
+		return nil
+	}, "auth.policy.default", "auth.policy.rules")
+
+	if quotas != nil {
+		reloader.Handle(func(old, new *config.Config) error {
+			quotas.SetConfig(new.Quota)
+			return nil
+		}, "quota.default.request_rate.rate", "quota.default.request_rate.burst",
+			"quota.default.user_rate.rate", "quota.default.user_rate.burst",
+			"quota.default.max_keys", "quota.default.max_bytes", "quota.default.max_value_size",
+			"quota.tenants", "quota.routes")
+	}
+
+	if auditLog != nil {
+		reloader.Handle(func(old, new *config.Config) error {
+			auditLog.SetConfig(new.Audit)
+			return nil
+		}, "audit.values", "audit.sync", "audit.segment_bytes", "audit.retention_days")
+	}
+
+	if dataKeys != nil {
+		reloader.Handle(func(old, new *config.Config) error {
+			dataKeys.Update(new.Encryption)
+			return nil
+		}, "encryption.rotation_interval", "encryption.reencrypt_rate")
+	}
+
+	// New node certificate files; switching TLS on or off needs a restart
+	reloader.Handle(func(old, new *config.Config) error {
+		if !old.Internode.TLS {
+			return errors.New("internode TLS is not enabled")
+		}
+		next := old.Internode
+		next.CAFile, next.CertFile, next.KeyFile = new.Internode.CAFile, new.Internode.CertFile, new.Internode.KeyFile
+		return internode.Configure(next, serviceTokens)
+	}, "internode.ca_file", "internode.cert_file", "internode.key_file")
+}
+
+// auditConfigReload records a reload without an admin request to audit it,
+// on SIGHUP or a change of the config file
+func auditConfigReload(auditLog *audit.Log, trigger string, result *config.ReloadResult, err error) {
+	e := audit.Event{
+		Category:  audit.CategoryAdmin,
+		Operation: "config reload",
+		Target:    map[string]string{"trigger": trigger},
+		Outcome:   audit.OutcomeSuccess,
+	}
+	if err != nil {
+		e.Outcome, e.Reason = audit.OutcomeFailed, err.Error()
+		auditLog.Record(e)
+		return
+	}
+	if len(result.Applied) > 0 {
+		e.Target["applied"] = strings.Join(result.Applied, ",")
+	}
+	if len(result.RestartRequired) > 0 {
+		e.Target["restart_required"] = strings.Join(result.RestartRequired, ",")
+	}
+	if len(result.Failed) > 0 {
+		e.Outcome, e.Reason = audit.OutcomeFailed, result.String()
+	}
+	auditLog.Record(e)
+}
@@ -0,0 +1,66 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"distore/storage"
+)
+
+// Backup is the content of an encrypted backup file. Its values are
+// encrypted with a key of its own, wrapped by a master key, so that any
+// node with the master key can restore it.
+type Backup struct {
+	MasterKey  string             `json:"master_key"`
+	WrappedKey []byte             `json:"wrapped_key"`
+	Items      []storage.KeyValue `json:"items"` // values sealed with the backup key, in base64
+}
+
+// SealBackup encrypts items into a backup with a new key
+func SealBackup(kms KMS, items []storage.KeyValue) (*Backup, error) {
+	plain, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return nil, err
+	}
+	b := &Backup{MasterKey: kms.CurrentKeyID(), Items: make([]storage.KeyValue, len(items))}
+	if b.WrappedKey, err = kms.Wrap(b.MasterKey, plain); err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		sealed, err := seal(aead, []byte(item.Value), []byte(item.Key))
+		if err != nil {
+			return nil, err
+		}
+		b.Items[i] = storage.KeyValue{Key: item.Key, Value: base64.StdEncoding.EncodeToString(sealed)}
+	}
+	return b, nil
+}
+
+// OpenBackup decrypts the items of a backup
+func OpenBackup(kms KMS, b *Backup) ([]storage.KeyValue, error) {
+	plain, err := kms.Unwrap(b.MasterKey, b.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("backup key: %w", err)
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]storage.KeyValue, len(b.Items))
+	for i, item := range b.Items {
+		sealed, err := base64.StdEncoding.DecodeString(item.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w of %s: %v", ErrDecrypt, item.Key, err)
+		}
+		value, err := open(aead, sealed, []byte(item.Key))
+		if err != nil {
+			return nil, fmt.Errorf("%w of %s: %v", ErrDecrypt, item.Key, err)
+		}
+		items[i] = storage.KeyValue{Key: item.Key, Value: string(value)}
+	}
+	return items, nil
+}
@@ -0,0 +1,214 @@
+package encryption
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"distore/config"
+	"distore/storage"
+)
+
+func newTestKeyring(t *testing.T) (*Keyring, *LocalKMS, string) {
+	t.Helper()
+	dir := t.TempDir()
+	kms, err := NewLocalKMS(filepath.Join(dir, "master.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keyring.json")
+	keyring, err := OpenKeyring(path, kms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring, kms, path
+}
+
+func TestKeyring_EncryptsPerTenant(t *testing.T) {
+	keyring, kms, path := newTestKeyring(t)
+
+	encrypted, err := keyring.EncryptValue("acme:a", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, valuePrefix+"acme:1:") || strings.Contains(encrypted, "secret") {
+		t.Errorf("Expected a value encrypted with the first data key of acme, got %q", encrypted)
+	}
+	if value, err := keyring.DecryptValue("acme:a", encrypted); err != nil || value != "secret" {
+		t.Errorf("Expected secret, got %q %v", value, err)
+	}
+
+	// The key is authenticated: a value moved to another key does not decrypt
+	if _, err := keyring.DecryptValue("acme:b", encrypted); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Expected ErrDecrypt for a moved value, got %v", err)
+	}
+	// Values written before encryption was enabled are read as they are
+	if value, err := keyring.DecryptValue("acme:c", "plain"); err != nil || value != "plain" {
+		t.Errorf("Expected the plaintext back, got %q %v", value, err)
+	}
+
+	// Data keys are saved wrapped and survive a restart
+	keyring.EncryptValue("other:a", "x")
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "aead") {
+		t.Errorf("Expected only wrapped keys in the keyring file, got %s", data)
+	}
+	reopened, err := OpenKeyring(path, kms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := reopened.DecryptValue("acme:a", encrypted); err != nil || value != "secret" {
+		t.Errorf("Expected the reopened keyring to decrypt, got %q %v", value, err)
+	}
+	if status := reopened.Status(); len(status) != 2 || status[0].Tenant != "acme" || status[1].Tenant != "other" {
+		t.Errorf("Expected the data keys of acme and other, got %+v", status)
+	}
+}
+
+func TestKeyring_RotateAndRewrap(t *testing.T) {
+	keyring, kms, path := newTestKeyring(t)
+	old, _ := keyring.EncryptValue("acme:a", "v1")
+	firstMaster := kms.CurrentKeyID()
+
+	if _, err := kms.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := keyring.Rotate(); err != nil || n != 1 {
+		t.Fatalf("Expected 1 tenant rotated, got %d %v", n, err)
+	}
+	if n, err := keyring.Rewrap(); err != nil || n != 1 {
+		t.Fatalf("Expected the first data key rewrapped, got %d %v", n, err)
+	}
+
+	status := keyring.Status()
+	if len(status) != 1 || status[0].Current != 2 || status[0].Versions != 2 || len(status[0].MasterKeys) != 1 || status[0].MasterKeys[0] == firstMaster {
+		t.Errorf("Expected 2 versions wrapped by the new master key, got %+v", status)
+	}
+	current, _ := keyring.EncryptValue("acme:a", "v2")
+	if !strings.HasPrefix(current, valuePrefix+"acme:2:") {
+		t.Errorf("Expected new values under version 2, got %q", current)
+	}
+	if !keyring.stale("acme:a", old) || keyring.stale("acme:a", current) {
+		t.Error("Expected only the value of version 1 to be stale")
+	}
+
+	// The older master key can go once everything is rewrapped
+	keys, _ := ReadMasterKeys(kms.path)
+	delete(keys.Keys, firstMaster)
+	keys.Write(kms.path)
+	reloaded, err := NewFileKMS(kms.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenKeyring(path, reloaded)
+	if err != nil {
+		t.Fatalf("Expected the keyring to open without the retired master key: %v", err)
+	}
+	if value, err := reopened.DecryptValue("acme:a", old); err != nil || value != "v1" {
+		t.Errorf("Expected version 1 to still decrypt, got %q %v", value, err)
+	}
+}
+
+func TestStorage_ReencryptsStaleValues(t *testing.T) {
+	keyring, _, _ := newTestKeyring(t)
+	base := storage.NewMemoryStorage()
+	base.Set("acme:plain", "before")
+	s := NewStorage(base, keyring)
+
+	s.Set("acme:a", "1")
+	if stored, _ := base.Get("acme:a"); !strings.HasPrefix(stored, valuePrefix) {
+		t.Errorf("Expected the base storage to hold an encrypted value, got %q", stored)
+	}
+	if value, err := s.Get("acme:a"); err != nil || value != "1" {
+		t.Errorf("Expected 1, got %q %v", value, err)
+	}
+	items, err := s.GetAll()
+	if err != nil || len(items) != 2 {
+		t.Fatalf("Expected 2 decrypted items, got %+v %v", items, err)
+	}
+
+	keyring.Rotate()
+	for _, key := range []string{"acme:plain", "acme:a"} {
+		if changed, err := s.Reencrypt(key); err != nil || !changed {
+			t.Errorf("Expected %s to be re-encrypted, got %v %v", key, changed, err)
+		}
+		if stored, _ := base.Get(key); !strings.HasPrefix(stored, valuePrefix+"acme:2:") {
+			t.Errorf("Expected %s under version 2, got %q", key, stored)
+		}
+	}
+	if changed, _ := s.Reencrypt("acme:a"); changed {
+		t.Error("Expected a current value to be left alone")
+	}
+	if value, _ := s.Get("acme:plain"); value != "before" {
+		t.Errorf("Expected before, got %q", value)
+	}
+}
+
+func TestRotator_ReencryptsInTheBackground(t *testing.T) {
+	keyring, _, _ := newTestKeyring(t)
+	base := storage.NewMemoryStorage()
+	for _, key := range []string{"a", "b", "acme:c"} {
+		base.Set(key, "plain")
+	}
+	s := NewStorage(base, keyring)
+	r := NewRotator(s, config.EncryptionConfig{})
+	r.Start()
+	defer r.Stop()
+
+	waitFor := func(reencrypted int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if p := r.Progress(); !p.Running && p.Reencrypted == reencrypted && !p.Finished.IsZero() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected %d values re-encrypted, got %+v", reencrypted, r.Progress())
+	}
+	waitFor(3)
+
+	started := r.Progress().Started
+	if err := r.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Progress().Started.Equal(started) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitFor(3)
+	for _, key := range []string{"a", "b", "acme:c"} {
+		if stored, _ := base.Get(key); !strings.Contains(stored, ":2:") {
+			t.Errorf("Expected %s under version 2 after rotation, got %q", key, stored)
+		}
+	}
+}
+
+func TestBackup_SealAndOpen(t *testing.T) {
+	_, kms, _ := newTestKeyring(t)
+	items := []storage.KeyValue{{Key: "acme:a", Value: "secret"}, {Key: "b", Value: ""}}
+
+	backup, err := SealBackup(kms, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.MasterKey != kms.CurrentKeyID() || backup.Items[0].Value == "secret" {
+		t.Errorf("Expected sealed values, got %+v", backup)
+	}
+	opened, err := OpenBackup(kms, backup)
+	if err != nil || len(opened) != 2 || opened[0] != items[0] || opened[1] != items[1] {
+		t.Errorf("Expected the items back, got %+v %v", opened, err)
+	}
+
+	backup.Items[0].Key = "acme:b"
+	if _, err := OpenBackup(kms, backup); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Expected ErrDecrypt for a renamed item, got %v", err)
+	}
+	other, _ := NewLocalKMS(filepath.Join(t.TempDir(), "master.json"))
+	if _, err := OpenBackup(other, backup); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("Expected ErrUnknownMasterKey without the master key, got %v", err)
+	}
+}
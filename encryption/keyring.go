@@ -0,0 +1,326 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// valuePrefix starts every encrypted value, followed by the tenant and the
+// version of the data key and the sealed value in base64:
+// "\x00enc1:<tenant>:<version>:<base64>"
+const valuePrefix = "\x00enc1:"
+
+// ErrDecrypt is returned for values that cannot be decrypted: tampered
+// with, moved to another key or encrypted with a data key that is gone
+var ErrDecrypt = errors.New("cannot decrypt value")
+
+// DataKey is a version of a tenant's data key as the keyring file keeps
+// it: wrapped by a master key
+type DataKey struct {
+	Version   int       `json:"version"`
+	MasterKey string    `json:"master_key"`
+	Wrapped   []byte    `json:"wrapped"`
+	CreatedAt time.Time `json:"created_at"`
+
+	aead cipher.AEAD
+}
+
+// Keyring holds the data keys of each tenant, the newest encrypting and
+// every version decrypting. Keys outside of a tenant share the data key of
+// the tenant "". Only wrapped data keys are written to its file.
+type Keyring struct {
+	mu      sync.RWMutex
+	kms     KMS
+	path    string                // "" keeps the keyring in memory
+	tenants map[string][]*DataKey // oldest first
+}
+
+// OpenKeyring loads the keyring at path and unwraps its data keys
+func OpenKeyring(path string, kms KMS) (*Keyring, error) {
+	k := &Keyring{kms: kms, path: path, tenants: make(map[string][]*DataKey)}
+	if path == "" {
+		return k, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &k.tenants); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for tenant, keys := range k.tenants {
+		for _, key := range keys {
+			if err := k.unwrap(key); err != nil {
+				return nil, fmt.Errorf("data key %d of tenant %q: %w", key.Version, tenant, err)
+			}
+		}
+	}
+	return k, nil
+}
+
+func (k *Keyring) unwrap(key *DataKey) error {
+	plain, err := k.kms.Unwrap(key.MasterKey, key.Wrapped)
+	if err != nil {
+		return err
+	}
+	key.aead, err = newAEAD(plain)
+	return err
+}
+
+// KMS returns the KMS wrapping the data keys
+func (k *Keyring) KMS() KMS {
+	return k.kms
+}
+
+// newKey generates a data key of version, wrapped by the current master key
+func (k *Keyring) newKey(version int) (*DataKey, error) {
+	plain, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	masterKey := k.kms.CurrentKeyID()
+	wrapped, err := k.kms.Wrap(masterKey, plain)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{Version: version, MasterKey: masterKey, Wrapped: wrapped, CreatedAt: time.Now().UTC(), aead: aead}, nil
+}
+
+// current returns the data key encrypting the values of tenant, creating
+// the first one
+func (k *Keyring) current(tenant string) (*DataKey, error) {
+	k.mu.RLock()
+	keys := k.tenants[tenant]
+	k.mu.RUnlock()
+	if len(keys) > 0 {
+		return keys[len(keys)-1], nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if keys := k.tenants[tenant]; len(keys) > 0 {
+		return keys[len(keys)-1], nil
+	}
+	key, err := k.newKey(1)
+	if err != nil {
+		return nil, err
+	}
+	k.tenants[tenant] = []*DataKey{key}
+	if err := k.save(); err != nil {
+		delete(k.tenants, tenant)
+		return nil, err
+	}
+	return key, nil
+}
+
+func (k *Keyring) version(tenant string, version int) (*DataKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.tenants[tenant] {
+		if key.Version == version {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// save writes the keyring. Called with the write lock held.
+func (k *Keyring) save() error {
+	if k.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(k.tenants, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(k.path, data)
+}
+
+// Rotate adds a data key version to every tenant, which encrypts their
+// values from now on. It returns the number of tenants rotated.
+func (k *Keyring) Rotate() (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	rotated := make(map[string][]*DataKey, len(k.tenants))
+	for tenant, keys := range k.tenants {
+		key, err := k.newKey(keys[len(keys)-1].Version + 1)
+		if err != nil {
+			return 0, err
+		}
+		rotated[tenant] = append(keys[:len(keys):len(keys)], key)
+	}
+	previous := k.tenants
+	k.tenants = rotated
+	if err := k.save(); err != nil {
+		k.tenants = previous
+		return 0, err
+	}
+	return len(rotated), nil
+}
+
+// Rewrap wraps the data keys wrapped by an older master key with the
+// current one, after which the older master key can be retired. It
+// returns the number of data keys rewrapped.
+func (k *Keyring) Rewrap() (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	masterKey := k.kms.CurrentKeyID()
+	rewrapped := make(map[string][]*DataKey, len(k.tenants))
+	count := 0
+	for tenant, keys := range k.tenants {
+		rewrapped[tenant] = make([]*DataKey, len(keys))
+		for i, key := range keys {
+			rewrapped[tenant][i] = key
+			if key.MasterKey == masterKey {
+				continue
+			}
+			plain, err := k.kms.Unwrap(key.MasterKey, key.Wrapped)
+			if err != nil {
+				return 0, fmt.Errorf("data key %d of tenant %q: %w", key.Version, tenant, err)
+			}
+			wrapped, err := k.kms.Wrap(masterKey, plain)
+			if err != nil {
+				return 0, err
+			}
+			copied := *key
+			copied.MasterKey, copied.Wrapped = masterKey, wrapped
+			rewrapped[tenant][i] = &copied
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	previous := k.tenants
+	k.tenants = rewrapped
+	if err := k.save(); err != nil {
+		k.tenants = previous
+		return 0, err
+	}
+	return count, nil
+}
+
+// TenantKeys describes the data keys of a tenant
+type TenantKeys struct {
+	Tenant     string    `json:"tenant"`
+	Current    int       `json:"current_version"`
+	Versions   int       `json:"versions"`
+	RotatedAt  time.Time `json:"rotated_at"`
+	MasterKeys []string  `json:"master_keys"` // wrapping the tenant's data keys
+}
+
+// Status describes the data keys of every tenant
+func (k *Keyring) Status() []TenantKeys {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	status := make([]TenantKeys, 0, len(k.tenants))
+	for tenant, keys := range k.tenants {
+		current := keys[len(keys)-1]
+		t := TenantKeys{Tenant: tenant, Current: current.Version, Versions: len(keys), RotatedAt: current.CreatedAt}
+		seen := make(map[string]bool)
+		for _, key := range keys {
+			if !seen[key.MasterKey] {
+				seen[key.MasterKey] = true
+				t.MasterKeys = append(t.MasterKeys, key.MasterKey)
+			}
+		}
+		sort.Strings(t.MasterKeys)
+		status = append(status, t)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Tenant < status[j].Tenant })
+	return status
+}
+
+// tenantOf returns the tenant of a stored key, "" outside of any tenant
+func tenantOf(key string) string {
+	tenant, _, ok := strings.Cut(key, ":")
+	if !ok {
+		return ""
+	}
+	return tenant
+}
+
+// EncryptValue encrypts the value of key with the current data key of its
+// tenant. The key is authenticated along, so that the value cannot be
+// moved to another key.
+func (k *Keyring) EncryptValue(key, value string) (string, error) {
+	tenant := tenantOf(key)
+	dataKey, err := k.current(tenant)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(dataKey.aead, []byte(value), []byte(key))
+	if err != nil {
+		return "", err
+	}
+	return valuePrefix + tenant + ":" + strconv.Itoa(dataKey.Version) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptValue decrypts a value of key. Values that are not encrypted,
+// written before encryption was enabled, are returned as they are.
+func (k *Keyring) DecryptValue(key, value string) (string, error) {
+	tenant, version, sealed, ok := parseValue(value)
+	if !ok {
+		if strings.HasPrefix(value, valuePrefix) {
+			return "", fmt.Errorf("%w of %s: malformed", ErrDecrypt, key)
+		}
+		return value, nil
+	}
+	dataKey, found := k.version(tenant, version)
+	if !found {
+		return "", fmt.Errorf("%w of %s: no data key %d for tenant %q", ErrDecrypt, key, version, tenant)
+	}
+	plain, err := open(dataKey.aead, sealed, []byte(key))
+	if err != nil {
+		return "", fmt.Errorf("%w of %s: %v", ErrDecrypt, key, err)
+	}
+	return string(plain), nil
+}
+
+// stale tells whether a stored value is not encrypted with the current
+// data key of the tenant of key
+func (k *Keyring) stale(key, value string) bool {
+	tenant, version, _, ok := parseValue(value)
+	if !ok {
+		return true
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := k.tenants[tenant]
+	return len(keys) == 0 || keys[len(keys)-1].Version != version
+}
+
+func parseValue(value string) (tenant string, version int, sealed []byte, ok bool) {
+	rest, found := strings.CutPrefix(value, valuePrefix)
+	if !found {
+		return "", 0, nil, false
+	}
+	parts := strings.SplitN(rest, ":", 3)
+	if len(parts) != 3 {
+		return "", 0, nil, false
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, nil, false
+	}
+	sealed, err = base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", 0, nil, false
+	}
+	return parts[0], version, sealed, true
+}
@@ -0,0 +1,270 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"distore/config"
+)
+
+// KMS wraps data keys with master keys that never leave it, like the key
+// management service of a cloud provider
+type KMS interface {
+	// CurrentKeyID names the master key new data keys are wrapped with
+	CurrentKeyID() string
+	Wrap(keyID string, dataKey []byte) ([]byte, error)
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// ErrUnknownMasterKey is returned for data keys wrapped by a master key the
+// KMS does not have
+var ErrUnknownMasterKey = errors.New("unknown master key")
+
+// NewKMS returns the KMS of cfg
+func NewKMS(cfg config.EncryptionConfig) (KMS, error) {
+	switch cfg.KMS {
+	case "", "file":
+		return NewFileKMS(cfg.MasterKeyFile)
+	case "local":
+		return NewLocalKMS(cfg.MasterKeyFile)
+	default:
+		return nil, fmt.Errorf("unknown kms %q", cfg.KMS)
+	}
+}
+
+// MasterKeys is the content of a master key file: AES-256 keys by ID, the
+// current one wrapping new data keys and the others kept to unwrap the
+// data keys they wrapped
+type MasterKeys struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"` // base64 in the file
+}
+
+// ReadMasterKeys reads a master key file
+func ReadMasterKeys(path string) (*MasterKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys MasterKeys
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, ok := keys.Keys[keys.Current]; !ok {
+		return nil, fmt.Errorf("%s: current key %q is not in keys", path, keys.Current)
+	}
+	for id, key := range keys.Keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("%s: key %q has %d bytes, AES-256 needs 32", path, id, len(key))
+		}
+	}
+	return &keys, nil
+}
+
+// Add generates a master key and makes it current
+func (m *MasterKeys) Add() (string, error) {
+	key, err := randomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	id, err := randomBytes(4)
+	if err != nil {
+		return "", err
+	}
+	if m.Keys == nil {
+		m.Keys = make(map[string][]byte)
+	}
+	m.Current = "mk-" + hex.EncodeToString(id)
+	m.Keys[m.Current] = key
+	return m.Current, nil
+}
+
+// Write saves the keys to path, readable by the owner only
+func (m *MasterKeys) Write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// FileKMS holds master keys read from a file. To rotate the master key,
+// add a key to the file, make it current and call Reload.
+type FileKMS struct {
+	mu      sync.RWMutex
+	path    string
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+func NewFileKMS(path string) (*FileKMS, error) {
+	k := &FileKMS{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload re-reads the master key file
+func (k *FileKMS) Reload() error {
+	keys, err := ReadMasterKeys(k.path)
+	if err != nil {
+		return err
+	}
+	return k.set(keys)
+}
+
+func (k *FileKMS) set(keys *MasterKeys) error {
+	aeads := make(map[string]cipher.AEAD, len(keys.Keys))
+	for id, key := range keys.Keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		aeads[id] = aead
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.current, k.aeads = keys.Current, aeads
+	return nil
+}
+
+func (k *FileKMS) CurrentKeyID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// KeyIDs lists the master keys of the file
+func (k *FileKMS) KeyIDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.aeads))
+	for id := range k.aeads {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (k *FileKMS) aead(keyID string) (cipher.AEAD, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownMasterKey, keyID)
+	}
+	return aead, nil
+}
+
+// Wrap encrypts a data key with a master key, bound to its ID
+func (k *FileKMS) Wrap(keyID string, dataKey []byte) ([]byte, error) {
+	aead, err := k.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, dataKey, []byte(keyID))
+}
+
+func (k *FileKMS) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	aead, err := k.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, wrapped, []byte(keyID))
+}
+
+// LocalKMS stands in for an external KMS on a single machine: it creates
+// its master keys itself, keeps them in a file and rotates them on request
+type LocalKMS struct {
+	*FileKMS
+	rotateMu sync.Mutex
+}
+
+// NewLocalKMS opens the key file at path, creating it with a first key
+func NewLocalKMS(path string) (*LocalKMS, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		keys := &MasterKeys{}
+		if _, err := keys.Add(); err != nil {
+			return nil, err
+		}
+		if err := keys.Write(path); err != nil {
+			return nil, err
+		}
+	}
+	file, err := NewFileKMS(path)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalKMS{FileKMS: file}, nil
+}
+
+// Rotate creates a master key and makes it current. The previous keys are
+// kept to unwrap the data keys they wrapped.
+func (k *LocalKMS) Rotate() (string, error) {
+	k.rotateMu.Lock()
+	defer k.rotateMu.Unlock()
+	keys, err := ReadMasterKeys(k.path)
+	if err != nil {
+		return "", err
+	}
+	id, err := keys.Add()
+	if err != nil {
+		return "", err
+	}
+	if err := keys.Write(k.path); err != nil {
+		return "", err
+	}
+	return id, k.set(keys)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which it prepends
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeFileAtomic replaces path with data, readable by the owner only
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
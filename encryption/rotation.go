@@ -0,0 +1,229 @@
+package encryption
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"distore/config"
+)
+
+const defaultReencryptRate = 100
+
+// Progress describes the latest re-encryption pass
+type Progress struct {
+	Running     bool      `json:"running"`
+	Started     time.Time `json:"started,omitempty"`
+	Finished    time.Time `json:"finished,omitempty"`
+	Scanned     int       `json:"scanned"`
+	Reencrypted int       `json:"reencrypted"`
+	Failed      int       `json:"failed"`
+}
+
+// Rotator rotates the data keys on a schedule, and re-encrypts in the
+// background the values left under an older data key or not encrypted
+type Rotator struct {
+	store *Storage
+
+	mu       sync.Mutex
+	cfg      config.EncryptionConfig
+	progress Progress
+	reset    chan struct{}
+	pass     chan struct{}
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewRotator(store *Storage, cfg config.EncryptionConfig) *Rotator {
+	return &Rotator{store: store, cfg: cfg, reset: make(chan struct{}, 1), pass: make(chan struct{}, 1)}
+}
+
+// Keyring returns the data keys the rotator rotates
+func (r *Rotator) Keyring() *Keyring {
+	return r.store.Keyring()
+}
+
+// Update changes the rotation schedule and the re-encryption rate of a
+// running rotator
+func (r *Rotator) Update(cfg config.EncryptionConfig) {
+	r.mu.Lock()
+	r.cfg = cfg
+	r.mu.Unlock()
+
+	select {
+	case r.reset <- struct{}{}:
+	default:
+	}
+}
+
+// Rotate makes a local KMS create a master key, or a file KMS re-read its
+// file, then adds a data key version to every tenant, rewraps the data
+// keys with the current master key and starts a re-encryption pass
+func (r *Rotator) Rotate() error {
+	keyring := r.store.Keyring()
+	switch kms := keyring.KMS().(type) {
+	case *LocalKMS:
+		id, err := kms.Rotate()
+		if err != nil {
+			return err
+		}
+		log.Printf("Rotated master key, now wrapping with %s", id)
+	case *FileKMS:
+		if err := kms.Reload(); err != nil {
+			return err
+		}
+	}
+
+	tenants, err := keyring.Rotate()
+	if err != nil {
+		return err
+	}
+	rewrapped, err := keyring.Rewrap()
+	if err != nil {
+		return err
+	}
+	log.Printf("Rotated the data keys of %d tenants, rewrapped %d data keys", tenants, rewrapped)
+
+	select {
+	case r.pass <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Progress describes the latest re-encryption pass
+func (r *Rotator) Progress() Progress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.progress
+}
+
+// Start rotates keys and re-encrypts in the background until Stop is
+// called. A first pass encrypts the values written before encryption was
+// enabled.
+func (r *Rotator) Start() {
+	r.mu.Lock()
+	if r.stop != nil {
+		r.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	r.stop = stop
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		pass := true
+		for {
+			if pass && !r.reencrypt(stop) {
+				return
+			}
+			pass = false
+
+			r.mu.Lock()
+			cfg := r.cfg
+			r.mu.Unlock()
+
+			var tick <-chan time.Time
+			var timer *time.Timer
+			if cfg.RotationInterval > 0 {
+				timer = time.NewTimer(time.Duration(cfg.RotationInterval) * time.Second)
+				tick = timer.C
+			}
+			select {
+			case <-tick:
+				if err := r.Rotate(); err != nil {
+					log.Printf("Data key rotation failed: %v", err)
+				}
+			case <-r.pass:
+				pass = true
+			case <-r.reset:
+			case <-stop:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}()
+}
+
+// reencrypt re-encrypts the stale values of the store at the configured
+// rate. It returns false when stopped.
+func (r *Rotator) reencrypt(stop <-chan struct{}) bool {
+	items, err := r.store.Storage.GetAll()
+	if err != nil {
+		log.Printf("Re-encryption: %v", err)
+		return true
+	}
+	r.mu.Lock()
+	r.progress = Progress{Running: true, Started: time.Now()}
+	r.mu.Unlock()
+
+	keyring := r.store.Keyring()
+	window, done := time.Now(), 0
+	for _, item := range items {
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+		r.mu.Lock()
+		r.progress.Scanned++
+		rate := r.cfg.ReencryptRate
+		r.mu.Unlock()
+		if !keyring.stale(item.Key, item.Value) {
+			continue
+		}
+
+		if rate <= 0 {
+			rate = defaultReencryptRate
+		}
+		if done >= rate {
+			select {
+			case <-time.After(time.Until(window.Add(time.Second))):
+			case <-stop:
+				return false
+			}
+			window, done = time.Now(), 0
+		}
+		done++
+
+		changed, err := r.store.Reencrypt(item.Key)
+		r.mu.Lock()
+		if err != nil {
+			r.progress.Failed++
+			log.Printf("Re-encryption of %s failed: %v", item.Key, err)
+		} else if changed {
+			r.progress.Reencrypted++
+		}
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	r.progress.Running = false
+	r.progress.Finished = time.Now()
+	progress := r.progress
+	r.mu.Unlock()
+	if progress.Reencrypted > 0 || progress.Failed > 0 {
+		log.Printf("Re-encryption pass done: %d values re-encrypted, %d failed", progress.Reencrypted, progress.Failed)
+	}
+	return true
+}
+
+// Stop halts the rotation and the re-encryption
+func (r *Rotator) Stop() {
+	r.mu.Lock()
+	if r.stop == nil {
+		r.mu.Unlock()
+		return
+	}
+	close(r.stop)
+	r.stop = nil
+	r.mu.Unlock()
+	r.wg.Wait()
+}
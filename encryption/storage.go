@@ -0,0 +1,103 @@
+package encryption
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"distore/storage"
+)
+
+// Storage encrypts the values written through it and decrypts the values
+// read. It wraps the base storage, so that the values are encrypted in the
+// data file whatever the layers above do with them.
+type Storage struct {
+	storage.Storage
+	keyring *Keyring
+	locks   [64]sync.Mutex // by key, so that re-encryption loses no write
+}
+
+func NewStorage(base storage.Storage, keyring *Keyring) *Storage {
+	return &Storage{Storage: base, keyring: keyring}
+}
+
+// Unwrap returns the wrapped storage
+func (s *Storage) Unwrap() storage.Storage {
+	return s.Storage
+}
+
+// Keyring returns the data keys of the storage
+func (s *Storage) Keyring() *Keyring {
+	return s.keyring
+}
+
+func (s *Storage) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &s.locks[h.Sum32()%uint32(len(s.locks))]
+}
+
+func (s *Storage) Set(key, value string) error {
+	encrypted, err := s.keyring.EncryptValue(key, value)
+	if err != nil {
+		return err
+	}
+	mu := s.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	return s.Storage.Set(key, encrypted)
+}
+
+func (s *Storage) Get(key string) (string, error) {
+	value, err := s.Storage.Get(key)
+	if err != nil {
+		return "", err
+	}
+	return s.keyring.DecryptValue(key, value)
+}
+
+func (s *Storage) Delete(key string) error {
+	mu := s.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	return s.Storage.Delete(key)
+}
+
+func (s *Storage) GetAll() ([]storage.KeyValue, error) {
+	items, err := s.Storage.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		if items[i].Value, err = s.keyring.DecryptValue(item.Key, item.Value); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// Reencrypt encrypts the stored value of key with the current data key of
+// its tenant, unless it already is. It reports whether the value changed.
+func (s *Storage) Reencrypt(key string) (bool, error) {
+	mu := s.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	stored, err := s.Storage.Get(key)
+	if err == storage.ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !s.keyring.stale(key, stored) {
+		return false, nil
+	}
+	value, err := s.keyring.DecryptValue(key, stored)
+	if err != nil {
+		return false, err
+	}
+	encrypted, err := s.keyring.EncryptValue(key, value)
+	if err != nil {
+		return false, err
+	}
+	return true, s.Storage.Set(key, encrypted)
+}
@@ -2,41 +2,63 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"distore/api"
 	"distore/auth"
 	"distore/config"
 	"distore/replication"
 	"distore/storage"
 	"encoding/json"
+	"encoding/pem"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 func TestIntegration(t *testing.T) {
 	// Setup
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyBytes, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
 	cfg := &config.Config{
 		// HTTPPort:     8080,
 		ReplicaCount: 2,
 		Nodes:        []string{"node1", "node2"},
 		Auth: config.AuthConfig{
-			Enabled:    true,
-			PrivateKey: "test-private-key",
-			PublicKey:  "test-public-key",
+			Enabled:       true,
+			PrivateKey:    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})),
+			PublicKey:     string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})),
+			TokenDuration: 3600,
 		},
 	}
 
 	store := storage.NewMemoryStorage()
 	replicator := replication.NewReplicator(cfg.Nodes, cfg.ReplicaCount)
-	authService, _ := auth.NewAuthService(&cfg.Auth)
+	signer, err := auth.NewAuthService(&cfg.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities := auth.NewIdentities()
+	if _, _, err := identities.Put("test-user", auth.IdentitySpec{TenantID: "test-tenant", Roles: []string{"read", "write"}, Secret: "test-password"}); err != nil {
+		t.Fatal(err)
+	}
+	authService := auth.NewIssuer(signer, identities, time.Hour)
 	handlers := api.NewHandlers(store, replicator, authService)
+	handlers.Issuer = authService
 
 	t.Run("Full CRUD flow with auth", func(t *testing.T) {
 		// Get token first
 		tokenReq := map[string]interface{}{
-			"user_id":   "test-user",
-			"tenant_id": "test-tenant",
-			"roles":     []string{"read", "write"},
+			"grant_type": "password",
+			"user_id":    "test-user",
+			"password":   "test-password",
 		}
 		tokenBody, _ := json.Marshal(tokenReq)
 
@@ -48,9 +70,9 @@ func TestIntegration(t *testing.T) {
 			t.Fatalf("Token request failed: %d", tokenResp.Code)
 		}
 
-		var tokenData map[string]string
+		var tokenData map[string]interface{}
 		json.NewDecoder(tokenResp.Body).Decode(&tokenData)
-		token := tokenData["token"]
+		token, _ := tokenData["token"].(string)
 
 		// Test set with auth
 		setReq := map[string]string{"key": "int-key", "value": "int-value"}
@@ -90,3 +112,44 @@ func TestIntegration(t *testing.T) {
 		}
 	})
 }
+
+func TestDataRoutes_WritesNeedWriteRole(t *testing.T) {
+	tokens := auth.NewSimpleAuthService(3600)
+	guard := auth.NewGuard(nil, nil)
+	handlers := api.NewHandlers(storage.NewMemoryStorage(), replication.NewReplicator([]string{}, 0), tokens)
+
+	router := mux.NewRouter()
+	writes := dataRoutes(router, auth.RoleWrite, tokens, guard)
+	writes.HandleFunc("/set", handlers.SetHandler).Methods("POST")
+	writes.HandleFunc("/delete/{key}", handlers.DeleteHandler).Methods("DELETE")
+	reads := dataRoutes(router, auth.RoleRead, tokens, guard)
+	reads.HandleFunc("/get/{key}", handlers.GetHandler).Methods("GET")
+
+	do := func(roles []string, method, target, body string) int {
+		token, _ := tokens.GenerateToken("u", "t1", roles)
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	read := []string{"read"}
+	if code := do(read, "POST", "/set", `{"key":"k","value":"v"}`); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a set with a read token, got %d", code)
+	}
+	if code := do(read, "DELETE", "/delete/k", ""); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a delete with a read token, got %d", code)
+	}
+
+	write := []string{"write"}
+	if code := do(write, "POST", "/set", `{"key":"k","value":"v"}`); code != http.StatusCreated {
+		t.Errorf("Expected a write token to set, got %d", code)
+	}
+	if code := do(read, "GET", "/get/k", ""); code != http.StatusOK {
+		t.Errorf("Expected a read token to get, got %d", code)
+	}
+	if code := do(write, "DELETE", "/delete/k", ""); code != http.StatusOK {
+		t.Errorf("Expected a write token to delete, got %d", code)
+	}
+}
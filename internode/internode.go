@@ -0,0 +1,191 @@
+// Package internode secures the requests nodes send each other: https with
+// mutual TLS against the cluster CA, and a replicator service token on every
+// request. Components build peer URLs with URL and their HTTP clients with
+// NewClient or Wrap, and client requests they relay with Relay; until
+// Configure is called all stay plain http.
+package internode
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"distore/config"
+)
+
+// TokenSource returns the bearer token sent with internal requests
+type TokenSource interface {
+	Token() (string, error)
+}
+
+type settings struct {
+	scheme    string
+	clientTLS *tls.Config
+	serverTLS *tls.Config
+	tokens    TokenSource
+}
+
+var current atomic.Pointer[settings]
+
+func load() *settings {
+	if s := current.Load(); s != nil {
+		return s
+	}
+	return &settings{scheme: "http"}
+}
+
+// Configure switches node-to-node traffic to the given settings. It can be
+// called again to rotate certificates; open connections keep theirs.
+func Configure(cfg config.InternodeConfig, tokens TokenSource) error {
+	s := &settings{scheme: "http"}
+	if cfg.ServiceToken {
+		s.tokens = tokens
+	}
+
+	if cfg.TLS {
+		caPEM, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("reading cluster CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificate found in %s", cfg.CAFile)
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading node certificate: %w", err)
+		}
+
+		s.scheme = "https"
+		s.clientTLS = &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		// Public clients have no node certificate, so it is only required
+		// on the internal routes (see auth.InternodeMiddleware)
+		s.serverTLS = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	current.Store(s)
+	return nil
+}
+
+// Reset goes back to plain http without tokens
+func Reset() {
+	current.Store(nil)
+}
+
+// Scheme is "https" with internode TLS, "http" otherwise
+func Scheme() string {
+	return load().scheme
+}
+
+// URL returns the address of path on node, e.g. URL("node1:8080", "/internal/set")
+func URL(node, path string) string {
+	return load().scheme + "://" + node + path
+}
+
+// ServerTLSConfig returns the listener config with internode TLS, or nil.
+// A public certificate, when given, is served instead of the node certificate;
+// nodes then need to trust it as well.
+func ServerTLSConfig(public *tls.Certificate) *tls.Config {
+	if load().serverTLS == nil {
+		return nil
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := load().serverTLS
+			if cfg == nil {
+				return nil, nil
+			}
+			if public != nil {
+				cfg = cfg.Clone()
+				cfg.Certificates = []tls.Certificate{*public}
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// defaultTransport shares its connections between all clients from NewClient
+var defaultTransport = &transport{base: http.DefaultTransport.(*http.Transport)}
+
+// NewClient returns an HTTP client for requests to other nodes. Clients
+// share one connection pool, so it is cheap to call per request.
+func NewClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: defaultTransport}
+}
+
+// Wrap adds the internode TLS config and service token to base
+func Wrap(base *http.Transport) http.RoundTripper {
+	if base == nil {
+		return defaultTransport
+	}
+	return &transport{base: base}
+}
+
+// Relay returns a transport for client requests relayed to the nodes, as by
+// edge instances. It trusts the cluster CA with internode TLS but sends
+// neither the node certificate nor a service token, so nodes authorize the
+// client's own credentials.
+func Relay(base *http.Transport) http.RoundTripper {
+	return &transport{base: base, relay: true}
+}
+
+type transport struct {
+	base  *http.Transport
+	relay bool // client requests: no node certificate or service token
+
+	mu      sync.Mutex
+	applied *settings // settings the cached transport was built for
+	rt      *http.Transport
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := load()
+	if !t.relay && s.tokens != nil && req.Header.Get("Authorization") == "" {
+		token, err := s.tokens.Token()
+		if err != nil {
+			return nil, fmt.Errorf("service token: %w", err)
+		}
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return t.transportFor(s).RoundTrip(req)
+}
+
+// transportFor returns base with the client TLS config of s, rebuilding it
+// after the settings changed
+func (t *transport) transportFor(s *settings) *http.Transport {
+	if s.clientTLS == nil {
+		return t.base
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.applied != s {
+		if t.rt != nil {
+			t.rt.CloseIdleConnections()
+		}
+		t.rt = t.base.Clone()
+		t.rt.TLSClientConfig = s.clientTLS
+		if t.relay {
+			t.rt.TLSClientConfig = s.clientTLS.Clone()
+			t.rt.TLSClientConfig.Certificates = nil
+		}
+		t.applied = s
+	}
+	return t.rt
+}
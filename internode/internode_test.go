@@ -0,0 +1,152 @@
+package internode
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"distore/config"
+)
+
+type staticToken string
+
+func (s staticToken) Token() (string, error) { return string(s), nil }
+
+// writeNodeFiles creates a CA and a certificate for 127.0.0.1 in a temp dir
+func writeNodeFiles(t *testing.T) config.InternodeConfig {
+	t.Helper()
+	dir := t.TempDir()
+	ca, caPEM, _, err := NewCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.IssueNodeCert("node1", []string{"127.0.0.1", "localhost"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.InternodeConfig{
+		TLS:      true,
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "node1.pem"),
+		KeyFile:  filepath.Join(dir, "node1-key.pem"),
+	}
+	for file, data := range map[string][]byte{cfg.CAFile: caPEM, cfg.CertFile: certPEM, cfg.KeyFile: keyPEM} {
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg
+}
+
+func TestMutualTLS(t *testing.T) {
+	cfg := writeNodeFiles(t)
+	cfg.ServiceToken = true
+	if err := Configure(cfg, staticToken("service-token")); err != nil {
+		t.Fatal(err)
+	}
+	defer Reset()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "no node certificate", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer service-token" {
+			http.Error(w, "no token", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = ServerTLSConfig(nil)
+	server.StartTLS()
+	defer server.Close()
+	node := strings.TrimPrefix(server.URL, "https://")
+
+	if url := URL(node, "/internal/set"); !strings.HasPrefix(url, "https://") {
+		t.Fatalf("Expected an https URL, got %s", url)
+	}
+	resp, err := NewClient(2 * time.Second).Get(URL(node, "/internal/set"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected node request to pass, got %d", resp.StatusCode)
+	}
+
+	// A client trusting the CA but without a node certificate is not a node
+	clientTLS := load().clientTLS.Clone()
+	clientTLS.Certificates = nil
+	plain := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	resp, err = plain.Get(URL(node, "/internal/set"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a node certificate, got %d", resp.StatusCode)
+	}
+
+	// Relayed client requests trust the CA but are not node requests either
+	relay := &http.Client{Transport: Relay(&http.Transport{})}
+	resp, err = relay.Get(URL(node, "/internal/set"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a relayed request, got %d", resp.StatusCode)
+	}
+
+	// A certificate from another CA fails the handshake
+	other := writeNodeFiles(t)
+	cert, err := tls.LoadX509KeyPair(other.CertFile, other.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS.Certificates = []tls.Certificate{cert}
+	foreign := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	if resp, err := foreign.Get(URL(node, "/internal/set")); err == nil {
+		resp.Body.Close()
+		t.Error("Expected a certificate from another CA to be rejected")
+	}
+}
+
+func TestDefaultsToPlainHTTP(t *testing.T) {
+	Reset()
+	if url := URL("node1:8080", "/internal/get/k"); url != "http://node1:8080/internal/get/k" {
+		t.Errorf("Unexpected URL %s", url)
+	}
+
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	resp, err := NewClient(time.Second).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if auth != "" {
+		t.Errorf("Expected no token without service tokens, got %q", auth)
+	}
+}
+
+func TestConfigure_InvalidFiles(t *testing.T) {
+	cfg := writeNodeFiles(t)
+	cfg.CertFile = cfg.CAFile // key does not match
+	if err := Configure(cfg, nil); err == nil {
+		Reset()
+		t.Fatal("Expected mismatched certificate and key to be rejected")
+	}
+	if Scheme() != "http" {
+		t.Error("A failed Configure must keep the previous settings")
+	}
+}
@@ -36,6 +36,13 @@ func ValidateMultiCloudConfig(cfg *config.MultiCloudConfig) error {
 		return fmt.Errorf("invalid latency config: %w", err)
 	}
 
+	// Validate read routing policy
+	switch cfg.ReadPolicy {
+	case "", "local_dc_first", "nearest", "edge_first", "primary_only":
+	default:
+		return fmt.Errorf("invalid read policy %q", cfg.ReadPolicy)
+	}
+
 	// Validate cloud providers
 	for _, provider := range cfg.CloudProviders {
 		if err := validateCloudProviderConfig(provider); err != nil {
@@ -148,6 +155,14 @@ func validateLatencyConfig(latency config.LatencyConfig) error {
 		return fmt.Errorf("latency threshold must be non-negative")
 	}
 
+	if latency.ProbeIntervalMs < 0 || latency.ProbeTimeoutMs < 0 || latency.WindowSize < 0 {
+		return fmt.Errorf("latency probe settings must be non-negative")
+	}
+
+	if latency.Smoothing < 0 || latency.Smoothing > 1 {
+		return fmt.Errorf("latency smoothing must be between 0 and 1")
+	}
+
 	return nil
 }
 
@@ -2,82 +2,135 @@ package k8s
 
 import (
 	"distore/config"
+	"fmt"
 	"log"
+	"net/http"
 	"sync"
 	"time"
+
+	"k8s.io/client-go/kubernetes"
 )
 
 // EdgeNodeManager manages edge node deployments and configurations
 type EdgeNodeManager struct {
-	kubeClient interface{} // Will be kubernetes.Clientset when K8s dependencies are available
+	kubeClient kubernetes.Interface // nil when edge instances are not deployed by this manager
 	config     *config.MultiCloudConfig
 	mu         sync.RWMutex
-	// Potentially a way to communicate with the main cluster's API
+
+	// Edge instance deployment, see edge_deploy.go
+	deployOpts EdgeDeploymentOptions
+	overrides  map[string]edgeOverrides // edge node id -> settings from UpdateEdgeConfiguration
+
+	// Health probing, see edge_health.go
+	healthOpts EdgeHealthOptions
+	health     map[string]*EdgeNodeHealth // edge node id -> last probe result
+	httpClient *http.Client
+	stop       chan struct{}
 }
 
 // NewEdgeNodeManager creates a new edge node manager
 func NewEdgeNodeManager(cfg *config.MultiCloudConfig) (*EdgeNodeManager, error) {
-	// Note: This is a simplified version without Kubernetes dependencies
-	// In a real implementation, you would create a Kubernetes client here
-
+	// Edge instances are deployed only once SetKubeClient is called
 	enm := &EdgeNodeManager{
-		kubeClient: nil, // Will be set when K8s dependencies are available
 		config:     cfg,
+		healthOpts: DefaultEdgeHealthOptions(),
+		health:     make(map[string]*EdgeNodeHealth),
+		stop:       make(chan struct{}),
 	}
+	enm.httpClient = &http.Client{Timeout: enm.healthOpts.Timeout}
 
 	go enm.monitorEdgeNodes()
 
 	return enm, nil
 }
 
+// Stop ends the background health probing
+func (enm *EdgeNodeManager) Stop() {
+	enm.mu.Lock()
+	defer enm.mu.Unlock()
+	if enm.stop != nil {
+		close(enm.stop)
+		enm.stop = nil
+	}
+}
+
 func (enm *EdgeNodeManager) monitorEdgeNodes() {
-	ticker := time.NewTicker(1 * time.Minute) // Monitor every minute
-	defer ticker.Stop()
-
-	for range ticker.C {
-		log.Println("Monitoring edge nodes...")
-		enm.mu.RLock()
-		edgeNodes := enm.config.EdgeNodes
-		enm.mu.RUnlock()
-
-		for _, edgeCfg := range edgeNodes {
-			// Simulate checking edge node status and applying configurations
-			log.Printf("Checking edge node: %s at %s", edgeCfg.ID, edgeCfg.Location)
-			// In a real scenario, this would involve:
-			// 1. Checking connectivity to the edge node's API
-			// 2. Verifying data consistency/cache status if cacheOnly is true
-			// 3. Potentially deploying/updating edge-specific distore instances
+	enm.mu.RLock()
+	stop := enm.stop
+	enm.mu.RUnlock()
+
+	for {
+		enm.ProbeAll()
+
+		opts, _ := enm.healthOptions()
+		select {
+		case <-time.After(opts.Interval):
+		case <-stop:
+			return
 		}
 	}
 }
 
-// DeployEdgeInstance simulates deploying a distore instance to an edge location
+// DeployEdgeInstance creates or updates the ConfigMap, Service, Deployment
+// and, for full replica edges, the volume of an edge instance
 func (enm *EdgeNodeManager) DeployEdgeInstance(edgeNode config.EdgeNodeConfig) error {
-	log.Printf("Deploying Distore instance to edge node %s (%s)", edgeNode.ID, edgeNode.Location)
-
-	// Note: This is a simplified version without Kubernetes dependencies
-	// In a real implementation, you would create a Kubernetes Pod here
-	// Example pod configuration:
-	// - Name: distore-edge-{edgeNode.ID}
-	// - Image: distore/distore:latest
-	// - Args: --http_port=8080 --data_dir=/data --cache_only={edgeNode.CacheOnly}
-	// - Labels: app=distore-edge, edge-id={edgeNode.ID}, location={edgeNode.Location}
+	client, opts, err := enm.deployment()
+	if err != nil {
+		return err
+	}
 
-	if enm.kubeClient != nil {
-		// In a real implementation, create the pod using Kubernetes client
-		log.Printf("Creating Kubernetes pod for edge node %s", edgeNode.ID)
+	log.Printf("Deploying Distore instance to edge node %s (%s)", edgeNode.ID, edgeNode.Location)
+	if err := enm.applyEdgeInstance(client, opts, edgeNode); err != nil {
+		return err
 	}
 
 	log.Printf("Successfully deployed edge instance for %s", edgeNode.ID)
 	return nil
 }
 
-// UpdateEdgeConfiguration simulates updating the configuration of an existing edge instance
+// UpdateEdgeConfiguration changes settings of a configured edge node and
+// applies them to its instance. Accepted keys are location, cache_only,
+// latency_ms, image, cache_entries, cache_bytes and max_staleness_ms.
 func (enm *EdgeNodeManager) UpdateEdgeConfiguration(edgeNodeID string, newConfig map[string]string) error {
 	log.Printf("Updating configuration for edge node %s with %v", edgeNodeID, newConfig)
-	// In a real scenario, this would involve patching the deployment/statefulset
-	// or sending an API call to the edge instance.
-	return nil
+
+	enm.mu.Lock()
+	if enm.config == nil {
+		enm.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknownEdgeNode, edgeNodeID)
+	}
+	index := -1
+	for i, node := range enm.config.EdgeNodes {
+		if node.ID == edgeNodeID {
+			index = i
+		}
+	}
+	if index < 0 {
+		enm.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknownEdgeNode, edgeNodeID)
+	}
+
+	edge := enm.config.EdgeNodes[index]
+	overrides := enm.overrides[edgeNodeID]
+	if err := applyEdgeConfiguration(&edge, &overrides, newConfig); err != nil {
+		enm.mu.Unlock()
+		return err
+	}
+
+	// Copy on write, callers may hold the slice returned by GetEdgeNodes
+	edgeNodes := append([]config.EdgeNodeConfig(nil), enm.config.EdgeNodes...)
+	edgeNodes[index] = edge
+	enm.config.EdgeNodes = edgeNodes
+	if enm.overrides == nil {
+		enm.overrides = make(map[string]edgeOverrides)
+	}
+	enm.overrides[edgeNodeID] = overrides
+	enm.mu.Unlock()
+
+	if _, _, err := enm.deployment(); err == ErrNoKubeClient {
+		return nil
+	}
+	return enm.DeployEdgeInstance(edge)
 }
 
 // GetEdgeNodes returns all configured edge nodes
@@ -134,40 +187,58 @@ func (enm *EdgeNodeManager) GetFullReplicaNodes() []config.EdgeNodeConfig {
 	return nodes
 }
 
-// GetOptimalEdgeNode returns the optimal edge node for a given location
+// GetOptimalEdgeNode returns the optimal edge node for a given location.
+// Offline edges are skipped, degraded ones are used only without a healthy one.
 func (enm *EdgeNodeManager) GetOptimalEdgeNode(location string) *config.EdgeNodeConfig {
-	enm.mu.RLock()
-	defer enm.mu.RUnlock()
-
-	var bestNode *config.EdgeNodeConfig
-	minLatency := int(^uint(0) >> 1) // Max int
-
-	for _, node := range enm.config.EdgeNodes {
-		if node.Location == location && node.LatencyMs < minLatency {
-			bestNode = &node
-			minLatency = node.LatencyMs
-		}
-	}
-
-	return bestNode
+	return enm.selectEdgeNode(func(node config.EdgeNodeConfig) bool {
+		return node.Location == location
+	})
 }
 
-// GetOptimalCacheOnlyNode returns the cache-only node with lowest latency
+// GetOptimalCacheOnlyNode returns the available cache-only node with lowest latency
 func (enm *EdgeNodeManager) GetOptimalCacheOnlyNode() *config.EdgeNodeConfig {
+	return enm.selectEdgeNode(func(node config.EdgeNodeConfig) bool {
+		return node.CacheOnly
+	})
+}
+
+func (enm *EdgeNodeManager) selectEdgeNode(match func(config.EdgeNodeConfig) bool) *config.EdgeNodeConfig {
 	enm.mu.RLock()
 	defer enm.mu.RUnlock()
 
+	if enm.config == nil {
+		return nil
+	}
+
 	var bestNode *config.EdgeNodeConfig
-	minLatency := int(^uint(0) >> 1) // Max int
+	bestRank, minLatency := 0, 0
 
-	for _, node := range enm.config.EdgeNodes {
-		if node.CacheOnly && node.LatencyMs < minLatency {
-			bestNode = &node
-			minLatency = node.LatencyMs
+	for i := range enm.config.EdgeNodes {
+		node := &enm.config.EdgeNodes[i]
+		if !match(*node) {
+			continue
+		}
+
+		state, latency := enm.stateLocked(*node)
+		rank := 0
+		switch state {
+		case EdgeStateOffline:
+			continue
+		case EdgeStateDegraded:
+			rank = 1
+		}
+
+		if bestNode == nil || rank < bestRank || (rank == bestRank && latency < minLatency) {
+			bestNode = node
+			bestRank, minLatency = rank, latency
 		}
 	}
 
-	return bestNode
+	if bestNode == nil {
+		return nil
+	}
+	best := *bestNode
+	return &best
 }
 
 // SyncWithDataCenters syncs edge nodes with data centers
@@ -188,27 +259,18 @@ func (enm *EdgeNodeManager) SyncWithDataCenters() error {
 	return nil
 }
 
-// EdgeNodeHealth represents the health status of an edge node
-type EdgeNodeHealth struct {
-	NodeID   string `json:"node_id"`
-	Location string `json:"location"`
-	Latency  int    `json:"latency_ms"`
-	Healthy  bool   `json:"healthy"`
-}
-
 // GetEdgeNodeHealth returns the health status of a specific edge node
 func (enm *EdgeNodeManager) GetEdgeNodeHealth(edgeNodeID string) *EdgeNodeHealth {
 	enm.mu.RLock()
 	defer enm.mu.RUnlock()
 
+	if enm.config == nil {
+		return nil
+	}
 	for _, node := range enm.config.EdgeNodes {
 		if node.ID == edgeNodeID {
-			return &EdgeNodeHealth{
-				NodeID:   node.ID,
-				Location: node.Location,
-				Latency:  node.LatencyMs,
-				Healthy:  true, // Simplified health check
-			}
+			health := enm.healthLocked(node)
+			return &health
 		}
 	}
 
@@ -221,13 +283,11 @@ func (enm *EdgeNodeManager) GetAllEdgeNodeHealth() []EdgeNodeHealth {
 	defer enm.mu.RUnlock()
 
 	var health []EdgeNodeHealth
+	if enm.config == nil {
+		return health
+	}
 	for _, node := range enm.config.EdgeNodes {
-		health = append(health, EdgeNodeHealth{
-			NodeID:   node.ID,
-			Location: node.Location,
-			Latency:  node.LatencyMs,
-			Healthy:  true,
-		})
+		health = append(health, enm.healthLocked(node))
 	}
 
 	return health
@@ -1,9 +1,21 @@
 package k8s
 
 import (
+	"context"
 	"distore/config"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestEdgeNodeManager_New(t *testing.T) {
@@ -303,6 +315,297 @@ func createTestEdgeNodeManager(t *testing.T, cfg *config.MultiCloudConfig) *Edge
 	}
 }
 
+func TestEdgeNodeManager_HealthTransitions(t *testing.T) {
+	var down atomic.Bool
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer edge.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backup.Close()
+
+	cfg := &config.MultiCloudConfig{
+		Enabled: true,
+		EdgeNodes: []config.EdgeNodeConfig{
+			{ID: "edge-near", Location: "Paris", Node: strings.TrimPrefix(edge.URL, "http://"), LatencyMs: 5},
+			{ID: "edge-far", Location: "Paris", Node: strings.TrimPrefix(backup.URL, "http://"), LatencyMs: 100},
+		},
+	}
+	enm := &EdgeNodeManager{config: cfg}
+	enm.SetHealthOptions(EdgeHealthOptions{Timeout: time.Second, OfflineAfter: 2})
+
+	enm.ProbeAll()
+	if health := enm.GetEdgeNodeHealth("edge-near"); health.State != EdgeStateHealthy || !health.Healthy {
+		t.Fatalf("Expected edge-near healthy, got %+v", health)
+	}
+
+	down.Store(true)
+	enm.ProbeAll()
+	health := enm.GetEdgeNodeHealth("edge-near")
+	if health.State != EdgeStateDegraded || health.Healthy {
+		t.Errorf("Expected edge-near degraded after one failure, got %+v", health)
+	}
+	if health.LastError == "" {
+		t.Error("Expected the failed probe to be recorded")
+	}
+
+	enm.ProbeAll()
+	if health := enm.GetEdgeNodeHealth("edge-near"); health.State != EdgeStateOffline {
+		t.Errorf("Expected edge-near offline after two failures, got %+v", health)
+	}
+
+	// The offline edge is skipped even though it was configured as closer
+	optimal := enm.GetOptimalEdgeNode("Paris")
+	if optimal == nil || optimal.ID != "edge-far" {
+		t.Errorf("Expected edge-far to be selected, got %+v", optimal)
+	}
+
+	down.Store(false)
+	enm.ProbeAll()
+	health = enm.GetEdgeNodeHealth("edge-near")
+	if health.State != EdgeStateHealthy || health.ConsecutiveFailures != 0 {
+		t.Errorf("Expected edge-near to recover, got %+v", health)
+	}
+}
+
+func TestEdgeNodeManager_CacheStats(t *testing.T) {
+	var lastSync atomic.Value
+	lastSync.Store(time.Now())
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/internal/edge_stats" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"entries": 42,
+			"hits":    3,
+			"misses":  1,
+			"sources": []map[string]interface{}{{"last_sync": lastSync.Load()}},
+		})
+	}))
+	defer edge.Close()
+
+	cfg := &config.MultiCloudConfig{
+		Enabled: true,
+		EdgeNodes: []config.EdgeNodeConfig{
+			{ID: "edge-cache", Location: "Cache", Node: strings.TrimPrefix(edge.URL, "http://"), CacheOnly: true},
+		},
+	}
+	enm := &EdgeNodeManager{config: cfg}
+	enm.SetHealthOptions(EdgeHealthOptions{Timeout: time.Second, MaxSyncLag: time.Minute})
+
+	enm.ProbeAll()
+	health := enm.GetEdgeNodeHealth("edge-cache")
+	if health.State != EdgeStateHealthy {
+		t.Fatalf("Expected edge-cache healthy, got %+v", health)
+	}
+	if health.CacheEntries != 42 || health.CacheHitRate != 0.75 {
+		t.Errorf("Expected 42 entries at 0.75 hit rate, got %d at %v", health.CacheEntries, health.CacheHitRate)
+	}
+
+	// An edge that stopped syncing invalidations is degraded
+	lastSync.Store(time.Now().Add(-2 * time.Minute))
+	enm.ProbeAll()
+	health = enm.GetEdgeNodeHealth("edge-cache")
+	if health.State != EdgeStateDegraded {
+		t.Errorf("Expected edge-cache degraded by sync lag, got %+v", health)
+	}
+	if health.SyncLagMs < time.Minute.Milliseconds() {
+		t.Errorf("Expected sync lag above a minute, got %dms", health.SyncLagMs)
+	}
+}
+
+func newDeployingEdgeManager(edgeNodes ...config.EdgeNodeConfig) (*EdgeNodeManager, *fake.Clientset) {
+	client := fake.NewClientset()
+	enm := &EdgeNodeManager{config: &config.MultiCloudConfig{
+		Enabled:   true,
+		EdgeNodes: edgeNodes,
+		DataCenters: []config.DataCenterConfig{
+			{ID: "us-east", Nodes: []string{"core-0:8080", "core-1:8080"}},
+		},
+	}}
+	enm.SetKubeClient(client, EdgeDeploymentOptions{Namespace: "edge-test", Image: "distore/server:1.0"})
+	return enm, client
+}
+
+func TestEdgeNodeManager_DeployEdgeInstance(t *testing.T) {
+	cacheEdge := config.EdgeNodeConfig{ID: "edge-nyc", Location: "New York", CacheOnly: true}
+	replicaEdge := config.EdgeNodeConfig{ID: "edge-london", Location: "London"}
+	enm, client := newDeployingEdgeManager(cacheEdge, replicaEdge)
+	ctx := context.Background()
+
+	for _, edge := range []config.EdgeNodeConfig{cacheEdge, replicaEdge} {
+		if err := enm.DeployEdgeInstance(edge); err != nil {
+			t.Fatalf("DeployEdgeInstance(%s) failed: %v", edge.ID, err)
+		}
+	}
+
+	deployment, err := client.AppsV1().Deployments("edge-test").Get(ctx, "distore-edge-edge-nyc", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected a deployment for edge-nyc: %v", err)
+	}
+	if deployment.Labels[EdgeLocationLabel] != "new-york" || deployment.Labels[EdgeModeLabel] != "cache-only" {
+		t.Errorf("Unexpected labels %v", deployment.Labels)
+	}
+	terms := deployment.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) != 1 || terms[0].MatchExpressions[0].Key != EdgeLocationLabel || terms[0].MatchExpressions[0].Values[0] != "new-york" {
+		t.Errorf("Expected node affinity to new-york, got %+v", terms)
+	}
+	pod := deployment.Spec.Template.Spec
+	if pod.Containers[0].Image != "distore/server:1.0" {
+		t.Errorf("Expected image distore/server:1.0, got %s", pod.Containers[0].Image)
+	}
+	if pod.Volumes[0].EmptyDir == nil {
+		t.Error("Expected a cache-only edge to keep no volume")
+	}
+
+	cm, err := client.CoreV1().ConfigMaps("edge-test").Get(ctx, "distore-edge-edge-nyc-config", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected a config map for edge-nyc: %v", err)
+	}
+	var cfg config.Config
+	if err := json.Unmarshal([]byte(cm.Data["config.json"]), &cfg); err != nil {
+		t.Fatalf("Invalid edge config: %v", err)
+	}
+	if !cfg.Edge.CacheOnly || len(cfg.Nodes) != 2 || len(cfg.MultiCloud.DataCenters) != 1 {
+		t.Errorf("Expected a cache-only config in front of the core nodes, got %+v", cfg)
+	}
+
+	if _, err := client.CoreV1().Services("edge-test").Get(ctx, "distore-edge-edge-nyc", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected a service for edge-nyc: %v", err)
+	}
+	if _, err := client.CoreV1().PersistentVolumeClaims("edge-test").Get(ctx, "distore-edge-edge-nyc-data", metav1.GetOptions{}); err == nil {
+		t.Error("Expected no volume for a cache-only edge")
+	}
+
+	// A full replica edge keeps its data on a volume
+	if _, err := client.CoreV1().PersistentVolumeClaims("edge-test").Get(ctx, "distore-edge-edge-london-data", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected a volume for edge-london: %v", err)
+	}
+	deployment, _ = client.AppsV1().Deployments("edge-test").Get(ctx, "distore-edge-edge-london", metav1.GetOptions{})
+	if claim := deployment.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim; claim == nil || claim.ClaimName != "distore-edge-edge-london-data" {
+		t.Errorf("Expected edge-london to mount its volume, got %+v", deployment.Spec.Template.Spec.Volumes[0])
+	}
+}
+
+func TestEdgeNodeManager_UpdateEdgeConfiguration(t *testing.T) {
+	edge := config.EdgeNodeConfig{ID: "edge-nyc", Location: "New York", CacheOnly: true}
+	enm, client := newDeployingEdgeManager(edge)
+	ctx := context.Background()
+
+	if err := enm.DeployEdgeInstance(edge); err != nil {
+		t.Fatalf("DeployEdgeInstance failed: %v", err)
+	}
+	before, _ := client.AppsV1().Deployments("edge-test").Get(ctx, "distore-edge-edge-nyc", metav1.GetOptions{})
+
+	err := enm.UpdateEdgeConfiguration("edge-nyc", map[string]string{
+		"image":            "distore/server:2.0",
+		"location":         "Boston",
+		"max_staleness_ms": "2000",
+	})
+	if err != nil {
+		t.Fatalf("UpdateEdgeConfiguration failed: %v", err)
+	}
+
+	after, _ := client.AppsV1().Deployments("edge-test").Get(ctx, "distore-edge-edge-nyc", metav1.GetOptions{})
+	if image := after.Spec.Template.Spec.Containers[0].Image; image != "distore/server:2.0" {
+		t.Errorf("Expected image distore/server:2.0, got %s", image)
+	}
+	if after.Labels[EdgeLocationLabel] != "boston" {
+		t.Errorf("Expected location label boston, got %v", after.Labels)
+	}
+	if before.Spec.Template.Annotations[edgeConfigHashAnnotation] == after.Spec.Template.Annotations[edgeConfigHashAnnotation] {
+		t.Error("Expected a config change to restart the edge pod")
+	}
+
+	cm, _ := client.CoreV1().ConfigMaps("edge-test").Get(ctx, "distore-edge-edge-nyc-config", metav1.GetOptions{})
+	var cfg config.Config
+	json.Unmarshal([]byte(cm.Data["config.json"]), &cfg)
+	if cfg.Edge.MaxStalenessMs != 2000 {
+		t.Errorf("Expected max staleness 2000ms, got %d", cfg.Edge.MaxStalenessMs)
+	}
+	if got := enm.GetEdgeNodes()[0].Location; got != "Boston" {
+		t.Errorf("Expected the configured location to change, got %s", got)
+	}
+
+	if err := enm.UpdateEdgeConfiguration("edge-nyc", map[string]string{"colour": "blue"}); !errors.Is(err, ErrInvalidEdgeValue) {
+		t.Errorf("Expected ErrInvalidEdgeValue for an unknown key, got %v", err)
+	}
+	if err := enm.UpdateEdgeConfiguration("edge-nyc", map[string]string{"cache_only": "maybe"}); !errors.Is(err, ErrInvalidEdgeValue) {
+		t.Errorf("Expected ErrInvalidEdgeValue for an invalid value, got %v", err)
+	}
+	if err := enm.UpdateEdgeConfiguration("edge-paris", map[string]string{"image": "x"}); !errors.Is(err, ErrUnknownEdgeNode) {
+		t.Errorf("Expected ErrUnknownEdgeNode, got %v", err)
+	}
+}
+
+func TestEdgeNodeManager_SyncRemovesEdges(t *testing.T) {
+	nyc := config.EdgeNodeConfig{ID: "edge-nyc", Location: "New York", CacheOnly: true}
+	london := config.EdgeNodeConfig{ID: "edge-london", Location: "London"}
+	enm, client := newDeployingEdgeManager(nyc, london)
+	ctx := context.Background()
+
+	if err := enm.SyncEdgeInstances(); err != nil {
+		t.Fatalf("SyncEdgeInstances failed: %v", err)
+	}
+	if list, _ := client.AppsV1().Deployments("edge-test").List(ctx, metav1.ListOptions{}); len(list.Items) != 2 {
+		t.Fatalf("Expected 2 edge deployments, got %d", len(list.Items))
+	}
+
+	if err := enm.UpdateEdgeNodes([]config.EdgeNodeConfig{nyc}); err != nil {
+		t.Fatalf("UpdateEdgeNodes failed: %v", err)
+	}
+
+	list, _ := client.AppsV1().Deployments("edge-test").List(ctx, metav1.ListOptions{})
+	if len(list.Items) != 1 || list.Items[0].Labels[EdgeIDLabel] != "edge-nyc" {
+		t.Errorf("Expected only edge-nyc to remain, got %d deployments", len(list.Items))
+	}
+	for _, name := range []string{"distore-edge-edge-london", "distore-edge-edge-london-config", "distore-edge-edge-london-data"} {
+		if _, err := client.CoreV1().Services("edge-test").Get(ctx, name, metav1.GetOptions{}); err == nil {
+			t.Errorf("Expected service %s to be removed", name)
+		}
+	}
+	if _, err := client.CoreV1().ConfigMaps("edge-test").Get(ctx, "distore-edge-edge-london-config", metav1.GetOptions{}); err == nil {
+		t.Error("Expected the config map of edge-london to be removed")
+	}
+	if _, err := client.CoreV1().PersistentVolumeClaims("edge-test").Get(ctx, "distore-edge-edge-london-data", metav1.GetOptions{}); err == nil {
+		t.Error("Expected the volume of edge-london to be removed")
+	}
+
+	// Objects of other deployments are left alone
+	other := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "edge-test"}}
+	client.CoreV1().ConfigMaps("edge-test").Create(ctx, other, metav1.CreateOptions{})
+	if err := enm.UpdateEdgeNodes(nil); err != nil {
+		t.Fatalf("UpdateEdgeNodes failed: %v", err)
+	}
+	if _, err := client.CoreV1().ConfigMaps("edge-test").Get(ctx, "unrelated", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected unrelated objects to stay: %v", err)
+	}
+}
+
+func TestEdgeNodeManager_DeployWithoutKubeClient(t *testing.T) {
+	enm := createTestEdgeNodeManager(t, &config.MultiCloudConfig{
+		EdgeNodes: []config.EdgeNodeConfig{{ID: "edge-nyc", Location: "New York"}},
+	})
+
+	if err := enm.DeployEdgeInstance(enm.GetEdgeNodes()[0]); !errors.Is(err, ErrNoKubeClient) {
+		t.Errorf("Expected ErrNoKubeClient, got %v", err)
+	}
+	// The configuration is still updated for health probing and selection
+	if err := enm.UpdateEdgeConfiguration("edge-nyc", map[string]string{"latency_ms": "15"}); err != nil {
+		t.Errorf("UpdateEdgeConfiguration failed: %v", err)
+	}
+	if latency := enm.GetEdgeNodes()[0].LatencyMs; latency != 15 {
+		t.Errorf("Expected latency 15, got %d", latency)
+	}
+}
+
 // Test helper to verify edge node configuration
 func verifyEdgeNodeConfiguration(t *testing.T, node config.EdgeNodeConfig, expectedID, expectedLocation string, cacheOnly bool) {
 	if node.ID != expectedID {
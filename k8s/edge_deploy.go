@@ -0,0 +1,551 @@
+package k8s
+
+import (
+	"context"
+	"crypto/sha256"
+	"distore/config"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	ErrNoKubeClient     = errors.New("kubernetes client not configured")
+	ErrUnknownEdgeNode  = errors.New("edge node not configured")
+	ErrInvalidEdgeValue = errors.New("invalid edge configuration value")
+)
+
+// Labels of edge instance objects
+const (
+	EdgeAppLabel      = "distore-edge"
+	EdgeIDLabel       = "distore.io/edge-id"
+	EdgeModeLabel     = "distore.io/edge-mode"
+	EdgeLocationLabel = "topology.distore.io/location"
+
+	edgeConfigHashAnnotation = "distore.io/config-hash"
+)
+
+// EdgeDeploymentOptions describe how edge instances are run
+type EdgeDeploymentOptions struct {
+	Namespace       string
+	Image           string
+	HTTPPort        int32
+	PrometheusPort  int32
+	LocationLabel   string   // node label an edge is pinned to, matched against its location
+	StorageSize     string   // volume of full replica edges
+	CoreNodes       []string // nodes of the core cluster, from the data centers when empty
+	Labels          map[string]string
+	OwnerReferences []metav1.OwnerReference
+}
+
+// DefaultEdgeDeploymentOptions returns the default edge deployment settings
+func DefaultEdgeDeploymentOptions() EdgeDeploymentOptions {
+	return EdgeDeploymentOptions{
+		Namespace:      "distore-system",
+		Image:          "distore/server:latest",
+		HTTPPort:       8080,
+		PrometheusPort: 9090,
+		LocationLabel:  EdgeLocationLabel,
+		StorageSize:    "1Gi",
+	}
+}
+
+func withEdgeDeploymentDefaults(opts EdgeDeploymentOptions) EdgeDeploymentOptions {
+	defaults := DefaultEdgeDeploymentOptions()
+	if opts.Namespace == "" {
+		opts.Namespace = defaults.Namespace
+	}
+	if opts.Image == "" {
+		opts.Image = defaults.Image
+	}
+	if opts.HTTPPort == 0 {
+		opts.HTTPPort = defaults.HTTPPort
+	}
+	if opts.PrometheusPort == 0 {
+		opts.PrometheusPort = defaults.PrometheusPort
+	}
+	if opts.LocationLabel == "" {
+		opts.LocationLabel = defaults.LocationLabel
+	}
+	if opts.StorageSize == "" {
+		opts.StorageSize = defaults.StorageSize
+	}
+	return opts
+}
+
+// edgeOverrides are per edge settings changed through UpdateEdgeConfiguration
+type edgeOverrides struct {
+	Image          string
+	CacheEntries   int
+	CacheBytes     int64
+	MaxStalenessMs int
+}
+
+// SetKubeClient lets the manager create the Kubernetes objects of the edge instances
+func (enm *EdgeNodeManager) SetKubeClient(client kubernetes.Interface, opts EdgeDeploymentOptions) {
+	enm.mu.Lock()
+	defer enm.mu.Unlock()
+	enm.kubeClient = client
+	enm.deployOpts = withEdgeDeploymentDefaults(opts)
+}
+
+// deployment returns the client and settings used to apply edge instances
+func (enm *EdgeNodeManager) deployment() (kubernetes.Interface, EdgeDeploymentOptions, error) {
+	enm.mu.RLock()
+	defer enm.mu.RUnlock()
+	if enm.kubeClient == nil {
+		return nil, EdgeDeploymentOptions{}, ErrNoKubeClient
+	}
+	return enm.kubeClient, withEdgeDeploymentDefaults(enm.deployOpts), nil
+}
+
+// SyncEdgeInstances deploys every configured edge and tears down the
+// instances of edges that were removed from the config
+func (enm *EdgeNodeManager) SyncEdgeInstances() error {
+	client, opts, err := enm.deployment()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	configured := make(map[string]bool)
+	for _, edge := range enm.GetEdgeNodes() {
+		configured[edge.ID] = true
+		if err := enm.DeployEdgeInstance(edge); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	ctx := context.Background()
+	deployments, err := client.AppsV1().Deployments(opts.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(edgeSelector(opts)).String(),
+	})
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("listing edge instances: %w", err))...)
+	}
+	for _, deployment := range deployments.Items {
+		if id := deployment.Labels[EdgeIDLabel]; id != "" && !configured[id] {
+			if err := enm.RemoveEdgeInstance(id); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// UpdateEdgeNodes replaces the configured edges and syncs their instances
+func (enm *EdgeNodeManager) UpdateEdgeNodes(edgeNodes []config.EdgeNodeConfig) error {
+	enm.mu.Lock()
+	if enm.config == nil {
+		enm.config = &config.MultiCloudConfig{}
+	}
+	enm.config.EdgeNodes = append([]config.EdgeNodeConfig(nil), edgeNodes...)
+	enm.mu.Unlock()
+
+	return enm.SyncEdgeInstances()
+}
+
+// RemoveEdgeInstance deletes the objects of an edge instance. The volume of
+// a full replica edge goes too, its data is a copy of the core cluster.
+func (enm *EdgeNodeManager) RemoveEdgeInstance(edgeNodeID string) error {
+	client, opts, err := enm.deployment()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	name := edgeInstanceName(edgeNodeID)
+
+	deletes := []func() error{
+		func() error {
+			return client.AppsV1().Deployments(opts.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		},
+		func() error {
+			return client.CoreV1().Services(opts.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		},
+		func() error {
+			return client.CoreV1().ConfigMaps(opts.Namespace).Delete(ctx, edgeConfigMapName(edgeNodeID), metav1.DeleteOptions{})
+		},
+		func() error {
+			return client.CoreV1().PersistentVolumeClaims(opts.Namespace).Delete(ctx, edgeVolumeName(edgeNodeID), metav1.DeleteOptions{})
+		},
+	}
+	for _, del := range deletes {
+		if err := del(); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("removing edge instance %s: %w", edgeNodeID, err)
+		}
+	}
+
+	enm.mu.Lock()
+	delete(enm.overrides, edgeNodeID)
+	enm.mu.Unlock()
+
+	log.Printf("Removed edge instance %s", edgeNodeID)
+	return nil
+}
+
+// applyEdgeInstance creates or updates the objects of one edge instance
+func (enm *EdgeNodeManager) applyEdgeInstance(client kubernetes.Interface, opts EdgeDeploymentOptions, edge config.EdgeNodeConfig) error {
+	if edge.ID == "" || !labelValuePattern.MatchString(edge.ID) {
+		return fmt.Errorf("%w: edge id %q", ErrInvalidEdgeValue, edge.ID)
+	}
+
+	enm.mu.RLock()
+	overrides := enm.overrides[edge.ID]
+	multiCloud := config.MultiCloudConfig{}
+	if enm.config != nil {
+		multiCloud = *enm.config
+	}
+	enm.mu.RUnlock()
+
+	ctx := context.Background()
+
+	configMap, err := buildEdgeConfigMap(opts, multiCloud, edge, overrides)
+	if err != nil {
+		return err
+	}
+	if err := applyEdgeConfigMap(ctx, client, configMap); err != nil {
+		return fmt.Errorf("edge %s config map: %w", edge.ID, err)
+	}
+
+	if err := applyEdgeService(ctx, client, buildEdgeService(opts, edge)); err != nil {
+		return fmt.Errorf("edge %s service: %w", edge.ID, err)
+	}
+
+	if !edge.CacheOnly {
+		pvc, err := buildEdgeVolume(opts, edge)
+		if err != nil {
+			return err
+		}
+		_, err = client.CoreV1().PersistentVolumeClaims(opts.Namespace).Get(ctx, pvc.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = client.CoreV1().PersistentVolumeClaims(opts.Namespace).Create(ctx, pvc, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return fmt.Errorf("edge %s volume: %w", edge.ID, err)
+		}
+	}
+
+	deployment := buildEdgeDeployment(opts, edge, overrides, configMap.Data["config.json"])
+	if err := applyEdgeDeployment(ctx, client, deployment); err != nil {
+		return fmt.Errorf("edge %s deployment: %w", edge.ID, err)
+	}
+	return nil
+}
+
+// applyEdgeConfiguration applies the keys accepted by UpdateEdgeConfiguration
+func applyEdgeConfiguration(edge *config.EdgeNodeConfig, overrides *edgeOverrides, newConfig map[string]string) error {
+	for key, value := range newConfig {
+		var err error
+		switch key {
+		case "location":
+			edge.Location = value
+		case "cache_only":
+			edge.CacheOnly, err = strconv.ParseBool(value)
+		case "latency_ms":
+			edge.LatencyMs, err = strconv.Atoi(value)
+		case "image":
+			overrides.Image = value
+		case "cache_entries":
+			overrides.CacheEntries, err = strconv.Atoi(value)
+		case "cache_bytes":
+			overrides.CacheBytes, err = strconv.ParseInt(value, 10, 64)
+		case "max_staleness_ms":
+			overrides.MaxStalenessMs, err = strconv.Atoi(value)
+		default:
+			return fmt.Errorf("%w: unknown key %q", ErrInvalidEdgeValue, key)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s=%q", ErrInvalidEdgeValue, key, value)
+		}
+	}
+	return nil
+}
+
+func edgeConfigMapName(edgeID string) string { return edgeInstanceName(edgeID) + "-config" }
+func edgeVolumeName(edgeID string) string    { return edgeInstanceName(edgeID) + "-data" }
+
+// edgeSelector matches every edge instance of this manager
+func edgeSelector(opts EdgeDeploymentOptions) map[string]string {
+	selector := map[string]string{"app": EdgeAppLabel}
+	for k, v := range opts.Labels {
+		selector[k] = v
+	}
+	return selector
+}
+
+var (
+	labelValuePattern   = regexp.MustCompile(`^[a-z0-9A-Z]([-a-z0-9A-Z_.]{0,61}[a-z0-9A-Z])?$`)
+	labelInvalidPattern = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// locationLabelValue turns a location like "New York" into "new-york"
+func locationLabelValue(location string) string {
+	value := strings.Trim(labelInvalidPattern.ReplaceAllString(strings.ToLower(location), "-"), "-")
+	if len(value) > 63 {
+		value = strings.Trim(value[:63], "-")
+	}
+	return value
+}
+
+func edgeLabels(opts EdgeDeploymentOptions, edge config.EdgeNodeConfig) map[string]string {
+	mode := "replica"
+	if edge.CacheOnly {
+		mode = "cache-only"
+	}
+	result := edgeSelector(opts)
+	result[EdgeIDLabel] = edge.ID
+	result[EdgeModeLabel] = mode
+	if location := locationLabelValue(edge.Location); location != "" {
+		result[EdgeLocationLabel] = location
+	}
+	return result
+}
+
+func edgeObjectMeta(opts EdgeDeploymentOptions, edge config.EdgeNodeConfig, name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:            name,
+		Namespace:       opts.Namespace,
+		Labels:          edgeLabels(opts, edge),
+		OwnerReferences: opts.OwnerReferences,
+	}
+}
+
+// edgeAddress is the address an edge instance advertises
+func edgeAddress(opts EdgeDeploymentOptions, edgeID string) string {
+	return fmt.Sprintf("%s.%s.svc:%d", edgeInstanceName(edgeID), opts.Namespace, opts.HTTPPort)
+}
+
+// buildEdgeConfigMap renders the node config of an edge: a cache in front of
+// the data centers, or a full replica joining the core nodes
+func buildEdgeConfigMap(opts EdgeDeploymentOptions, multiCloud config.MultiCloudConfig, edge config.EdgeNodeConfig, overrides edgeOverrides) (*corev1.ConfigMap, error) {
+	coreNodes := opts.CoreNodes
+	if len(coreNodes) == 0 {
+		for _, dc := range multiCloud.DataCenters {
+			coreNodes = append(coreNodes, dc.Nodes...)
+		}
+	}
+
+	cfg := config.Config{
+		HTTPPort:       int(opts.HTTPPort),
+		PrometheusPort: int(opts.PrometheusPort),
+		Nodes:          append([]string(nil), coreNodes...),
+		ReplicaCount:   3,
+		MultiCloud:     multiCloud,
+		Edge: config.EdgeConfig{
+			CacheOnly:      edge.CacheOnly,
+			CacheEntries:   overrides.CacheEntries,
+			CacheBytes:     overrides.CacheBytes,
+			MaxStalenessMs: overrides.MaxStalenessMs,
+		},
+	}
+	cfg.MultiCloud.Enabled = true
+	cfg.MultiCloud.LocalDataCenter = ""
+	if !edge.CacheOnly {
+		cfg.DataDir = "/data"
+		cfg.Nodes = append(cfg.Nodes, edgeAddress(opts, edge.ID))
+	}
+	if len(cfg.Nodes) < cfg.ReplicaCount {
+		cfg.ReplicaCount = len(cfg.Nodes)
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: edgeObjectMeta(opts, edge, edgeConfigMapName(edge.ID)),
+		Data:       map[string]string{"config.json": string(data)},
+	}, nil
+}
+
+func buildEdgeService(opts EdgeDeploymentOptions, edge config.EdgeNodeConfig) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: edgeObjectMeta(opts, edge, edgeInstanceName(edge.ID)),
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeClusterIP,
+			Selector: map[string]string{"app": EdgeAppLabel, EdgeIDLabel: edge.ID},
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: opts.HTTPPort, TargetPort: intstr.FromString("http")},
+				{Name: "metrics", Port: opts.PrometheusPort, TargetPort: intstr.FromString("metrics")},
+			},
+		},
+	}
+}
+
+func buildEdgeVolume(opts EdgeDeploymentOptions, edge config.EdgeNodeConfig) (*corev1.PersistentVolumeClaim, error) {
+	size, err := resource.ParseQuantity(opts.StorageSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: storage size %q", ErrInvalidEdgeValue, opts.StorageSize)
+	}
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: edgeObjectMeta(opts, edge, edgeVolumeName(edge.ID)),
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+		},
+	}, nil
+}
+
+// buildEdgeDeployment runs one instance pinned to the nodes of its location.
+// The config hash annotation restarts the pod when its config changes.
+func buildEdgeDeployment(opts EdgeDeploymentOptions, edge config.EdgeNodeConfig, overrides edgeOverrides, nodeConfig string) *appsv1.Deployment {
+	image := opts.Image
+	if overrides.Image != "" {
+		image = overrides.Image
+	}
+	hash := sha256.Sum256([]byte(nodeConfig))
+	podLabels := edgeLabels(opts, edge)
+
+	dataVolume := corev1.Volume{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}
+	if !edge.CacheOnly {
+		dataVolume.VolumeSource = corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: edgeVolumeName(edge.ID)},
+		}
+	}
+
+	var affinity *corev1.Affinity
+	if location := locationLabelValue(edge.Location); location != "" {
+		affinity = &corev1.Affinity{
+			NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchExpressions: []corev1.NodeSelectorRequirement{{
+							Key:      opts.LocationLabel,
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   []string{location},
+						}},
+					}},
+				},
+			},
+		}
+	}
+
+	replicas := int32(1)
+	return &appsv1.Deployment{
+		ObjectMeta: edgeObjectMeta(opts, edge, edgeInstanceName(edge.ID)),
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": EdgeAppLabel, EdgeIDLabel: edge.ID}},
+			// A full replica edge holds a ReadWriteOnce volume
+			Strategy: appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      podLabels,
+					Annotations: map[string]string{edgeConfigHashAnnotation: hex.EncodeToString(hash[:8])},
+				},
+				Spec: corev1.PodSpec{
+					Affinity: affinity,
+					Containers: []corev1.Container{{
+						Name:  containerName,
+						Image: image,
+						Args: []string{
+							"-config=" + configDir + "/config.json",
+							"-advertise=" + edgeAddress(opts, edge.ID),
+						},
+						Ports: []corev1.ContainerPort{
+							{Name: "http", ContainerPort: opts.HTTPPort},
+							{Name: "metrics", ContainerPort: opts.PrometheusPort},
+						},
+						VolumeMounts: []corev1.VolumeMount{
+							{Name: "data", MountPath: "/data"},
+							{Name: "config", MountPath: configDir, ReadOnly: true},
+						},
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								HTTPGet: &corev1.HTTPGetAction{Path: "/health", Port: intstr.FromString("http")},
+							},
+							PeriodSeconds: 5,
+						},
+					}},
+					Volumes: []corev1.Volume{
+						dataVolume,
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: edgeConfigMapName(edge.ID)},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func applyEdgeConfigMap(ctx context.Context, client kubernetes.Interface, desired *corev1.ConfigMap) error {
+	configMaps := client.CoreV1().ConfigMaps(desired.Namespace)
+	existing, err := configMaps.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, desired, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if equality.Semantic.DeepEqual(existing.Data, desired.Data) && equality.Semantic.DeepEqual(existing.Labels, desired.Labels) {
+		return nil
+	}
+	existing.Data = desired.Data
+	existing.Labels = desired.Labels
+	_, err = configMaps.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+func applyEdgeService(ctx context.Context, client kubernetes.Interface, desired *corev1.Service) error {
+	services := client.CoreV1().Services(desired.Namespace)
+	existing, err := services.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = services.Create(ctx, desired, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if equality.Semantic.DeepDerivative(desired.Spec.Ports, existing.Spec.Ports) && equality.Semantic.DeepEqual(existing.Labels, desired.Labels) {
+		return nil
+	}
+	existing.Labels = desired.Labels
+	existing.Spec.Ports = desired.Spec.Ports
+	_, err = services.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+func applyEdgeDeployment(ctx context.Context, client kubernetes.Interface, desired *appsv1.Deployment) error {
+	deployments := client.AppsV1().Deployments(desired.Namespace)
+	existing, err := deployments.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = deployments.Create(ctx, desired, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if equality.Semantic.DeepDerivative(desired.Spec.Template, existing.Spec.Template) && equality.Semantic.DeepEqual(existing.Labels, desired.Labels) {
+		return nil
+	}
+	// The selector is immutable, it only holds the edge id
+	existing.Labels = desired.Labels
+	existing.Spec.Template = desired.Spec.Template
+	existing.Spec.Strategy = desired.Spec.Strategy
+	_, err = deployments.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
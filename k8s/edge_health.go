@@ -0,0 +1,263 @@
+package k8s
+
+import (
+	"context"
+	"distore/config"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EdgeNodeState is the health state of an edge node
+type EdgeNodeState string
+
+const (
+	EdgeStateUnknown  EdgeNodeState = "unknown" // not probed yet
+	EdgeStateHealthy  EdgeNodeState = "healthy"
+	EdgeStateDegraded EdgeNodeState = "degraded" // slow, failing intermittently or lagging behind invalidations
+	EdgeStateOffline  EdgeNodeState = "offline"
+)
+
+// EdgeHealthOptions configure the edge node probing
+type EdgeHealthOptions struct {
+	Interval     time.Duration // time between probe rounds
+	Timeout      time.Duration // timeout of a single probe
+	OfflineAfter int           // consecutive failed probes before an edge is offline
+	MaxSyncLag   time.Duration // invalidation sync lag above which a cache edge is degraded
+}
+
+// DefaultEdgeHealthOptions returns the default probing settings
+func DefaultEdgeHealthOptions() EdgeHealthOptions {
+	return EdgeHealthOptions{
+		Interval:     30 * time.Second,
+		Timeout:      5 * time.Second,
+		OfflineAfter: 3,
+		MaxSyncLag:   10 * time.Second,
+	}
+}
+
+// EdgeNodeHealth represents the health status of an edge node
+type EdgeNodeHealth struct {
+	NodeID              string        `json:"node_id"`
+	Location            string        `json:"location"`
+	Latency             int           `json:"latency_ms"` // measured once probed, configured before
+	Healthy             bool          `json:"healthy"`
+	State               EdgeNodeState `json:"state"`
+	CacheHitRate        float64       `json:"cache_hit_rate"`
+	CacheEntries        int           `json:"cache_entries"`
+	SyncLagMs           int64         `json:"sync_lag_ms"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	LastProbe           time.Time     `json:"last_probe,omitempty"`
+	LastError           string        `json:"last_error,omitempty"`
+}
+
+// edgeCacheStats is the part of an edge node's cache statistics used for health
+type edgeCacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Sources []struct {
+		LastSync time.Time `json:"last_sync"`
+	} `json:"sources"`
+}
+
+// SetHealthOptions replaces the probing settings, unset values keep their defaults
+func (enm *EdgeNodeManager) SetHealthOptions(opts EdgeHealthOptions) {
+	opts = withEdgeHealthDefaults(opts)
+
+	enm.mu.Lock()
+	defer enm.mu.Unlock()
+	enm.healthOpts = opts
+	enm.httpClient = &http.Client{Timeout: opts.Timeout}
+}
+
+func withEdgeHealthDefaults(opts EdgeHealthOptions) EdgeHealthOptions {
+	defaults := DefaultEdgeHealthOptions()
+	if opts.Interval <= 0 {
+		opts.Interval = defaults.Interval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaults.Timeout
+	}
+	if opts.OfflineAfter <= 0 {
+		opts.OfflineAfter = defaults.OfflineAfter
+	}
+	if opts.MaxSyncLag <= 0 {
+		opts.MaxSyncLag = defaults.MaxSyncLag
+	}
+	return opts
+}
+
+// healthOptions returns the probing settings and client
+func (enm *EdgeNodeManager) healthOptions() (EdgeHealthOptions, *http.Client) {
+	enm.mu.RLock()
+	defer enm.mu.RUnlock()
+
+	opts := withEdgeHealthDefaults(enm.healthOpts)
+	client := enm.httpClient
+	if client == nil {
+		client = &http.Client{Timeout: opts.Timeout}
+	}
+	return opts, client
+}
+
+// ProbeAll checks every edge node concurrently and records the results
+func (enm *EdgeNodeManager) ProbeAll() {
+	edgeNodes := enm.GetEdgeNodes()
+
+	var wg sync.WaitGroup
+	for _, node := range edgeNodes {
+		wg.Add(1)
+		go func(node config.EdgeNodeConfig) {
+			defer wg.Done()
+			enm.probeEdgeNode(node)
+		}(node)
+	}
+	wg.Wait()
+}
+
+// probeEdgeNode measures the /health round trip of an edge node and, for
+// cache-only edges, reads the cache statistics
+func (enm *EdgeNodeManager) probeEdgeNode(node config.EdgeNodeConfig) {
+	opts, client := enm.healthOptions()
+
+	start := time.Now()
+	err := getJSON(client, fmt.Sprintf("http://%s/health", node.Node), opts.Timeout, nil)
+	latency := time.Since(start)
+
+	var stats *edgeCacheStats
+	if err == nil && node.CacheOnly {
+		var s edgeCacheStats
+		if statsErr := getJSON(client, fmt.Sprintf("http://%s/internal/edge_stats", node.Node), opts.Timeout, &s); statsErr == nil {
+			stats = &s
+		}
+	}
+
+	enm.recordProbe(node, latency, err, stats)
+}
+
+func (enm *EdgeNodeManager) recordProbe(node config.EdgeNodeConfig, latency time.Duration, err error, stats *edgeCacheStats) {
+	enm.mu.Lock()
+	defer enm.mu.Unlock()
+
+	opts := withEdgeHealthDefaults(enm.healthOpts)
+	if enm.health == nil {
+		enm.health = make(map[string]*EdgeNodeHealth)
+	}
+	health, ok := enm.health[node.ID]
+	if !ok {
+		health = &EdgeNodeHealth{NodeID: node.ID, Location: node.Location, Latency: node.LatencyMs}
+		enm.health[node.ID] = health
+	}
+	previous := health.State
+	health.LastProbe = time.Now()
+
+	if err != nil {
+		health.ConsecutiveFailures++
+		health.LastError = err.Error()
+		if health.ConsecutiveFailures >= opts.OfflineAfter {
+			health.State = EdgeStateOffline
+		} else {
+			health.State = EdgeStateDegraded
+		}
+	} else {
+		health.ConsecutiveFailures = 0
+		health.LastError = ""
+		health.Latency = int(latency.Milliseconds())
+		health.State = EdgeStateHealthy
+
+		if stats != nil {
+			health.CacheEntries = stats.Entries
+			if total := stats.Hits + stats.Misses; total > 0 {
+				health.CacheHitRate = float64(stats.Hits) / float64(total)
+			}
+			health.SyncLagMs = syncLag(stats).Milliseconds()
+			if time.Duration(health.SyncLagMs)*time.Millisecond > opts.MaxSyncLag {
+				health.State = EdgeStateDegraded
+			}
+		}
+
+		threshold := 0
+		if enm.config != nil {
+			threshold = enm.config.LatencyThresholds.EdgeThresholdMs
+		}
+		if threshold > 0 && health.Latency > threshold {
+			health.State = EdgeStateDegraded
+		}
+	}
+	health.Healthy = health.State == EdgeStateHealthy
+
+	if previous != health.State {
+		log.Printf("Edge node %s (%s): %s -> %s", node.ID, node.Location, stateOrUnknown(previous), health.State)
+	}
+}
+
+// syncLag returns how far the oldest invalidation stream of an edge is behind
+func syncLag(stats *edgeCacheStats) time.Duration {
+	var lag time.Duration
+	for _, src := range stats.Sources {
+		if src.LastSync.IsZero() {
+			continue
+		}
+		if l := time.Since(src.LastSync); l > lag {
+			lag = l
+		}
+	}
+	return lag
+}
+
+// stateLocked returns the state and the latency used for selection
+func (enm *EdgeNodeManager) stateLocked(node config.EdgeNodeConfig) (EdgeNodeState, int) {
+	if health, ok := enm.health[node.ID]; ok {
+		return health.State, health.Latency
+	}
+	return EdgeStateUnknown, node.LatencyMs
+}
+
+// healthLocked returns the recorded health, or the configured values of an
+// edge that was not probed yet
+func (enm *EdgeNodeManager) healthLocked(node config.EdgeNodeConfig) EdgeNodeHealth {
+	if health, ok := enm.health[node.ID]; ok {
+		return *health
+	}
+	return EdgeNodeHealth{
+		NodeID:   node.ID,
+		Location: node.Location,
+		Latency:  node.LatencyMs,
+		Healthy:  true,
+		State:    EdgeStateUnknown,
+	}
+}
+
+func stateOrUnknown(state EdgeNodeState) EdgeNodeState {
+	if state == "" {
+		return EdgeStateUnknown
+	}
+	return state
+}
+
+func getJSON(client *http.Client, url string, timeout time.Duration, out interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
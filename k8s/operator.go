@@ -0,0 +1,695 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"distore/cluster"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// OperatorOptions configure the DistoreCluster controller
+type OperatorOptions struct {
+	Namespace      string        // namespace to watch, empty for all
+	ResyncInterval time.Duration // time between full reconciles of every cluster
+	RequeueDelay   time.Duration // recheck delay of a cluster that is scaling or upgrading
+}
+
+// DefaultOperatorOptions returns the default controller settings
+func DefaultOperatorOptions() OperatorOptions {
+	return OperatorOptions{
+		ResyncInterval: 5 * time.Minute,
+		RequeueDelay:   10 * time.Second,
+	}
+}
+
+// Operator reconciles DistoreCluster resources into StatefulSets, Services,
+// PVCs and ConfigMaps, and orders joins, departures and restarts of the
+// nodes through their admin API
+type Operator struct {
+	kube    kubernetes.Interface
+	dynamic dynamic.Interface
+	admin   NodeAdmin
+	opts    OperatorOptions
+
+	mu      sync.Mutex
+	pending map[types.NamespacedName]bool
+	queue   chan types.NamespacedName
+}
+
+func NewOperator(kube kubernetes.Interface, dyn dynamic.Interface, admin NodeAdmin, opts OperatorOptions) *Operator {
+	defaults := DefaultOperatorOptions()
+	if opts.ResyncInterval <= 0 {
+		opts.ResyncInterval = defaults.ResyncInterval
+	}
+	if opts.RequeueDelay <= 0 {
+		opts.RequeueDelay = defaults.RequeueDelay
+	}
+	return &Operator{
+		kube:    kube,
+		dynamic: dyn,
+		admin:   admin,
+		opts:    opts,
+		pending: make(map[types.NamespacedName]bool),
+		queue:   make(chan types.NamespacedName, 1024),
+	}
+}
+
+func (o *Operator) clusters(namespace string) dynamic.ResourceInterface {
+	return o.dynamic.Resource(DistoreClusterGVR).Namespace(namespace)
+}
+
+// Run watches DistoreCluster resources and reconciles them until ctx is done
+func (o *Operator) Run(ctx context.Context) error {
+	if err := o.resync(ctx); err != nil {
+		return fmt.Errorf("listing %s resources: %w", DistoreClusterKind, err)
+	}
+	go o.watch(ctx)
+
+	ticker := time.NewTicker(o.opts.ResyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case key := <-o.queue:
+			o.mu.Lock()
+			delete(o.pending, key)
+			o.mu.Unlock()
+
+			requeue, err := o.Reconcile(ctx, key.Namespace, key.Name)
+			if err != nil {
+				log.Printf("Operator: reconciling %s failed: %v", key, err)
+			}
+			if requeue || err != nil {
+				time.AfterFunc(o.opts.RequeueDelay, func() { o.enqueue(key) })
+			}
+		case <-ticker.C:
+			if err := o.resync(ctx); err != nil {
+				log.Printf("Operator: resync failed: %v", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (o *Operator) enqueue(key types.NamespacedName) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.pending[key] {
+		return
+	}
+	select {
+	case o.queue <- key:
+		o.pending[key] = true
+	default:
+		// A full queue is drained by the next resync
+	}
+}
+
+func (o *Operator) resync(ctx context.Context) error {
+	list, err := o.clusters(o.opts.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, item := range list.Items {
+		o.enqueue(types.NamespacedName{Namespace: item.GetNamespace(), Name: item.GetName()})
+	}
+	return nil
+}
+
+// watch enqueues every changed cluster, restarting the watch when it ends
+func (o *Operator) watch(ctx context.Context) {
+	for ctx.Err() == nil {
+		w, err := o.clusters(o.opts.Namespace).Watch(ctx, metav1.ListOptions{})
+		if err != nil {
+			log.Printf("Operator: watching %s resources failed: %v", DistoreClusterKind, err)
+			select {
+			case <-time.After(o.opts.RequeueDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		for event := range w.ResultChan() {
+			if event.Type == watch.Error {
+				continue
+			}
+			if obj, ok := event.Object.(*unstructured.Unstructured); ok {
+				o.enqueue(types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()})
+			}
+		}
+		w.Stop()
+	}
+}
+
+// reconcileState carries one reconcile of a cluster
+type reconcileState struct {
+	dc      *DistoreCluster
+	obj     *unstructured.Unstructured
+	status  DistoreClusterStatus
+	pods    map[int]*corev1.Pod // ordinal -> pod
+	members []string
+
+	progressing     bool
+	progressReason  string
+	progressMessage string
+	adminErr        error
+}
+
+func (rs *reconcileState) progress(reason, format string, args ...interface{}) {
+	if rs.progressing {
+		return
+	}
+	rs.progressing = true
+	rs.progressReason = reason
+	rs.progressMessage = fmt.Sprintf(format, args...)
+}
+
+func (rs *reconcileState) isMember(addr string) bool {
+	for _, m := range rs.members {
+		if m == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Reconcile brings one cluster closer to its spec. It returns true while a
+// scale or upgrade is in progress and the cluster should be checked again.
+func (o *Operator) Reconcile(ctx context.Context, namespace, name string) (bool, error) {
+	obj, err := o.clusters(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// Owned objects are garbage collected through their owner references
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	dc, err := clusterFromUnstructured(obj)
+	if err != nil {
+		return false, err
+	}
+	dc.Spec = dc.Spec.withDefaults()
+
+	rs := &reconcileState{dc: dc, obj: obj, status: dc.Status}
+	rs.status.Conditions = append([]metav1.Condition(nil), dc.Status.Conditions...)
+	rs.status.ObservedGeneration = dc.Generation
+	rs.members = append([]string(nil), dc.Status.Nodes...)
+
+	if err := dc.Spec.validate(); err != nil {
+		return false, o.fail(ctx, rs, "InvalidSpec", err)
+	}
+
+	// Departing members keep their pods until they handed their data over
+	replicas := int(dc.Spec.Replicas)
+	for _, addr := range rs.members {
+		if ordinal := nodeOrdinal(dc, addr); ordinal >= replicas {
+			replicas = ordinal + 1
+		}
+	}
+
+	if err := o.applyResources(ctx, dc, replicas); err != nil {
+		if isSpecError(err) {
+			return false, o.fail(ctx, rs, "InvalidSpec", err)
+		}
+		o.setStatus(rs, replicas)
+		meta.SetStatusCondition(&rs.status.Conditions, o.condition(rs, ConditionDegraded, true, "ApplyFailed", err.Error()))
+		if statusErr := o.updateStatus(ctx, rs); statusErr != nil {
+			log.Printf("Operator: updating status of %s/%s failed: %v", namespace, name, statusErr)
+		}
+		return true, err
+	}
+
+	if rs.pods, err = o.listPods(ctx, dc); err != nil {
+		return true, err
+	}
+
+	o.reconcileMembers(ctx, rs)
+	if !rs.progressing && rs.adminErr == nil {
+		if err := o.reconcileUpgrade(ctx, rs); err != nil {
+			return true, err
+		}
+	}
+
+	o.setStatus(rs, replicas)
+	if err := o.updateStatus(ctx, rs); err != nil {
+		return true, err
+	}
+	available := meta.IsStatusConditionTrue(rs.status.Conditions, ConditionAvailable)
+	return rs.progressing || rs.adminErr != nil || !available, nil
+}
+
+// specError marks errors caused by the cluster spec, retrying does not help
+type specError struct{ error }
+
+func (e specError) Unwrap() error { return e.error }
+
+func isSpecError(err error) bool {
+	_, ok := err.(specError)
+	return ok
+}
+
+// fail reports a spec that cannot be reconciled
+func (o *Operator) fail(ctx context.Context, rs *reconcileState, reason string, err error) error {
+	log.Printf("Operator: %s/%s: %v", rs.dc.Namespace, rs.dc.Name, err)
+	rs.status.Phase = PhaseFailed
+	meta.SetStatusCondition(&rs.status.Conditions, o.condition(rs, ConditionDegraded, true, reason, err.Error()))
+	meta.SetStatusCondition(&rs.status.Conditions, o.condition(rs, ConditionProgressing, false, reason, "waiting for a valid spec"))
+	return o.updateStatus(ctx, rs)
+}
+
+// applyResources creates or updates the objects owned by the cluster
+func (o *Operator) applyResources(ctx context.Context, dc *DistoreCluster, replicas int) error {
+	configMap, err := buildConfigMap(dc, replicas)
+	if err != nil {
+		return err
+	}
+	if err := o.applyConfigMap(ctx, configMap); err != nil {
+		return fmt.Errorf("config map: %w", err)
+	}
+
+	for _, svc := range []*corev1.Service{buildHeadlessService(dc), buildClientService(dc)} {
+		if err := o.applyService(ctx, svc); err != nil {
+			return fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+	}
+
+	for ordinal := 0; ordinal < replicas; ordinal++ {
+		pvc, err := buildPVC(dc, ordinal)
+		if err != nil {
+			return specError{err}
+		}
+		if err := o.ensurePVC(ctx, pvc); err != nil {
+			return fmt.Errorf("volume claim %s: %w", pvc.Name, err)
+		}
+	}
+
+	if err := o.applyEdgeInstances(dc, replicas); err != nil {
+		return err
+	}
+
+	sts, err := buildStatefulSet(dc, int32(replicas))
+	if err != nil {
+		return specError{err}
+	}
+	if err := o.applyStatefulSet(ctx, sts); err != nil {
+		return fmt.Errorf("stateful set: %w", err)
+	}
+	return nil
+}
+
+// applyEdgeInstances deploys the edge nodes of the spec and tears down the
+// instances of removed ones
+func (o *Operator) applyEdgeInstances(dc *DistoreCluster, replicas int) error {
+	multiCloud := clusterConfig(dc, replicas).MultiCloud
+
+	// A manager per reconcile, without the health probing of NewEdgeNodeManager
+	edges := &EdgeNodeManager{config: &multiCloud}
+	edges.SetKubeClient(o.kube, EdgeDeploymentOptions{
+		Namespace:       dc.Namespace,
+		Image:           dc.Spec.Image,
+		HTTPPort:        dc.Spec.HTTPPort,
+		PrometheusPort:  dc.Spec.PrometheusPort,
+		StorageSize:     dc.Spec.Storage.Size,
+		CoreNodes:       nodeAddresses(dc, replicas),
+		Labels:          map[string]string{"distore.io/cluster": dc.Name},
+		OwnerReferences: objectMeta(dc, "").OwnerReferences,
+	})
+	if err := edges.SyncEdgeInstances(); err != nil {
+		if errors.Is(err, ErrInvalidEdgeValue) {
+			return specError{err}
+		}
+		return fmt.Errorf("edge instances: %w", err)
+	}
+	return nil
+}
+
+func (o *Operator) applyConfigMap(ctx context.Context, desired *corev1.ConfigMap) error {
+	client := o.kube.CoreV1().ConfigMaps(desired.Namespace)
+	existing, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, desired, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if equality.Semantic.DeepEqual(existing.Data, desired.Data) {
+		return nil
+	}
+	existing.Data = desired.Data
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+func (o *Operator) applyService(ctx context.Context, desired *corev1.Service) error {
+	client := o.kube.CoreV1().Services(desired.Namespace)
+	existing, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, desired, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if equality.Semantic.DeepDerivative(desired.Spec.Ports, existing.Spec.Ports) &&
+		equality.Semantic.DeepEqual(desired.Spec.Selector, existing.Spec.Selector) {
+		return nil
+	}
+	// The cluster IP is immutable, only ports and selector follow the spec
+	existing.Spec.Ports = desired.Spec.Ports
+	existing.Spec.Selector = desired.Spec.Selector
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// ensurePVC creates a missing claim. Claims are never shrunk or deleted, so
+// the data of a removed node survives until an administrator deletes it.
+func (o *Operator) ensurePVC(ctx context.Context, desired *corev1.PersistentVolumeClaim) error {
+	client := o.kube.CoreV1().PersistentVolumeClaims(desired.Namespace)
+	_, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, desired, metav1.CreateOptions{})
+	}
+	return err
+}
+
+func (o *Operator) applyStatefulSet(ctx context.Context, desired *appsv1.StatefulSet) error {
+	client := o.kube.AppsV1().StatefulSets(desired.Namespace)
+	existing, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, desired, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Spec.Replicas != nil && *existing.Spec.Replicas == *desired.Spec.Replicas &&
+		equality.Semantic.DeepDerivative(desired.Spec.Template, existing.Spec.Template) {
+		return nil
+	}
+	// Selector, service name and claim templates are immutable
+	existing.Spec.Replicas = desired.Spec.Replicas
+	existing.Spec.Template = desired.Spec.Template
+	existing.Spec.UpdateStrategy = desired.Spec.UpdateStrategy
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+func (o *Operator) listPods(ctx context.Context, dc *DistoreCluster) (map[int]*corev1.Pod, error) {
+	list, err := o.kube.CoreV1().Pods(dc.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(selectorLabels(dc)).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	pods := make(map[int]*corev1.Pod, len(list.Items))
+	for i := range list.Items {
+		pod := &list.Items[i]
+		host := pod.Name + "."
+		if ordinal := nodeOrdinal(dc, host); ordinal >= 0 {
+			pods[ordinal] = pod
+		}
+	}
+	return pods, nil
+}
+
+// reconcileMembers moves the membership towards spec.replicas: a new cluster
+// is formed once every pod is ready, added pods bootstrap from the members
+// one at a time and removed pods decommission highest ordinal first
+func (o *Operator) reconcileMembers(ctx context.Context, rs *reconcileState) {
+	dc := rs.dc
+	replicas := int(dc.Spec.Replicas)
+
+	if len(rs.members) == 0 {
+		for ordinal := 0; ordinal < replicas; ordinal++ {
+			if pod := rs.pods[ordinal]; pod == nil || !podReady(pod) {
+				rs.progress("Creating", "waiting for pod %s to become ready", podName(dc, ordinal))
+				return
+			}
+		}
+		rs.members = nodeAddresses(dc, replicas)
+		rs.status.CurrentImage = dc.Spec.Image
+		log.Printf("Operator: %s/%s formed with %d nodes", dc.Namespace, dc.Name, replicas)
+		return
+	}
+
+	// Scale down, highest ordinal first
+	departing := ""
+	for _, addr := range rs.members {
+		if ordinal := nodeOrdinal(dc, addr); ordinal >= replicas && ordinal > nodeOrdinal(dc, departing) {
+			departing = addr
+		}
+	}
+	if departing != "" {
+		o.decommission(ctx, rs, departing)
+		return
+	}
+
+	// Scale up, lowest ordinal first
+	for ordinal := 0; ordinal < replicas; ordinal++ {
+		addr := nodeAddress(dc, ordinal)
+		if rs.isMember(addr) {
+			continue
+		}
+		o.bootstrap(ctx, rs, ordinal, addr)
+		return
+	}
+}
+
+func (o *Operator) decommission(ctx context.Context, rs *reconcileState, addr string) {
+	rs.progress("ScalingDown", "decommissioning %s", addr)
+
+	status, err := o.admin.LifecycleStatus(ctx, addr)
+	if err != nil {
+		rs.adminErr = fmt.Errorf("lifecycle status of %s: %w", addr, err)
+		return
+	}
+	if status.State == cluster.LocalNodeDecommissioned {
+		rs.members = removeString(rs.members, addr)
+		log.Printf("Operator: %s/%s: %s decommissioned", rs.dc.Namespace, rs.dc.Name, addr)
+		return
+	}
+	if status.Job != nil && status.Job.Operation == cluster.OpDecommission && status.Job.State == cluster.LifecycleRunning {
+		return
+	}
+	if status.Job != nil && status.Job.Operation == cluster.OpDecommission && status.Job.State == cluster.LifecycleFailed {
+		log.Printf("Operator: %s/%s: decommission of %s failed, retrying: %s", rs.dc.Namespace, rs.dc.Name, addr, status.Job.Error)
+	}
+	if err := o.admin.Decommission(ctx, addr); err != nil {
+		rs.adminErr = fmt.Errorf("decommission of %s: %w", addr, err)
+	}
+}
+
+func (o *Operator) bootstrap(ctx context.Context, rs *reconcileState, ordinal int, addr string) {
+	rs.progress("ScalingUp", "adding %s", addr)
+
+	pod := rs.pods[ordinal]
+	if pod == nil || !podReady(pod) {
+		return
+	}
+
+	status, err := o.admin.LifecycleStatus(ctx, addr)
+	if err != nil {
+		rs.adminErr = fmt.Errorf("lifecycle status of %s: %w", addr, err)
+		return
+	}
+	if job := status.Job; job != nil && job.Operation == cluster.OpBootstrap {
+		switch job.State {
+		case cluster.LifecycleRunning:
+			return
+		case cluster.LifecycleCompleted:
+			rs.members = append(rs.members, addr)
+			log.Printf("Operator: %s/%s: %s joined", rs.dc.Namespace, rs.dc.Name, addr)
+			return
+		case cluster.LifecycleFailed:
+			log.Printf("Operator: %s/%s: bootstrap of %s failed, retrying: %s", rs.dc.Namespace, rs.dc.Name, addr, job.Error)
+		}
+	}
+	if err := o.admin.Bootstrap(ctx, addr, rs.members); err != nil {
+		rs.adminErr = fmt.Errorf("bootstrap of %s: %w", addr, err)
+	}
+}
+
+// reconcileUpgrade replaces pods running an old image one at a time, highest
+// ordinal first. The peers mark a node as leaving before its pod is deleted
+// and clear the mark once the new pod is ready.
+func (o *Operator) reconcileUpgrade(ctx context.Context, rs *reconcileState) error {
+	dc := rs.dc
+
+	if draining := rs.status.DrainingNode; draining != "" {
+		pod := rs.pods[nodeOrdinal(dc, draining)]
+		if pod == nil || podImage(pod) != dc.Spec.Image || !podReady(pod) {
+			rs.progress("RollingUpgrade", "waiting for %s to restart with %s", draining, dc.Spec.Image)
+			return nil
+		}
+		if err := o.setLeaving(ctx, rs, draining, false); err != nil {
+			rs.adminErr = err
+			return nil
+		}
+		rs.status.DrainingNode = ""
+	}
+
+	// Only a fully ready cluster loses a node to an upgrade
+	next, nextOrdinal := "", -1
+	for _, addr := range rs.members {
+		ordinal := nodeOrdinal(dc, addr)
+		pod := rs.pods[ordinal]
+		if pod == nil || !podReady(pod) {
+			return nil
+		}
+		if podImage(pod) != dc.Spec.Image && ordinal > nextOrdinal {
+			next, nextOrdinal = addr, ordinal
+		}
+	}
+	if next == "" {
+		rs.status.CurrentImage = dc.Spec.Image
+		return nil
+	}
+
+	rs.progress("RollingUpgrade", "upgrading %s to %s", next, dc.Spec.Image)
+	if err := o.setLeaving(ctx, rs, next, true); err != nil {
+		rs.adminErr = err
+		return nil
+	}
+
+	// Record the drain before the pod goes away, so a restarted operator
+	// still clears the leaving marks
+	rs.status.DrainingNode = next
+	rs.status.Nodes = rs.members
+	if err := o.updateStatus(ctx, rs); err != nil {
+		return err
+	}
+
+	pod := rs.pods[nextOrdinal]
+	if err := o.kube.CoreV1().Pods(dc.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("deleting pod %s: %w", pod.Name, err)
+	}
+	log.Printf("Operator: %s/%s: restarting %s with %s", dc.Namespace, dc.Name, pod.Name, dc.Spec.Image)
+	return nil
+}
+
+// setLeaving marks or clears node as leaving on every other member
+func (o *Operator) setLeaving(ctx context.Context, rs *reconcileState, node string, leaving bool) error {
+	var errs []string
+	for _, peer := range rs.members {
+		if peer == node {
+			continue
+		}
+		if err := o.admin.SetLeaving(ctx, peer, node, leaving); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", peer, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("draining %s: %s", node, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// setStatus derives replica counts, phase and conditions
+func (o *Operator) setStatus(rs *reconcileState, replicas int) {
+	dc := rs.dc
+
+	sort.Slice(rs.members, func(i, j int) bool {
+		return nodeOrdinal(dc, rs.members[i]) < nodeOrdinal(dc, rs.members[j])
+	})
+	rs.status.Nodes = rs.members
+	rs.status.TotalReplicas = int32(replicas)
+	rs.status.ReadyReplicas = 0
+	for ordinal := 0; ordinal < replicas; ordinal++ {
+		if pod := rs.pods[ordinal]; pod != nil && podReady(pod) {
+			rs.status.ReadyReplicas++
+		}
+	}
+
+	readyMembers := 0
+	for _, addr := range rs.members {
+		if pod := rs.pods[nodeOrdinal(dc, addr)]; pod != nil && podReady(pod) {
+			readyMembers++
+		}
+	}
+	available := len(rs.members) > 0 && readyMembers == len(rs.members) && len(rs.members) == int(dc.Spec.Replicas)
+	if available {
+		rs.status.Phase = PhaseRunning
+		meta.SetStatusCondition(&rs.status.Conditions, o.condition(rs, ConditionAvailable, true, "AllNodesReady",
+			fmt.Sprintf("%d of %d nodes ready", readyMembers, dc.Spec.Replicas)))
+	} else {
+		rs.status.Phase = PhasePending
+		meta.SetStatusCondition(&rs.status.Conditions, o.condition(rs, ConditionAvailable, false, "NodesNotReady",
+			fmt.Sprintf("%d of %d nodes ready", readyMembers, dc.Spec.Replicas)))
+	}
+
+	if rs.progressing {
+		meta.SetStatusCondition(&rs.status.Conditions, o.condition(rs, ConditionProgressing, true, rs.progressReason, rs.progressMessage))
+	} else {
+		meta.SetStatusCondition(&rs.status.Conditions, o.condition(rs, ConditionProgressing, false, "Reconciled", "cluster matches its spec"))
+	}
+
+	if rs.adminErr != nil {
+		log.Printf("Operator: %s/%s: %v", dc.Namespace, dc.Name, rs.adminErr)
+		meta.SetStatusCondition(&rs.status.Conditions, o.condition(rs, ConditionDegraded, true, "AdminAPIError", rs.adminErr.Error()))
+	} else {
+		meta.SetStatusCondition(&rs.status.Conditions, o.condition(rs, ConditionDegraded, false, "Reconciled", ""))
+	}
+}
+
+func (o *Operator) condition(rs *reconcileState, condType string, status bool, reason, message string) metav1.Condition {
+	condStatus := metav1.ConditionFalse
+	if status {
+		condStatus = metav1.ConditionTrue
+	}
+	return metav1.Condition{
+		Type:               condType,
+		Status:             condStatus,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: rs.dc.Generation,
+	}
+}
+
+// updateStatus writes the status subresource and keeps the resource
+// version for a second write in the same reconcile
+func (o *Operator) updateStatus(ctx context.Context, rs *reconcileState) error {
+	status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&rs.status)
+	if err != nil {
+		return err
+	}
+	obj := rs.obj.DeepCopy()
+	obj.Object["status"] = status
+
+	updated, err := o.clusters(obj.GetNamespace()).UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("updating status: %w", err)
+	}
+	rs.obj = updated
+	return nil
+}
+
+func removeString(list []string, s string) []string {
+	out := make([]string, 0, len(list))
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
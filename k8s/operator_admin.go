@@ -0,0 +1,124 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"distore/cluster"
+)
+
+// NodeAdmin is the part of the node admin API the operator drives
+type NodeAdmin interface {
+	// SetLeaving marks node as leaving on peer, or clears the mark
+	SetLeaving(ctx context.Context, peer, node string, leaving bool) error
+	// Bootstrap makes node pull its ranges from seeds and join the cluster
+	Bootstrap(ctx context.Context, node string, seeds []string) error
+	// Decommission makes node hand its data over and leave the cluster
+	Decommission(ctx context.Context, node string) error
+	LifecycleStatus(ctx context.Context, node string) (NodeLifecycleStatus, error)
+}
+
+// NodeLifecycleStatus is the answer of GET /admin/lifecycle
+type NodeLifecycleStatus struct {
+	State cluster.LocalNodeState `json:"state"`
+	Job   *cluster.LifecycleJob  `json:"job,omitempty"`
+}
+
+// HTTPNodeAdmin calls the admin API of the nodes over HTTP
+type HTTPNodeAdmin struct {
+	Client *http.Client
+	Scheme string // "http" or "https", defaults to http
+	Token  string // bearer token of an admin identity when auth is enabled
+}
+
+func NewHTTPNodeAdmin(token string) *HTTPNodeAdmin {
+	return &HTTPNodeAdmin{
+		Client: &http.Client{Timeout: 10 * time.Second},
+		Scheme: "http",
+		Token:  token,
+	}
+}
+
+func (a *HTTPNodeAdmin) SetLeaving(ctx context.Context, peer, node string, leaving bool) error {
+	path := "/admin/nodes/" + url.PathEscape(node) + "/leaving"
+	if !leaving {
+		path += "?clear=true"
+	}
+	status, err := a.do(ctx, "POST", peer, path, nil, nil)
+	// A peer without failure detection, or one that does not track the node,
+	// has nothing to drain
+	if status == http.StatusNotFound || status == http.StatusServiceUnavailable {
+		return nil
+	}
+	return err
+}
+
+func (a *HTTPNodeAdmin) Bootstrap(ctx context.Context, node string, seeds []string) error {
+	_, err := a.do(ctx, "POST", node, "/admin/lifecycle/bootstrap", map[string]interface{}{"seeds": seeds}, nil)
+	return err
+}
+
+func (a *HTTPNodeAdmin) Decommission(ctx context.Context, node string) error {
+	_, err := a.do(ctx, "POST", node, "/admin/lifecycle/decommission", nil, nil)
+	return err
+}
+
+func (a *HTTPNodeAdmin) LifecycleStatus(ctx context.Context, node string) (NodeLifecycleStatus, error) {
+	var status NodeLifecycleStatus
+	_, err := a.do(ctx, "GET", node, "/admin/lifecycle", nil, &status)
+	return status, err
+}
+
+// do sends a request and decodes a JSON answer, returning the status code
+func (a *HTTPNodeAdmin) do(ctx context.Context, method, node, path string, body, out interface{}) (int, error) {
+	scheme := a.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s://%s%s", scheme, node, path), reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,389 @@
+package k8s
+
+import (
+	"distore/config"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	containerName  = "distore"
+	dataVolumeName = "data"
+	configDir      = "/etc/distore"
+	authDir        = "/etc/distore/auth"
+	tlsDir         = "/etc/distore/tls"
+)
+
+// Names of the objects owned by a cluster
+func headlessServiceName(dc *DistoreCluster) string { return dc.Name + "-headless" }
+func configMapName(dc *DistoreCluster) string       { return dc.Name + "-config" }
+func podName(dc *DistoreCluster, ordinal int) string {
+	return fmt.Sprintf("%s-%d", dc.Name, ordinal)
+}
+
+// pvcName follows the StatefulSet naming so the claims are adopted by the pods
+func pvcName(dc *DistoreCluster, ordinal int) string {
+	return fmt.Sprintf("%s-%s", dataVolumeName, podName(dc, ordinal))
+}
+
+// nodeAddress is the address a pod advertises to its peers
+func nodeAddress(dc *DistoreCluster, ordinal int) string {
+	return fmt.Sprintf("%s.%s.%s.svc:%d", podName(dc, ordinal), headlessServiceName(dc), dc.Namespace, dc.Spec.HTTPPort)
+}
+
+// nodeOrdinal returns the pod ordinal of a node address, -1 if it is not a pod of dc
+func nodeOrdinal(dc *DistoreCluster, addr string) int {
+	host, _, _ := strings.Cut(addr, ".")
+	suffix, ok := strings.CutPrefix(host, dc.Name+"-")
+	if !ok {
+		return -1
+	}
+	ordinal, err := strconv.Atoi(suffix)
+	if err != nil || ordinal < 0 {
+		return -1
+	}
+	return ordinal
+}
+
+func nodeAddresses(dc *DistoreCluster, replicas int) []string {
+	addrs := make([]string, replicas)
+	for i := range addrs {
+		addrs[i] = nodeAddress(dc, i)
+	}
+	return addrs
+}
+
+func selectorLabels(dc *DistoreCluster) map[string]string {
+	return map[string]string{
+		"app":                "distore",
+		"component":          "cluster",
+		"distore.io/cluster": dc.Name,
+	}
+}
+
+func objectMeta(dc *DistoreCluster, name string) metav1.ObjectMeta {
+	controller := true
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: dc.Namespace,
+		Labels:    selectorLabels(dc),
+		OwnerReferences: []metav1.OwnerReference{{
+			APIVersion:         DistoreClusterGVR.GroupVersion().String(),
+			Kind:               DistoreClusterKind,
+			Name:               dc.Name,
+			UID:                dc.UID,
+			Controller:         &controller,
+			BlockOwnerDeletion: &controller,
+		}},
+	}
+}
+
+// nodeConfig renders the config.json shared by all pods of the cluster
+func nodeConfig(dc *DistoreCluster, replicas int) (string, error) {
+	data, err := json.MarshalIndent(clusterConfig(dc, replicas), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func clusterConfig(dc *DistoreCluster, replicas int) config.Config {
+	spec := dc.Spec
+	nodes := nodeAddresses(dc, replicas)
+
+	replicaCount := 3
+	if replicas < replicaCount {
+		replicaCount = replicas
+	}
+
+	// Every setting is written out, so the rest must keep the node defaults
+	cfg := *config.Default()
+	cfg.HTTPPort = int(spec.HTTPPort)
+	cfg.PrometheusPort = int(spec.PrometheusPort)
+	cfg.DataDir = spec.DataDir
+	cfg.Nodes = nodes
+	cfg.ReplicaCount = replicaCount
+	if spec.Auth.Enabled {
+		// The keys are read from the mounted auth secret
+		cfg.Auth.Enabled = true
+		cfg.Auth.PrivateKeyFile = authDir + "/private.pem"
+		cfg.Auth.PublicKeyFile = authDir + "/public.pem"
+		// Nodes only replicate identities and keys to authenticated peers.
+		// All pods share the secret, so they can verify each other's tokens.
+		cfg.Internode.ServiceToken = true
+	}
+	if spec.TLS.Enabled {
+		cfg.TLS = config.TLSConfig{
+			Enabled:  true,
+			CertFile: tlsDir + "/" + corev1.TLSCertKey,
+			KeyFile:  tlsDir + "/" + corev1.TLSPrivateKeyKey,
+		}
+	}
+	if spec.MultiCloud.Enabled {
+		cfg.MultiCloud.Enabled = true
+		for _, dcSpec := range spec.MultiCloud.DataCenters {
+			dataCenter := config.DataCenterConfig{
+				ID:           dcSpec.ID,
+				Region:       dcSpec.Region,
+				Priority:     dcSpec.Priority,
+				ReplicaCount: dcSpec.ReplicaCount,
+			}
+			// Nodes refuse multi-cloud configs without these
+			if dataCenter.Region == "" {
+				dataCenter.Region = dataCenter.ID
+			}
+			if dataCenter.Priority == 0 {
+				dataCenter.Priority = 1
+			}
+			if dataCenter.ReplicaCount == 0 {
+				dataCenter.ReplicaCount = replicaCount
+			}
+			// The pods of this cluster form its only data center
+			if len(spec.MultiCloud.DataCenters) == 1 {
+				dataCenter.Nodes = nodes
+			}
+			cfg.MultiCloud.DataCenters = append(cfg.MultiCloud.DataCenters, dataCenter)
+		}
+		for _, edge := range spec.MultiCloud.EdgeNodes {
+			cfg.MultiCloud.EdgeNodes = append(cfg.MultiCloud.EdgeNodes, config.EdgeNodeConfig{
+				ID:        edge.ID,
+				Location:  edge.Location,
+				Node:      fmt.Sprintf("%s.%s.svc:%d", edgeInstanceName(edge.ID), dc.Namespace, spec.HTTPPort),
+				CacheOnly: edge.CacheOnly,
+			})
+		}
+	}
+	return cfg
+}
+
+// edgeInstanceName is the name of the pod and service of an edge node
+func edgeInstanceName(edgeID string) string {
+	return "distore-edge-" + edgeID
+}
+
+func buildConfigMap(dc *DistoreCluster, replicas int) (*corev1.ConfigMap, error) {
+	data, err := nodeConfig(dc, replicas)
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: objectMeta(dc, configMapName(dc)),
+		Data:       map[string]string{"config.json": data},
+	}, nil
+}
+
+func servicePorts(dc *DistoreCluster) []corev1.ServicePort {
+	return []corev1.ServicePort{
+		{Name: "http", Port: dc.Spec.HTTPPort, TargetPort: intstr.FromString("http")},
+		{Name: "metrics", Port: dc.Spec.PrometheusPort, TargetPort: intstr.FromString("metrics")},
+	}
+}
+
+// buildHeadlessService gives every pod the stable DNS name it advertises.
+// Addresses are published before readiness so joining nodes can be reached.
+func buildHeadlessService(dc *DistoreCluster) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: objectMeta(dc, headlessServiceName(dc)),
+		Spec: corev1.ServiceSpec{
+			ClusterIP:                corev1.ClusterIPNone,
+			Selector:                 selectorLabels(dc),
+			Ports:                    servicePorts(dc),
+			PublishNotReadyAddresses: true,
+		},
+	}
+}
+
+// buildClientService balances clients over the ready pods
+func buildClientService(dc *DistoreCluster) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: objectMeta(dc, dc.Name),
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeClusterIP,
+			Selector: selectorLabels(dc),
+			Ports:    servicePorts(dc),
+		},
+	}
+}
+
+func buildPVCSpec(dc *DistoreCluster) (corev1.PersistentVolumeClaimSpec, error) {
+	size, err := resource.ParseQuantity(dc.Spec.Storage.Size)
+	if err != nil {
+		return corev1.PersistentVolumeClaimSpec{}, fmt.Errorf("invalid storage.size %q: %w", dc.Spec.Storage.Size, err)
+	}
+	spec := corev1.PersistentVolumeClaimSpec{
+		AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+		Resources: corev1.VolumeResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+		},
+	}
+	if dc.Spec.Storage.StorageClass != "" {
+		storageClass := dc.Spec.Storage.StorageClass
+		spec.StorageClassName = &storageClass
+	}
+	return spec, nil
+}
+
+func buildPVC(dc *DistoreCluster, ordinal int) (*corev1.PersistentVolumeClaim, error) {
+	spec, err := buildPVCSpec(dc)
+	if err != nil {
+		return nil, err
+	}
+	// Like StatefulSet claims, the data outlives the cluster resource
+	meta := objectMeta(dc, pvcName(dc, ordinal))
+	meta.OwnerReferences = nil
+	return &corev1.PersistentVolumeClaim{ObjectMeta: meta, Spec: spec}, nil
+}
+
+func parseResourceList(list ClusterResourceList, field string) (corev1.ResourceList, error) {
+	resources := corev1.ResourceList{}
+	for name, value := range map[corev1.ResourceName]string{
+		corev1.ResourceCPU:    list.CPU,
+		corev1.ResourceMemory: list.Memory,
+	} {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s.%s %q: %w", field, name, value, err)
+		}
+		resources[name] = quantity
+	}
+	return resources, nil
+}
+
+// buildStatefulSet renders the pods of the cluster. Pods are replaced by the
+// operator one at a time (OnDelete), so every restart can be drained first.
+func buildStatefulSet(dc *DistoreCluster, replicas int32) (*appsv1.StatefulSet, error) {
+	spec := dc.Spec
+
+	requests, err := parseResourceList(spec.Resources.Requests, "resources.requests")
+	if err != nil {
+		return nil, err
+	}
+	limits, err := parseResourceList(spec.Resources.Limits, "resources.limits")
+	if err != nil {
+		return nil, err
+	}
+	pvcSpec, err := buildPVCSpec(dc)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := corev1.URISchemeHTTP
+	if spec.TLS.Enabled {
+		scheme = corev1.URISchemeHTTPS
+	}
+	healthProbe := func(initialDelay int32) *corev1.Probe {
+		return &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{Path: "/health", Port: intstr.FromString("http"), Scheme: scheme},
+			},
+			InitialDelaySeconds: initialDelay,
+			PeriodSeconds:       5,
+		}
+	}
+
+	container := corev1.Container{
+		Name:  containerName,
+		Image: spec.Image,
+		Args: []string{
+			"-config=" + configDir + "/config.json",
+			fmt.Sprintf("-advertise=$(POD_NAME).%s.%s.svc:%d", headlessServiceName(dc), dc.Namespace, spec.HTTPPort),
+		},
+		Env: []corev1.EnvVar{{
+			Name: "POD_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+			},
+		}},
+		Ports: []corev1.ContainerPort{
+			{Name: "http", ContainerPort: spec.HTTPPort},
+			{Name: "metrics", ContainerPort: spec.PrometheusPort},
+		},
+		Resources: corev1.ResourceRequirements{Requests: requests, Limits: limits},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: dataVolumeName, MountPath: spec.DataDir},
+			{Name: "config", MountPath: configDir, ReadOnly: true},
+		},
+		ReadinessProbe: healthProbe(5),
+		LivenessProbe:  healthProbe(30),
+	}
+
+	volumes := []corev1.Volume{{
+		Name: "config",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMapName(dc)},
+			},
+		},
+	}}
+	for _, secret := range []struct {
+		name, secretName, dir string
+		enabled               bool
+	}{
+		{"auth", spec.Auth.SecretName, authDir, spec.Auth.Enabled},
+		{"tls", spec.TLS.SecretName, tlsDir, spec.TLS.Enabled},
+	} {
+		if !secret.enabled {
+			continue
+		}
+		volumes = append(volumes, corev1.Volume{
+			Name:         secret.name,
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secret.secretName}},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name: secret.name, MountPath: secret.dir, ReadOnly: true,
+		})
+	}
+
+	return &appsv1.StatefulSet{
+		ObjectMeta: objectMeta(dc, dc.Name),
+		Spec: appsv1.StatefulSetSpec{
+			ServiceName: headlessServiceName(dc),
+			Replicas:    &replicas,
+			Selector:    &metav1.LabelSelector{MatchLabels: selectorLabels(dc)},
+			// Joins and departures are ordered by the operator through the admin API
+			PodManagementPolicy: appsv1.ParallelPodManagement,
+			UpdateStrategy:      appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: selectorLabels(dc)},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{container},
+					Volumes:    volumes,
+				},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{Name: dataVolumeName, Labels: selectorLabels(dc)},
+				Spec:       pvcSpec,
+			}},
+		},
+	}, nil
+}
+
+// podImage returns the image of the distore container of a pod
+func podImage(pod *corev1.Pod) string {
+	for _, c := range pod.Spec.Containers {
+		if c.Name == containerName {
+			return c.Image
+		}
+	}
+	return ""
+}
+
+func podReady(pod *corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,653 @@
+package k8s
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"distore/auth"
+	"distore/cluster"
+	"distore/config"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "distore-test"
+
+// fakeNodeAdmin records admin API calls and answers lifecycle status from a map
+type fakeNodeAdmin struct {
+	mu        sync.Mutex
+	calls     []string
+	lifecycle map[string]NodeLifecycleStatus
+}
+
+func newFakeNodeAdmin() *fakeNodeAdmin {
+	return &fakeNodeAdmin{lifecycle: make(map[string]NodeLifecycleStatus)}
+}
+
+func (a *fakeNodeAdmin) record(call string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, call)
+}
+
+func (a *fakeNodeAdmin) SetLeaving(ctx context.Context, peer, node string, leaving bool) error {
+	if leaving {
+		a.record("leaving " + peer + " " + node)
+	} else {
+		a.record("clear " + peer + " " + node)
+	}
+	return nil
+}
+
+func (a *fakeNodeAdmin) Bootstrap(ctx context.Context, node string, seeds []string) error {
+	a.record("bootstrap " + node + " " + strings.Join(seeds, ","))
+	a.setJob(node, cluster.LocalNodeJoining, cluster.OpBootstrap, cluster.LifecycleRunning)
+	return nil
+}
+
+func (a *fakeNodeAdmin) Decommission(ctx context.Context, node string) error {
+	a.record("decommission " + node)
+	a.setJob(node, cluster.LocalNodeLeaving, cluster.OpDecommission, cluster.LifecycleRunning)
+	return nil
+}
+
+func (a *fakeNodeAdmin) LifecycleStatus(ctx context.Context, node string) (NodeLifecycleStatus, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status, ok := a.lifecycle[node]
+	if !ok {
+		status.State = cluster.LocalNodeNormal
+	}
+	return status, nil
+}
+
+func (a *fakeNodeAdmin) setJob(node string, state cluster.LocalNodeState, op cluster.LifecycleOperation, jobState cluster.LifecycleJobState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lifecycle[node] = NodeLifecycleStatus{
+		State: state,
+		Job:   &cluster.LifecycleJob{Operation: op, Node: node, State: jobState},
+	}
+}
+
+func (a *fakeNodeAdmin) takeCalls() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	calls := a.calls
+	a.calls = nil
+	return calls
+}
+
+type operatorFixture struct {
+	t        *testing.T
+	kube     *fake.Clientset
+	dynamic  *dynamicfake.FakeDynamicClient
+	admin    *fakeNodeAdmin
+	operator *Operator
+}
+
+func newOperatorFixture(t *testing.T, spec map[string]interface{}) *operatorFixture {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "distore.io/v1",
+		"kind":       DistoreClusterKind,
+		"metadata": map[string]interface{}{
+			"name":      "store",
+			"namespace": testNamespace,
+			"uid":       "uid-1",
+		},
+		"spec": spec,
+	}}
+
+	f := &operatorFixture{
+		t:    t,
+		kube: fake.NewClientset(),
+		dynamic: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{DistoreClusterGVR: "DistoreClusterList"}, obj),
+		admin: newFakeNodeAdmin(),
+	}
+	f.operator = NewOperator(f.kube, f.dynamic, f.admin, OperatorOptions{Namespace: testNamespace})
+	return f
+}
+
+func (f *operatorFixture) reconcile() bool {
+	f.t.Helper()
+	requeue, err := f.operator.Reconcile(context.Background(), testNamespace, "store")
+	if err != nil {
+		f.t.Fatalf("Reconcile failed: %v", err)
+	}
+	return requeue
+}
+
+func (f *operatorFixture) cluster() *DistoreCluster {
+	f.t.Helper()
+	obj, err := f.dynamic.Resource(DistoreClusterGVR).Namespace(testNamespace).Get(context.Background(), "store", metav1.GetOptions{})
+	if err != nil {
+		f.t.Fatalf("Failed to get cluster: %v", err)
+	}
+	dc, err := clusterFromUnstructured(obj)
+	if err != nil {
+		f.t.Fatalf("Failed to decode cluster: %v", err)
+	}
+	return dc
+}
+
+func (f *operatorFixture) updateSpec(field string, value interface{}) {
+	f.t.Helper()
+	client := f.dynamic.Resource(DistoreClusterGVR).Namespace(testNamespace)
+	obj, err := client.Get(context.Background(), "store", metav1.GetOptions{})
+	if err != nil {
+		f.t.Fatalf("Failed to get cluster: %v", err)
+	}
+	if err := unstructured.SetNestedField(obj.Object, value, "spec", field); err != nil {
+		f.t.Fatalf("Failed to set spec.%s: %v", field, err)
+	}
+	obj.SetGeneration(obj.GetGeneration() + 1)
+	if _, err := client.Update(context.Background(), obj, metav1.UpdateOptions{}); err != nil {
+		f.t.Fatalf("Failed to update cluster: %v", err)
+	}
+}
+
+func (f *operatorFixture) statefulSet() *appsv1.StatefulSet {
+	f.t.Helper()
+	sts, err := f.kube.AppsV1().StatefulSets(testNamespace).Get(context.Background(), "store", metav1.GetOptions{})
+	if err != nil {
+		f.t.Fatalf("Failed to get stateful set: %v", err)
+	}
+	return sts
+}
+
+// startPod plays the StatefulSet controller and kubelet for one ordinal
+func (f *operatorFixture) startPod(ordinal int, image string) {
+	f.t.Helper()
+	pods := f.kube.CoreV1().Pods(testNamespace)
+	name := "store-" + strconv.Itoa(ordinal)
+	pods.Delete(context.Background(), name, metav1.DeleteOptions{})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Labels: selectorLabels(&DistoreCluster{ObjectMeta: metav1.ObjectMeta{Name: "store"}})},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: containerName, Image: image}}},
+		Status: corev1.PodStatus{Conditions: []corev1.PodCondition{
+			{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+		}},
+	}
+	if _, err := pods.Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		f.t.Fatalf("Failed to create pod %s: %v", name, err)
+	}
+}
+
+func (f *operatorFixture) podExists(ordinal int) bool {
+	_, err := f.kube.CoreV1().Pods(testNamespace).Get(context.Background(), "store-"+strconv.Itoa(ordinal), metav1.GetOptions{})
+	return err == nil
+}
+
+// running creates a cluster of three ready nodes
+func (f *operatorFixture) running(image string) {
+	f.t.Helper()
+	f.reconcile()
+	for i := 0; i < 3; i++ {
+		f.startPod(i, image)
+	}
+	f.reconcile()
+	if dc := f.cluster(); dc.Status.Phase != PhaseRunning {
+		f.t.Fatalf("Expected a running cluster, got %+v", dc.Status)
+	}
+	f.admin.takeCalls()
+}
+
+func addr(ordinal int) string {
+	return "store-" + strconv.Itoa(ordinal) + ".store-headless." + testNamespace + ".svc:8080"
+}
+
+func baseSpec() map[string]interface{} {
+	return map[string]interface{}{
+		"replicas": int64(3),
+		"image":    "distore/server:1.0",
+		"storage":  map[string]interface{}{"size": "5Gi", "storageClass": "fast"},
+	}
+}
+
+func TestOperator_CreatesResources(t *testing.T) {
+	f := newOperatorFixture(t, baseSpec())
+	ctx := context.Background()
+
+	if !f.reconcile() {
+		t.Error("Expected a requeue while the pods start")
+	}
+
+	sts := f.statefulSet()
+	if *sts.Spec.Replicas != 3 {
+		t.Errorf("Expected 3 replicas, got %d", *sts.Spec.Replicas)
+	}
+	if sts.Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType {
+		t.Errorf("Expected OnDelete updates, got %s", sts.Spec.UpdateStrategy.Type)
+	}
+	if sts.Spec.ServiceName != "store-headless" {
+		t.Errorf("Expected headless service name, got %s", sts.Spec.ServiceName)
+	}
+	container := sts.Spec.Template.Spec.Containers[0]
+	if container.Image != "distore/server:1.0" {
+		t.Errorf("Expected image distore/server:1.0, got %s", container.Image)
+	}
+	if got := container.Resources.Limits.Memory().String(); got != "512Mi" {
+		t.Errorf("Expected default memory limit 512Mi, got %s", got)
+	}
+	if len(sts.OwnerReferences) != 1 || sts.OwnerReferences[0].Kind != DistoreClusterKind {
+		t.Errorf("Expected the cluster to own the stateful set, got %+v", sts.OwnerReferences)
+	}
+
+	headless, err := f.kube.CoreV1().Services(testNamespace).Get(ctx, "store-headless", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected headless service: %v", err)
+	}
+	if headless.Spec.ClusterIP != corev1.ClusterIPNone {
+		t.Errorf("Expected a headless service, got cluster IP %q", headless.Spec.ClusterIP)
+	}
+	if _, err := f.kube.CoreV1().Services(testNamespace).Get(ctx, "store", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected client service: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		pvc, err := f.kube.CoreV1().PersistentVolumeClaims(testNamespace).Get(ctx, "data-store-"+strconv.Itoa(i), metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Expected volume claim %d: %v", i, err)
+		}
+		if *pvc.Spec.StorageClassName != "fast" || pvc.Spec.Resources.Requests.Storage().String() != "5Gi" {
+			t.Errorf("Unexpected volume claim spec %+v", pvc.Spec)
+		}
+	}
+
+	cm, err := f.kube.CoreV1().ConfigMaps(testNamespace).Get(ctx, "store-config", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected config map: %v", err)
+	}
+	var cfg config.Config
+	if err := json.Unmarshal([]byte(cm.Data["config.json"]), &cfg); err != nil {
+		t.Fatalf("Invalid node config: %v", err)
+	}
+	if len(cfg.Nodes) != 3 || cfg.Nodes[2] != addr(2) || cfg.HTTPPort != 8080 {
+		t.Errorf("Unexpected node config %+v", cfg)
+	}
+
+	dc := f.cluster()
+	if dc.Status.Phase != PhasePending {
+		t.Errorf("Expected pending phase, got %s", dc.Status.Phase)
+	}
+	if !meta.IsStatusConditionTrue(dc.Status.Conditions, ConditionProgressing) {
+		t.Errorf("Expected Progressing condition, got %+v", dc.Status.Conditions)
+	}
+}
+
+func TestOperator_BecomesAvailable(t *testing.T) {
+	f := newOperatorFixture(t, baseSpec())
+	f.reconcile()
+	for i := 0; i < 3; i++ {
+		f.startPod(i, "distore/server:1.0")
+	}
+
+	if f.reconcile() {
+		t.Error("Expected no requeue for a ready cluster")
+	}
+
+	dc := f.cluster()
+	if dc.Status.Phase != PhaseRunning || dc.Status.ReadyReplicas != 3 {
+		t.Errorf("Expected 3 ready replicas in running phase, got %+v", dc.Status)
+	}
+	if len(dc.Status.Nodes) != 3 || dc.Status.Nodes[0] != addr(0) {
+		t.Errorf("Expected 3 member nodes, got %v", dc.Status.Nodes)
+	}
+	if dc.Status.CurrentImage != "distore/server:1.0" {
+		t.Errorf("Expected current image, got %q", dc.Status.CurrentImage)
+	}
+	if !meta.IsStatusConditionTrue(dc.Status.Conditions, ConditionAvailable) ||
+		meta.IsStatusConditionTrue(dc.Status.Conditions, ConditionProgressing) ||
+		meta.IsStatusConditionTrue(dc.Status.Conditions, ConditionDegraded) {
+		t.Errorf("Unexpected conditions %+v", dc.Status.Conditions)
+	}
+	if calls := f.admin.takeCalls(); len(calls) != 0 {
+		t.Errorf("Expected no admin calls for a new cluster, got %v", calls)
+	}
+}
+
+func TestOperator_RollingUpgrade(t *testing.T) {
+	f := newOperatorFixture(t, baseSpec())
+	f.running("distore/server:1.0")
+
+	f.updateSpec("image", "distore/server:2.0")
+	f.reconcile()
+
+	if image := f.statefulSet().Spec.Template.Spec.Containers[0].Image; image != "distore/server:2.0" {
+		t.Errorf("Expected the pod template to use the new image, got %s", image)
+	}
+
+	// Highest ordinal first, drained on its peers before the restart
+	calls := f.admin.takeCalls()
+	for _, ordinal := range []int{2, 1, 0} {
+		if f.podExists(ordinal) {
+			t.Fatalf("Expected pod %d to be deleted", ordinal)
+		}
+		for i := 0; i < ordinal; i++ {
+			if !f.podExists(i) {
+				t.Fatalf("Pod %d deleted before pod %d", i, ordinal)
+			}
+		}
+		if len(calls) != 2 || !strings.HasPrefix(calls[0], "leaving ") || !strings.HasSuffix(calls[0], addr(ordinal)) {
+			t.Fatalf("Expected the peers to drain %s, got %v", addr(ordinal), calls)
+		}
+		if dc := f.cluster(); dc.Status.DrainingNode != addr(ordinal) {
+			t.Fatalf("Expected %s draining, got %q", addr(ordinal), dc.Status.DrainingNode)
+		}
+
+		// Nothing else moves until the pod is back
+		f.reconcile()
+		if calls := f.admin.takeCalls(); len(calls) != 0 {
+			t.Fatalf("Expected no admin calls while %d restarts, got %v", ordinal, calls)
+		}
+
+		f.startPod(ordinal, "distore/server:2.0")
+		f.reconcile()
+		calls = f.admin.takeCalls()
+		if len(calls) < 2 || !strings.HasPrefix(calls[0], "clear ") || !strings.HasSuffix(calls[1], addr(ordinal)) {
+			t.Fatalf("Expected the drain of %s to be cleared, got %v", addr(ordinal), calls)
+		}
+		// The same pass drains the next node
+		calls = calls[2:]
+	}
+
+	dc := f.cluster()
+	if dc.Status.CurrentImage != "distore/server:2.0" || dc.Status.DrainingNode != "" {
+		t.Errorf("Expected the upgrade to finish, got %+v", dc.Status)
+	}
+	if !meta.IsStatusConditionTrue(dc.Status.Conditions, ConditionAvailable) ||
+		meta.IsStatusConditionTrue(dc.Status.Conditions, ConditionProgressing) {
+		t.Errorf("Unexpected conditions %+v", dc.Status.Conditions)
+	}
+}
+
+func TestOperator_ScaleUp(t *testing.T) {
+	f := newOperatorFixture(t, baseSpec())
+	f.running("distore/server:1.0")
+
+	f.updateSpec("replicas", int64(4))
+	f.reconcile()
+
+	if replicas := *f.statefulSet().Spec.Replicas; replicas != 4 {
+		t.Errorf("Expected 4 replicas, got %d", replicas)
+	}
+	if _, err := f.kube.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.Background(), "data-store-3", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected a volume claim for the new pod: %v", err)
+	}
+	dc := f.cluster()
+	if reason := meta.FindStatusCondition(dc.Status.Conditions, ConditionProgressing).Reason; reason != "ScalingUp" {
+		t.Errorf("Expected ScalingUp, got %s", reason)
+	}
+
+	f.startPod(3, "distore/server:1.0")
+	f.reconcile()
+	calls := f.admin.takeCalls()
+	want := "bootstrap " + addr(3) + " " + strings.Join([]string{addr(0), addr(1), addr(2)}, ",")
+	if len(calls) != 1 || calls[0] != want {
+		t.Fatalf("Expected %q, got %v", want, calls)
+	}
+
+	// Still streaming
+	f.reconcile()
+	if len(f.cluster().Status.Nodes) != 3 {
+		t.Error("Expected the node to join only after its bootstrap")
+	}
+
+	f.admin.setJob(addr(3), cluster.LocalNodeNormal, cluster.OpBootstrap, cluster.LifecycleCompleted)
+	f.reconcile()
+	dc = f.cluster()
+	if len(dc.Status.Nodes) != 4 || dc.Status.Phase != PhaseRunning {
+		t.Errorf("Expected 4 running members, got %+v", dc.Status)
+	}
+}
+
+func TestOperator_ScaleDown(t *testing.T) {
+	f := newOperatorFixture(t, baseSpec())
+	f.running("distore/server:1.0")
+
+	f.updateSpec("replicas", int64(2))
+	f.reconcile()
+
+	if calls := f.admin.takeCalls(); len(calls) != 1 || calls[0] != "decommission "+addr(2) {
+		t.Fatalf("Expected the decommission of %s, got %v", addr(2), calls)
+	}
+	if replicas := *f.statefulSet().Spec.Replicas; replicas != 3 {
+		t.Errorf("Expected the pod to stay until its data moved, got %d replicas", replicas)
+	}
+
+	f.reconcile()
+	if calls := f.admin.takeCalls(); len(calls) != 0 {
+		t.Errorf("Expected no new calls while decommissioning, got %v", calls)
+	}
+
+	f.admin.setJob(addr(2), cluster.LocalNodeDecommissioned, cluster.OpDecommission, cluster.LifecycleCompleted)
+	f.reconcile()
+	if nodes := f.cluster().Status.Nodes; len(nodes) != 2 {
+		t.Errorf("Expected 2 members, got %v", nodes)
+	}
+
+	f.reconcile()
+	if replicas := *f.statefulSet().Spec.Replicas; replicas != 2 {
+		t.Errorf("Expected 2 replicas, got %d", replicas)
+	}
+	if _, err := f.kube.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.Background(), "data-store-2", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the volume claim of the removed node to be kept: %v", err)
+	}
+}
+
+func TestOperator_InvalidSpec(t *testing.T) {
+	spec := baseSpec()
+	spec["storage"] = map[string]interface{}{"size": "lots"}
+	f := newOperatorFixture(t, spec)
+
+	if f.reconcile() {
+		t.Error("Expected no requeue for an invalid spec")
+	}
+
+	dc := f.cluster()
+	if dc.Status.Phase != PhaseFailed {
+		t.Errorf("Expected failed phase, got %s", dc.Status.Phase)
+	}
+	cond := meta.FindStatusCondition(dc.Status.Conditions, ConditionDegraded)
+	if cond == nil || cond.Status != metav1.ConditionTrue || cond.Reason != "InvalidSpec" {
+		t.Errorf("Expected Degraded InvalidSpec, got %+v", cond)
+	}
+	if _, err := f.kube.AppsV1().StatefulSets(testNamespace).Get(context.Background(), "store", metav1.GetOptions{}); err == nil {
+		t.Error("Expected no stateful set for an invalid spec")
+	}
+}
+
+func TestOperator_AuthConfig(t *testing.T) {
+	spec := baseSpec()
+	spec["auth"] = map[string]interface{}{"enabled": true, "secretName": "store-auth"}
+	f := newOperatorFixture(t, spec)
+	f.reconcile()
+
+	cm, err := f.kube.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), "store-config", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected config map: %v", err)
+	}
+	// Nodes read their config file over the defaults
+	cfg := config.Default()
+	if err := config.Decode([]byte(cm.Data["config.json"]), "json", cfg); err != nil {
+		t.Fatalf("Invalid node config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Nodes reject the rendered config: %v", err)
+	}
+	if !cfg.Internode.ServiceToken {
+		t.Error("Expected internode service tokens with auth enabled")
+	}
+	if cfg.Auth.TokenDuration <= 0 {
+		t.Errorf("Expected a positive token duration, got %d", cfg.Auth.TokenDuration)
+	}
+	if cfg.Auth.PrivateKeyFile != authDir+"/private.pem" || cfg.Auth.PublicKeyFile != authDir+"/public.pem" {
+		t.Fatalf("Expected the keys of the auth secret, got %q and %q", cfg.Auth.PrivateKeyFile, cfg.Auth.PublicKeyFile)
+	}
+
+	// Stand in for the mounted secret
+	dir := t.TempDir()
+	key, err := auth.GenerateSigningKey(auth.AlgES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(key.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth.PrivateKeyFile = filepath.Join(dir, "private.pem")
+	cfg.Auth.PublicKeyFile = filepath.Join(dir, "public.pem")
+	if err := os.WriteFile(cfg.Auth.PrivateKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.Auth.PublicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := auth.NewAuthService(&cfg.Auth)
+	if err != nil {
+		t.Fatalf("Nodes cannot start with the rendered auth config: %v", err)
+	}
+	token, err := service.GenerateToken("admin", "default", []string{"admin"})
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	if _, err := service.ValidateToken(token); err != nil {
+		t.Errorf("Failed to validate token: %v", err)
+	}
+}
+
+func TestHTTPNodeAdmin(t *testing.T) {
+	var paths []string
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		paths = append(paths, r.Method+" "+r.URL.RequestURI())
+		switch r.URL.Path {
+		case "/admin/lifecycle":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"state": "leaving",
+				"job":   map[string]interface{}{"operation": "decommission", "state": "running"},
+			})
+		case "/admin/nodes/missing:8080/leaving":
+			http.Error(w, "node not found", http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer node.Close()
+
+	host := strings.TrimPrefix(node.URL, "http://")
+	admin := NewHTTPNodeAdmin("secret")
+	ctx := context.Background()
+
+	if err := admin.SetLeaving(ctx, host, "peer:8080", true); err != nil {
+		t.Errorf("SetLeaving failed: %v", err)
+	}
+	if err := admin.SetLeaving(ctx, host, "peer:8080", false); err != nil {
+		t.Errorf("Clearing leaving failed: %v", err)
+	}
+	if err := admin.SetLeaving(ctx, host, "missing:8080", true); err != nil {
+		t.Errorf("Expected an unknown node to need no drain, got %v", err)
+	}
+	if err := admin.Bootstrap(ctx, host, []string{"a:8080"}); err != nil {
+		t.Errorf("Bootstrap failed: %v", err)
+	}
+	status, err := admin.LifecycleStatus(ctx, host)
+	if err != nil {
+		t.Fatalf("LifecycleStatus failed: %v", err)
+	}
+	if status.State != cluster.LocalNodeLeaving || status.Job == nil || status.Job.Operation != cluster.OpDecommission {
+		t.Errorf("Unexpected lifecycle status %+v", status)
+	}
+
+	want := []string{
+		"POST /admin/nodes/peer:8080/leaving",
+		"POST /admin/nodes/peer:8080/leaving?clear=true",
+		"POST /admin/nodes/missing:8080/leaving",
+		"POST /admin/lifecycle/bootstrap",
+		"GET /admin/lifecycle",
+	}
+	if strings.Join(paths, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected requests %v, got %v", want, paths)
+	}
+
+	if err := NewHTTPNodeAdmin("wrong").Decommission(ctx, host); err == nil {
+		t.Error("Expected an error for a rejected request")
+	}
+}
+
+func TestOperator_EdgeInstances(t *testing.T) {
+	spec := baseSpec()
+	spec["multiCloud"] = map[string]interface{}{
+		"enabled":     true,
+		"dataCenters": []interface{}{map[string]interface{}{"id": "dc1", "region": "us-east-1"}},
+		"edgeNodes": []interface{}{
+			map[string]interface{}{"id": "nyc", "location": "New York", "cacheOnly": true},
+			map[string]interface{}{"id": "ams", "location": "Amsterdam", "cacheOnly": true},
+		},
+	}
+	f := newOperatorFixture(t, spec)
+	ctx := context.Background()
+	f.reconcile()
+
+	deployment, err := f.kube.AppsV1().Deployments(testNamespace).Get(ctx, "distore-edge-nyc", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected an edge deployment: %v", err)
+	}
+	if len(deployment.OwnerReferences) != 1 || deployment.OwnerReferences[0].Name != "store" {
+		t.Errorf("Expected the cluster to own the edge, got %+v", deployment.OwnerReferences)
+	}
+	if image := deployment.Spec.Template.Spec.Containers[0].Image; image != "distore/server:1.0" {
+		t.Errorf("Expected the cluster image, got %s", image)
+	}
+
+	// Core nodes reach the edge through its service
+	cm, _ := f.kube.CoreV1().ConfigMaps(testNamespace).Get(ctx, "store-config", metav1.GetOptions{})
+	var cfg config.Config
+	json.Unmarshal([]byte(cm.Data["config.json"]), &cfg)
+	if len(cfg.MultiCloud.EdgeNodes) != 2 || cfg.MultiCloud.EdgeNodes[0].Node != "distore-edge-nyc."+testNamespace+".svc:8080" {
+		t.Errorf("Unexpected edge nodes %+v", cfg.MultiCloud.EdgeNodes)
+	}
+	if _, err := f.kube.CoreV1().Services(testNamespace).Get(ctx, "distore-edge-nyc", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected an edge service: %v", err)
+	}
+
+	f.updateSpec("multiCloud", map[string]interface{}{
+		"enabled":   true,
+		"edgeNodes": []interface{}{map[string]interface{}{"id": "nyc", "location": "New York", "cacheOnly": true}},
+	})
+	f.reconcile()
+	if _, err := f.kube.AppsV1().Deployments(testNamespace).Get(ctx, "distore-edge-ams", metav1.GetOptions{}); err == nil {
+		t.Error("Expected the removed edge to be torn down")
+	}
+	if _, err := f.kube.AppsV1().Deployments(testNamespace).Get(ctx, "distore-edge-nyc", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the remaining edge to stay: %v", err)
+	}
+}
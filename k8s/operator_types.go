@@ -0,0 +1,163 @@
+package k8s
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// DistoreClusterGVR identifies the DistoreCluster custom resource defined in operator.yaml
+var DistoreClusterGVR = schema.GroupVersionResource{
+	Group:    "distore.io",
+	Version:  "v1",
+	Resource: "distoreclusters",
+}
+
+// DistoreClusterKind is the kind of the DistoreCluster custom resource
+const DistoreClusterKind = "DistoreCluster"
+
+// Cluster phases reported in the status
+const (
+	PhasePending = "Pending"
+	PhaseRunning = "Running"
+	PhaseFailed  = "Failed"
+)
+
+// Status condition types
+const (
+	ConditionAvailable   = "Available"   // every member is ready
+	ConditionProgressing = "Progressing" // a scale or upgrade is running
+	ConditionDegraded    = "Degraded"    // the spec or the admin API stop reconciliation
+)
+
+// DistoreCluster is a Distore cluster managed by the operator
+type DistoreCluster struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DistoreClusterSpec   `json:"spec"`
+	Status DistoreClusterStatus `json:"status,omitempty"`
+}
+
+type DistoreClusterSpec struct {
+	Replicas       int32                `json:"replicas"`
+	Image          string               `json:"image"`
+	HTTPPort       int32                `json:"httpPort,omitempty"`
+	PrometheusPort int32                `json:"prometheusPort,omitempty"`
+	DataDir        string               `json:"dataDir,omitempty"`
+	Storage        ClusterStorageSpec   `json:"storage,omitempty"`
+	Auth           ClusterSecretSpec    `json:"auth,omitempty"`
+	TLS            ClusterSecretSpec    `json:"tls,omitempty"`
+	MultiCloud     ClusterMultiCloud    `json:"multiCloud,omitempty"`
+	Resources      ClusterResourcesSpec `json:"resources,omitempty"`
+}
+
+type ClusterStorageSpec struct {
+	Size         string `json:"size,omitempty"`
+	StorageClass string `json:"storageClass,omitempty"`
+}
+
+// ClusterSecretSpec enables a feature whose key material lives in a secret
+type ClusterSecretSpec struct {
+	Enabled    bool   `json:"enabled,omitempty"`
+	SecretName string `json:"secretName,omitempty"`
+}
+
+type ClusterMultiCloud struct {
+	Enabled     bool                `json:"enabled,omitempty"`
+	DataCenters []ClusterDataCenter `json:"dataCenters,omitempty"`
+	EdgeNodes   []ClusterEdgeNode   `json:"edgeNodes,omitempty"`
+}
+
+type ClusterDataCenter struct {
+	ID           string `json:"id"`
+	Region       string `json:"region,omitempty"`
+	Priority     int    `json:"priority,omitempty"`
+	ReplicaCount int    `json:"replicaCount,omitempty"`
+}
+
+type ClusterEdgeNode struct {
+	ID        string `json:"id"`
+	Location  string `json:"location,omitempty"`
+	CacheOnly bool   `json:"cacheOnly,omitempty"`
+}
+
+type ClusterResourcesSpec struct {
+	Requests ClusterResourceList `json:"requests,omitempty"`
+	Limits   ClusterResourceList `json:"limits,omitempty"`
+}
+
+type ClusterResourceList struct {
+	CPU    string `json:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty"`
+}
+
+type DistoreClusterStatus struct {
+	Phase              string             `json:"phase,omitempty"`
+	ReadyReplicas      int32              `json:"readyReplicas"`
+	TotalReplicas      int32              `json:"totalReplicas"`
+	Nodes              []string           `json:"nodes,omitempty"`        // addresses of the nodes that joined the cluster
+	CurrentImage       string             `json:"currentImage,omitempty"` // image every member runs
+	DrainingNode       string             `json:"drainingNode,omitempty"` // member restarted by a rolling upgrade
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// withDefaults fills the values the CRD schema defaults, for clusters
+// created before the defaults existed
+func (spec DistoreClusterSpec) withDefaults() DistoreClusterSpec {
+	if spec.HTTPPort == 0 {
+		spec.HTTPPort = 8080
+	}
+	if spec.PrometheusPort == 0 {
+		spec.PrometheusPort = 9090
+	}
+	if spec.DataDir == "" {
+		spec.DataDir = "/data"
+	}
+	if spec.Storage.Size == "" {
+		spec.Storage.Size = "10Gi"
+	}
+	if spec.Resources.Requests.CPU == "" {
+		spec.Resources.Requests.CPU = "100m"
+	}
+	if spec.Resources.Requests.Memory == "" {
+		spec.Resources.Requests.Memory = "128Mi"
+	}
+	if spec.Resources.Limits.CPU == "" {
+		spec.Resources.Limits.CPU = "500m"
+	}
+	if spec.Resources.Limits.Memory == "" {
+		spec.Resources.Limits.Memory = "512Mi"
+	}
+	return spec
+}
+
+// validate checks what the CRD schema cannot
+func (spec DistoreClusterSpec) validate() error {
+	if spec.Replicas < 1 {
+		return fmt.Errorf("replicas must be at least 1, got %d", spec.Replicas)
+	}
+	if spec.Image == "" {
+		return fmt.Errorf("image is required")
+	}
+	if spec.Auth.Enabled && spec.Auth.SecretName == "" {
+		return fmt.Errorf("auth.secretName is required when auth is enabled")
+	}
+	if spec.TLS.Enabled && spec.TLS.SecretName == "" {
+		return fmt.Errorf("tls.secretName is required when tls is enabled")
+	}
+	return nil
+}
+
+// clusterFromUnstructured converts a resource read by the dynamic client
+func clusterFromUnstructured(obj *unstructured.Unstructured) (*DistoreCluster, error) {
+	var dc DistoreCluster
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &dc); err != nil {
+		return nil, fmt.Errorf("decoding %s %s/%s: %w", DistoreClusterKind, obj.GetNamespace(), obj.GetName(), err)
+	}
+	return &dc, nil
+}
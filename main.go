@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -9,14 +10,21 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"distore/api"
+	"distore/audit"
 	"distore/auth"
 	"distore/cluster"
 	"distore/config"
+	"distore/encryption"
+	"distore/internode"
+	"distore/k8s"
 	"distore/monitoring"
+	"distore/quota"
 	"distore/replication"
 	"distore/storage"
 
@@ -24,12 +32,24 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAuditCommand(os.Args[2:]))
+	}
+
 	// Parse command line arguments
-	configFile := flag.String("config", "config.json", "Path to config file")
+	configFile := flag.String("config", "config.json", "Path to a JSON or YAML config file")
+	advertise := flag.String("advertise", "", "Address peers reach this node at (default localhost:<http_port>)")
+	var overrides stringList
+	flag.Var(&overrides, "set", "Override a setting, e.g. -set replication.write_quorum=2 (repeatable)")
+	watchInterval := flag.Duration("config_watch", 0, "Reload the config file when it changes, checking at this interval (0 disables)")
 	flag.Parse()
 
-	// Load configuration
-	cfg, err := config.LoadConfig(*configFile)
+	// Load configuration: defaults, file, DISTORE_* environment, -set flags
+	configLoader := newConfigLoader(overrides)
+	cfg, err := configLoader.Load(*configFile)
 	if err != nil {
 		log.Fatalf("Error loading config from %s: %v", *configFile, err)
 	}
@@ -49,30 +69,302 @@ func main() {
 	}
 	defer baseStore.Close()
 
-	// Wrapping storage with advanced capabilities
-	store := wrapStorageWithAdvancedFeatures(baseStore, cfg)
+	// Encryption at rest: values are encrypted with per-tenant data keys
+	// wrapped by a master key, below every layer that counts or copies them
+	var encStore *encryption.Storage
+	var valueCipher storage.ValueCipher
+	if cfg.Encryption.Enabled {
+		kms, err := encryption.NewKMS(cfg.Encryption)
+		if err != nil {
+			log.Fatalf("Error loading master keys: %v", err)
+		}
+		keyringFile := cfg.Encryption.KeyringFile
+		if keyringFile == "" {
+			keyringFile = filepath.Join(cfg.DataDir, "keyring.json")
+		}
+		keyring, err := encryption.OpenKeyring(keyringFile, kms)
+		if err != nil {
+			log.Fatalf("Error opening keyring: %v", err)
+		}
+		encStore = encryption.NewStorage(baseStore, keyring)
+		baseStore = encStore
+		valueCipher = keyring
+		log.Printf("Encryption at rest enabled (master key %s)", kms.CurrentKeyID())
+	}
 
-	// Init replication
-	replicator := replication.NewReplicator(cfg.Nodes, cfg.ReplicaCount)
+	// Core nodes publish key changes to the edge caches
+	var invalidations *cluster.InvalidationLog
+	if !cfg.Edge.CacheOnly && len(cfg.MultiCloud.EdgeNodes) > 0 {
+		invalidations = cluster.NewInvalidationLog(cfg.Edge.InvalidationLogSize)
+		baseStore = storage.NewObservedStorage(baseStore, invalidations.Record)
+	}
+
+	// Per-tenant storage quotas, counted on the base storage so that every
+	// write is seen, replicated and expiring keys included
+	var quotas *quota.Manager
+	if cfg.Quota.Enabled {
+		quotas = quota.NewManager(cfg.Quota)
+		if err := quotas.Load(baseStore); err != nil {
+			log.Fatalf("Failed to count tenant usage: %v", err)
+		}
+		baseStore = quota.NewStorage(baseStore, quotas)
+		log.Printf("Tenant quotas enabled")
+	}
+
+	// Wrapping storage with advanced capabilities
+	store, layers := wrapStorageWithAdvancedFeatures(baseStore, cfg)
+	if layers.wal != nil && valueCipher != nil {
+		layers.wal.SetCipher(valueCipher)
+	}
 
-	// Initialize rebalancer with self address
 	selfAddr := fmt.Sprintf("localhost:%d", cfg.HTTPPort)
-	rebalancer := cluster.NewRebalancer(store, replicator, selfAddr)
+	if *advertise != "" {
+		selfAddr = *advertise
+	}
 
-	// Init authentication
+	// Init authentication: tokens are only issued to stored identities
 	var authService auth.AuthServiceInterface
+	var jwtService *auth.AuthService
+	var issuer *auth.Issuer
+	identities := auth.NewIdentities()
 	if cfg.Auth.Enabled {
-		authService, err = auth.NewAuthService(&cfg.Auth)
+		signer, err := auth.NewAuthService(&cfg.Auth)
 		if err != nil {
-			log.Printf("Warning: using simple auth service due to error: %v", err)
-			authService = auth.NewSimpleAuthService(cfg.Auth.TokenDuration)
+			log.Fatalf("Invalid auth keys: %v", err)
 		}
+		jwtService = signer.(*auth.AuthService)
+		issuer = auth.NewIssuer(jwtService, identities, time.Duration(cfg.Auth.RefreshTokenDuration)*time.Second)
+		issuer.SetExternalIssuers(auth.NewOIDCVerifiers(cfg.Auth.OIDC))
+		authService = issuer
 		log.Printf("Authentication enabled")
 	} else {
 		authService = nil
 		log.Printf("Authentication disabled")
 	}
 
+	// Tenant isolation and key access policy, denials are audited
+	policy, err := auth.NewAccessPolicy(cfg.Auth.Policy)
+	if err != nil {
+		log.Fatalf("Invalid access policy: %v", err)
+	}
+	auditors := auth.Auditors{auth.LogAuditor{}}
+
+	// Hash-chained audit log of data writes, admin actions and auth events
+	var auditLog *audit.Log
+	if cfg.Audit.Enabled {
+		auditLog, err = audit.Open(auditDir(cfg), selfAddr, cfg.Audit)
+		if err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		defer auditLog.Close()
+		auditors = append(auditors, auditLog.Auditor())
+		log.Printf("Audit log enabled in %s", auditLog.Dir())
+	}
+	guard := auth.NewGuard(policy, auditors)
+
+	// Node-to-node traffic: mTLS and replicator service tokens, set up before
+	// any component talks to its peers
+	var serviceTokens internode.TokenSource
+	var internodeTokens auth.AuthServiceInterface
+	if cfg.Internode.ServiceToken {
+		if jwtService == nil {
+			log.Fatalf("internode.service_token requires auth")
+		}
+		serviceTokens = auth.NewServiceTokens(jwtService.ClusterSigner(), selfAddr)
+		internodeTokens = jwtService
+	}
+	if err := internode.Configure(cfg.Internode, serviceTokens); err != nil {
+		log.Fatalf("Invalid internode configuration: %v", err)
+	}
+	if cfg.Internode.TLS || cfg.Internode.ServiceToken {
+		log.Printf("Internode security enabled (mTLS: %v, service tokens: %v)", cfg.Internode.TLS, cfg.Internode.ServiceToken)
+	}
+
+	// Init replication
+	checkInterval := time.Duration(cfg.Failover.CheckInterval) * time.Second
+	if checkInterval <= 0 {
+		checkInterval = replication.DefaultFailoverCheckInterval
+	}
+	replicator := replication.NewReplicatorWithFailover(cfg.Nodes, cfg.ReplicaCount,
+		checkInterval, time.Duration(cfg.Failover.Timeout)*time.Second)
+	defer replicator.Stop()
+	replicator.SetQuorum(cfg.Replication.WriteQuorum, cfg.Replication.ReadQuorum)
+	if valueCipher != nil {
+		if err := replicator.SetHintCipher(valueCipher); err != nil {
+			log.Fatalf("Failed to encrypt hints: %v", err)
+		}
+	}
+	if fm := replicator.FailoverManager(); fm != nil {
+		fm.SetDetectorConfig(cluster.FailureDetectorConfigFromConfig(cfg.Failover, checkInterval))
+	}
+
+	// Per-keyspace replication settings
+	keyspaces := replication.NewKeyspaceRegistry(cfg.MultiCloud.DataCenters)
+	if err := keyspaces.Load(cfg.Keyspaces); err != nil {
+		log.Fatalf("Invalid keyspace configuration: %v", err)
+	}
+	replicator.SetKeyspaces(keyspaces)
+
+	// Cross-DC pipeline: local DC quorum plus queued shipping to remote DCs
+	var crossDC *cluster.CrossDCReplicator
+	var latencyProber *cluster.LatencyProber
+	if cfg.MultiCloud.Enabled || cfg.Edge.CacheOnly {
+		crossDC = cluster.NewCrossDCReplicator(cfg.MultiCloud)
+	}
+	if crossDC != nil && cfg.Replication.CrossDCEnabled && !cfg.Edge.CacheOnly {
+		opts := cluster.DefaultCrossDCOptions()
+		opts.Self = selfAddr
+		opts.LocalDC = cfg.MultiCloud.LocalDataCenter
+		opts.Async = cfg.Replication.AsyncReplication
+		if cfg.DataDir != "" {
+			opts.QueueDir = filepath.Join(cfg.DataDir, "crossdc")
+		}
+		if cfg.Replication.CrossDCBatchSize > 0 {
+			opts.BatchSize = cfg.Replication.CrossDCBatchSize
+		}
+		if cfg.Replication.CrossDCFlushInterval > 0 {
+			opts.FlushInterval = time.Duration(cfg.Replication.CrossDCFlushInterval) * time.Millisecond
+		}
+		if cfg.Replication.MaxLatencyMs > 0 {
+			opts.AckTimeout = time.Duration(cfg.Replication.MaxLatencyMs) * time.Millisecond
+		}
+		if err := crossDC.Start(opts); err != nil {
+			log.Fatalf("Error starting cross-DC replication: %v", err)
+		}
+		defer crossDC.Stop()
+		replicator.SetCrossDC(crossDC)
+	}
+	if crossDC != nil {
+		// Measured latencies drive target selection instead of the configured ones
+		latencyProber = cluster.NewLatencyProber(crossDC, cluster.LatencyProberConfigFromConfig(selfAddr, cfg.MultiCloud))
+		latencyProber.Start()
+		defer latencyProber.Stop()
+	}
+
+	// Edge mode: reads from a bounded cache, writes forwarded to the core cluster
+	var edgeCache *cluster.EdgeCache
+	if cfg.Edge.CacheOnly {
+		edgeOpts := cluster.DefaultEdgeCacheOptions()
+		edgeOpts.Self = selfAddr
+		edgeOpts.MaxEntries = cfg.Edge.CacheEntries
+		edgeOpts.MaxBytes = cfg.Edge.CacheBytes
+		edgeOpts.MaxStaleness = time.Duration(cfg.Edge.MaxStalenessMs) * time.Millisecond
+		edgeCache = cluster.NewEdgeCache(crossDC, edgeOpts)
+		if err := edgeCache.Start(); err != nil {
+			log.Fatalf("Error starting edge cache: %v", err)
+		}
+		defer edgeCache.Stop()
+		store = edgeCache
+		log.Printf("Running as cache-only edge node")
+	}
+
+	// Health probing of the edge nodes served by this cluster
+	var edgeManager *k8s.EdgeNodeManager
+	if cfg.MultiCloud.Enabled && len(cfg.MultiCloud.EdgeNodes) > 0 && edgeCache == nil {
+		edgeManager, err = k8s.NewEdgeNodeManager(&cfg.MultiCloud)
+		if err != nil {
+			log.Fatalf("Error creating edge node manager: %v", err)
+		}
+		defer edgeManager.Stop()
+	}
+
+	// Locality-aware reads over the replicas of each key
+	var readRouter *cluster.ReadRouter
+	if crossDC != nil && edgeCache == nil {
+		readRouter = cluster.NewReadRouter(selfAddr, store, crossDC, func(key string) []string {
+			return replicator.ReplicasFor(key, selfAddr)
+		})
+		readRouter.SetFailoverManager(replicator.FailoverManager())
+		if err := readRouter.SetDefaultPolicy(cluster.ReadPolicy(cfg.MultiCloud.ReadPolicy)); err != nil {
+			log.Fatalf("Invalid read policy: %v", err)
+		}
+	}
+
+	// Read-only guard: driven by node health in multi-node setups, manual otherwise
+	readOnly := replicator.ReadOnlyManager()
+	if readOnly == nil {
+		readOnly = cluster.NewReadOnlyManager(0)
+	}
+	readOnly.SetHysteresis(
+		time.Duration(cfg.Failover.ReadOnlyEnterDelay)*time.Second,
+		time.Duration(cfg.Failover.ReadOnlyExitDelay)*time.Second,
+	)
+	if cfg.Failover.CheckInterval > 0 {
+		readOnly.SetRetryAfter(time.Duration(cfg.Failover.CheckInterval) * time.Second)
+	}
+
+	// Initialize rebalancer with self address
+	rebalancer := cluster.NewRebalancer(store, replicator, selfAddr)
+	rebalanceOpts := cluster.DefaultRebalanceOptions()
+	if cfg.Rebalance.BatchSize > 0 {
+		rebalanceOpts.BatchSize = cfg.Rebalance.BatchSize
+	}
+	if cfg.Rebalance.VirtualNodes > 0 {
+		rebalanceOpts.VirtualNodes = cfg.Rebalance.VirtualNodes
+	}
+	if cfg.Rebalance.VerifyRetries > 0 {
+		rebalanceOpts.VerifyRetries = cfg.Rebalance.VerifyRetries
+	}
+	rebalanceOpts.BandwidthLimit = cfg.Rebalance.BandwidthBytesPerSec
+	rebalancer.SetOptions(rebalanceOpts)
+
+	// Replicated cluster metadata: members, ring tokens and keyspaces
+	metadata, err := newMetadataStore(cfg, selfAddr)
+	if err != nil {
+		log.Fatalf("Failed to open cluster metadata: %v", err)
+	}
+	followMetadata(metadata, replicator, rebalancer, keyspaces)
+	shareIdentities(metadata, identities)
+	if cfg.Auth.Enabled {
+		if !cfg.Internode.TLS {
+			log.Printf("Identities are not shared between nodes without internode.tls")
+		}
+		created, err := identities.Bootstrap(cfg.Auth.Bootstrap)
+		if err != nil {
+			log.Fatalf("Failed to create the bootstrap admin: %v", err)
+		}
+		if created {
+			log.Printf("Created the bootstrap admin from auth.bootstrap")
+		} else if identities.Len() == 0 {
+			log.Printf("Warning: no identities exist, set auth.bootstrap to create an admin")
+		}
+	}
+	// Signing keys: published to the other nodes, rotated on a schedule
+	var keyRotator *auth.KeyRotator
+	if jwtService != nil {
+		shareSigningKeys(metadata, jwtService, selfAddr)
+		keyRotator = auth.NewKeyRotator(jwtService, cfg.Auth.KeyRotation)
+		keyRotator.Start()
+		defer keyRotator.Stop()
+	}
+	metadata.Start()
+	defer metadata.Stop()
+
+	// Data keys: rotated on a schedule, values re-encrypted in the background
+	var dataKeys *encryption.Rotator
+	if encStore != nil {
+		dataKeys = encryption.NewRotator(encStore, cfg.Encryption)
+		dataKeys.Start()
+		defer dataKeys.Stop()
+	}
+
+	// Node lifecycle workflows (decommission, bootstrap, replace)
+	lifecycle := cluster.NewNodeLifecycle(selfAddr, store, metadata.Membership(rebalancer), rebalancer)
+	lifecycle.SetFailoverManager(replicator.FailoverManager())
+
+	// Hot reload: SIGHUP, file watch or POST /admin/config/reload
+	reloader := config.NewReloader(*configFile, configLoader, cfg)
+	registerReloadHandlers(reloader, layers, replicator, metadata, jwtService, keyRotator, issuer, guard, serviceTokens, quotas, auditLog, dataKeys)
+	if auditLog != nil {
+		reloader.OnReload(func(trigger string, result *config.ReloadResult, err error) {
+			auditConfigReload(auditLog, trigger, result, err)
+		})
+	}
+	if *watchInterval > 0 {
+		reloader.Watch(*watchInterval)
+		defer reloader.Stop()
+	}
+
 	// Init metrics
 	metrics := monitoring.NewMetrics()
 	healthChecker := monitoring.NewHealthChecker(store, replicator)
@@ -82,6 +374,30 @@ func main() {
 	// inject rebalancer (optional)
 	// NOTE: rebalancer field is optional, set directly
 	handlers.Rebalancer = rebalancer
+	handlers.Repairer = cluster.NewRepairer(store, selfAddr, func(key string) []string {
+		return replicator.ReplicasFor(key, selfAddr)
+	})
+	handlers.Hints = replicator.HintedHandoff()
+	handlers.Failover = replicator.FailoverManager()
+	handlers.ReadOnly = readOnly
+	handlers.Lifecycle = lifecycle
+	handlers.Keyspaces = keyspaces
+	handlers.CrossDC = crossDC
+	handlers.Latency = latencyProber
+	handlers.ReadRouter = readRouter
+	handlers.Invalidations = invalidations
+	handlers.EdgeCache = edgeCache
+	handlers.Edges = edgeManager
+	handlers.ConfigReloader = reloader
+	handlers.Metadata = metadata
+	handlers.Issuer = issuer
+	handlers.Signer = jwtService
+	handlers.Quotas = quotas
+	handlers.Audit = auditLog
+	handlers.Encryption = dataKeys
+	handlers.Placement = func(key string) []string {
+		return replicator.ReplicasFor(key, selfAddr)
+	}
 
 	router := mux.NewRouter()
 
@@ -103,16 +419,30 @@ func main() {
 	// Auth endpoints
 	if cfg.Auth.Enabled {
 		public.HandleFunc("/auth/token", handlers.TokenHandler).Methods("POST")
+		public.Handle("/auth/logout", auth.AuthMiddleware(authService)(http.HandlerFunc(handlers.LogoutHandler))).Methods("POST")
+		public.HandleFunc("/.well-known/jwks.json", handlers.JWKSHandler).Methods("GET")
 	}
 
+	// Writes retried with an Idempotency-Key header are applied once
+	idempotency := api.NewIdempotencyCache(10*time.Minute, 100000)
+
 	// Advanced data operations endpoints
 	advanced := router.PathPrefix("/advanced").Subrouter()
 	if cfg.Auth.Enabled {
 		advanced.Use(auth.AuthMiddleware(authService))
-		advanced.Use(auth.RBACMiddleware(auth.RoleWrite))
+		advanced.Use(guard.RBAC(auth.RoleWrite))
+		advanced.Use(guard.Tenant)
+		advanced.Use(guard.KeyAccess)
 	} else {
 		advanced.Use(auth.PublicMiddleware) // important for working without authentication
 	}
+	advanced.Use(idempotency.Middleware)
+	if auditLog != nil {
+		advanced.Use(auditLog.DataMiddleware(store))
+	}
+	if quotas != nil {
+		advanced.Use(quotas.Middleware)
+	}
 
 	advanced.HandleFunc("/ttl", handlers.TTLHandler).Methods("POST")
 	advanced.HandleFunc("/increment", handlers.IncrementHandler).Methods("POST")
@@ -123,59 +453,142 @@ func main() {
 	advanced.HandleFunc("/lock/{key}", handlers.AcquireLockHandler).Methods("POST")
 	advanced.HandleFunc("/lock/{key}", handlers.ReleaseLockHandler).Methods("DELETE")
 
-	// Protected endpoints
-	protected := router.PathPrefix("").Subrouter()
-	if cfg.Auth.Enabled && authService != nil {
-		protected.Use(auth.AuthMiddleware(authService))
-		protected.Use(auth.RBACMiddleware(auth.RoleRead))
-		protected.Use(auth.TenantMiddleware)
-		protected.Use(auth.KeyAccessMiddleware)
-	} else {
-		protected.Use(auth.PublicMiddleware)
+	// Protected endpoints, writes need the write role
+	dataMiddlewares := []mux.MiddlewareFunc{idempotency.Middleware}
+	if auditLog != nil {
+		dataMiddlewares = append(dataMiddlewares, auditLog.DataMiddleware(store))
 	}
+	if quotas != nil {
+		dataMiddlewares = append(dataMiddlewares, quotas.Middleware)
+	}
+	writes := dataRoutes(router, auth.RoleWrite, authService, guard, dataMiddlewares...)
+	writes.HandleFunc("/set", handlers.SetHandler).Methods("POST")
+	writes.HandleFunc("/delete/{key}", handlers.DeleteHandler).Methods("DELETE")
 
-	protected.HandleFunc("/set", handlers.SetHandler).Methods("POST")
+	protected := dataRoutes(router, auth.RoleRead, authService, guard, dataMiddlewares...)
 	protected.HandleFunc("/get/{key}", handlers.GetHandler).Methods("GET")
-	protected.HandleFunc("/delete/{key}", handlers.DeleteHandler).Methods("DELETE")
 	protected.HandleFunc("/keys", handlers.GetAllHandler).Methods("GET")
+	protected.HandleFunc("/cluster/nodes", handlers.ClusterNodesHandler).Methods("GET")
+	protected.HandleFunc("/cluster/placement", handlers.PlacementHandler).Methods("GET")
 
 	// Internal endpoints for replication
 	internal := router.PathPrefix("/internal").Subrouter()
-	internal.Use(auth.PublicMiddleware)
+	var metadataUpdates http.Handler = http.HandlerFunc(handlers.InternalMetadataHandler)
+	if cfg.Internode.TLS || internodeTokens != nil {
+		internal.Use(auth.InternodeMiddleware(cfg.Internode.TLS, internodeTokens))
+	} else {
+		internal.Use(auth.PublicMiddleware)
+		// Cluster-wide changes are still only taken from the members
+		metadataUpdates = auth.MemberOriginMiddleware(func() []string { return metadata.Get().Members })(metadataUpdates)
+	}
 	internal.HandleFunc("/set", handlers.InternalSetHandler).Methods("POST")
+	internal.HandleFunc("/batch_set", handlers.InternalBatchSetHandler).Methods("POST")
+	internal.HandleFunc("/checksum", handlers.InternalChecksumHandler).Methods("POST")
+	internal.HandleFunc("/dc_batch", handlers.InternalDCBatchHandler).Methods("POST")
+	internal.HandleFunc("/range", handlers.InternalRangeHandler).Methods("POST")
+	internal.HandleFunc("/membership", handlers.InternalMembershipHandler).Methods("POST")
+	internal.HandleFunc("/metadata", handlers.InternalMetadataHandler).Methods("GET")
+	internal.Handle("/metadata", metadataUpdates).Methods("POST")
 	internal.HandleFunc("/delete/{key}", handlers.InternalDeleteHandler).Methods("DELETE")
 	internal.HandleFunc("/get/{key}", handlers.InternalGetHandler).Methods("GET")
+	internal.HandleFunc("/invalidations", handlers.InternalInvalidationsHandler).Methods("GET")
+	internal.HandleFunc("/edge_stats", handlers.EdgeCacheStatusHandler).Methods("GET")
 
 	// Admin endpoints
 	admin := router.PathPrefix("/admin").Subrouter()
 	if cfg.Auth.Enabled && authService != nil {
 		admin.Use(auth.AuthMiddleware(authService))
-		admin.Use(auth.RBACMiddleware(auth.RoleAdmin))
+		admin.Use(guard.RBAC(auth.RoleAdmin))
+		admin.Use(guard.Tenant)
+		// Tenant admins may only back up and restore their own keys, and see
+		// their own usage and audit events
+		admin.Use(guard.AdminScope("/admin/backup", "/admin/restore", "/admin/quotas", "/admin/audit"))
+		admin.Use(guard.KeyAccess)
 	} else {
 		admin.Use(auth.PublicMiddleware)
 	}
+	admin.Use(idempotency.Middleware)
+	if auditLog != nil {
+		admin.Use(auditLog.AdminMiddleware)
+	}
 	admin.HandleFunc("/nodes", handlers.ListNodesHandler).Methods("GET")
 	admin.HandleFunc("/nodes", handlers.AddNodeHandler).Methods("POST")
+	admin.HandleFunc("/nodes/status", handlers.NodeStatusHandler).Methods("GET")
 	admin.HandleFunc("/nodes/{node}", handlers.RemoveNodeHandler).Methods("DELETE")
+	admin.HandleFunc("/nodes/{node}/leaving", handlers.NodeLeavingHandler).Methods("POST")
+	admin.HandleFunc("/lifecycle", handlers.LifecycleStatusHandler).Methods("GET")
+	admin.HandleFunc("/lifecycle/decommission", handlers.DecommissionHandler).Methods("POST")
+	admin.HandleFunc("/lifecycle/bootstrap", handlers.BootstrapHandler).Methods("POST")
+	admin.HandleFunc("/lifecycle/replace", handlers.ReplaceNodeHandler).Methods("POST")
 	admin.HandleFunc("/rebalance", handlers.TriggerRebalanceHandler).Methods("POST")
+	admin.HandleFunc("/rebalance/status", handlers.RebalanceStatusHandler).Methods("GET")
+	admin.HandleFunc("/rebalance/{action}", handlers.RebalanceControlHandler).Methods("POST")
+	admin.HandleFunc("/repair", handlers.StartRepairHandler).Methods("POST")
+	admin.HandleFunc("/repair/status", handlers.RepairStatusHandler).Methods("GET")
+	admin.HandleFunc("/repair/cancel", handlers.CancelRepairHandler).Methods("POST")
+	admin.HandleFunc("/hints", handlers.HintsHandler).Methods("GET")
+	admin.HandleFunc("/hints/deliver", handlers.DeliverHintsHandler).Methods("POST")
+	admin.HandleFunc("/hints/{node}", handlers.DropHintsHandler).Methods("DELETE")
+	admin.HandleFunc("/readonly", handlers.ReadOnlyStatusHandler).Methods("GET")
+	admin.HandleFunc("/readonly", handlers.SetReadOnlyHandler).Methods("POST")
+	admin.HandleFunc("/crossdc", handlers.CrossDCStatusHandler).Methods("GET")
+	admin.HandleFunc("/latency", handlers.LatencyStatusHandler).Methods("GET")
+	admin.HandleFunc("/edge", handlers.EdgeCacheStatusHandler).Methods("GET")
+	admin.HandleFunc("/edges", handlers.EdgeHealthHandler).Methods("GET")
+	admin.HandleFunc("/edges/{id}", handlers.EdgeHealthHandler).Methods("GET")
+	admin.HandleFunc("/keyspaces", handlers.ListKeyspacesHandler).Methods("GET")
+	admin.HandleFunc("/keyspaces/resolve", handlers.ResolveKeyspaceHandler).Methods("GET")
+	admin.HandleFunc("/keyspaces/{name}", handlers.GetKeyspaceHandler).Methods("GET")
+	admin.HandleFunc("/keyspaces/{name}", handlers.PutKeyspaceHandler).Methods("PUT")
+	admin.HandleFunc("/keyspaces/{name}", handlers.DeleteKeyspaceHandler).Methods("DELETE")
 	admin.HandleFunc("/config", handlers.GetConfigHandler).Methods("GET")
 	admin.HandleFunc("/config", handlers.UpdateConfigHandler).Methods("PATCH")
+	admin.HandleFunc("/config/reload", handlers.ReloadConfigHandler).Methods("POST")
+	admin.HandleFunc("/metadata", handlers.MetadataHandler).Methods("GET")
+	admin.HandleFunc("/identities", handlers.ListIdentitiesHandler).Methods("GET")
+	admin.HandleFunc("/identities/{id}", handlers.GetIdentityHandler).Methods("GET")
+	admin.HandleFunc("/identities/{id}", handlers.PutIdentityHandler).Methods("PUT")
+	admin.HandleFunc("/identities/{id}", handlers.DeleteIdentityHandler).Methods("DELETE")
+	admin.HandleFunc("/identities/{id}/api_keys", handlers.CreateAPIKeyHandler).Methods("POST")
+	admin.HandleFunc("/identities/{id}/api_keys/{key_id}", handlers.DeleteAPIKeyHandler).Methods("DELETE")
+	admin.HandleFunc("/identities/{id}/revoke", handlers.RevokeIdentityTokensHandler).Methods("POST")
 	admin.HandleFunc("/backup", handlers.BackupHandler).Methods("POST")
 	admin.HandleFunc("/restore", handlers.RestoreHandler).Methods("POST")
+	admin.HandleFunc("/quotas", handlers.QuotasHandler).Methods("GET")
+	admin.HandleFunc("/audit", handlers.AuditHandler).Methods("GET")
+	admin.HandleFunc("/audit/verify", handlers.AuditVerifyHandler).Methods("GET")
+	admin.HandleFunc("/encryption", handlers.EncryptionStatusHandler).Methods("GET")
+	admin.HandleFunc("/encryption/rotate", handlers.RotateEncryptionKeysHandler).Methods("POST")
 
 	// Middleware chain
 	router.Use(monitoring.LoggerMiddleware)
 	router.Use(createMetricsMiddleware(metrics))
 	router.Use(loggingMiddleware)
+	if edgeCache != nil {
+		router.Use(edgeForwardMiddleware(edgeCache))
+	}
 
 	// Run background tasks for metrics
-	go startBackgroundTasks(store, replicator, metrics)
+	go startBackgroundTasks(store, replicator, crossDC, latencyProber, edgeManager, quotas, metrics)
 
 	// Launch the server
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", cfg.HTTPPort),
 		Handler: router,
 	}
+	if cfg.Internode.TLS {
+		// One listener serves both: the public certificate when configured,
+		// and node certificates are checked on the internal routes
+		var public *tls.Certificate
+		if cfg.TLS.Enabled {
+			cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+			if err != nil {
+				log.Fatalf("Error loading TLS certificate: %v", err)
+			}
+			public = &cert
+		}
+		server.TLSConfig = internode.ServerTLSConfig(public)
+	}
 
 	go func() {
 		log.Printf("Server starting on port %d", cfg.HTTPPort)
@@ -189,7 +602,9 @@ func main() {
 		log.Printf("  DELETE /advanced/lock/{key}")
 
 		var err error
-		if cfg.TLS.Enabled {
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else if cfg.TLS.Enabled {
 			err = server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
 		} else {
 			err = server.ListenAndServe()
@@ -200,6 +615,21 @@ func main() {
 		}
 	}()
 
+	// A new node pulls its ranges before serving reads
+	if len(cfg.Rebalance.JoinSeeds) > 0 {
+		if err := lifecycle.Bootstrap(cfg.Rebalance.JoinSeeds); err != nil {
+			log.Printf("Bootstrap failed to start: %v", err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloader.ReloadAndLog("SIGHUP")
+		}
+	}()
+
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -216,18 +646,25 @@ func main() {
 	log.Println("Server exited")
 }
 
+// storageLayers keeps the wrappers whose settings can be reloaded live
+type storageLayers struct {
+	ttl         *storage.TTLStorage
+	cache       *storage.CacheStorage
+	compression *storage.CompressedStorage
+	wal         *storage.WALStorage
+}
+
 // wrapStorageWithAdvancedFeatures wraps basic storage with advanced features
-func wrapStorageWithAdvancedFeatures(baseStore storage.Storage, cfg *config.Config) storage.Storage {
+func wrapStorageWithAdvancedFeatures(baseStore storage.Storage, cfg *config.Config) (storage.Storage, storageLayers) {
 	store := baseStore
+	var layers storageLayers
 
 	// 1. Add TTL support (if enabled)
 	if cfg.Advanced.TTLEnabled {
-		cleanupInterval := time.Duration(cfg.Advanced.CleanupInterval) * time.Second
-		if cleanupInterval == 0 {
-			cleanupInterval = 1 * time.Minute
-		}
+		cleanupInterval := ttlCleanupInterval(cfg)
 		ttlStore := storage.NewTTLStorage(store, cleanupInterval)
 		store = ttlStore
+		layers.ttl = ttlStore
 		log.Printf("TTL support enabled (cleanup interval: %v)", cleanupInterval)
 	}
 
@@ -235,10 +672,7 @@ func wrapStorageWithAdvancedFeatures(baseStore storage.Storage, cfg *config.Conf
 	if cfg.Performance.Enabled {
 		// hot data caching
 		if cfg.Performance.CacheSize > 0 {
-			cacheTTL := time.Duration(cfg.Performance.CacheTTL) * time.Second
-			if cacheTTL == 0 {
-				cacheTTL = 5 * time.Minute
-			}
+			cacheTTL := cacheEntryTTL(cfg)
 			cacheStore := storage.NewCacheStorage(
 				store,
 				storage.LRU,
@@ -246,22 +680,21 @@ func wrapStorageWithAdvancedFeatures(baseStore storage.Storage, cfg *config.Conf
 				cacheTTL,
 			)
 			store = cacheStore
+			layers.cache = cacheStore
 			log.Printf("Cache enabled (size: %d, TTL: %v)",
 				cfg.Performance.CacheSize, cacheTTL)
 		}
 
 		// data compression
 		if cfg.Performance.CompressionEnabled {
-			threshold := cfg.Performance.CompressionThreshold
-			if threshold == 0 {
-				threshold = 1024 // 1KB by default
-			}
+			threshold := compressionThreshold(cfg)
 			compressedStore := storage.NewCompressedStorage(
 				store,
 				storage.CompressionGZIP,
 				threshold,
 			)
 			store = compressedStore
+			layers.compression = compressedStore
 			log.Printf("Compression enabled (threshold: %d bytes)", threshold)
 		}
 
@@ -281,6 +714,7 @@ func wrapStorageWithAdvancedFeatures(baseStore storage.Storage, cfg *config.Conf
 			walStore, err := storage.NewWALStorage(store, cfg.DataDir)
 			if err == nil {
 				store = walStore
+				layers.wal = walStore
 				log.Printf("Write-ahead log enabled")
 			} else {
 				log.Printf("WAL initialization failed: %v", err)
@@ -309,11 +743,32 @@ func wrapStorageWithAdvancedFeatures(baseStore storage.Storage, cfg *config.Conf
 		log.Printf("CAS and locking support enabled")
 	}
 
-	return store
+	return store, layers
+}
+
+func ttlCleanupInterval(cfg *config.Config) time.Duration {
+	if cfg.Advanced.CleanupInterval == 0 {
+		return time.Minute
+	}
+	return time.Duration(cfg.Advanced.CleanupInterval) * time.Second
+}
+
+func cacheEntryTTL(cfg *config.Config) time.Duration {
+	if cfg.Performance.CacheTTL == 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(cfg.Performance.CacheTTL) * time.Second
+}
+
+func compressionThreshold(cfg *config.Config) int {
+	if cfg.Performance.CompressionThreshold == 0 {
+		return 1024 // 1KB by default
+	}
+	return cfg.Performance.CompressionThreshold
 }
 
 // startBackgroundTasks starts background tasks
-func startBackgroundTasks(store storage.Storage, replicator *replication.Replicator, metrics *monitoring.Metrics) {
+func startBackgroundTasks(store storage.Storage, replicator *replication.Replicator, crossDC *cluster.CrossDCReplicator, latencyProber *cluster.LatencyProber, edgeManager *k8s.EdgeNodeManager, quotas *quota.Manager, metrics *monitoring.Metrics) {
 	// Metrics update every 30 seconds
 	metricsTicker := time.NewTicker(30 * time.Second)
 	defer metricsTicker.Stop()
@@ -321,6 +776,52 @@ func startBackgroundTasks(store storage.Storage, replicator *replication.Replica
 	for range metricsTicker.C {
 		metrics.UpdateStorageMetrics(store)
 		metrics.UpdateReplicationMetrics(replicator)
+		if crossDC != nil {
+			metrics.UpdateCrossDCMetrics(crossDC)
+		}
+		if latencyProber != nil {
+			metrics.UpdateLatencyProbeMetrics(latencyProber)
+		}
+		if edgeManager != nil {
+			metrics.UpdateEdgeHealthMetrics(edgeManager)
+		}
+		if quotas != nil {
+			metrics.UpdateQuotaMetrics(quotas)
+		}
+	}
+}
+
+// dataRoutes returns a subrouter for key routes. With auth, callers need
+// role, and the tenant and access policy checks apply; middlewares run after.
+func dataRoutes(router *mux.Router, role auth.Role, authService auth.AuthServiceInterface, guard *auth.Guard, middlewares ...mux.MiddlewareFunc) *mux.Router {
+	sub := router.PathPrefix("").Subrouter()
+	if authService != nil {
+		sub.Use(auth.AuthMiddleware(authService))
+		sub.Use(guard.RBAC(role))
+		sub.Use(guard.Tenant)
+		sub.Use(guard.KeyAccess)
+	} else {
+		sub.Use(auth.PublicMiddleware)
+	}
+	sub.Use(middlewares...)
+	return sub
+}
+
+// edgeForwardMiddleware sends every client request except key reads to the
+// core cluster; internal, admin, health and metrics endpoints stay local
+func edgeForwardMiddleware(edgeCache *cluster.EdgeCache) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := r.URL.Path
+			local := strings.HasPrefix(path, "/internal/") || strings.HasPrefix(path, "/admin/") ||
+				strings.HasPrefix(path, "/health") || path == "/metrics" ||
+				(r.Method == http.MethodGet && strings.HasPrefix(path, "/get/"))
+			if local {
+				next.ServeHTTP(w, r)
+				return
+			}
+			edgeCache.Forward(w, r)
+		})
 	}
 }
 
@@ -1,6 +1,9 @@
 package monitoring
 
 import (
+	"distore/cluster"
+	"distore/k8s"
+	"distore/quota"
 	"distore/replication"
 	"distore/storage"
 	"fmt"
@@ -19,6 +22,23 @@ type Metrics struct {
 	storageSize     prometheus.Gauge
 	replicationLag  prometheus.Gauge
 	nodesOnline     prometheus.Gauge
+	nodeState       *prometheus.GaugeVec
+	nodePhi         *prometheus.GaugeVec
+	crossDCLag      *prometheus.GaugeVec
+	crossDCPending  *prometheus.GaugeVec
+	crossDCFailures *prometheus.GaugeVec
+	latencyEWMA     *prometheus.GaugeVec
+	latencyQuantile *prometheus.GaugeVec
+	latencyExceeded *prometheus.GaugeVec
+	probeFailures   *prometheus.GaugeVec
+	edgeState       *prometheus.GaugeVec
+	edgeLatency     *prometheus.GaugeVec
+	edgeHitRate     *prometheus.GaugeVec
+	edgeSyncLag     *prometheus.GaugeVec
+	tenantKeys      *prometheus.GaugeVec
+	tenantBytes     *prometheus.GaugeVec
+	tenantThrottled *prometheus.GaugeVec
+	tenantRejected  *prometheus.GaugeVec
 }
 
 type ResponseWriter struct {
@@ -58,6 +78,91 @@ func NewMetrics() *Metrics {
 			Name: "nodes_online_total",
 			Help: "Number of online replica nodes",
 		}),
+
+		nodeState: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_state",
+			Help: "Failure detector state per node (1 for the current state)",
+		}, []string{"node", "state"}),
+
+		nodePhi: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_phi",
+			Help: "Phi accrual suspicion level per node",
+		}, []string{"node"}),
+
+		crossDCLag: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "crossdc_replication_lag_seconds",
+			Help: "Age of the oldest write not yet acknowledged by a remote data center",
+		}, []string{"data_center"}),
+
+		crossDCPending: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "crossdc_queue_pending",
+			Help: "Writes queued for a remote data center",
+		}, []string{"data_center"}),
+
+		crossDCFailures: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "crossdc_ship_failures_total",
+			Help: "Failed batch deliveries to a remote data center",
+		}, []string{"data_center"}),
+
+		latencyEWMA: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_latency_seconds",
+			Help: "Smoothed round trip time to a node",
+		}, []string{"node", "data_center", "kind"}),
+
+		latencyQuantile: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_latency_quantile_seconds",
+			Help: "Round trip time percentiles over the recent probes of a node",
+		}, []string{"node", "quantile"}),
+
+		latencyExceeded: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_latency_threshold_exceeded",
+			Help: "Whether a node is beyond its latency threshold or unreachable",
+		}, []string{"node"}),
+
+		probeFailures: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_latency_probe_failures_total",
+			Help: "Failed latency probes per node",
+		}, []string{"node"}),
+
+		edgeState: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "edge_node_state",
+			Help: "Health state per edge node (1 for the current state)",
+		}, []string{"edge", "location", "state"}),
+
+		edgeLatency: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "edge_node_latency_seconds",
+			Help: "Measured health probe latency of an edge node",
+		}, []string{"edge"}),
+
+		edgeHitRate: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "edge_cache_hit_ratio",
+			Help: "Cache hit ratio reported by a cache-only edge node",
+		}, []string{"edge"}),
+
+		edgeSyncLag: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "edge_invalidation_sync_lag_seconds",
+			Help: "Time since a cache-only edge node last synced invalidations",
+		}, []string{"edge"}),
+
+		tenantKeys: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tenant_keys",
+			Help: "Keys a tenant stores on this node",
+		}, []string{"tenant"}),
+
+		tenantBytes: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tenant_bytes",
+			Help: "Bytes of keys and values a tenant stores on this node",
+		}, []string{"tenant"}),
+
+		tenantThrottled: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tenant_rate_limited_total",
+			Help: "Requests of a tenant rejected by a rate limit",
+		}, []string{"tenant", "scope"}),
+
+		tenantRejected: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tenant_quota_rejections_total",
+			Help: "Writes of a tenant rejected by a storage quota",
+		}, []string{"tenant", "quota"}),
 	}
 }
 
@@ -84,11 +189,87 @@ func (m *Metrics) UpdateStorageMetrics(storage storage.Storage) {
 func (m *Metrics) UpdateReplicationMetrics(replicator *replication.Replicator) {
 	go func() {
 		// Logic for measuring lag can be added here
-		nodes := replicator.GetNodes()
-		m.nodesOnline.Set(float64(len(nodes)))
+		statuses := replicator.GetNodeStatus()
+		if statuses == nil {
+			m.nodesOnline.Set(float64(len(replicator.GetNodes())))
+			return
+		}
+
+		online := 0
+		m.nodeState.Reset()
+		m.nodePhi.Reset()
+		for node, status := range statuses {
+			if status.Online {
+				online++
+			}
+			for _, state := range []cluster.NodeState{
+				cluster.NodeStateUp, cluster.NodeStateSuspect, cluster.NodeStateDown, cluster.NodeStateLeaving,
+			} {
+				value := 0.0
+				if status.State == state {
+					value = 1
+				}
+				m.nodeState.WithLabelValues(node, string(state)).Set(value)
+			}
+			m.nodePhi.WithLabelValues(node).Set(status.Phi)
+		}
+		m.nodesOnline.Set(float64(online))
 	}()
 }
 
+func (m *Metrics) UpdateCrossDCMetrics(cdc *cluster.CrossDCReplicator) {
+	for _, status := range cdc.Status() {
+		m.crossDCLag.WithLabelValues(status.DataCenter).Set(status.LagSeconds)
+		m.crossDCPending.WithLabelValues(status.DataCenter).Set(float64(status.Pending))
+		m.crossDCFailures.WithLabelValues(status.DataCenter).Set(float64(status.Failures))
+	}
+}
+
+func (m *Metrics) UpdateLatencyProbeMetrics(prober *cluster.LatencyProber) {
+	for _, stats := range prober.Stats() {
+		m.latencyEWMA.WithLabelValues(stats.Node, stats.DataCenter, stats.Kind).Set(stats.EWMA.Seconds())
+		m.latencyQuantile.WithLabelValues(stats.Node, "0.5").Set(stats.P50.Seconds())
+		m.latencyQuantile.WithLabelValues(stats.Node, "0.95").Set(stats.P95.Seconds())
+		m.latencyQuantile.WithLabelValues(stats.Node, "0.99").Set(stats.P99.Seconds())
+		exceeded := 0.0
+		if stats.Exceeded {
+			exceeded = 1
+		}
+		m.latencyExceeded.WithLabelValues(stats.Node).Set(exceeded)
+		m.probeFailures.WithLabelValues(stats.Node).Set(float64(stats.Failures))
+	}
+}
+
+func (m *Metrics) UpdateEdgeHealthMetrics(edges *k8s.EdgeNodeManager) {
+	for _, health := range edges.GetAllEdgeNodeHealth() {
+		for _, state := range []k8s.EdgeNodeState{
+			k8s.EdgeStateUnknown, k8s.EdgeStateHealthy, k8s.EdgeStateDegraded, k8s.EdgeStateOffline,
+		} {
+			value := 0.0
+			if health.State == state {
+				value = 1
+			}
+			m.edgeState.WithLabelValues(health.NodeID, health.Location, string(state)).Set(value)
+		}
+		m.edgeLatency.WithLabelValues(health.NodeID).Set(float64(health.Latency) / 1000)
+		m.edgeHitRate.WithLabelValues(health.NodeID).Set(health.CacheHitRate)
+		m.edgeSyncLag.WithLabelValues(health.NodeID).Set(float64(health.SyncLagMs) / 1000)
+	}
+}
+
+func (m *Metrics) UpdateQuotaMetrics(quotas *quota.Manager) {
+	for _, usage := range quotas.Usage() {
+		m.tenantKeys.WithLabelValues(usage.Tenant).Set(float64(usage.Keys))
+		m.tenantBytes.WithLabelValues(usage.Tenant).Set(float64(usage.Bytes))
+		for scope, count := range usage.Throttled {
+			m.tenantThrottled.WithLabelValues(usage.Tenant, scope).Set(float64(count))
+		}
+		for name, count := range usage.Rejected {
+			m.tenantRejected.WithLabelValues(usage.Tenant, name).Set(float64(count))
+		}
+	}
+}
+
 func (m *Metrics) Handler() http.Handler {
 	return promhttp.Handler()
 }
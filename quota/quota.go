@@ -0,0 +1,203 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"distore/config"
+	"distore/storage"
+)
+
+// ErrQuotaExceeded is returned for writes that would take a tenant beyond
+// one of its storage quotas
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Manager enforces the rate limits and storage quotas of each tenant and
+// keeps their usage
+type Manager struct {
+	mu     sync.Mutex
+	cfg    config.QuotaConfig
+	usage  map[string]*tenantUsage
+	limits map[string]*bucket // by tenant, user or route, see Allow
+	pruned time.Time
+	now    func() time.Time
+}
+
+type tenantUsage struct {
+	keys, bytes int64
+	throttled   map[string]int64 // rate limited requests by scope
+	rejected    map[string]int64 // writes over quota by quota
+}
+
+// TenantUsage reports a tenant's usage on this node and its limits
+type TenantUsage struct {
+	Tenant       string           `json:"tenant"`
+	Keys         int64            `json:"keys"`
+	Bytes        int64            `json:"bytes"`
+	MaxKeys      int64            `json:"max_keys,omitempty"`
+	MaxBytes     int64            `json:"max_bytes,omitempty"`
+	MaxValueSize int64            `json:"max_value_size,omitempty"`
+	Throttled    map[string]int64 `json:"throttled,omitempty"` // by scope: tenant, user or route
+	Rejected     map[string]int64 `json:"rejected,omitempty"`  // by quota
+}
+
+func NewManager(cfg config.QuotaConfig) *Manager {
+	return &Manager{
+		cfg:    cfg,
+		usage:  make(map[string]*tenantUsage),
+		limits: make(map[string]*bucket),
+		now:    time.Now,
+	}
+}
+
+// SetConfig changes the limits of a running manager. Rate limits start
+// over with full buckets.
+func (m *Manager) SetConfig(cfg config.QuotaConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg = cfg
+	m.limits = make(map[string]*bucket)
+}
+
+// limitsOf returns the limits of tenant. Called with the lock held.
+func (m *Manager) limitsOf(tenant string) config.TenantQuotaConfig {
+	if limits, ok := m.cfg.Tenants[tenant]; ok {
+		return limits
+	}
+	return m.cfg.Default
+}
+
+func (m *Manager) usageOf(tenant string) *tenantUsage {
+	u, ok := m.usage[tenant]
+	if !ok {
+		u = &tenantUsage{throttled: make(map[string]int64), rejected: make(map[string]int64)}
+		m.usage[tenant] = u
+	}
+	return u
+}
+
+// TenantOfKey returns the tenant a stored key belongs to, "" for keys
+// outside of any tenant
+func TenantOfKey(key string) string {
+	tenant, _, ok := strings.Cut(key, ":")
+	if !ok {
+		return ""
+	}
+	return tenant
+}
+
+// Load counts the keys and bytes each tenant has in s
+func (m *Manager) Load(s storage.Storage) error {
+	items, err := s.GetAll()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.usage {
+		u.keys, u.bytes = 0, 0
+	}
+	for _, item := range items {
+		if tenant := TenantOfKey(item.Key); tenant != "" {
+			u := m.usageOf(tenant)
+			u.keys++
+			u.bytes += int64(len(item.Key) + len(item.Value))
+		}
+	}
+	return nil
+}
+
+// reserve accounts for a write that changes the keys and bytes of tenant,
+// unless it would exceed a quota
+func (m *Manager) reserve(tenant string, keys, bytes, valueSize int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limits := m.limitsOf(tenant)
+	u := m.usageOf(tenant)
+
+	var err error
+	switch {
+	case limits.MaxValueSize > 0 && valueSize > limits.MaxValueSize:
+		u.rejected["max_value_size"]++
+		err = fmt.Errorf("%w: value of %d bytes exceeds the %d bytes allowed for tenant %s", ErrQuotaExceeded, valueSize, limits.MaxValueSize, tenant)
+	case limits.MaxKeys > 0 && keys > 0 && u.keys+keys > limits.MaxKeys:
+		u.rejected["max_keys"]++
+		err = fmt.Errorf("%w: tenant %s has %d of %d keys", ErrQuotaExceeded, tenant, u.keys, limits.MaxKeys)
+	case limits.MaxBytes > 0 && bytes > 0 && u.bytes+bytes > limits.MaxBytes:
+		u.rejected["max_bytes"]++
+		err = fmt.Errorf("%w: tenant %s stores %d of %d bytes", ErrQuotaExceeded, tenant, u.bytes, limits.MaxBytes)
+	}
+	if err != nil {
+		return err
+	}
+	u.keys += keys
+	u.bytes += bytes
+	return nil
+}
+
+// release undoes a reservation, or accounts for a removal
+func (m *Manager) release(tenant string, keys, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.usageOf(tenant)
+	u.keys -= keys
+	u.bytes -= bytes
+}
+
+// Usage reports every tenant with stored keys, a limit or rejections
+func (m *Manager) Usage() []TenantUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tenants := make(map[string]bool, len(m.usage)+len(m.cfg.Tenants))
+	for tenant := range m.usage {
+		tenants[tenant] = true
+	}
+	for tenant := range m.cfg.Tenants {
+		tenants[tenant] = true
+	}
+
+	usage := make([]TenantUsage, 0, len(tenants))
+	for tenant := range tenants {
+		usage = append(usage, m.usageLocked(tenant))
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tenant < usage[j].Tenant })
+	return usage
+}
+
+// UsageOf reports the usage of one tenant
+func (m *Manager) UsageOf(tenant string) TenantUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usageLocked(tenant)
+}
+
+func (m *Manager) usageLocked(tenant string) TenantUsage {
+	limits := m.limitsOf(tenant)
+	usage := TenantUsage{
+		Tenant:       tenant,
+		MaxKeys:      limits.MaxKeys,
+		MaxBytes:     limits.MaxBytes,
+		MaxValueSize: limits.MaxValueSize,
+	}
+	if u, ok := m.usage[tenant]; ok {
+		usage.Keys, usage.Bytes = u.keys, u.bytes
+		usage.Throttled = copyCounts(u.throttled)
+		usage.Rejected = copyCounts(u.rejected)
+	}
+	return usage
+}
+
+func copyCounts(counts map[string]int64) map[string]int64 {
+	if len(counts) == 0 {
+		return nil
+	}
+	c := make(map[string]int64, len(counts))
+	for k, v := range counts {
+		c[k] = v
+	}
+	return c
+}
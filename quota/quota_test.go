@@ -0,0 +1,198 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"distore/auth"
+	"distore/config"
+	"distore/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeClock lets tests refill buckets without sleeping
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestManager(cfg config.QuotaConfig) (*Manager, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	m := NewManager(cfg)
+	m.now = clock.now
+	return m, clock
+}
+
+func TestManager_Allow(t *testing.T) {
+	m, clock := newTestManager(config.QuotaConfig{
+		Default: config.TenantQuotaConfig{
+			RequestRate: config.RateLimitConfig{Rate: 10, Burst: 3},
+			UserRate:    config.RateLimitConfig{Rate: 1, Burst: 2},
+		},
+		Tenants: map[string]config.TenantQuotaConfig{"big": {}},
+		Routes:  map[string]config.RateLimitConfig{"POST /advanced/batch": {Rate: 0.5}},
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, _, ok := m.Allow("acme", "alice", "GET /get/{key}"); !ok {
+			t.Fatalf("Request %d within the burst rejected", i)
+		}
+	}
+	scope, retryAfter, ok := m.Allow("acme", "alice", "GET /get/{key}")
+	if ok || scope != "user" || retryAfter != time.Second {
+		t.Errorf("Expected the user limit to apply for 1s, got %q %v %v", scope, retryAfter, ok)
+	}
+	if _, _, ok := m.Allow("acme", "bob", "GET /get/{key}"); !ok {
+		t.Error("Another user of the tenant rejected")
+	}
+	// The rejected request took no token from the tenant: bob's request
+	// above took the third
+	if scope, _, ok := m.Allow("acme", "carol", "GET /get/{key}"); ok || scope != "tenant" {
+		t.Errorf("Expected the tenant limit to apply, got %q %v", scope, ok)
+	}
+
+	clock.advance(time.Second)
+	if _, _, ok := m.Allow("acme", "alice", "GET /get/{key}"); !ok {
+		t.Error("Request rejected after the buckets refilled")
+	}
+
+	// Route limits apply per tenant, and a tenant entry replaces the default
+	if _, _, ok := m.Allow("big", "", "POST /advanced/batch"); !ok {
+		t.Fatal("First batch rejected")
+	}
+	if scope, retryAfter, ok := m.Allow("big", "", "POST /advanced/batch"); ok || scope != "route" || retryAfter != 2*time.Second {
+		t.Errorf("Expected the route limit to apply for 2s, got %q %v %v", scope, retryAfter, ok)
+	}
+	if _, _, ok := m.Allow("acme", "dave", "POST /advanced/batch"); !ok {
+		t.Error("Route limit of one tenant applied to another")
+	}
+
+	if usage := m.UsageOf("acme"); usage.Throttled["user"] != 1 || usage.Throttled["tenant"] != 1 {
+		t.Errorf("Unexpected throttling counts %v", usage.Throttled)
+	}
+}
+
+func TestManager_Middleware(t *testing.T) {
+	m, _ := newTestManager(config.QuotaConfig{Default: config.TenantQuotaConfig{RequestRate: config.RateLimitConfig{Rate: 1}}})
+	router := mux.NewRouter()
+	router.Use(m.Middleware)
+	router.HandleFunc("/get/{key}", func(w http.ResponseWriter, r *http.Request) {})
+
+	do := func(claims *auth.Claims) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/get/a", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "claims", claims))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tenant := &auth.Claims{UserID: "alice", TenantID: "acme", Roles: []string{"read"}}
+	if rr := do(tenant); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rr.Code)
+	}
+	rr := do(tenant)
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	admin := &auth.Claims{UserID: "root", TenantID: auth.AllTenants, Roles: []string{"admin"}}
+	for i := 0; i < 3; i++ {
+		if rr := do(admin); rr.Code != http.StatusOK {
+			t.Errorf("Cluster admin rate limited: %d", rr.Code)
+		}
+	}
+}
+
+func TestStorage_Quotas(t *testing.T) {
+	base := storage.NewMemoryStorage()
+	base.Set("acme:existing", "12345")
+	base.Set("unscoped", "value")
+
+	m, _ := newTestManager(config.QuotaConfig{
+		Default: config.TenantQuotaConfig{MaxKeys: 3, MaxBytes: 55, MaxValueSize: 20},
+	})
+	if err := m.Load(base); err != nil {
+		t.Fatal(err)
+	}
+	if usage := m.UsageOf("acme"); usage.Keys != 1 || usage.Bytes != 18 {
+		t.Fatalf("Expected 1 key and 18 bytes after loading, got %+v", usage)
+	}
+	s := NewStorage(base, m)
+
+	if err := s.Set("acme:a", strings.Repeat("x", 21)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected a too large value to be rejected, got %v", err)
+	}
+	if err := s.Set("acme:a", strings.Repeat("x", 20)); err != nil {
+		t.Fatal(err)
+	}
+	// Overwriting a key only counts the difference
+	if err := s.Set("acme:a", strings.Repeat("x", 10)); err != nil {
+		t.Fatal(err)
+	}
+	if usage := m.UsageOf("acme"); usage.Keys != 2 || usage.Bytes != 34 {
+		t.Errorf("Expected 2 keys and 34 bytes, got %+v", usage)
+	}
+
+	if err := s.Set("acme:b", strings.Repeat("x", 20)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected max_bytes to be enforced, got %v", err)
+	}
+	if err := s.Set("acme:b", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("acme:c", "x"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected max_keys to be enforced, got %v", err)
+	}
+	if _, err := base.Get("acme:c"); err == nil {
+		t.Error("Rejected write was stored")
+	}
+
+	// Deleting frees the quota, other tenants and unscoped keys are not limited
+	if err := s.Delete("acme:b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("acme:c", "x"); err != nil {
+		t.Errorf("Write rejected after a delete: %v", err)
+	}
+	if err := s.Set("other:a", strings.Repeat("x", 20)); err != nil {
+		t.Errorf("Write of another tenant rejected: %v", err)
+	}
+	if err := s.Set("unscoped2", strings.Repeat("x", 100)); err != nil {
+		t.Errorf("Unscoped write rejected: %v", err)
+	}
+
+	usage := m.UsageOf("acme")
+	if usage.Rejected["max_value_size"] != 1 || usage.Rejected["max_bytes"] != 1 || usage.Rejected["max_keys"] != 1 {
+		t.Errorf("Unexpected rejection counts %v", usage.Rejected)
+	}
+	if storage.Unwrap(s) != base {
+		t.Error("Expected Unwrap to return the base storage")
+	}
+}
+
+func TestStorage_CountsStoredBytes(t *testing.T) {
+	m, _ := newTestManager(config.QuotaConfig{
+		Default: config.TenantQuotaConfig{MaxValueSize: 100},
+	})
+	// Compression sits above the quota, as on a node
+	s := storage.NewCompressedStorage(NewStorage(storage.NewMemoryStorage(), m), storage.CompressionGZIP, 10)
+
+	if err := s.Set("acme:a", strings.Repeat("x", 1000)); err != nil {
+		t.Errorf("Expected a value compressing below max_value_size to be accepted, got %v", err)
+	}
+	if usage := m.UsageOf("acme"); usage.Bytes >= 1000 {
+		t.Errorf("Expected the compressed size to be counted, got %d bytes", usage.Bytes)
+	}
+	random := make([]byte, 200)
+	for i := range random {
+		random[i] = byte(i*7919 + i*i)
+	}
+	if err := s.Set("acme:b", string(random)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected a value too large once compressed to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package quota
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"distore/auth"
+	"distore/config"
+
+	"github.com/gorilla/mux"
+)
+
+// idleBucketTTL is how long an unused bucket is kept. A bucket idle that
+// long has refilled, so forgetting it changes nothing.
+const idleBucketTTL = 10 * time.Minute
+
+// bucket is a token bucket: it holds up to burst tokens, refilled at rate
+// per second, and each request takes one
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token, or tells how long until one is available
+func (b *bucket) take(limit config.RateLimitConfig, now time.Time) (time.Duration, bool) {
+	burst := float64(limit.Burst)
+	if burst == 0 {
+		burst = math.Ceil(limit.Rate)
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), false
+}
+
+// Allow takes a token from each bucket a request of user in tenant to route
+// draws from: the tenant's, the user's and the tenant's for the route. It
+// reports the scope whose bucket is empty and when to retry.
+func (m *Manager) Allow(tenant, user, route string) (scope string, retryAfter time.Duration, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.pruneBuckets(now)
+
+	limits := m.limitsOf(tenant)
+	checks := []struct {
+		scope, key string
+		limit      config.RateLimitConfig
+	}{
+		{"tenant", "tenant\x00" + tenant, limits.RequestRate},
+		{"user", "user\x00" + tenant + "\x00" + user, limits.UserRate},
+		{"route", "route\x00" + tenant + "\x00" + route, m.cfg.Routes[route]},
+	}
+
+	// Look at every bucket first, so that a rejected request takes no
+	// token from the others
+	buckets := make([]*bucket, len(checks))
+	for i, check := range checks {
+		if check.limit.Rate <= 0 || (check.scope == "user" && user == "") {
+			continue
+		}
+		b, found := m.limits[check.key]
+		if !found {
+			b = &bucket{tokens: math.Inf(1), last: now}
+			m.limits[check.key] = b
+		}
+		probe := *b
+		if wait, ok := probe.take(check.limit, now); !ok {
+			m.usageOf(tenant).throttled[check.scope]++
+			return check.scope, wait, false
+		}
+		buckets[i] = b
+	}
+	for i, b := range buckets {
+		if b != nil {
+			b.take(checks[i].limit, now)
+		}
+	}
+	return "", 0, true
+}
+
+// pruneBuckets forgets idle buckets. Called with the lock held.
+func (m *Manager) pruneBuckets(now time.Time) {
+	if now.Sub(m.pruned) < idleBucketTTL {
+		return
+	}
+	m.pruned = now
+	for key, b := range m.limits {
+		if now.Sub(b.last) > idleBucketTTL {
+			delete(m.limits, key)
+		}
+	}
+}
+
+// Middleware rate limits requests by the tenant and user of their token and
+// by route. Cluster admins are not limited.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := auth.ClaimsFrom(r.Context())
+		if auth.IsClusterAdmin(claims) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tenant, user := auth.DefaultTenant, ""
+		if claims != nil {
+			tenant, user = auth.TenantOf(claims), claims.UserID
+		}
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		scope, retryAfter, ok := m.Allow(tenant, user, r.Method+" "+route)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, fmt.Sprintf("Rate limit exceeded (%s) for tenant %s", scope, tenant), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,85 @@
+package quota
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"distore/storage"
+)
+
+// Storage enforces the storage quotas of the tenants on the keys written
+// through it, and keeps their usage current. It wraps the base storage, so
+// that it sees every write, replicated and expiring keys included.
+// Sizes are those of the values as stored: after compression, which sits
+// above it, and before encryption at rest, which sits below. max_value_size
+// and max_bytes therefore count stored bytes, not the bytes clients send.
+type Storage struct {
+	storage.Storage
+	quotas *Manager
+	locks  [64]sync.Mutex // by key, so the size replaced by a write is exact
+}
+
+func NewStorage(base storage.Storage, quotas *Manager) *Storage {
+	return &Storage{Storage: base, quotas: quotas}
+}
+
+// Unwrap returns the wrapped storage
+func (s *Storage) Unwrap() storage.Storage {
+	return s.Storage
+}
+
+func (s *Storage) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &s.locks[h.Sum32()%uint32(len(s.locks))]
+}
+
+func (s *Storage) Set(key, value string) error {
+	tenant := TenantOfKey(key)
+	if tenant == "" {
+		return s.Storage.Set(key, value)
+	}
+
+	mu := s.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	keys, bytes := int64(1), int64(len(key)+len(value))
+	old, err := s.Storage.Get(key)
+	if err == nil {
+		keys, bytes = 0, int64(len(value)-len(old))
+	} else if !errors.Is(err, storage.ErrKeyNotFound) {
+		return err
+	}
+
+	if err := s.quotas.reserve(tenant, keys, bytes, int64(len(value))); err != nil {
+		return err
+	}
+	if err := s.Storage.Set(key, value); err != nil {
+		s.quotas.release(tenant, keys, bytes)
+		return err
+	}
+	return nil
+}
+
+func (s *Storage) Delete(key string) error {
+	tenant := TenantOfKey(key)
+	if tenant == "" {
+		return s.Storage.Delete(key)
+	}
+
+	mu := s.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	old, err := s.Storage.Get(key)
+	if err != nil {
+		return s.Storage.Delete(key)
+	}
+	if err := s.Storage.Delete(key); err != nil {
+		return err
+	}
+	s.quotas.release(tenant, 1, int64(len(key)+len(old)))
+	return nil
+}
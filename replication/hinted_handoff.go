@@ -7,8 +7,12 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
+
+	"distore/internode"
+	"distore/storage"
 )
 
 type Hint struct {
@@ -25,6 +29,7 @@ type HintedHandoff struct {
 	storageDir  string
 	maxAttempts int
 	retryDelay  time.Duration
+	cipher      storage.ValueCipher // encrypts the values in hints.json, nil keeps them plain
 }
 
 func NewHintedHandoff(storageDir string) *HintedHandoff {
@@ -44,6 +49,23 @@ func NewHintedHandoff(storageDir string) *HintedHandoff {
 	return hh
 }
 
+// SetCipher makes the hints file hold encrypted values, and decrypts the
+// hints loaded from it
+func (hh *HintedHandoff) SetCipher(cipher storage.ValueCipher) error {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+
+	for i, hint := range hh.hints {
+		value, err := cipher.DecryptValue(hint.Key, hint.Value)
+		if err != nil {
+			return fmt.Errorf("hint for %s: %w", hint.Key, err)
+		}
+		hh.hints[i].Value = value
+	}
+	hh.cipher = cipher
+	return hh.saveHints()
+}
+
 func (hh *HintedHandoff) StoreHint(key, value, node string) error {
 	hh.mu.Lock()
 	defer hh.mu.Unlock()
@@ -69,7 +91,68 @@ func (hh *HintedHandoff) startRetryWorker() {
 	}
 }
 
-func (hh *HintedHandoff) retryHints() {
+// HintStats describes the hints kept for a node
+type HintStats struct {
+	Node     string    `json:"node"`
+	Hints    int       `json:"hints"`
+	Oldest   time.Time `json:"oldest"`
+	Attempts int       `json:"attempts"` // most delivery attempts of a hint
+}
+
+// Stats describes the hints kept, by node
+func (hh *HintedHandoff) Stats() []HintStats {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+
+	byNode := make(map[string]int) // index in stats
+	var stats []HintStats
+	for _, hint := range hh.hints {
+		i, ok := byNode[hint.Node]
+		if !ok {
+			i = len(stats)
+			byNode[hint.Node] = i
+			stats = append(stats, HintStats{Node: hint.Node, Oldest: hint.Timestamp})
+		}
+		s := &stats[i]
+		s.Hints++
+		if hint.Timestamp.Before(s.Oldest) {
+			s.Oldest = hint.Timestamp
+		}
+		if hint.Attempts > s.Attempts {
+			s.Attempts = hint.Attempts
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Node < stats[j].Node })
+	return stats
+}
+
+// Deliver tries to deliver the hints now instead of at the next retry, and
+// returns the number delivered and the number left
+func (hh *HintedHandoff) Deliver() (delivered, remaining int) {
+	return hh.retryHints()
+}
+
+// Drop discards the hints kept for node, e.g. after it left the cluster for
+// good, and returns their number
+func (hh *HintedHandoff) Drop(node string) (int, error) {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+
+	kept := hh.hints[:0:0]
+	for _, hint := range hh.hints {
+		if hint.Node != node {
+			kept = append(kept, hint)
+		}
+	}
+	dropped := len(hh.hints) - len(kept)
+	if dropped == 0 {
+		return 0, nil
+	}
+	hh.hints = kept
+	return dropped, hh.saveHints()
+}
+
+func (hh *HintedHandoff) retryHints() (delivered, remaining int) {
 	hh.mu.Lock()
 	defer hh.mu.Unlock()
 
@@ -89,16 +172,18 @@ func (hh *HintedHandoff) retryHints() {
 			remainingHints = append(remainingHints, hint)
 		} else {
 			fmt.Printf("Successfully delivered hint to %s\n", hint.Node)
+			delivered++
 		}
 	}
 
 	hh.hints = remainingHints
 	hh.saveHints()
+	return delivered, len(remainingHints)
 }
 
 func (hh *HintedHandoff) tryDeliverHint(hint Hint) error {
 	// Attempt to deliver a hint to the target node
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := internode.NewClient(5 * time.Second)
 
 	req := ReplicationRequest{Key: hint.Key, Value: hint.Value}
 	jsonData, err := json.Marshal(req)
@@ -106,7 +191,7 @@ func (hh *HintedHandoff) tryDeliverHint(hint Hint) error {
 		return err
 	}
 
-	url := fmt.Sprintf("http://%s/internal/set", hint.Node)
+	url := internode.URL(hint.Node, "/internal/set")
 	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(jsonData))
 	if err != nil {
 		return err
@@ -128,7 +213,19 @@ func (hh *HintedHandoff) tryDeliverHint(hint Hint) error {
 
 func (hh *HintedHandoff) saveHints() error {
 	filePath := filepath.Join(hh.storageDir, "hints.json")
-	data, err := json.Marshal(hh.hints)
+	hints := hh.hints
+	if hh.cipher != nil {
+		hints = make([]Hint, len(hh.hints))
+		for i, hint := range hh.hints {
+			value, err := hh.cipher.EncryptValue(hint.Key, hint.Value)
+			if err != nil {
+				return err
+			}
+			hint.Value = value
+			hints[i] = hint
+		}
+	}
+	data, err := json.Marshal(hints)
 	if err != nil {
 		return err
 	}
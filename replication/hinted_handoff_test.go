@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -73,3 +75,68 @@ func TestHintedHandoff(t *testing.T) {
 		}
 	})
 }
+
+// prefixCipher stands in for encryption in tests
+type prefixCipher struct{}
+
+func (prefixCipher) EncryptValue(key, value string) (string, error) {
+	return "enc:" + strings.ToUpper(value), nil
+}
+
+func (prefixCipher) DecryptValue(key, value string) (string, error) {
+	return strings.ToLower(strings.TrimPrefix(value, "enc:")), nil
+}
+
+func TestHintedHandoff_EncryptsHintsFile(t *testing.T) {
+	dir := t.TempDir()
+	hh := NewHintedHandoff(dir)
+	hh.StoreHint("key", "before", "node1:8080")
+
+	// Hints written before encryption was enabled are read as they are
+	reopened := NewHintedHandoff(dir)
+	if err := reopened.SetCipher(prefixCipher{}); err != nil {
+		t.Fatal(err)
+	}
+	reopened.StoreHint("key", "after", "node1:8080")
+
+	data, _ := os.ReadFile(filepath.Join(dir, "hints.json"))
+	if !strings.Contains(string(data), "enc:BEFORE") || !strings.Contains(string(data), "enc:AFTER") || strings.Contains(string(data), "after") {
+		t.Errorf("Expected only encrypted values in the hints file, got %s", data)
+	}
+	if reopened.hints[0].Value != "before" || reopened.hints[1].Value != "after" {
+		t.Errorf("Expected plaintext hints in memory, got %+v", reopened.hints)
+	}
+}
+
+func TestHintedHandoff_StatsDeliverDrop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	up := server.URL[7:]
+
+	hh := NewHintedHandoff(t.TempDir())
+	hh.StoreHint("a", "1", up)
+	hh.StoreHint("b", "1", "127.0.0.1:1")
+	hh.StoreHint("c", "1", "127.0.0.1:1")
+	hh.StoreHint("d", "1", "127.0.0.1:2")
+
+	stats := hh.Stats()
+	if len(stats) != 3 || stats[0].Node != "127.0.0.1:1" || stats[0].Hints != 2 || stats[2].Node != up {
+		t.Fatalf("Expected the hints of 3 nodes, got %+v", stats)
+	}
+
+	if delivered, remaining := hh.Deliver(); delivered != 1 || remaining != 3 {
+		t.Errorf("Expected 1 hint delivered and 3 left, got %d and %d", delivered, remaining)
+	}
+	if stats := hh.Stats(); len(stats) != 2 || stats[0].Attempts != 1 {
+		t.Errorf("Expected the undelivered hints to count an attempt, got %+v", stats)
+	}
+
+	if dropped, err := hh.Drop("127.0.0.1:1"); err != nil || dropped != 2 {
+		t.Errorf("Expected 2 hints dropped, got %d %v", dropped, err)
+	}
+	if stats := hh.Stats(); len(stats) != 1 || stats[0].Node != "127.0.0.1:2" {
+		t.Errorf("Expected the hints of one node left, got %+v", stats)
+	}
+}
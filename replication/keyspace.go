@@ -0,0 +1,362 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"distore/config"
+)
+
+// ConsistencyLevel is the number of replicas that must answer a request
+type ConsistencyLevel string
+
+const (
+	ConsistencyOne    ConsistencyLevel = "one"
+	ConsistencyQuorum ConsistencyLevel = "quorum"
+	ConsistencyAll    ConsistencyLevel = "all"
+)
+
+// Required returns the number of acknowledgements needed out of replicas
+func (c ConsistencyLevel) Required(replicas int) int {
+	if replicas <= 0 {
+		return 0
+	}
+	switch c {
+	case ConsistencyOne:
+		return 1
+	case ConsistencyAll:
+		return replicas
+	default:
+		return replicas/2 + 1
+	}
+}
+
+func (c ConsistencyLevel) valid() bool {
+	return c == ConsistencyOne || c == ConsistencyQuorum || c == ConsistencyAll
+}
+
+// DefaultKeyspace is the name reported for keys not matching any keyspace
+const DefaultKeyspace = "default"
+
+var (
+	ErrKeyspaceNotFound = errors.New("keyspace not found")
+	ErrInvalidKeyspace  = errors.New("invalid keyspace")
+)
+
+// Keyspace is a named group of keys (selected by prefix) with its own
+// replication factor, consistency defaults, DC placement and TTL default
+type Keyspace struct {
+	Name              string           `json:"name"`
+	Prefixes          []string         `json:"prefixes"`
+	ReplicationFactor int              `json:"replication_factor"`
+	WriteConsistency  ConsistencyLevel `json:"write_consistency"`
+	ReadConsistency   ConsistencyLevel `json:"read_consistency"`
+	Placement         map[string]int   `json:"placement,omitempty"`
+	DefaultTTL        int              `json:"default_ttl"`
+}
+
+// TTL returns the default expiry of keys in the keyspace, 0 means none
+func (ks Keyspace) TTL() time.Duration {
+	return time.Duration(ks.DefaultTTL) * time.Second
+}
+
+// KeyspaceFromConfig converts a config entry into a keyspace
+func KeyspaceFromConfig(cfg config.KeyspaceConfig) Keyspace {
+	placement := make(map[string]int, len(cfg.Placement))
+	for dc, copies := range cfg.Placement {
+		placement[dc] = copies
+	}
+	return Keyspace{
+		Name:              cfg.Name,
+		Prefixes:          append([]string(nil), cfg.Prefixes...),
+		ReplicationFactor: cfg.ReplicationFactor,
+		WriteConsistency:  ConsistencyLevel(cfg.WriteConsistency),
+		ReadConsistency:   ConsistencyLevel(cfg.ReadConsistency),
+		Placement:         placement,
+		DefaultTTL:        cfg.DefaultTTL,
+	}
+}
+
+// Config converts a keyspace back into its config entry
+func (ks Keyspace) Config() config.KeyspaceConfig {
+	var placement map[string]int
+	if len(ks.Placement) > 0 {
+		placement = make(map[string]int, len(ks.Placement))
+		for dc, copies := range ks.Placement {
+			placement[dc] = copies
+		}
+	}
+	return config.KeyspaceConfig{
+		Name:              ks.Name,
+		Prefixes:          append([]string(nil), ks.Prefixes...),
+		ReplicationFactor: ks.ReplicationFactor,
+		WriteConsistency:  string(ks.WriteConsistency),
+		ReadConsistency:   string(ks.ReadConsistency),
+		Placement:         placement,
+		DefaultTTL:        ks.DefaultTTL,
+	}
+}
+
+// KeyspaceRegistry holds the keyspaces and resolves keys to them
+type KeyspaceRegistry struct {
+	mu          sync.RWMutex
+	keyspaces   map[string]Keyspace
+	dataCenters map[string][]string // data center id -> nodes
+}
+
+func NewKeyspaceRegistry(dataCenters []config.DataCenterConfig) *KeyspaceRegistry {
+	reg := &KeyspaceRegistry{
+		keyspaces:   make(map[string]Keyspace),
+		dataCenters: make(map[string][]string),
+	}
+	for _, dc := range dataCenters {
+		reg.dataCenters[dc.ID] = append([]string(nil), dc.Nodes...)
+	}
+	return reg
+}
+
+// Load adds the keyspaces of the config file
+func (reg *KeyspaceRegistry) Load(keyspaces []config.KeyspaceConfig) error {
+	for _, cfg := range keyspaces {
+		if err := reg.Put(KeyspaceFromConfig(cfg)); err != nil {
+			return fmt.Errorf("keyspace %q: %w", cfg.Name, err)
+		}
+	}
+	return nil
+}
+
+// Replace swaps all keyspaces for the given ones. Nothing changes if any of
+// them is invalid.
+func (reg *KeyspaceRegistry) Replace(keyspaces []config.KeyspaceConfig) error {
+	next := &KeyspaceRegistry{
+		keyspaces:   make(map[string]Keyspace),
+		dataCenters: reg.dataCenters,
+	}
+	if err := next.Load(keyspaces); err != nil {
+		return err
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.keyspaces = next.keyspaces
+	return nil
+}
+
+// Configs returns the keyspaces as config entries ordered by name
+func (reg *KeyspaceRegistry) Configs() []config.KeyspaceConfig {
+	list := reg.List()
+	configs := make([]config.KeyspaceConfig, 0, len(list))
+	for _, ks := range list {
+		configs = append(configs, ks.Config())
+	}
+	return configs
+}
+
+// Put validates and creates or replaces a keyspace
+func (reg *KeyspaceRegistry) Put(ks Keyspace) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	ks, err := reg.normalize(ks)
+	if err != nil {
+		return err
+	}
+	reg.keyspaces[ks.Name] = ks
+	return nil
+}
+
+// normalize fills defaults and validates the keyspace against the others
+func (reg *KeyspaceRegistry) normalize(ks Keyspace) (Keyspace, error) {
+	if ks.Name == "" || ks.Name == DefaultKeyspace {
+		return ks, fmt.Errorf("%w: name is required and %q is reserved", ErrInvalidKeyspace, DefaultKeyspace)
+	}
+	if len(ks.Prefixes) == 0 {
+		return ks, fmt.Errorf("%w: at least one prefix is required", ErrInvalidKeyspace)
+	}
+	for _, prefix := range ks.Prefixes {
+		if prefix == "" {
+			return ks, fmt.Errorf("%w: empty prefix", ErrInvalidKeyspace)
+		}
+		for name, other := range reg.keyspaces {
+			if name == ks.Name {
+				continue
+			}
+			for _, p := range other.Prefixes {
+				if p == prefix {
+					return ks, fmt.Errorf("%w: prefix %q already used by keyspace %q", ErrInvalidKeyspace, prefix, name)
+				}
+			}
+		}
+	}
+
+	if ks.WriteConsistency == "" {
+		ks.WriteConsistency = ConsistencyQuorum
+	}
+	if ks.ReadConsistency == "" {
+		ks.ReadConsistency = ConsistencyQuorum
+	}
+	if !ks.WriteConsistency.valid() || !ks.ReadConsistency.valid() {
+		return ks, fmt.Errorf("%w: consistency must be one, quorum or all", ErrInvalidKeyspace)
+	}
+	if ks.DefaultTTL < 0 {
+		return ks, fmt.Errorf("%w: default_ttl must not be negative", ErrInvalidKeyspace)
+	}
+
+	if len(ks.Placement) > 0 {
+		copies := 0
+		for dc, n := range ks.Placement {
+			nodes, ok := reg.dataCenters[dc]
+			if !ok {
+				return ks, fmt.Errorf("%w: unknown data center %q", ErrInvalidKeyspace, dc)
+			}
+			if n <= 0 || n > len(nodes) {
+				return ks, fmt.Errorf("%w: data center %q has %d nodes, cannot place %d copies", ErrInvalidKeyspace, dc, len(nodes), n)
+			}
+			copies += n
+		}
+		if ks.ReplicationFactor != 0 && ks.ReplicationFactor != copies {
+			return ks, fmt.Errorf("%w: replication_factor %d does not match placement total %d", ErrInvalidKeyspace, ks.ReplicationFactor, copies)
+		}
+		ks.ReplicationFactor = copies
+	}
+	if ks.ReplicationFactor <= 0 {
+		return ks, fmt.Errorf("%w: replication_factor must be positive", ErrInvalidKeyspace)
+	}
+
+	return ks, nil
+}
+
+// Delete removes a keyspace. Its keys fall back to the default replication.
+func (reg *KeyspaceRegistry) Delete(name string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if _, ok := reg.keyspaces[name]; !ok {
+		return false
+	}
+	delete(reg.keyspaces, name)
+	return true
+}
+
+// Get returns a keyspace by name
+func (reg *KeyspaceRegistry) Get(name string) (Keyspace, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	ks, ok := reg.keyspaces[name]
+	return ks, ok
+}
+
+// List returns all keyspaces ordered by name
+func (reg *KeyspaceRegistry) List() []Keyspace {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	list := make([]Keyspace, 0, len(reg.keyspaces))
+	for _, ks := range reg.keyspaces {
+		list = append(list, ks)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Resolve returns the keyspace with the longest prefix matching the key
+func (reg *KeyspaceRegistry) Resolve(key string) (Keyspace, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	var (
+		best    Keyspace
+		bestLen = -1
+	)
+	for _, ks := range reg.keyspaces {
+		for _, prefix := range ks.Prefixes {
+			if len(prefix) > bestLen && strings.HasPrefix(key, prefix) {
+				best, bestLen = ks, len(prefix)
+			}
+		}
+	}
+	return best, bestLen >= 0
+}
+
+// Replicas picks the nodes holding the key. With a placement the copies are
+// taken from each data center, otherwise from all members. Within a set of
+// candidates nodes are ranked by rendezvous hashing, so the choice is stable
+// and only changes for keys of nodes that join or leave.
+func (reg *KeyspaceRegistry) Replicas(ks Keyspace, key string, members []string) []string {
+	if len(ks.Placement) == 0 {
+		return rankNodes(key, members, ks.ReplicationFactor)
+	}
+
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	dcs := make([]string, 0, len(ks.Placement))
+	for dc := range ks.Placement {
+		dcs = append(dcs, dc)
+	}
+	sort.Strings(dcs)
+
+	var replicas []string
+	for _, dc := range dcs {
+		candidates := reg.dataCenters[dc]
+		// Only use DC nodes that are cluster members, unless none of them is
+		if inCluster := intersect(candidates, members); len(inCluster) > 0 {
+			candidates = inCluster
+		}
+		replicas = append(replicas, rankNodes(key, candidates, ks.Placement[dc])...)
+	}
+	return replicas
+}
+
+// rankNodes returns the n nodes with the highest rendezvous score for the key
+func rankNodes(key string, nodes []string, n int) []string {
+	ranked := append([]string(nil), nodes...)
+	scores := make(map[string]uint32, len(ranked))
+	for _, node := range ranked {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(node))
+		scores[node] = h.Sum32()
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if scores[ranked[i]] != scores[ranked[j]] {
+			return scores[ranked[i]] > scores[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+
+	if n < len(ranked) {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+func intersect(a, b []string) []string {
+	set := make(map[string]bool, len(b))
+	for _, n := range b {
+		set[n] = true
+	}
+	var result []string
+	for _, n := range a {
+		if set[n] {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
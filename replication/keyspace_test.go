@@ -0,0 +1,153 @@
+package replication
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"distore/config"
+)
+
+func testDataCenters() []config.DataCenterConfig {
+	return []config.DataCenterConfig{
+		{ID: "eu-west", Nodes: []string{"eu1:8080", "eu2:8080", "eu3:8080"}},
+		{ID: "us-east", Nodes: []string{"us1:8080", "us2:8080"}},
+	}
+}
+
+func TestKeyspaceRegistry_Validation(t *testing.T) {
+	reg := NewKeyspaceRegistry(testDataCenters())
+
+	invalid := []Keyspace{
+		{Name: "", Prefixes: []string{"a:"}, ReplicationFactor: 1},
+		{Name: DefaultKeyspace, Prefixes: []string{"a:"}, ReplicationFactor: 1},
+		{Name: "noprefix", ReplicationFactor: 1},
+		{Name: "norf", Prefixes: []string{"a:"}},
+		{Name: "badcl", Prefixes: []string{"a:"}, ReplicationFactor: 1, WriteConsistency: "most"},
+		{Name: "baddc", Prefixes: []string{"a:"}, Placement: map[string]int{"ap-south": 1}},
+		{Name: "toomany", Prefixes: []string{"a:"}, Placement: map[string]int{"us-east": 3}},
+		{Name: "mismatch", Prefixes: []string{"a:"}, ReplicationFactor: 2, Placement: map[string]int{"eu-west": 2, "us-east": 1}},
+	}
+	for _, ks := range invalid {
+		if err := reg.Put(ks); err == nil {
+			t.Errorf("keyspace %q should be rejected", ks.Name)
+		}
+	}
+
+	if err := reg.Put(Keyspace{Name: "users", Prefixes: []string{"user:"}, Placement: map[string]int{"eu-west": 2, "us-east": 1}}); err != nil {
+		t.Fatalf("valid keyspace rejected: %v", err)
+	}
+	ks, _ := reg.Get("users")
+	if ks.ReplicationFactor != 3 || ks.WriteConsistency != ConsistencyQuorum || ks.ReadConsistency != ConsistencyQuorum {
+		t.Errorf("defaults not applied: %+v", ks)
+	}
+
+	if err := reg.Put(Keyspace{Name: "other", Prefixes: []string{"user:"}, ReplicationFactor: 1}); err == nil {
+		t.Error("prefix shared with another keyspace should be rejected")
+	}
+}
+
+func TestKeyspaceRegistry_ResolveAndPlacement(t *testing.T) {
+	reg := NewKeyspaceRegistry(testDataCenters())
+	err := reg.Load([]config.KeyspaceConfig{
+		{Name: "users", Prefixes: []string{"user:"}, Placement: map[string]int{"eu-west": 2, "us-east": 1}},
+		{Name: "vip", Prefixes: []string{"user:vip:"}, ReplicationFactor: 1, WriteConsistency: "all", DefaultTTL: 60},
+	})
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+
+	if ks, ok := reg.Resolve("user:vip:42"); !ok || ks.Name != "vip" {
+		t.Errorf("longest prefix should win, got %q", ks.Name)
+	}
+	if ks, ok := reg.Resolve("user:42"); !ok || ks.Name != "users" {
+		t.Errorf("expected users keyspace, got %q", ks.Name)
+	}
+	if _, ok := reg.Resolve("session:1"); ok {
+		t.Error("unmatched key should use the default keyspace")
+	}
+
+	ks, _ := reg.Get("users")
+	members := []string{"eu1:8080", "eu2:8080", "eu3:8080", "us1:8080", "us2:8080"}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		replicas := reg.Replicas(ks, key, members)
+		if len(replicas) != 3 {
+			t.Fatalf("expected 3 replicas, got %v", replicas)
+		}
+		perDC := map[byte]int{}
+		for _, r := range replicas {
+			perDC[r[0]]++
+		}
+		if perDC['e'] != 2 || perDC['u'] != 1 {
+			t.Fatalf("placement not respected: %v", replicas)
+		}
+
+		again := reg.Replicas(ks, key, members)
+		for j := range replicas {
+			if replicas[j] != again[j] {
+				t.Fatal("replica choice should be stable")
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		level    ConsistencyLevel
+		replicas int
+		want     int
+	}{
+		{ConsistencyOne, 3, 1}, {ConsistencyQuorum, 3, 2}, {ConsistencyQuorum, 4, 3}, {ConsistencyAll, 3, 3}, {ConsistencyAll, 0, 0},
+	} {
+		if got := c.level.Required(c.replicas); got != c.want {
+			t.Errorf("%s of %d: got %d, want %d", c.level, c.replicas, got, c.want)
+		}
+	}
+}
+
+func TestReplicator_KeyspaceReplication(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string]int)
+	var nodes []string
+	for i := 0; i < 3; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			received[r.Host]++
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer srv.Close()
+		nodes = append(nodes, srv.URL[7:])
+	}
+
+	replicator := NewReplicator(nodes, 3)
+	replicator.hintedHandoff = nil
+	reg := NewKeyspaceRegistry(nil)
+	if err := reg.Put(Keyspace{Name: "cache", Prefixes: []string{"cache:"}, ReplicationFactor: 1, WriteConsistency: ConsistencyAll}); err != nil {
+		t.Fatalf("put error: %v", err)
+	}
+	replicator.SetKeyspaces(reg)
+
+	for i := 0; i < 10; i++ {
+		if err := replicator.ReplicateSet(fmt.Sprintf("cache:%d", i), "v"); err != nil {
+			t.Fatalf("replication error: %v", err)
+		}
+	}
+
+	mu.Lock()
+	total := 0
+	for _, n := range received {
+		total += n
+	}
+	mu.Unlock()
+	if total != 10 {
+		t.Errorf("replication factor 1 should send each write once, got %d requests", total)
+	}
+
+	// An unreachable replica fails a write that requires all copies
+	replicator.UpdateNodes([]string{"127.0.0.1:1"})
+	if err := replicator.ReplicateSet("cache:x", "v"); err == nil {
+		t.Error("expected write consistency error")
+	}
+}
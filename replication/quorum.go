@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"sync"
 	"time"
+
+	"distore/internode"
 )
 
 type QuorumConfig struct {
@@ -82,7 +84,7 @@ func (q *QuorumReplicator) replicateSetToNode(key, value, nodeURL string) error
 		return err
 	}
 
-	url := fmt.Sprintf("http://%s/internal/set", nodeURL)
+	url := internode.URL(nodeURL, "/internal/set")
 	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonData))
 	if err != nil {
 		return err
@@ -7,6 +7,7 @@ import (
 	"fmt"
 
 	"distore/cluster"
+	"distore/internode"
 	"distore/storage"
 	"distore/synchro"
 	"log"
@@ -25,7 +26,14 @@ type Replicator struct {
 	hintedHandoff   *HintedHandoff
 	failoverManager *cluster.FailoverManager
 	readOnlyManager *cluster.ReadOnlyManager
+	stopWatch       func() // stops the read-only manager following node health
 	repairManager   *synchro.RepairManager
+	keyspaces       *KeyspaceRegistry
+	crossDC         *cluster.CrossDCReplicator
+
+	// Configured quorum sizes, 0 means a majority of the nodes
+	writeQuorum int
+	readQuorum  int
 }
 
 type ReplicationRequest struct {
@@ -33,7 +41,26 @@ type ReplicationRequest struct {
 	Value string `json:"value"`
 }
 
+// Default health check timings of the failover manager
+const (
+	DefaultFailoverCheckInterval = 30 * time.Second
+	DefaultFailoverTimeout       = 5 * time.Second
+)
+
 func NewReplicator(nodes []string, replicaCount int) *Replicator {
+	return NewReplicatorWithFailover(nodes, replicaCount, DefaultFailoverCheckInterval, DefaultFailoverTimeout)
+}
+
+// NewReplicatorWithFailover is like NewReplicator but checks node health every
+// checkInterval, giving up on a check after timeout. Zero values fall back to
+// the defaults.
+func NewReplicatorWithFailover(nodes []string, replicaCount int, checkInterval, timeout time.Duration) *Replicator {
+	if checkInterval <= 0 {
+		checkInterval = DefaultFailoverCheckInterval
+	}
+	if timeout <= 0 {
+		timeout = DefaultFailoverTimeout
+	}
 	if replicaCount <= 0 {
 		replicaCount = 1
 	}
@@ -46,15 +73,16 @@ func NewReplicator(nodes []string, replicaCount int) *Replicator {
 		replicaCount: replicaCount,
 		httpClient: &http.Client{
 			Timeout:   2 * time.Second,
-			Transport: &http.Transport{MaxIdleConnsPerHost: 10},
+			Transport: internode.Wrap(&http.Transport{MaxIdleConnsPerHost: 10}),
 		},
 	}
 
 	// Init extended functions only if there are multiple nodes
 	if len(nodes) > 1 {
 		// Инициализируем системы отказоустойчивости
-		replicator.failoverManager = cluster.NewFailoverManager(nodes, 30*time.Second, 5*time.Second)
+		replicator.failoverManager = cluster.NewFailoverManager(nodes, checkInterval, timeout)
 		replicator.readOnlyManager = cluster.NewReadOnlyManager((len(nodes) / 2) + 1)
+		replicator.stopWatch = replicator.readOnlyManager.WatchFailover(replicator.failoverManager)
 		replicator.quorumConfig = &QuorumConfig{
 			WriteQuorum: (len(nodes) / 2) + 1, // N/2 + 1
 			ReadQuorum:  (len(nodes) / 2) + 1,
@@ -68,6 +96,16 @@ func NewReplicator(nodes []string, replicaCount int) *Replicator {
 }
 
 func (r *Replicator) ReplicateSet(key, value string) error {
+	// Keys of a keyspace follow its own replication settings
+	if ks, ok := r.keyspaceFor(key); ok {
+		return r.replicateSetKeyspace(ks, key, value)
+	}
+
+	// Multi-DC clusters write to the local DC quorum and ship to remote DCs
+	if cdc := r.CrossDC(); cdc != nil {
+		return cdc.Replicate(key, value)
+	}
+
 	// Use quorum recording (if configured)
 	if r.quorumConfig != nil {
 		return r.replicateSetWithQuorum(key, value)
@@ -77,6 +115,144 @@ func (r *Replicator) ReplicateSet(key, value string) error {
 	return r.replicateSetLegacy(key, value)
 }
 
+// Stop ends the background work started by the replicator
+func (r *Replicator) Stop() {
+	if r.stopWatch != nil {
+		r.stopWatch()
+	}
+}
+
+// FailoverManager returns the node health tracker, or nil for single-node setups
+func (r *Replicator) FailoverManager() *cluster.FailoverManager {
+	return r.failoverManager
+}
+
+// HintedHandoff returns the hints kept for unreachable nodes, or nil for
+// single-node setups
+func (r *Replicator) HintedHandoff() *HintedHandoff {
+	return r.hintedHandoff
+}
+
+// ReadOnlyManager returns the quorum-driven write guard, or nil for single-node setups
+func (r *Replicator) ReadOnlyManager() *cluster.ReadOnlyManager {
+	return r.readOnlyManager
+}
+
+// GetNodeStatus returns the failure detector view of all nodes, or nil when
+// health tracking is not enabled
+func (r *Replicator) GetNodeStatus() map[string]*cluster.NodeStatus {
+	if r.failoverManager == nil {
+		return nil
+	}
+	return r.failoverManager.GetNodeStatus()
+}
+
+// SetKeyspaces enables per-keyspace replication. Keys outside every keyspace
+// keep using the global replica count.
+func (r *Replicator) SetKeyspaces(keyspaces *KeyspaceRegistry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keyspaces = keyspaces
+}
+
+// Keyspaces returns the keyspace registry, or nil if keyspaces are not enabled
+func (r *Replicator) Keyspaces() *KeyspaceRegistry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keyspaces
+}
+
+// SetHintCipher encrypts the values of the hints kept for unreachable
+// nodes. Single node clusters keep no hints.
+func (r *Replicator) SetHintCipher(cipher storage.ValueCipher) error {
+	if r.hintedHandoff == nil {
+		return nil
+	}
+	return r.hintedHandoff.SetCipher(cipher)
+}
+
+// SetCrossDC routes writes of keys outside every keyspace through the
+// cross-DC pipeline instead of the flat node list
+func (r *Replicator) SetCrossDC(cdc *cluster.CrossDCReplicator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.crossDC = cdc
+}
+
+// CrossDC returns the cross-DC pipeline, or nil if it is not enabled
+func (r *Replicator) CrossDC() *cluster.CrossDCReplicator {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.crossDC
+}
+
+func (r *Replicator) keyspaceFor(key string) (Keyspace, bool) {
+	keyspaces := r.Keyspaces()
+	if keyspaces == nil {
+		return Keyspace{}, false
+	}
+	return keyspaces.Resolve(key)
+}
+
+// ReplicasFor returns the nodes holding a key, primary first. Keys outside a
+// keyspace are held by every node, including self.
+func (r *Replicator) ReplicasFor(key, self string) []string {
+	nodes := r.GetNodes()
+	if ks, ok := r.keyspaceFor(key); ok {
+		return r.Keyspaces().Replicas(ks, key, nodes)
+	}
+	if self != "" && !contains(nodes, self) {
+		nodes = append(nodes, self)
+	}
+	return rankNodes(key, nodes, len(nodes))
+}
+
+// replicateSetKeyspace writes to the keyspace replicas in parallel and waits
+// for as many acknowledgements as the write consistency requires
+func (r *Replicator) replicateSetKeyspace(ks Keyspace, key, value string) error {
+	if r.readOnlyManager != nil && !r.readOnlyManager.CanWrite() {
+		return fmt.Errorf("cluster is in read-only mode")
+	}
+
+	targets := r.Keyspaces().Replicas(ks, key, r.GetNodes())
+	required := ks.WriteConsistency.Required(len(targets))
+	if len(targets) < ks.ReplicationFactor {
+		log.Printf("Keyspace %s: only %d of %d replicas available for key %s", ks.Name, len(targets), ks.ReplicationFactor, key)
+	}
+
+	results := make(chan error, len(targets))
+	for _, node := range targets {
+		go func(nodeURL string) {
+			err := r.replicateSetToNode(key, value, nodeURL)
+			if err != nil {
+				if r.hintedHandoff != nil {
+					if hintErr := r.hintedHandoff.StoreHint(key, value, nodeURL); hintErr != nil {
+						log.Printf("Failed to store hint for %s: %v", nodeURL, hintErr)
+					}
+				}
+			} else if r.consistencyMgr != nil {
+				r.consistencyMgr.RecordWrite(key, nodeURL)
+			}
+			results <- err
+		}(node)
+	}
+
+	successful := 0
+	for range targets {
+		if err := <-results; err == nil {
+			successful++
+		} else {
+			log.Printf("Replication of %s failed: %v", key, err)
+		}
+	}
+
+	if successful < required {
+		return fmt.Errorf("keyspace %s: write consistency %s not reached: %d/%d",
+			ks.Name, ks.WriteConsistency, successful, required)
+	}
+	return nil
+}
+
 func (r *Replicator) SetRepairManager(repairManager *synchro.RepairManager) {
 	r.repairManager = repairManager
 }
@@ -86,8 +262,9 @@ func (r *Replicator) replicateSetWithQuorum(key, value string) error {
 		return fmt.Errorf("cluster is in read-only mode")
 	}
 
+	writeQuorum, _ := r.Quorum()
 	activeNodes := r.failoverManager.GetActiveNodes()
-	if len(activeNodes) < r.quorumConfig.WriteQuorum {
+	if len(activeNodes) < writeQuorum {
 		return fmt.Errorf("insufficient active nodes for write quorum")
 	}
 
@@ -114,14 +291,14 @@ func (r *Replicator) replicateSetWithQuorum(key, value string) error {
 			}
 		}
 
-		if successful >= r.quorumConfig.WriteQuorum {
+		if successful >= writeQuorum {
 			break // quorum reached
 		}
 	}
 
-	if successful < r.quorumConfig.WriteQuorum {
+	if successful < writeQuorum {
 		return fmt.Errorf("write quorum not reached: %d/%d",
-			successful, r.quorumConfig.WriteQuorum)
+			successful, writeQuorum)
 	}
 
 	return nil
@@ -137,7 +314,7 @@ func (r *Replicator) replicateSetToNode(key, value, nodeURL string) error {
 		return err
 	}
 
-	url := fmt.Sprintf("http://%s/internal/set", nodeURL)
+	url := internode.URL(nodeURL, "/internal/set")
 	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonData))
 	if err != nil {
 		return err
@@ -178,11 +355,18 @@ func (r *Replicator) GetWithConsistency(key, clientID string) (string, error) {
 }
 
 func (r *Replicator) readWithQuorum(key string) (string, error) {
-	results := make(chan string, len(r.nodes))
-	errors := make(chan error, len(r.nodes))
+	nodes := r.GetNodes()
+	_, required := r.Quorum()
+	if ks, ok := r.keyspaceFor(key); ok {
+		nodes = r.Keyspaces().Replicas(ks, key, nodes)
+		required = ks.ReadConsistency.Required(len(nodes))
+	}
+
+	results := make(chan string, len(nodes))
+	errors := make(chan error, len(nodes))
 	var wg sync.WaitGroup
 
-	for _, node := range r.nodes {
+	for _, node := range nodes {
 		wg.Add(1)
 		go func(nodeURL string) {
 			defer wg.Done()
@@ -204,7 +388,7 @@ func (r *Replicator) readWithQuorum(key string) (string, error) {
 	valueCounts := make(map[string]int)
 	for value := range results {
 		valueCounts[value]++
-		if valueCounts[value] >= r.quorumConfig.ReadQuorum {
+		if valueCounts[value] >= required {
 			return value, nil
 		}
 	}
@@ -216,7 +400,7 @@ func (r *Replicator) readFromNode(key, nodeURL string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	url := fmt.Sprintf("http://%s/internal/get/%s", nodeURL, key)
+	url := internode.URL(nodeURL, "/internal/get/"+key)
 	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return "", err
@@ -287,6 +471,13 @@ func (r *Replicator) ReplicateDelete(key string) error {
 	replicaCount := r.replicaCount
 	r.mu.RUnlock()
 
+	if ks, ok := r.keyspaceFor(key); ok {
+		nodes = r.Keyspaces().Replicas(ks, key, nodes)
+		replicaCount = len(nodes)
+	} else if cdc := r.CrossDC(); cdc != nil {
+		return cdc.ReplicateDelete(key)
+	}
+
 	if len(nodes) == 0 {
 		return nil // there are no nodes for replication
 	}
@@ -307,7 +498,7 @@ func (r *Replicator) ReplicateDelete(key string) error {
 			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 			defer cancel()
 
-			url := fmt.Sprintf("http://%s/internal/delete/%s", nodeURL, key)
+			url := internode.URL(nodeURL, "/internal/delete/"+key)
 			httpReq, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
 			if err != nil {
 				errors <- fmt.Errorf("failed to create request for %s: %w", nodeURL, err)
@@ -383,9 +574,54 @@ func (r *Replicator) UpdateNodes(newNodes []string) {
 	}
 	if r.readOnlyManager != nil && r.quorumConfig != nil {
 		// Update quorum parameters based on new cluster size
-		r.quorumConfig.TotalNodes = len(r.nodes)
-		r.quorumConfig.WriteQuorum = (len(r.nodes) / 2) + 1
-		r.quorumConfig.ReadQuorum = (len(r.nodes) / 2) + 1
+		r.updateQuorumLocked()
+		if r.failoverManager != nil {
+			r.readOnlyManager.UpdateNodeCount(len(r.failoverManager.GetActiveNodes()))
+		}
+	}
+}
+
+// SetQuorum sets the write and read quorum sizes, 0 meaning a majority of
+// the nodes. Sizes above the node count are capped.
+func (r *Replicator) SetQuorum(write, read int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.writeQuorum = write
+	r.readQuorum = read
+	if r.quorumConfig != nil {
+		r.updateQuorumLocked()
+	}
+}
+
+// Quorum returns the write and read quorum sizes in use
+func (r *Replicator) Quorum() (write, read int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.quorumConfig == nil {
+		majority := len(r.nodes)/2 + 1
+		return majority, majority
+	}
+	return r.quorumConfig.WriteQuorum, r.quorumConfig.ReadQuorum
+}
+
+func (r *Replicator) updateQuorumLocked() {
+	size := func(configured int) int {
+		if configured <= 0 {
+			return len(r.nodes)/2 + 1
+		}
+		if configured > len(r.nodes) {
+			return len(r.nodes)
+		}
+		return configured
+	}
+
+	r.quorumConfig.TotalNodes = len(r.nodes)
+	r.quorumConfig.WriteQuorum = size(r.writeQuorum)
+	r.quorumConfig.ReadQuorum = size(r.readQuorum)
+	if r.readOnlyManager != nil {
+		r.readOnlyManager.SetQuorumSize(r.quorumConfig.WriteQuorum)
 	}
 }
 
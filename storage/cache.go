@@ -185,6 +185,19 @@ func (cs *CacheStorage) evict() {
 	}
 }
 
+// Resize changes the capacity and entry TTL of a running cache, evicting
+// entries beyond the new capacity
+func (cs *CacheStorage) Resize(maxSize int, ttl time.Duration) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.maxSize = maxSize
+	cs.ttl = ttl
+	for len(cs.cache) > cs.maxSize {
+		cs.evict()
+	}
+}
+
 func (cs *CacheStorage) GetCacheStats() CacheStats {
 	cs.mu.RLock()
 	defer cs.mu.RUnlock()
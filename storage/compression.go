@@ -33,6 +33,14 @@ func NewCompressedStorage(base Storage, compType CompressionType, threshold int)
 	}
 }
 
+// SetThreshold changes the minimum size of compressed values. Values
+// already stored keep their encoding.
+func (cs *CompressedStorage) SetThreshold(threshold int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.threshold = threshold
+}
+
 func (cs *CompressedStorage) Set(key, value string) error {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
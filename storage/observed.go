@@ -0,0 +1,28 @@
+package storage
+
+// ObservedStorage reports every key that is written or deleted, so changes
+// can be published to caches outside of the node
+type ObservedStorage struct {
+	Storage
+	onChange func(key string)
+}
+
+func NewObservedStorage(base Storage, onChange func(key string)) *ObservedStorage {
+	return &ObservedStorage{Storage: base, onChange: onChange}
+}
+
+func (s *ObservedStorage) Set(key, value string) error {
+	if err := s.Storage.Set(key, value); err != nil {
+		return err
+	}
+	s.onChange(key)
+	return nil
+}
+
+func (s *ObservedStorage) Delete(key string) error {
+	if err := s.Storage.Delete(key); err != nil {
+		return err
+	}
+	s.onChange(key)
+	return nil
+}
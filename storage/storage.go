@@ -10,6 +10,16 @@ var (
 type KeyValue struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
+	// TTLMillis is the remaining time to live of a key copied to another
+	// node, 0 when the key does not expire
+	TTLMillis int64 `json:"ttl_ms,omitempty"`
+}
+
+// ValueCipher encrypts the values of keys for the files that hold them
+// outside of the storage, like the WAL and the hints
+type ValueCipher interface {
+	EncryptValue(key, value string) (string, error)
+	DecryptValue(key, value string) (string, error)
 }
 
 type Storage interface {
@@ -19,3 +29,42 @@ type Storage interface {
 	GetAll() ([]KeyValue, error)
 	Close() error
 }
+
+// Unwrap returns the storage wrapped by a decorator, or nil for base storages
+func Unwrap(s Storage) Storage {
+	switch st := s.(type) {
+	case *TTLStorage:
+		return st.Storage
+	case *CacheStorage:
+		return st.Storage
+	case *CompressedStorage:
+		return st.Storage
+	case *OptimizedStorage:
+		return st.Storage
+	case *WALStorage:
+		return st.Storage
+	case *AtomicStorage:
+		return st.Storage
+	case *BatchStorage:
+		return st.Storage
+	case *CASStorage:
+		return st.Storage
+	case *ObservedStorage:
+		return st.Storage
+	case interface{ Unwrap() Storage }:
+		return st.Unwrap()
+	default:
+		return nil
+	}
+}
+
+// FindTTLStorage returns the TTL layer of a decorated storage, if any
+func FindTTLStorage(s Storage) *TTLStorage {
+	for s != nil {
+		if ttl, ok := s.(*TTLStorage); ok {
+			return ttl
+		}
+		s = Unwrap(s)
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package storage
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMemoryStorage(t *testing.T) {
@@ -113,3 +115,105 @@ func TestDiskStorage(t *testing.T) {
 		}
 	})
 }
+
+func TestObservedStorage(t *testing.T) {
+	var changed []string
+	store := NewObservedStorage(NewMemoryStorage(), func(key string) {
+		changed = append(changed, key)
+	})
+
+	store.Set("a", "1")
+	store.Get("a")
+	store.Delete("a")
+	if err := store.Delete("missing"); err == nil {
+		t.Fatal("expected error deleting a missing key")
+	}
+
+	if len(changed) != 2 || changed[0] != "a" || changed[1] != "a" {
+		t.Errorf("expected set and delete of a to be observed, got %v", changed)
+	}
+	if Unwrap(store) == nil {
+		t.Error("expected Unwrap to return the observed storage")
+	}
+}
+
+func TestCacheStorage_Resize(t *testing.T) {
+	cache := NewCacheStorage(NewMemoryStorage(), LRU, 10, time.Minute)
+	for i := 0; i < 10; i++ {
+		cache.Set(fmt.Sprintf("k%d", i), "v")
+	}
+
+	cache.Resize(3, time.Minute)
+	if stats := cache.GetCacheStats(); stats.Evictions != 7 {
+		t.Errorf("expected 7 evictions after shrinking, got %d", stats.Evictions)
+	}
+	// Evicted keys are still served from the underlying storage
+	if v, err := cache.Get("k0"); err != nil || v != "v" {
+		t.Errorf("expected k0 from storage, got %q %v", v, err)
+	}
+}
+
+func TestCompressedStorage_SetThreshold(t *testing.T) {
+	base := NewMemoryStorage()
+	store := NewCompressedStorage(base, CompressionGZIP, 1024)
+	value := strings.Repeat("a", 100)
+
+	store.Set("small", value)
+	store.SetThreshold(10)
+	store.Set("large", value)
+
+	if raw, _ := base.Get("small"); raw != value {
+		t.Error("expected value below the old threshold to be stored as is")
+	}
+	if raw, _ := base.Get("large"); raw == value {
+		t.Error("expected value above the new threshold to be compressed")
+	}
+	for _, key := range []string{"small", "large"} {
+		if v, err := store.Get(key); err != nil || v != value {
+			t.Errorf("%s: expected original value, got %q %v", key, v, err)
+		}
+	}
+}
+
+// reverseCipher stands in for encryption in tests
+type reverseCipher struct{}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+func (reverseCipher) EncryptValue(key, value string) (string, error) {
+	return "enc:" + reverse(value), nil
+}
+
+func (reverseCipher) DecryptValue(key, value string) (string, error) {
+	return reverse(strings.TrimPrefix(value, "enc:")), nil
+}
+
+func TestWAL_EncryptsValues(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.SetCipher(reverseCipher{})
+	wal.LogSet("key", "secret")
+
+	data, _ := os.ReadFile(wal.filePath)
+	if strings.Contains(string(data), "secret") || !strings.Contains(string(data), "enc:terces") {
+		t.Errorf("Expected the WAL to hold the encrypted value, got %s", data)
+	}
+
+	store := NewMemoryStorage()
+	if err := wal.Recover(store); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+	if value, _ := store.Get("key"); value != "secret" {
+		t.Errorf("Expected recovery to decrypt the value, got %q", value)
+	}
+}
@@ -10,6 +10,7 @@ type TTLStorage struct {
 	ttlData         map[string]time.Time
 	mu              sync.RWMutex
 	cleanupInterval time.Duration
+	cleanupTicker   *time.Ticker
 }
 
 func NewTTLStorage(base Storage, cleanupInterval time.Duration) *TTLStorage {
@@ -17,6 +18,7 @@ func NewTTLStorage(base Storage, cleanupInterval time.Duration) *TTLStorage {
 		Storage:         base,
 		ttlData:         make(map[string]time.Time),
 		cleanupInterval: cleanupInterval,
+		cleanupTicker:   time.NewTicker(cleanupInterval),
 	}
 
 	go ttlStorage.startCleanupWorker()
@@ -40,6 +42,23 @@ func (s *TTLStorage) SetWithTTL(key, value string, ttl time.Duration) error {
 	return nil
 }
 
+// Expire sets the TTL of an existing key without rewriting its value
+func (s *TTLStorage) Expire(key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.Storage.Get(key); err != nil {
+		return err
+	}
+
+	if ttl > 0 {
+		s.ttlData[key] = time.Now().Add(ttl)
+	} else {
+		delete(s.ttlData, key)
+	}
+	return nil
+}
+
 func (s *TTLStorage) Set(key, value string) error {
 	return s.SetWithTTL(key, value, 0) // no TTL
 }
@@ -69,14 +88,22 @@ func (s *TTLStorage) Delete(key string) error {
 }
 
 func (s *TTLStorage) startCleanupWorker() {
-	ticker := time.NewTicker(s.cleanupInterval)
-	defer ticker.Stop()
-
-	for range ticker.C {
+	for range s.cleanupTicker.C {
 		s.cleanupExpired()
 	}
 }
 
+// SetCleanupInterval changes how often expired keys are purged
+func (s *TTLStorage) SetCleanupInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupInterval = interval
+	s.cleanupTicker.Reset(interval)
+}
+
 func (s *TTLStorage) cleanupExpired() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -106,3 +133,17 @@ func (s *TTLStorage) GetTTL(key string) (time.Duration, error) {
 
 	return remaining, nil
 }
+
+// RemainingTTLMillis returns the remaining time to live of key in s in
+// milliseconds, rounded up, or 0 when the key does not expire
+func RemainingTTLMillis(s Storage, key string) int64 {
+	ttlStorage := FindTTLStorage(s)
+	if ttlStorage == nil {
+		return 0
+	}
+	ttl, err := ttlStorage.GetTTL(key)
+	if err != nil {
+		return 0
+	}
+	return int64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
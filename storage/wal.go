@@ -23,6 +23,7 @@ type WriteAheadLog struct {
 	sequence  uint64
 	mu        sync.Mutex
 	batchSize int
+	cipher    ValueCipher // encrypts the values of entries, nil keeps them plain
 }
 
 func NewWriteAheadLog(dataDir string, batchSize int) (*WriteAheadLog, error) {
@@ -49,10 +50,26 @@ func NewWriteAheadLog(dataDir string, batchSize int) (*WriteAheadLog, error) {
 	}, nil
 }
 
+// SetCipher makes the log encrypt the values of the entries written from
+// now on, and decrypt them on recovery
+func (wal *WriteAheadLog) SetCipher(cipher ValueCipher) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	wal.cipher = cipher
+}
+
 func (wal *WriteAheadLog) LogSet(key, value string) error {
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
+	if wal.cipher != nil {
+		encrypted, err := wal.cipher.EncryptValue(key, value)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt WAL entry: %w", err)
+		}
+		value = encrypted
+	}
+
 	entry := WALEntry{
 		Operation: "SET",
 		Key:       key,
@@ -121,6 +138,11 @@ func (wal *WriteAheadLog) Recover(storage Storage) error {
 
 		switch entry.Operation {
 		case "SET":
+			if wal.cipher != nil {
+				if entry.Value, err = wal.cipher.DecryptValue(entry.Key, entry.Value); err != nil {
+					return fmt.Errorf("failed to decrypt WAL entry %d: %w", entry.Sequence, err)
+				}
+			}
 			storage.Set(entry.Key, entry.Value)
 		case "DELETE":
 			storage.Delete(entry.Key)
@@ -154,6 +176,11 @@ func NewWALStorage(base Storage, dataDir string) (*WALStorage, error) {
 	}, nil
 }
 
+// SetCipher encrypts the values the WAL holds
+func (ws *WALStorage) SetCipher(cipher ValueCipher) {
+	ws.wal.SetCipher(cipher)
+}
+
 func (ws *WALStorage) Set(key, value string) error {
 	// Firstly, write into WAL
 	if err := ws.wal.LogSet(key, value); err != nil {
@@ -1,6 +1,9 @@
 package testutils
 
+import "sync"
+
 type MockReplicator struct {
+	mu           sync.Mutex
 	Nodes        []string
 	ReplicaCount int
 	SetCalls     int
@@ -12,12 +15,41 @@ func NewMockReplicator(nodes []string, replicaCount int) *MockReplicator {
 	return &MockReplicator{Nodes: append([]string{}, nodes...), ReplicaCount: replicaCount}
 }
 
-func (m *MockReplicator) ReplicateSet(key, value string) error { m.SetCalls++; return nil }
-func (m *MockReplicator) ReplicateDelete(key string) error     { m.DeleteCalls++; return nil }
+func (m *MockReplicator) ReplicateSet(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.SetCalls++
+	return nil
+}
+
+func (m *MockReplicator) ReplicateDelete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.DeleteCalls++
+	return nil
+}
+
 func (m *MockReplicator) UpdateNodes(newNodes []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.Nodes = append([]string{}, newNodes...)
 	m.UpdateCalls++
 }
-func (m *MockReplicator) GetNodes() []string        { return append([]string{}, m.Nodes...) }
-func (m *MockReplicator) GetReplicaCount() int      { return m.ReplicaCount }
-func (m *MockReplicator) SetReplicaCount(count int) { m.ReplicaCount = count }
+
+func (m *MockReplicator) GetNodes() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.Nodes...)
+}
+
+func (m *MockReplicator) GetReplicaCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ReplicaCount
+}
+
+func (m *MockReplicator) SetReplicaCount(count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ReplicaCount = count
+}